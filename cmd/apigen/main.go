@@ -0,0 +1,279 @@
+// cmd/apigen/main.go
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"go/format"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/ryk-9/go-chat/pkg/chat"
+)
+
+// The parts of an OpenAPI document the generator understands
+type spec struct {
+	Paths      map[string]map[string]operation `json:"paths"`
+	Components struct {
+		Schemas map[string]schema `json:"schemas"`
+	} `json:"components"`
+}
+
+type operation struct {
+	OperationID string  `json:"operationId"`
+	Summary     string  `json:"summary"`
+	Parameters  []param `json:"parameters"`
+	RequestBody *struct {
+		Content map[string]struct {
+			Schema schema `json:"schema"`
+		} `json:"content"`
+	} `json:"requestBody"`
+	Responses map[string]struct {
+		Content map[string]struct {
+			Schema schema `json:"schema"`
+		} `json:"content"`
+	} `json:"responses"`
+
+	method, path string
+}
+
+type param struct {
+	Name        string `json:"name"`
+	In          string `json:"in"`
+	Description string `json:"description"`
+	Required    bool   `json:"required"`
+	Schema      schema `json:"schema"`
+}
+
+type schema struct {
+	Ref                  string            `json:"$ref"`
+	Type                 string            `json:"type"`
+	Format               string            `json:"format"`
+	Items                *schema           `json:"items"`
+	AdditionalProperties *schema           `json:"additionalProperties"`
+	Properties           map[string]schema `json:"properties"`
+	Required             []string          `json:"required"`
+}
+
+// initialisms are written in capitals in Go names
+var initialisms = map[string]bool{"id": true, "ip": true, "url": true, "api": true}
+
+func main() {
+	out := flag.String("out", "pkg/chatapi", "Directory to write openapi.json and the client code to")
+	flag.Parse()
+	log.SetFlags(0)
+
+	document := chat.OpenAPI()
+	var s spec
+	if err := json.Unmarshal(document, &s); err != nil {
+		log.Fatalf("parse OpenAPI document: %v", err)
+	}
+	code, err := format.Source(generate(s))
+	if err != nil {
+		log.Fatalf("format client: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(*out, "openapi.json"), document, 0o644); err != nil {
+		log.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(*out, "client_gen.go"), code, 0o644); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// generate writes the client's types and methods
+func generate(s spec) []byte {
+	var b bytes.Buffer
+
+	names := make([]string, 0, len(s.Components.Schemas))
+	for name := range s.Components.Schemas {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		schema := s.Components.Schemas[name]
+		fmt.Fprintf(&b, "\n// %s is the %s schema of the OpenAPI document\ntype %s struct {\n", name, name, name)
+		properties := make([]string, 0, len(schema.Properties))
+		for property := range schema.Properties {
+			properties = append(properties, property)
+		}
+		sort.Strings(properties)
+		for _, property := range properties {
+			field := schema.Properties[property]
+			tag := property
+			if !slices.Contains(schema.Required, property) {
+				tag += ",omitempty"
+				if field.Format == "date-time" {
+					tag = property + ",omitzero"
+				}
+			}
+			fmt.Fprintf(&b, "\t%s %s `json:%q`\n", goName(property), goType(field), tag)
+		}
+		b.WriteString("}\n")
+	}
+
+	var operations []operation
+	for path, methods := range s.Paths {
+		for method, op := range methods {
+			op.method, op.path = strings.ToUpper(method), path
+			operations = append(operations, op)
+		}
+	}
+	sort.Slice(operations, func(i, j int) bool { return operations[i].OperationID < operations[j].OperationID })
+	for _, op := range operations {
+		generateOperation(&b, op)
+	}
+
+	var out bytes.Buffer
+	out.WriteString("// Code generated by go run ./cmd/apigen from openapi.json. DO NOT EDIT.\n\n")
+	out.WriteString("package chatapi\n\nimport (\n")
+	for _, pkg := range []string{"context", "net/http", "net/url", "strconv", "time"} {
+		if bytes.Contains(b.Bytes(), []byte(filepath.Base(pkg)+".")) {
+			fmt.Fprintf(&out, "\t%q\n", pkg)
+		}
+	}
+	out.WriteString(")\n")
+	out.Write(b.Bytes())
+	return out.Bytes()
+}
+
+// generateOperation writes a method calling op, and the struct of its
+// query parameters if it has any
+func generateOperation(b *bytes.Buffer, op operation) {
+	name := goName(op.OperationID)
+	args := []string{"ctx context.Context"}
+	pathExpr := fmt.Sprintf("%q", op.path)
+	var queryParams []param
+	for _, p := range op.Parameters {
+		switch p.In {
+		case "path":
+			args = append(args, p.Name+" string")
+			pathExpr = strings.Replace(pathExpr, "{"+p.Name+"}", `"+url.PathEscape(`+p.Name+`)+"`, 1)
+		case "query":
+			queryParams = append(queryParams, p)
+		}
+	}
+	pathExpr = strings.TrimSuffix(strings.ReplaceAll(pathExpr, `+""`, ""), `+""`)
+
+	if queryParams != nil {
+		fmt.Fprintf(b, "\n// %sParams are the query parameters of %s\ntype %sParams struct {\n", name, name, name)
+		for _, p := range queryParams {
+			description := p.Description
+			if p.Required {
+				description += " (required)"
+			}
+			fmt.Fprintf(b, "\t// %s\n\t%s %s\n", description, goName(p.Name), goType(p.Schema))
+		}
+		b.WriteString("}\n")
+		args = append(args, "params "+name+"Params")
+	}
+	body := "nil"
+	if op.RequestBody != nil {
+		args = append(args, "body "+goType(op.RequestBody.Content["application/json"].Schema))
+		body = "body"
+	}
+
+	result, raw := "", false
+	if response, ok := op.Responses["200"]; ok {
+		if media, ok := response.Content["application/json"]; ok && len(response.Content) == 1 {
+			result = goType(media.Schema)
+		} else {
+			result, raw = "[]byte", true
+		}
+	}
+
+	b.WriteString("\n" + comment(fmt.Sprintf("%s calls %s %s: %s", name, op.method, op.path, op.Summary)))
+	returns := "error"
+	if result != "" {
+		returns = "(" + result + ", error)"
+	}
+	fmt.Fprintf(b, "func (c *Client) %s(%s) %s {\n", name, strings.Join(args, ", "), returns)
+	query := "nil"
+	if queryParams != nil {
+		query = "query"
+		b.WriteString("\tquery := url.Values{}\n")
+	}
+	for _, p := range queryParams {
+		field := "params." + goName(p.Name)
+		switch goType(p.Schema) {
+		case "string":
+			fmt.Fprintf(b, "\tif %s != \"\" {\n\t\tquery.Set(%q, %s)\n\t}\n", field, p.Name, field)
+		case "int":
+			fmt.Fprintf(b, "\tif %s != 0 {\n\t\tquery.Set(%q, strconv.Itoa(%s))\n\t}\n", field, p.Name, field)
+		case "int64":
+			fmt.Fprintf(b, "\tif %s != 0 {\n\t\tquery.Set(%q, strconv.FormatInt(%s, 10))\n\t}\n", field, p.Name, field)
+		default:
+			log.Fatalf("%s: unsupported parameter type %s", op.OperationID, goType(p.Schema))
+		}
+	}
+	method := "http.Method" + strings.ToUpper(op.method[:1]) + strings.ToLower(op.method[1:])
+	switch {
+	case raw:
+		fmt.Fprintf(b, "\treturn c.raw(ctx, %s, %s, %s)\n", method, pathExpr, query)
+	case result != "":
+		fmt.Fprintf(b, "\tvar result %s\n\terr := c.do(ctx, %s, %s, %s, %s, &result)\n\treturn result, err\n", result, method, pathExpr, query, body)
+	default:
+		fmt.Fprintf(b, "\treturn c.do(ctx, %s, %s, %s, %s, nil)\n", method, pathExpr, query, body)
+	}
+	b.WriteString("}\n")
+}
+
+// comment wraps text into a doc comment of lines up to 76 characters
+func comment(text string) string {
+	var b strings.Builder
+	line := "//"
+	for _, word := range strings.Fields(text) {
+		if len(line)+1+len(word) > 76 && line != "//" {
+			b.WriteString(line + "\n")
+			line = "//"
+		}
+		line += " " + word
+	}
+	b.WriteString(line + "\n")
+	return b.String()
+}
+
+// goType returns the Go type of a schema
+func goType(s schema) string {
+	switch {
+	case s.Ref != "":
+		return s.Ref[strings.LastIndex(s.Ref, "/")+1:]
+	case s.Type == "array":
+		return "[]" + goType(*s.Items)
+	case s.Type == "object" && s.AdditionalProperties != nil:
+		return "map[string]" + goType(*s.AdditionalProperties)
+	case s.Type == "string" && s.Format == "date-time":
+		return "time.Time"
+	case s.Type == "string":
+		return "string"
+	case s.Type == "boolean":
+		return "bool"
+	case s.Type == "integer" && s.Format == "int64":
+		return "int64"
+	case s.Type == "integer":
+		return "int"
+	case s.Type == "number":
+		return "float64"
+	}
+	log.Fatalf("unsupported schema %+v", s)
+	return ""
+}
+
+// goName turns a JSON or operation name, in snake or camel case, into an
+// exported Go name
+func goName(name string) string {
+	var b strings.Builder
+	for _, word := range strings.Split(name, "_") {
+		if initialisms[word] {
+			b.WriteString(strings.ToUpper(word))
+		} else if word != "" {
+			b.WriteString(strings.ToUpper(word[:1]) + word[1:])
+		}
+	}
+	return b.String()
+}
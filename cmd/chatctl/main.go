@@ -0,0 +1,410 @@
+// cmd/chatctl/main.go
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const usage = `Usage: chatctl [flags] <command> [args]
+
+Commands:
+  users                                   List connected users
+  kick <username> [reason]                Disconnect a user and tell everyone
+  disconnect <username> [reason]          Quietly close a user's connection
+  announce <text>                         Send a notice to everyone on the server
+  send [-user <name> | -room <room>] <text>
+                                          Send a server message to a user, a room or everyone
+  stats                                   Show server statistics
+  bans                                    List active bans
+  ban [-ip <addr>] [-for <duration>] <username> [reason]
+                                          Ban a user (or just an IP with an empty username)
+  unban [-ip <addr>] [<username>]         Lift bans on a user or IP
+  audit [-limit <n>]                      Show recent security audit events
+  erase [-anonymize] <username>           Delete (or anonymize) all stored data for a user
+
+Flags:
+`
+
+func main() {
+	// Parse command-line flags
+	serverURL := flag.String("server", "http://localhost:8080", "Base URL of the chat server")
+	token := flag.String("token", os.Getenv("CHAT_ADMIN_TOKEN"), "Admin API token (default $CHAT_ADMIN_TOKEN)")
+	jsonOutput := flag.Bool("json", false, "Print the server's JSON responses instead of tables")
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	api := &adminClient{baseURL: strings.TrimRight(*serverURL, "/"), token: *token, json: *jsonOutput}
+
+	var err error
+	switch cmd, args := flag.Arg(0), flag.Args()[1:]; cmd {
+	case "users":
+		err = runUsers(api)
+	case "kick":
+		err = runKick(api, args)
+	case "disconnect":
+		err = runDisconnect(api, args)
+	case "announce":
+		err = runAnnounce(api, args)
+	case "send":
+		err = runSend(api, args)
+	case "stats":
+		err = runStats(api)
+	case "bans":
+		err = runBans(api)
+	case "ban":
+		err = runBan(api, args)
+	case "unban":
+		err = runUnban(api, args)
+	case "audit":
+		err = runAudit(api, args)
+	case "erase":
+		err = runErase(api, args)
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command: %s\n\n", cmd)
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// runUsers lists the connected clients
+func runUsers(api *adminClient) error {
+	var clients []struct {
+		Username  string    `json:"username"`
+		Role      string    `json:"role"`
+		Room      string    `json:"room"`
+		IP        string    `json:"ip"`
+		UserAgent string    `json:"user_agent"`
+		JoinedAt  time.Time `json:"joined_at"`
+	}
+	if err := api.do(http.MethodGet, "/admin/clients", &clients); err != nil || api.json {
+		return err
+	}
+
+	if len(clients) == 0 {
+		fmt.Println("No users connected")
+		return nil
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "USER\tROLE\tROOM\tIP\tCONNECTED\tUSER AGENT")
+	for _, c := range clients {
+		fmt.Fprintf(tw, "%s\t%s\t#%s\t%s\t%s\t%s\n", c.Username, c.Role, c.Room, c.IP,
+			time.Since(c.JoinedAt).Round(time.Second), c.UserAgent)
+	}
+	return tw.Flush()
+}
+
+// runKick disconnects a user
+func runKick(api *adminClient, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: chatctl kick <username> [reason]")
+	}
+	query := url.Values{"user": {args[0]}, "reason": {strings.Join(args[1:], " ")}}
+	if err := api.do(http.MethodDelete, "/admin/clients?"+query.Encode(), nil); err != nil {
+		return err
+	}
+	fmt.Printf("Kicked %s\n", args[0])
+	return nil
+}
+
+// runDisconnect quietly closes a user's connection
+func runDisconnect(api *adminClient, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: chatctl disconnect <username> [reason]")
+	}
+	query := url.Values{"user": {args[0]}, "reason": {strings.Join(args[1:], " ")}}
+	if err := api.do(http.MethodPost, "/admin/disconnect?"+query.Encode(), nil); err != nil {
+		return err
+	}
+	fmt.Printf("Disconnected %s\n", args[0])
+	return nil
+}
+
+// runAnnounce sends a server-wide notice
+func runAnnounce(api *adminClient, args []string) error {
+	text := strings.Join(args, " ")
+	if strings.TrimSpace(text) == "" {
+		return fmt.Errorf("usage: chatctl announce <text>")
+	}
+	if err := api.do(http.MethodPost, "/admin/announce?"+url.Values{"text": {text}}.Encode(), nil); err != nil {
+		return err
+	}
+	fmt.Println("Announcement sent")
+	return nil
+}
+
+// runSend sends a server message to a user, a room, or everyone
+func runSend(api *adminClient, args []string) error {
+	fs := flag.NewFlagSet("send", flag.ExitOnError)
+	user := fs.String("user", "", "Send only to this user")
+	room := fs.String("room", "", "Send only to this room")
+	fs.Parse(args)
+	text := strings.Join(fs.Args(), " ")
+	if strings.TrimSpace(text) == "" || (*user != "" && *room != "") {
+		return fmt.Errorf("usage: chatctl send [-user <name> | -room <room>] <text>")
+	}
+
+	query := url.Values{"text": {text}}
+	if *user != "" {
+		query.Set("user", *user)
+	}
+	if *room != "" {
+		query.Set("room", *room)
+	}
+	if err := api.do(http.MethodPost, "/admin/messages?"+query.Encode(), nil); err != nil {
+		return err
+	}
+	fmt.Println("Message sent")
+	return nil
+}
+
+// runStats shows the server statistics
+func runStats(api *adminClient) error {
+	var stats struct {
+		StartedAt     time.Time `json:"started_at"`
+		UptimeSeconds int64     `json:"uptime_seconds"`
+		Clients       int       `json:"clients"`
+		Guests        int       `json:"guests"`
+		MaxClients    int       `json:"max_clients"`
+		PeakClients   int       `json:"peak_clients"`
+		PeakClientsAt time.Time `json:"peak_clients_at"`
+		Rooms         int       `json:"rooms"`
+		RoomMembers   []struct {
+			Name    string `json:"name"`
+			Members int    `json:"members"`
+		} `json:"room_members"`
+		Connections       int64   `json:"connections"`
+		Messages          int64   `json:"messages"`
+		MessagesPerSecond float64 `json:"messages_per_second"`
+		Bans              int     `json:"bans"`
+		Shadowbans        int     `json:"shadowbans"`
+	}
+	if err := api.do(http.MethodGet, "/admin/stats", &stats); err != nil || api.json {
+		return err
+	}
+
+	clients := fmt.Sprint(stats.Clients)
+	if stats.MaxClients > 0 {
+		clients += fmt.Sprintf(" of %d", stats.MaxClients)
+	}
+	fmt.Printf("Started:     %s (up %s)\n", stats.StartedAt.Local().Format(time.DateTime),
+		time.Duration(stats.UptimeSeconds)*time.Second)
+	fmt.Printf("Clients:     %s (%d guests)\n", clients, stats.Guests)
+	if stats.PeakClients > 0 {
+		fmt.Printf("Peak:        %d at %s\n", stats.PeakClients, stats.PeakClientsAt.Local().Format(time.DateTime))
+	}
+	rooms := make([]string, len(stats.RoomMembers))
+	for i, room := range stats.RoomMembers {
+		rooms[i] = fmt.Sprintf("#%s (%d)", room.Name, room.Members)
+	}
+	fmt.Printf("Rooms:       %d %s\n", stats.Rooms, strings.Join(rooms, ", "))
+	fmt.Printf("Connections: %d since start\n", stats.Connections)
+	fmt.Printf("Messages:    %d since start (%.2f/s over the last minute)\n", stats.Messages, stats.MessagesPerSecond)
+	fmt.Printf("Bans:        %d active, %d shadowbans\n", stats.Bans, stats.Shadowbans)
+	return nil
+}
+
+// ban mirrors the server's ban records
+type ban struct {
+	Username  string    `json:"username"`
+	IP        string    `json:"ip"`
+	Reason    string    `json:"reason"`
+	By        string    `json:"by"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// runBans lists the active bans
+func runBans(api *adminClient) error {
+	var bans []ban
+	if err := api.do(http.MethodGet, "/admin/bans", &bans); err != nil || api.json {
+		return err
+	}
+
+	if len(bans) == 0 {
+		fmt.Println("No active bans")
+		return nil
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "USER\tIP\tBY\tEXPIRES\tREASON")
+	for _, b := range bans {
+		expires := "never"
+		if !b.ExpiresAt.IsZero() {
+			expires = b.ExpiresAt.Local().Format(time.DateTime)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", b.Username, b.IP, b.By, expires, b.Reason)
+	}
+	return tw.Flush()
+}
+
+// runBan bans a user and/or IP
+func runBan(api *adminClient, args []string) error {
+	fs := flag.NewFlagSet("ban", flag.ExitOnError)
+	ip := fs.String("ip", "", "Also ban this IP address")
+	duration := fs.String("for", "", "How long the ban lasts, e.g. 24h or 7d (default: permanent)")
+	fs.Parse(args)
+	if fs.NArg() == 0 && *ip == "" {
+		return fmt.Errorf("usage: chatctl ban [-ip <addr>] [-for <duration>] <username> [reason]")
+	}
+
+	query := url.Values{"ip": {*ip}, "duration": {*duration}}
+	if fs.NArg() > 0 {
+		query.Set("user", fs.Arg(0))
+		query.Set("reason", strings.Join(fs.Args()[1:], " "))
+	}
+	var result ban
+	if err := api.do(http.MethodPost, "/admin/bans?"+query.Encode(), &result); err != nil || api.json {
+		return err
+	}
+
+	subject := strings.TrimSpace(result.Username + " " + result.IP)
+	if result.ExpiresAt.IsZero() {
+		fmt.Printf("Banned %s permanently\n", subject)
+	} else {
+		fmt.Printf("Banned %s until %s\n", subject, result.ExpiresAt.Local().Format(time.DateTime))
+	}
+	return nil
+}
+
+// runUnban lifts bans on a user and/or IP
+func runUnban(api *adminClient, args []string) error {
+	fs := flag.NewFlagSet("unban", flag.ExitOnError)
+	ip := fs.String("ip", "", "Lift bans on this IP address")
+	fs.Parse(args)
+	if fs.NArg() == 0 && *ip == "" {
+		return fmt.Errorf("usage: chatctl unban [-ip <addr>] [<username>]")
+	}
+
+	query := url.Values{"ip": {*ip}, "user": {fs.Arg(0)}}
+	var result struct {
+		Removed int `json:"removed"`
+	}
+	if err := api.do(http.MethodDelete, "/admin/bans?"+query.Encode(), &result); err != nil || api.json {
+		return err
+	}
+	fmt.Printf("Lifted %d bans\n", result.Removed)
+	return nil
+}
+
+// runAudit shows recent audit events
+func runAudit(api *adminClient, args []string) error {
+	fs := flag.NewFlagSet("audit", flag.ExitOnError)
+	limit := fs.Int("limit", 50, "Number of events to show")
+	fs.Parse(args)
+
+	var events []struct {
+		Time   time.Time `json:"time"`
+		Event  string    `json:"event"`
+		Actor  string    `json:"actor"`
+		Target string    `json:"target"`
+		IP     string    `json:"ip"`
+		Detail string    `json:"detail"`
+	}
+	if err := api.do(http.MethodGet, fmt.Sprintf("/admin/audit?limit=%d", *limit), &events); err != nil || api.json {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "TIME\tEVENT\tACTOR\tTARGET\tIP\tDETAIL")
+	for _, e := range events {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", e.Time.Local().Format(time.DateTime),
+			e.Event, e.Actor, e.Target, e.IP, e.Detail)
+	}
+	return tw.Flush()
+}
+
+// runErase asks the server to erase a user's stored data
+func runErase(api *adminClient, args []string) error {
+	fs := flag.NewFlagSet("erase", flag.ExitOnError)
+	anonymize := fs.Bool("anonymize", false, "Keep messages but remove the author instead of deleting them")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: chatctl erase [-anonymize] <username>")
+	}
+
+	mode := "delete"
+	if *anonymize {
+		mode = "anonymize"
+	}
+	query := url.Values{"user": {fs.Arg(0)}, "mode": {mode}}
+
+	var result struct {
+		User     string `json:"user"`
+		Mode     string `json:"mode"`
+		Messages int    `json:"messages"`
+		Account  bool   `json:"account"`
+	}
+	if err := api.do(http.MethodPost, "/admin/erase?"+query.Encode(), &result); err != nil || api.json {
+		return err
+	}
+
+	fmt.Printf("Erased data for %s (%s): %d messages affected\n", result.User, result.Mode, result.Messages)
+	if result.Account {
+		fmt.Println("Account deleted")
+	}
+	return nil
+}
+
+// adminClient sends authenticated requests to the server's admin API
+type adminClient struct {
+	baseURL string
+	token   string
+
+	// json prints responses as they come instead of decoding them
+	json bool
+}
+
+// do performs a request and decodes the JSON response into out, or prints
+// it if the client is in JSON mode
+func (c *adminClient) do(method, path string, out interface{}) error {
+	if c.token == "" {
+		return fmt.Errorf("no admin token given (use -token or $CHAT_ADMIN_TOKEN)")
+	}
+
+	req, err := http.NewRequest(method, c.baseURL+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("server returned %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	if out == nil || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	if c.json {
+		_, err := io.Copy(os.Stdout, resp.Body)
+		return err
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -3,18 +3,33 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"unicode/utf8"
 
 	"github.com/ryk-9/go-chat/pkg/chat"
 )
 
 func main() {
 	// Parse command-line flags
-	serverAddr := flag.String("server", "", "Server address (host:port)")
+	serverAddr := flag.String("server", "", "Server address (host:port) or URL (e.g. wss://chat.example.com/ws)")
 	username := flag.String("user", "", "Your username")
+	token := flag.String("token", os.Getenv("CHAT_TOKEN"), "Authentication token, if the server requires one (default $CHAT_TOKEN)")
+	password := flag.String("password", os.Getenv("CHAT_PASSWORD"), "Password, if the server requires one (default $CHAT_PASSWORD)")
+	caFile := flag.String("ca", "", "PEM file of certificate authorities to trust for wss:// servers")
+	insecure := flag.Bool("insecure", false, "Skip server certificate verification (testing only)")
+	certFile := flag.String("cert", "", "Client certificate file, for servers using certificate authentication")
+	keyFile := flag.String("key", "", "Client certificate private key file")
+	encrypt := flag.Bool("e2e", false, "End-to-end encrypt whispers (the recipient must use -e2e too)")
+	compress := flag.Bool("compress", false, "Compress messages if the server supports it")
+	compressLevel := flag.Int("compress-level", chat.DefaultCompressionLevel, "Compression level, from 1 (fastest) to 9 (smallest)")
+	compressThreshold := flag.Int("compress-threshold", chat.DefaultCompressionThreshold, "Send messages shorter than this many bytes uncompressed")
+	webTransport := flag.Bool("webtransport", false, "Try WebTransport over HTTP/3 first for wss:// servers, falling back to WebSocket (experimental)")
 	flag.Parse()
 
 	// Check if server address was provided via flags or positional args
@@ -48,7 +63,7 @@ func main() {
 		*username = strings.TrimSpace(input)
 
 		// Keep prompting until we get a valid username
-		for *username == "" || len(*username) < 2 || len(*username) > 20 ||
+		for *username == "" || utf8.RuneCountInString(*username) < 2 || utf8.RuneCountInString(*username) > 20 ||
 			strings.ContainsAny(*username, " \t\n/\\:") {
 			fmt.Println("Username must be 2-20 characters without spaces or special chars (/, \\, :)")
 			fmt.Print("Enter your username: ")
@@ -57,9 +72,23 @@ func main() {
 		}
 	}
 
-	// Run the client
+	// Run the client until it is disconnected or interrupted
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 	fmt.Printf("Connecting as %s to %s...\n", *username, *serverAddr)
-	err := chat.RunClient(*serverAddr, *username)
+	err := chat.RunClientWithOptions(ctx, *serverAddr, *username, chat.ClientOptions{
+		Token:                *token,
+		Password:             *password,
+		CAFile:               *caFile,
+		InsecureSkipVerify:   *insecure,
+		CertFile:             *certFile,
+		KeyFile:              *keyFile,
+		Encrypt:              *encrypt,
+		Compression:          *compress,
+		CompressionLevel:     *compressLevel,
+		CompressionThreshold: *compressThreshold,
+		WebTransport:         *webTransport,
+	})
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		os.Exit(1)
@@ -0,0 +1,54 @@
+// cmd/examplebot/main.go
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/ryk-9/go-chat/pkg/bot"
+	"github.com/ryk-9/go-chat/pkg/chat"
+)
+
+func main() {
+	serverAddr := flag.String("server", "localhost:8080", "Server address (host:port) or URL (e.g. wss://chat.example.com/ws)")
+	username := flag.String("user", "echobot", "The bot's username")
+	token := flag.String("token", os.Getenv("CHAT_TOKEN"), "Authentication token, if the server requires one (default $CHAT_TOKEN)")
+	password := flag.String("password", os.Getenv("CHAT_PASSWORD"), "Password, if the server requires one (default $CHAT_PASSWORD)")
+	room := flag.String("room", chat.DefaultRoom, "Room to join")
+	prefix := flag.String("prefix", bot.DefaultPrefix, "Prefix of the bot's commands")
+	flag.Parse()
+
+	b := bot.New(*serverAddr, *username, bot.Options{
+		Client: chat.ClientOptions{Token: *token, Password: *password},
+		Room:   *room,
+		Prefix: *prefix,
+	})
+	b.Command("echo", "Repeat what you say", func(ctx context.Context, msg *bot.Message) {
+		if msg.Args == "" {
+			msg.Reply("Usage: " + *prefix + "echo <text>")
+			return
+		}
+		msg.Reply(msg.Args)
+	})
+	b.Command("whoami", "Say who you are", func(ctx context.Context, msg *bot.Message) {
+		msg.Reply("You are " + msg.From + ".")
+	})
+	// Whispers that aren't commands are echoed back
+	b.OnMessage(func(ctx context.Context, msg *bot.Message) {
+		if msg.Private {
+			msg.Reply("you said: " + msg.Text)
+		}
+	})
+
+	// Run the bot until interrupted
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := b.Run(ctx); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
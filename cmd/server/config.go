@@ -0,0 +1,99 @@
+// cmd/server/config.go
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// loadConfigFile applies a YAML config file to the flags that weren't set
+// on the command line (explicit). Each key is a flag name; nested mappings
+// join their keys with '-' (so tls: {cert: ...} sets -tls-cert) and lists
+// become comma-separated values. Other flags go back to their defaults, so
+// settings removed from the file are undone when it is reloaded.
+func loadConfigFile(path string, flags *flag.FlagSet, explicit map[string]bool) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var tree map[string]any
+	if err := yaml.Unmarshal(data, &tree); err != nil {
+		return fmt.Errorf("parse %s: %w", path, err)
+	}
+
+	values := make(map[string]string)
+	if err := flattenConfig("", tree, values); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	// Only touch the flags once the whole file is known to be valid
+	for name := range values {
+		if name == "config" || flags.Lookup(name) == nil {
+			return fmt.Errorf("%s: unknown setting %q", path, name)
+		}
+	}
+	// Aliases such as -p and -port share a Value, which must be left alone
+	// if either was given
+	given := make(map[flag.Value]bool)
+	flags.Visit(func(f *flag.Flag) {
+		if explicit[f.Name] {
+			given[f.Value] = true
+		}
+	})
+	flags.VisitAll(func(f *flag.Flag) {
+		if !given[f.Value] {
+			f.Value.Set(f.DefValue)
+		}
+	})
+
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if given[flags.Lookup(name).Value] {
+			continue
+		}
+		if err := flags.Set(name, values[name]); err != nil {
+			return fmt.Errorf("%s: %s: %w", path, name, err)
+		}
+	}
+	return nil
+}
+
+// flattenConfig turns nested YAML mappings into flag names and values
+func flattenConfig(prefix string, tree map[string]any, values map[string]string) error {
+	for key, value := range tree {
+		name := strings.ReplaceAll(key, "_", "-")
+		if prefix != "" {
+			name = prefix + "-" + name
+		}
+
+		switch v := value.(type) {
+		case map[string]any:
+			if err := flattenConfig(name, v, values); err != nil {
+				return err
+			}
+		case []any:
+			items := make([]string, len(v))
+			for i, item := range v {
+				if _, nested := item.(map[string]any); nested {
+					return fmt.Errorf("%s: list items must be plain values", name)
+				}
+				items[i] = fmt.Sprint(item)
+			}
+			values[name] = strings.Join(items, ",")
+		case nil:
+			values[name] = ""
+		default:
+			values[name] = fmt.Sprint(v)
+		}
+	}
+	return nil
+}
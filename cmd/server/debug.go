@@ -0,0 +1,36 @@
+// cmd/server/debug.go
+package main
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+
+	"github.com/ryk-9/go-chat/pkg/chat"
+)
+
+// pprofHandler serves the runtime profiles under /debug/pprof/
+func pprofHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return mux
+}
+
+// publishVars publishes the server's live counters as the "chat" expvar,
+// served at /debug/vars alongside the standard memstats and cmdline
+func publishVars(server *chat.Server) {
+	expvar.Publish("chat", expvar.Func(func() any { return server.Vars() }))
+}
+
+// debugHandler serves the profiles and /debug/vars, for the private
+// listener
+func debugHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/debug/pprof/", pprofHandler())
+	mux.Handle("/debug/vars", expvar.Handler())
+	return mux
+}
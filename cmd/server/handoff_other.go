@@ -0,0 +1,28 @@
+// cmd/server/handoff_other.go
+
+//go:build !unix || solaris
+
+package main
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"time"
+)
+
+// errNoHandoff is returned where socket handoff isn't supported
+var errNoHandoff = errors.New("socket handoff is not supported on this platform")
+
+// reusePortControl would set SO_REUSEPORT, which this platform lacks
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	return errNoHandoff
+}
+
+// notifyRestart does nothing: there is no restart signal here
+func notifyRestart(c chan<- os.Signal) {}
+
+// startSuccessor always fails on this platform
+func startSuccessor(l *listeners, timeout time.Duration) (int, error) {
+	return 0, errNoHandoff
+}
@@ -0,0 +1,104 @@
+// cmd/server/handoff_unix.go
+
+//go:build unix && !solaris
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// reusePortControl sets SO_REUSEPORT on a socket before it is bound
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// notifyRestart relays the signal asking for a zero-downtime restart
+func notifyRestart(c chan<- os.Signal) {
+	signal.Notify(c, syscall.SIGUSR2)
+}
+
+// startSuccessor starts a new copy of the server binary with the same
+// arguments, handing it the open listeners, and waits up to timeout for it
+// to report that it is serving. It returns the new server's pid.
+func startSuccessor(l *listeners, timeout time.Duration) (int, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return 0, err
+	}
+	names, files, err := l.files()
+	if err != nil {
+		return 0, err
+	}
+	defer closeFiles(files)
+
+	ready, readyW, err := os.Pipe()
+	if err != nil {
+		return 0, err
+	}
+	defer ready.Close()
+
+	// ExtraFiles become fds 3, 4, ... in the new process
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = fmt.Sprintf("%s:%d", name, 3+i)
+	}
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = append(files, readyW)
+	// The watchdog passes to the new server along with the main PID
+	var env []string
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, "WATCHDOG_PID=") {
+			env = append(env, kv)
+		}
+	}
+	cmd.Env = append(env,
+		listenFDsEnv+"="+strings.Join(pairs, ","),
+		fmt.Sprintf("%s=%d", readyFDEnv, 3+len(files)))
+
+	err = cmd.Start()
+	readyW.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	// The new server writes to the pipe once it is serving; if it exits
+	// first the read fails
+	result := make(chan error, 1)
+	go func() {
+		_, err := ready.Read(make([]byte, 1))
+		result <- err
+	}()
+	select {
+	case err := <-result:
+		if err != nil {
+			cmd.Wait()
+			return 0, errors.New("new server exited before it was ready")
+		}
+	case <-time.After(timeout):
+		cmd.Process.Kill()
+		cmd.Wait()
+		return 0, fmt.Errorf("new server not ready after %s", timeout)
+	}
+
+	pid := cmd.Process.Pid
+	cmd.Process.Release()
+	return pid, nil
+}
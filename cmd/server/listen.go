@@ -0,0 +1,222 @@
+// cmd/server/listen.go
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Environment variables a server sets for the successor it hands its
+// sockets to: the inherited listeners as name:fd pairs, and the pipe to
+// report readiness on
+const (
+	listenFDsEnv = "GOCHAT_LISTEN_FDS"
+	readyFDEnv   = "GOCHAT_READY_FD"
+)
+
+// listeners opens the server's listening sockets by name ("main", "acme",
+// "debug"), taking them over from the previous server when there was one,
+// and remembers them so they can be handed on in turn
+type listeners struct {
+	mu        sync.Mutex
+	reusePort bool
+	inherited map[string]*os.File
+	open      map[string]net.Listener
+}
+
+// newListeners picks up any sockets inherited from a previous server or
+// passed by systemd socket activation. Inherited unix sockets are left in
+// place on shutdown, since their owner may still need them. With
+// reusePort, new sockets are opened with SO_REUSEPORT so another server
+// can listen on the same address.
+func newListeners(reusePort bool) (*listeners, error) {
+	l := &listeners{
+		reusePort: reusePort,
+		inherited: make(map[string]*os.File),
+		open:      make(map[string]net.Listener),
+	}
+
+	fds := os.Getenv(listenFDsEnv)
+	os.Unsetenv(listenFDsEnv)
+	if fds == "" {
+		activated, err := systemdListeners()
+		if err != nil {
+			return nil, err
+		}
+		for name, f := range activated {
+			l.inherited[name] = f
+		}
+		return l, nil
+	}
+	for _, pair := range strings.Split(fds, ",") {
+		i := strings.LastIndexByte(pair, ':')
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid %s entry %q", listenFDsEnv, pair)
+		}
+		name := pair[:i]
+		fd, err := strconv.Atoi(pair[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s entry %q", listenFDsEnv, pair)
+		}
+		l.inherited[name] = os.NewFile(uintptr(fd), name)
+	}
+	return l, nil
+}
+
+// listen returns the listener called name, inherited or newly opened on
+// addr, which is host:port or unix:///path/to/socket
+func (l *listeners) listen(name, addr string) (net.Listener, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var ln net.Listener
+	var err error
+	if f, ok := l.inherited[name]; ok {
+		delete(l.inherited, name)
+		ln, err = net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("inherited %s listener: %w", name, err)
+		}
+	} else if path, ok := strings.CutPrefix(addr, "unix://"); ok {
+		if err := removeStaleSocket(path); err != nil {
+			return nil, err
+		}
+		if ln, err = net.Listen("unix", path); err != nil {
+			return nil, err
+		}
+	} else {
+		lc := net.ListenConfig{}
+		if l.reusePort {
+			lc.Control = reusePortControl
+		}
+		if ln, err = lc.Listen(context.Background(), "tcp", addr); err != nil {
+			return nil, err
+		}
+	}
+	l.open[name] = ln
+	return ln, nil
+}
+
+// listenUDP opens a UDP socket on addr. UDP sockets aren't handed over,
+// as QUIC connections can't share one, so while addr is in use (e.g. by a
+// previous server that is still draining) it keeps trying.
+func listenUDP(addr string) (net.PacketConn, error) {
+	for warned := false; ; warned = true {
+		conn, err := net.ListenPacket("udp", addr)
+		if !errors.Is(err, syscall.EADDRINUSE) {
+			return conn, err
+		}
+		if !warned {
+			slog.Warn("UDP address in use, retrying", "addr", addr)
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// closeUnused closes the inherited sockets nothing asked for, e.g. after a
+// restart with a listener turned off
+func (l *listeners) closeUnused() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for name, f := range l.inherited {
+		f.Close()
+		delete(l.inherited, name)
+	}
+}
+
+// closeAll closes the open listeners after handing them over, stopping
+// new connections here. Socket files are left for the new server.
+func (l *listeners) closeAll() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, ln := range l.open {
+		if ul, ok := ln.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+		ln.Close()
+	}
+}
+
+// removeStaleSocket removes a socket file left behind by a server that
+// didn't shut down cleanly, refusing if a server is still listening on it
+func removeStaleSocket(path string) error {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is in use by another server", path)
+	}
+	return os.Remove(path)
+}
+
+// files duplicates the open listeners' sockets for a successor, in name
+// order
+func (l *listeners) files() ([]string, []*os.File, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	names := make([]string, 0, len(l.open))
+	for name := range l.open {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	files := make([]*os.File, 0, len(names))
+	for _, name := range names {
+		ln, ok := l.open[name].(interface{ File() (*os.File, error) })
+		if !ok {
+			closeFiles(files)
+			return nil, nil, fmt.Errorf("%s listener cannot be handed over", name)
+		}
+		f, err := ln.File()
+		if err != nil {
+			closeFiles(files)
+			return nil, nil, fmt.Errorf("%s listener: %w", name, err)
+		}
+		files = append(files, f)
+	}
+	return names, files, nil
+}
+
+// closeFiles closes every file in files
+func closeFiles(files []*os.File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
+
+// notifyReady tells the server that started this one, if any, that it is
+// serving, so the old server can start draining
+func notifyReady() {
+	value := os.Getenv(readyFDEnv)
+	os.Unsetenv(readyFDEnv)
+	if value == "" {
+		return
+	}
+	fd, err := strconv.Atoi(value)
+	if err != nil {
+		return
+	}
+	f := os.NewFile(uintptr(fd), "ready")
+	f.Write([]byte("ready\n"))
+	f.Close()
+}
@@ -2,34 +2,704 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"expvar"
 	"flag"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"sync/atomic"
 	"syscall"
+	"time"
 
+	_ "github.com/jackc/pgx/v5/stdlib"
+	"github.com/quic-go/webtransport-go"
 	"github.com/ryk-9/go-chat/pkg/chat"
+	"golang.org/x/crypto/acme/autocert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	_ "modernc.org/sqlite"
 )
 
+// version is set at build time with -ldflags "-X main.version=v1.2.3"
+var version = "dev"
+
 func main() {
 	// Parse command-line flags
+	configPath := flag.String("config", "", "YAML file of settings, keyed by flag name (flags on the command line override it)")
 	port := flag.Int("port", 8080, "Port to run the server on")
 	flag.IntVar(port, "p", 8080, "Port to run the server on (shorthand)")
+	history := flag.Int("history", 50, "Number of recent messages replayed to new clients (0 disables)")
+	storePath := flag.String("store", "", "File to persist messages in (default: in-memory only)")
+	pmStorePath := flag.String("pm-store", "", "File to persist private messages in (default: in-memory only)")
+	usersPath := flag.String("users", "", "File, sqlite://path or postgres:// URL to persist registered accounts in (default: in-memory only)")
+	bansPath := flag.String("bans", "", "File to persist bans in (default: in-memory only)")
+	auditPath := flag.String("audit-log", "", "File to append security audit events to as JSON lines")
+	maxAge := flag.Duration("retention-age", 0, "Delete stored messages older than this, e.g. 720h (0 keeps forever)")
+	maxMessages := flag.Int("retention-messages", 0, "Maximum stored messages per room (0 is unlimited)")
+	pruneInterval := flag.Duration("prune-interval", 10*time.Minute, "How often the retention policy is enforced")
+	archiveEndpoint := flag.String("archive-s3-endpoint", "", "S3-compatible endpoint to archive expired messages to (credentials from $AWS_ACCESS_KEY_ID/$AWS_SECRET_ACCESS_KEY)")
+	archiveBucket := flag.String("archive-s3-bucket", "", "Bucket for archived messages")
+	archiveRegion := flag.String("archive-s3-region", "us-east-1", "Region of the archive bucket")
+	archivePrefix := flag.String("archive-s3-prefix", "", "Key prefix for archived messages")
+	authSecret := flag.String("auth-token", os.Getenv("CHAT_AUTH_TOKEN"), "Shared secret clients must present to connect (default $CHAT_AUTH_TOKEN)")
+	authTokensFile := flag.String("auth-tokens-file", "", "File of username:token lines granting per-user access")
+	jwtSecret := flag.String("jwt-secret", os.Getenv("CHAT_JWT_SECRET"), "HMAC secret for validating JWTs (default $CHAT_JWT_SECRET)")
+	jwksURL := flag.String("jwt-jwks-url", "", "JWKS URL for validating RS256/ES256 JWTs")
+	jwtIssuer := flag.String("jwt-issuer", "", "Required JWT issuer (iss claim)")
+	jwtAudience := flag.String("jwt-audience", "", "Required JWT audience (aud claim)")
+	jwtUsernameClaim := flag.String("jwt-username-claim", "preferred_username", "JWT claim holding the username (falls back to sub)")
+	jwtRolesClaim := flag.String("jwt-roles-claim", "roles", "JWT claim holding the user's roles")
+	jwtRequireExp := flag.Bool("jwt-require-exp", true, "Refuse JWTs without an expiry (exp claim)")
+	oidcIssuer := flag.String("oidc-issuer", "", "OpenID Connect issuer URL; enables /login")
+	oidcClientID := flag.String("oidc-client-id", "", "OIDC client ID")
+	oidcClientSecret := flag.String("oidc-client-secret", os.Getenv("CHAT_OIDC_CLIENT_SECRET"), "OIDC client secret (default $CHAT_OIDC_CLIENT_SECRET)")
+	oidcRedirectURL := flag.String("oidc-redirect-url", "", "Public URL of the OIDC callback, e.g. https://chat.example.com/auth/callback")
+	htpasswdFile := flag.String("htpasswd", "", "File of username:bcrypt-hash lines to check passwords against (reloaded on SIGHUP)")
+	ldapURL := flag.String("ldap-url", "", "LDAP server to authenticate users against, e.g. ldaps://ldap.example.com")
+	ldapStartTLS := flag.Bool("ldap-starttls", false, "Use StartTLS on an ldap:// connection")
+	ldapUserDN := flag.String("ldap-user-dn", "", "DN template to bind as, e.g. uid=%s,ou=people,dc=example,dc=com")
+	ldapBindDN := flag.String("ldap-bind-dn", "", "Service account DN used to search for users")
+	ldapBindPassword := flag.String("ldap-bind-password", os.Getenv("CHAT_LDAP_BIND_PASSWORD"), "Service account password (default $CHAT_LDAP_BIND_PASSWORD)")
+	ldapBaseDN := flag.String("ldap-base-dn", "", "Base DN to search for users")
+	ldapUserFilter := flag.String("ldap-user-filter", "(uid=%s)", "Search filter locating a user")
+	ldapAdminGroup := flag.String("ldap-admin-group", "", "Group DN whose members are chat admins")
+	ldapModeratorGroup := flag.String("ldap-moderator-group", "", "Group DN whose members are chat moderators")
+	adminToken := flag.String("admin-token", os.Getenv("CHAT_ADMIN_TOKEN"), "Token required for the /admin API (default $CHAT_ADMIN_TOKEN; empty disables it)")
+	tlsCert := flag.String("tls-cert", "", "TLS certificate file; serves HTTPS/WSS when set with -tls-key")
+	tlsKey := flag.String("tls-key", "", "TLS private key file")
+	tlsClientCA := flag.String("tls-client-ca", "", "PEM file of CAs for client certificates; verified certificates log in as their common name")
+	tlsRequireClientCert := flag.Bool("tls-require-client-cert", false, "Reject TLS connections without a valid client certificate")
+	acmeDomain := flag.String("acme-domain", "", "Obtain certificates from Let's Encrypt for these comma-separated domains")
+	acmeEmail := flag.String("acme-email", "", "Contact email for the Let's Encrypt account")
+	acmeCache := flag.String("acme-cache", "certs", "Directory to cache Let's Encrypt certificates in")
+	acmeHTTPAddr := flag.String("acme-http-addr", ":80", "Address for the HTTP-01 challenge listener")
+	allowedOrigins := flag.String("allowed-origins", "", "Comma-separated web origins allowed to connect besides the server's own, e.g. https://app.example.com,*.example.com (\"*\" allows all)")
+	powBits := flag.Int("pow-bits", 0, "Require a proof of work of this many bits from each connection, e.g. 20 (0 disables)")
+	maxClients := flag.Int("max-clients", 0, "Maximum number of connected users (0 is unlimited)")
+	maxConnsPerIP := flag.Int("max-conns-per-ip", 10, "Maximum concurrent connections from one IP (0 is unlimited)")
+	connRate := flag.Int("conn-rate", 30, "Maximum connection attempts per IP per minute (0 is unlimited)")
+	upgradeRate := flag.Int("upgrade-rate", 0, "Maximum WebSocket upgrades per second across the server, e.g. 200 (0 is unlimited)")
+	upgradeBurst := flag.Int("upgrade-burst", 50, "Upgrades let in at once before -upgrade-rate applies")
+	upgradeQueue := flag.Int("upgrade-queue", 1000, "Upgrades that may wait for -upgrade-rate before the rest are turned away with 503 and Retry-After")
+	trustedProxies := flag.String("trusted-proxies", "", "Comma-separated proxy IPs or CIDRs whose X-Forwarded-For and X-Real-IP headers are trusted")
+	msgRate := flag.Float64("msg-rate", 5, "Messages per second each client may send on average (0 disables flood control)")
+	msgBurst := flag.Int("msg-burst", 10, "Messages a client may send in a burst")
+	floodStrikes := flag.Int("flood-mute-strikes", 10, "Rate-limited messages within a minute before a client is muted (0 never mutes)")
+	floodMute := flag.Duration("flood-mute", time.Minute, "How long flooding clients are muted")
+	loginFailures := flag.Int("login-max-failures", 5, "Failed logins per username or IP before it is locked out (0 never locks out)")
+	loginLockout := flag.Duration("login-lockout", time.Minute, "First lockout after too many failed logins; each further failure doubles it")
+	loginLockoutMax := flag.Duration("login-lockout-max", time.Hour, "Longest lockout after failed logins")
+	spamRepeat := flag.Int("spam-repeat", 3, "Identical messages in a row that count as spam (0 disables)")
+	spamCaps := flag.Int("spam-caps", 80, "Percentage of capital letters that counts as spam (0 disables)")
+	spamBurst := flag.Int("spam-burst", 8, "Messages within -spam-burst-window that count as spam (0 disables)")
+	spamBurstWindow := flag.Duration("spam-burst-window", 10*time.Second, "Window for -spam-burst")
+	spamStrikeWindow := flag.Duration("spam-strike-window", 10*time.Minute, "How long a spam offence counts towards escalation (warn, slow, mute)")
+	spamSlow := flag.Duration("spam-slow", 10*time.Second, "Interval between messages for users slowed down for spamming (0 skips straight to muting)")
+	spamSlowFor := flag.Duration("spam-slow-for", 5*time.Minute, "How long spammers are slowed down")
+	spamMute := flag.Duration("spam-mute", 10*time.Minute, "How long repeat spammers are muted (0 never mutes)")
+	blockLinks := flag.Bool("block-links", false, "Refuse messages with links to domains not listed in -link-domains")
+	linkDomains := flag.String("link-domains", "", "Comma-separated domains (and their subdomains) links may always point to")
+	linkMinAge := flag.Duration("link-min-account-age", 0, "Only registered accounts at least this old may post links, e.g. 72h (0 disables)")
+	muteEcho := flag.Bool("mute-echo", false, "Echo muted users' messages back to them instead of telling them they are muted")
+	console := flag.Bool("console", true, "Read admin commands (list, kick, ban, announce, stats, shutdown...) from stdin")
+	automodFile := flag.String("automod-rules", "", "JSON file of auto-moderation rules (reloaded on SIGHUP)")
+	motdFile := flag.String("motd-file", "", "File with the welcome message shown to joining users (reloaded on SIGHUP)")
+	reservedNames := flag.String("reserved-names", strings.Join(chat.DefaultReservedNames, ","), "Comma-separated usernames that require credentials for that name")
+	allowGuests := flag.Bool("allow-guests", false, "Admit unauthenticated connections as restricted guest-NNN users")
+	slowMode := flag.Duration("slow-mode", 0, "Start in slow mode: users may send one message per this interval, e.g. 10s (0 is off)")
+	guestInterval := flag.Duration("guest-interval", 3*time.Second, "Minimum time between a guest's messages")
+	rooms := flag.String("rooms", "", "Comma-separated rooms that always exist, even when empty")
+	logFormat := flag.String("log-format", "text", "Log output format: text or json")
+	logLevel := flag.String("log-level", "info", "Minimum log level: debug, info, warn or error")
+	logFile := flag.String("log-file", "", "Write logs to this file instead of stderr")
+	logMaxSize := flag.Int("log-max-size", 100, "Rotate the log file when it reaches this many megabytes (0 is off)")
+	logRotate := flag.Duration("log-rotate", 0, "Also rotate the log file every interval, e.g. 24h for daily at midnight UTC (0 is off)")
+	logMaxBackups := flag.Int("log-max-backups", 10, "Rotated log files to keep (0 keeps all)")
+	logMaxAge := flag.Duration("log-max-age", 0, "Delete rotated log files older than this, e.g. 720h (0 keeps them)")
+	backplaneURL := flag.String("backplane", "", "Share rooms, broadcasts and the user list with other instances through this Redis or NATS server, e.g. redis://redis:6379 or nats://nats:4222")
+	backplaneChannel := flag.String("backplane-channel", chat.DefaultBackplaneChannel, "Pub/sub channel (or NATS subject) the instances share on the backplane")
+	accessLogFile := flag.String("access-log", "", "Log every WebSocket upgrade and a traffic summary of every connection to this file (rotated like -log-file), or \"-\" for the main log")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 10*time.Second, "How long to wait for clients to disconnect when shutting down")
+	listenAddrs := flag.String("listen", "", "Comma-separated addresses to listen on instead of -port: host:port or unix:///path/to/socket")
+	reusePort := flag.Bool("reuse-port", false, "Listen with SO_REUSEPORT, so a new server can start on the same port before this one stops")
+	handoffTimeout := flag.Duration("handoff-timeout", 30*time.Second, "How long to wait for the new server to start on SIGUSR2 before giving up")
+	pprofEnabled := flag.Bool("pprof", false, "Serve /debug/pprof profiles on the main port to requests with the admin token")
+	expvarEnabled := flag.Bool("expvar", false, "Serve live counters at /debug/vars on the main port to requests with the admin token")
+	tcpAddr := flag.String("tcp-addr", "", "Let nc, telnet and scripts join with plain lines of text on this address, e.g. :6000")
+	tcpTLS := flag.Bool("tcp-tls", false, "Serve -tcp-addr over TLS with the main port's certificates")
+	ircAddr := flag.String("irc-addr", "", "Let IRC clients like weechat and irssi join on this address, e.g. :6667")
+	ircTLS := flag.Bool("irc-tls", false, "Serve -irc-addr over TLS with the main port's certificates, usually on :6697")
+	webTransportAddr := flag.String("webtransport-addr", "", "Take WebTransport sessions over HTTP/3 on this UDP address, usually the main port's, e.g. :8443 (experimental, needs TLS)")
+	grpcAddr := flag.String("grpc-addr", "", "Serve the gRPC API (Chat.Stream, Send and ListUsers) on this address, e.g. :9090, with TLS if the main port has it")
+	pprofAddr := flag.String("pprof-addr", "", "Serve /debug/pprof profiles and /debug/vars without authentication on this address, e.g. localhost:6060")
+	sentryDSN := flag.String("sentry-dsn", os.Getenv("SENTRY_DSN"), "Report panics and errors to this Sentry project (default $SENTRY_DSN)")
+	sentryEnv := flag.String("sentry-environment", os.Getenv("SENTRY_ENVIRONMENT"), "Environment to tag Sentry events with, e.g. production (default $SENTRY_ENVIRONMENT)")
+	slackConfig := flag.String("slack-config", "", "JSON file of rooms to bridge with Slack channels, through incoming webhooks and the Events API at /slack/events")
+	discordToken := flag.String("discord-token", os.Getenv("DISCORD_TOKEN"), "Bot token to mirror rooms with Discord channels with (default $DISCORD_TOKEN)")
+	discordChannels := flag.String("discord-channels", "", "Comma-separated rooms and the Discord channel IDs they mirror, e.g. lobby=112233445566778899")
+	xmppComponent := flag.String("xmpp-component", "", "Expose rooms as MUCs through an XMPP server's component port, e.g. localhost:5347")
+	xmppDomain := flag.String("xmpp-domain", "", "Domain of the XMPP component, e.g. rooms.example.com, as configured on the XMPP server")
+	xmppSecret := flag.String("xmpp-secret", os.Getenv("XMPP_SECRET"), "Shared secret of the XMPP component (default $XMPP_SECRET)")
+	scriptsDir := flag.String("scripts", "", "Directory of Lua scripts to run, e.g. greeters, auto-responders and games")
+	scriptsUser := flag.String("scripts-user", "bot", "Username the scripts post as")
+	webClient := flag.Bool("web", true, "Serve the browser client at /")
+	webhooksConfig := flag.String("webhooks", "", "JSON file of webhook URLs to post chat events to, signed with their secrets")
+	smtpAddr := flag.String("smtp-addr", "", "Mail server (host:port) for emailing registered users their mentions and whispers while offline")
+	smtpUser := flag.String("smtp-user", "", "Username to authenticate to the mail server with")
+	smtpPassword := flag.String("smtp-password", os.Getenv("SMTP_PASSWORD"), "Password to authenticate to the mail server with (default $SMTP_PASSWORD)")
+	emailFrom := flag.String("email-from", "", "Sender address of notification emails, e.g. \"Chat <chat@example.com>\"")
+	emailDigest := flag.Duration("email-digest", 10*time.Minute, "How long to collect an offline user's notifications before emailing them together")
+	vapidKey := flag.String("vapid-key", "", "PEM file of the VAPID key for Web Push notifications to browsers, created if it doesn't exist (empty disables Web Push)")
+	vapidSubject := flag.String("vapid-subject", "", "Contact URL for push services, e.g. mailto:ops@example.com (required with -vapid-key)")
+	pushPath := flag.String("push-subscriptions", "", "File to persist Web Push subscriptions in (default: in-memory only)")
+	kafkaBrokers := flag.String("kafka-brokers", "", "Export every message and system event to Kafka through these comma-separated brokers, e.g. kafka1:9092,kafka2:9092")
+	kafkaTopic := flag.String("kafka-topic", chat.DefaultKafkaTopic, "Existing Kafka topic to export events to")
+	kafkaBatchSize := flag.Int("kafka-batch-size", 100, "Most events to send to Kafka in one batch")
+	kafkaBatchBytes := flag.Int64("kafka-batch-bytes", 1<<20, "Most bytes to send to Kafka in one batch")
+	kafkaBatchTimeout := flag.Duration("kafka-batch-timeout", time.Second, "Longest to wait for a Kafka batch to fill before sending it")
+	compress := flag.Bool("compress", false, "Offer permessage-deflate compression to clients")
+	compressLevel := flag.Int("compress-level", chat.DefaultCompressionLevel, "Compression level, from 1 (fastest) to 9 (smallest)")
+	compressThreshold := flag.Int("compress-threshold", chat.DefaultCompressionThreshold, "Send messages shorter than this many bytes uncompressed")
+	slowClients := flag.String("slow-clients", string(chat.SlowClientDisconnect), "What to do when a client falls too far behind: disconnect, drop-oldest or drop-newest")
+	readTimeout := flag.Duration("read-timeout", chat.DefaultReadTimeout, "Disconnect clients that send nothing for this long after their last message")
+	pongWait := flag.Duration("pong-wait", chat.DefaultPongWait, "Disconnect clients that send nothing for this long after their last pong")
+	pingInterval := flag.Duration("ping-interval", chat.DefaultPingInterval, "How often to ping clients; must be well under -pong-wait")
+	writeTimeout := flag.Duration("write-timeout", chat.DefaultWriteTimeout, "Disconnect clients when writing one message to them takes longer than this")
+	sendQueue := flag.Int("send-queue", chat.DefaultSendQueueSize, "Messages that may wait to be written to a client before -slow-clients applies")
+	sendQueueBytes := flag.Int("send-queue-bytes", chat.DefaultSendQueueBytes, "Bytes of messages that may wait to be written to a client before -slow-clients applies")
+	maxQueuedBytes := flag.Int("max-queued-bytes", 0, "Bytes of messages that may wait to be written across all clients before -slow-clients applies to any client with a backlog (0 is unlimited)")
+	maxHistory := flag.Int("max-history-messages", 0, "Maximum messages an in-memory or file store keeps in memory, evicting the oldest (0 is unlimited)")
+	maxRoomHistory := flag.Int("max-room-messages", 0, "Maximum messages per room an in-memory or file store keeps in memory, evicting the oldest (0 is unlimited)")
+	readBuffer := flag.Int("read-buffer", chat.DefaultBufferSize, "Size in bytes of each connection's read buffer")
+	writeBuffer := flag.Int("write-buffer", chat.DefaultBufferSize, "Size in bytes of each connection's write buffer")
+	batchSize := flag.Int("batch-size", 0, "Send up to this many queued messages in one frame to clients that support batches (0 or 1 disables)")
+	batchDelay := flag.Duration("batch-delay", 0, "How long to wait for more messages to fill a batch, e.g. 20ms (0 only batches what is already queued)")
+	broadcastWorkers := flag.Int("broadcast-workers", runtime.NumCPU(), "Goroutines sharing out broadcasts to large rooms (0 sends them from one)")
+	transportName := flag.String("transport", string(chat.TransportGorilla), "WebSocket implementation: gorilla, or epoll (Linux only) for many mostly idle connections")
+	showVersion := flag.Bool("version", false, "Print the version and exit")
 	flag.Parse()
 
+	if *showVersion {
+		fmt.Println("chat-server", serverVersion())
+		return
+	}
+
+	// Remember which flags were given, so the config file (also when it
+	// is reloaded) never overrides them
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+	if *configPath != "" {
+		if err := loadConfigFile(*configPath, flag.CommandLine, explicit); err != nil {
+			fatal("Error loading config", "err", err)
+		}
+	}
+
+	var logOutput io.Writer = os.Stderr
+	if *logFile != "" {
+		file, err := chat.OpenLogFile(chat.LogFileConfig{
+			Path:        *logFile,
+			MaxSize:     int64(*logMaxSize) << 20,
+			RotateEvery: *logRotate,
+			MaxBackups:  *logMaxBackups,
+			MaxAge:      *logMaxAge,
+		})
+		if err != nil {
+			fatal("Error opening log file", "err", err)
+		}
+		defer file.Close()
+		logOutput = file
+	}
+	logger, err := chat.NewLogger(logOutput, *logFormat, *logLevel)
+	if err != nil {
+		fatal("Error configuring logging", "err", err)
+	}
+	slog.SetDefault(logger)
+
+	var accessLog *slog.Logger
+	switch *accessLogFile {
+	case "":
+	case "-":
+		accessLog = logger
+	default:
+		file, err := chat.OpenLogFile(chat.LogFileConfig{
+			Path:        *accessLogFile,
+			MaxSize:     int64(*logMaxSize) << 20,
+			RotateEvery: *logRotate,
+			MaxBackups:  *logMaxBackups,
+			MaxAge:      *logMaxAge,
+		})
+		if err != nil {
+			fatal("Error opening access log", "err", err)
+		}
+		defer file.Close()
+		// The level was checked above
+		accessLog, _ = chat.NewLogger(file, *logFormat, "info")
+	}
+
+	// Sockets handed over by a previous server on SIGUSR2 are picked up
+	// before anything else listens
+	sockets, err := newListeners(*reusePort)
+	if err != nil {
+		fatal("Error taking over listeners", "err", err)
+	}
+
+	if *powBits > 32 {
+		fatal("-pow-bits must be at most 32")
+	}
+	if (*tlsCert == "") != (*tlsKey == "") {
+		fatal("-tls-cert and -tls-key must be used together")
+	}
+	if *acmeDomain != "" && *tlsCert != "" {
+		fatal("-acme-domain cannot be combined with -tls-cert")
+	}
+	if (*tlsClientCA != "" || *tlsRequireClientCert) && *tlsCert == "" && *acmeDomain == "" {
+		fatal("Client certificates require -tls-cert or -acme-domain")
+	}
+	if *tlsRequireClientCert && *tlsClientCA == "" {
+		fatal("-tls-require-client-cert requires -tls-client-ca")
+	}
+	if _, err := chat.ParseSlowClientPolicy(*slowClients); err != nil {
+		fatal("Invalid -slow-clients", "err", err)
+	}
+	transport, err := chat.ParseTransport(*transportName)
+	if err != nil {
+		fatal("Invalid -transport", "err", err)
+	}
+	if (*pprofEnabled || *expvarEnabled) && *adminToken == "" {
+		fatal("-pprof and -expvar require -admin-token; use -pprof-addr for a private listener without one")
+	}
+
 	// Initialize the server
-	server := chat.NewServer()
-	go server.Run()
+	cfg := chat.DefaultConfig()
+	cfg.HistorySize = *history
+	cfg.RetentionMaxAge = *maxAge
+	cfg.RetentionMaxMessages = *maxMessages
+	cfg.PruneInterval = *pruneInterval
+	cfg.Logger = logger
+	cfg.AccessLog = accessLog
+	cfg.Version = serverVersion()
+	cfg.AdminToken = *adminToken
+	cfg.Compression = *compress
+	cfg.CompressionLevel = *compressLevel
+	cfg.CompressionThreshold = *compressThreshold
+	cfg.BroadcastWorkers = *broadcastWorkers
+	cfg.Transport = transport
+	cfg.BatchSize = *batchSize
+	cfg.BatchDelay = *batchDelay
+	cfg.ReadTimeout = *readTimeout
+	cfg.PongWait = *pongWait
+	cfg.PingInterval = *pingInterval
+	cfg.WriteTimeout = *writeTimeout
+	cfg.SendQueueSize = *sendQueue
+	cfg.SendQueueBytes = *sendQueueBytes
+	cfg.MaxHistoryMessages = *maxHistory
+	cfg.MaxRoomMessages = *maxRoomHistory
+	cfg.ReadBufferSize = *readBuffer
+	cfg.WriteBufferSize = *writeBuffer
+	// The limits and filters, which SIGHUP reloads
+	settings := func(cfg *chat.Config) {
+		cfg.AllowGuests = *allowGuests
+		cfg.ReservedNames = strings.Split(*reservedNames, ",")
+		cfg.ProofOfWorkBits = *powBits
+		cfg.MaxClients = *maxClients
+		cfg.MaxConnectionsPerIP = *maxConnsPerIP
+		cfg.ConnectionsPerMinute = *connRate
+		cfg.UpgradesPerSecond = *upgradeRate
+		cfg.UpgradeBurst = *upgradeBurst
+		cfg.UpgradeQueue = *upgradeQueue
+		cfg.TrustedProxies = strings.Split(*trustedProxies, ",")
+		cfg.MessageRate = *msgRate
+		cfg.MessageBurst = *msgBurst
+		cfg.FloodMuteStrikes = *floodStrikes
+		cfg.FloodMuteDuration = *floodMute
+		cfg.LoginMaxFailures = *loginFailures
+		cfg.LoginLockout = *loginLockout
+		cfg.LoginLockoutMax = *loginLockoutMax
+		cfg.SpamRepeatLimit = *spamRepeat
+		cfg.SpamCapsPercent = *spamCaps
+		cfg.SpamBurstMessages = *spamBurst
+		cfg.SpamBurstWindow = *spamBurstWindow
+		cfg.SpamStrikeWindow = *spamStrikeWindow
+		cfg.SpamSlowInterval = *spamSlow
+		cfg.SpamSlowDuration = *spamSlowFor
+		cfg.SpamMuteDuration = *spamMute
+		cfg.EchoMutedMessages = *muteEcho
+		if policy, err := chat.ParseSlowClientPolicy(*slowClients); err == nil {
+			cfg.SlowClientPolicy = policy
+		} else {
+			slog.Error("Ignoring invalid -slow-clients", "err", err)
+		}
+		cfg.BlockLinks = *blockLinks
+		cfg.LinkMinAccountAge = *linkMinAge
+		cfg.LinkDomains = nil
+		if *linkDomains != "" {
+			cfg.LinkDomains = strings.Split(*linkDomains, ",")
+		}
+		cfg.AllowedOrigins = nil
+		if *allowedOrigins != "" {
+			cfg.AllowedOrigins = strings.Split(*allowedOrigins, ",")
+		}
+		cfg.GuestMessageInterval = *guestInterval
+		cfg.MaxQueuedBytes = *maxQueuedBytes
+	}
+	settings(&cfg)
+	if *rooms != "" {
+		cfg.Rooms = strings.Split(*rooms, ",")
+	}
+	cfg.SlowMode = *slowMode
+	if *automodFile != "" {
+		rules, err := chat.LoadAutomodRules(*automodFile)
+		if err != nil {
+			fatal("Error loading automod rules", "err", err)
+		}
+		cfg.AutomodRules = rules
+	}
+	if *motdFile != "" {
+		motd, err := chat.LoadMOTD(*motdFile)
+		if err != nil {
+			fatal("Error loading MOTD", "err", err)
+		}
+		cfg.MOTD = motd
+	}
+	var auth chat.MultiAuth
+	if *tlsClientCA != "" {
+		auth = append(auth, chat.CertAuth{})
+	}
+	if *jwtSecret != "" || *jwksURL != "" {
+		jwtAuth, err := chat.NewJWTAuth(chat.JWTConfig{
+			Secret:        []byte(*jwtSecret),
+			JWKSURL:       *jwksURL,
+			Issuer:        *jwtIssuer,
+			Audience:      *jwtAudience,
+			UsernameClaim: *jwtUsernameClaim,
+			RolesClaim:    *jwtRolesClaim,
+			RequireExp:    jwtRequireExp,
+		})
+		if err != nil {
+			fatal("Error configuring JWT auth", "err", err)
+		}
+		auth = append(auth, jwtAuth)
+	}
+	var tokenAuth *chat.TokenAuth
+	if *authSecret != "" || *authTokensFile != "" {
+		tokenAuth = &chat.TokenAuth{SharedSecret: *authSecret}
+		if *authTokensFile != "" {
+			tokens, err := chat.LoadUserTokens(*authTokensFile)
+			if err != nil {
+				fatal("Error loading tokens", "err", err)
+			}
+			tokenAuth.UserTokens = tokens
+		}
+		auth = append(auth, tokenAuth)
+	}
+	var htpasswd *chat.HtpasswdAuth
+	if *htpasswdFile != "" {
+		var err error
+		htpasswd, err = chat.NewHtpasswdAuth(*htpasswdFile)
+		if err != nil {
+			fatal("Error loading credentials", "err", err)
+		}
+		auth = append(auth, htpasswd)
+	}
+	if *ldapURL != "" {
+		ldapAuth, err := chat.NewLDAPAuth(chat.LDAPConfig{
+			URL:            *ldapURL,
+			StartTLS:       *ldapStartTLS,
+			UserDNTemplate: *ldapUserDN,
+			BindDN:         *ldapBindDN,
+			BindPassword:   *ldapBindPassword,
+			BaseDN:         *ldapBaseDN,
+			UserFilter:     *ldapUserFilter,
+			AdminGroup:     *ldapAdminGroup,
+			ModeratorGroup: *ldapModeratorGroup,
+		})
+		if err != nil {
+			fatal("Error configuring LDAP auth", "err", err)
+		}
+		auth = append(auth, ldapAuth)
+	}
+	var oidc *chat.OIDCProvider
+	if *oidcIssuer != "" {
+		var err error
+		oidc, err = chat.NewOIDCProvider(chat.OIDCConfig{
+			IssuerURL:     *oidcIssuer,
+			ClientID:      *oidcClientID,
+			ClientSecret:  *oidcClientSecret,
+			RedirectURL:   *oidcRedirectURL,
+			UsernameClaim: *jwtUsernameClaim,
+		})
+		if err != nil {
+			fatal("Error configuring OIDC", "err", err)
+		}
+		auth = append(auth, oidc)
+	}
+	if len(auth) > 0 {
+		cfg.Auth = auth
+	}
+	if *archiveEndpoint != "" {
+		archiver, err := chat.NewS3Archiver(chat.S3Config{
+			Endpoint:        *archiveEndpoint,
+			Region:          *archiveRegion,
+			Bucket:          *archiveBucket,
+			Prefix:          *archivePrefix,
+			AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		})
+		if err != nil {
+			fatal("Error configuring archive", "err", err)
+		}
+		if *maxAge <= 0 {
+			slog.Warn("Archiving has no effect without -retention-age")
+		}
+		cfg.Archiver = archiver
+	}
+	if *backplaneURL != "" {
+		backplane, err := openBackplane(*backplaneURL, *backplaneChannel)
+		if err != nil {
+			fatal("Error connecting to backplane", "err", err)
+		}
+		defer backplane.Close()
+		cfg.Backplane = backplane
+	}
+	if *kafkaBrokers != "" {
+		exporter, err := chat.NewKafkaExporter(chat.KafkaConfig{
+			Brokers:      strings.Split(*kafkaBrokers, ","),
+			Topic:        *kafkaTopic,
+			BatchSize:    *kafkaBatchSize,
+			BatchBytes:   *kafkaBatchBytes,
+			BatchTimeout: *kafkaBatchTimeout,
+		})
+		if err != nil {
+			fatal("Error configuring Kafka export", "err", err)
+		}
+		defer exporter.Close(10 * time.Second)
+		cfg.Exporter = exporter
+	}
+	if *webhooksConfig != "" {
+		webhooksCfg, err := chat.LoadWebhookConfig(*webhooksConfig)
+		if err != nil {
+			fatal("Error loading webhook config", "err", err)
+		}
+		webhooks, err := chat.NewWebhookExporter(webhooksCfg)
+		if err != nil {
+			fatal("Error configuring webhooks", "err", err)
+		}
+		defer webhooks.Close(10 * time.Second)
+		if cfg.Exporter != nil {
+			cfg.Exporter = chat.Exporters{cfg.Exporter, webhooks}
+		} else {
+			cfg.Exporter = webhooks
+		}
+	}
+	if *smtpAddr != "" {
+		if *emailFrom == "" {
+			fatal("-smtp-addr requires -email-from")
+		}
+		cfg.Email = &chat.EmailConfig{
+			SMTPAddr:    *smtpAddr,
+			Username:    *smtpUser,
+			Password:    *smtpPassword,
+			From:        *emailFrom,
+			DigestDelay: *emailDigest,
+		}
+	}
+	if *sentryDSN != "" {
+		reporter, err := chat.NewSentryReporter(chat.SentryConfig{
+			DSN:         *sentryDSN,
+			Environment: *sentryEnv,
+			Release:     cfg.Version,
+		})
+		if err != nil {
+			fatal("Error configuring error reporting", "err", err)
+		}
+		// Closed after the stores, so errors closing them are still sent
+		defer reporter.Close(5 * time.Second)
+		cfg.ErrorReporter = reporter
+	}
+	if *storePath != "" {
+		store, err := chat.OpenFileStore(*storePath)
+		if err != nil {
+			fatal("Error opening message store", "err", err)
+		}
+		defer store.Close()
+		cfg.Store = store
+	}
+	if *pmStorePath != "" {
+		pmStore, err := chat.OpenFileStore(*pmStorePath)
+		if err != nil {
+			fatal("Error opening private message store", "err", err)
+		}
+		defer pmStore.Close()
+		cfg.PrivateStore = pmStore
+	}
+	if *usersPath != "" {
+		users, err := openUserStore(*usersPath)
+		if err != nil {
+			fatal("Error opening user store", "err", err)
+		}
+		defer users.Close()
+		cfg.Users = users
+	}
+	if *auditPath != "" {
+		audit, err := chat.OpenAuditLog(*auditPath)
+		if err != nil {
+			fatal("Error opening audit log", "err", err)
+		}
+		defer audit.Close()
+		cfg.Audit = audit
+	}
+	var bans *chat.FileBanStore
+	if *bansPath != "" {
+		var err error
+		bans, err = chat.OpenFileBanStore(*bansPath)
+		if err != nil {
+			fatal("Error opening ban store", "err", err)
+		}
+		defer bans.Close()
+		cfg.Bans = bans
+	}
+	if *pushPath != "" {
+		pushStore, err := chat.OpenFilePushStore(*pushPath)
+		if err != nil {
+			fatal("Error opening push subscription store", "err", err)
+		}
+		defer pushStore.Close()
+		cfg.PushSubscriptions = pushStore
+	}
+	if *vapidKey != "" {
+		if *vapidSubject == "" {
+			fatal("-vapid-key requires -vapid-subject")
+		}
+		key, err := chat.LoadVAPIDKey(*vapidKey)
+		if err != nil {
+			fatal("Error loading VAPID key", "err", err)
+		}
+		cfg.WebPush = &chat.WebPushConfig{Key: key, Subject: *vapidSubject}
+	}
+	server := chat.NewServerWithConfig(cfg)
+	runCtx, stopRun := context.WithCancel(context.Background())
+	defer stopRun()
+	go server.Run(runCtx)
+
+	// Routes go on their own mux rather than http.DefaultServeMux, which
+	// net/http/pprof registers itself on
+	mux := http.NewServeMux()
 
 	// Set up WebSocket handler
-	http.HandleFunc("/ws", server.HandleWebSocket)
+	mux.HandleFunc("/ws", server.HandleWebSocket)
+
+	// Serve the browser client, which joins through /ws, on every path
+	// nothing else claims
+	if *webClient {
+		mux.Handle("/", chat.WebClient())
+	}
+
+	// Set up the Server-Sent Events fallback for clients that can't use
+	// WebSockets: a stream of messages, and their messages posted back
+	mux.HandleFunc("/events", server.HandleEvents)
+	mux.HandleFunc("/send", server.HandleSend)
+
+	// Set up the Slack bridge, whose Events API requests come in here
+	if *slackConfig != "" {
+		slackCfg, err := chat.LoadSlackConfig(*slackConfig)
+		if err != nil {
+			fatal("Error loading Slack config", "err", err)
+		}
+		slack, err := chat.NewSlackBridge(server, slackCfg)
+		if err != nil {
+			fatal("Error configuring Slack bridge", "err", err)
+		}
+		defer slack.Close(5 * time.Second)
+		mux.Handle("/slack/events", slack)
+	}
+
+	// Connect the Discord bot mirroring rooms with channels
+	if *discordChannels != "" {
+		channels := map[string]string{}
+		for _, pair := range strings.Split(*discordChannels, ",") {
+			room, channel, ok := strings.Cut(pair, "=")
+			if !ok {
+				fatal("Invalid -discord-channels entry, want room=channel-id", "entry", pair)
+			}
+			channels[strings.TrimSpace(room)] = strings.TrimSpace(channel)
+		}
+		discord, err := chat.NewDiscordBridge(server, chat.DiscordConfig{Token: *discordToken, Channels: channels})
+		if err != nil {
+			fatal("Error configuring Discord bridge", "err", err)
+		}
+		defer discord.Close(5 * time.Second)
+	}
 
-	// Set up health check endpoint
-	http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
-		w.Write([]byte("OK"))
-	})
+	// Connect to the XMPP server exposing rooms as MUCs
+	if *xmppComponent != "" {
+		xmpp, err := chat.NewXMPPComponent(server, chat.XMPPConfig{Addr: *xmppComponent, Domain: *xmppDomain, Secret: *xmppSecret})
+		if err != nil {
+			fatal("Error connecting XMPP component", "err", err)
+		}
+		defer xmpp.Close()
+	}
+
+	// Run the scripts reacting to what happens in the chat
+	if *scriptsDir != "" {
+		scripts, err := chat.NewScriptEngine(server, chat.ScriptConfig{Dir: *scriptsDir, Username: *scriptsUser})
+		if err != nil {
+			fatal("Error loading scripts", "err", err)
+		}
+		defer scripts.Close(5 * time.Second)
+	}
+
+	// Set up OIDC login flow
+	if oidc != nil {
+		mux.HandleFunc("/login", oidc.HandleLogin)
+		mux.HandleFunc(oidc.CallbackPath(), oidc.HandleCallback)
+	}
+
+	// Set up admin API (disabled unless a token is configured)
+	mux.Handle("/admin/", server.AdminHandler())
+
+	// Set up the REST API (disabled unless there is an admin token or
+	// authentication)
+	mux.Handle("/api/", server.APIHandler())
+
+	// Set up profiling and live counters, behind the admin token on the
+	// main port or open on a separate (private) listener
+	publishVars(server)
+	if *pprofEnabled {
+		mux.Handle("/debug/pprof/", server.RequireAdmin(pprofHandler()))
+	}
+	if *expvarEnabled {
+		mux.Handle("/debug/vars", server.RequireAdmin(expvar.Handler()))
+	}
+	if *pprofAddr != "" {
+		ln, err := sockets.listen("debug", *pprofAddr)
+		if err != nil {
+			fatal("Error starting profiling listener", "err", err)
+		}
+		go func() {
+			slog.Info("Profiling listener starting", "addr", *pprofAddr)
+			if err := http.Serve(ln, debugHandler()); err != nil && !errors.Is(err, net.ErrClosed) {
+				fatal("Profiling listener error", "err", err)
+			}
+		}()
+	}
+
+	// Set up liveness and readiness checks for orchestrators
+	mux.Handle("/healthz", server.LivenessHandler())
+	mux.Handle("/readyz", server.ReadinessHandler())
+
+	// Set up health check endpoint, in plain text or JSON
+	mux.Handle("/health", server.HealthHandler())
 
 	// Set up graceful shutdown
 	stop := make(chan os.Signal, 1)
@@ -37,17 +707,364 @@ func main() {
 
 	// Start HTTP server in a goroutine
 	serverAddress := fmt.Sprintf(":%d", *port)
-	srv := &http.Server{Addr: serverAddress}
+	srv := &http.Server{Addr: serverAddress, Handler: mux}
+
+	// Obtain and renew certificates automatically, answering HTTP-01
+	// challenges on a separate plain HTTP listener
+	if *acmeDomain != "" {
+		manager := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(strings.Split(*acmeDomain, ",")...),
+			Cache:      autocert.DirCache(*acmeCache),
+			Email:      *acmeEmail,
+		}
+		srv.TLSConfig = manager.TLSConfig()
+
+		ln, err := sockets.listen("acme", *acmeHTTPAddr)
+		if err != nil {
+			fatal("Error starting ACME challenge listener", "err", err)
+		}
+		go func() {
+			slog.Info("ACME challenge listener starting", "addr", *acmeHTTPAddr)
+			if err := http.Serve(ln, manager.HTTPHandler(nil)); err != nil && !errors.Is(err, net.ErrClosed) {
+				fatal("ACME challenge listener error", "err", err)
+			}
+		}()
+	}
+
+	// Verify client certificates against the given CAs
+	if *tlsClientCA != "" {
+		pem, err := os.ReadFile(*tlsClientCA)
+		if err != nil {
+			fatal("Error reading client CA file", "err", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			fatal("No certificates found in client CA file", "file", *tlsClientCA)
+		}
+		if srv.TLSConfig == nil {
+			srv.TLSConfig = &tls.Config{}
+		}
+		srv.TLSConfig.ClientCAs = pool
+		srv.TLSConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		if *tlsRequireClientCert {
+			srv.TLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+
+	// Serve on -port, or on each of the -listen addresses
+	addresses := []string{serverAddress}
+	if *listenAddrs != "" {
+		addresses = strings.Split(*listenAddrs, ",")
+	}
+	useTLS := *tlsCert != "" || *acmeDomain != ""
+	slog.Info("Press Ctrl+C to stop the server")
+	for i, addr := range addresses {
+		addr = strings.TrimSpace(addr)
+		name := "main"
+		if i > 0 {
+			name = fmt.Sprintf("main-%d", i)
+		}
+		ln, err := sockets.listen(name, addr)
+		if err != nil {
+			fatal("Error starting server", "addr", addr, "err", err)
+		}
+		go func() {
+			slog.Info("Chat server starting", "addr", ln.Addr().String(), "tls", useTLS)
+			var err error
+			if useTLS {
+				// With ACME the certificates come from srv.TLSConfig
+				err = srv.ServeTLS(ln, *tlsCert, *tlsKey)
+			} else {
+				err = srv.Serve(ln)
+			}
+			if err != nil && err != http.ErrServerClosed && !errors.Is(err, net.ErrClosed) {
+				fatal("Server error", "addr", addr, "err", err)
+			}
+		}()
+	}
+	// listenerTLS returns the TLS settings of the main port for the other
+	// listeners, which can't load the certificate files as ServeTLS does
+	listenerTLS := func() *tls.Config {
+		config := &tls.Config{}
+		if srv.TLSConfig != nil {
+			config = srv.TLSConfig.Clone()
+		}
+		if *tlsCert != "" {
+			cert, err := tls.LoadX509KeyPair(*tlsCert, *tlsKey)
+			if err != nil {
+				fatal("Error loading TLS certificate", "err", err)
+			}
+			config.Certificates = []tls.Certificate{cert}
+		}
+		return config
+	}
+
+	// Serve the gRPC API alongside, with the main port's certificates
+	var grpcServer *grpc.Server
+	if *grpcAddr != "" {
+		var opts []grpc.ServerOption
+		if useTLS {
+			opts = append(opts, grpc.Creds(credentials.NewTLS(listenerTLS())))
+		}
+		grpcServer = server.GRPCServer(opts...)
+		ln, err := sockets.listen("grpc", *grpcAddr)
+		if err != nil {
+			fatal("Error starting gRPC listener", "err", err)
+		}
+		go func() {
+			slog.Info("gRPC server starting", "addr", ln.Addr().String(), "tls", useTLS)
+			if err := grpcServer.Serve(ln); err != nil && !errors.Is(err, net.ErrClosed) {
+				fatal("gRPC server error", "err", err)
+			}
+		}()
+	}
+
+	// Serve the line protocol, whose clients are drained with the rest
+	if *tcpAddr != "" {
+		if *tcpTLS && !useTLS {
+			fatal("-tcp-tls needs -tls-cert or -acme-domain")
+		}
+		ln, err := sockets.listen("tcp", *tcpAddr)
+		if err != nil {
+			fatal("Error starting line listener", "err", err)
+		}
+		go func() {
+			slog.Info("Line listener starting", "addr", ln.Addr().String(), "tls", *tcpTLS)
+			if *tcpTLS {
+				ln = tls.NewListener(ln, listenerTLS())
+			}
+			if err := server.ServeLines(ln); !errors.Is(err, net.ErrClosed) {
+				fatal("Line listener error", "err", err)
+			}
+		}()
+	}
+
+	// Serve IRC clients, who are drained with the rest too
+	if *ircAddr != "" {
+		if *ircTLS && !useTLS {
+			fatal("-irc-tls needs -tls-cert or -acme-domain")
+		}
+		ln, err := sockets.listen("irc", *ircAddr)
+		if err != nil {
+			fatal("Error starting IRC listener", "err", err)
+		}
+		go func() {
+			slog.Info("IRC listener starting", "addr", ln.Addr().String(), "tls", *ircTLS)
+			if *ircTLS {
+				ln = tls.NewListener(ln, listenerTLS())
+			}
+			if err := server.ServeIRC(ln); !errors.Is(err, net.ErrClosed) {
+				fatal("IRC listener error", "err", err)
+			}
+		}()
+	}
+
+	// Serve WebTransport over HTTP/3, for clients on lossy networks
+	var wtServer *webtransport.Server
+	if *webTransportAddr != "" {
+		if !useTLS {
+			fatal("-webtransport-addr needs -tls-cert or -acme-domain")
+		}
+		wtServer = server.WebTransportServer(listenerTLS())
+		go func() {
+			conn, err := listenUDP(*webTransportAddr)
+			if err != nil {
+				fatal("Error starting WebTransport listener", "err", err)
+			}
+			slog.Info("WebTransport server starting", "addr", conn.LocalAddr().String())
+			if err := wtServer.Serve(conn); err != nil && !errors.Is(err, context.Canceled) {
+				fatal("WebTransport server error", "err", err)
+			}
+		}()
+	}
+	sockets.closeUnused()
+	// Let the server that handed over its sockets, if any, start draining,
+	// and tell systemd the server is up
+	notifyReady()
+	if err := sdNotify("READY=1"); err != nil {
+		slog.Warn("Error notifying systemd", "err", err)
+	}
+
+	// Keep systemd's watchdog fed while the server is live
+	if interval := watchdogInterval(); interval > 0 {
+		go func() {
+			ticker := time.NewTicker(interval / 2)
+			defer ticker.Stop()
+			for range ticker.C {
+				if chat.Healthy(server.Live()) {
+					sdNotify("WATCHDOG=1")
+				}
+			}
+		}()
+	}
+
+	// On SIGUSR2, start the (possibly upgraded) binary on the same sockets
+	// and drain this server once it is serving
+	var handedOff atomic.Bool
+	restart := make(chan os.Signal, 1)
+	notifyRestart(restart)
+	go func() {
+		for range restart {
+			slog.Info("Starting a new server to hand over to")
+			pid, err := startSuccessor(sockets, *handoffTimeout)
+			if err != nil {
+				slog.Error("Handover failed, carrying on", "err", err)
+				continue
+			}
+			slog.Info("New server is ready", "pid", pid)
+			sdNotify(fmt.Sprintf("MAINPID=%d", pid))
+			handedOff.Store(true)
+			stop <- syscall.SIGTERM
+			return
+		}
+	}()
 
+	// Reload the config file's limits and filters, credentials, bans, the
+	// MOTD and automod rules on SIGHUP, keeping everyone connected
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
 	go func() {
-		log.Printf("Chat server starting on %s", serverAddress)
-		log.Printf("Press Ctrl+C to stop the server")
-		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("Server error: %v", err)
+		for range hup {
+			slog.Info("Reloading configuration")
+			sdNotify("RELOADING=1")
+			if *configPath != "" {
+				if err := loadConfigFile(*configPath, flag.CommandLine, explicit); err != nil {
+					slog.Error("Error reloading config, keeping the previous settings", "err", err)
+				} else {
+					next := chat.DefaultConfig()
+					settings(&next)
+					if changes := server.Reload(next); len(changes) == 0 {
+						slog.Info("No settings changed")
+					}
+				}
+			}
+			if htpasswd != nil {
+				if err := htpasswd.Reload(); err != nil {
+					slog.Error("Error reloading credentials, keeping the previous ones", "err", err)
+				} else {
+					slog.Info("Reloaded credentials", "users", htpasswd.Len())
+				}
+			}
+			if tokenAuth != nil && *authTokensFile != "" {
+				if tokens, err := chat.LoadUserTokens(*authTokensFile); err != nil {
+					slog.Error("Error reloading tokens, keeping the previous ones", "err", err)
+				} else {
+					tokenAuth.SetUserTokens(tokens)
+					slog.Info("Reloaded tokens", "users", len(tokens))
+				}
+			}
+			if bans != nil {
+				if err := bans.Reload(); err != nil {
+					slog.Error("Error reloading bans, keeping the previous ones", "err", err)
+				} else if list, err := bans.ListBans(); err == nil {
+					slog.Info("Reloaded bans", "bans", len(list))
+				}
+			}
+			if *motdFile != "" {
+				if motd, err := chat.LoadMOTD(*motdFile); err != nil {
+					slog.Error("Error reloading MOTD, keeping the previous one", "err", err)
+				} else {
+					server.SetMOTD(motd)
+					slog.Info("Reloaded MOTD")
+				}
+			}
+			if *automodFile != "" {
+				rules, err := chat.LoadAutomodRules(*automodFile)
+				if err == nil {
+					err = server.SetAutomodRules(rules)
+				}
+				if err != nil {
+					slog.Error("Error reloading automod rules, keeping the previous ones", "err", err)
+				} else {
+					slog.Info("Reloaded automod rules", "rules", len(rules))
+				}
+			}
+			sdNotify("READY=1")
 		}
 	}()
 
-	// Wait for interrupt signal
+	// Let the operator at the terminal administer the server
+	if *console {
+		go server.RunConsole(os.Stdin, os.Stdout, func() { stop <- os.Interrupt })
+	}
+
+	// Wait for interrupt signal or the console's shutdown command
 	<-stop
-	log.Println("Shutting down server...")
+	// A second signal kills the server without waiting for the drain
+	signal.Reset(os.Interrupt, syscall.SIGTERM)
+	slog.Info("Shutting down server", "timeout", *shutdownTimeout)
+
+	// Drain the chat clients first, so they get a notice and a close frame
+	// rather than a reset, then stop the listener. The stores are closed
+	// (and flushed) by the deferred Close calls on the way out. After a
+	// handover the new server is accepting on the same sockets, so they
+	// are closed here first and reconnecting clients reach it.
+	if handedOff.Load() {
+		sockets.closeAll()
+	} else {
+		sdNotify("STOPPING=1")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		slog.Warn("Not all clients disconnected in time", "err", err)
+	}
+	stopRun()
+	if err := srv.Shutdown(ctx); err != nil && !errors.Is(err, net.ErrClosed) {
+		slog.Warn("Error stopping HTTP server", "err", err)
+	}
+	if grpcServer != nil {
+		// The streams have been drained with the other clients
+		grpcServer.Stop()
+	}
+	if wtServer != nil {
+		wtServer.Close()
+	}
+	slog.Info("Server stopped")
+}
+
+// fatal logs an error and exits
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// openUserStore opens the account store at spec: an SQLite database for
+// sqlite://path, Postgres for a postgres:// URL, or otherwise a JSON file
+func openUserStore(spec string) (chat.UserStore, error) {
+	switch {
+	case strings.HasPrefix(spec, "sqlite://"):
+		return chat.OpenSQLUserStore("sqlite", strings.TrimPrefix(spec, "sqlite://"))
+	case strings.HasPrefix(spec, "postgres://"), strings.HasPrefix(spec, "postgresql://"):
+		return chat.OpenSQLUserStore("pgx", spec)
+	default:
+		return chat.OpenFileUserStore(spec)
+	}
+}
+
+// openBackplane connects to the backplane at rawURL, picking the bus by the
+// URL's scheme
+func openBackplane(rawURL, channel string) (chat.Backplane, error) {
+	scheme, _, _ := strings.Cut(rawURL, "://")
+	switch scheme {
+	case "redis", "rediss":
+		return chat.NewRedisBackplane(chat.RedisConfig{URL: rawURL, Channel: channel})
+	case "nats", "tls":
+		return chat.NewNATSBackplane(chat.NATSConfig{URL: rawURL, Subject: channel})
+	default:
+		return nil, fmt.Errorf("unsupported backplane %q (want redis://, rediss://, nats:// or tls://)", rawURL)
+	}
+}
+
+// serverVersion returns version, or the module version recorded by go
+// install when it wasn't set at build time
+func serverVersion() string {
+	if version != "dev" {
+		return version
+	}
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" && info.Main.Version != "(devel)" {
+		return info.Main.Version
+	}
+	return version
 }
@@ -0,0 +1,98 @@
+// cmd/server/systemd.go
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sdListenFDsStart is the first file descriptor systemd passes sockets on
+const sdListenFDsStart = 3
+
+// systemdListeners returns the sockets passed by systemd socket
+// activation, keyed by the listener they stand in for. Sockets named with
+// FileDescriptorName= after a listener ("main", "main-1", "acme" or
+// "debug") replace it; the rest serve chat, in order.
+func systemdListeners() (map[string]*os.File, error) {
+	pid, fds := os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS")
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	if fds == "" || pid != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(fds)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS %q", fds)
+	}
+
+	files := make(map[string]*os.File, n)
+	chat := 0
+	for i := range n {
+		name := ""
+		if i < len(names) {
+			name = names[i]
+		}
+		if _, taken := files[name]; taken || !listenerName(name) {
+			name = "main"
+			if chat > 0 {
+				name = fmt.Sprintf("main-%d", chat)
+			}
+			chat++
+		}
+		files[name] = os.NewFile(uintptr(sdListenFDsStart+i), name)
+	}
+	return files, nil
+}
+
+// listenerName reports whether name is one of the server's listeners
+func listenerName(name string) bool {
+	if name == "main" || name == "acme" || name == "debug" {
+		return true
+	}
+	n, ok := strings.CutPrefix(name, "main-")
+	if !ok {
+		return false
+	}
+	_, err := strconv.Atoi(n)
+	return err == nil
+}
+
+// sdNotify sends a state change such as "READY=1" to systemd when the
+// server runs as a Type=notify service, and does nothing otherwise
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	// A leading @ means a socket in the abstract namespace
+	if strings.HasPrefix(socket, "@") {
+		socket = "\x00" + socket[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// watchdogInterval returns how often systemd expects a WATCHDOG=1 ping,
+// or zero if the watchdog is off
+func watchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
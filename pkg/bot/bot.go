@@ -0,0 +1,424 @@
+// pkg/bot/bot.go
+
+// Package bot is a framework for chat bots built on chat.Client. It routes
+// commands such as "!weather paris" to handlers, paces what the bot sends
+// to stay within the server's rate limits, and reconnects when the
+// connection drops.
+package bot
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/ryk-9/go-chat/pkg/chat"
+)
+
+// Defaults for Options
+const (
+	DefaultPrefix = "!"
+	// DefaultRate and DefaultBurst stay under the server's default flood
+	// control, 5 messages per second with bursts of 10
+	DefaultRate         = 2
+	DefaultBurst        = 5
+	DefaultReconnectMin = time.Second
+	DefaultReconnectMax = time.Minute
+)
+
+// sendQueueSize is how many messages may wait to be sent; Send blocks
+// while the queue is full
+const sendQueueSize = 100
+
+// rateLimitPause is how long the bot stops sending when the server says it
+// is sending too fast
+const rateLimitPause = time.Second
+
+// errStopped is returned by Send and Whisper once Run has returned
+var errStopped = errors.New("bot stopped")
+
+// Options holds a bot's settings. The zero value uses the defaults.
+type Options struct {
+	// Client holds the connection's settings, such as credentials
+	Client chat.ClientOptions
+
+	// Room is the room the bot joins, by default chat.DefaultRoom
+	Room string
+
+	// Prefix starts commands, by default DefaultPrefix
+	Prefix string
+
+	// Rate and Burst limit how fast the bot sends, in messages per second
+	// with bursts of up to Burst, by default DefaultRate and DefaultBurst
+	Rate  float64
+	Burst int
+
+	// ReconnectMin is the wait before the first attempt to reconnect,
+	// doubling after each failed one up to ReconnectMax. By default they
+	// are DefaultReconnectMin and DefaultReconnectMax.
+	ReconnectMin time.Duration
+	ReconnectMax time.Duration
+
+	// Logger receives the bot's log output, by default slog.Default()
+	Logger *slog.Logger
+}
+
+// HandlerFunc handles a command or message to a bot. ctx is the one Run
+// was given.
+type HandlerFunc func(ctx context.Context, msg *Message)
+
+// Message is a room message or whisper from another user
+type Message struct {
+	chat.ClientMessage
+
+	// Command is the name of the command sent, without the prefix, as in
+	// "weather", and Args what followed it. Both are empty for messages
+	// that aren't commands.
+	Command string
+	Args    string
+
+	bot *Bot
+}
+
+// Reply answers msg with a whisper if it was one, otherwise in the room
+func (m *Message) Reply(text string) error {
+	if m.Private {
+		return m.bot.Whisper(m.From, text)
+	}
+	return m.bot.Send(text)
+}
+
+// command is a command added with Command
+type command struct {
+	help    string
+	handler HandlerFunc
+}
+
+// outgoing is a message waiting to be sent: a whisper to to, or a room
+// message or command if to is ""
+type outgoing struct {
+	to   string
+	text string
+}
+
+// Bot is a chat bot. Add its commands and handlers, then Run it.
+type Bot struct {
+	server   string
+	username string
+	opts     Options
+	log      *slog.Logger
+
+	commands  map[string]command
+	onMessage HandlerFunc
+
+	running atomic.Bool
+	stopped chan struct{}
+
+	// outbox holds the messages waiting to be sent. pending is one taken
+	// from it but not sent yet, and pacer paces those sent; both are used
+	// by one connection's sender at a time.
+	outbox  chan outgoing
+	pending *outgoing
+	pacer   pacer
+
+	// pauseUntil is when the bot may send again after the server told it
+	// to slow down, in Unix nanoseconds
+	pauseUntil atomic.Int64
+}
+
+// New returns a bot that will join the server at serverAddr, a host:port
+// or URL as given to chat.NewClient, as username
+func New(serverAddr, username string, opts Options) *Bot {
+	if opts.Room == "" {
+		opts.Room = chat.DefaultRoom
+	}
+	if opts.Prefix == "" {
+		opts.Prefix = DefaultPrefix
+	}
+	if opts.Rate <= 0 {
+		opts.Rate = DefaultRate
+	}
+	if opts.Burst <= 0 {
+		opts.Burst = DefaultBurst
+	}
+	if opts.ReconnectMin <= 0 {
+		opts.ReconnectMin = DefaultReconnectMin
+	}
+	if opts.ReconnectMax < opts.ReconnectMin {
+		opts.ReconnectMax = max(DefaultReconnectMax, opts.ReconnectMin)
+	}
+	if opts.Logger == nil {
+		opts.Logger = slog.Default()
+	}
+	return &Bot{
+		server:   serverAddr,
+		username: username,
+		opts:     opts,
+		log:      opts.Logger.With("bot", username),
+		commands: map[string]command{},
+		stopped:  make(chan struct{}),
+		outbox:   make(chan outgoing, sendQueueSize),
+		pacer:    pacer{rate: opts.Rate, burst: float64(opts.Burst), tokens: float64(opts.Burst), last: time.Now()},
+	}
+}
+
+// Command adds a command, sent as the prefix and name, as in "!weather".
+// help describes it in the reply to "!help", which the bot answers unless
+// it is given a help command. Commands must be added before Run.
+func (b *Bot) Command(name, help string, handler HandlerFunc) {
+	b.commands[name] = command{help: help, handler: handler}
+}
+
+// OnMessage sets the handler for other users' messages that aren't one of
+// the bot's commands. It must be set before Run.
+func (b *Bot) OnMessage(handler HandlerFunc) {
+	b.onMessage = handler
+}
+
+// Username returns the name the bot joins as
+func (b *Bot) Username() string {
+	return b.username
+}
+
+// Send queues a message for the bot's room, or a command, waiting while
+// the queue is full. Messages queued while the bot is disconnected are
+// sent once it reconnects.
+func (b *Bot) Send(text string) error {
+	return b.queue(outgoing{text: text})
+}
+
+// Whisper queues a private message to username, like Send
+func (b *Bot) Whisper(username, text string) error {
+	return b.queue(outgoing{to: username, text: text})
+}
+
+// queue adds msg to the outbox, unless the bot has stopped
+func (b *Bot) queue(msg outgoing) error {
+	select {
+	case <-b.stopped:
+		return errStopped
+	default:
+	}
+	select {
+	case b.outbox <- msg:
+		return nil
+	case <-b.stopped:
+		return errStopped
+	}
+}
+
+// Run connects the bot and keeps it connected until ctx is done, waiting
+// longer between attempts while reconnecting fails. It returns nil once
+// ctx is done, or chat.ErrCredentialsRejected if the server turns down the
+// bot's credentials, as trying again wouldn't help. Handlers run on their
+// own goroutines, so a slow one doesn't hold up the others.
+func (b *Bot) Run(ctx context.Context) error {
+	if !b.running.CompareAndSwap(false, true) {
+		return errors.New("bot already running")
+	}
+	defer close(b.stopped)
+
+	backoff := b.opts.ReconnectMin
+	for {
+		connected, err := b.connect(ctx)
+		if errors.Is(err, chat.ErrCredentialsRejected) {
+			return err
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+		if connected {
+			backoff = b.opts.ReconnectMin
+		}
+		b.log.Warn("Reconnecting", "in", backoff, "err", err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil
+		}
+		backoff = min(backoff*2, b.opts.ReconnectMax)
+	}
+}
+
+// connect makes one connection and sends and handles messages until it
+// ends or ctx is done. It reports whether the connection was made, and
+// why it ended.
+func (b *Bot) connect(ctx context.Context) (bool, error) {
+	client := chat.NewClient(b.server, b.username, b.opts.Client)
+	var (
+		joined bool
+		ended  error
+	)
+	client.OnMessage(func(msg chat.ClientMessage) {
+		b.receive(ctx, msg)
+	})
+	client.OnEvent(func(event chat.ClientEvent) {
+		switch event.Type {
+		case chat.ClientJoined:
+			// Move to the bot's room once the server has taken it in
+			if !joined && event.Room != b.opts.Room {
+				client.Join(b.opts.Room)
+			}
+			joined = true
+		case chat.ClientDisconnected:
+			ended = event.Err
+			if event.Text != "" {
+				ended = errors.New(event.Text)
+			} else if ended == nil {
+				ended = errors.New("connection closed")
+			}
+		}
+	})
+	if err := client.Connect(ctx); err != nil {
+		return false, err
+	}
+	b.log.Info("Connected", "server", b.server)
+
+	stop := make(chan struct{})
+	sent := make(chan struct{})
+	go func() {
+		defer close(sent)
+		b.send(client, stop)
+	}()
+	select {
+	case <-client.Done():
+	case <-ctx.Done():
+		client.Close()
+	}
+	close(stop)
+	<-sent
+	// ended was set by the last event, before Done was closed
+	return true, ended
+}
+
+// send sends the queued messages on client until stop is closed, within
+// the bot's rate and pausing when the server says to slow down. A message
+// that couldn't be sent because the connection ended is kept for the next
+// one.
+func (b *Bot) send(client *chat.Client, stop <-chan struct{}) {
+	for {
+		if b.pending == nil {
+			select {
+			case msg := <-b.outbox:
+				b.pending = &msg
+			case <-stop:
+				return
+			}
+		}
+
+		now := time.Now()
+		wait := max(b.pacer.take(now), time.Unix(0, b.pauseUntil.Load()).Sub(now))
+		if wait > 0 {
+			select {
+			case <-time.After(wait):
+			case <-stop:
+				return
+			}
+		}
+
+		var err error
+		if b.pending.to != "" {
+			err = client.Whisper(b.pending.to, b.pending.text)
+		} else {
+			err = client.Send(b.pending.text)
+		}
+		if err != nil {
+			// A write fails as the connection ends; give the reader a
+			// moment to notice before giving up on the message
+			select {
+			case <-client.Done():
+				<-stop
+				return
+			case <-time.After(time.Second):
+				b.log.Warn("Error sending", "err", err)
+			}
+		}
+		b.pending = nil
+	}
+}
+
+// receive hands commands and other users' messages to their handlers, and
+// pauses sending when the server says the bot is sending too fast
+func (b *Bot) receive(ctx context.Context, msg chat.ClientMessage) {
+	if msg.From == "" {
+		b.throttle(msg.Line)
+		return
+	}
+	if strings.EqualFold(msg.From, b.username) {
+		return
+	}
+
+	m := &Message{ClientMessage: msg, bot: b}
+	if rest, ok := strings.CutPrefix(strings.TrimSpace(msg.Text), b.opts.Prefix); ok && rest != "" {
+		m.Command, m.Args, _ = strings.Cut(rest, " ")
+		m.Args = strings.TrimSpace(m.Args)
+	}
+	if cmd, ok := b.commands[m.Command]; ok {
+		go cmd.handler(ctx, m)
+	} else if m.Command == "help" {
+		go m.Reply(b.help())
+	} else if b.onMessage != nil {
+		go b.onMessage(ctx, m)
+	}
+}
+
+// throttle pauses sending if line is the server refusing a message for
+// coming too fast, as in "ERROR: Rate limit exceeded. Slow down." or
+// "Slow mode is on: ... Please wait 4.5s."
+func (b *Bot) throttle(line string) {
+	pause := time.Duration(0)
+	if strings.HasPrefix(line, "ERROR: Rate limit exceeded.") {
+		pause = rateLimitPause
+	} else if _, wait, ok := strings.Cut(line, "Please wait "); ok {
+		pause, _ = time.ParseDuration(strings.TrimSuffix(wait, "."))
+	}
+	if pause <= 0 {
+		return
+	}
+	b.log.Debug("Told to slow down", "pause", pause)
+	until := time.Now().Add(pause).UnixNano()
+	if until > b.pauseUntil.Load() {
+		b.pauseUntil.Store(until)
+	}
+}
+
+// help lists the bot's commands
+func (b *Bot) help() string {
+	names := make([]string, 0, len(b.commands))
+	for name := range b.commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for i, name := range names {
+		names[i] = b.opts.Prefix + name
+		if help := b.commands[name].help; help != "" {
+			names[i] += " - " + help
+		}
+	}
+	if len(names) == 0 {
+		return "No commands."
+	}
+	return "Commands: " + strings.Join(names, "; ")
+}
+
+// pacer is a token bucket spacing out messages
+type pacer struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// take takes a token, returning how long to wait until it is due
+func (p *pacer) take(now time.Time) time.Duration {
+	p.tokens = min(p.burst, p.tokens+now.Sub(p.last).Seconds()*p.rate)
+	p.last = now
+	p.tokens--
+	if p.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-p.tokens / p.rate * float64(time.Second))
+}
@@ -0,0 +1,114 @@
+// pkg/bot/bot_test.go
+package bot
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ryk-9/go-chat/pkg/chat"
+)
+
+// TestBot has a user run a bot's commands in a room and by whisper, and
+// checks that the bot comes back after being disconnected
+func TestBot(t *testing.T) {
+	discard := slog.New(slog.NewTextHandler(io.Discard, nil))
+	server := chat.NewServerWithConfig(chat.Config{Logger: discard})
+	ts := httptest.NewServer(http.HandlerFunc(server.HandleWebSocket))
+	defer ts.Close()
+	url := "ws" + strings.TrimPrefix(ts.URL, "http")
+
+	b := New(url, "echobot", Options{Room: "dev", ReconnectMin: 10 * time.Millisecond, Logger: discard})
+	b.Command("echo", "Repeat what you say", func(ctx context.Context, msg *Message) {
+		msg.Reply(msg.Args)
+	})
+	b.OnMessage(func(ctx context.Context, msg *Message) {
+		if msg.Private {
+			msg.Reply("you said: " + msg.Text)
+		}
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error)
+	go func() { stopped <- b.Run(ctx) }()
+
+	messages := make(chan chat.ClientMessage, 100)
+	alice := chat.NewClient(url, "alice", chat.ClientOptions{})
+	alice.OnMessage(func(msg chat.ClientMessage) { messages <- msg })
+	if err := alice.Connect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Close()
+	alice.Join("dev")
+	// waitBot sends text, again every so often while the bot may be
+	// reconnecting, until the bot answers with want
+	waitBot := func(text, want string) {
+		t.Helper()
+		timeout := time.After(5 * time.Second)
+		for {
+			alice.Send(text)
+			retry := time.After(250 * time.Millisecond)
+			for {
+				select {
+				case msg := <-messages:
+					if msg.From == "echobot" && msg.Text == want {
+						return
+					}
+					continue
+				case <-retry:
+				case <-timeout:
+					t.Fatalf("%s: no %q from echobot", text, want)
+				}
+				break
+			}
+		}
+	}
+
+	waitBot("!echo hello", "hello")
+	waitBot("!help", "Commands: !echo - Repeat what you say")
+	waitBot("/whisper echobot psst", "you said: psst")
+
+	// Drop the bot's connection; it reconnects to dev
+	if !server.Disconnect("echobot", "testing") {
+		t.Fatal("echobot not connected")
+	}
+	waitBot("!echo again", "again")
+
+	cancel()
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Errorf("Run returned %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run didn't return after its context was cancelled")
+	}
+	if err := b.Send("late"); err != errStopped {
+		t.Errorf("Send after Run got %v", err)
+	}
+}
+
+// TestPacer checks that a pacer lets a burst through, then spaces out
+// what follows at its rate
+func TestPacer(t *testing.T) {
+	now := time.Now()
+	p := pacer{rate: 2, burst: 3, tokens: 3, last: now}
+	for i := 0; i < 3; i++ {
+		if wait := p.take(now); wait != 0 {
+			t.Fatalf("message %d of the burst waits %v", i+1, wait)
+		}
+	}
+	if wait := p.take(now); wait != 500*time.Millisecond {
+		t.Errorf("after the burst, waits %v", wait)
+	}
+	if wait := p.take(now); wait != time.Second {
+		t.Errorf("then waits %v", wait)
+	}
+	if wait := p.take(now.Add(10 * time.Second)); wait != 0 {
+		t.Errorf("after a rest, waits %v", wait)
+	}
+}
@@ -0,0 +1,39 @@
+// pkg/chat/access.go
+package chat
+
+import (
+	"time"
+)
+
+// upgradeRequest is the access log entry for one WebSocket upgrade
+// request, filled in by HandleWebSocket as it goes
+type upgradeRequest struct {
+	start     time.Time
+	ip        string
+	userAgent string
+	username  string
+	result    string
+}
+
+// logUpgrade writes the access log entry for req: who asked, which user
+// they became, and whether they got in or why not
+func (s *Server) logUpgrade(req *upgradeRequest) {
+	if s.accessLog == nil {
+		return
+	}
+	s.accessLog.Info("Upgrade request", "remote_addr", req.ip, "user_agent", req.userAgent,
+		"username", req.username, "result", req.result, "duration", time.Since(req.start))
+}
+
+// logConnection writes the access log summary of a client's connection
+// once it has closed. Only ReadPump may call it, after unregistering c.
+func (c *Session) logConnection() {
+	if c.Server.accessLog == nil {
+		return
+	}
+	c.Server.accessLog.Info("Connection closed", "remote_addr", c.IP, "user_agent", c.UserAgent,
+		"username", c.Username, "duration", time.Since(c.joinedAt),
+		"messages_received", c.receivedMessages, "bytes_received", c.receivedBytes,
+		"messages_sent", c.sentMessages.Load(), "bytes_sent", c.sentBytes.Load(),
+		"messages_dropped", c.dropped.Load())
+}
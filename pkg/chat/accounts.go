@@ -0,0 +1,217 @@
+// pkg/chat/accounts.go
+package chat
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Account login settings
+const (
+	minPasswordLength = 8
+	loginTimeout      = 60 * time.Second
+	maxLoginAttempts  = 3
+)
+
+// redactSecrets hides passwords in commands before they are logged
+func redactSecrets(msg string) string {
+	for _, cmd := range []string{"/register ", "/login ", "/email verify ", "/push subscribe "} {
+		if strings.HasPrefix(msg, cmd) {
+			return cmd + "********"
+		}
+	}
+	return msg
+}
+
+// roleRank orders roles by privilege so the stronger of two can be picked
+func roleRank(r Role) int {
+	switch r {
+	case RoleGuest:
+		return 0
+	case RoleModerator:
+		return 2
+	case RoleAdmin:
+		return 3
+	default:
+		return 1
+	}
+}
+
+// hashPassword returns a bcrypt hash suitable for User.PasswordHash
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// checkPassword reports whether password matches the account's hash
+func checkPassword(user User, password string) bool {
+	if user.PasswordHash == "" {
+		return false
+	}
+	return bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)) == nil
+}
+
+// claimAccount makes sure a connection using a registered username owns
+// the account, either through the authenticator, Basic credentials on the
+// upgrade request, or by answering a /login prompt. It returns the account
+// (the zero User if the name isn't registered) and false if the connection
+// should be dropped.
+func (s *Server) claimAccount(conn wsConn, r *http.Request, username string, identity Identity) (User, bool) {
+	account, err := s.getUser(r.Context(), username)
+	if errors.Is(err, ErrUserNotFound) {
+		return User{}, true
+	}
+	if err != nil {
+		s.log.Error("Error looking up account", "username", username, "err", err)
+		conn.WriteMessage(websocket.TextMessage, []byte("ERROR: Could not verify your account. Please try again later."))
+		return User{}, false
+	}
+
+	// The authenticator already vouched for this exact user
+	if identity.Username != "" && sameUsername(identity.Username, username) {
+		return account, true
+	}
+
+	ip := s.clientIP(r)
+	if wait, locked := s.loginLocked(username, ip); locked {
+		conn.WriteMessage(websocket.TextMessage, []byte(lockedOutMessage(wait)))
+		return User{}, false
+	}
+
+	if user, password, ok := r.BasicAuth(); ok && strings.EqualFold(user, username) {
+		if checkPassword(account, password) {
+			s.logins.succeed(username)
+			return account, true
+		}
+		s.log.Warn("Invalid handshake password", "username", username, "remote_addr", ip)
+		s.audit(AuditLoginFailure, "", username, ip, "invalid handshake password")
+		s.loginFailed(username, ip)
+		conn.WriteMessage(websocket.TextMessage, []byte("ERROR: Invalid password for this username."))
+		return User{}, false
+	}
+
+	return account, s.awaitLogin(conn, account, ip)
+}
+
+// awaitLogin asks the connection from ip to prove it owns account with
+// /login before it joins the chat
+func (s *Server) awaitLogin(conn wsConn, account User, ip string) bool {
+	conn.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf(
+		"The username %s is registered. Type /login <password> within %d seconds to continue.",
+		account.Username, int(loginTimeout.Seconds()))))
+
+	conn.SetReadDeadline(time.Now().Add(loginTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	for attempt := 1; attempt <= maxLoginAttempts; {
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			s.log.Info("Login abandoned", "username", account.Username, "remote_addr", ip, "err", err)
+			conn.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf(
+				"ERROR: %s: Login timed out for this registered username.", ErrUsernameReserved)))
+			return false
+		}
+
+		password, ok := strings.CutPrefix(string(message), "/login ")
+		if !ok {
+			conn.WriteMessage(websocket.TextMessage, []byte("Please log in first: /login <password>"))
+			continue
+		}
+
+		if checkPassword(account, password) {
+			s.logins.succeed(account.Username)
+			return true
+		}
+		s.log.Warn("Failed login attempt", "username", account.Username, "remote_addr", ip, "attempt", attempt)
+		s.audit(AuditLoginFailure, "", account.Username, ip, fmt.Sprintf("attempt %d", attempt))
+		s.loginFailed(account.Username, ip)
+		if wait, locked := s.loginLocked(account.Username, ip); locked {
+			conn.WriteMessage(websocket.TextMessage, []byte(lockedOutMessage(wait)))
+			return false
+		}
+		conn.WriteMessage(websocket.TextMessage, []byte("Invalid password."))
+		attempt++
+	}
+
+	conn.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf(
+		"ERROR: %s: Too many failed login attempts for this registered username.", ErrUsernameReserved)))
+	return false
+}
+
+// handleRegister implements /register <password>, claiming the current
+// username so nobody else can use it without the password
+func (c *Session) handleRegister(password string) {
+	if len(password) < minPasswordLength {
+		c.send(fmt.Sprintf(
+			"Usage: /register <password> (at least %d characters)", minPasswordLength))
+		return
+	}
+
+	hash, err := hashPassword(password)
+	if err != nil {
+		c.logger().Error("Error hashing password", "err", err)
+		c.send("Registration failed, please try again.")
+		return
+	}
+
+	err = c.Server.Users.CreateUser(User{
+		Username:     c.Username,
+		PasswordHash: hash,
+		Role:         RoleUser,
+	})
+	if errors.Is(err, ErrUserExists) {
+		c.send("This username is already registered.")
+		return
+	}
+	if err != nil {
+		c.logger().Error("Error registering account", "err", err)
+		c.send("Registration failed, please try again.")
+		return
+	}
+
+	c.LoggedIn = true
+	c.logger().Info("Registered account")
+	c.Server.audit(AuditRegister, c.Username, "", c.IP, "")
+	c.send(fmt.Sprintf(
+		"Registered %s. From now on, connect with your password or use /login <password>.", c.Username))
+}
+
+// handleLogin implements /login <password> for a client that has already
+// joined. Registered names must log in before joining, so this only
+// confirms the current state.
+func (c *Session) handleLogin(password string) {
+	if c.LoggedIn {
+		c.send(fmt.Sprintf("You are already logged in as %s.", c.Username))
+		return
+	}
+
+	account, err := c.Server.getUser(c.ctx, c.Username)
+	if errors.Is(err, ErrUserNotFound) {
+		c.send("This username is not registered. Use /register <password> to claim it.")
+		return
+	}
+	if wait, locked := c.Server.loginLocked(c.Username, c.IP); locked {
+		c.send(fmt.Sprintf(
+			"Too many failed login attempts. Try again in %s.", wait.Round(time.Second)))
+		return
+	}
+	if err != nil || !checkPassword(account, password) {
+		c.Server.audit(AuditLoginFailure, c.Username, c.Username, c.IP, "/login")
+		c.Server.loginFailed(c.Username, c.IP)
+		c.send("Invalid password.")
+		return
+	}
+
+	c.Server.logins.succeed(c.Username)
+	c.LoggedIn = true
+	c.send(fmt.Sprintf("Logged in as %s.", c.Username))
+}
@@ -0,0 +1,595 @@
+// pkg/chat/admin.go
+package chat
+
+import (
+	"crypto/subtle"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AdminHandler returns the HTTP handler for the /admin/ endpoints. Every
+// request must carry the configured admin token, either as
+// "Authorization: Bearer <token>" or in the X-Admin-Token header. If no
+// token is configured the admin API is disabled entirely.
+func (s *Server) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/clients", s.handleAdminClients)
+	mux.HandleFunc("/admin/disconnect", s.handleAdminDisconnect)
+	mux.HandleFunc("/admin/stats", s.handleAdminStats)
+	mux.HandleFunc("/admin/export", s.handleAdminExport)
+	mux.HandleFunc("/admin/erase", s.handleAdminErase)
+	mux.HandleFunc("/admin/bans", s.handleAdminBans)
+	mux.HandleFunc("/admin/shadowbans", s.handleAdminShadowbans)
+	mux.HandleFunc("/admin/announce", s.handleAdminAnnounce)
+	mux.HandleFunc("/admin/messages", s.handleAdminMessages)
+	mux.HandleFunc("/admin/audit", s.handleAdminAudit)
+	return s.RequireAdmin(mux)
+}
+
+// RequireAdmin rejects requests that don't present the admin token, so
+// other endpoints can be protected like the admin API
+func (s *Server) RequireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.Config.AdminToken == "" {
+			http.Error(w, "admin API disabled", http.StatusNotFound)
+			return
+		}
+
+		ip := s.clientIP(r)
+		if wait, locked := s.loginLocked("", ip); locked {
+			lockedOutError(w, wait)
+			return
+		}
+
+		token := r.Header.Get("X-Admin-Token")
+		if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+			token = strings.TrimPrefix(auth, "Bearer ")
+		}
+		if subtle.ConstantTimeCompare([]byte(token), []byte(s.Config.AdminToken)) != 1 {
+			s.log.Warn("Rejected admin request: invalid token", "remote_addr", ip, "path", r.URL.Path)
+			s.audit(AuditAuthFailure, "", r.URL.Path, ip, "invalid admin token")
+			s.loginFailed("", ip)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="go-chat admin"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ClientInfo describes a connected client for the admin API
+type ClientInfo struct {
+	Username  string    `json:"username"`
+	Role      Role      `json:"role"`
+	Room      string    `json:"room"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	LoggedIn  bool      `json:"logged_in"`
+	Encrypted bool      `json:"encrypted"`
+	JoinedAt  time.Time `json:"joined_at"`
+
+	// QueuedMessages and QueuedBytes are what is waiting to be written to
+	// the client
+	QueuedMessages int   `json:"queued_messages"`
+	QueuedBytes    int64 `json:"queued_bytes"`
+}
+
+// ClientInfos returns the connected clients, longest connected first
+func (s *Server) ClientInfos() []ClientInfo {
+	infos := make([]ClientInfo, 0, s.clients.len())
+	s.clients.each(func(client *Session) {
+		infos = append(infos, ClientInfo{
+			Username:  client.Username,
+			Role:      client.Role,
+			Room:      client.Room,
+			IP:        client.IP,
+			UserAgent: client.UserAgent,
+			LoggedIn:  client.LoggedIn,
+			Encrypted: client.PublicKey != "",
+			JoinedAt:  client.joinedAt,
+
+			QueuedMessages: len(client.outbox),
+			QueuedBytes:    client.queuedBytes.Load(),
+		})
+	})
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].JoinedAt.Before(infos[j].JoinedAt) })
+	return infos
+}
+
+// handleAdminClients lists connected clients and disconnects them.
+// GET /admin/clients
+// DELETE /admin/clients?user=<name>&reason=<text>
+func (s *Server) handleAdminClients(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.ClientInfos())
+
+	case http.MethodDelete:
+		username := r.URL.Query().Get("user")
+		if username == "" {
+			http.Error(w, "user is required", http.StatusBadRequest)
+			return
+		}
+		if !s.KickUser(username, r.URL.Query().Get("reason"), "admin API") {
+			http.Error(w, "user is not connected", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleAdminDisconnect quietly closes a client's connection, unlike a
+// kick, which is announced to everyone.
+// POST /admin/disconnect?user=<name>&reason=<text>
+func (s *Server) handleAdminDisconnect(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	username := r.URL.Query().Get("user")
+	if username == "" {
+		http.Error(w, "user is required", http.StatusBadRequest)
+		return
+	}
+	reason := r.URL.Query().Get("reason")
+	if reason == "" {
+		reason = "Disconnected by an administrator"
+	}
+	if !s.Disconnect(username, reason) {
+		http.Error(w, "user is not connected", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Stats summarizes the server's activity for the admin API
+type Stats struct {
+	StartedAt         time.Time  `json:"started_at"`
+	UptimeSeconds     int64      `json:"uptime_seconds"`
+	Clients           int        `json:"clients"`
+	RemoteClients     int        `json:"remote_clients"`
+	Guests            int        `json:"guests"`
+	MaxClients        int        `json:"max_clients"`
+	PeakClients       int        `json:"peak_clients"`
+	PeakClientsAt     time.Time  `json:"peak_clients_at"`
+	Rooms             int        `json:"rooms"`
+	RoomMembers       []RoomInfo `json:"room_members"`
+	Connections       int64      `json:"connections"`
+	Messages          int64      `json:"messages"`
+	MessagesPerSecond float64    `json:"messages_per_second"`
+	Bans              int        `json:"bans"`
+	Shadowbans        int        `json:"shadowbans"`
+}
+
+// Stats returns the server's current statistics. Connections and Messages
+// count joins and room messages since the server started, and PeakClients
+// is the most users connected at once in that time. RemoteClients are the
+// users connected to other instances sharing the backplane.
+func (s *Server) Stats() (Stats, error) {
+	rooms := s.GetRoomList()
+	stats := Stats{
+		StartedAt:         s.startedAt,
+		UptimeSeconds:     int64(time.Since(s.startedAt).Seconds()),
+		MaxClients:        s.config().MaxClients,
+		Rooms:             len(rooms),
+		RoomMembers:       rooms,
+		Connections:       s.connections.Load(),
+		Messages:          s.messages.Load(),
+		MessagesPerSecond: s.messageRate.perSecond(time.Now()),
+		Shadowbans:        len(s.Shadowbans()),
+	}
+	stats.PeakClients, stats.PeakClientsAt = s.peak()
+
+	stats.Clients = s.clients.len()
+	stats.RemoteClients = len(s.remote.users())
+	s.clients.each(func(client *Session) {
+		if client.Role == RoleGuest {
+			stats.Guests++
+		}
+	})
+
+	bans, err := s.Bans.ListBans()
+	if err != nil {
+		return stats, err
+	}
+	stats.Bans = len(bans)
+	return stats, nil
+}
+
+// handleAdminStats reports server statistics.
+// GET /admin/stats
+func (s *Server) handleAdminStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	stats, err := s.Stats()
+	if err != nil {
+		s.log.Error("Error collecting stats", "err", err)
+		http.Error(w, "could not collect stats", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+// handleAdminExport streams a room's message history as JSON or CSV
+func (s *Server) handleAdminExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	room := r.URL.Query().Get("room")
+	if room == "" {
+		room = DefaultRoom
+	}
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "json"
+	}
+
+	var contentType string
+	var export func(http.ResponseWriter, string) error
+	switch format {
+	case "json":
+		contentType, export = "application/json", s.exportJSON
+	case "csv":
+		contentType, export = "text/csv", s.exportCSV
+	default:
+		http.Error(w, "format must be json or csv", http.StatusBadRequest)
+		return
+	}
+
+	filename := fmt.Sprintf("%s-%s.%s", room, time.Now().Format("20060102-150405"), format)
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	if err := export(w, room); err != nil {
+		s.log.Error("Error exporting room", "room", room, "err", err)
+		return
+	}
+
+	s.requestLogger(r).Info("Exported room history", "room", room, "format", format)
+	s.audit(AuditAdmin, "admin API", room, s.clientIP(r), "export "+format)
+}
+
+// EraseResult reports what an erase request removed
+type EraseResult struct {
+	User     string `json:"user"`
+	Mode     string `json:"mode"`
+	Messages int    `json:"messages"`
+	Account  bool   `json:"account"`
+}
+
+// handleAdminErase deletes or anonymizes everything stored about a user.
+// POST /admin/erase?user=<name>&mode=delete|anonymize
+func (s *Server) handleAdminErase(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	username := r.URL.Query().Get("user")
+	if username == "" {
+		http.Error(w, "user is required", http.StatusBadRequest)
+		return
+	}
+	mode := r.URL.Query().Get("mode")
+	if mode == "" {
+		mode = "delete"
+	}
+	if mode != "delete" && mode != "anonymize" {
+		http.Error(w, "mode must be delete or anonymize", http.StatusBadRequest)
+		return
+	}
+
+	result, err := s.EraseUser(username, mode == "anonymize")
+	if err != nil {
+		s.log.Error("Error erasing user data", "username", username, "err", err)
+		http.Error(w, "erase failed", http.StatusInternalServerError)
+		return
+	}
+
+	s.requestLogger(r).Info("Erased user data", "username", username, "mode", mode, "messages", result.Messages)
+	s.audit(AuditAdmin, "admin API", username, s.clientIP(r), "erase "+mode)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// handleAdminBans lists, adds and lifts bans.
+// GET /admin/bans
+// POST /admin/bans?user=<name>&ip=<addr>&reason=<text>&duration=<e.g. 24h>
+// DELETE /admin/bans?user=<name>&ip=<addr>
+func (s *Server) handleAdminBans(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	username, ip := query.Get("user"), query.Get("ip")
+
+	switch r.Method {
+	case http.MethodGet:
+		bans, err := s.Bans.ListBans()
+		if err != nil {
+			s.log.Error("Error listing bans", "err", err)
+			http.Error(w, "could not list bans", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(bans)
+
+	case http.MethodPost:
+		if username == "" && ip == "" {
+			http.Error(w, "user or ip is required", http.StatusBadRequest)
+			return
+		}
+		ban := Ban{Username: username, IP: ip, Reason: query.Get("reason"), By: "admin API"}
+		if d := query.Get("duration"); d != "" {
+			duration, ok := parseLongDuration(d)
+			if !ok {
+				http.Error(w, "duration must be a positive duration such as 24h or 7d", http.StatusBadRequest)
+				return
+			}
+			ban.ExpiresAt = time.Now().Add(duration)
+		}
+		ban, err := s.BanUser(ban)
+		if err != nil {
+			s.log.Error("Error adding ban", "err", err)
+			http.Error(w, "ban failed", http.StatusInternalServerError)
+			return
+		}
+		s.requestLogger(r).Info("Ban added via admin API", "username", username, "ip", ip)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(ban)
+
+	case http.MethodDelete:
+		if username == "" && ip == "" {
+			http.Error(w, "user or ip is required", http.StatusBadRequest)
+			return
+		}
+		removed, err := s.Bans.RemoveBans(username, ip)
+		if err != nil {
+			s.log.Error("Error removing bans", "err", err)
+			http.Error(w, "unban failed", http.StatusInternalServerError)
+			return
+		}
+		s.requestLogger(r).Info("Bans lifted via admin API", "username", username, "ip", ip, "removed", removed)
+		s.audit(AuditUnban, "admin API", username, ip, fmt.Sprintf("%d bans lifted", removed))
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(BansRemoved{Removed: removed})
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleAdminShadowbans lists, adds and lifts shadowbans.
+// GET /admin/shadowbans
+// POST /admin/shadowbans?user=<name>
+// DELETE /admin/shadowbans?user=<name>
+func (s *Server) handleAdminShadowbans(w http.ResponseWriter, r *http.Request) {
+	username := r.URL.Query().Get("user")
+	if r.Method != http.MethodGet && username == "" {
+		http.Error(w, "user is required", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.Shadowbans())
+	case http.MethodPost:
+		s.ShadowbanUser(username, "admin API")
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		if !s.UnshadowbanUser(username, "admin API") {
+			http.Error(w, "user is not shadowbanned", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleAdminAnnounce broadcasts a server-wide announcement. The text is
+// taken from the text parameter or, failing that, the request body.
+// POST /admin/announce?text=<text>
+func (s *Server) handleAdminAnnounce(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	text, ok := adminText(w, r)
+	if !ok {
+		return
+	}
+
+	s.Announce(text, "admin API")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// adminText returns the text parameter or, failing that, the request body,
+// writing an error response if neither is set
+func adminText(w http.ResponseWriter, r *http.Request) (string, bool) {
+	text := r.URL.Query().Get("text")
+	if text == "" {
+		body, err := io.ReadAll(io.LimitReader(r.Body, 4096))
+		if err != nil {
+			http.Error(w, "could not read body", http.StatusBadRequest)
+			return "", false
+		}
+		text = string(body)
+	}
+	text = strings.TrimSpace(text)
+	if text == "" {
+		http.Error(w, "text is required", http.StatusBadRequest)
+		return "", false
+	}
+	return text, true
+}
+
+// handleAdminMessages sends a server message to one user, one room, or
+// (with neither set) everyone as a system notice. The text is taken as for
+// /admin/announce.
+// POST /admin/messages?user=<username>|room=<room>&text=<text>
+func (s *Server) handleAdminMessages(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := r.URL.Query().Get("user")
+	room := r.URL.Query().Get("room")
+	if user != "" && room != "" {
+		http.Error(w, "user and room are mutually exclusive", http.StatusBadRequest)
+		return
+	}
+	text, ok := adminText(w, r)
+	if !ok {
+		return
+	}
+
+	switch {
+	case user != "":
+		if !s.SendToUser(user, text) {
+			http.Error(w, "user not connected", http.StatusNotFound)
+			return
+		}
+		s.audit(AuditAdmin, "admin API", user, s.clientIP(r), "message: "+text)
+	case room != "":
+		if _, err := s.SendToRoom(room, text); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.audit(AuditAdmin, "admin API", room, s.clientIP(r), "room message: "+text)
+	default:
+		s.BroadcastSystem(text)
+		s.audit(AuditAdmin, "admin API", "", s.clientIP(r), "system message: "+text)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleAdminAudit returns the most recent audit events as JSON.
+// GET /admin/audit?limit=<n>
+func (s *Server) handleAdminAudit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	limit := 100
+	if l := r.URL.Query().Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n <= 0 {
+			http.Error(w, "limit must be a positive number", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.Audit.Recent(limit))
+}
+
+// EraseUser removes a user's stored messages (or anonymizes them) and
+// deletes their account and push subscriptions, so no personal data
+// about them is retained
+func (s *Server) EraseUser(username string, anonymize bool) (EraseResult, error) {
+	result := EraseResult{User: username, Mode: "delete"}
+	if anonymize {
+		result.Mode = "anonymize"
+	}
+
+	n, err := s.Store.EraseUser(username, anonymize)
+	result.Messages = n
+	if n > 0 && s.history != nil {
+		s.history.reset()
+	}
+	if err != nil {
+		return result, err
+	}
+	n, err = s.PrivateStore.EraseUser(username, anonymize)
+	result.Messages += n
+	if err != nil {
+		return result, err
+	}
+
+	if err := s.PushSubscriptions.RemoveSubscriptions(username); err != nil {
+		return result, err
+	}
+	err = s.Users.DeleteUser(username)
+	if err == nil {
+		result.Account = true
+	} else if !errors.Is(err, ErrUserNotFound) {
+		return result, err
+	}
+	return result, nil
+}
+
+// exportJSON writes the room history as a JSON array, one message at a time
+func (s *Server) exportJSON(w http.ResponseWriter, room string) error {
+	if _, err := w.Write([]byte("[\n")); err != nil {
+		return err
+	}
+
+	first := true
+	err := s.Store.ForEach(room, func(msg Message) error {
+		line, err := json.Marshal(msg)
+		if err != nil {
+			return err
+		}
+		if !first {
+			if _, err := w.Write([]byte(",\n")); err != nil {
+				return err
+			}
+		}
+		first = false
+		_, err = w.Write(line)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write([]byte("\n]\n"))
+	return err
+}
+
+// exportCSV writes the room history as CSV with a header row
+func (s *Server) exportCSV(w http.ResponseWriter, room string) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{"id", "room", "from", "time", "text"}); err != nil {
+		return err
+	}
+
+	err := s.Store.ForEach(room, func(msg Message) error {
+		return cw.Write([]string{
+			strconv.FormatInt(msg.ID, 10),
+			msg.Room,
+			msg.From,
+			msg.Time.Format(time.RFC3339),
+			msg.Text,
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
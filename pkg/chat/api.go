@@ -0,0 +1,351 @@
+// pkg/chat/api.go
+package chat
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limits on the messages GET /api/rooms/{room}/messages returns at once
+const (
+	defaultAPIMessages = 50
+	maxAPIMessages     = 1000
+)
+
+// APIUser is a connected user as listed by GET /api/users
+type APIUser struct {
+	Username string `json:"username"`
+	Room     string `json:"room"`
+	// Role is only known for users connected to this instance
+	Role   Role `json:"role,omitempty"`
+	Remote bool `json:"remote,omitempty"`
+}
+
+// apiCaller is who an API request was made by: the admin, or a user
+// authenticated by Config.Auth, with their username unless the credentials
+// let them choose one
+type apiCaller struct {
+	admin    bool
+	identity Identity
+}
+
+// apiCallerKey is the context key of a request's apiCaller
+type apiCallerKey struct{}
+
+// apiLimits holds the message rate limits of users posting through the
+// API, who have no client to keep them
+type apiLimits struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+// APIHandler returns the HTTP handler for the /api/ endpoints, for
+// dashboards and scripts that don't keep a connection open:
+//
+//	GET /api/rooms
+//	GET /api/rooms/{room}/messages?limit=<n>&before=<id>
+//	POST /api/rooms/{room}/messages {"text": "...", "from": "..."}
+//	GET /api/users?room=<room>
+//
+// Every request must carry the admin token or credentials accepted by
+// Config.Auth, as "Authorization: Bearer <token>". If neither is
+// configured the API is disabled entirely. GET /api/openapi.json, which
+// needs no credentials, describes this API and the admin API.
+func (s *Server) APIHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/rooms", s.handleAPIRooms)
+	mux.HandleFunc("GET /api/rooms/{room}/messages", s.handleAPIMessages)
+	mux.HandleFunc("POST /api/rooms/{room}/messages", s.handleAPIPost)
+	mux.HandleFunc("GET /api/users", s.handleAPIUsers)
+	outer := http.NewServeMux()
+	outer.HandleFunc("GET /api/openapi.json", s.handleOpenAPI)
+	outer.Handle("/", s.requireAPICaller(mux))
+	return outer
+}
+
+// requireAPICaller rejects requests that present neither the admin token
+// nor credentials Config.Auth accepts, counting failures towards lockouts
+func (s *Server) requireAPICaller(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.Config.AdminToken == "" && s.Config.Auth == nil {
+			http.Error(w, "API disabled", http.StatusNotFound)
+			return
+		}
+
+		ip := s.clientIP(r)
+		basicUser, _, _ := r.BasicAuth()
+		if wait, locked := s.loginLocked(basicUser, ip); locked {
+			lockedOutError(w, wait)
+			return
+		}
+		if ban, banned := s.checkBan("", ip); banned {
+			http.Error(w, strings.TrimPrefix(banMessage(ban), "ERROR: "), http.StatusForbidden)
+			return
+		}
+
+		var caller apiCaller
+		token := requestToken(r)
+		switch {
+		case s.Config.AdminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(s.Config.AdminToken)) == 1:
+			caller.admin = true
+		case s.Config.Auth != nil:
+			id, err := s.authenticate(r)
+			if err != nil && !errors.Is(err, ErrUnauthorized) {
+				s.log.Warn("Rejected API request", "remote_addr", ip, "err", err)
+				http.Error(w, "authentication unavailable", http.StatusServiceUnavailable)
+				return
+			}
+			if err == nil {
+				if id.Role == "" {
+					id.Role = RoleUser
+				}
+				caller.identity = id
+				break
+			}
+			fallthrough
+		default:
+			s.log.Warn("Rejected API request: invalid credentials", "remote_addr", ip, "path", r.URL.Path)
+			s.audit(AuditAuthFailure, "", r.URL.Path, ip, "invalid API credentials")
+			s.loginFailed(basicUser, ip)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="go-chat"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if caller.identity.Username != "" {
+			if ban, banned := s.checkBan(caller.identity.Username, ""); banned {
+				http.Error(w, strings.TrimPrefix(banMessage(ban), "ERROR: "), http.StatusForbidden)
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiCallerKey{}, caller)))
+	})
+}
+
+// handleAPIRooms lists the rooms and how many users are in each.
+// GET /api/rooms
+func (s *Server) handleAPIRooms(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.GetRoomList())
+}
+
+// handleAPIMessages returns a room's latest messages, oldest first, or
+// those before a message ID to page back through history.
+// GET /api/rooms/{room}/messages?limit=<n>&before=<id>
+func (s *Server) handleAPIMessages(w http.ResponseWriter, r *http.Request) {
+	room, ok := normalizeRoom(r.PathValue("room"))
+	if !ok {
+		http.Error(w, "invalid room name", http.StatusBadRequest)
+		return
+	}
+	limit := defaultAPIMessages
+	if value := r.URL.Query().Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			http.Error(w, "limit must be a positive number", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, maxAPIMessages)
+	}
+	var before int64
+	if value := r.URL.Query().Get("before"); value != "" {
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || n <= 0 {
+			http.Error(w, "before must be a message ID", http.StatusBadRequest)
+			return
+		}
+		before = n
+	}
+
+	var messages []Message
+	var err error
+	if before == 0 {
+		messages, err = s.Store.Recent(room, limit)
+	} else {
+		// Keep the last limit messages before the ID
+		err = s.Store.ForEach(room, func(msg Message) error {
+			if msg.ID >= before {
+				return errStopIteration
+			}
+			messages = append(messages, msg)
+			if len(messages) > limit {
+				messages = messages[1:]
+			}
+			return nil
+		})
+		if errors.Is(err, errStopIteration) {
+			err = nil
+		}
+	}
+	if err != nil {
+		s.log.Error("Error loading messages for API", "room", room, "err", err)
+		http.Error(w, "could not load messages", http.StatusInternalServerError)
+		return
+	}
+	if messages == nil {
+		messages = []Message{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(messages)
+}
+
+// errStopIteration ends a ForEach early
+var errStopIteration = errors.New("stop iteration")
+
+// handleAPIPost posts a message to a room as the caller. The admin, and
+// callers whose credentials don't fix their username, say who it is from;
+// they may not post as a connected user or a registered account unless
+// they are the admin. Bans, mutes, shadowbans and the message rate apply
+// as for clients.
+// POST /api/rooms/{room}/messages {"text": "...", "from": "..."}
+func (s *Server) handleAPIPost(w http.ResponseWriter, r *http.Request) {
+	caller := r.Context().Value(apiCallerKey{}).(apiCaller)
+	room, ok := normalizeRoom(r.PathValue("room"))
+	if !ok {
+		http.Error(w, "invalid room name", http.StatusBadRequest)
+		return
+	}
+	var body struct {
+		From string `json:"from"`
+		Text string `json:"text"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxPostedMessage)).Decode(&body); err != nil {
+		http.Error(w, "body must be a JSON object with text", http.StatusBadRequest)
+		return
+	}
+	if strings.TrimSpace(body.Text) == "" {
+		http.Error(w, "text is required", http.StatusBadRequest)
+		return
+	}
+
+	from := caller.identity.Username
+	if from == "" || caller.admin {
+		from = body.From
+	} else if body.From != "" && !sameUsername(body.From, from) {
+		http.Error(w, "your credentials don't let you post as someone else", http.StatusForbidden)
+		return
+	}
+	from, err := validateUsername(from)
+	if err != nil {
+		http.Error(w, "from: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	ip := s.clientIP(r)
+	if !caller.admin {
+		if caller.identity.Username == "" && !s.apiNameFree(from, caller.identity) {
+			http.Error(w, "username taken", http.StatusForbidden)
+			return
+		}
+		if caller.identity.Role == RoleGuest && !s.roomExists(room) {
+			http.Error(w, "guests cannot create rooms", http.StatusForbidden)
+			return
+		}
+		if ban, banned := s.checkBan(from, ""); banned {
+			http.Error(w, strings.TrimPrefix(banMessage(ban), "ERROR: "), http.StatusForbidden)
+			return
+		}
+		if m, muted := s.muteFor(from); muted {
+			http.Error(w, fmt.Sprintf("muted until %s", m.until.Format(time.RFC1123)), http.StatusForbidden)
+			return
+		}
+		if !s.apiLimits.allow(from, s.config()) {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "sending too fast", http.StatusTooManyRequests)
+			return
+		}
+	}
+
+	// Shadowbanned users aren't told their message went nowhere
+	if !s.Shadowbanned(from) {
+		if caller.admin {
+			s.audit(AuditAdmin, "API", room, ip, "message as "+from+": "+body.Text)
+		}
+		s.postMessage(r.Context(), room, from, ip, "", body.Text)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// apiNameFree reports whether an API caller who chooses their name may
+// post as name: it mustn't be reserved, a registered account, or in use
+func (s *Server) apiNameFree(name string, identity Identity) bool {
+	if s.reservedName(name, identity) || s.usernameTaken(name) {
+		return false
+	}
+	_, err := s.Users.GetUser(name)
+	return errors.Is(err, ErrUserNotFound)
+}
+
+// allow takes a token from username's bucket, under the same limits as
+// clients' messages
+func (l *apiLimits) allow(username string, cfg *Config) bool {
+	if cfg.MessageRate <= 0 {
+		return true
+	}
+	burst := max(cfg.MessageBurst, 1)
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.buckets == nil {
+		l.buckets = map[string]*tokenBucket{}
+	}
+	// Forget users who have stopped posting, rather than keep a bucket
+	// for every name ever used
+	if len(l.buckets) > 1000 {
+		for key, bucket := range l.buckets {
+			if bucket.full(now) {
+				delete(l.buckets, key)
+			}
+		}
+	}
+	key := userKey(username)
+	bucket, ok := l.buckets[key]
+	if !ok || bucket.rate != cfg.MessageRate || bucket.burst != float64(burst) {
+		bucket = newTokenBucket(cfg.MessageRate, burst)
+		l.buckets[key] = bucket
+	}
+	return bucket.allow(now)
+}
+
+// handleAPIUsers lists the users connected here and to other instances,
+// optionally only those in one room.
+// GET /api/users?room=<room>
+func (s *Server) handleAPIUsers(w http.ResponseWriter, r *http.Request) {
+	room := ""
+	if value := r.URL.Query().Get("room"); value != "" {
+		var ok bool
+		if room, ok = normalizeRoom(value); !ok {
+			http.Error(w, "invalid room name", http.StatusBadRequest)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.listUsers(room))
+}
+
+// listUsers returns the users connected here and to other instances, in
+// room unless it is empty, sorted by username
+func (s *Server) listUsers(room string) []APIUser {
+	users := []APIUser{}
+	s.clients.each(func(client *Session) {
+		if room == "" || client.Room == room {
+			users = append(users, APIUser{Username: client.Username, Room: client.Room, Role: client.Role})
+		}
+	})
+	for _, user := range s.remote.users() {
+		if room == "" || user.Room == room {
+			users = append(users, APIUser{Username: user.Username, Room: user.Room, Remote: true})
+		}
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Username < users[j].Username })
+	return users
+}
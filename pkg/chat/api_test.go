@@ -0,0 +1,89 @@
+// pkg/chat/api_test.go
+package chat
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestAPI posts as a user token, the shared secret and the admin token,
+// checking who may post as whom, then reads the messages back a page at a
+// time and lists the rooms and users
+func TestAPI(t *testing.T) {
+	s := NewServerWithConfig(Config{
+		Logger:     slog.New(slog.NewTextHandler(io.Discard, nil)),
+		AdminToken: "root",
+		Auth:       &TokenAuth{SharedSecret: "shared", UserTokens: map[string]string{"tok-alice": "alice"}},
+	})
+	if err := s.Users.CreateUser(User{Username: "dave", Role: RoleUser}); err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(s.APIHandler())
+	defer ts.Close()
+
+	do := func(method, path, token, body string) (int, string) {
+		t.Helper()
+		req, _ := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(data)
+	}
+	for _, post := range []struct {
+		token, body string
+		want        int
+	}{
+		{"", `{"text": "anonymous"}`, http.StatusUnauthorized},
+		{"tok-alice", `{"text": "hello"}`, http.StatusNoContent},
+		{"tok-alice", `{"from": "bob", "text": "not alice"}`, http.StatusForbidden},
+		{"shared", `{"from": "carol", "text": "hi"}`, http.StatusNoContent},
+		{"shared", `{"from": "Dave", "text": "not dave"}`, http.StatusForbidden},
+		{"shared", `{"text": "nobody"}`, http.StatusBadRequest},
+		{"root", `{"from": "dave", "text": "dave here"}`, http.StatusNoContent},
+		{"root", `{"from": "dave"}`, http.StatusBadRequest},
+	} {
+		if code, body := do(http.MethodPost, "/api/rooms/lobby/messages", post.token, post.body); code != post.want {
+			t.Errorf("posting %s with %q got %d %q, want %d", post.body, post.token, code, body, post.want)
+		}
+	}
+	s.MuteUser("alice", time.Minute, "", "test")
+	if code, _ := do(http.MethodPost, "/api/rooms/lobby/messages", "tok-alice", `{"text": "muted"}`); code != http.StatusForbidden {
+		t.Errorf("muted user's post got %d", code)
+	}
+
+	var messages []Message
+	_, body := do(http.MethodGet, "/api/rooms/lobby/messages", "tok-alice", "")
+	if err := json.Unmarshal([]byte(body), &messages); err != nil || len(messages) != 3 {
+		t.Fatalf("messages %q, %v", body, err)
+	}
+	for i, want := range []string{"alice: hello", "carol: hi", "dave: dave here"} {
+		if got := messages[i].From + ": " + messages[i].Text; got != want {
+			t.Errorf("message %d is %q, want %q", i, got, want)
+		}
+	}
+	_, body = do(http.MethodGet, "/api/rooms/lobby/messages?limit=1&before="+strconv.FormatInt(messages[2].ID, 10), "tok-alice", "")
+	var page []Message
+	if err := json.Unmarshal([]byte(body), &page); err != nil || len(page) != 1 || page[0].ID != messages[1].ID {
+		t.Errorf("page before %d: %q, %v", messages[2].ID, body, err)
+	}
+
+	if code, body := do(http.MethodGet, "/api/rooms", "shared", ""); code != http.StatusOK || !strings.Contains(body, `"name":"lobby"`) {
+		t.Errorf("rooms %d %q", code, body)
+	}
+	if code, body := do(http.MethodGet, "/api/users?room=lobby", "root", ""); code != http.StatusOK || strings.TrimSpace(body) != "[]" {
+		t.Errorf("users %d %q", code, body)
+	}
+}
@@ -0,0 +1,163 @@
+// pkg/chat/archive.go
+package chat
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Archiver stores messages somewhere durable before they are pruned
+type Archiver interface {
+	// Archive saves msgs; the messages are only pruned if it returns nil
+	Archive(msgs []Message) error
+}
+
+// S3Config describes an S3-compatible bucket to archive messages to
+type S3Config struct {
+	// Endpoint is the base URL of the service, e.g. https://s3.us-east-1.amazonaws.com
+	// or http://localhost:9000 for MinIO
+	Endpoint string
+	Region   string
+	Bucket   string
+
+	// Prefix is prepended to every object key, e.g. "chat-archive/"
+	Prefix string
+
+	AccessKeyID     string
+	SecretAccessKey string
+}
+
+// S3Archiver uploads messages as gzip-compressed JSON objects using
+// path-style requests signed with AWS Signature Version 4
+type S3Archiver struct {
+	Config S3Config
+	Client *http.Client
+}
+
+// NewS3Archiver creates an archiver for the given bucket
+func NewS3Archiver(cfg S3Config) (*S3Archiver, error) {
+	if cfg.Endpoint == "" || cfg.Bucket == "" {
+		return nil, fmt.Errorf("S3 archiving requires an endpoint and a bucket")
+	}
+	if cfg.AccessKeyID == "" || cfg.SecretAccessKey == "" {
+		return nil, fmt.Errorf("S3 archiving requires credentials")
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	if _, err := url.Parse(cfg.Endpoint); err != nil {
+		return nil, fmt.Errorf("invalid S3 endpoint: %w", err)
+	}
+
+	return &S3Archiver{
+		Config: cfg,
+		Client: &http.Client{Timeout: time.Minute},
+	}, nil
+}
+
+// Archive uploads msgs as a single compressed JSON array. The object key
+// is derived from the time range of the messages so reruns after a failed
+// prune overwrite rather than duplicate.
+func (a *S3Archiver) Archive(msgs []Message) error {
+	if len(msgs) == 0 {
+		return nil
+	}
+
+	var body bytes.Buffer
+	gz := gzip.NewWriter(&body)
+	if err := json.NewEncoder(gz).Encode(msgs); err != nil {
+		return fmt.Errorf("encode archive: %w", err)
+	}
+	if err := gz.Close(); err != nil {
+		return fmt.Errorf("compress archive: %w", err)
+	}
+
+	first, last := msgs[0], msgs[len(msgs)-1]
+	key := fmt.Sprintf("%s%s/messages-%d-%d.json.gz",
+		a.Config.Prefix, first.Time.UTC().Format("2006/01/02"), first.ID, last.ID)
+
+	return a.put(key, body.Bytes())
+}
+
+// put uploads an object with a SigV4-signed PUT request
+func (a *S3Archiver) put(key string, data []byte) error {
+	objectURL := strings.TrimRight(a.Config.Endpoint, "/") + "/" + a.Config.Bucket + "/" + key
+	req, err := http.NewRequest(http.MethodPut, objectURL, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Encoding", "gzip")
+	a.sign(req, data, time.Now().UTC())
+
+	resp, err := a.Client.Do(req)
+	if err != nil {
+		return fmt.Errorf("upload %s: %w", key, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("upload %s: %s: %s", key, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// sign adds AWS Signature Version 4 headers to req
+func (a *S3Archiver) sign(req *http.Request, payload []byte, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256Hex(payload)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signedHeaders := "content-encoding;content-type;host;x-amz-content-sha256;x-amz-date"
+	canonicalHeaders := "content-encoding:" + req.Header.Get("Content-Encoding") + "\n" +
+		"content-type:" + req.Header.Get("Content-Type") + "\n" +
+		"host:" + req.URL.Host + "\n" +
+		"x-amz-content-sha256:" + payloadHash + "\n" +
+		"x-amz-date:" + amzDate + "\n"
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + a.Config.Region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+a.Config.SecretAccessKey), date)
+	key = hmacSHA256(key, a.Config.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		a.Config.AccessKeyID, scope, signedHeaders, signature))
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,135 @@
+// pkg/chat/audit.go
+package chat
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// Audit event types
+const (
+	AuditConnect      = "connect"
+	AuditDisconnect   = "disconnect"
+	AuditAuthFailure  = "auth_failure"
+	AuditRejected     = "rejected"
+	AuditLoginFailure = "login_failure"
+	AuditLockout      = "lockout"
+	AuditRegister     = "register"
+	AuditBan          = "ban"
+	AuditUnban        = "unban"
+	AuditKick         = "kick"
+	AuditMute         = "mute"
+	AuditUnmute       = "unmute"
+	AuditShadowban    = "shadowban"
+	AuditUnshadowban  = "unshadowban"
+	AuditRoleChange   = "role_change"
+	AuditAutomod      = "automod"
+	AuditSpam         = "spam"
+	AuditReport       = "report"
+	AuditAdmin        = "admin"
+)
+
+// auditRecentSize is how many events are kept in memory for /admin/audit
+const auditRecentSize = 1000
+
+// AuditEvent is one security-relevant event. Chat content is never
+// recorded.
+type AuditEvent struct {
+	Time   time.Time `json:"time"`
+	Event  string    `json:"event"`
+	Actor  string    `json:"actor,omitempty"`
+	Target string    `json:"target,omitempty"`
+	IP     string    `json:"ip,omitempty"`
+	Detail string    `json:"detail,omitempty"`
+}
+
+// AuditLog writes audit events as JSON lines, separate from the server log,
+// and keeps the most recent ones in memory
+type AuditLog struct {
+	mu     sync.Mutex
+	w      io.Writer
+	file   *os.File
+	recent []AuditEvent
+	next   int
+}
+
+// NewAuditLog writes events to w (nil keeps them in memory only)
+func NewAuditLog(w io.Writer) *AuditLog {
+	return &AuditLog{w: w}
+}
+
+// OpenAuditLog appends events to the file at path
+func OpenAuditLog(path string) (*AuditLog, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("open audit log: %w", err)
+	}
+	a := NewAuditLog(f)
+	a.file = f
+	return a, nil
+}
+
+// Record writes an event, filling in the time if it's missing
+func (a *AuditLog) Record(event AuditEvent) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if len(a.recent) < auditRecentSize {
+		a.recent = append(a.recent, event)
+	} else {
+		a.recent[a.next] = event
+		a.next = (a.next + 1) % auditRecentSize
+	}
+
+	if a.w == nil {
+		return
+	}
+	line, err := json.Marshal(event)
+	if err != nil {
+		slog.Error("Error encoding audit event", "err", err)
+		return
+	}
+	if _, err := a.w.Write(append(line, '\n')); err != nil {
+		slog.Error("Error writing audit log", "err", err)
+	}
+}
+
+// Recent returns up to limit of the latest events, oldest first
+func (a *AuditLog) Recent(limit int) []AuditEvent {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	events := make([]AuditEvent, 0, len(a.recent))
+	events = append(events, a.recent[a.next:]...)
+	events = append(events, a.recent[:a.next]...)
+	if limit > 0 && len(events) > limit {
+		events = events[len(events)-limit:]
+	}
+	return events
+}
+
+// Close closes the audit log file, if any
+func (a *AuditLog) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.file == nil {
+		return nil
+	}
+	return a.file.Close()
+}
+
+// audit records an event in the server's audit log
+func (s *Server) audit(event, actor, target, ip, detail string) {
+	s.Audit.Record(AuditEvent{Event: event, Actor: actor, Target: target, IP: ip, Detail: detail})
+	s.export(ExportEvent{Type: event, Username: actor, Target: target, IP: ip, Detail: detail})
+}
@@ -0,0 +1,173 @@
+// pkg/chat/auth.go
+package chat
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// ErrUnauthorized is returned by an Authenticator that rejects a request
+var ErrUnauthorized = errors.New("unauthorized")
+
+// Identity is what a connection proved about itself while authenticating
+type Identity struct {
+	// Username is fixed by the credentials; empty lets the client pick one
+	Username string
+
+	// Role is the role granted by the credentials; empty means RoleUser
+	Role Role
+}
+
+// Authenticator decides whether a WebSocket upgrade request may connect
+type Authenticator interface {
+	// Authenticate inspects the request's credentials and returns the
+	// identity they prove, or an error wrapping ErrUnauthorized
+	Authenticate(r *http.Request) (Identity, error)
+}
+
+// requestToken extracts a bearer token from the Authorization header, the
+// X-Chat-Token header, or the "token" query parameter, in that order
+func requestToken(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+	}
+	if token := r.Header.Get("X-Chat-Token"); token != "" {
+		return token
+	}
+	return r.URL.Query().Get("token")
+}
+
+// presentedCredentials reports whether r carries credentials for an
+// Authenticator to check: an Authorization header, a token in any of the
+// places requestToken looks, or an OIDC session cookie. username is who
+// they claim to be, where that can be told without checking them, as with
+// Basic auth.
+func presentedCredentials(r *http.Request) (username string, ok bool) {
+	username, _, _ = r.BasicAuth()
+	if r.Header.Get("Authorization") != "" || requestToken(r) != "" {
+		return username, true
+	}
+	cookie, err := r.Cookie(SessionCookie)
+	return username, err == nil && cookie.Value != ""
+}
+
+// authenticate checks the request with the configured authenticator and
+// refuses identities whose username isn't one a client could pick, or
+// which take a guest name (see validateIdentity)
+func (s *Server) authenticate(r *http.Request) (Identity, error) {
+	id, err := s.Config.Auth.Authenticate(r)
+	if err != nil {
+		return Identity{}, err
+	}
+	validated, err := validateIdentity(id)
+	if err != nil {
+		return Identity{}, fmt.Errorf("%w: username %q: %v", ErrUnauthorized, id.Username, err)
+	}
+	return validated, nil
+}
+
+// MultiAuth tries several authenticators in order and accepts the request
+// as soon as one of them does
+type MultiAuth []Authenticator
+
+// Authenticate returns the identity from the first authenticator that
+// accepts the request
+func (m MultiAuth) Authenticate(r *http.Request) (Identity, error) {
+	err := fmt.Errorf("%w: no authenticators configured", ErrUnauthorized)
+	for _, auth := range m {
+		var id Identity
+		id, err = auth.Authenticate(r)
+		if err == nil {
+			return id, nil
+		}
+	}
+	return Identity{}, err
+}
+
+// TokenAuth accepts connections presenting either the shared secret or one
+// of the per-user tokens. A shared secret lets the client choose any
+// username; a per-user token pins the connection to that user.
+type TokenAuth struct {
+	// SharedSecret is accepted from anyone; empty disables it
+	SharedSecret string
+
+	// UserTokens maps a token to the username it authenticates
+	UserTokens map[string]string
+
+	// mu guards UserTokens against SetUserTokens
+	mu sync.RWMutex
+}
+
+// SetUserTokens replaces the per-user tokens, e.g. after reloading the
+// token file
+func (a *TokenAuth) SetUserTokens(tokens map[string]string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.UserTokens = tokens
+}
+
+// Authenticate checks the request's token against the shared secret and
+// the per-user tokens
+func (a *TokenAuth) Authenticate(r *http.Request) (Identity, error) {
+	token := requestToken(r)
+	if token == "" {
+		return Identity{}, fmt.Errorf("%w: missing token", ErrUnauthorized)
+	}
+
+	if a.SharedSecret != "" && subtle.ConstantTimeCompare([]byte(token), []byte(a.SharedSecret)) == 1 {
+		return Identity{}, nil
+	}
+
+	// Compare against every token so timing doesn't reveal which ones exist
+	var username string
+	a.mu.RLock()
+	for userToken, name := range a.UserTokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(userToken)) == 1 {
+			username = name
+		}
+	}
+	a.mu.RUnlock()
+	if username != "" {
+		return Identity{Username: username, Role: RoleUser}, nil
+	}
+
+	return Identity{}, fmt.Errorf("%w: invalid token", ErrUnauthorized)
+}
+
+// LoadUserTokens reads a per-user token file with one "username:token"
+// entry per line. Blank lines and lines starting with # are ignored.
+func LoadUserTokens(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open token file: %w", err)
+	}
+	defer f.Close()
+
+	tokens := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		username, token, ok := strings.Cut(line, ":")
+		username, token = strings.TrimSpace(username), strings.TrimSpace(token)
+		if !ok || username == "" || token == "" {
+			return nil, fmt.Errorf("%s:%d: expected username:token", path, lineNum)
+		}
+		tokens[token] = username
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read token file: %w", err)
+	}
+	return tokens, nil
+}
@@ -0,0 +1,134 @@
+// pkg/chat/auth_test.go
+package chat
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// dialStatus tries to connect with header and returns the HTTP status the
+// upgrade got
+func dialStatus(t *testing.T, url string, header http.Header) int {
+	t.Helper()
+	conn, resp, err := websocket.DefaultDialer.Dial(url, header)
+	if err == nil {
+		conn.Close()
+		return http.StatusSwitchingProtocols
+	}
+	if resp == nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode
+}
+
+// TestTokenAuth connects with the shared secret and per-user tokens, sent
+// each way requestToken looks for them, and checks that missing, wrong and
+// revoked tokens are refused, as are tokens for names a client couldn't pick
+func TestTokenAuth(t *testing.T) {
+	auth := &TokenAuth{SharedSecret: "s3cret", UserTokens: map[string]string{"alice-token": "alice", "guest-token": "guest-0042", "bad-token": "alice bob"}}
+	s, url := newTestServer(t, Config{Auth: auth})
+
+	for _, tt := range []struct {
+		name   string
+		url    string
+		header http.Header
+		want   int
+	}{
+		{"no token", url, nil, http.StatusUnauthorized},
+		{"wrong token", url, http.Header{"Authorization": {"Bearer guess"}}, http.StatusUnauthorized},
+		{"token prefix", url, http.Header{"Authorization": {"Bearer s3cre"}}, http.StatusUnauthorized},
+		{"not a bearer token", url, http.Header{"Authorization": {"s3cret"}}, http.StatusUnauthorized},
+		{"bearer", url, http.Header{"Authorization": {"Bearer s3cret"}}, http.StatusSwitchingProtocols},
+		{"header", url, http.Header{"X-Chat-Token": {"alice-token"}}, http.StatusSwitchingProtocols},
+		{"query", url + "?token=s3cret", nil, http.StatusSwitchingProtocols},
+		{"token for a guest name", url, http.Header{"X-Chat-Token": {"guest-token"}}, http.StatusUnauthorized},
+		{"token for an invalid name", url, http.Header{"X-Chat-Token": {"bad-token"}}, http.StatusUnauthorized},
+	} {
+		if got := dialStatus(t, tt.url, tt.header); got != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.name, got, tt.want)
+		}
+	}
+	_, resp, _ := websocket.DefaultDialer.Dial(url, nil)
+	if resp == nil || resp.Header.Get("WWW-Authenticate") == "" {
+		t.Error("401 has no WWW-Authenticate challenge")
+	}
+
+	// A per-user token pins the username, whatever the client asks for
+	conn, _, err := websocket.DefaultDialer.Dial(url, http.Header{"X-Chat-Token": {"alice-token"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.WriteMessage(websocket.TextMessage, []byte("mallory"))
+	if !waitFor(5*time.Second, func() bool { return connected(s, "alice") }) || connected(s, "mallory") {
+		t.Error("per-user token didn't connect as alice")
+	}
+	// The shared secret lets the client choose
+	conn, _, err = websocket.DefaultDialer.Dial(url, http.Header{"Authorization": {"Bearer s3cret"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.WriteMessage(websocket.TextMessage, []byte("bob"))
+	if !waitFor(5*time.Second, func() bool { return connected(s, "bob") }) {
+		t.Error("shared secret didn't connect as bob")
+	}
+
+	auth.SetUserTokens(map[string]string{"carol-token": "carol"})
+	if got := dialStatus(t, url, http.Header{"X-Chat-Token": {"alice-token"}}); got != http.StatusUnauthorized {
+		t.Errorf("revoked token: got %d", got)
+	}
+	if got := dialStatus(t, url, http.Header{"X-Chat-Token": {"carol-token"}}); got != http.StatusSwitchingProtocols {
+		t.Errorf("new token: got %d", got)
+	}
+}
+
+// TestMultiAuth checks that a request is accepted if any authenticator
+// accepts it, and that the last rejection is returned otherwise
+func TestMultiAuth(t *testing.T) {
+	auth := MultiAuth{
+		&TokenAuth{SharedSecret: "first"},
+		&TokenAuth{UserTokens: map[string]string{"second": "bob"}},
+	}
+	r := httptest.NewRequest("GET", "/ws?token=second", nil)
+	if id, err := auth.Authenticate(r); err != nil || id.Username != "bob" {
+		t.Errorf("got %+v, %v", id, err)
+	}
+	r = httptest.NewRequest("GET", "/ws?token=third", nil)
+	if _, err := auth.Authenticate(r); !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("got %v, want ErrUnauthorized", err)
+	}
+	if _, err := (MultiAuth{}).Authenticate(r); !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("empty MultiAuth got %v", err)
+	}
+}
+
+// TestLoadUserTokens reads a token file with comments and blank lines, and
+// refuses one with a malformed line
+func TestLoadUserTokens(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "tokens")
+	os.WriteFile(path, []byte("# chat tokens\nalice: a1\n\nbob:b2\n"), 0600)
+	tokens, err := LoadUserTokens(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 2 || tokens["a1"] != "alice" || tokens["b2"] != "bob" {
+		t.Errorf("got %v", tokens)
+	}
+
+	os.WriteFile(path, []byte("alice:a1\nbob\n"), 0600)
+	if _, err := LoadUserTokens(path); err == nil {
+		t.Error("malformed file accepted")
+	}
+	if _, err := LoadUserTokens(filepath.Join(dir, "missing")); err == nil {
+		t.Error("missing file accepted")
+	}
+}
@@ -0,0 +1,201 @@
+// pkg/chat/automod.go
+package chat
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Automod actions
+const (
+	AutomodWarn   = "warn"   // tell the sender their message broke a rule
+	AutomodDelete = "delete" // drop the message
+	AutomodMute   = "mute"   // drop the message and mute the sender
+	AutomodAlert  = "alert"  // tell connected moderators
+)
+
+// AutomodRule triggers actions on room messages that match a regular
+// expression or contain one of a list of keywords (case-insensitive).
+// Rules are loaded from a JSON array, e.g.
+//
+//	[{"name": "invites", "pattern": "discord\\.gg/", "actions": ["delete", "warn"]},
+//	 {"name": "scam", "keywords": ["free nitro"], "actions": ["mute", "alert"], "duration": "30m"}]
+type AutomodRule struct {
+	Name     string   `json:"name"`
+	Pattern  string   `json:"pattern,omitempty"`
+	Keywords []string `json:"keywords,omitempty"`
+	Actions  []string `json:"actions"`
+
+	// Message is shown to the sender for warn, delete and mute actions
+	Message string `json:"message,omitempty"`
+
+	// Duration is how long the mute action lasts (default 10m)
+	Duration string `json:"duration,omitempty"`
+
+	re       *regexp.Regexp
+	muteFor  time.Duration
+	keywords []string
+}
+
+// compile validates the rule and prepares it for matching
+func (r *AutomodRule) compile() error {
+	if r.Name == "" {
+		return fmt.Errorf("rule has no name")
+	}
+	if r.Pattern == "" && len(r.Keywords) == 0 {
+		return fmt.Errorf("rule %s needs a pattern or keywords", r.Name)
+	}
+	if r.Pattern != "" {
+		re, err := regexp.Compile(r.Pattern)
+		if err != nil {
+			return fmt.Errorf("rule %s: %w", r.Name, err)
+		}
+		r.re = re
+	}
+	r.keywords = nil
+	for _, kw := range r.Keywords {
+		if kw = strings.ToLower(strings.TrimSpace(kw)); kw != "" {
+			r.keywords = append(r.keywords, kw)
+		}
+	}
+
+	if len(r.Actions) == 0 {
+		return fmt.Errorf("rule %s has no actions", r.Name)
+	}
+	for _, action := range r.Actions {
+		switch action {
+		case AutomodWarn, AutomodDelete, AutomodMute, AutomodAlert:
+		default:
+			return fmt.Errorf("rule %s: unknown action %q", r.Name, action)
+		}
+	}
+
+	r.muteFor = defaultMuteDuration
+	if r.Duration != "" {
+		d, ok := parseLongDuration(r.Duration)
+		if !ok {
+			return fmt.Errorf("rule %s: invalid duration %q", r.Name, r.Duration)
+		}
+		r.muteFor = d
+	}
+	return nil
+}
+
+// matches reports whether text triggers the rule
+func (r *AutomodRule) matches(text string) bool {
+	if r.re != nil && r.re.MatchString(text) {
+		return true
+	}
+	if len(r.keywords) > 0 {
+		lower := strings.ToLower(text)
+		for _, kw := range r.keywords {
+			if strings.Contains(lower, kw) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// has reports whether the rule includes action
+func (r *AutomodRule) has(action string) bool {
+	for _, a := range r.Actions {
+		if a == action {
+			return true
+		}
+	}
+	return false
+}
+
+// LoadAutomodRules reads and validates rules from a JSON file
+func LoadAutomodRules(path string) ([]AutomodRule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read automod rules: %w", err)
+	}
+	var rules []AutomodRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("parse automod rules: %w", err)
+	}
+	for i := range rules {
+		if err := rules[i].compile(); err != nil {
+			return nil, err
+		}
+	}
+	return rules, nil
+}
+
+// SetAutomodRules replaces the rules applied to room messages
+func (s *Server) SetAutomodRules(rules []AutomodRule) error {
+	compiled := make([]AutomodRule, len(rules))
+	copy(compiled, rules)
+	for i := range compiled {
+		if err := compiled[i].compile(); err != nil {
+			return err
+		}
+	}
+
+	s.automodMu.Lock()
+	s.automod = compiled
+	s.automodMu.Unlock()
+	return nil
+}
+
+// automodRules returns the current rules; the slice must not be modified
+func (s *Server) automodRules() []AutomodRule {
+	s.automodMu.RLock()
+	defer s.automodMu.RUnlock()
+	return s.automod
+}
+
+// automod runs a room message from the client through the rules and
+// carries out the actions of every rule it triggers. It returns false if
+// the message should be dropped. Moderators are exempt.
+func (c *Session) automod(text string) bool {
+	if c.can(permModerate) {
+		return true
+	}
+
+	deliver := true
+	rules := c.Server.automodRules()
+	for i := range rules {
+		rule := &rules[i]
+		if !rule.matches(text) {
+			continue
+		}
+
+		c.logger().Info("Automod rule matched", "rule", rule.Name, "actions", rule.Actions)
+		c.Server.audit(AuditAutomod, "", c.Username, c.IP, "rule "+rule.Name+": "+strings.Join(rule.Actions, ","))
+
+		notice := rule.Message
+		if notice == "" {
+			notice = fmt.Sprintf("Your message broke the %s rule.", rule.Name)
+		}
+		if rule.has(AutomodDelete) || rule.has(AutomodMute) {
+			deliver = false
+			if !rule.has(AutomodWarn) && !rule.has(AutomodMute) {
+				c.send("Your message was removed: " + notice)
+			}
+		}
+		if rule.has(AutomodWarn) {
+			c.send("Warning: " + notice)
+		}
+		if rule.has(AutomodMute) {
+			c.Server.MuteUser(c.Username, rule.muteFor, "automod: "+rule.Name, "")
+		}
+		if rule.has(AutomodAlert) {
+			c.Server.alertModerators(fmt.Sprintf("[AUTOMOD] %s triggered rule %s in #%s: %s",
+				c.Username, rule.Name, c.Room, text))
+		}
+	}
+	return deliver
+}
+
+// alertModerators sends a notice to every connected moderator and admin
+func (s *Server) alertModerators(message string) {
+	s.sendToEach(s.clients.filter(func(client *Session) bool { return client.can(permModerate) }), message)
+}
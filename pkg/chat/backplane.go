@@ -0,0 +1,289 @@
+// pkg/chat/backplane.go
+package chat
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Backplane carries events between server instances, so users connected to
+// different instances behind a load balancer can talk to each other.
+// Implementations only move bytes; see RedisBackplane and NATSBackplane.
+type Backplane interface {
+	// Publish sends an event to every instance subscribed to the
+	// backplane, possibly including this one
+	Publish(event []byte) error
+
+	// Subscribe calls fn with each event published by any instance until
+	// the backplane is closed. fn is called from one goroutine at a time.
+	Subscribe(fn func(event []byte)) error
+
+	// Close stops delivering events and releases the connection
+	Close() error
+}
+
+// DefaultBackplaneChannel is the channel (or subject) instances share
+// unless configured otherwise
+const DefaultBackplaneChannel = "go-chat"
+
+// Timeouts for talking to the backplane's server. Subscribers ping every
+// backplanePingInterval and reconnect if nothing arrives for twice that,
+// backing off up to backplaneMaxBackoff between attempts.
+const (
+	backplaneDialTimeout  = 5 * time.Second
+	backplanePingInterval = 30 * time.Second
+	backplaneMaxBackoff   = 30 * time.Second
+)
+
+// backplaneQueueSize is how many events may wait to be published; Publish
+// fails when the queue is full
+const backplaneQueueSize = 1024
+
+// presenceInterval is how often each instance publishes the full list of
+// its users. An instance not heard from for presenceExpiry is assumed gone,
+// along with its users.
+const (
+	presenceInterval = 10 * time.Second
+	presenceExpiry   = 3 * presenceInterval
+)
+
+// Backplane event types
+const (
+	// eventRoom and eventAll are notices for a room or everyone; eventMessage
+	// is a user's room message, which is recorded as well as delivered
+	eventRoom    = "room"
+	eventAll     = "all"
+	eventMessage = "message"
+	// eventUser is a message for one user, e.g. a whisper
+	eventUser = "user"
+	// eventJoin says a user connected or changed room, and eventLeave that
+	// they disconnected. eventPresence lists all of an instance's users,
+	// and eventGone says the instance has shut down.
+	eventJoin     = "join"
+	eventLeave    = "leave"
+	eventPresence = "presence"
+	eventGone     = "gone"
+	// eventSync asks every instance to send its eventPresence straight
+	// away, so one that has just started needn't wait for them
+	eventSync = "sync"
+)
+
+// backplaneEvent is the JSON form of an event on the backplane
+type backplaneEvent struct {
+	Origin   string         `json:"origin"`
+	Type     string         `json:"type"`
+	Room     string         `json:"room,omitempty"`
+	Username string         `json:"username,omitempty"`
+	Text     string         `json:"text,omitempty"`
+	Users    []presenceUser `json:"users,omitempty"`
+}
+
+// presenceUser is a user connected to another instance
+type presenceUser struct {
+	Username string `json:"username"`
+	Room     string `json:"room"`
+}
+
+// presence tracks the users connected to other instances
+type presence struct {
+	mu        sync.Mutex
+	instances map[string]*remoteInstance
+}
+
+// remoteInstance is what is known about another instance
+type remoteInstance struct {
+	seen time.Time
+	// users is keyed by userKey
+	users map[string]presenceUser
+}
+
+// reconnectBackplane calls connect, backing off between attempts, until it
+// succeeds (true) or closed reports the backplane closed (false)
+func reconnectBackplane(name string, closed func() bool, connect func() error) bool {
+	backoff := time.Second
+	for {
+		time.Sleep(backoff)
+		if closed() {
+			return false
+		}
+		err := connect()
+		if err == nil {
+			slog.Info("Reconnected to backplane", "backplane", name)
+			return true
+		}
+		slog.Warn("Error reconnecting to backplane", "backplane", name, "err", err, "retry_in", backoff)
+		backoff = min(2*backoff, backplaneMaxBackoff)
+	}
+}
+
+// newInstanceID returns a random ID telling this instance's events apart
+func newInstanceID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// runBackplane subscribes to the backplane and announces this instance's
+// users every presenceInterval, until ctx is done or the server drains
+func (s *Server) runBackplane(ctx context.Context) {
+	if err := s.Config.Backplane.Subscribe(s.handleBackplaneEvent); err != nil {
+		s.log.Error("Error subscribing to backplane", "err", err)
+		return
+	}
+	s.log.Info("Joined backplane", "instance", s.instanceID)
+	s.publish(backplaneEvent{Type: eventSync})
+
+	ticker := time.NewTicker(presenceInterval)
+	defer ticker.Stop()
+	for {
+		s.publishPresence()
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		if s.Draining() {
+			return
+		}
+	}
+}
+
+// publish sends an event to the other instances, if there is a backplane
+func (s *Server) publish(event backplaneEvent) {
+	if s.Config.Backplane == nil {
+		return
+	}
+	event.Origin = s.instanceID
+	data, err := json.Marshal(event)
+	if err != nil {
+		s.log.Error("Error encoding backplane event", "type", event.Type, "err", err)
+		return
+	}
+	if err := s.Config.Backplane.Publish(data); err != nil {
+		s.log.Warn("Error publishing to backplane", "type", event.Type, "err", err)
+	}
+}
+
+// publishPresence sends the list of this instance's users
+func (s *Server) publishPresence() {
+	users := make([]presenceUser, 0, s.clients.len())
+	s.clients.each(func(client *Session) {
+		users = append(users, presenceUser{Username: client.Username, Room: client.Room})
+	})
+	s.publish(backplaneEvent{Type: eventPresence, Users: users})
+}
+
+// handleBackplaneEvent acts on an event from another instance. Events are
+// only delivered to local clients, never passed back to the backplane.
+func (s *Server) handleBackplaneEvent(data []byte) {
+	var event backplaneEvent
+	if err := json.Unmarshal(data, &event); err != nil {
+		s.log.Warn("Ignoring malformed backplane event", "err", err)
+		return
+	}
+	if event.Origin == s.instanceID || event.Origin == "" {
+		return
+	}
+
+	switch event.Type {
+	case eventRoom:
+		s.deliverToRoom(event.Room, event.Text)
+	case eventAll:
+		s.deliverToAll(event.Text)
+	case eventMessage:
+		s.recordMessage(context.Background(), event.Room, event.Username, event.Text)
+		s.deliverToRoom(event.Room, fmt.Sprintf("%s: %s", event.Username, event.Text))
+	case eventUser:
+		if client := s.clientByName(event.Username); client != nil {
+			client.send(event.Text)
+		}
+	case eventJoin, eventLeave, eventPresence, eventGone:
+		s.remote.update(event)
+	case eventSync:
+		s.publishPresence()
+	default:
+		s.log.Debug("Ignoring unknown backplane event", "type", event.Type)
+	}
+}
+
+// whisperRemote sends a whisper to a user connected to another instance
+func (c *Session) whisperRemote(target, message string) {
+	c.send(fmt.Sprintf("[PM to %s]: %s", target, message))
+	if c.Server.Shadowbanned(c.Username) {
+		return
+	}
+	c.Server.publish(backplaneEvent{Type: eventUser, Username: target, Text: fmt.Sprintf("[PM from %s]: %s", c.Username, message)})
+	c.Server.recordPrivateMessage(c.ctx, c.Username, target, message)
+}
+
+// update applies a presence event from another instance
+func (p *presence) update(event backplaneEvent) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.instances == nil {
+		p.instances = make(map[string]*remoteInstance)
+	}
+	if event.Type == eventGone {
+		delete(p.instances, event.Origin)
+		return
+	}
+
+	instance := p.instances[event.Origin]
+	if instance == nil || event.Type == eventPresence {
+		instance = &remoteInstance{users: make(map[string]presenceUser)}
+		p.instances[event.Origin] = instance
+	}
+	instance.seen = time.Now()
+
+	switch event.Type {
+	case eventJoin:
+		instance.users[userKey(event.Username)] = presenceUser{Username: event.Username, Room: event.Room}
+	case eventLeave:
+		delete(instance.users, userKey(event.Username))
+	case eventPresence:
+		for _, user := range event.Users {
+			instance.users[userKey(user.Username)] = user
+		}
+	}
+}
+
+// users returns the users connected to other instances, sorted by name,
+// forgetting instances that have gone quiet
+func (p *presence) users() []presenceUser {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var users []presenceUser
+	for origin, instance := range p.instances {
+		if time.Since(instance.seen) > presenceExpiry {
+			delete(p.instances, origin)
+			continue
+		}
+		for _, user := range instance.users {
+			users = append(users, user)
+		}
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Username < users[j].Username })
+	return users
+}
+
+// lookup finds username among the users connected to other instances
+func (p *presence) lookup(username string) (presenceUser, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	key := userKey(username)
+	for _, instance := range p.instances {
+		if user, ok := instance.users[key]; ok && time.Since(instance.seen) <= presenceExpiry {
+			return user, true
+		}
+	}
+	return presenceUser{}, false
+}
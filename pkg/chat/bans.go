@@ -0,0 +1,453 @@
+// pkg/chat/bans.go
+package chat
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ErrBanned is the error code sent to banned users who try to join
+const ErrBanned = "ERR_BANNED"
+
+// Ban keeps a user and/or an IP address off the server
+type Ban struct {
+	Username  string    `json:"username,omitempty"`
+	IP        string    `json:"ip,omitempty"`
+	Reason    string    `json:"reason,omitempty"`
+	By        string    `json:"by,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+
+	// ExpiresAt is when the ban lifts; zero means never
+	ExpiresAt time.Time `json:"expires_at,omitzero"`
+}
+
+// Active reports whether the ban is still in force at now
+func (b Ban) Active(now time.Time) bool {
+	return b.ExpiresAt.IsZero() || now.Before(b.ExpiresAt)
+}
+
+// matches reports whether the ban covers a username or IP (either may be
+// empty to skip that check)
+func (b Ban) matches(username, ip string) bool {
+	return (username != "" && b.Username != "" && sameUsername(b.Username, username)) ||
+		(ip != "" && b.IP != "" && b.IP == ip)
+}
+
+// BanStore persists bans. Expired bans are ignored and eventually dropped.
+type BanStore interface {
+	// AddBan records a ban, replacing any ban on the same username and IP
+	AddBan(ban Ban) error
+
+	// RemoveBans lifts every ban on username or ip and returns how many
+	// were removed
+	RemoveBans(username, ip string) (int, error)
+
+	// FindBan returns an active ban covering username or ip, if any
+	FindBan(username, ip string) (Ban, bool, error)
+
+	// ListBans returns all active bans, oldest first
+	ListBans() ([]Ban, error)
+
+	// Close releases any resources held by the store
+	Close() error
+}
+
+// MemoryBanStore keeps bans in memory only; they are lost on restart
+type MemoryBanStore struct {
+	mu   sync.Mutex
+	bans []Ban
+}
+
+// NewMemoryBanStore creates an empty in-memory ban store
+func NewMemoryBanStore() *MemoryBanStore {
+	return &MemoryBanStore{}
+}
+
+// AddBan records a ban
+func (m *MemoryBanStore) AddBan(ban Ban) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.addLocked(ban)
+	return nil
+}
+
+func (m *MemoryBanStore) addLocked(ban Ban) {
+	if ban.CreatedAt.IsZero() {
+		ban.CreatedAt = time.Now()
+	}
+	m.expireLocked()
+	for i, existing := range m.bans {
+		if sameUsername(existing.Username, ban.Username) && existing.IP == ban.IP {
+			m.bans[i] = ban
+			return
+		}
+	}
+	m.bans = append(m.bans, ban)
+}
+
+// RemoveBans lifts bans on username or ip
+func (m *MemoryBanStore) RemoveBans(username, ip string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.removeLocked(username, ip), nil
+}
+
+func (m *MemoryBanStore) removeLocked(username, ip string) int {
+	kept := m.bans[:0]
+	for _, ban := range m.bans {
+		if !ban.matches(username, ip) {
+			kept = append(kept, ban)
+		}
+	}
+	removed := len(m.bans) - len(kept)
+	m.bans = kept
+	return removed
+}
+
+// FindBan returns an active ban covering username or ip
+func (m *MemoryBanStore) FindBan(username, ip string) (Ban, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	for _, ban := range m.bans {
+		if ban.Active(now) && ban.matches(username, ip) {
+			return ban, true, nil
+		}
+	}
+	return Ban{}, false, nil
+}
+
+// ListBans returns all active bans
+func (m *MemoryBanStore) ListBans() ([]Ban, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.listLocked(), nil
+}
+
+func (m *MemoryBanStore) listLocked() []Ban {
+	now := time.Now()
+	bans := make([]Ban, 0, len(m.bans))
+	for _, ban := range m.bans {
+		if ban.Active(now) {
+			bans = append(bans, ban)
+		}
+	}
+	sort.SliceStable(bans, func(i, j int) bool { return bans[i].CreatedAt.Before(bans[j].CreatedAt) })
+	return bans
+}
+
+// expireLocked drops bans that have lifted. m.mu must be held.
+func (m *MemoryBanStore) expireLocked() {
+	m.bans = m.listLocked()
+}
+
+// Close is a no-op for the in-memory store
+func (m *MemoryBanStore) Close() error {
+	return nil
+}
+
+// FileBanStore keeps bans in a JSON file, rewritten on every change
+type FileBanStore struct {
+	*MemoryBanStore
+	path string
+}
+
+// OpenFileBanStore loads (or creates) the ban file at path
+func OpenFileBanStore(path string) (*FileBanStore, error) {
+	mem := NewMemoryBanStore()
+
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("open ban store: %w", err)
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &mem.bans); err != nil {
+			return nil, fmt.Errorf("corrupt ban store %s: %w", path, err)
+		}
+		mem.expireLocked()
+	}
+
+	return &FileBanStore{MemoryBanStore: mem, path: path}, nil
+}
+
+// Reload rereads the ban file, picking up bans added or lifted by editing
+// it. On error the bans already loaded stay in effect.
+func (f *FileBanStore) Reload() error {
+	data, err := os.ReadFile(f.path)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("read ban store: %w", err)
+	}
+	var bans []Ban
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &bans); err != nil {
+			return fmt.Errorf("corrupt ban store %s: %w", f.path, err)
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.bans = bans
+	f.expireLocked()
+	return nil
+}
+
+// AddBan records a ban and saves the file
+func (f *FileBanStore) AddBan(ban Ban) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.addLocked(ban)
+	return f.saveLocked()
+}
+
+// RemoveBans lifts bans on username or ip and saves the file
+func (f *FileBanStore) RemoveBans(username, ip string) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	removed := f.removeLocked(username, ip)
+	if removed == 0 {
+		return 0, nil
+	}
+	return removed, f.saveLocked()
+}
+
+// saveLocked writes all active bans to disk. f.mu must be held.
+func (f *FileBanStore) saveLocked() error {
+	f.expireLocked()
+	err := writeFileAtomic(f.path, func(w io.Writer) error {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(f.bans)
+	})
+	if err != nil {
+		return fmt.Errorf("save ban store: %w", err)
+	}
+	return nil
+}
+
+// checkBan returns the active ban covering username or ip, if any. If the
+// store can't be read the connection is let through rather than locking
+// everyone out.
+func (s *Server) checkBan(username, ip string) (Ban, bool) {
+	ban, banned, err := s.Bans.FindBan(username, ip)
+	if err != nil {
+		s.log.Error("Error checking bans", "username", username, "remote_addr", ip, "err", err)
+		return Ban{}, false
+	}
+	return ban, banned
+}
+
+// banMessage tells a banned user why they can't join
+func banMessage(ban Ban) string {
+	msg := fmt.Sprintf("ERROR: %s: You are banned from this server", ErrBanned)
+	if ban.Reason != "" {
+		msg += ": " + ban.Reason
+	}
+	if !ban.ExpiresAt.IsZero() {
+		msg += fmt.Sprintf(" (until %s)", ban.ExpiresAt.Format(time.RFC1123))
+	}
+	return msg + "."
+}
+
+// BanUser records a ban, disconnects any connected clients it covers, and
+// returns the ban as stored
+func (s *Server) BanUser(ban Ban) (Ban, error) {
+	if ban.Username == "" && ban.IP == "" {
+		return ban, fmt.Errorf("a ban needs a username or an IP")
+	}
+	if ban.CreatedAt.IsZero() {
+		ban.CreatedAt = time.Now()
+	}
+	if err := s.Bans.AddBan(ban); err != nil {
+		return ban, err
+	}
+	s.log.Info("Banned", "username", ban.Username, "ip", ban.IP, "by", ban.By, "reason", ban.Reason, "expires_at", ban.ExpiresAt)
+	detail := ban.Reason
+	if !ban.ExpiresAt.IsZero() {
+		detail = fmt.Sprintf("until %s: %s", ban.ExpiresAt.Format(time.RFC3339), ban.Reason)
+	}
+	s.audit(AuditBan, ban.By, ban.Username, ban.IP, detail)
+
+	targets := s.clients.filter(func(client *Session) bool { return ban.matches(client.Username, client.IP) })
+
+	reason := strings.TrimPrefix(banMessage(ban), "ERROR: ")
+	for _, client := range targets {
+		s.closeClient(client, websocket.ClosePolicyViolation, reason)
+	}
+	return ban, nil
+}
+
+// parseLongDuration reads a ban or mute length such as 30m, 12h, 7d or 2w
+func parseLongDuration(s string) (time.Duration, bool) {
+	unit := time.Duration(0)
+	switch {
+	case strings.HasSuffix(s, "d"):
+		unit = 24 * time.Hour
+	case strings.HasSuffix(s, "w"):
+		unit = 7 * 24 * time.Hour
+	}
+	if unit != 0 {
+		n, err := strconv.Atoi(s[:len(s)-1])
+		if err != nil || n <= 0 {
+			return 0, false
+		}
+		return time.Duration(n) * unit, true
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, false
+	}
+	return d, true
+}
+
+// handleBan implements /ban [-ip] <user> [duration] [reason]. With -ip the
+// user's current address is banned as well.
+func (c *Session) handleBan(args string) {
+	if !c.can(permModerate) {
+		c.send("Only moderators can ban users.")
+		return
+	}
+
+	fields := strings.Fields(args)
+	banIP := len(fields) > 0 && fields[0] == "-ip"
+	if banIP {
+		fields = fields[1:]
+	}
+	if len(fields) == 0 {
+		c.send("Usage: /ban [-ip] <username> [duration] [reason]")
+		return
+	}
+	target, fields := fields[0], fields[1:]
+	if sameUsername(target, c.Username) {
+		c.send("You cannot ban yourself.")
+		return
+	}
+	targetClient := c.Server.clientByName(target)
+	if !c.outranks(targetClient) {
+		c.send(fmt.Sprintf("You cannot ban %s.", target))
+		return
+	}
+
+	ban := Ban{Username: target, By: c.Username}
+	length := ""
+	if len(fields) > 0 {
+		if d, ok := parseLongDuration(fields[0]); ok {
+			ban.ExpiresAt = time.Now().Add(d)
+			length, fields = fields[0], fields[1:]
+		}
+	}
+	ban.Reason = strings.Join(fields, " ")
+	if banIP {
+		if targetClient == nil {
+			c.send(fmt.Sprintf(
+				"%s is not connected, so only the username is banned.", target))
+		} else if targetClient.IP == c.IP {
+			c.send(fmt.Sprintf(
+				"%s connects from your own IP; ban them without -ip.", targetClient.Username))
+			return
+		} else {
+			ban.IP = targetClient.IP
+		}
+	}
+
+	if _, err := c.Server.BanUser(ban); err != nil {
+		c.logger().Error("Error banning", "target", target, "err", err)
+		c.send("Ban failed, please try again.")
+		return
+	}
+
+	event := fmt.Sprintf("*** %s was banned by %s", target, c.Username)
+	if length != "" {
+		event += " for " + length
+	}
+	c.Server.broadcastMessage(event + " ***")
+}
+
+// handleUnban implements /unban <user or IP>
+func (c *Session) handleUnban(args string) {
+	if !c.can(permModerate) {
+		c.send("Only moderators can unban users.")
+		return
+	}
+
+	target := strings.TrimSpace(args)
+	if target == "" {
+		c.send("Usage: /unban <username or IP>")
+		return
+	}
+
+	username, ip := target, ""
+	if net.ParseIP(target) != nil {
+		username, ip = "", target
+	}
+	removed, err := c.Server.Bans.RemoveBans(username, ip)
+	if err != nil {
+		c.logger().Error("Error unbanning", "target", target, "err", err)
+		c.send("Unban failed, please try again.")
+		return
+	}
+	if removed == 0 {
+		c.send(fmt.Sprintf("%s is not banned.", target))
+		return
+	}
+	c.logger().Info("Unbanned", "target", target)
+	c.Server.audit(AuditUnban, c.Username, username, ip, fmt.Sprintf("%d bans lifted", removed))
+	c.send(fmt.Sprintf("Unbanned %s.", target))
+}
+
+// handleBans implements /bans, listing the active bans
+func (c *Session) handleBans() {
+	if !c.can(permModerate) {
+		c.send("Only moderators can list bans.")
+		return
+	}
+
+	bans, err := c.Server.Bans.ListBans()
+	if err != nil {
+		c.logger().Error("Error listing bans", "err", err)
+		c.send("Could not list bans, please try again.")
+		return
+	}
+	if len(bans) == 0 {
+		c.send("No active bans.")
+		return
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Active bans (%d):", len(bans))
+	for _, ban := range bans {
+		subject := ban.Username
+		switch {
+		case subject == "":
+			subject = "IP " + ban.IP
+		case ban.IP != "":
+			subject += " (IP " + ban.IP + ")"
+		}
+		fmt.Fprintf(&b, "\n- %s by %s", subject, ban.By)
+		if ban.ExpiresAt.IsZero() {
+			b.WriteString(", permanent")
+		} else {
+			fmt.Fprintf(&b, ", %s left", time.Until(ban.ExpiresAt).Round(time.Minute))
+		}
+		if ban.Reason != "" {
+			b.WriteString(": " + ban.Reason)
+		}
+	}
+	c.send(b.String())
+}
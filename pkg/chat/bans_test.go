@@ -0,0 +1,176 @@
+// pkg/chat/bans_test.go
+package chat
+
+import (
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// TestBanOnConnect bans a connected user and checks that they are
+// disconnected, that they and lookalikes of their name are refused on
+// reconnecting, and that lifting the ban lets them back in
+func TestBanOnConnect(t *testing.T) {
+	s, url := newTestServer(t, Config{})
+	mallory, err := connect(url, "mallory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mallory.Close()
+	alice, err := connect(url, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Close()
+
+	if _, err := s.BanUser(Ban{Username: "mallory", Reason: "spam", By: "admin"}); err != nil {
+		t.Fatal(err)
+	}
+	mallory.SetReadDeadline(time.Now().Add(5 * time.Second))
+	drain(mallory)
+	if !waitFor(5*time.Second, func() bool { return !connected(s, "mallory") }) {
+		t.Fatal("banned user still connected")
+	}
+	if !connected(s, "alice") {
+		t.Error("ban disconnected another user")
+	}
+
+	for _, name := range []string{"mallory", "Mallory"} {
+		_, err := connect(url, name)
+		if err == nil || !strings.Contains(err.Error(), "ERROR: ERR_BANNED: You are banned from this server: spam.") {
+			t.Errorf("%s reconnecting: got %v", name, err)
+		}
+	}
+
+	if n, err := s.Bans.RemoveBans("mallory", ""); err != nil || n != 1 {
+		t.Fatalf("removed %d bans, %v", n, err)
+	}
+	conn, err := connect(url, "mallory")
+	if err != nil {
+		t.Fatalf("after unbanning: %v", err)
+	}
+	conn.Close()
+}
+
+// TestFileBanStore checks that bans survive reopening the file, and that a
+// ban on the same user replaces the earlier one
+func TestFileBanStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bans.json")
+	store, err := OpenFileBanStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.AddBan(Ban{Username: "mallory", Reason: "spam", CreatedAt: time.Now()})
+	store.AddBan(Ban{Username: "mallory", Reason: "more spam", CreatedAt: time.Now()})
+	store.AddBan(Ban{Username: "eve", CreatedAt: time.Now()})
+	store.Close()
+
+	store, err = OpenFileBanStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	bans, err := store.ListBans()
+	if err != nil || len(bans) != 2 {
+		t.Fatalf("got %v, %v", bans, err)
+	}
+	if ban, ok, _ := store.FindBan("MALLORY", ""); !ok || ban.Reason != "more spam" {
+		t.Errorf("got %+v, %v", ban, ok)
+	}
+	if _, ok, _ := store.FindBan("alice", ""); ok {
+		t.Error("alice is banned")
+	}
+}
+
+// TestBanDurations has a moderator ban a user for a while and list the
+// bans, checks that the ban lifts by itself, and that an IP ban keeps
+// everyone from that address out until it expires
+func TestBanDurations(t *testing.T) {
+	secret := []byte("s3cret")
+	auth, err := NewJWTAuth(JWTConfig{Secret: secret, RequireExp: new(bool)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, url := newTestServer(t, Config{Auth: auth})
+	// join connects with a token for username and its roles, and returns
+	// the connection with the first message the server sends
+	join := func(username string, roles ...string) (*websocket.Conn, <-chan string, string) {
+		t.Helper()
+		token := signJWT(t, map[string]interface{}{"alg": "HS256"}, map[string]interface{}{"sub": username, "roles": roles}, secret)
+		conn, resp, err := websocket.DefaultDialer.Dial(url, http.Header{"Authorization": {"Bearer " + token}})
+		if err != nil {
+			if resp != nil {
+				return nil, nil, resp.Status
+			}
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		conn.WriteMessage(websocket.TextMessage, []byte(username))
+		lines := readLines(conn)
+		select {
+		case first := <-lines:
+			return conn, lines, first
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: no reply", username)
+		}
+		return nil, nil, ""
+	}
+
+	moira, moiraLines, _ := join("moira", "moderator")
+	mallory, malloryLines, _ := join("mallory")
+	mallory.WriteMessage(websocket.TextMessage, []byte("/ban moira"))
+	waitLine(t, malloryLines, "Only moderators can ban users.", "")
+
+	moira.WriteMessage(websocket.TextMessage, []byte("/ban mallory 500ms flooding"))
+	waitLine(t, moiraLines, "*** mallory was banned by moira for 500ms ***", "")
+	if !waitFor(5*time.Second, func() bool { return !connected(s, "mallory") }) {
+		t.Fatal("banned user still connected")
+	}
+	moira.WriteMessage(websocket.TextMessage, []byte("/bans"))
+	waitLine(t, moiraLines, "Active bans (1):\n- mallory by moira, 0s left: flooding", "")
+	if _, _, first := join("mallory"); !strings.Contains(first, ErrBanned) || !strings.Contains(first, "(until ") {
+		t.Errorf("banned user reconnecting got %q", first)
+	}
+	if !waitFor(5*time.Second, func() bool {
+		_, _, first := join("mallory")
+		return strings.HasPrefix(first, "Welcome")
+	}) {
+		t.Fatal("ban didn't lift")
+	}
+
+	if _, err := s.BanUser(Ban{IP: "127.0.0.1", By: "admin", ExpiresAt: time.Now().Add(500 * time.Millisecond)}); err != nil {
+		t.Fatal(err)
+	}
+	if !waitFor(5*time.Second, func() bool { return !connected(s, "moira") }) {
+		t.Fatal("IP ban didn't disconnect the address's users")
+	}
+	if _, _, status := join("alice"); status != "403 Forbidden" {
+		t.Errorf("banned IP connecting got %q", status)
+	}
+	if !waitFor(5*time.Second, func() bool {
+		_, _, first := join("alice")
+		return strings.HasPrefix(first, "Welcome")
+	}) {
+		t.Fatal("IP ban didn't lift")
+	}
+}
+
+// TestParseLongDuration checks the ban and mute lengths accepted
+func TestParseLongDuration(t *testing.T) {
+	for in, want := range map[string]time.Duration{
+		"30m": 30 * time.Minute, "12h": 12 * time.Hour, "7d": 7 * 24 * time.Hour, "2w": 14 * 24 * time.Hour,
+	} {
+		if got, ok := parseLongDuration(in); !ok || got != want {
+			t.Errorf("%s: got %v, %v", in, got, ok)
+		}
+	}
+	for _, in := range []string{"", "0d", "-1h", "0s", "1y", "d", "spam"} {
+		if got, ok := parseLongDuration(in); ok {
+			t.Errorf("%s: got %v", in, got)
+		}
+	}
+}
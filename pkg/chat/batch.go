@@ -0,0 +1,98 @@
+// pkg/chat/batch.go
+package chat
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// BatchProtocol is the WebSocket subprotocol a client asks for to receive
+// several messages in one frame when the server has Config.BatchSize set.
+// Text frames still carry one message each, as without it; a binary frame
+// is a batch, holding for each message its length in bytes in decimal, a
+// newline, and the message itself. SplitBatch takes a batch apart.
+const BatchProtocol = "go-chat.batch"
+
+// errTruncatedBatch is returned by SplitBatch for a batch that ends early
+var errTruncatedBatch = errors.New("truncated batch")
+
+// SplitBatch returns the messages in a batch frame (see BatchProtocol)
+func SplitBatch(frame []byte) ([]string, error) {
+	var messages []string
+	for len(frame) > 0 {
+		header, rest, ok := bytes.Cut(frame, []byte{'\n'})
+		if !ok {
+			return nil, errTruncatedBatch
+		}
+		n, err := strconv.Atoi(string(header))
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid batch message length %q", header)
+		}
+		if n > len(rest) {
+			return nil, errTruncatedBatch
+		}
+		messages = append(messages, string(rest[:n]))
+		frame = rest[n:]
+	}
+	return messages, nil
+}
+
+// collectBatch appends first to batch and, if the client takes batches,
+// the messages queued after it, up to Config.BatchSize of them. It waits up
+// to Config.BatchDelay for more to arrive. A stop ends the batch and is
+// returned separately, to be carried out once the batch is written.
+func (c *Session) collectBatch(batch []outbound, first outbound) ([]outbound, *outbound) {
+	batch = append(batch, first)
+	cfg := &c.Server.Config
+	if !c.batched || cfg.BatchSize <= 1 {
+		return batch, nil
+	}
+
+	var wait <-chan time.Time
+	if cfg.BatchDelay > 0 {
+		timer := time.NewTimer(cfg.BatchDelay)
+		defer timer.Stop()
+		wait = timer.C
+	}
+	for len(batch) < cfg.BatchSize {
+		var msg outbound
+		if wait == nil {
+			select {
+			case msg = <-c.outbox:
+			default:
+				return batch, nil
+			}
+		} else {
+			select {
+			case msg = <-c.outbox:
+			case <-wait:
+				return batch, nil
+			case <-c.done:
+				return batch, nil
+			}
+		}
+		if msg.stop {
+			return batch, &msg
+		}
+		batch = append(batch, msg)
+	}
+	return batch, nil
+}
+
+// writeBatch writes batch to the connection as one binary frame
+func (c *Session) writeBatch(batch []outbound) error {
+	buf := getBuffer()
+	defer putBuffer(buf)
+	for _, msg := range batch {
+		buf.Write(strconv.AppendInt(buf.AvailableBuffer(), int64(len(msg.text)), 10))
+		buf.WriteByte('\n')
+		buf.WriteString(msg.text)
+	}
+	compressAbove(c.conn, buf.Len(), c.Server.Config.CompressionThreshold)
+	return c.conn.WriteMessage(websocket.BinaryMessage, buf.Bytes())
+}
@@ -0,0 +1,88 @@
+// pkg/chat/bridge.go
+package chat
+
+import (
+	"strings"
+	"unicode"
+)
+
+// bridge relays room messages to another chat service, such as a Slack
+// channel, and posts the messages from there with postMessage
+type bridge interface {
+	// name is the service's name, which messages posted from it are
+	// marked with, so they aren't relayed back
+	name() string
+
+	// relay hands over a message posted to room. It is called from client
+	// goroutines, so it must not block.
+	relay(room, username, text string)
+}
+
+// presenceBridge is a bridge that also follows who is in which room
+type presenceBridge interface {
+	bridge
+
+	// moved tells of username joining the chat in room to, moving from
+	// room from to room to, or leaving the chat from room from, the other
+	// being "". Like relay, it must not block.
+	moved(username, from, to string)
+}
+
+// addBridge starts relaying room messages to b
+func (s *Server) addBridge(b bridge) {
+	s.bridgesMu.Lock()
+	defer s.bridgesMu.Unlock()
+	s.bridges = append(s.bridges, b)
+}
+
+// relay hands a message posted here to every bridge but the one it came
+// through, if any. Messages from other instances aren't relayed again;
+// their instance relays them.
+func (s *Server) relay(room, username, via, text string) {
+	s.bridgesMu.RLock()
+	defer s.bridgesMu.RUnlock()
+	for _, b := range s.bridges {
+		if b.name() != via {
+			b.relay(room, username, text)
+		}
+	}
+}
+
+// relayPresence tells the bridges that follow presence of a user here
+// joining, leaving or changing rooms (see presenceBridge.moved)
+func (s *Server) relayPresence(username, from, to string) {
+	s.bridgesMu.RLock()
+	defer s.bridgesMu.RUnlock()
+	for _, b := range s.bridges {
+		if b, ok := b.(presenceBridge); ok {
+			b.moved(username, from, to)
+		}
+	}
+}
+
+// bridgedUsername returns the chat name for a user of a bridged service
+// called name, made a valid username and ending in suffix so they can't
+// pass for chat users, or based on their ID on the service if that can't
+// be done
+func bridgedUsername(name, id, suffix string) string {
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case r == ' ':
+			return '_'
+		case unicode.IsLetter(r), unicode.IsDigit(r), unicode.IsMark(r), r == '-', r == '_', r == '.':
+			return r
+		}
+		return -1
+	}, name)
+	if runes := []rune(name); len(runes) > maxUsernameLength-len(suffix) {
+		name = string(runes[:maxUsernameLength-len(suffix)])
+	}
+	if valid, err := validateUsername(name + suffix); err == nil {
+		return valid
+	}
+	id = strings.ToLower(id)
+	if len(id) > maxUsernameLength-len(suffix) {
+		id = id[:maxUsernameLength-len(suffix)]
+	}
+	return id + suffix
+}
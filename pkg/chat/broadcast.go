@@ -0,0 +1,90 @@
+// pkg/chat/broadcast.go
+package chat
+
+import (
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// broadcastChunk is how many recipients one broadcast worker queues a
+// message for. Broadcasts to fewer clients aren't worth splitting up.
+const broadcastChunk = 500
+
+// broadcastPool spreads queueing a broadcast for a large room over a fixed
+// set of workers
+type broadcastPool struct {
+	jobs chan broadcastJob
+}
+
+// broadcastJob queues msg for a chunk of a broadcast's recipients
+type broadcastJob struct {
+	clients []*Session
+	msg     outbound
+	done    *sync.WaitGroup
+}
+
+// newBroadcastPool starts workers goroutines, or returns nil if workers
+// isn't positive
+func newBroadcastPool(workers int) *broadcastPool {
+	if workers <= 0 {
+		return nil
+	}
+	p := &broadcastPool{jobs: make(chan broadcastJob)}
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+	return p
+}
+
+// work queues messages for the chunks it is given. The pool is never
+// closed, so it runs for the life of the process.
+func (p *broadcastPool) work() {
+	for job := range p.jobs {
+		queueAll(job.clients, job.msg)
+		job.done.Done()
+	}
+}
+
+// sendToEach sends the same message to every client in clients. The frame
+// is prepared once and shared, rather than built for each of them, and
+// large broadcasts are split between the broadcast workers. It returns once
+// the message is queued for everyone, so broadcasts from one goroutine
+// reach each client in order.
+func (s *Server) sendToEach(clients []*Session, message string) {
+	msg := outbound{text: message}
+	if len(clients) > 1 && s.netpoll == nil {
+		prepared, err := websocket.NewPreparedMessage(websocket.TextMessage, []byte(message))
+		if err == nil {
+			msg.prepared = prepared
+		}
+	}
+	if s.broadcasts == nil || len(clients) <= broadcastChunk {
+		queueAll(clients, msg)
+		return
+	}
+
+	var done sync.WaitGroup
+	for len(clients) > 0 {
+		chunk := clients[:min(broadcastChunk, len(clients))]
+		clients = clients[len(chunk):]
+		done.Add(1)
+		select {
+		case s.broadcasts.jobs <- broadcastJob{clients: chunk, msg: msg, done: &done}:
+		default:
+			// Every worker is busy, so don't wait for one
+			queueAll(chunk, msg)
+			done.Done()
+		}
+	}
+	done.Wait()
+}
+
+// queueAll queues msg for each client in clients
+func queueAll(clients []*Session, msg outbound) {
+	for _, client := range clients {
+		// A client that can't keep up is disconnected by queue, and one
+		// that has gone is removed by its ReadPump
+		client.queue(msg)
+	}
+}
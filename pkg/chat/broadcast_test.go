@@ -0,0 +1,101 @@
+// pkg/chat/broadcast_test.go
+package chat
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// benchmarkClients registers n clients with s, each with a goroutine
+// draining its outbox in place of a write pump
+func benchmarkClients(b *testing.B, s *Server, n int) []*Session {
+	b.Helper()
+	clients := make([]*Session, n)
+	for i := range clients {
+		client := &Session{Username: fmt.Sprintf("user%d", i), Room: DefaultRoom, Server: s, outbox: make(chan outbound, DefaultSendQueueSize)}
+		if err := s.clients.add(client, 0, func() bool { return false }, nil); err != nil {
+			b.Fatal(err)
+		}
+		go func() {
+			for msg := range client.outbox {
+				client.queuedBytes.Add(-int64(len(msg.text)))
+			}
+		}()
+		clients[i] = client
+	}
+	b.Cleanup(func() {
+		for _, client := range clients {
+			close(client.outbox)
+		}
+	})
+	return clients
+}
+
+// BenchmarkBroadcastLocking compares queueing a broadcast for a snapshot of
+// its recipients, as deliverToRoom does, with queueing it while holding the
+// registry's locks. Meanwhile other goroutines keep moving clients between
+// rooms, and ns/update is how long each move took, mostly spent waiting
+// for the lock.
+func BenchmarkBroadcastLocking(b *testing.B) {
+	broadcasts := []struct {
+		name      string
+		broadcast func(s *Server, msg outbound)
+	}{
+		{"snapshot", func(s *Server, msg outbound) {
+			queueAll(s.clients.filter(nil), msg)
+		}},
+		{"locked", func(s *Server, msg outbound) {
+			s.clients.each(func(client *Session) { client.queue(msg) })
+		}},
+	}
+	for _, recipients := range []int{100, 2000} {
+		for _, broadcast := range broadcasts {
+			b.Run(fmt.Sprintf("%d/%s", recipients, broadcast.name), func(b *testing.B) {
+				s := NewServerWithConfig(Config{Logger: slog.New(slog.NewTextHandler(io.Discard, nil)), SlowClientPolicy: SlowClientDropNewest})
+				clients := benchmarkClients(b, s, recipients)
+
+				const movers = 4
+				stop := make(chan struct{})
+				var moves, waited atomic.Int64
+				var wg sync.WaitGroup
+				for i := 0; i < movers; i++ {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						for n := i; ; n += movers {
+							select {
+							case <-stop:
+								return
+							default:
+							}
+							client := clients[n%len(clients)]
+							start := time.Now()
+							s.clients.update(client, func() { client.Room = DefaultRoom })
+							waited.Add(int64(time.Since(start)))
+							moves.Add(1)
+							time.Sleep(10 * time.Microsecond)
+						}
+					}()
+				}
+
+				msg := outbound{text: "a message to everyone"}
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					broadcast.broadcast(s, msg)
+				}
+				b.StopTimer()
+				close(stop)
+				wg.Wait()
+				if n := moves.Load(); n > 0 {
+					b.ReportMetric(float64(waited.Load())/float64(n), "ns/update")
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,57 @@
+// pkg/chat/buffers.go
+package chat
+
+import (
+	"bytes"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// maxPooledBuffer is the largest buffer put back in the pool. The odd huge
+// message shouldn't pin its buffer in memory for good.
+const maxPooledBuffer = 64 << 10
+
+// buffers holds the byte buffers that messages are read into and written
+// from, so each message doesn't allocate its own
+var buffers = sync.Pool{
+	New: func() any { return new(bytes.Buffer) },
+}
+
+// getBuffer returns an empty buffer from the pool
+func getBuffer() *bytes.Buffer {
+	return buffers.Get().(*bytes.Buffer)
+}
+
+// putBuffer returns buf to the pool. It must not be used afterwards.
+func putBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > maxPooledBuffer {
+		return
+	}
+	buf.Reset()
+	buffers.Put(buf)
+}
+
+// readText reads the next message from conn as a string. Unlike
+// Conn.ReadMessage, the only allocation is the string itself.
+func readText(conn wsConn) (string, error) {
+	_, r, err := conn.NextReader()
+	if err != nil {
+		return "", err
+	}
+	buf := getBuffer()
+	defer putBuffer(buf)
+	if _, err := buf.ReadFrom(r); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// writeText writes text to conn as a text message, without allocating a
+// copy of it for each write
+func writeText(conn wsConn, text string) error {
+	buf := getBuffer()
+	defer putBuffer(buf)
+	buf.WriteString(text)
+	return conn.WriteMessage(websocket.TextMessage, buf.Bytes())
+}
@@ -0,0 +1,124 @@
+// pkg/chat/buffers_test.go
+package chat
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// connPair returns the server and client ends of a WebSocket connection
+func connPair(b *testing.B) (server, client *websocket.Conn) {
+	b.Helper()
+	conns := make(chan *websocket.Conn, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := Upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			b.Error(err)
+			return
+		}
+		conns <- conn
+	}))
+	b.Cleanup(ts.Close)
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http"), nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	server = <-conns
+	b.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return server, client
+}
+
+// benchmarkSizes are the message sizes benchmarked: a chat line, and a long
+// paste
+var benchmarkSizes = []struct {
+	name string
+	size int
+}{
+	{"short", 40},
+	{"long", 4 << 10},
+}
+
+// BenchmarkRead compares reading messages with Conn.ReadMessage, as
+// ReadPump used to, with readText
+func BenchmarkRead(b *testing.B) {
+	reads := []struct {
+		name string
+		read func(wsConn) (string, error)
+	}{
+		{"ReadMessage", func(conn wsConn) (string, error) {
+			_, message, err := conn.ReadMessage()
+			return string(message), err
+		}},
+		{"readText", readText},
+	}
+	for _, size := range benchmarkSizes {
+		message := []byte(strings.Repeat("x", size.size))
+		for _, read := range reads {
+			b.Run(size.name+"/"+read.name, func(b *testing.B) {
+				server, client := connPair(b)
+				go func() {
+					for {
+						if err := client.WriteMessage(websocket.TextMessage, message); err != nil {
+							return
+						}
+					}
+				}()
+				b.ReportAllocs()
+				b.SetBytes(int64(size.size))
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if _, err := read.read(server); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+// BenchmarkWrite compares writing a message by converting it to a byte
+// slice, as writePump used to, with writeText
+func BenchmarkWrite(b *testing.B) {
+	writes := []struct {
+		name  string
+		write func(wsConn, string) error
+	}{
+		{"WriteMessage", func(conn wsConn, text string) error {
+			return conn.WriteMessage(websocket.TextMessage, []byte(text))
+		}},
+		{"writeText", writeText},
+	}
+	for _, size := range benchmarkSizes {
+		text := strings.Repeat("x", size.size)
+		for _, write := range writes {
+			b.Run(size.name+"/"+write.name, func(b *testing.B) {
+				server, client := connPair(b)
+				go func() {
+					for {
+						_, r, err := client.NextReader()
+						if err != nil {
+							return
+						}
+						io.Copy(io.Discard, r)
+					}
+				}()
+				b.ReportAllocs()
+				b.SetBytes(int64(size.size))
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if err := write.write(server, text); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,26 @@
+// pkg/chat/certauth.go
+package chat
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// CertAuth accepts connections that presented a TLS client certificate
+// verified against the server's client CAs, using the certificate's common
+// name as the username. The server's tls.Config must set ClientCAs and a
+// verifying ClientAuth mode.
+type CertAuth struct{}
+
+// Authenticate takes the username from the verified client certificate
+func (CertAuth) Authenticate(r *http.Request) (Identity, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return Identity{}, fmt.Errorf("%w: no verified client certificate", ErrUnauthorized)
+	}
+
+	cert := r.TLS.VerifiedChains[0][0]
+	if cert.Subject.CommonName == "" {
+		return Identity{}, fmt.Errorf("%w: client certificate has no common name", ErrUnauthorized)
+	}
+	return Identity{Username: cert.Subject.CommonName, Role: RoleUser}, nil
+}
@@ -0,0 +1,124 @@
+// pkg/chat/certauth_test.go
+package chat
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// testCA issues client certificates
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "go-chat test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert: cert, key: key}
+}
+
+// issue returns a client certificate for commonName
+func (ca *testCA) issue(t *testing.T, commonName string) tls.Certificate {
+	t.Helper()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// TestCertAuth connects with client certificates and checks that only
+// those issued by the trusted CA for a valid, non-guest common name are
+// accepted, as that name
+func TestCertAuth(t *testing.T) {
+	ca, otherCA := newTestCA(t), newTestCA(t)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.cert)
+
+	s := NewServerWithConfig(Config{Auth: CertAuth{}, Logger: slog.New(slog.NewTextHandler(io.Discard, nil))})
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(s.HandleWebSocket))
+	ts.TLS = &tls.Config{ClientCAs: clientCAs, ClientAuth: tls.VerifyClientCertIfGiven}
+	ts.StartTLS()
+	defer ts.Close()
+	url := "wss" + strings.TrimPrefix(ts.URL, "https")
+	roots := x509.NewCertPool()
+	roots.AddCert(ts.Certificate())
+
+	// dial connects presenting certs and returns the upgrade's status, or
+	// 0 if the TLS handshake failed
+	dial := func(certs ...tls.Certificate) (*websocket.Conn, int) {
+		dialer := websocket.Dialer{TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: certs}}
+		conn, resp, err := dialer.Dial(url, nil)
+		switch {
+		case err == nil:
+			return conn, http.StatusSwitchingProtocols
+		case resp != nil:
+			return nil, resp.StatusCode
+		}
+		return nil, 0
+	}
+
+	conn, status := dial(ca.issue(t, "alice"))
+	if status != http.StatusSwitchingProtocols {
+		t.Fatalf("trusted certificate: got %d", status)
+	}
+	defer conn.Close()
+	conn.WriteMessage(websocket.TextMessage, []byte("mallory"))
+	if !waitFor(5*time.Second, func() bool { return connected(s, "alice") }) || connected(s, "mallory") {
+		t.Error("certificate didn't connect as alice")
+	}
+
+	if _, status := dial(); status != http.StatusUnauthorized {
+		t.Errorf("no certificate: got %d", status)
+	}
+	if _, status := dial(ca.issue(t, "")); status != http.StatusUnauthorized {
+		t.Errorf("certificate without a common name: got %d", status)
+	}
+	if _, status := dial(ca.issue(t, "guest-0001")); status != http.StatusUnauthorized {
+		t.Errorf("certificate for a guest name: got %d", status)
+	}
+	if _, status := dial(ca.issue(t, "Alice Smith")); status != http.StatusUnauthorized {
+		t.Errorf("certificate for an invalid name: got %d", status)
+	}
+	if _, status := dial(otherCA.issue(t, "alice")); status == http.StatusSwitchingProtocols {
+		t.Error("certificate from an untrusted CA accepted")
+	}
+}
@@ -2,142 +2,580 @@
 package chat
 
 import (
-	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
 	"fmt"
-	"log"
+	"net/http"
 	"net/url"
 	"os"
-	"os/signal"
 	"strings"
-	"syscall"
+	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"github.com/gorilla/websocket"
 )
 
-// RunClient connects to a chat server and handles the chat session
-func RunClient(serverAddr, username string) error {
-	// Validate username
-	if len(username) < 2 || len(username) > 20 {
-		return fmt.Errorf("username must be between 2 and 20 characters")
+// ClientOptions holds optional settings for a chat session
+type ClientOptions struct {
+	// Token is sent to servers that require authentication
+	Token string
+
+	// Password is sent with the username as HTTP Basic credentials to
+	// servers that check passwords (e.g. against LDAP)
+	Password string
+
+	// CAFile is a PEM bundle of certificate authorities trusted for wss://
+	// servers, in addition to the system roots
+	CAFile string
+
+	// InsecureSkipVerify disables server certificate checks (testing only)
+	InsecureSkipVerify bool
+
+	// CertFile and KeyFile are a client certificate presented to servers
+	// that authenticate users by certificate
+	CertFile string
+	KeyFile  string
+
+	// Encrypt sends whispers end-to-end encrypted, so the server can't read
+	// them. Both sides must have it enabled.
+	Encrypt bool
+
+	// Compression offers permessage-deflate to the server. If it agrees,
+	// messages of at least CompressionThreshold bytes are compressed at
+	// CompressionLevel, from 1 (fastest, the default) to 9 (smallest).
+	Compression          bool
+	CompressionLevel     int
+	CompressionThreshold int
+
+	// WebTransport connects to wss:// servers with WebTransport over
+	// HTTP/3 (experimental), falling back to a WebSocket if the server
+	// doesn't take it or UDP is blocked
+	WebTransport bool
+}
+
+// webTransportDialTimeout is how long the client tries WebTransport before
+// falling back to a WebSocket
+const webTransportDialTimeout = 3 * time.Second
+
+// serverURL turns a host:port or a full ws://, wss://, http:// or https://
+// URL into the WebSocket URL to dial. The path defaults to /ws.
+func serverURL(addr string) (*url.URL, error) {
+	if !strings.Contains(addr, "://") {
+		return &url.URL{Scheme: "ws", Host: addr, Path: "/ws"}, nil
 	}
 
-	if strings.ContainsAny(username, " \t\n/\\:") {
-		return fmt.Errorf("username cannot contain spaces or special characters (/, \\, :)")
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid server URL: %w", err)
+	}
+	switch u.Scheme {
+	case "ws", "wss":
+	case "http":
+		u.Scheme = "ws"
+	case "https":
+		u.Scheme = "wss"
+	default:
+		return nil, fmt.Errorf("unsupported server URL scheme %q", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("server URL has no host")
 	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/ws"
+	}
+	return u, nil
+}
 
-	// Construct websocket URL
-	u := url.URL{Scheme: "ws", Host: serverAddr, Path: "/ws"}
-	fmt.Printf("Connecting to %s...\n", u.String())
+// tlsConfig returns the options' TLS settings, or nil for the defaults
+func (opts ClientOptions) tlsConfig() (*tls.Config, error) {
+	if opts.CAFile == "" && !opts.InsecureSkipVerify && opts.CertFile == "" {
+		return nil, nil
+	}
 
-	// Connect to the WebSocket server
-	headers := make(map[string][]string)
-	headers["Ngrok-Skip-Browser-Warning"] = []string{"true"}
-	conn, _, err := websocket.DefaultDialer.Dial(u.String(), headers)
+	tlsConfig := &tls.Config{InsecureSkipVerify: opts.InsecureSkipVerify}
+	if opts.CAFile != "" {
+		pem, err := os.ReadFile(opts.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read CA bundle: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", opts.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if opts.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// dialer returns a WebSocket dialer using the options' TLS settings
+func (opts ClientOptions) dialer() (*websocket.Dialer, error) {
+	dialer := *websocket.DefaultDialer
+	dialer.EnableCompression = opts.Compression
+	dialer.Subprotocols = []string{BatchProtocol}
+	tlsConfig, err := opts.tlsConfig()
 	if err != nil {
-		return fmt.Errorf("connection error: %w", err)
+		return nil, err
 	}
-	defer conn.Close()
+	dialer.TLSClientConfig = tlsConfig
+	return &dialer, nil
+}
 
-	// Send username as the first message
-	if err := conn.WriteMessage(websocket.TextMessage, []byte(username)); err != nil {
-		return fmt.Errorf("error sending username: %w", err)
+// clientConn is what a chat session talks over: a WebSocket connection or
+// a WebTransport session
+type clientConn interface {
+	ReadMessage() (messageType int, p []byte, err error)
+	WriteMessage(messageType int, data []byte) error
+	EnableWriteCompression(enable bool)
+	SetCompressionLevel(level int) error
+	Close() error
+}
+
+// dial connects to the server at u, with WebTransport if opts.WebTransport
+// is set and the server takes it, otherwise with a WebSocket. fallback is
+// why WebTransport was asked for but not used.
+func (opts ClientOptions) dial(ctx context.Context, u *url.URL, headers http.Header) (conn clientConn, resp *http.Response, fallback, err error) {
+	if opts.WebTransport && u.Scheme == "wss" {
+		tlsConfig, err := opts.tlsConfig()
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		wtURL := *u
+		wtURL.Scheme = "https"
+		wtCtx, cancel := context.WithTimeout(ctx, webTransportDialTimeout)
+		defer cancel()
+		conn, resp, err := dialWebTransport(wtCtx, &wtURL, headers, tlsConfig)
+		if err == nil {
+			return conn, resp, nil, nil
+		}
+		if resp != nil && resp.StatusCode == http.StatusUnauthorized {
+			return nil, resp, nil, err
+		}
+		fallback = fmt.Errorf("WebTransport unavailable (%v), falling back to WebSocket", err)
+	} else if opts.WebTransport {
+		fallback = errors.New("WebTransport needs a wss:// server, using WebSocket")
 	}
 
-	// Setup channels
-	done := make(chan struct{})
-	interrupt := make(chan os.Signal, 1)
-	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
-
-	// Clear the screen and show welcome message
-	fmt.Print("\033[H\033[2J") // Clear screen
-	fmt.Println("=== Go Chat CLI ===")
-	fmt.Println("Type /help for available commands")
-	fmt.Println("Press Ctrl+C to exit")
-	fmt.Println("====================")
-
-	// Goroutine to receive messages
-	go func() {
-		defer close(done)
-		for {
-			_, message, err := conn.ReadMessage()
-			if err != nil {
-				if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
-					fmt.Printf("\rConnection closed: %v\n", err)
-				}
-				return
-			}
+	dialer, err := opts.dialer()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	wsConn, resp, err := dialer.DialContext(ctx, u.String(), headers)
+	if err != nil {
+		return nil, resp, nil, err
+	}
+	return wsConn, resp, fallback, nil
+}
+
+// ErrCredentialsRejected is returned by Client.Connect when the server
+// rejects the client's token, password or certificate
+var ErrCredentialsRejected = errors.New("authentication failed: server rejected the credentials")
 
-			msgText := string(message)
+// errNotConnected is returned by a Client's methods before Connect
+var errNotConnected = errors.New("not connected")
 
-			// Only log to debug level, not to console
-			log.SetOutput(os.Stderr)
-			log.SetFlags(0)
+// Types of ClientEvent
+const (
+	// ClientConnected is sent once the connection is up and the username
+	// sent. Text is the server's URL, and Err why WebTransport wasn't used
+	// if it was asked for.
+	ClientConnected = "connected"
+	// ClientJoined is sent when the client joins Room: the first room on
+	// connecting, then each room it moves to
+	ClientJoined = "joined"
+	// ClientUserJoined and ClientUserLeft are sent when Username joins or
+	// leaves the chat or the client's Room
+	ClientUserJoined = "user_joined"
+	ClientUserLeft   = "user_left"
+	// ClientError is a problem that didn't end the connection
+	ClientError = "error"
+	// ClientDisconnected is the last event. Text is the reason the server
+	// gave, if any, and Err is set unless the connection closed normally.
+	ClientDisconnected = "disconnected"
+)
+
+// ClientEvent is a change in a Client's connection or room
+type ClientEvent struct {
+	Type     string
+	Room     string
+	Username string
+	Text     string
+	Err      error
+}
+
+// ClientMessage is a line from the server, as a user would see it. Room
+// messages and whispers also have who sent them picked out.
+type ClientMessage struct {
+	// Line is the whole line, with encrypted whispers decrypted
+	Line string
+	// From is who sent a room message or a whisper to the client, and To
+	// who a whisper from the client went to. Both are empty for the
+	// server's notices and replies.
+	From string
+	To   string
+	// Room is the room a room message was posted in
+	Room string
+	// Text is what was written, without the sender
+	Text string
+	// Private is set for whispers
+	Private bool
+}
 
-			// Print the clean message to console
-			fmt.Printf("\r%s\n", msgText)
-			fmt.Print("> ")
+// serverLabels start replies of the server's that would otherwise look
+// like room messages, as in "Usage: /join <room>"
+var serverLabels = map[string]bool{"ERROR": true, "Uptime": true, "Usage": true, "Warning": true}
+
+// parseMessage picks the sender out of a line posted in room: "name: text"
+// for room messages, "[PM from name]: text" or "[PM to name]: text" for
+// whispers, with " (encrypted)" before the colon if they were
+func parseMessage(line, room string) ClientMessage {
+	msg := ClientMessage{Line: line}
+	head, body, ok := strings.Cut(line, ": ")
+	if !ok {
+		return msg
+	}
+	if peer, ok := strings.CutPrefix(strings.TrimSuffix(head, " (encrypted)"), "[PM "); ok && strings.HasSuffix(peer, "]") {
+		peer = strings.TrimSuffix(peer, "]")
+		if from, ok := strings.CutPrefix(peer, "from "); ok {
+			msg.From = from
+		} else if to, ok := strings.CutPrefix(peer, "to "); ok {
+			msg.To = to
+		} else {
+			return msg
 		}
-	}()
+		msg.Text, msg.Private = body, true
+		return msg
+	}
+	if head == "" || strings.ContainsAny(head, " \t\n[]*") || strings.HasPrefix(head, "-") || serverLabels[head] {
+		return msg
+	}
+	msg.From, msg.Room, msg.Text = head, room, body
+	return msg
+}
 
-	// User input loop
-	scanner := bufio.NewScanner(os.Stdin)
-	fmt.Print("> ")
-	go func() {
-		for scanner.Scan() {
-			message := scanner.Text()
+// Client is a chat session for Go programs and bots: messages and events
+// are handed to callbacks, and messages are sent with its methods. It
+// connects once. RunClient is the terminal client built on it.
+type Client struct {
+	server   string
+	username string
+	opts     ClientOptions
 
-			// Skip empty messages
-			if strings.TrimSpace(message) == "" {
-				fmt.Print("> ")
-				continue
-			}
+	onMessage func(ClientMessage)
+	onEvent   func(ClientEvent)
 
-			// Handle client-side exit command
-			if message == "/exit" {
-				fmt.Println("Exiting chat...")
-				// Send close message
-				conn.WriteMessage(
-					websocket.CloseMessage,
-					websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
-				)
-				return
-			}
+	started atomic.Bool
+	e2e     *e2eSession
+	done    chan struct{}
 
-			// Send the message silently without debug output
-			err := conn.WriteMessage(websocket.TextMessage, []byte(message))
-			if err != nil {
-				fmt.Printf("Error sending message: %v\n", err)
-				return
-			}
+	// writeMu serializes writes, from the caller and from answering the
+	// server's challenges, and guards conn
+	writeMu sync.Mutex
+	conn    clientConn
+
+	roomMu sync.Mutex
+	room   string
+}
+
+// NewClient returns a client that will join the server at serverAddr, a
+// host:port or a URL as given to RunClient, as username
+func NewClient(serverAddr, username string, opts ClientOptions) *Client {
+	return &Client{server: serverAddr, username: username, opts: opts, done: make(chan struct{})}
+}
+
+// OnMessage sets the function called with each message from the server.
+// Callbacks are called one at a time, in order, and must be set before
+// Connect.
+func (c *Client) OnMessage(fn func(ClientMessage)) {
+	c.onMessage = fn
+}
+
+// OnEvent sets the function called with each ClientEvent, after the
+// message it came from if there was one
+func (c *Client) OnEvent(fn func(ClientEvent)) {
+	c.onEvent = fn
+}
 
-			fmt.Print("> ")
+// Username returns the name the client joins as
+func (c *Client) Username() string {
+	return c.username
+}
+
+// Room returns the room the client is in, or "" before it has joined
+func (c *Client) Room() string {
+	c.roomMu.Lock()
+	defer c.roomMu.Unlock()
+	return c.room
+}
+
+// checkClientUsername catches usernames the server is sure to refuse,
+// before connecting; the server has the final say
+func checkClientUsername(username string) error {
+	if n := utf8.RuneCountInString(username); n < minUsernameLength || n > maxUsernameLength {
+		return fmt.Errorf("username must be between %d and %d characters", minUsernameLength, maxUsernameLength)
+	}
+	if strings.ContainsAny(username, " \t\n/\\:") {
+		return fmt.Errorf("username cannot contain spaces or special characters (/, \\, :)")
+	}
+	return nil
+}
+
+// Connect dials the server and sends the username, then hands what the
+// server sends to the callbacks until the connection ends. ctx bounds
+// only the dial; Close ends the session.
+func (c *Client) Connect(ctx context.Context) error {
+	if err := checkClientUsername(c.username); err != nil {
+		return err
+	}
+	u, err := serverURL(c.server)
+	if err != nil {
+		return err
+	}
+	level, err := compressionLevel(c.opts.CompressionLevel)
+	if err != nil {
+		return err
+	}
+
+	if !c.started.CompareAndSwap(false, true) {
+		return errors.New("already connected")
+	}
+	connected := false
+	defer func() {
+		if !connected {
+			c.started.Store(false)
 		}
 	}()
 
-	// Wait for termination
-	for {
+	headers := make(http.Header)
+	headers["Ngrok-Skip-Browser-Warning"] = []string{"true"}
+	if c.opts.Password != "" {
+		basic := base64.StdEncoding.EncodeToString([]byte(c.username + ":" + c.opts.Password))
+		headers["Authorization"] = []string{"Basic " + basic}
+	}
+	if c.opts.Token != "" {
+		if c.opts.Password != "" {
+			headers["X-Chat-Token"] = []string{c.opts.Token}
+		} else {
+			headers["Authorization"] = []string{"Bearer " + c.opts.Token}
+		}
+	}
+	if c.opts.Encrypt {
+		if c.e2e, err = newE2ESession(); err != nil {
+			return err
+		}
+		headers[PublicKeyHeader] = []string{c.e2e.encodedPublicKey()}
+	}
+
+	conn, resp, fallback, err := c.opts.dial(ctx, u, headers)
+	if err != nil {
+		if resp != nil && resp.StatusCode == http.StatusUnauthorized {
+			return ErrCredentialsRejected
+		}
+		return fmt.Errorf("connection error: %w", err)
+	}
+	conn.SetCompressionLevel(level)
+	compressAbove(conn, len(c.username), c.opts.CompressionThreshold)
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(c.username)); err != nil {
+		conn.Close()
+		return fmt.Errorf("error sending username: %w", err)
+	}
+	c.writeMu.Lock()
+	c.conn = conn
+	c.writeMu.Unlock()
+	connected = true
+
+	c.event(ClientEvent{Type: ClientConnected, Text: u.String(), Err: fallback})
+	go c.receive()
+	return nil
+}
+
+// Send sends a message to the client's room, or a command, as is
+func (c *Client) Send(message string) error {
+	return c.write(websocket.TextMessage, []byte(message))
+}
+
+// Whisper sends a private message to username, encrypted if the client
+// was created with Encrypt
+func (c *Client) Whisper(username, message string) error {
+	if c.e2e == nil {
+		return c.Send("/whisper " + username + " " + message)
+	}
+	cmd, err := c.e2e.whisper(username, message)
+	if err != nil {
+		return fmt.Errorf("encrypt message: %w", err)
+	}
+	return c.Send(cmd)
+}
+
+// Join moves the client to room, creating it if nobody is in it. A
+// ClientJoined event follows once the server has moved it.
+func (c *Client) Join(room string) error {
+	return c.Send("/join " + room)
+}
+
+// Done returns a channel closed once the connection has ended
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// Close asks the server to close the connection, and waits a second for
+// it to before hanging up
+func (c *Client) Close() error {
+	c.writeMu.Lock()
+	conn := c.conn
+	c.writeMu.Unlock()
+	if conn == nil {
+		return errNotConnected
+	}
+	select {
+	case <-c.done:
+		return nil
+	default:
+	}
+
+	err := c.write(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	if err == nil {
 		select {
-		case <-done:
+		case <-c.done:
 			return nil
-		case <-interrupt:
-			fmt.Println("\rInterrupted, closing connection...")
-
-			// Gracefully close WebSocket
-			err := conn.WriteMessage(
-				websocket.CloseMessage,
-				websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
-			)
-			if err != nil {
-				return fmt.Errorf("write close error: %w", err)
+		case <-time.After(time.Second):
+		}
+	}
+	conn.Close()
+	<-c.done
+	return err
+}
+
+// write sends one frame on the connection
+func (c *Client) write(messageType int, data []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.conn == nil {
+		return errNotConnected
+	}
+	compressAbove(c.conn, len(data), c.opts.CompressionThreshold)
+	return c.conn.WriteMessage(messageType, data)
+}
+
+// event hands an event to the OnEvent callback, if there is one
+func (c *Client) event(event ClientEvent) {
+	if c.onEvent != nil {
+		c.onEvent(event)
+	}
+}
+
+// receive reads from the connection until it ends
+func (c *Client) receive() {
+	defer close(c.done)
+	defer c.conn.Close()
+
+	for {
+		messageType, frame, err := c.conn.ReadMessage()
+		if err != nil {
+			event := ClientEvent{Type: ClientDisconnected, Err: err}
+			var closeErr *websocket.CloseError
+			if errors.As(err, &closeErr) {
+				event.Text = closeErr.Text
 			}
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				event.Err = nil
+			}
+			c.event(event)
+			return
+		}
 
-			// Wait for server to close connection or timeout
-			select {
-			case <-done:
-			case <-time.After(time.Second):
+		// A binary frame is a batch of messages (see BatchProtocol)
+		lines := []string{string(frame)}
+		if messageType == websocket.BinaryMessage {
+			if lines, err = SplitBatch(frame); err != nil {
+				c.event(ClientEvent{Type: ClientError, Err: fmt.Errorf("ignoring malformed batch: %w", err)})
+				continue
 			}
-			return nil
 		}
+		for _, line := range lines {
+			c.handle(line)
+		}
+	}
+}
+
+// handle answers challenges and key replies itself, and hands anything
+// else to the callbacks
+func (c *Client) handle(line string) {
+	// Answer the server's anti-bot challenge without bothering the user
+	if challenge, difficulty, ok := parseProofOfWork(line); ok {
+		c.Send(fmt.Sprintf("/pow %d", SolveProofOfWork(challenge, difficulty)))
+		return
+	}
+
+	// Encrypted whispers are handled here so only plaintext is passed on
+	if c.e2e != nil && strings.HasPrefix(line, pubkeyPrefix) {
+		sends, notice := c.e2e.handleKey(line)
+		for _, cmd := range sends {
+			c.Send(cmd)
+		}
+		if notice == "" {
+			return
+		}
+		line = notice
+	} else if c.e2e != nil && strings.HasPrefix(line, epmPrefix) {
+		line = c.e2e.open(line)
+	}
+
+	event, isEvent := c.membership(line)
+	if c.onMessage != nil {
+		c.onMessage(parseMessage(line, c.Room()))
+	}
+	if isEvent {
+		c.event(event)
+	}
+}
+
+// membership turns a notice of someone joining or leaving the chat or a
+// room, as in "*** alice joined #dev ***", into an event, following the
+// client's own moves between rooms
+func (c *Client) membership(line string) (ClientEvent, bool) {
+	notice, ok := strings.CutPrefix(line, "*** ")
+	if !ok || !strings.HasSuffix(notice, " ***") {
+		return ClientEvent{}, false
+	}
+	name, what, _ := strings.Cut(strings.TrimSuffix(notice, " ***"), " ")
+	self := sameUsername(name, c.username)
+
+	room := c.Room()
+	switch {
+	case what == "joined the chat" && self:
+		room = DefaultRoom
+	case what == "joined the chat", what == "left the chat":
+	case strings.HasPrefix(what, "joined #"), strings.HasPrefix(what, "left #"):
+		_, room, _ = strings.Cut(what, "#")
+	default:
+		return ClientEvent{}, false
+	}
+
+	switch {
+	case self && strings.HasPrefix(what, "joined"):
+		c.roomMu.Lock()
+		c.room = room
+		c.roomMu.Unlock()
+		return ClientEvent{Type: ClientJoined, Room: room, Username: name}, true
+	case self:
+		return ClientEvent{}, false
+	case strings.HasPrefix(what, "joined"):
+		return ClientEvent{Type: ClientUserJoined, Room: room, Username: name}, true
 	}
+	return ClientEvent{Type: ClientUserLeft, Room: room, Username: name}, true
 }
@@ -0,0 +1,149 @@
+// pkg/chat/client_test.go
+package chat
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// testClient is a Client whose callbacks feed channels
+type testClient struct {
+	*Client
+	messages chan ClientMessage
+	events   chan ClientEvent
+}
+
+// newTestClient connects username to the server at url
+func newTestClient(t *testing.T, url, username string, opts ClientOptions) *testClient {
+	t.Helper()
+	c := &testClient{
+		Client:   NewClient(url, username, opts),
+		messages: make(chan ClientMessage, 100),
+		events:   make(chan ClientEvent, 100),
+	}
+	c.OnMessage(func(msg ClientMessage) { c.messages <- msg })
+	c.OnEvent(func(event ClientEvent) { c.events <- event })
+	if err := c.Connect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	c.waitEvent(t, func(event ClientEvent) bool { return event.Type == ClientJoined && event.Room == DefaultRoom })
+	return c
+}
+
+// waitMessage waits for a message matching match
+func (c *testClient) waitMessage(t *testing.T, match func(ClientMessage) bool) ClientMessage {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case msg := <-c.messages:
+			if match(msg) {
+				return msg
+			}
+		case <-timeout:
+			t.Fatalf("%s: no matching message", c.Username())
+		}
+	}
+}
+
+// waitEvent waits for an event matching match
+func (c *testClient) waitEvent(t *testing.T, match func(ClientEvent) bool) ClientEvent {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case event := <-c.events:
+			if match(event) {
+				return event
+			}
+		case <-timeout:
+			t.Fatalf("%s: no matching event", c.Username())
+		}
+	}
+}
+
+// TestClient has two library clients talk in a room, whisper, encrypted
+// and not, and move between rooms
+func TestClient(t *testing.T) {
+	_, url := newTestServer(t, Config{})
+	alice := newTestClient(t, url, "alice", ClientOptions{Encrypt: true})
+	bob := newTestClient(t, url, "bob", ClientOptions{Encrypt: true})
+	alice.waitEvent(t, func(event ClientEvent) bool {
+		return event.Type == ClientUserJoined && event.Username == "bob" && event.Room == DefaultRoom
+	})
+
+	if err := bob.Send("hello"); err != nil {
+		t.Fatal(err)
+	}
+	msg := alice.waitMessage(t, func(msg ClientMessage) bool { return msg.From != "" })
+	if msg.From != "bob" || msg.Room != DefaultRoom || msg.Text != "hello" || msg.Private {
+		t.Errorf("room message = %+v", msg)
+	}
+
+	// The first whisper waits for bob's key, the reply uses the key it came with
+	if err := alice.Whisper("bob", "psst"); err != nil {
+		t.Fatal(err)
+	}
+	msg = bob.waitMessage(t, func(msg ClientMessage) bool { return msg.Private })
+	if msg.From != "alice" || msg.Text != "psst" || msg.Line != "[PM from alice] (encrypted): psst" {
+		t.Errorf("whisper = %+v", msg)
+	}
+	if err := bob.Whisper("alice", "hi"); err != nil {
+		t.Fatal(err)
+	}
+	if msg = alice.waitMessage(t, func(msg ClientMessage) bool { return msg.Private }); msg.From != "bob" || msg.Text != "hi" {
+		t.Errorf("reply = %+v", msg)
+	}
+
+	if err := bob.Join("dev"); err != nil {
+		t.Fatal(err)
+	}
+	bob.waitEvent(t, func(event ClientEvent) bool { return event.Type == ClientJoined && event.Room == "dev" })
+	if bob.Room() != "dev" {
+		t.Errorf("bob is in %q", bob.Room())
+	}
+	alice.waitEvent(t, func(event ClientEvent) bool {
+		return event.Type == ClientUserLeft && event.Username == "bob" && event.Room == DefaultRoom
+	})
+
+	if err := bob.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-bob.Done():
+	default:
+		t.Fatal("Done not closed after Close")
+	}
+	if event := bob.waitEvent(t, func(event ClientEvent) bool { return event.Type == ClientDisconnected }); event.Err != nil {
+		t.Errorf("normal close reported %v", event.Err)
+	}
+	if err := bob.Send("gone"); err == nil {
+		t.Error("Send after Close succeeded")
+	}
+}
+
+// TestParseMessage picks senders out of lines, and not out of the server's
+// own labelled replies
+func TestParseMessage(t *testing.T) {
+	for _, tc := range []struct {
+		line string
+		want ClientMessage
+	}{
+		{"alice: hi: there", ClientMessage{From: "alice", Room: "dev", Text: "hi: there"}},
+		{"Alice_B.slack: hi", ClientMessage{From: "Alice_B.slack", Room: "dev", Text: "hi"}},
+		{"[PM from bob]: psst", ClientMessage{From: "bob", Text: "psst", Private: true}},
+		{"[PM to bob] (encrypted): psst", ClientMessage{To: "bob", Text: "psst", Private: true}},
+		{"Usage: /join <room>", ClientMessage{}},
+		{"ERROR: Username already taken.", ClientMessage{}},
+		{"Connected users (2):\n1. alice\n2. bob\n", ClientMessage{}},
+		{"*** alice joined the chat ***", ClientMessage{}},
+		{"[ANNOUNCEMENT] maintenance: soon", ClientMessage{}},
+	} {
+		tc.want.Line = tc.line
+		if got := parseMessage(tc.line, "dev"); got != tc.want {
+			t.Errorf("parseMessage(%q) = %+v, want %+v", tc.line, got, tc.want)
+		}
+	}
+}
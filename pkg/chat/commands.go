@@ -0,0 +1,238 @@
+// pkg/chat/commands.go
+package chat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// CommandFunc handles a slash command added with RegisterCommand. args is
+// what followed the command's name, without the space between them, and
+// ctx is the client's, cancelled once it disconnects. Replies go to the
+// client with its Send method.
+type CommandFunc func(ctx context.Context, client *Session, args string)
+
+// builtinCommands are the server's own commands, by name
+var builtinCommands = map[string]func(c *Session, args string){
+	"/help":        (*Session).handleHelp,
+	"/users":       (*Session).handleUsers,
+	"/rooms":       func(c *Session, _ string) { c.handleRooms() },
+	"/join":        (*Session).handleJoin,
+	"/time":        (*Session).handleTime,
+	"/stats":       func(c *Session, _ string) { c.handleStats() },
+	"/whisper":     (*Session).handleWhisper,
+	"/ewhisper":    (*Session).handleEncryptedWhisper,
+	"/pubkey":      (*Session).handlePublicKey,
+	"/pm-history":  (*Session).handlePrivateHistory,
+	"/register":    (*Session).handleRegisterCommand,
+	"/login":       (*Session).handleLogin,
+	"/report":      (*Session).handleReport,
+	"/email":       (*Session).handleEmail,
+	"/push":        (*Session).handlePush,
+	"/kick":        (*Session).handleKick,
+	"/ban":         (*Session).handleBan,
+	"/unban":       (*Session).handleUnban,
+	"/bans":        func(c *Session, _ string) { c.handleBans() },
+	"/mute":        (*Session).handleMute,
+	"/unmute":      (*Session).handleUnmute,
+	"/shadowban":   (*Session).handleShadowban,
+	"/unshadowban": (*Session).handleUnshadowban,
+	"/op":          func(c *Session, args string) { c.handleOp(args, RoleModerator) },
+	"/deop":        func(c *Session, args string) { c.handleOp(args, RoleUser) },
+	"/announce":    (*Session).handleAnnounce,
+	"/slowmode":    (*Session).handleSlowMode,
+}
+
+// RegisterCommand adds a slash command, handled by handler when a client
+// sends it. name may be given with or without its slash, and may use
+// letters, digits, '-' and '_'. It is an error to register a built-in
+// command, or one already registered. Registered commands are listed at
+// the end of /help, and pass through the OnCommand hooks like the rest.
+func (s *Server) RegisterCommand(name string, handler CommandFunc) error {
+	if handler == nil {
+		return errors.New("command handler is nil")
+	}
+	name = "/" + strings.TrimPrefix(name, "/")
+	if !validCommandName(name[1:]) {
+		return fmt.Errorf("invalid command name %q", name)
+	}
+	if _, ok := builtinCommands[name]; ok {
+		return fmt.Errorf("%s is a built-in command", name)
+	}
+
+	s.commandsMu.Lock()
+	defer s.commandsMu.Unlock()
+	if _, ok := s.commands[name]; ok {
+		return fmt.Errorf("command %s is already registered", name)
+	}
+	if s.commands == nil {
+		s.commands = make(map[string]CommandFunc)
+	}
+	s.commands[name] = handler
+	return nil
+}
+
+// validCommandName reports whether name, without its slash, may be used
+// for a registered command
+func validCommandName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// registeredCommand returns the handler registered for name, if any
+func (s *Server) registeredCommand(name string) (CommandFunc, bool) {
+	s.commandsMu.RLock()
+	defer s.commandsMu.RUnlock()
+	handler, ok := s.commands[name]
+	return handler, ok
+}
+
+// registeredCommands returns the names of the registered commands, sorted
+func (s *Server) registeredCommands() []string {
+	s.commandsMu.RLock()
+	defer s.commandsMu.RUnlock()
+	names := make([]string, 0, len(s.commands))
+	for name := range s.commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// handleCommand processes client commands like /help, /users, etc.
+func (c *Session) handleCommand(cmd string) {
+	c.logger().Debug("Command", "command", redactSecrets(cmd))
+
+	name, args, _ := strings.Cut(cmd, " ")
+	if handler, ok := builtinCommands[name]; ok {
+		handler(c, args)
+	} else if handler, ok := c.Server.registeredCommand(name); ok {
+		handler(c.ctx, c, args)
+	} else {
+		c.send(fmt.Sprintf("Unknown command: %s. Type /help for available commands.", cmd))
+	}
+}
+
+// helpText lists the built-in commands for /help
+const helpText = `
+Available commands:
+/help - Show this help message
+/users - List all connected users
+/rooms - List rooms
+/join <room> - Move to another room, creating it if it doesn't exist
+/time - Show current server time
+/stats - Show server uptime, message totals, peak users and rooms
+/exit - Exit the chat
+/whisper <username> <message> - Send private message to a user
+/pubkey <username> - Get a user's key for encrypted whispers
+/pm-history <username> - Show your recent private messages with a user
+/register <password> - Claim your username so only you can use it
+/login <password> - Log in to your registered username
+/report <username> <reason> - Report a user to the moderators
+/email [<address> | verify <code> | on | off | remove] - Get mentions and whispers by email while offline
+/push [key | subscribe <json> | unsubscribe <endpoint>] - Get them as browser notifications (used by web clients)
+
+Moderators:
+/kick <username> [reason] - Disconnect a user
+/ban [-ip] <username> [duration] [reason] - Ban a user (and their IP) and disconnect them
+/unban <username or IP> - Lift a ban
+/bans - List active bans
+/mute <username> [duration] [reason] - Stop a user from posting (10m by default)
+/unmute <username> - Lift a mute
+
+Admins:
+/shadowban [username] - Show a user's messages only to themselves, or list shadowbanned users
+/unshadowban <username> - Lift a shadowban
+/op <username> - Make a registered user a moderator
+/deop <username> - Make a moderator a regular user again
+/announce <text> - Send a notice to everyone on the server
+/slowmode [interval|off] - Show or set server-wide slow mode, e.g. /slowmode 30s
+`
+
+// handleHelp lists the built-in commands, then any registered ones
+func (c *Session) handleHelp(string) {
+	help := helpText
+	if names := c.Server.registeredCommands(); len(names) > 0 {
+		help += "\nMore commands:\n" + strings.Join(names, "\n") + "\n"
+	}
+	c.send(help)
+}
+
+// handleUsers lists the connected users
+func (c *Session) handleUsers(string) {
+	users := c.Server.GetClientList()
+	usersMsg := fmt.Sprintf("Connected users (%d):\n", len(users))
+	for i, user := range users {
+		usersMsg += fmt.Sprintf("%d. %s\n", i+1, user)
+	}
+	c.send(usersMsg)
+}
+
+// handleTime sends the server's time
+func (c *Session) handleTime(string) {
+	c.send(fmt.Sprintf("Server time: %s", time.Now().Format(time.RFC1123)))
+}
+
+// handleWhisper sends a private message: "<username> <message>"
+func (c *Session) handleWhisper(args string) {
+	if !c.can(permWhisper) {
+		c.send("Guests cannot send private messages.")
+		return
+	}
+	if c.muted() {
+		return
+	}
+	parts := strings.SplitN(args, " ", 2)
+	if len(parts) != 2 {
+		c.send("Usage: /whisper <username> <message>")
+		return
+	}
+
+	targetUsername := strings.TrimSpace(parts[0])
+	message := parts[1]
+	if !c.allowLinks(message) {
+		return
+	}
+
+	targetClient := c.Server.clientByName(targetUsername)
+	if targetClient == nil {
+		if remote, ok := c.Server.remote.lookup(targetUsername); ok {
+			c.whisperRemote(remote.Username, message)
+			return
+		}
+		if c.whisperOffline(targetUsername, message) {
+			return
+		}
+		c.send(fmt.Sprintf("User '%s' not found", targetUsername))
+		return
+	}
+
+	// Confirmation to sender
+	c.send(fmt.Sprintf("[PM to %s]: %s", targetUsername, message))
+	if c.Server.Shadowbanned(c.Username) {
+		return
+	}
+	// Send to recipient
+	targetClient.send(fmt.Sprintf("[PM from %s]: %s", c.Username, message))
+	c.Server.recordPrivateMessage(c.ctx, c.Username, targetClient.Username, message)
+}
+
+// handleRegisterCommand handles /register for those allowed to register
+func (c *Session) handleRegisterCommand(password string) {
+	if !c.can(permRegister) {
+		c.send("Guests cannot register. Reconnect with your credentials instead.")
+		return
+	}
+	c.handleRegister(password)
+}
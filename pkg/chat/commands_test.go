@@ -0,0 +1,47 @@
+// pkg/chat/commands_test.go
+package chat
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+// TestRegisterCommand registers a command, checks the names that are
+// refused, and runs it and /help from a client
+func TestRegisterCommand(t *testing.T) {
+	s, url := newTestServer(t, Config{})
+	roll := func(ctx context.Context, client *Session, args string) {
+		client.Send(client.Username + " rolled " + args)
+	}
+	if err := s.RegisterCommand("roll", roll); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"/roll", "/help", "", "/two words", "/a:b"} {
+		if err := s.RegisterCommand(name, roll); err == nil {
+			t.Errorf("registered %q", name)
+		}
+	}
+	if err := s.RegisterCommand("/nil", nil); err == nil {
+		t.Error("registered a nil handler")
+	}
+
+	alice := newTestClient(t, url, "alice", ClientOptions{})
+	for _, text := range []string{"/roll 2d6", "/help", "/rolls"} {
+		if err := alice.Send(text); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reply := func(msg ClientMessage) bool {
+		return !strings.HasPrefix(msg.Line, "***") && !strings.HasPrefix(msg.Line, "Welcome")
+	}
+	if msg := alice.waitMessage(t, reply); msg.Line != "alice rolled 2d6" {
+		t.Errorf("/roll replied %q", msg.Line)
+	}
+	if msg := alice.waitMessage(t, reply); !strings.HasSuffix(msg.Line, "More commands:\n/roll\n") {
+		t.Errorf("/help doesn't list /roll: %q", msg.Line)
+	}
+	if msg := alice.waitMessage(t, reply); !strings.HasPrefix(msg.Line, "Unknown command: /rolls.") {
+		t.Errorf("/rolls replied %q", msg.Line)
+	}
+}
@@ -0,0 +1,35 @@
+// pkg/chat/compress.go
+package chat
+
+import (
+	"compress/flate"
+	"fmt"
+)
+
+// DefaultCompressionLevel is the deflate level used when none is set: the
+// fastest, which saves most of what the slower levels would on chat text
+const DefaultCompressionLevel = flate.BestSpeed
+
+// DefaultCompressionThreshold is the size in bytes below which messages are
+// sent uncompressed; deflating shorter ones costs more than it saves
+const DefaultCompressionThreshold = 256
+
+// compressionLevel returns level, or DefaultCompressionLevel if it is 0.
+// A level outside 1 (fastest) to 9 (smallest) also gives the default, along
+// with an error saying so.
+func compressionLevel(level int) (int, error) {
+	if level == 0 {
+		return DefaultCompressionLevel, nil
+	}
+	if level < flate.BestSpeed || level > flate.BestCompression {
+		return DefaultCompressionLevel, fmt.Errorf("invalid compression level %d: must be between %d and %d", level, flate.BestSpeed, flate.BestCompression)
+	}
+	return level, nil
+}
+
+// compressAbove makes conn compress its next message if it is at least
+// threshold bytes long. It has no effect unless the peer agreed to
+// compression.
+func compressAbove(conn interface{ EnableWriteCompression(bool) }, size, threshold int) {
+	conn.EnableWriteCompression(size >= threshold)
+}
@@ -0,0 +1,215 @@
+// pkg/chat/console.go
+package chat
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// consoleActor is who console actions are attributed to
+const consoleActor = "console"
+
+const consoleHelp = `Console commands:
+  list                                  List connected users
+  kick <user> [reason]                  Disconnect a user
+  ban <user|ip> [duration] [reason]     Ban a user or IP and disconnect them
+  unban <user|ip>                       Lift a ban
+  bans                                  List active bans
+  announce <text>                       Send a notice to everyone
+  slowmode [interval|off]               Show or set server-wide slow mode
+  stats                                 Show server statistics
+  shutdown                              Stop the server
+`
+
+// RunConsole reads admin commands from r, one per line, and writes their
+// output to w. It returns when r is exhausted or after the shutdown
+// command has called shutdown.
+func (s *Server) RunConsole(r io.Reader, w io.Writer, shutdown func()) {
+	fmt.Fprintln(w, "Admin console ready. Type help for commands.")
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		cmd, args, _ := strings.Cut(strings.TrimSpace(scanner.Text()), " ")
+		args = strings.TrimSpace(args)
+
+		switch cmd {
+		case "":
+		case "help":
+			fmt.Fprint(w, consoleHelp)
+		case "list", "users":
+			s.consoleList(w)
+		case "kick":
+			s.consoleKick(w, args)
+		case "ban":
+			s.consoleBan(w, args)
+		case "unban":
+			s.consoleUnban(w, args)
+		case "bans":
+			s.consoleBans(w)
+		case "announce":
+			if args == "" {
+				fmt.Fprintln(w, "Usage: announce <text>")
+				continue
+			}
+			s.Announce(args, consoleActor)
+		case "slowmode":
+			s.consoleSlowMode(w, args)
+		case "stats":
+			s.consoleStats(w)
+		case "shutdown", "quit", "exit":
+			fmt.Fprintln(w, "Shutting down...")
+			shutdown()
+			return
+		default:
+			fmt.Fprintf(w, "Unknown command: %s. Type help for commands.\n", cmd)
+		}
+	}
+}
+
+// consoleList prints the connected clients as a table
+func (s *Server) consoleList(w io.Writer) {
+	clients := s.ClientInfos()
+	if len(clients) == 0 {
+		fmt.Fprintln(w, "No users connected.")
+		return
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "USER\tROLE\tROOM\tIP\tCONNECTED\tUSER AGENT")
+	for _, c := range clients {
+		fmt.Fprintf(tw, "%s\t%s\t#%s\t%s\t%s\t%s\n", c.Username, c.Role, c.Room, c.IP,
+			time.Since(c.JoinedAt).Round(time.Second), c.UserAgent)
+	}
+	tw.Flush()
+}
+
+// consoleKick implements kick <user> [reason]
+func (s *Server) consoleKick(w io.Writer, args string) {
+	target, reason, _ := strings.Cut(args, " ")
+	if target == "" {
+		fmt.Fprintln(w, "Usage: kick <user> [reason]")
+		return
+	}
+	if !s.KickUser(target, strings.TrimSpace(reason), consoleActor) {
+		fmt.Fprintf(w, "User '%s' not found\n", target)
+		return
+	}
+	fmt.Fprintf(w, "Kicked %s.\n", target)
+}
+
+// consoleBan implements ban <user|ip> [duration] [reason]
+func (s *Server) consoleBan(w io.Writer, args string) {
+	fields := strings.Fields(args)
+	if len(fields) == 0 {
+		fmt.Fprintln(w, "Usage: ban <user|ip> [duration] [reason]")
+		return
+	}
+
+	ban := Ban{By: consoleActor}
+	if net.ParseIP(fields[0]) != nil {
+		ban.IP = fields[0]
+	} else {
+		ban.Username = fields[0]
+	}
+	fields = fields[1:]
+	if len(fields) > 0 {
+		if d, ok := parseLongDuration(fields[0]); ok {
+			ban.ExpiresAt = time.Now().Add(d)
+			fields = fields[1:]
+		}
+	}
+	ban.Reason = strings.Join(fields, " ")
+
+	if _, err := s.BanUser(ban); err != nil {
+		fmt.Fprintf(w, "Ban failed: %v\n", err)
+		return
+	}
+	if ban.Username != "" {
+		s.broadcastMessage(fmt.Sprintf("*** %s was banned by the server ***", ban.Username))
+	}
+	fmt.Fprintf(w, "Banned %s.\n", args)
+}
+
+// consoleUnban implements unban <user|ip>
+func (s *Server) consoleUnban(w io.Writer, target string) {
+	if target == "" {
+		fmt.Fprintln(w, "Usage: unban <user|ip>")
+		return
+	}
+
+	username, ip := target, ""
+	if net.ParseIP(target) != nil {
+		username, ip = "", target
+	}
+	removed, err := s.Bans.RemoveBans(username, ip)
+	if err != nil {
+		fmt.Fprintf(w, "Unban failed: %v\n", err)
+		return
+	}
+	if removed == 0 {
+		fmt.Fprintf(w, "%s is not banned.\n", target)
+		return
+	}
+	s.audit(AuditUnban, consoleActor, username, ip, fmt.Sprintf("%d bans lifted", removed))
+	fmt.Fprintf(w, "Unbanned %s.\n", target)
+}
+
+// consoleBans prints the active bans as a table
+func (s *Server) consoleBans(w io.Writer) {
+	bans, err := s.Bans.ListBans()
+	if err != nil {
+		fmt.Fprintf(w, "Could not list bans: %v\n", err)
+		return
+	}
+	if len(bans) == 0 {
+		fmt.Fprintln(w, "No active bans.")
+		return
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "USER\tIP\tBY\tEXPIRES\tREASON")
+	for _, ban := range bans {
+		expires := "never"
+		if !ban.ExpiresAt.IsZero() {
+			expires = ban.ExpiresAt.Format(time.DateTime)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", ban.Username, ban.IP, ban.By, expires, ban.Reason)
+	}
+	tw.Flush()
+}
+
+// consoleSlowMode implements slowmode [interval|off]
+func (s *Server) consoleSlowMode(w io.Writer, arg string) {
+	if arg != "" {
+		interval, ok := parseSlowMode(arg)
+		if !ok {
+			fmt.Fprintln(w, "Usage: slowmode [interval|off], e.g. slowmode 30s")
+			return
+		}
+		s.SetSlowMode(interval, consoleActor)
+	}
+	if slow := s.SlowMode(); slow > 0 {
+		fmt.Fprintf(w, "Slow mode is on: one message every %s.\n", slow)
+	} else {
+		fmt.Fprintln(w, "Slow mode is off.")
+	}
+}
+
+// consoleStats prints the server statistics
+func (s *Server) consoleStats(w io.Writer) {
+	stats, err := s.Stats()
+	if err != nil {
+		fmt.Fprintf(w, "Could not collect stats: %v\n", err)
+		return
+	}
+	fmt.Fprintf(w, "Uptime:      %s\n", time.Duration(stats.UptimeSeconds)*time.Second)
+	fmt.Fprintf(w, "Clients:     %d (%d guests), peak %d\n", stats.Clients, stats.Guests, stats.PeakClients)
+	fmt.Fprintf(w, "Rooms:       %d\n", stats.Rooms)
+	fmt.Fprintf(w, "Connections: %d since start\n", stats.Connections)
+	fmt.Fprintf(w, "Messages:    %d since start (%.2f/s)\n", stats.Messages, stats.MessagesPerSecond)
+	fmt.Fprintf(w, "Bans:        %d active\n", stats.Bans)
+}
@@ -0,0 +1,97 @@
+// pkg/chat/context_test.go
+package chat
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// contextStore is a MemoryStore that remembers the contexts appends were
+// made under
+type contextStore struct {
+	*MemoryStore
+	mu       sync.Mutex
+	contexts []context.Context
+}
+
+func (s *contextStore) AppendContext(ctx context.Context, msg Message) (Message, error) {
+	s.mu.Lock()
+	s.contexts = append(s.contexts, ctx)
+	s.mu.Unlock()
+	return s.Append(msg)
+}
+
+func (s *contextStore) last() context.Context {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.contexts) == 0 {
+		return nil
+	}
+	return s.contexts[len(s.contexts)-1]
+}
+
+// TestRunContext checks that Run works until its context is cancelled, and
+// the server is no longer ready after
+func TestRunContext(t *testing.T) {
+	s, _ := newTestServer(t, Config{RetentionMaxMessages: 10})
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		s.Run(ctx)
+		close(stopped)
+	}()
+	if !waitFor(5*time.Second, func() bool { return Healthy(s.Ready()) }) {
+		t.Fatalf("not ready while running: %v", s.Ready())
+	}
+
+	cancel()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run didn't return after its context was cancelled")
+	}
+	if Healthy(s.Ready()) {
+		t.Error("still ready after Run returned")
+	}
+}
+
+// TestSessionContext checks that a client's messages are stored under its
+// connection's context, which is cancelled when it disconnects, and that
+// PostMessage passes its context on
+func TestSessionContext(t *testing.T) {
+	store := &contextStore{MemoryStore: NewMemoryStore()}
+	s, url := newTestServer(t, Config{Store: store})
+
+	conn, err := connect(url, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if !waitFor(5*time.Second, func() bool { return store.last() != nil }) {
+		t.Fatal("message not stored")
+	}
+	ctx := store.last()
+	if ctx.Err() != nil {
+		t.Fatal("context cancelled while connected")
+	}
+	conn.Close()
+	if !waitFor(5*time.Second, func() bool { return ctx.Err() != nil }) {
+		t.Error("context not cancelled after disconnecting")
+	}
+
+	type key struct{}
+	posted := context.WithValue(context.Background(), key{}, "posted")
+	if err := s.PostMessage(posted, DefaultRoom, "bot", "hi"); err != nil {
+		t.Fatal(err)
+	}
+	if store.last().Value(key{}) != "posted" {
+		t.Error("PostMessage didn't store under its context")
+	}
+}
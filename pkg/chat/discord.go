@@ -0,0 +1,226 @@
+// pkg/chat/discord.go
+package chat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// discordQueueSize is how many messages may wait to be posted to Discord;
+// more are dropped
+const discordQueueSize = 1000
+
+// discordMaxLength is the longest message Discord takes, in characters
+const discordMaxLength = 2000
+
+// discordSuffix ends the names of Discord users in the chat, so they can't
+// pass for chat users
+const discordSuffix = ".discord"
+
+// discordEmoji matches custom emoji in message content, as in <:gopher:123>
+var discordEmoji = regexp.MustCompile(`<a?:(\w+):\d+>`)
+
+// discordMarkdown escapes what Discord's markdown gives a meaning to in
+// usernames
+var discordMarkdown = strings.NewReplacer("*", `\*`, "_", `\_`, "~", `\~`, "`", "\\`", "|", `\|`)
+
+// DiscordConfig describes the rooms mirrored with Discord channels
+type DiscordConfig struct {
+	// Token is the bot's token. The bot needs the Message Content intent,
+	// and permission to read and send messages in the channels.
+	Token string
+
+	// Channels maps rooms to the IDs of the Discord channels they mirror
+	Channels map[string]string
+}
+
+// DiscordBridge mirrors rooms with Discord channels through a bot: room
+// messages are sent to the channel by the bot, and messages in the channel
+// are posted to the room as their sender's name with discordSuffix after
+// it. Mentions become names, and attachments links. Bots' messages, the
+// bridge's own among them, are left out, and nothing is relayed back to
+// where it came from. Messages are sent in the background, in order, within
+// Discord's rate limits; failures are logged and the messages dropped.
+type DiscordBridge struct {
+	Config DiscordConfig
+
+	server  *Server
+	session *discordgo.Session
+
+	// channels and rooms map rooms to channel IDs and back
+	channels map[string]string
+	rooms    map[string]string
+
+	// send sends a message to a channel, through the session unless a
+	// test replaces it
+	send func(channelID, content string) error
+
+	outgoing chan discordPost
+	done     chan struct{}
+	dropped  atomic.Int64
+	mu       sync.Mutex
+	closed   bool
+}
+
+// discordPost is a message waiting to be sent to a channel
+type discordPost struct {
+	channel string
+	content string
+}
+
+// NewDiscordBridge checks cfg, connects the bot to Discord and starts
+// mirroring s's rooms with its channels. Close it when shutting down.
+func NewDiscordBridge(s *Server, cfg DiscordConfig) (*DiscordBridge, error) {
+	b, err := newDiscordBridge(s, cfg)
+	if err != nil {
+		return nil, err
+	}
+	b.session.Identify.Intents = discordgo.IntentsGuilds | discordgo.IntentsGuildMessages | discordgo.IntentMessageContent
+	// Handlers run one at a time, so messages are posted in order
+	b.session.SyncEvents = true
+	b.session.AddHandler(b.message)
+	if err := b.session.Open(); err != nil {
+		return nil, fmt.Errorf("connect to Discord: %w", err)
+	}
+	go b.run()
+	s.addBridge(b)
+	return b, nil
+}
+
+// newDiscordBridge returns a bridge for cfg whose session isn't connected
+func newDiscordBridge(s *Server, cfg DiscordConfig) (*DiscordBridge, error) {
+	if cfg.Token == "" {
+		return nil, errors.New("the Discord bridge needs a bot token")
+	}
+	if len(cfg.Channels) == 0 {
+		return nil, errors.New("the Discord bridge needs at least one channel")
+	}
+	session, err := discordgo.New("Bot " + cfg.Token)
+	if err != nil {
+		return nil, err
+	}
+	b := &DiscordBridge{
+		Config:   cfg,
+		server:   s,
+		session:  session,
+		channels: map[string]string{},
+		rooms:    map[string]string{},
+		outgoing: make(chan discordPost, discordQueueSize),
+		done:     make(chan struct{}),
+	}
+	for room, channel := range cfg.Channels {
+		name, ok := normalizeRoom(room)
+		if !ok {
+			return nil, fmt.Errorf("invalid room name %q", room)
+		}
+		if channel == "" {
+			return nil, fmt.Errorf("room %s needs a channel ID", name)
+		}
+		if _, ok := b.rooms[channel]; ok {
+			return nil, fmt.Errorf("channel %s is mirrored twice", channel)
+		}
+		b.channels[name] = channel
+		b.rooms[channel] = name
+	}
+	b.send = func(channelID, content string) error {
+		_, err := b.session.ChannelMessageSendComplex(channelID, &discordgo.MessageSend{
+			Content: content,
+			// Nobody is pinged from the chat, not even by @everyone
+			AllowedMentions: &discordgo.MessageAllowedMentions{},
+		})
+		return err
+	}
+	return b, nil
+}
+
+func (b *DiscordBridge) name() string { return "discord" }
+
+// relay queues a room message to be sent to the room's channel, if it has
+// one, dropping it if the queue is full
+func (b *DiscordBridge) relay(room, username, text string) {
+	channel, ok := b.channels[room]
+	if !ok {
+		return
+	}
+	content := "**" + discordMarkdown.Replace(username) + "**: " + text
+	if runes := []rune(content); len(runes) > discordMaxLength {
+		content = string(runes[:discordMaxLength-1]) + "…"
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return
+	}
+	select {
+	case b.outgoing <- discordPost{channel: channel, content: content}:
+	default:
+		b.dropped.Add(1)
+	}
+}
+
+// run sends queued messages until Close, logging how many were dropped at
+// most every few seconds. The session waits out rate limits.
+func (b *DiscordBridge) run() {
+	defer close(b.done)
+	var lastWarning time.Time
+	for post := range b.outgoing {
+		if err := b.send(post.channel, post.content); err != nil {
+			b.server.log.Warn("Error sending to Discord", "channel", post.channel, "err", err)
+		}
+		if time.Since(lastWarning) > 10*time.Second {
+			if n := b.dropped.Swap(0); n > 0 {
+				b.server.log.Warn("Dropped messages, Discord queue full", "messages", n)
+				lastWarning = time.Now()
+			}
+		}
+	}
+}
+
+// message posts a message in a mirrored channel to its room. The session
+// calls it for each message in turn.
+func (b *DiscordBridge) message(session *discordgo.Session, m *discordgo.MessageCreate) {
+	room, ok := b.rooms[m.ChannelID]
+	if !ok || m.Author == nil || m.Author.Bot || m.WebhookID != "" {
+		return
+	}
+	if m.Type != discordgo.MessageTypeDefault && m.Type != discordgo.MessageTypeReply {
+		return
+	}
+	text, _ := m.ContentWithMoreMentionsReplaced(session)
+	text = discordEmoji.ReplaceAllString(text, ":$1:")
+	for _, attachment := range m.Attachments {
+		text = strings.TrimSpace(text + " " + attachment.URL)
+	}
+	if strings.TrimSpace(text) == "" {
+		return
+	}
+	b.server.postMessage(context.Background(), room, bridgedUsername(m.Author.DisplayName(), m.Author.ID, discordSuffix), "", b.name(), text)
+}
+
+// Close sends the messages still queued, waiting up to timeout for them to
+// be sent, and disconnects the bot
+func (b *DiscordBridge) Close(timeout time.Duration) {
+	b.mu.Lock()
+	if !b.closed {
+		b.closed = true
+		close(b.outgoing)
+	}
+	b.mu.Unlock()
+
+	select {
+	case <-b.done:
+	case <-time.After(timeout):
+		b.server.log.Warn("Timed out sending the last messages to Discord")
+	}
+	if err := b.session.Close(); err != nil {
+		b.server.log.Warn("Error disconnecting from Discord", "err", err)
+	}
+}
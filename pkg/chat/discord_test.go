@@ -0,0 +1,79 @@
+// pkg/chat/discord_test.go
+package chat
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/gorilla/websocket"
+)
+
+// TestDiscordBridge relays a room message to its channel, then a message
+// from the channel to the room, with its mentions, emoji and attachments
+// made text, and checks it isn't relayed back
+func TestDiscordBridge(t *testing.T) {
+	s, url := newTestServer(t, Config{})
+	b, err := newDiscordBridge(s, DiscordConfig{Token: "token", Channels: map[string]string{"#Lobby": "42"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sent := make(chan discordPost, 10)
+	b.send = func(channel, content string) error {
+		sent <- discordPost{channel: channel, content: content}
+		return nil
+	}
+	go b.run()
+	s.addBridge(b)
+	defer b.Close(time.Second)
+
+	ws, err := connect(url, "go_fer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	expectSent := func(want string) {
+		t.Helper()
+		select {
+		case post := <-sent:
+			if post.channel != "42" || post.content != want {
+				t.Errorf("sent %q to %s, want %q", post.content, post.channel, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%q not sent", want)
+		}
+	}
+	ws.WriteMessage(websocket.TextMessage, []byte("hello *discord*"))
+	expectSent(`**go\_fer**: hello *discord*`)
+
+	b.message(b.session, &discordgo.MessageCreate{Message: &discordgo.Message{
+		ChannelID: "42",
+		Author:    &discordgo.User{ID: "1", Username: "robot", Bot: true},
+		Content:   "beep",
+	}})
+	b.message(b.session, &discordgo.MessageCreate{Message: &discordgo.Message{
+		ChannelID:   "42",
+		Author:      &discordgo.User{ID: "7", Username: "gopher", GlobalName: "Go Pher"},
+		Content:     "hi <@8> <:party:123>",
+		Mentions:    []*discordgo.User{{ID: "8", Username: "alice"}},
+		Attachments: []*discordgo.MessageAttachment{{URL: "https://cdn.discordapp.com/a.png"}},
+	}})
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		_, text, err := ws.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(string(text), "beep") {
+			t.Fatalf("bot message posted: %q", text)
+		}
+		if string(text) == "Go_Pher.discord: hi @alice :party: https://cdn.discordapp.com/a.png" {
+			break
+		}
+	}
+
+	// The channel's message isn't sent back to it
+	ws.WriteMessage(websocket.TextMessage, []byte("again"))
+	expectSent(`**go\_fer**: again`)
+}
@@ -0,0 +1,216 @@
+// pkg/chat/e2e.go
+package chat
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/nacl/box"
+)
+
+// End-to-end encrypted whispers. Clients that want them publish an X25519
+// public key in the PublicKeyHeader of the upgrade request. A sender asks
+// for the recipient's key with "/pubkey <user>" (answered with
+// "PUBKEY <user> <key>", or "-" for no key), then sends
+// "/ewhisper <user> <payload>" where payload is the base64 of a 24-byte
+// nonce followed by a NaCl box. The recipient gets
+// "EPM <sender> <sender key> <payload>". The server only ever relays
+// ciphertext, so encrypted whispers are not stored.
+
+// PublicKeyHeader carries a client's base64 X25519 public key
+const PublicKeyHeader = "X-Chat-Public-Key"
+
+// Prefixes of the server messages used by encrypted whispers
+const (
+	pubkeyPrefix = "PUBKEY "
+	epmPrefix    = "EPM "
+)
+
+// noPublicKey is sent in place of a key for users who haven't published one
+const noPublicKey = "-"
+
+// decodeKey parses a base64 X25519 key
+func decodeKey(s string) (*[32]byte, bool) {
+	raw, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || len(raw) != 32 {
+		return nil, false
+	}
+	var key [32]byte
+	copy(key[:], raw)
+	return &key, true
+}
+
+// handlePublicKey implements /pubkey <user>
+func (c *Session) handlePublicKey(args string) {
+	target := strings.TrimSpace(args)
+	if target == "" {
+		c.send("Usage: /pubkey <username>")
+		return
+	}
+
+	key := noPublicKey
+	if client := c.Server.clientByName(target); client != nil && client.PublicKey != "" {
+		key = client.PublicKey
+	}
+	c.send(pubkeyPrefix + target + " " + key)
+}
+
+// handleEncryptedWhisper implements /ewhisper <user> <payload>, relaying
+// an encrypted private message it cannot read
+func (c *Session) handleEncryptedWhisper(args string) {
+	if !c.can(permWhisper) {
+		c.send("Guests cannot send private messages.")
+		return
+	}
+	if c.muted() {
+		return
+	}
+
+	target, payload, ok := strings.Cut(strings.TrimSpace(args), " ")
+	if !ok || payload == "" {
+		c.send("Usage: /ewhisper <username> <payload>")
+		return
+	}
+	if c.PublicKey == "" {
+		c.send("Publish a public key before sending encrypted messages.")
+		return
+	}
+
+	targetClient := c.Server.clientByName(target)
+	if targetClient == nil {
+		c.send(fmt.Sprintf("User '%s' not found", target))
+		return
+	}
+	if targetClient.PublicKey == "" {
+		c.send(fmt.Sprintf("%s cannot receive encrypted messages", targetClient.Username))
+		return
+	}
+
+	if c.Server.Shadowbanned(c.Username) {
+		return
+	}
+	targetClient.send(epmPrefix + c.Username + " " + c.PublicKey + " " + payload)
+}
+
+// e2eSession is a client's side of encrypted whispers: its key pair, the
+// keys it has learned, and whispers waiting for a recipient's key
+type e2eSession struct {
+	publicKey  *[32]byte
+	privateKey *[32]byte
+
+	mu      sync.Mutex
+	keys    map[string]*[32]byte
+	pending map[string][]string
+}
+
+// newE2ESession generates a fresh key pair for one connection
+func newE2ESession() (*e2eSession, error) {
+	pub, priv, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("generate encryption key: %w", err)
+	}
+	return &e2eSession{
+		publicKey:  pub,
+		privateKey: priv,
+		keys:       make(map[string]*[32]byte),
+		pending:    make(map[string][]string),
+	}, nil
+}
+
+// encodedPublicKey returns the key to send in PublicKeyHeader
+func (e *e2eSession) encodedPublicKey() string {
+	return base64.StdEncoding.EncodeToString(e.publicKey[:])
+}
+
+// seal encrypts text for the holder of peer's private key
+func (e *e2eSession) seal(text string, peer *[32]byte) (string, error) {
+	var nonce [24]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return "", err
+	}
+	sealed := box.Seal(nonce[:], []byte(text), &nonce, peer, e.privateKey)
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// whisper turns an outgoing whisper into the command to send: the
+// encrypted message if the recipient's key is known, otherwise a key
+// request (the whisper is sent once the key arrives)
+func (e *e2eSession) whisper(target, text string) (string, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	key := userKey(target)
+	if peer, ok := e.keys[key]; ok {
+		payload, err := e.seal(text, peer)
+		if err != nil {
+			return "", err
+		}
+		return "/ewhisper " + target + " " + payload, nil
+	}
+
+	e.pending[key] = append(e.pending[key], text)
+	return "/pubkey " + target, nil
+}
+
+// handleKey processes a PUBKEY reply, returning the commands for any
+// whispers that were waiting for it and a notice for the user
+func (e *e2eSession) handleKey(msg string) (sends []string, notice string) {
+	target, encoded, _ := strings.Cut(strings.TrimPrefix(msg, pubkeyPrefix), " ")
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	key := userKey(target)
+	waiting := e.pending[key]
+	delete(e.pending, key)
+
+	peer, ok := decodeKey(encoded)
+	if !ok {
+		if len(waiting) > 0 {
+			notice = fmt.Sprintf("%s cannot receive encrypted messages; %d message(s) not sent", target, len(waiting))
+		}
+		return nil, notice
+	}
+	e.keys[key] = peer
+
+	for _, text := range waiting {
+		payload, err := e.seal(text, peer)
+		if err != nil {
+			return sends, fmt.Sprintf("Could not encrypt message to %s: %v", target, err)
+		}
+		sends = append(sends, "/ewhisper "+target+" "+payload)
+	}
+	return sends, ""
+}
+
+// open decrypts an EPM message for display
+func (e *e2eSession) open(msg string) string {
+	parts := strings.SplitN(strings.TrimPrefix(msg, epmPrefix), " ", 3)
+	if len(parts) != 3 {
+		return "[Malformed encrypted message]"
+	}
+	from := parts[0]
+
+	peer, ok := decodeKey(parts[1])
+	sealed, err := base64.StdEncoding.DecodeString(parts[2])
+	if !ok || err != nil || len(sealed) < 24 {
+		return fmt.Sprintf("[Unreadable encrypted message from %s]", from)
+	}
+
+	var nonce [24]byte
+	copy(nonce[:], sealed[:24])
+	text, ok := box.Open(nil, sealed[24:], &nonce, peer, e.privateKey)
+	if !ok {
+		return fmt.Sprintf("[Unreadable encrypted message from %s]", from)
+	}
+
+	// Remember the sender's key so replies don't need a lookup
+	e.mu.Lock()
+	e.keys[userKey(from)] = peer
+	e.mu.Unlock()
+
+	return fmt.Sprintf("[PM from %s] (encrypted): %s", from, text)
+}
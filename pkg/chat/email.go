@@ -0,0 +1,373 @@
+// pkg/chat/email.go
+package chat
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Email notification settings
+const (
+	// settingEmailNotifications is the account setting that turns email
+	// notifications off; they are on for verified addresses by default
+	settingEmailNotifications = "email_notifications"
+
+	defaultDigestDelay   = 10 * time.Minute
+	maxDigestItems       = 50
+	verificationTTL      = time.Hour
+	verificationInterval = time.Minute
+	maxVerifyAttempts    = 5
+)
+
+// EmailConfig is how the server sends email: verification codes for
+// addresses users add with /email, and digests of the mentions and
+// whispers they get while offline
+type EmailConfig struct {
+	// SMTPAddr is the mail server as host:port; STARTTLS is used if it
+	// offers it
+	SMTPAddr string
+	// Username and Password, if set, authenticate with PLAIN, which
+	// needs TLS unless the server is on localhost
+	Username string
+	Password string
+	// From is the sender address, e.g. "Chat <chat@example.com>"
+	From string
+	// DigestDelay is how long notifications are collected after the
+	// first before they are mailed together, 10 minutes by default
+	DigestDelay time.Duration
+}
+
+// emailNotifier collects notifications for offline users into digests
+// and mails them, and the codes that verify their addresses
+type emailNotifier struct {
+	s   *Server
+	cfg EmailConfig
+	// send delivers a message to one address; tests replace it
+	send func(to string, msg []byte) error
+
+	mu            sync.Mutex
+	digests       map[string]*emailDigest
+	verifications map[string]*emailVerification
+}
+
+// emailDigest is the notifications waiting to be mailed to one user
+type emailDigest struct {
+	username string
+	items    []string
+	dropped  int
+	timer    *time.Timer
+}
+
+// emailVerification is a code mailed to an address a user wants to add
+type emailVerification struct {
+	address  string
+	code     string
+	sent     time.Time
+	attempts int
+}
+
+func newEmailNotifier(s *Server, cfg EmailConfig) *emailNotifier {
+	if cfg.DigestDelay <= 0 {
+		cfg.DigestDelay = defaultDigestDelay
+	}
+	n := &emailNotifier{
+		s:             s,
+		cfg:           cfg,
+		digests:       make(map[string]*emailDigest),
+		verifications: make(map[string]*emailVerification),
+	}
+	n.send = n.sendSMTP
+	return n
+}
+
+// sendSMTP delivers msg to one address through the configured server
+func (n *emailNotifier) sendSMTP(to string, msg []byte) error {
+	from, err := mail.ParseAddress(n.cfg.From)
+	if err != nil {
+		return fmt.Errorf("email from address: %w", err)
+	}
+	var auth smtp.Auth
+	if n.cfg.Username != "" {
+		host, _, _ := net.SplitHostPort(n.cfg.SMTPAddr)
+		auth = smtp.PlainAuth("", n.cfg.Username, n.cfg.Password, host)
+	}
+	return smtp.SendMail(n.cfg.SMTPAddr, auth, from.Address, []string{to}, msg)
+}
+
+// message builds an email to address
+func (n *emailNotifier) message(address, subject, body string) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", n.cfg.From)
+	fmt.Fprintf(&b, "To: %s\r\n", address)
+	fmt.Fprintf(&b, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("Content-Transfer-Encoding: 8bit\r\n\r\n")
+	b.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+	return []byte(b.String())
+}
+
+// notifiable returns the address to notify account at, if it has a
+// verified one and hasn't turned notifications off
+func notifiable(account User) (string, bool) {
+	if account.Email == "" || !account.EmailVerified || account.Settings[settingEmailNotifications] == "off" {
+		return "", false
+	}
+	return account.Email, true
+}
+
+// notifyOffline adds item to the digest for username if they are offline
+// and want email, reporting whether it will be mailed
+func (s *Server) notifyOffline(username, item string) bool {
+	n := s.email
+	if n == nil || s.online(username) {
+		return false
+	}
+	account, err := s.Users.GetUser(username)
+	if err != nil {
+		return false
+	}
+	if _, ok := notifiable(account); !ok {
+		return false
+	}
+
+	line := fmt.Sprintf("[%s] %s", time.Now().UTC().Format("2006-01-02 15:04 MST"), item)
+	key := userKey(account.Username)
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	digest := n.digests[key]
+	if digest == nil {
+		digest = &emailDigest{username: account.Username}
+		digest.timer = time.AfterFunc(n.cfg.DigestDelay, func() { n.flush(key) })
+		n.digests[key] = digest
+	}
+	if len(digest.items) < maxDigestItems {
+		digest.items = append(digest.items, line)
+	} else {
+		digest.dropped++
+	}
+	return true
+}
+
+// flush mails the digest for key, unless its user has come back online
+// or no longer wants it
+func (n *emailNotifier) flush(key string) {
+	n.mu.Lock()
+	digest := n.digests[key]
+	delete(n.digests, key)
+	n.mu.Unlock()
+	if digest == nil || n.s.online(digest.username) {
+		return
+	}
+	// Read the account again in case the address or setting changed
+	account, err := n.s.Users.GetUser(digest.username)
+	if err != nil {
+		return
+	}
+	address, ok := notifiable(account)
+	if !ok {
+		return
+	}
+
+	subject := "New notification from the chat"
+	if len(digest.items) > 1 {
+		subject = fmt.Sprintf("%d new notifications from the chat", len(digest.items)+digest.dropped)
+	}
+	var body strings.Builder
+	fmt.Fprintf(&body, "Hi %s,\n\nWhile you were away:\n\n", account.Username)
+	for _, item := range digest.items {
+		body.WriteString(item + "\n")
+	}
+	if digest.dropped > 0 {
+		fmt.Fprintf(&body, "...and %d more.\n", digest.dropped)
+	}
+	body.WriteString("\nTo stop these emails, send /email off in the chat.\n")
+	if err := n.send(address, n.message(address, subject, body.String())); err != nil {
+		n.s.log.Warn("Could not send notification email", "username", account.Username, "err", err)
+		return
+	}
+	n.s.log.Info("Sent notification email", "username", account.Username, "notifications", len(digest.items)+digest.dropped)
+}
+
+// flushAll mails every waiting digest now, as the server shuts down
+func (n *emailNotifier) flushAll() {
+	if n == nil {
+		return
+	}
+	n.mu.Lock()
+	keys := make([]string, 0, len(n.digests))
+	for key, digest := range n.digests {
+		digest.timer.Stop()
+		keys = append(keys, key)
+	}
+	n.mu.Unlock()
+	for _, key := range keys {
+		n.flush(key)
+	}
+}
+
+// verificationCode returns a random six-digit code
+func verificationCode() string {
+	n, err := rand.Int(rand.Reader, big.NewInt(1_000_000))
+	if err != nil {
+		panic("crypto/rand failed: " + err.Error())
+	}
+	return fmt.Sprintf("%06d", n)
+}
+
+// errVerificationPending is returned when a code was sent too recently
+var errVerificationPending = errors.New("a code was sent less than a minute ago")
+
+// startVerification mails a code to address for username to confirm with
+// /email verify
+func (n *emailNotifier) startVerification(username, address string) error {
+	key := userKey(username)
+	n.mu.Lock()
+	if v := n.verifications[key]; v != nil && time.Since(v.sent) < verificationInterval {
+		n.mu.Unlock()
+		return errVerificationPending
+	}
+	v := &emailVerification{address: address, code: verificationCode(), sent: time.Now()}
+	n.verifications[key] = v
+	n.mu.Unlock()
+
+	body := fmt.Sprintf("Hi %s,\n\nTo get chat notifications at this address, send this in the chat:\n\n/email verify %s\n\nThe code expires in an hour. If you didn't ask for it, ignore this email.\n", username, v.code)
+	return n.send(address, n.message(address, "Confirm your email address", body))
+}
+
+// verify checks a code sent to username, returning the address it
+// confirms
+func (n *emailNotifier) verify(username, code string) (string, bool) {
+	key := userKey(username)
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	v := n.verifications[key]
+	if v == nil || time.Since(v.sent) > verificationTTL {
+		delete(n.verifications, key)
+		return "", false
+	}
+	if subtle.ConstantTimeCompare([]byte(code), []byte(v.code)) != 1 {
+		// Don't let codes be guessed
+		if v.attempts++; v.attempts >= maxVerifyAttempts {
+			delete(n.verifications, key)
+		}
+		return "", false
+	}
+	delete(n.verifications, key)
+	return v.address, true
+}
+
+// handleEmail implements /email: adding and verifying an address for
+// notifications of mentions and whispers while offline, and turning them
+// on and off
+func (c *Session) handleEmail(args string) {
+	n := c.Server.email
+	if n == nil {
+		c.send("Email notifications are not enabled on this server.")
+		return
+	}
+	if !c.LoggedIn {
+		c.send("Only registered users can get email notifications. Use /register <password> first.")
+		return
+	}
+	account, err := c.Server.Users.GetUser(c.Username)
+	if err != nil {
+		c.logger().Error("Error loading account", "err", err)
+		c.send("Could not load your account, please try again.")
+		return
+	}
+
+	command, arg, _ := strings.Cut(strings.TrimSpace(args), " ")
+	arg = strings.TrimSpace(arg)
+	switch command {
+	case "":
+		if account.Email == "" {
+			c.send("You have no email address. Use /email <address> to add one.")
+			return
+		}
+		state := "on"
+		if account.Settings[settingEmailNotifications] == "off" {
+			state = "off"
+		}
+		verified := "verified"
+		if !account.EmailVerified {
+			verified = "not verified"
+		}
+		c.send(fmt.Sprintf("Your email address is %s (%s). Notifications are %s.", account.Email, verified, state))
+		return
+
+	case "verify":
+		address, ok := n.verify(c.Username, arg)
+		if !ok {
+			c.send("That code is wrong or has expired. Use /email <address> to get a new one.")
+			return
+		}
+		account.Email, account.EmailVerified = address, true
+		if c.saveAccount(account) {
+			c.send(fmt.Sprintf("Verified %s. You'll get an email when you're mentioned or whispered while offline.", address))
+		}
+		return
+
+	case "on", "off":
+		if account.Settings == nil {
+			account.Settings = map[string]string{}
+		}
+		if command == "on" {
+			delete(account.Settings, settingEmailNotifications)
+		} else {
+			account.Settings[settingEmailNotifications] = "off"
+		}
+		if c.saveAccount(account) {
+			c.send(fmt.Sprintf("Email notifications are %s.", command))
+		}
+		return
+
+	case "remove":
+		account.Email, account.EmailVerified = "", false
+		if c.saveAccount(account) {
+			c.send("Removed your email address.")
+		}
+		return
+	}
+
+	address, err := mail.ParseAddress(command)
+	if err != nil || address.Address != command || arg != "" {
+		c.send("Usage: /email [<address> | verify <code> | on | off | remove]")
+		return
+	}
+	// Send from another goroutine so a slow mail server doesn't hold up
+	// the client's messages
+	go func() {
+		err := n.startVerification(c.Username, address.Address)
+		switch {
+		case errors.Is(err, errVerificationPending):
+			c.send("A code was sent less than a minute ago. Please wait before asking for another.")
+		case err != nil:
+			c.logger().Warn("Could not send verification email", "err", err)
+			c.send("Could not send the verification email, please try again later.")
+		default:
+			c.send(fmt.Sprintf("Sent a code to %s. Confirm it with /email verify <code>.", address.Address))
+		}
+	}()
+}
+
+// saveAccount stores changes to the client's account, telling them if it
+// failed
+func (c *Session) saveAccount(account User) bool {
+	if err := c.Server.Users.UpdateUser(account); err != nil {
+		c.logger().Error("Error updating account", "err", err)
+		c.send("Could not update your account, please try again.")
+		return false
+	}
+	return true
+}
@@ -0,0 +1,101 @@
+// pkg/chat/email_test.go
+package chat
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// TestEmailNotifications verifies an address with the mailed code, then
+// checks a mention and a whisper while offline arrive in one digest, and
+// nothing is sent once notifications are turned off
+func TestEmailNotifications(t *testing.T) {
+	s, url := newTestServer(t, Config{Email: &EmailConfig{From: "chat@example.com", DigestDelay: 100 * time.Millisecond}})
+	type email struct{ to, body string }
+	sent := make(chan email, 10)
+	s.email.send = func(to string, msg []byte) error {
+		sent <- email{to, string(msg)}
+		return nil
+	}
+	receive := func() email {
+		t.Helper()
+		select {
+		case e := <-sent:
+			return e
+		case <-time.After(5 * time.Second):
+			t.Fatal("no email sent")
+			return email{}
+		}
+	}
+
+	alice, err := connect(url, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	readUntil := func(conn *websocket.Conn, prefix string) {
+		t.Helper()
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		for {
+			_, text, err := conn.ReadMessage()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.HasPrefix(string(text), prefix) {
+				return
+			}
+		}
+	}
+	alice.WriteMessage(websocket.TextMessage, []byte("/register correct-horse"))
+	readUntil(alice, "Registered alice")
+	alice.WriteMessage(websocket.TextMessage, []byte("/email alice@example.com"))
+	verification := receive()
+	code := regexp.MustCompile(`/email verify (\d{6})`).FindStringSubmatch(verification.body)
+	if verification.to != "alice@example.com" || code == nil {
+		t.Fatalf("verification email to %s: %q", verification.to, verification.body)
+	}
+	alice.WriteMessage(websocket.TextMessage, []byte("/email verify 000000x"))
+	readUntil(alice, "That code is wrong")
+	alice.WriteMessage(websocket.TextMessage, []byte("/email verify "+code[1]))
+	readUntil(alice, "Verified alice@example.com")
+	alice.Close()
+	for deadline := time.Now().Add(5 * time.Second); s.online("alice"); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("alice still online")
+		}
+	}
+
+	bob, err := connect(url, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bob.Close()
+	bob.WriteMessage(websocket.TextMessage, []byte("ping @alice"))
+	bob.WriteMessage(websocket.TextMessage, []byte("/whisper alice are you there?"))
+	readUntil(bob, "alice is offline and will be notified of your message.")
+	digest := receive()
+	if digest.to != "alice@example.com" ||
+		!strings.Contains(digest.body, "Subject: 2 new notifications") ||
+		!strings.Contains(digest.body, "bob mentioned you in #lobby: ping @alice") ||
+		!strings.Contains(digest.body, "bob whispered: are you there?") {
+		t.Errorf("digest to %s: %q", digest.to, digest.body)
+	}
+	if history, _ := s.PrivateHistory("alice", "bob", 10); len(history) != 1 {
+		t.Errorf("offline whisper not recorded: %+v", history)
+	}
+
+	account, _ := s.Users.GetUser("alice")
+	account.Settings = map[string]string{settingEmailNotifications: "off"}
+	s.Users.UpdateUser(account)
+	bob.WriteMessage(websocket.TextMessage, []byte("/whisper alice hello?"))
+	readUntil(bob, "User 'alice' not found")
+	bob.WriteMessage(websocket.TextMessage, []byte("@alice hello?"))
+	select {
+	case e := <-sent:
+		t.Errorf("emailed after opting out: %q", e.body)
+	case <-time.After(300 * time.Millisecond):
+	}
+}
@@ -0,0 +1,496 @@
+// pkg/chat/epoll.go
+package chat
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+	"github.com/gorilla/websocket"
+)
+
+// frameTimeout is how long a polled client has to finish sending a message
+// once it has started
+const frameTimeout = 10 * time.Second
+
+// sweepInterval is how often the poller looks for clients that have timed
+// out or are due a ping
+const sweepInterval = time.Second
+
+// netpoll serves the clients of a server using TransportEpoll. An idle
+// client has no goroutine: the poller reports when there is something to
+// read, and a goroutine reads it and goes away. Their write pumps likewise
+// run only while there is something to write (see flush).
+type netpoll struct {
+	s      *Server
+	poller *poller
+
+	mu     sync.Mutex
+	conns  map[int32]*epollConn
+	nextID int32
+}
+
+// newNetpoll starts polling for s, or returns an error if the platform
+// can't
+func newNetpoll(s *Server) (*netpoll, error) {
+	p, err := newPoller()
+	if err != nil {
+		return nil, err
+	}
+	np := &netpoll{s: s, poller: p, conns: make(map[int32]*epollConn)}
+	go np.poll()
+	go np.sweep()
+	return np, nil
+}
+
+// poll hands each connection the poller finds ready to a goroutine to read.
+// The poller is never closed, so it runs for the life of the process.
+func (np *netpoll) poll() {
+	err := np.poller.wait(np.ready)
+	np.s.log.Error("Polling connections failed", "err", err)
+}
+
+// upgrade upgrades r to a WebSocket connection with gobwas/ws. Its client
+// is polled once registered, if its socket can be.
+func (np *netpoll) upgrade(w http.ResponseWriter, r *http.Request) (wsConn, error) {
+	if !np.s.checkOrigin(r) {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return nil, errors.New("request origin not allowed")
+	}
+	upgrader := ws.HTTPUpgrader{}
+	if np.s.Config.BatchSize > 1 {
+		upgrader.Protocol = func(protocol string) bool { return protocol == BatchProtocol }
+	}
+	netConn, rw, handshake, err := upgrader.Upgrade(r, w)
+	if err != nil {
+		if netConn != nil {
+			netConn.Close()
+		}
+		return nil, err
+	}
+	conn := &epollConn{conn: netConn, fd: fileDescriptor(netConn), protocol: handshake.Protocol, np: np}
+	if n := rw.Reader.Buffered(); n > 0 {
+		// The client didn't wait for the handshake to finish
+		pending, _ := rw.Reader.Peek(n)
+		conn.pending = bytes.Clone(pending)
+	}
+	return conn, nil
+}
+
+// fileDescriptor returns conn's socket, or -1 if it has none to poll
+func fileDescriptor(conn net.Conn) int {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return -1
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return -1
+	}
+	fd := -1
+	raw.Control(func(s uintptr) { fd = int(s) })
+	return fd
+}
+
+// polledConn returns conn if it is to be polled, or nil
+func polledConn(conn wsConn) *epollConn {
+	if conn, ok := conn.(*epollConn); ok && conn.fd >= 0 {
+		return conn
+	}
+	return nil
+}
+
+// add starts polling a newly registered client
+func (np *netpoll) add(c *Session) {
+	conn := c.polled
+	c.keepAlive()
+	conn.polling = true
+
+	np.mu.Lock()
+	closed := conn.closed
+	serveNow := false
+	var err error
+	if !closed {
+		for np.nextID++; np.nextID == 0 || np.conns[np.nextID] != nil; np.nextID++ {
+		}
+		conn.client, conn.id = c, np.nextID
+		conn.nextPing = time.Now().Add(np.s.Config.PingInterval)
+		np.conns[conn.id] = conn
+		if err = np.poller.watch(conn.fd, conn.id); err != nil {
+			delete(np.conns, conn.id)
+		} else if conn.buffered() {
+			// Already read from the socket, so the poller won't report it
+			conn.busy, serveNow = true, true
+		}
+	}
+	np.mu.Unlock()
+
+	if closed || err != nil {
+		if err != nil {
+			c.logger().Warn("Error polling connection", "err", err)
+		}
+		conn.Close()
+		c.disconnect()
+		return
+	}
+	if serveNow {
+		go np.serve(conn)
+	}
+}
+
+// ready has a goroutine read the connection with id, which the poller
+// found ready
+func (np *netpoll) ready(id int32) {
+	np.mu.Lock()
+	conn := np.conns[id]
+	if conn == nil || conn.busy {
+		np.mu.Unlock()
+		return
+	}
+	conn.busy = true
+	np.mu.Unlock()
+	go np.serve(conn)
+}
+
+// serve reads what the client sent and hands the connection back to the
+// poller, or disconnects the client if it failed or was closed meanwhile
+func (np *netpoll) serve(conn *epollConn) {
+	if np.read(conn) && np.rewatch(conn) {
+		return
+	}
+	conn.Close()
+	conn.client.disconnect()
+}
+
+// read handles the next frame from the client, and any more it sent with
+// its handshake, as ReadPump would. It reports false if reading failed.
+func (np *netpoll) read(conn *epollConn) (ok bool) {
+	c := conn.client
+	defer c.recoverPanic("read_pump")
+	buf := getBuffer()
+	defer putBuffer(buf)
+
+	conn.conn.SetReadDeadline(time.Now().Add(frameTimeout))
+	for {
+		buf.Reset()
+		op, err := conn.nextFrame(buf)
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+				c.logger().Warn("Unexpected close", "err", err)
+			}
+			return false
+		}
+		if op.IsData() {
+			c.handleMessage(buf.String())
+		}
+		if !conn.buffered() {
+			return true
+		}
+	}
+}
+
+// rewatch hands the connection back to the poller after serve, reporting
+// false if it was closed meanwhile
+func (np *netpoll) rewatch(conn *epollConn) bool {
+	np.mu.Lock()
+	defer np.mu.Unlock()
+	if conn.closed || np.poller.rewatch(conn.fd, conn.id) != nil {
+		return false
+	}
+	conn.busy = false
+	return true
+}
+
+// closing stops polling a connection that is being closed, and
+// disconnects its client unless serve is about to
+func (np *netpoll) closing(conn *epollConn) {
+	np.mu.Lock()
+	defer np.mu.Unlock()
+	conn.closed = true
+	if np.conns[conn.id] != conn {
+		return
+	}
+	delete(np.conns, conn.id)
+	np.poller.unwatch(conn.fd)
+	if !conn.busy {
+		conn.busy = true
+		go conn.client.disconnect()
+	}
+}
+
+// sweep closes the connections of polled clients that have timed out,
+// which ReadPump's read deadline would do, and has the rest pinged every
+// Config.PingInterval. It runs for the life of the process.
+func (np *netpoll) sweep() {
+	interval := np.s.Config.PingInterval
+	ticker := time.NewTicker(sweepInterval)
+	var expired []*epollConn
+	for now := range ticker.C {
+		expired = expired[:0]
+		np.mu.Lock()
+		for _, conn := range np.conns {
+			deadline := conn.deadline.Load()
+			switch {
+			case conn.busy:
+			case deadline != 0 && now.UnixNano() > deadline:
+				expired = append(expired, conn)
+			case now.After(conn.nextPing):
+				conn.nextPing = now.Add(interval)
+				conn.client.pingDue.Store(true)
+				conn.client.wake()
+			}
+		}
+		np.mu.Unlock()
+		for _, conn := range expired {
+			conn.Close()
+		}
+	}
+}
+
+// wake starts the write pump of a polled client if it isn't running
+func (c *Session) wake() {
+	if c.polled != nil && c.flushing.CompareAndSwap(false, true) {
+		go c.flush()
+	}
+}
+
+// flush is the write pump of a polled client. It writes what is queued,
+// and a ping if one is due, then exits until wake starts it again. Once
+// it stops for good, after a stop or a failed write, flushing stays set.
+func (c *Session) flush() {
+	stopped := true
+	defer func() {
+		if stopped {
+			close(c.written)
+		}
+	}()
+	defer c.recoverPanic("write_pump")
+	batch := make([]outbound, 0, max(c.Server.Config.BatchSize, 1))
+
+	for {
+		select {
+		case msg := <-c.outbox:
+			if !c.writeNext(batch, msg) {
+				return
+			}
+			continue
+		default:
+		}
+		if c.pingDue.Swap(false) && !c.ping() {
+			return
+		}
+		// Anything queued before flushing is cleared would find it still
+		// set, so check again before leaving
+		c.flushing.Store(false)
+		if len(c.outbox) == 0 && !c.pingDue.Load() || !c.flushing.CompareAndSwap(false, true) {
+			stopped = false
+			return
+		}
+	}
+}
+
+// epollConn is a WebSocket connection served with gobwas/ws. It has no
+// buffers of its own; frames are read straight from the socket, so that
+// when the poller finds nothing to read there is nothing left unread.
+type epollConn struct {
+	conn     net.Conn
+	fd       int
+	protocol string
+	np       *netpoll
+
+	// pending is what the client sent along with its handshake, read
+	// before the socket
+	pending []byte
+
+	// onPong is called for each pong (see SetPongHandler)
+	onPong func(string) error
+
+	// deadline is the read deadline in Unix nanoseconds, or 0 for none.
+	// Once polling is set the poller enforces it, rather than the socket,
+	// which only has frameTimeout to finish each message.
+	deadline atomic.Int64
+	polling  bool
+
+	// writing serializes writes: the write pump's, and control frames from
+	// other goroutines
+	writing sync.Mutex
+
+	closeOnce sync.Once
+	closeErr  error
+
+	// Polling state, guarded by np.mu. busy is set while a goroutine is
+	// reading the connection or disconnecting its client, and closed once
+	// Close is called.
+	client   *Session
+	id       int32
+	busy     bool
+	closed   bool
+	nextPing time.Time
+}
+
+// Read reads the pending data, then the socket
+func (c *epollConn) Read(p []byte) (int, error) {
+	if len(c.pending) > 0 {
+		n := copy(p, c.pending)
+		c.pending = c.pending[n:]
+		return n, nil
+	}
+	return c.conn.Read(p)
+}
+
+// buffered reports whether some of what the client sent is pending
+func (c *epollConn) buffered() bool {
+	return len(c.pending) > 0
+}
+
+// nextFrame reads the next frame, adding the message to buf if it starts
+// one, all its fragments. Control frames are answered, and a close frame
+// ends in a *websocket.CloseError.
+func (c *epollConn) nextFrame(buf *bytes.Buffer) (ws.OpCode, error) {
+	reader := wsutil.Reader{Source: c, State: ws.StateServerSide, CheckUTF8: true, OnIntermediate: c.control}
+	header, err := reader.NextFrame()
+	if err == nil {
+		if header.OpCode.IsControl() {
+			err = c.control(header, &reader)
+		} else {
+			_, err = buf.ReadFrom(&reader)
+		}
+	}
+	var closed wsutil.ClosedError
+	if errors.As(err, &closed) {
+		err = &websocket.CloseError{Code: int(closed.Code), Text: closed.Reason}
+	}
+	return header.OpCode, err
+}
+
+// control answers a control frame, and passes pongs to onPong
+func (c *epollConn) control(header ws.Header, r io.Reader) error {
+	if header.OpCode == ws.OpPong && c.onPong != nil {
+		c.onPong("")
+	}
+	handler := wsutil.ControlHandler{Src: r, Dst: controlWriter{c}, State: ws.StateServerSide, DisableSrcCiphering: true}
+	return handler.Handle(header)
+}
+
+// controlWriter writes the replies to control frames, each in one write,
+// holding the write lock
+type controlWriter struct {
+	c *epollConn
+}
+
+func (w controlWriter) Write(p []byte) (int, error) {
+	w.c.writing.Lock()
+	defer w.c.writing.Unlock()
+	return w.c.conn.Write(p)
+}
+
+// writeFrame writes a frame in one go, by deadline if that is set
+func (c *epollConn) writeFrame(op ws.OpCode, payload []byte, deadline time.Time) error {
+	var header bytes.Buffer
+	if err := ws.WriteHeader(&header, ws.Header{Fin: true, OpCode: op, Length: int64(len(payload))}); err != nil {
+		return err
+	}
+	c.writing.Lock()
+	defer c.writing.Unlock()
+	if !deadline.IsZero() {
+		c.conn.SetWriteDeadline(deadline)
+	}
+	frame := net.Buffers{header.Bytes(), payload}
+	_, err := frame.WriteTo(c.conn)
+	return err
+}
+
+// ReadMessage waits for the next message, as websocket.Conn.ReadMessage
+// does. Polled connections are read with nextFrame instead.
+func (c *epollConn) ReadMessage() (int, []byte, error) {
+	var buf bytes.Buffer
+	for {
+		op, err := c.nextFrame(&buf)
+		if err != nil {
+			return 0, nil, err
+		}
+		if op.IsData() {
+			// gorilla/websocket's message types are the opcodes
+			return int(op), buf.Bytes(), nil
+		}
+	}
+}
+
+// NextReader waits for the next message and returns a reader for it
+func (c *epollConn) NextReader() (int, io.Reader, error) {
+	messageType, p, err := c.ReadMessage()
+	if err != nil {
+		return 0, nil, err
+	}
+	return messageType, bytes.NewReader(p), nil
+}
+
+// WriteMessage writes a message of messageType
+func (c *epollConn) WriteMessage(messageType int, data []byte) error {
+	return c.writeFrame(ws.OpCode(messageType), data, time.Time{})
+}
+
+// WritePreparedMessage isn't supported
+func (c *epollConn) WritePreparedMessage(pm *websocket.PreparedMessage) error {
+	return errPreparedMessage
+}
+
+// WriteControl writes a control frame by deadline. It may be called
+// alongside the write pump.
+func (c *epollConn) WriteControl(messageType int, data []byte, deadline time.Time) error {
+	return c.writeFrame(ws.OpCode(messageType), data, deadline)
+}
+
+// SetReadDeadline sets the read deadline
+func (c *epollConn) SetReadDeadline(t time.Time) error {
+	var deadline int64
+	if !t.IsZero() {
+		deadline = t.UnixNano()
+	}
+	c.deadline.Store(deadline)
+	if c.polling {
+		return nil
+	}
+	return c.conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the write deadline
+func (c *epollConn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
+
+// SetPongHandler sets the function called for each pong
+func (c *epollConn) SetPongHandler(h func(appData string) error) {
+	c.onPong = h
+}
+
+// EnableWriteCompression does nothing; messages aren't compressed
+func (c *epollConn) EnableWriteCompression(enable bool) {}
+
+// SetCompressionLevel does nothing; messages aren't compressed
+func (c *epollConn) SetCompressionLevel(level int) error {
+	return nil
+}
+
+// Subprotocol returns the subprotocol agreed in the handshake
+func (c *epollConn) Subprotocol() string {
+	return c.protocol
+}
+
+// Close closes the connection. A polled client is disconnected once
+// nothing is reading its connection.
+func (c *epollConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.np.closing(c)
+		c.closeErr = c.conn.Close()
+	})
+	return c.closeErr
+}
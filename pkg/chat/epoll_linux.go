@@ -0,0 +1,60 @@
+// pkg/chat/epoll_linux.go
+
+//go:build linux
+
+package chat
+
+import "golang.org/x/sys/unix"
+
+// pollEvents is what a connection is watched for: something to read, or
+// the client hanging up. Each notification disarms the connection until it
+// is watched again, so only one goroutine reads it at a time.
+const pollEvents = unix.EPOLLIN | unix.EPOLLRDHUP | unix.EPOLLONESHOT
+
+// poller reports which of the connections it watches are ready to read
+type poller struct {
+	fd int
+}
+
+// newPoller creates a poller
+func newPoller() (*poller, error) {
+	fd, err := unix.EpollCreate1(unix.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	return &poller{fd: fd}, nil
+}
+
+// watch starts watching the socket fd, reporting it by id
+func (p *poller) watch(fd int, id int32) error {
+	return unix.EpollCtl(p.fd, unix.EPOLL_CTL_ADD, fd, &unix.EpollEvent{Events: pollEvents, Fd: id})
+}
+
+// rewatch watches fd again once its notification has been dealt with
+func (p *poller) rewatch(fd int, id int32) error {
+	return unix.EpollCtl(p.fd, unix.EPOLL_CTL_MOD, fd, &unix.EpollEvent{Events: pollEvents, Fd: id})
+}
+
+// unwatch stops watching fd. It must be called before fd is closed, or a
+// socket opened afterwards could be reported under its id.
+func (p *poller) unwatch(fd int) error {
+	return unix.EpollCtl(p.fd, unix.EPOLL_CTL_DEL, fd, nil)
+}
+
+// wait calls ready with the id of each connection that becomes ready, until
+// polling fails
+func (p *poller) wait(ready func(id int32)) error {
+	events := make([]unix.EpollEvent, 256)
+	for {
+		n, err := unix.EpollWait(p.fd, events, -1)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		for _, event := range events[:n] {
+			ready(event.Fd)
+		}
+	}
+}
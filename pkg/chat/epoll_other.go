@@ -0,0 +1,24 @@
+// pkg/chat/epoll_other.go
+
+//go:build !linux
+
+package chat
+
+import "errors"
+
+// errNoEpoll is returned where the epoll transport isn't supported
+var errNoEpoll = errors.New("the epoll transport is only supported on Linux")
+
+// poller would report which connections are ready to read
+type poller struct{}
+
+// newPoller fails, as this platform lacks epoll
+func newPoller() (*poller, error) {
+	return nil, errNoEpoll
+}
+
+func (p *poller) watch(fd int, id int32) error   { return errNoEpoll }
+func (p *poller) rewatch(fd int, id int32) error { return errNoEpoll }
+func (p *poller) unwatch(fd int) error           { return errNoEpoll }
+
+func (p *poller) wait(ready func(id int32)) error { return errNoEpoll }
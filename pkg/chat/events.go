@@ -0,0 +1,330 @@
+// pkg/chat/events.go
+package chat
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+)
+
+// SessionHeader names the event stream a POST to /send is for. The
+// session is the data of the stream's first event, "session".
+const SessionHeader = "X-Chat-Session"
+
+// maxPostedMessage is the largest message accepted by HandleSend
+const maxPostedMessage = 64 << 10
+
+// postedQueue is how many posted messages may wait for a client's
+// ReadPump before HandleSend waits too
+const postedQueue = 16
+
+// eventStreams holds the open event streams by session, for HandleSend
+type eventStreams struct {
+	mu       sync.Mutex
+	sessions map[string]*sseConn
+}
+
+func newEventStreams() *eventStreams {
+	return &eventStreams{sessions: make(map[string]*sseConn)}
+}
+
+// lookup returns the stream for session, or nil
+func (e *eventStreams) lookup(session string) *sseConn {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.sessions[session]
+}
+
+func (e *eventStreams) add(conn *sseConn) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.sessions[conn.session] = conn
+}
+
+func (e *eventStreams) remove(conn *sseConn) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	delete(e.sessions, conn.session)
+}
+
+// HandleEvents serves /events, a Server-Sent Events stream for clients that
+// can't use WebSockets. It joins the chat like HandleWebSocket, with the
+// same limits and authentication, but only receives on the stream: the
+// client's messages, starting with its username unless ?user= gives it,
+// are POSTed to HandleSend. Each message arrives as a "message" event.
+func (s *Server) HandleEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var conn *sseConn
+	s.serveConnection(w, r, func(w http.ResponseWriter, r *http.Request) (wsConn, error) {
+		var err error
+		if conn, err = s.openEvents(w, r); err != nil {
+			return nil, err
+		}
+		return conn, nil
+	})
+	if conn != nil {
+		// The response can only be written until this handler returns
+		select {
+		case <-conn.done:
+		case <-r.Context().Done():
+			conn.Close()
+		}
+	}
+}
+
+// openEvents starts the event stream answering r, announcing its session
+func (s *Server) openEvents(w http.ResponseWriter, r *http.Request) (*sseConn, error) {
+	if !s.checkOrigin(r) {
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return nil, errors.New("origin not allowed")
+	}
+
+	done := make(chan struct{})
+	conn := &sseConn{
+		w:       w,
+		control: http.NewResponseController(w),
+		session: randomToken(),
+		streams: s.events,
+		inbox:   newInbox(postedQueue, done),
+		done:    done,
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	// Stop nginx buffering the stream
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	if err := conn.writeEvent("session", []byte(conn.session)); err != nil {
+		return nil, err
+	}
+	if user := r.URL.Query().Get("user"); user != "" {
+		conn.inbox.messages <- user
+	}
+	s.events.add(conn)
+	return conn, nil
+}
+
+// HandleSend serves /send, taking the body of each POST as a message from
+// the event stream named by SessionHeader (or ?session=). It answers 204
+// once the message is passed on, and 404 if the stream has closed.
+func (s *Server) HandleSend(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.checkOrigin(r) {
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return
+	}
+	session := r.Header.Get(SessionHeader)
+	if session == "" {
+		session = r.URL.Query().Get("session")
+	}
+	conn := s.events.lookup(session)
+	if conn == nil {
+		http.Error(w, "unknown session", http.StatusNotFound)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxPostedMessage))
+	if err != nil {
+		http.Error(w, "message too long", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if !utf8.Valid(body) {
+		http.Error(w, "message is not UTF-8", http.StatusBadRequest)
+		return
+	}
+	// Tools like curl and echo end what they send with a newline
+	text := strings.TrimSuffix(strings.TrimSuffix(string(body), "\n"), "\r")
+
+	select {
+	case conn.inbox.messages <- text:
+		w.WriteHeader(http.StatusNoContent)
+	case <-conn.done:
+		http.Error(w, "unknown session", http.StatusNotFound)
+	case <-r.Context().Done():
+	}
+}
+
+// sseConn is a client's event stream, with the messages it posts to
+// HandleSend as its incoming messages, standing in for a WebSocket
+// connection. Pings are comments on the stream: if one is written, the
+// client is as good as having answered it.
+type sseConn struct {
+	w       http.ResponseWriter
+	control *http.ResponseController
+	session string
+	streams *eventStreams
+	inbox   *inbox
+
+	// mu serializes writes, which fail once closed is set. done is
+	// closed along with it.
+	mu     sync.Mutex
+	closed bool
+	done   chan struct{}
+	onPong func(string) error
+}
+
+// writeEvent writes an event of type event (unnamed if empty) with data
+// as its lines, and flushes it
+func (c *sseConn) writeEvent(event string, data []byte) error {
+	buf := getBuffer()
+	defer putBuffer(buf)
+	if event != "" {
+		buf.WriteString("event: ")
+		buf.WriteString(event)
+		buf.WriteByte('\n')
+	}
+	for {
+		// Any of CRLF, CR and LF end a line in an event stream
+		line, rest, found := data, []byte(nil), false
+		if i := bytes.IndexAny(data, "\r\n"); i >= 0 {
+			line, rest, found = data[:i], data[i+1:], true
+			if data[i] == '\r' && len(rest) > 0 && rest[0] == '\n' {
+				rest = rest[1:]
+			}
+		}
+		buf.WriteString("data: ")
+		buf.Write(line)
+		buf.WriteByte('\n')
+		if !found {
+			break
+		}
+		data = rest
+	}
+	buf.WriteByte('\n')
+	return c.write(buf.Bytes())
+}
+
+// write writes p to the stream and flushes it
+func (c *sseConn) write(p []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return net.ErrClosed
+	}
+	if _, err := c.w.Write(p); err != nil {
+		return err
+	}
+	return c.control.Flush()
+}
+
+// NextReader returns the next posted message
+func (c *sseConn) NextReader() (int, io.Reader, error) {
+	messageType, message, err := c.ReadMessage()
+	if err != nil {
+		return 0, nil, err
+	}
+	return messageType, bytes.NewReader(message), nil
+}
+
+// ReadMessage waits for the next posted message, until the read deadline
+func (c *sseConn) ReadMessage() (int, []byte, error) {
+	return c.inbox.read()
+}
+
+// WriteMessage writes data as a message event; binary messages aren't
+// supported
+func (c *sseConn) WriteMessage(messageType int, data []byte) error {
+	if messageType != websocket.TextMessage {
+		return errors.New("event streams only carry text messages")
+	}
+	return c.writeEvent("", data)
+}
+
+// WritePreparedMessage isn't supported
+func (c *sseConn) WritePreparedMessage(pm *websocket.PreparedMessage) error {
+	return errPreparedMessage
+}
+
+// WriteControl writes a ping as a comment, calling the pong handler once
+// it is written, and a close as a "close" event whose data is the code and
+// reason, e.g. "1013 too slow", ending the stream
+func (c *sseConn) WriteControl(messageType int, data []byte, deadline time.Time) error {
+	if err := c.SetWriteDeadline(deadline); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return err
+	}
+	switch messageType {
+	case websocket.PingMessage:
+		if err := c.write([]byte(": ping\n\n")); err != nil {
+			return err
+		}
+		c.mu.Lock()
+		onPong := c.onPong
+		c.mu.Unlock()
+		if onPong != nil {
+			return onPong("")
+		}
+	case websocket.CloseMessage:
+		code := websocket.CloseNoStatusReceived
+		if len(data) >= 2 {
+			code = int(binary.BigEndian.Uint16(data))
+			data = data[2:]
+		}
+		// There is no closing handshake, so that's the end of the stream
+		err := c.writeEvent("close", []byte(strconv.Itoa(code)+" "+string(data)))
+		c.Close()
+		return err
+	}
+	return nil
+}
+
+// SetReadDeadline sets when ReadMessage gives up waiting
+func (c *sseConn) SetReadDeadline(t time.Time) error {
+	c.inbox.setDeadline(t)
+	return nil
+}
+
+// SetWriteDeadline sets when writing to the stream fails
+func (c *sseConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return net.ErrClosed
+	}
+	return c.control.SetWriteDeadline(t)
+}
+
+// SetPongHandler sets what is called when a ping has been written
+func (c *sseConn) SetPongHandler(h func(appData string) error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.onPong = h
+}
+
+// EnableWriteCompression does nothing: compression is left to HTTP
+func (c *sseConn) EnableWriteCompression(bool) {}
+
+// SetCompressionLevel does nothing: compression is left to HTTP
+func (c *sseConn) SetCompressionLevel(int) error { return nil }
+
+// Subprotocol returns "", as event streams have no subprotocols
+func (c *sseConn) Subprotocol() string { return "" }
+
+// Close ends the stream; HandleEvents then finishes the response
+func (c *sseConn) Close() error {
+	c.mu.Lock()
+	if !c.closed {
+		c.closed = true
+		close(c.done)
+	}
+	c.mu.Unlock()
+	c.streams.remove(c)
+	return nil
+}
@@ -0,0 +1,139 @@
+// pkg/chat/events_test.go
+package chat
+
+import (
+	"bufio"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// readEvent reads the next event from an event stream, skipping comments,
+// and returns its type ("" if unnamed) and data
+func readEvent(r *bufio.Reader) (event, data string, err error) {
+	var lines []string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return "", "", err
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "" && (event != "" || lines != nil):
+			return event, strings.Join(lines, "\n"), nil
+		case strings.HasPrefix(line, "event: "):
+			event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			lines = append(lines, strings.TrimPrefix(line, "data: "))
+		}
+	}
+}
+
+// TestEvents joins through an event stream alongside a WebSocket client:
+// each sees the other's messages, and kicking the stream's user ends it
+// with a close event
+func TestEvents(t *testing.T) {
+	s := NewServerWithConfig(Config{Logger: slog.New(slog.NewTextHandler(io.Discard, nil))})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", s.HandleWebSocket)
+	mux.HandleFunc("/events", s.HandleEvents)
+	mux.HandleFunc("/send", s.HandleSend)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	response, err := http.Get(ts.URL + "/events?user=streamer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	if ct := response.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Content-Type %q", ct)
+	}
+	stream := bufio.NewReader(response.Body)
+	event, session, err := readEvent(stream)
+	if err != nil || event != "session" {
+		t.Fatalf("first event %q %q, %v", event, session, err)
+	}
+	// Every event from here on is awaited with the stream cut off after a while
+	timer := time.AfterFunc(5*time.Second, func() { response.Body.Close() })
+	defer timer.Stop()
+	expect := func(want string) {
+		t.Helper()
+		for {
+			event, data, err := readEvent(stream)
+			if err != nil {
+				t.Fatalf("waiting for %q: %v", want, err)
+			}
+			if event == "" && data == want {
+				return
+			}
+		}
+	}
+	expect("*** streamer joined the chat ***")
+
+	conn, err := connect("ws"+strings.TrimPrefix(ts.URL, "http")+"/ws", "socket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("hello stream")); err != nil {
+		t.Fatal(err)
+	}
+	expect("socket: hello stream")
+
+	post := func(session, text string) int {
+		t.Helper()
+		request, _ := http.NewRequest(http.MethodPost, ts.URL+"/send", strings.NewReader(text))
+		request.Header.Set(SessionHeader, session)
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+		return response.StatusCode
+	}
+	if code := post(session, "hello socket\n"); code != http.StatusNoContent {
+		t.Fatalf("POST /send answered %d", code)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(message) == "streamer: hello socket" {
+			break
+		}
+	}
+	if code := post("unknown", "hello"); code != http.StatusNotFound {
+		t.Errorf("POST /send to an unknown session answered %d", code)
+	}
+
+	if !s.KickUser("streamer", "testing", "admin") {
+		t.Fatal("streamer not connected")
+	}
+	for {
+		event, data, err := readEvent(stream)
+		if err != nil {
+			t.Fatalf("waiting for the close event: %v", err)
+		}
+		if event == "close" {
+			if data != "1008 You were kicked by admin: testing" {
+				t.Errorf("close event data %q", data)
+			}
+			break
+		}
+	}
+	if _, err := stream.ReadByte(); err != io.EOF {
+		t.Errorf("stream still open after the close event: %v", err)
+	}
+	if code := post(session, "still here?"); code != http.StatusNotFound {
+		t.Errorf("POST /send after the stream closed answered %d", code)
+	}
+}
@@ -0,0 +1,68 @@
+// pkg/chat/export.go
+package chat
+
+import (
+	"time"
+)
+
+// Exported event types besides the audit event types, which are exported
+// as they are
+const (
+	ExportMessage        = "message"
+	ExportPrivateMessage = "private_message"
+	ExportJoin           = "join"
+	ExportLeave          = "leave"
+	ExportMention        = "mention"
+)
+
+// ExportEvent is a chat message or system event as handed to an
+// EventExporter. Unlike AuditEvent it includes chat content.
+type ExportEvent struct {
+	Time time.Time `json:"time"`
+	Type string    `json:"type"`
+	// Instance tells apart the servers sharing a backplane
+	Instance string `json:"instance"`
+	Room     string `json:"room,omitempty"`
+	// Username is who sent the message or did the action, and Target who
+	// it was sent to or done to
+	Username string `json:"username,omitempty"`
+	Target   string `json:"target,omitempty"`
+	IP       string `json:"ip,omitempty"`
+	Text     string `json:"text,omitempty"`
+	Detail   string `json:"detail,omitempty"`
+	// Bridge is the service a bridged message came from, e.g. "slack"
+	Bridge string `json:"bridge,omitempty"`
+}
+
+// EventExporter receives every chat message and system event, e.g. to feed
+// an analytics or compliance pipeline; see KafkaExporter
+type EventExporter interface {
+	// Export hands over one event. It is called from client goroutines,
+	// so it must not block.
+	Export(event ExportEvent)
+}
+
+// Exporters is an EventExporter that hands each event to several
+// exporters, in order
+type Exporters []EventExporter
+
+// Export hands event to each exporter
+func (e Exporters) Export(event ExportEvent) {
+	for _, exporter := range e {
+		exporter.Export(event)
+	}
+}
+
+// export passes an event to the exporter, if there is one, and the
+// subscriptions. Messages from other instances aren't exported again;
+// their instance exports them.
+func (s *Server) export(event ExportEvent) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	event.Instance = s.instanceID
+	if s.Config.Exporter != nil {
+		s.Config.Exporter.Export(event)
+	}
+	s.notifySubscribers(event)
+}
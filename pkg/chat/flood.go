@@ -0,0 +1,77 @@
+// pkg/chat/flood.go
+package chat
+
+import (
+	"time"
+)
+
+// floodStrikeWindow is how long rate-limit strikes count towards an
+// automatic mute
+const floodStrikeWindow = time.Minute
+
+// tokenBucket allows bursts of up to burst events, refilled at rate per
+// second. It is not safe for concurrent use.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket returns a full bucket
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// allow takes a token if one is available
+func (b *tokenBucket) allow(now time.Time) bool {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// full reports whether the bucket would be back at its burst size by now
+func (b *tokenBucket) full(now time.Time) bool {
+	return b.tokens+now.Sub(b.last).Seconds()*b.rate >= b.burst
+}
+
+// allowMessage applies flood control to a frame from the client, telling it
+// off and muting it after repeated strikes. It returns false if the frame
+// should be dropped.
+func (c *Session) allowMessage() bool {
+	cfg := c.Server.config()
+	if cfg.MessageRate <= 0 {
+		return true
+	}
+	// Start over if the limits were reloaded
+	if burst := max(cfg.MessageBurst, 1); c.limiter == nil || c.limiter.rate != cfg.MessageRate || c.limiter.burst != float64(burst) {
+		c.limiter = newTokenBucket(cfg.MessageRate, burst)
+	}
+
+	now := time.Now()
+	if c.limiter.allow(now) {
+		return true
+	}
+
+	if now.Sub(c.strikesSince) > floodStrikeWindow {
+		c.strikes = 0
+		c.strikesSince = now
+	}
+	c.strikes++
+
+	if cfg.FloodMuteStrikes > 0 && c.strikes >= cfg.FloodMuteStrikes && cfg.FloodMuteDuration > 0 {
+		c.strikes = 0
+		c.Server.MuteUser(c.Username, cfg.FloodMuteDuration, "flooding", "")
+		return false
+	}
+
+	c.send("ERROR: Rate limit exceeded. Slow down.")
+	return false
+}
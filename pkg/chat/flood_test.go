@@ -0,0 +1,92 @@
+// pkg/chat/flood_test.go
+package chat
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// readLines feeds the messages read from conn to a channel until it fails
+func readLines(conn *websocket.Conn) <-chan string {
+	lines := make(chan string, 100)
+	go func() {
+		defer close(lines)
+		for {
+			_, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			lines <- string(msg)
+		}
+	}()
+	return lines
+}
+
+// waitLine waits for a line containing want, failing the test if one
+// containing unwanted comes first
+func waitLine(t *testing.T, lines <-chan string, want, unwanted string) {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case line := <-lines:
+			if unwanted != "" && strings.Contains(line, unwanted) {
+				t.Fatalf("got %q before %q", line, want)
+			}
+			if strings.Contains(line, want) {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("no %q", want)
+		}
+	}
+}
+
+// TestFloodControl sends a burst faster than the message rate and checks
+// that the excess is dropped with a warning, that the client may send
+// again once its bucket refills, and that repeated flooding mutes it until
+// the mute expires
+func TestFloodControl(t *testing.T) {
+	s, url := newTestServer(t, Config{
+		MessageRate:       2,
+		MessageBurst:      3,
+		FloodMuteStrikes:  3,
+		FloodMuteDuration: 500 * time.Millisecond,
+	})
+	alice, err := connect(url, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Close()
+	bob, err := connect(url, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bob.Close()
+	aliceLines, bobLines := readLines(alice), readLines(bob)
+
+	for _, text := range []string{"one", "two", "three", "four"} {
+		alice.WriteMessage(websocket.TextMessage, []byte(text))
+	}
+	waitLine(t, aliceLines, "Rate limit exceeded", "")
+	waitLine(t, bobLines, "three", "four")
+
+	// Two a second refill a token in half a second
+	time.Sleep(600 * time.Millisecond)
+	alice.WriteMessage(websocket.TextMessage, []byte("five"))
+	waitLine(t, bobLines, "five", "four")
+
+	for i := 0; i < 10; i++ {
+		alice.WriteMessage(websocket.TextMessage, []byte("spam"))
+	}
+	if !waitFor(5*time.Second, func() bool { _, muted := s.muteFor("alice"); return muted }) {
+		t.Fatal("flooding didn't mute alice")
+	}
+	waitLine(t, aliceLines, "Your mute has expired.", "")
+	if _, muted := s.muteFor("alice"); muted {
+		t.Error("mute didn't expire")
+	}
+}
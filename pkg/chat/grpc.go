@@ -0,0 +1,353 @@
+// pkg/chat/grpc.go
+package chat
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	"github.com/ryk-9/go-chat/pkg/chatpb"
+)
+
+// GRPCServer returns a gRPC server offering the chat as the chatpb.Chat
+// service, with opts (e.g. grpc.Creds for TLS) added to its own. Streams
+// are admitted like WebSocket connections, with the same limits, bans and
+// Config.Auth, their metadata standing in for HTTP headers; Send and
+// ListUsers need the admin token.
+func (s *Server) GRPCServer(opts ...grpc.ServerOption) *grpc.Server {
+	opts = append([]grpc.ServerOption{
+		// HTTP/2 pings take the place of WebSocket pings
+		grpc.KeepaliveParams(keepalive.ServerParameters{
+			Time:    s.Config.PingInterval,
+			Timeout: s.Config.WriteTimeout,
+		}),
+		grpc.MaxRecvMsgSize(maxPostedMessage),
+	}, opts...)
+	server := grpc.NewServer(opts...)
+	chatpb.RegisterChatServer(server, &grpcService{chat: s})
+	return server
+}
+
+// grpcService implements chatpb.ChatServer
+type grpcService struct {
+	chatpb.UnimplementedChatServer
+	chat *Server
+}
+
+// Stream joins the chat through serveConnection, then keeps the RPC open
+// until the client is disconnected
+func (g *grpcService) Stream(stream chatpb.Chat_StreamServer) error {
+	ctx := stream.Context()
+	w := newRecordedResponse()
+	var conn *grpcConn
+	g.chat.serveConnection(w, grpcRequest(ctx, chatpb.Chat_Stream_FullMethodName), func(http.ResponseWriter, *http.Request) (wsConn, error) {
+		conn = newGRPCConn(stream)
+		go conn.receive()
+		return conn, nil
+	})
+	if conn == nil {
+		if err := ctx.Err(); err != nil {
+			return status.FromContextError(err).Err()
+		}
+		return grpcStatus(ctx, w)
+	}
+
+	// The stream can only be written until this handler returns
+	select {
+	case <-conn.done:
+	case <-ctx.Done():
+		conn.Close()
+	}
+	return conn.status
+}
+
+// Send posts a message with PostMessage
+func (g *grpcService) Send(ctx context.Context, req *chatpb.SendRequest) (*chatpb.SendResponse, error) {
+	r := grpcRequest(ctx, chatpb.Chat_Send_FullMethodName)
+	if err := g.requireAdmin(ctx, r); err != nil {
+		return nil, err
+	}
+	room := req.GetRoom()
+	if room == "" {
+		room = DefaultRoom
+	}
+	if err := g.chat.PostMessage(ctx, room, req.GetFrom(), req.GetText()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	g.chat.audit(AuditAdmin, "gRPC API", room, g.chat.clientIP(r), "message as "+req.GetFrom()+": "+req.GetText())
+	return &chatpb.SendResponse{}, nil
+}
+
+// ListUsers lists the users connected here and to other instances, sorted
+// by username
+func (g *grpcService) ListUsers(ctx context.Context, req *chatpb.ListUsersRequest) (*chatpb.ListUsersResponse, error) {
+	if err := g.requireAdmin(ctx, grpcRequest(ctx, chatpb.Chat_ListUsers_FullMethodName)); err != nil {
+		return nil, err
+	}
+	room := ""
+	if req.GetRoom() != "" {
+		var ok bool
+		if room, ok = normalizeRoom(req.GetRoom()); !ok {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid room name %q", req.GetRoom())
+		}
+	}
+
+	var users []*chatpb.User
+	for _, user := range g.chat.listUsers(room) {
+		users = append(users, &chatpb.User{Username: user.Username, Room: user.Room, Role: string(user.Role), Remote: user.Remote})
+	}
+	return &chatpb.ListUsersResponse{Users: users}, nil
+}
+
+// requireAdmin checks that r, standing in for the RPC in ctx, presents the
+// admin token, as RequireAdmin does for HTTP requests
+func (g *grpcService) requireAdmin(ctx context.Context, r *http.Request) error {
+	w := newRecordedResponse()
+	admitted := false
+	g.chat.RequireAdmin(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		admitted = true
+	})).ServeHTTP(w, r)
+	if !admitted {
+		return grpcStatus(ctx, w)
+	}
+	return nil
+}
+
+// grpcRequest returns an HTTP request standing in for the RPC in ctx, with
+// its metadata as headers and its peer's address and TLS state, so it can
+// be checked like an HTTP request
+func grpcRequest(ctx context.Context, method string) *http.Request {
+	r, _ := http.NewRequestWithContext(ctx, http.MethodPost, method, nil)
+	md, _ := metadata.FromIncomingContext(ctx)
+	for key, values := range md {
+		// Pseudo-headers like :authority aren't headers
+		if strings.HasPrefix(key, ":") {
+			continue
+		}
+		for _, value := range values {
+			r.Header.Add(key, value)
+		}
+	}
+	if authority := md.Get(":authority"); len(authority) > 0 {
+		r.Host = authority[0]
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		r.RemoteAddr = p.Addr.String()
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+			r.TLS = &info.State
+		}
+	}
+	return r
+}
+
+// grpcStatus returns the status the response to the RPC in ctx amounts to,
+// passing on any Retry-After header as trailer metadata
+func grpcStatus(ctx context.Context, w *recordedResponse) error {
+	if retry := w.header.Get("Retry-After"); retry != "" {
+		grpc.SetTrailer(ctx, metadata.Pairs("retry-after", retry))
+	}
+	code := codes.Unknown
+	switch w.code {
+	case 0, http.StatusOK, http.StatusNoContent:
+		return nil
+	case http.StatusBadRequest:
+		code = codes.InvalidArgument
+	case http.StatusUnauthorized:
+		code = codes.Unauthenticated
+	case http.StatusForbidden:
+		code = codes.PermissionDenied
+	case http.StatusNotFound:
+		code = codes.NotFound
+	case http.StatusTooManyRequests:
+		code = codes.ResourceExhausted
+	case http.StatusServiceUnavailable:
+		code = codes.Unavailable
+	}
+	return status.Error(code, strings.TrimSpace(w.body.String()))
+}
+
+// grpcConn is a client's Chat.Stream RPC, standing in for a WebSocket
+// connection. Closing it ends the RPC, with a status matching the close
+// code. Pings are left to HTTP/2: if its keepalive pings go unanswered the
+// RPC fails, so WebSocket pings are answered straight away.
+type grpcConn struct {
+	stream chatpb.Chat_StreamServer
+	inbox  *inbox
+
+	// sendMu serializes sends, as the stream requires
+	sendMu sync.Mutex
+
+	// mu guards writeDeadline and onPong
+	mu            sync.Mutex
+	writeDeadline time.Time
+	onPong        func(string) error
+
+	// done is closed when the connection is, after status is set to what
+	// the RPC ends with
+	closeOnce sync.Once
+	done      chan struct{}
+	status    error
+}
+
+func newGRPCConn(stream chatpb.Chat_StreamServer) *grpcConn {
+	done := make(chan struct{})
+	return &grpcConn{stream: stream, inbox: newInbox(postedQueue, done), done: done}
+}
+
+// receive passes each message received on the stream to the inbox, until
+// the client stops sending, which closes the connection
+func (c *grpcConn) receive() {
+	defer c.Close()
+	for {
+		msg, err := c.stream.Recv()
+		if err != nil {
+			return
+		}
+		select {
+		case c.inbox.messages <- msg.GetText():
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// end closes the connection, ending the RPC with status
+func (c *grpcConn) end(status error) {
+	c.closeOnce.Do(func() {
+		c.status = status
+		close(c.done)
+	})
+}
+
+// closeStatus returns the status an RPC ends with for a close code
+func closeStatus(code int, reason string) error {
+	switch code {
+	case websocket.CloseNormalClosure, websocket.CloseNoStatusReceived:
+		return nil
+	case websocket.CloseGoingAway:
+		return status.Error(codes.Unavailable, reason)
+	case websocket.ClosePolicyViolation:
+		return status.Error(codes.PermissionDenied, reason)
+	case websocket.CloseTryAgainLater:
+		return status.Error(codes.ResourceExhausted, reason)
+	}
+	return status.Error(codes.Aborted, reason)
+}
+
+// NextReader returns the next message received
+func (c *grpcConn) NextReader() (int, io.Reader, error) {
+	messageType, message, err := c.ReadMessage()
+	if err != nil {
+		return 0, nil, err
+	}
+	return messageType, bytes.NewReader(message), nil
+}
+
+// ReadMessage waits for the next message received, until the read deadline
+func (c *grpcConn) ReadMessage() (int, []byte, error) {
+	return c.inbox.read()
+}
+
+// WriteMessage sends data as a ServerMessage; binary messages aren't
+// supported. If the write deadline passes first, the connection is closed.
+func (c *grpcConn) WriteMessage(messageType int, data []byte) error {
+	if messageType != websocket.TextMessage {
+		return errors.New("gRPC streams only carry text messages")
+	}
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+	select {
+	case <-c.done:
+		return net.ErrClosed
+	default:
+	}
+
+	c.mu.Lock()
+	deadline := c.writeDeadline
+	c.mu.Unlock()
+	if !deadline.IsZero() {
+		// Ending the RPC is the only way to interrupt a blocked send
+		timer := time.AfterFunc(time.Until(deadline), func() { c.Close() })
+		defer timer.Stop()
+	}
+	return c.stream.Send(&chatpb.ServerMessage{Text: string(data)})
+}
+
+// WritePreparedMessage isn't supported
+func (c *grpcConn) WritePreparedMessage(pm *websocket.PreparedMessage) error {
+	return errPreparedMessage
+}
+
+// WriteControl calls the pong handler for a ping, and for a close ends the
+// RPC with the status matching its code (see closeStatus)
+func (c *grpcConn) WriteControl(messageType int, data []byte, deadline time.Time) error {
+	switch messageType {
+	case websocket.PingMessage:
+		c.mu.Lock()
+		onPong := c.onPong
+		c.mu.Unlock()
+		if onPong != nil {
+			return onPong("")
+		}
+	case websocket.CloseMessage:
+		code := websocket.CloseNoStatusReceived
+		if len(data) >= 2 {
+			code = int(binary.BigEndian.Uint16(data))
+			data = data[2:]
+		}
+		c.end(closeStatus(code, string(data)))
+	}
+	return nil
+}
+
+// SetReadDeadline sets when ReadMessage gives up waiting
+func (c *grpcConn) SetReadDeadline(t time.Time) error {
+	c.inbox.setDeadline(t)
+	return nil
+}
+
+// SetWriteDeadline sets when a send is given up on
+func (c *grpcConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeDeadline = t
+	return nil
+}
+
+// SetPongHandler sets what is called when a ping is written
+func (c *grpcConn) SetPongHandler(h func(appData string) error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.onPong = h
+}
+
+// EnableWriteCompression does nothing: compression is left to gRPC
+func (c *grpcConn) EnableWriteCompression(bool) {}
+
+// SetCompressionLevel does nothing: compression is left to gRPC
+func (c *grpcConn) SetCompressionLevel(int) error { return nil }
+
+// Subprotocol returns "", as gRPC streams have no subprotocols
+func (c *grpcConn) Subprotocol() string { return "" }
+
+// Close ends the RPC, successfully unless a close message said otherwise
+func (c *grpcConn) Close() error {
+	c.end(nil)
+	return nil
+}
@@ -0,0 +1,127 @@
+// pkg/chat/grpc_test.go
+package chat
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/ryk-9/go-chat/pkg/chatpb"
+)
+
+// TestGRPC joins through Chat.Stream alongside a WebSocket client, posts
+// with Send and lists both users, then kicks the stream's user, which ends
+// the RPC with PERMISSION_DENIED
+func TestGRPC(t *testing.T) {
+	s, url := newTestServer(t, Config{AdminToken: "secret"})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := s.GRPCServer()
+	go server.Serve(ln)
+	defer server.Stop()
+	cc, err := grpc.NewClient(ln.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+	client := chatpb.NewChatClient(cc)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stream, err := client.Stream(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.Send(&chatpb.ClientMessage{Text: "service"}); err != nil {
+		t.Fatal(err)
+	}
+	expect := func(want string) {
+		t.Helper()
+		for {
+			msg, err := stream.Recv()
+			if err != nil {
+				t.Fatalf("waiting for %q: %v", want, err)
+			}
+			if msg.GetText() == want {
+				return
+			}
+		}
+	}
+	expect("*** service joined the chat ***")
+
+	conn, err := connect(url, "socket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("hello stream")); err != nil {
+		t.Fatal(err)
+	}
+	expect("socket: hello stream")
+	if err := stream.Send(&chatpb.ClientMessage{Text: "hello socket"}); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	readUntil := func(want string) {
+		t.Helper()
+		for {
+			_, message, err := conn.ReadMessage()
+			if err != nil {
+				t.Fatalf("waiting for %q: %v", want, err)
+			}
+			if string(message) == want {
+				return
+			}
+		}
+	}
+	readUntil("service: hello socket")
+
+	send := &chatpb.SendRequest{From: "deploybot", Text: "deployed"}
+	if _, err := client.Send(ctx, send); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("Send without the admin token: %v", err)
+	}
+	admin := metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer secret")
+	if _, err := client.Send(admin, send); err != nil {
+		t.Fatal(err)
+	}
+	readUntil("deploybot: deployed")
+	if _, err := client.Send(admin, &chatpb.SendRequest{Room: "no spaces", From: "deploybot", Text: "x"}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Send to an invalid room: %v", err)
+	}
+
+	list, err := client.ListUsers(admin, &chatpb.ListUsersRequest{Room: DefaultRoom})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, user := range list.GetUsers() {
+		names = append(names, user.GetUsername()+"/"+user.GetRole())
+	}
+	if len(names) != 2 || names[0] != "service/user" || names[1] != "socket/user" {
+		t.Errorf("ListUsers = %v", names)
+	}
+
+	if !s.KickUser("service", "testing", "admin") {
+		t.Fatal("service not connected")
+	}
+	for {
+		_, err := stream.Recv()
+		if err == nil {
+			continue
+		}
+		if st := status.Convert(err); st.Code() != codes.PermissionDenied || st.Message() != "You were kicked by admin: testing" {
+			t.Errorf("stream ended with %v", err)
+		}
+		break
+	}
+}
@@ -0,0 +1,88 @@
+// pkg/chat/guests.go
+package chat
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+)
+
+// permission is an action that some roles aren't allowed to perform
+type permission int
+
+const (
+	permWhisper permission = iota
+	permCreateRoom
+	permRegister
+	permReport
+	permModerate
+	permAdminister
+)
+
+// can reports whether the client's role allows an action. Guests may read
+// and post (at a reduced rate) but nothing else, only moderators and
+// admins may moderate, and only admins may administer.
+func (c *Session) can(p permission) bool {
+	switch p {
+	case permWhisper, permCreateRoom, permRegister, permReport:
+		return c.Role != RoleGuest
+	case permModerate:
+		return roleRank(c.Role) >= roleRank(RoleModerator)
+	case permAdminister:
+		return c.Role == RoleAdmin
+	}
+	return true
+}
+
+// outranks reports whether the client may moderate target: admins may
+// moderate anyone, moderators only users below them. A nil target (not
+// connected) can always be moderated.
+func (c *Session) outranks(target *Session) bool {
+	if target == nil || c.Role == RoleAdmin {
+		return true
+	}
+	return roleRank(c.Role) > roleRank(target.Role)
+}
+
+// guestMinDigits, guestMaxDigits and guestAttempts bound the search for a free guest name:
+// ten tries at each length from guest-NNN to guest-NNNNNNNNN
+const (
+	guestMinDigits = 3
+	guestMaxDigits = 9
+	guestAttempts  = 10
+)
+
+// guestIdentity picks a guest-NNN name for an unauthenticated connection
+// that is neither connected nor registered
+func (s *Server) guestIdentity() (Identity, error) {
+	limit := 1
+	for i := 0; i < guestMinDigits; i++ {
+		limit *= 10
+	}
+	for digits := guestMinDigits; digits <= guestMaxDigits; digits, limit = digits+1, limit*10 {
+		for attempt := 0; attempt < guestAttempts; attempt++ {
+			name := fmt.Sprintf("%s%0*d", guestPrefix, digits, rand.Intn(limit))
+			if s.usernameTaken(name) {
+				continue
+			}
+			_, err := s.Users.GetUser(name)
+			if errors.Is(err, ErrUserNotFound) {
+				return Identity{Username: name, Role: RoleGuest}, nil
+			}
+			if err != nil {
+				return Identity{}, fmt.Errorf("check guest name: %w", err)
+			}
+		}
+	}
+	return Identity{}, fmt.Errorf("no free guest name")
+}
+
+// usernameTaken reports whether a client connected to this or another
+// instance uses username
+func (s *Server) usernameTaken(username string) bool {
+	if s.clients.lookup(username) != nil {
+		return true
+	}
+	_, remote := s.remote.lookup(username)
+	return remote
+}
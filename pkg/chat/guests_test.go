@@ -0,0 +1,65 @@
+// pkg/chat/guests_test.go
+package chat
+
+import (
+	"errors"
+	"net/http"
+	"regexp"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// guestNameStore answers GetUser with err, counting the lookups
+type guestNameStore struct {
+	*MemoryUserStore
+	err     error
+	lookups atomic.Int64
+}
+
+func (s *guestNameStore) GetUser(username string) (User, error) {
+	s.lookups.Add(1)
+	if s.err != nil {
+		return User{}, s.err
+	}
+	return User{Username: username}, nil
+}
+
+// TestGuestIdentity checks that guests get a free guest-NNN name, and that
+// connections are refused rather than kept waiting when the user store
+// fails or no name can be found
+func TestGuestIdentity(t *testing.T) {
+	s, url := newTestServer(t, Config{Auth: &TokenAuth{SharedSecret: "s3cret"}, AllowGuests: true})
+	identity, err := s.guestIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !regexp.MustCompile(`^guest-\d{3}$`).MatchString(identity.Username) || identity.Role != RoleGuest {
+		t.Errorf("got %+v", identity)
+	}
+	conn, err := connect(url, "anyone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	// A failing store is reported at once
+	failing := &guestNameStore{MemoryUserStore: NewMemoryUserStore(), err: errors.New("database is down")}
+	s.Users = failing
+	if _, err := s.guestIdentity(); err == nil || failing.lookups.Load() != 1 {
+		t.Errorf("got %v after %d lookups, want an error after 1", err, failing.lookups.Load())
+	}
+	_, resp, err := websocket.DefaultDialer.Dial(url, nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("with a failing store: got %v, want 503", resp)
+	}
+
+	// Every name is registered
+	taken := &guestNameStore{MemoryUserStore: NewMemoryUserStore()}
+	s.Users = taken
+	want := int64(guestAttempts * (guestMaxDigits - guestMinDigits + 1))
+	if _, err := s.guestIdentity(); err == nil || taken.lookups.Load() != want {
+		t.Errorf("got %v after %d lookups, want an error after %d", err, taken.lookups.Load(), want)
+	}
+}
@@ -0,0 +1,202 @@
+// pkg/chat/health.go
+package chat
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// healthTimeout is how long a health check waits for each part of the
+// server to respond
+const healthTimeout = 2 * time.Second
+
+// Pinger is implemented by stores that can tell whether their backend is
+// reachable. Stores that don't are assumed to be.
+type Pinger interface {
+	Ping() error
+}
+
+// HealthCheck is the result of checking one part of the server
+type HealthCheck struct {
+	Name string
+	Err  error
+}
+
+// Live checks that the server isn't wedged: the client registry, which
+// every join, leave and broadcast locks, must be free within healthTimeout
+func (s *Server) Live() []HealthCheck {
+	return []HealthCheck{{Name: "clients", Err: s.checkRegistry()}}
+}
+
+// Ready checks that the server should be sent clients: it must be live,
+// running (see Run) and not shutting down, and its stores must respond
+func (s *Server) Ready() []HealthCheck {
+	checks := s.Live()
+
+	var running error
+	if !s.running.Load() {
+		running = errors.New("not running")
+	} else if s.Draining() {
+		running = errors.New("shutting down")
+	}
+	checks = append(checks, HealthCheck{Name: "running", Err: running})
+
+	stores := []struct {
+		name  string
+		store any
+	}{
+		{"store", s.Store},
+		{"private_store", s.PrivateStore},
+		{"users", s.Users},
+		{"bans", s.Bans},
+	}
+	for _, st := range stores {
+		if p, ok := st.store.(Pinger); ok {
+			checks = append(checks, HealthCheck{Name: st.name, Err: withTimeout(p.Ping)})
+		}
+	}
+	return checks
+}
+
+// Healthy reports whether every check passed
+func Healthy(checks []HealthCheck) bool {
+	for _, check := range checks {
+		if check.Err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// checkRegistry waits for each of the registry's locks. If an earlier
+// check is still waiting, the registry is still stuck and no more
+// goroutines are piled up on it.
+func (s *Server) checkRegistry() error {
+	if !s.registryProbe.CompareAndSwap(false, true) {
+		return errors.New("still locked since an earlier check")
+	}
+	return withTimeout(func() error {
+		defer s.registryProbe.Store(false)
+		s.clients.probe()
+		return nil
+	})
+}
+
+// withTimeout runs fn, giving up after healthTimeout. fn carries on in the
+// background if it hangs.
+func withTimeout(fn func() error) error {
+	result := make(chan error, 1)
+	go func() { result <- fn() }()
+
+	select {
+	case err := <-result:
+		return err
+	case <-time.After(healthTimeout):
+		return fmt.Errorf("no response after %s", healthTimeout)
+	}
+}
+
+// LivenessHandler serves Live for /healthz: 200 if every check passes,
+// 503 with the failures otherwise
+func (s *Server) LivenessHandler() http.Handler {
+	return healthHandler(s.Live)
+}
+
+// ReadinessHandler serves Ready for /readyz like LivenessHandler
+func (s *Server) ReadinessHandler() http.Handler {
+	return healthHandler(s.Ready)
+}
+
+// healthHandler reports the results of checks as plain text, one check
+// per line
+func healthHandler(checks func() []HealthCheck) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var report strings.Builder
+		status := http.StatusOK
+		for _, check := range checks() {
+			result := "ok"
+			if check.Err != nil {
+				result = "failed: " + check.Err.Error()
+				status = http.StatusServiceUnavailable
+			}
+			fmt.Fprintf(&report, "%s: %s\n", check.Name, result)
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(status)
+		if status == http.StatusOK {
+			fmt.Fprint(w, "OK\n")
+		} else {
+			fmt.Fprint(w, "UNAVAILABLE\n")
+		}
+		fmt.Fprint(w, report.String())
+	})
+}
+
+// HealthStatus is the JSON form of /health: what the server is, how busy
+// it is, and the result of each readiness check
+type HealthStatus struct {
+	Status            string            `json:"status"`
+	Version           string            `json:"version,omitempty"`
+	StartedAt         time.Time         `json:"started_at"`
+	UptimeSeconds     int64             `json:"uptime_seconds"`
+	Clients           int               `json:"clients"`
+	MaxClients        int               `json:"max_clients"`
+	Rooms             int               `json:"rooms"`
+	Messages          int64             `json:"messages_total"`
+	MessagesPerSecond float64           `json:"messages_per_second"`
+	Checks            map[string]string `json:"checks"`
+}
+
+// Health returns the server's status, which is "ok" if it is ready and
+// "unavailable" otherwise
+func (s *Server) Health() HealthStatus {
+	vars := s.Vars()
+	status := HealthStatus{
+		Status:            "ok",
+		Version:           s.Config.Version,
+		StartedAt:         s.startedAt,
+		UptimeSeconds:     vars.UptimeSeconds,
+		Clients:           vars.Clients,
+		MaxClients:        s.config().MaxClients,
+		Rooms:             vars.Rooms,
+		Messages:          vars.Messages,
+		MessagesPerSecond: vars.MessagesPerSecond,
+		Checks:            make(map[string]string),
+	}
+	for _, check := range s.Ready() {
+		status.Checks[check.Name] = "ok"
+		if check.Err != nil {
+			status.Checks[check.Name] = check.Err.Error()
+			status.Status = "unavailable"
+		}
+	}
+	return status
+}
+
+// HealthHandler serves /health. By default it is a plain-text summary that
+// always answers 200 while the server is up. With ?format=json or an
+// Accept: application/json header it returns Health instead, with 503 if
+// the server isn't ready.
+func (s *Server) HealthHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-store")
+		if r.URL.Query().Get("format") != "json" && !strings.Contains(r.Header.Get("Accept"), "application/json") {
+			vars := s.Vars()
+			fmt.Fprintf(w, "OK\nclients %d\nmax_clients %d\n", vars.Clients, s.config().MaxClients)
+			return
+		}
+
+		status := s.Health()
+		w.Header().Set("Content-Type", "application/json")
+		if status.Status != "ok" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(status)
+	})
+}
@@ -0,0 +1,161 @@
+// pkg/chat/history.go
+package chat
+
+import (
+	"bytes"
+	"context"
+	"strconv"
+	"sync"
+)
+
+// historyCache keeps the newest Config.HistorySize messages of each room
+// in a fixed-size ring, so replaying history to a joining client copies
+// them out instead of searching the store
+type historyCache struct {
+	size int
+
+	mu    sync.RWMutex
+	rooms map[string]*historyRing
+}
+
+// historyRing holds a room's newest messages. Until loaded is set it is
+// empty, and is filled from the store the first time it is read.
+type historyRing struct {
+	mu       sync.RWMutex
+	loaded   bool
+	messages []Message
+	// next is where the next message goes, and count how many are held
+	next  int
+	count int
+}
+
+// historyBuffers holds the slices history is copied out into for replay
+var historyBuffers = sync.Pool{
+	New: func() any { return new([]Message) },
+}
+
+// newHistoryCache returns a cache of size messages per room, or nil if size
+// isn't positive
+func newHistoryCache(size int) *historyCache {
+	if size <= 0 {
+		return nil
+	}
+	return &historyCache{size: size, rooms: make(map[string]*historyRing)}
+}
+
+// ring returns room's ring, adding an unloaded one if it has none yet
+func (h *historyCache) ring(room string) *historyRing {
+	h.mu.RLock()
+	ring := h.rooms[room]
+	h.mu.RUnlock()
+	if ring != nil {
+		return ring
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if ring = h.rooms[room]; ring == nil {
+		ring = &historyRing{}
+		h.rooms[room] = ring
+	}
+	return ring
+}
+
+// record appends msg to store and, if room's ring is loaded, to the ring.
+// The ring stays locked meanwhile so that a load can't miss msg or see it
+// twice.
+func (h *historyCache) record(ctx context.Context, store MessageStore, msg Message) error {
+	ring := h.ring(msg.Room)
+	ring.mu.Lock()
+	defer ring.mu.Unlock()
+
+	msg, err := appendMessage(ctx, store, msg)
+	if err != nil {
+		return err
+	}
+	if ring.loaded {
+		ring.push(msg)
+	}
+	return nil
+}
+
+// recent copies room's newest messages, oldest first, into dst (reusing
+// its storage) and returns it. The first read of a room loads its ring
+// from store.
+func (h *historyCache) recent(store MessageStore, room string, dst []Message) ([]Message, error) {
+	ring := h.ring(room)
+	ring.mu.RLock()
+	if ring.loaded {
+		defer ring.mu.RUnlock()
+		return ring.copyTo(dst), nil
+	}
+	ring.mu.RUnlock()
+
+	ring.mu.Lock()
+	defer ring.mu.Unlock()
+	if !ring.loaded {
+		messages, err := store.Recent(room, h.size)
+		if err != nil {
+			return dst[:0], err
+		}
+		ring.messages = make([]Message, h.size)
+		ring.next, ring.count = 0, 0
+		for _, msg := range messages {
+			ring.push(msg)
+		}
+		ring.loaded = true
+	}
+	return ring.copyTo(dst), nil
+}
+
+// reset empties every ring, to be reloaded from the store when next read.
+// It is for when messages have been removed from or changed in the store.
+func (h *historyCache) reset() {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for _, ring := range h.rooms {
+		ring.mu.Lock()
+		ring.loaded, ring.messages = false, nil
+		ring.mu.Unlock()
+	}
+}
+
+// push adds msg as the newest message, overwriting the oldest if the ring
+// is full. The ring must be locked and loaded.
+func (r *historyRing) push(msg Message) {
+	r.messages[r.next] = msg
+	r.next = (r.next + 1) % len(r.messages)
+	r.count = min(r.count+1, len(r.messages))
+}
+
+// copyTo copies the messages, oldest first, into dst and returns it. It
+// only allocates if dst is too small. The ring must be locked.
+func (r *historyRing) copyTo(dst []Message) []Message {
+	dst = dst[:0]
+	if r.count == 0 {
+		return dst
+	}
+	start := (r.next - r.count + len(r.messages)) % len(r.messages)
+	if start+r.count <= len(r.messages) {
+		return append(dst, r.messages[start:start+r.count]...)
+	}
+	dst = append(dst, r.messages[start:]...)
+	return append(dst, r.messages[:r.next]...)
+}
+
+// formatHistory writes the history replayed to a joining client to buf
+func formatHistory(buf *bytes.Buffer, messages []Message) {
+	buf.WriteString("--- Last ")
+	buf.Write(strconv.AppendInt(buf.AvailableBuffer(), int64(len(messages)), 10))
+	buf.WriteString(" messages ---\n")
+	for _, msg := range messages {
+		buf.WriteByte('[')
+		buf.Write(msg.Time.AppendFormat(buf.AvailableBuffer(), "Jan 2 15:04"))
+		buf.WriteString("] ")
+		buf.WriteString(msg.From)
+		buf.WriteString(": ")
+		buf.WriteString(msg.Text)
+		buf.WriteByte('\n')
+	}
+	buf.WriteString("--- End of history ---")
+}
@@ -0,0 +1,61 @@
+// pkg/chat/history_test.go
+package chat
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// TestHistoryRing checks that each room's ring keeps its newest messages
+// in order as it wraps around, copies them out without allocating, and is
+// reloaded from the store once a user's messages are erased
+func TestHistoryRing(t *testing.T) {
+	s, _ := newTestServer(t, Config{HistorySize: 3})
+	s.recordMessage(context.Background(), "other", "carol", "elsewhere")
+	// The first read loads the ring from the store; the rest go straight in
+	s.recordMessage(context.Background(), DefaultRoom, "alice", "0")
+	if _, err := s.history.recent(s.Store, DefaultRoom, nil); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i < 8; i++ {
+		s.recordMessage(context.Background(), DefaultRoom, []string{"alice", "bob"}[i%2], fmt.Sprint(i))
+	}
+
+	texts := func(messages []Message) string {
+		var got []string
+		for _, msg := range messages {
+			got = append(got, msg.From+":"+msg.Text)
+		}
+		return strings.Join(got, " ")
+	}
+	dst := make([]Message, 0, 3)
+	messages, err := s.history.recent(s.Store, DefaultRoom, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := texts(messages); got != "bob:5 alice:6 bob:7" {
+		t.Errorf("history = %s", got)
+	}
+	allocs := testing.AllocsPerRun(100, func() {
+		s.history.recent(s.Store, DefaultRoom, dst)
+	})
+	if allocs != 0 {
+		t.Errorf("reading history allocated %v times", allocs)
+	}
+
+	if _, err := s.EraseUser("alice", false); err != nil {
+		t.Fatal(err)
+	}
+	messages, err = s.history.recent(s.Store, DefaultRoom, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := texts(messages); got != "bob:3 bob:5 bob:7" {
+		t.Errorf("history after erasing alice = %s", got)
+	}
+	if messages, _ := s.history.recent(s.Store, "other", dst); texts(messages) != "carol:elsewhere" {
+		t.Errorf("other room's history = %s", texts(messages))
+	}
+}
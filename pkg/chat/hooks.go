@@ -0,0 +1,94 @@
+// pkg/chat/hooks.go
+package chat
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrDropped is returned by a hook to reject a message or command without
+// telling the client
+var ErrDropped = errors.New("dropped by hook")
+
+// Hook is a set of functions the server calls at points in a client's
+// session, so embedders can filter, rewrite, log or count what clients do.
+// Any of them may be nil. The hooks in Config.Hooks run in order, each
+// seeing what the ones before it returned, and a rejection stops the chain.
+// ctx is the client's, cancelled once it disconnects.
+type Hook struct {
+	// OnConnect runs once a client has passed the server's checks, before
+	// it joins. An error turns it away with the error's text.
+	OnConnect func(ctx context.Context, client *Session) error
+
+	// OnMessage runs for each message a client posts to its room, after
+	// the server's own checks (mutes, rate limits, spam and automod), and
+	// returns the text to post. An error rejects the message and is sent
+	// to the client, unless it is ErrDropped.
+	OnMessage func(ctx context.Context, client *Session, text string) (string, error)
+
+	// OnCommand runs for each command a client sends, such as "/join dev",
+	// before it is handled, and returns the command to handle. Errors are
+	// treated as by OnMessage. Commands carrying passwords, like /login,
+	// are seen as sent.
+	OnCommand func(ctx context.Context, client *Session, command string) (string, error)
+
+	// OnDisconnect runs once a client that joined has left
+	OnDisconnect func(ctx context.Context, client *Session)
+}
+
+// hookConnect runs the OnConnect hooks for c, returning the first error
+func (s *Server) hookConnect(c *Session) error {
+	for _, hook := range s.Config.Hooks {
+		if hook.OnConnect == nil {
+			continue
+		}
+		if err := hook.OnConnect(c.ctx, c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hookText passes text from c through the OnMessage or OnCommand hooks,
+// picked by pick. It returns false, having told the client why unless the
+// hook dropped it, if a hook rejected it.
+func (c *Session) hookText(text string, pick func(Hook) func(context.Context, *Session, string) (string, error)) (string, bool) {
+	for _, hook := range c.Server.Config.Hooks {
+		fn := pick(hook)
+		if fn == nil {
+			continue
+		}
+		var err error
+		if text, err = fn(c.ctx, c, text); err != nil {
+			c.logger().Debug("Rejected by hook", "err", err)
+			if !errors.Is(err, ErrDropped) {
+				c.send(err.Error())
+			}
+			return "", false
+		}
+	}
+	return text, true
+}
+
+// hookMessage runs the OnMessage hooks for a message from c
+func (c *Session) hookMessage(text string) (string, bool) {
+	return c.hookText(text, func(hook Hook) func(context.Context, *Session, string) (string, error) {
+		return hook.OnMessage
+	})
+}
+
+// hookCommand runs the OnCommand hooks for a command from c
+func (c *Session) hookCommand(command string) (string, bool) {
+	return c.hookText(command, func(hook Hook) func(context.Context, *Session, string) (string, error) {
+		return hook.OnCommand
+	})
+}
+
+// hookDisconnect runs the OnDisconnect hooks for c
+func (s *Server) hookDisconnect(c *Session) {
+	for _, hook := range s.Config.Hooks {
+		if hook.OnDisconnect != nil {
+			hook.OnDisconnect(c.ctx, c)
+		}
+	}
+}
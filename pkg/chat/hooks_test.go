@@ -0,0 +1,91 @@
+// pkg/chat/hooks_test.go
+package chat
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// TestHooks chains hooks that turn away a user, rewrite, reject and drop
+// messages, alias a command and count disconnections
+func TestHooks(t *testing.T) {
+	var disconnected atomic.Int32
+	hooks := []Hook{
+		{
+			OnConnect: func(ctx context.Context, client *Session) error {
+				if client.Username == "mallory" {
+					return errors.New("Not today, mallory.")
+				}
+				// Hooks may reach for the WebSocket itself
+				if client.Conn == nil {
+					return errors.New("No WebSocket connection.")
+				}
+				return nil
+			},
+			OnMessage: func(ctx context.Context, client *Session, text string) (string, error) {
+				switch {
+				case strings.Contains(text, "spam"):
+					return "", errors.New("No spam here.")
+				case strings.Contains(text, "secret"):
+					return "", ErrDropped
+				}
+				return strings.ToUpper(text), nil
+			},
+			OnCommand: func(ctx context.Context, client *Session, command string) (string, error) {
+				if command == "/who" {
+					return "/users", nil
+				}
+				return command, nil
+			},
+		},
+		{
+			// Sees what the first hook made of the message
+			OnMessage: func(ctx context.Context, client *Session, text string) (string, error) {
+				return text + "!", nil
+			},
+			OnDisconnect: func(ctx context.Context, client *Session) {
+				disconnected.Add(1)
+			},
+		},
+	}
+	_, url := newTestServer(t, Config{Hooks: hooks})
+
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.WriteMessage(websocket.TextMessage, []byte("mallory"))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, msg, err := conn.ReadMessage(); err != nil || string(msg) != "ERROR: Not today, mallory." {
+		t.Errorf("mallory got %q, %v", msg, err)
+	}
+	conn.Close()
+
+	alice := newTestClient(t, url, "alice", ClientOptions{})
+	for _, text := range []string{"secret plan", "buy spam", "hello", "/who"} {
+		if err := alice.Send(text); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var got []string
+	for len(got) < 3 {
+		msg := alice.waitMessage(t, func(msg ClientMessage) bool {
+			return !strings.HasPrefix(msg.Line, "***") && !strings.HasPrefix(msg.Line, "Welcome")
+		})
+		got = append(got, msg.Line)
+	}
+	if got[0] != "No spam here." || got[1] != "alice: HELLO!" || !strings.HasPrefix(got[2], "Connected users (1)") {
+		t.Errorf("alice got %q", got)
+	}
+
+	alice.Close()
+	if !waitFor(5*time.Second, func() bool { return disconnected.Load() == 1 }) {
+		t.Errorf("OnDisconnect ran %d times", disconnected.Load())
+	}
+}
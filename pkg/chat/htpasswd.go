@@ -0,0 +1,110 @@
+// pkg/chat/htpasswd.go
+package chat
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// dummyHash is compared against when a username is unknown so that
+// response times don't reveal which usernames exist
+var (
+	dummyHashOnce sync.Once
+	dummyHash     []byte
+)
+
+// compareDummyHash spends as long as a real password check would
+func compareDummyHash(password string) {
+	dummyHashOnce.Do(func() {
+		dummyHash, _ = bcrypt.GenerateFromPassword([]byte("go-chat-dummy-password"), bcrypt.DefaultCost)
+	})
+	bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+}
+
+// HtpasswdAuth checks usernames and passwords, sent as HTTP Basic
+// credentials, against a file of "username:bcrypt-hash" lines as produced
+// by `htpasswd -B`
+type HtpasswdAuth struct {
+	path string
+
+	mu     sync.RWMutex
+	hashes map[string][]byte
+}
+
+// NewHtpasswdAuth loads the credentials file at path
+func NewHtpasswdAuth(path string) (*HtpasswdAuth, error) {
+	a := &HtpasswdAuth{path: path}
+	if err := a.Reload(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Reload rereads the credentials file. On error the previously loaded
+// credentials stay in effect.
+func (a *HtpasswdAuth) Reload() error {
+	f, err := os.Open(a.path)
+	if err != nil {
+		return fmt.Errorf("open credentials file: %w", err)
+	}
+	defer f.Close()
+
+	hashes := make(map[string][]byte)
+	scanner := bufio.NewScanner(f)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		username, hash, ok := strings.Cut(line, ":")
+		if !ok || username == "" || !strings.HasPrefix(hash, "$2") {
+			return fmt.Errorf("%s:%d: expected username:bcrypt-hash", a.path, lineNum)
+		}
+		hashes[userKey(username)] = []byte(hash)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("read credentials file: %w", err)
+	}
+
+	a.mu.Lock()
+	a.hashes = hashes
+	a.mu.Unlock()
+	return nil
+}
+
+// Len returns how many users are currently loaded
+func (a *HtpasswdAuth) Len() int {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return len(a.hashes)
+}
+
+// Authenticate checks the request's Basic credentials against the file
+func (a *HtpasswdAuth) Authenticate(r *http.Request) (Identity, error) {
+	username, password, ok := r.BasicAuth()
+	if !ok || username == "" {
+		return Identity{}, fmt.Errorf("%w: missing username and password", ErrUnauthorized)
+	}
+
+	a.mu.RLock()
+	hash, known := a.hashes[userKey(username)]
+	a.mu.RUnlock()
+	if !known {
+		compareDummyHash(password)
+		return Identity{}, fmt.Errorf("%w: unknown user %s", ErrUnauthorized, username)
+	}
+
+	if err := bcrypt.CompareHashAndPassword(hash, []byte(password)); err != nil {
+		return Identity{}, fmt.Errorf("%w: invalid password for %s", ErrUnauthorized, username)
+	}
+	return Identity{Username: username, Role: RoleUser}, nil
+}
@@ -0,0 +1,88 @@
+// pkg/chat/htpasswd_test.go
+package chat
+
+import (
+	"encoding/base64"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// writeHtpasswd writes a credentials file with a bcrypt hash of each
+// user's password
+func writeHtpasswd(t *testing.T, path string, passwords map[string]string) {
+	t.Helper()
+	data := "# go-chat users\n"
+	for username, password := range passwords {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data += username + ":" + string(hash) + "\n"
+	}
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// basicAuth returns a header with Basic credentials
+func basicAuth(username, password string) http.Header {
+	return http.Header{"Authorization": {"Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))}}
+}
+
+// TestHtpasswdAuth connects with passwords from a credentials file, and
+// checks that wrong passwords, unknown users and guest names are refused,
+// that a reload takes effect, and that a broken file doesn't replace a good
+// one
+func TestHtpasswdAuth(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.htpasswd")
+	writeHtpasswd(t, path, map[string]string{"alice": "wonderland", "bob": "builder", "guest-0001": "visitor"})
+	auth, err := NewHtpasswdAuth(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if auth.Len() != 3 {
+		t.Errorf("loaded %d users", auth.Len())
+	}
+	_, url := newTestServer(t, Config{Auth: auth})
+
+	for _, tt := range []struct {
+		name   string
+		header http.Header
+		want   int
+	}{
+		{"right password", basicAuth("alice", "wonderland"), http.StatusSwitchingProtocols},
+		{"right password, other case", basicAuth("Bob", "builder"), http.StatusSwitchingProtocols},
+		{"wrong password", basicAuth("alice", "looking-glass"), http.StatusUnauthorized},
+		{"unknown user", basicAuth("mallory", "wonderland"), http.StatusUnauthorized},
+		{"empty password", basicAuth("alice", ""), http.StatusUnauthorized},
+		{"guest name", basicAuth("guest-0001", "visitor"), http.StatusUnauthorized},
+		{"no credentials", nil, http.StatusUnauthorized},
+	} {
+		if got := dialStatus(t, url, tt.header); got != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.name, got, tt.want)
+		}
+	}
+
+	writeHtpasswd(t, path, map[string]string{"alice": "looking-glass"})
+	if err := auth.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if got := dialStatus(t, url, basicAuth("alice", "wonderland")); got != http.StatusUnauthorized {
+		t.Errorf("old password after reload: got %d", got)
+	}
+	if got := dialStatus(t, url, basicAuth("bob", "builder")); got != http.StatusUnauthorized {
+		t.Errorf("removed user after reload: got %d", got)
+	}
+
+	os.WriteFile(path, []byte("alice:plaintext\n"), 0600)
+	if err := auth.Reload(); err == nil {
+		t.Error("reloaded a file without bcrypt hashes")
+	}
+	if got := dialStatus(t, url, basicAuth("alice", "looking-glass")); got != http.StatusSwitchingProtocols {
+		t.Errorf("after a failed reload: got %d", got)
+	}
+}
@@ -0,0 +1,96 @@
+// pkg/chat/iplimit.go
+package chat
+
+import (
+	"sync"
+	"time"
+)
+
+// ipLimiter caps connection attempts (a token bucket refilled at perMinute)
+// and concurrent connections per source IP
+type ipLimiter struct {
+	perMinute int
+	maxConns  int
+
+	mu        sync.Mutex
+	entries   map[string]*ipEntry
+	lastSweep time.Time
+}
+
+// ipEntry is the limiter state for one IP
+type ipEntry struct {
+	attempts *tokenBucket
+	conns    int
+}
+
+// newIPLimiter creates a limiter; zero for either limit disables it
+func newIPLimiter(perMinute, maxConns int) *ipLimiter {
+	return &ipLimiter{
+		perMinute: perMinute,
+		maxConns:  maxConns,
+		entries:   make(map[string]*ipEntry),
+		lastSweep: time.Now(),
+	}
+}
+
+// acquire records a connection attempt from ip and reports whether it may
+// proceed. A successful acquire must be paired with release.
+func (l *ipLimiter) acquire(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.sweepLocked(now)
+
+	e := l.entries[ip]
+	if e == nil {
+		e = &ipEntry{attempts: newTokenBucket(float64(l.perMinute)/60, l.perMinute)}
+		l.entries[ip] = e
+	}
+
+	if l.perMinute > 0 && !e.attempts.allow(now) {
+		return false
+	}
+
+	if l.maxConns > 0 && e.conns >= l.maxConns {
+		return false
+	}
+	e.conns++
+	return true
+}
+
+// setLimits changes the limits. Connection attempts are counted afresh.
+func (l *ipLimiter) setLimits(perMinute, maxConns int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if perMinute != l.perMinute {
+		for _, e := range l.entries {
+			e.attempts = newTokenBucket(float64(perMinute)/60, perMinute)
+		}
+	}
+	l.perMinute, l.maxConns = perMinute, maxConns
+}
+
+// release ends a connection counted by acquire
+func (l *ipLimiter) release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if e := l.entries[ip]; e != nil && e.conns > 0 {
+		e.conns--
+	}
+}
+
+// sweepLocked forgets idle IPs whose bucket has refilled, at most once a
+// minute. l.mu must be held.
+func (l *ipLimiter) sweepLocked(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+	for ip, e := range l.entries {
+		if e.conns == 0 && e.attempts.full(now) {
+			delete(l.entries, ip)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+// pkg/chat/iplimit_test.go
+package chat
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// TestMaxConnectionsPerIP opens connections from one IP up to the limit,
+// checks that one more is refused, and that closing one makes room again
+func TestMaxConnectionsPerIP(t *testing.T) {
+	_, url := newTestServer(t, Config{MaxConnectionsPerIP: 2})
+	alice, err := connect(url, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Close()
+	bob, err := connect(url, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, resp, err := websocket.DefaultDialer.Dial(url, nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") == "" {
+		t.Fatalf("third connection: got %v, want 429 with Retry-After", resp)
+	}
+
+	bob.Close()
+	if !waitFor(5*time.Second, func() bool {
+		conn, err := connect(url, "carol")
+		if err != nil {
+			return false
+		}
+		conn.Close()
+		return true
+	}) {
+		t.Error("no room after a connection closed")
+	}
+}
+
+// TestIPLimiter trips the connection attempt limit for one IP and checks
+// that other IPs aren't affected, that attempts are allowed again as the
+// bucket refills, and that idle IPs are forgotten
+func TestIPLimiter(t *testing.T) {
+	l := newIPLimiter(3, 0)
+	for i := 0; i < 3; i++ {
+		if !l.acquire("192.0.2.1") {
+			t.Fatalf("attempt %d refused", i+1)
+		}
+		l.release("192.0.2.1")
+	}
+	if l.acquire("192.0.2.1") {
+		t.Error("fourth attempt in a minute allowed")
+	}
+	if !l.acquire("198.51.100.1") {
+		t.Error("another IP refused")
+	}
+	l.release("198.51.100.1")
+
+	// Three a minute is one every 20 seconds
+	l.mu.Lock()
+	l.entries["192.0.2.1"].attempts.last = time.Now().Add(-21 * time.Second)
+	l.mu.Unlock()
+	if !l.acquire("192.0.2.1") {
+		t.Error("attempt refused after the bucket refilled")
+	}
+	l.release("192.0.2.1")
+	if l.acquire("192.0.2.1") {
+		t.Error("second attempt allowed after one token refilled")
+	}
+
+	l.mu.Lock()
+	for _, e := range l.entries {
+		e.attempts.last = time.Now().Add(-time.Hour)
+	}
+	l.lastSweep = time.Now().Add(-2 * time.Minute)
+	l.mu.Unlock()
+	l.acquire("203.0.113.1")
+	l.mu.Lock()
+	remaining := len(l.entries)
+	l.mu.Unlock()
+	if remaining != 1 {
+		t.Errorf("%d IPs remembered after sweeping, want 1", remaining)
+	}
+
+	// Lifting the limit lets the IP straight back in
+	l.setLimits(0, 0)
+	for i := 0; i < 10; i++ {
+		if !l.acquire("203.0.113.1") {
+			t.Fatal("attempt refused without limits")
+		}
+	}
+}
@@ -0,0 +1,571 @@
+// pkg/chat/irc.go
+package chat
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ircServerName is the gateway's name as the prefix of its IRC messages,
+// and the host in users' prefixes
+const ircServerName = "go-chat"
+
+// ircNamesLength is roughly how long a NAMES reply line may get before the
+// names continue on another, well under IRC's 512 bytes
+const ircNamesLength = 400
+
+// IRC numeric replies the gateway sends
+const (
+	ircWelcome          = "001"
+	ircYourHost         = "002"
+	ircMyInfo           = "004"
+	ircISupport         = "005"
+	ircUModeIs          = "221"
+	ircEndOfWho         = "315"
+	ircList             = "322"
+	ircListEnd          = "323"
+	ircChannelModeIs    = "324"
+	ircNoTopic          = "331"
+	ircNamReply         = "353"
+	ircEndOfNames       = "366"
+	ircCannotSendToChan = "404"
+	ircNoMOTD           = "422"
+	ircNotRegistered    = "451"
+	ircAlreadyRegistred = "462"
+	ircPasswdMismatch   = "464"
+)
+
+// ServeIRC accepts connections on ln until it is closed, each joining the
+// chat through a minimal IRC server, for weechat, irssi and other IRC
+// clients. Rooms are channels, of which a user is in one at a time as in
+// the chat: JOIN moves to another room, and PART goes back to the default
+// one. PRIVMSG to the channel posts a message, starting with a slash for a
+// chat command, and to a nick whispers; NAMES and LIST list users and
+// rooms. Other commands are passed on as chat commands. The NICK is the username, and PASS, if sent, is passed as a bearer
+// token. IRC clients are otherwise admitted like WebSocket connections,
+// with the same limits, bans and Config.Auth.
+func (s *Server) ServeIRC(ln net.Listener) error {
+	return s.acceptLoop(ln, "IRC", s.serveIRC)
+}
+
+// serveIRC takes the client on netConn through IRC registration, then
+// admits it through serveConnection
+func (s *Server) serveIRC(netConn net.Conn) {
+	conn := &ircConn{lineConn: &lineConn{conn: netConn, reader: bufio.NewReader(netConn)}, server: s, room: DefaultRoom}
+	r, ok := s.lineRequest(netConn)
+	if !ok {
+		netConn.Close()
+		return
+	}
+	nick, ok := conn.register(r)
+	if !ok {
+		netConn.Close()
+		return
+	}
+	conn.pending = []byte(nick)
+	// The read deadline stands until ReadPump sets its own
+	netConn.SetWriteDeadline(time.Time{})
+
+	w := newRecordedResponse()
+	admitted := false
+	s.serveConnection(w, r, func(http.ResponseWriter, *http.Request) (wsConn, error) {
+		admitted = true
+		return conn, nil
+	})
+	if !admitted {
+		if w.code >= http.StatusBadRequest {
+			netConn.SetWriteDeadline(time.Now().Add(s.Config.WriteTimeout))
+			var lines []string
+			if w.code == http.StatusUnauthorized {
+				lines = append(lines, conn.numeric(ircPasswdMismatch, "Password incorrect"))
+			}
+			conn.writeLines(append(lines, ircLine("", "ERROR", "Closing link: "+strings.TrimSpace(w.body.String())))...)
+		}
+		netConn.Close()
+	}
+}
+
+// ircConn is an IRC client's connection, standing in for a WebSocket
+// connection: what the client sends is turned into chat messages and
+// commands, and what the chat sends into IRC messages (see translate).
+// WebSocket pings are IRC PINGs, answered by PONGs.
+type ircConn struct {
+	*lineConn
+	server *Server
+
+	// nick is the client's username, set once it is admitted
+	nick string
+
+	// roomMu guards room, the room the client is in, which is followed
+	// by the write pump and read by ReadPump
+	roomMu sync.Mutex
+	room   string
+
+	// welcomed and history belong to the write pump: whether the
+	// registration replies have been sent, and a history replay held
+	// back until the channel it belongs to is joined
+	welcomed bool
+	history  []string
+}
+
+// register reads the client's registration up to NICK and USER, passing
+// PASS on as a bearer token in r, and returns the nick
+func (c *ircConn) register(r *http.Request) (string, bool) {
+	nick, user := "", false
+	for nick == "" || !user {
+		raw, err := c.readLine()
+		if err != nil {
+			return "", false
+		}
+		command, params := parseIRC(string(cleanLine(raw)))
+		switch command {
+		case "":
+		case "CAP":
+			c.capabilities(params)
+		case "PASS":
+			if len(params) > 0 {
+				r.Header.Set("Authorization", "Bearer "+params[0])
+			}
+		case "NICK":
+			if len(params) > 0 {
+				nick = params[0]
+			}
+		case "USER":
+			user = true
+		case "PING":
+			c.writeLines(ircLine(ircServerName, "PONG", append([]string{ircServerName}, params...)...))
+		case "QUIT":
+			return "", false
+		default:
+			c.writeLines(c.numeric(ircNotRegistered, "You have not registered"))
+		}
+	}
+	return nick, true
+}
+
+// capabilities answers CAP LS, offering none
+func (c *ircConn) capabilities(params []string) {
+	if len(params) > 0 && strings.EqualFold(params[0], "LS") {
+		c.writeLines(ircLine(ircServerName, "CAP", "*", "LS", ""))
+	}
+}
+
+// NextReader returns the next message for the chat
+func (c *ircConn) NextReader() (int, io.Reader, error) {
+	messageType, message, err := c.ReadMessage()
+	if err != nil {
+		return 0, nil, err
+	}
+	return messageType, bytes.NewReader(message), nil
+}
+
+// ReadMessage returns the next chat message or command the client's IRC
+// messages amount to, answering those that are the gateway's own. A QUIT
+// is returned as a *websocket.CloseError.
+func (c *ircConn) ReadMessage() (int, []byte, error) {
+	if line := c.pending; line != nil {
+		c.pending = nil
+		return websocket.TextMessage, line, nil
+	}
+	for {
+		raw, err := c.readLine()
+		if err != nil {
+			return 0, nil, err
+		}
+		text, err := c.handle(string(cleanLine(raw)))
+		if err != nil {
+			return 0, nil, err
+		}
+		if text != "" {
+			return websocket.TextMessage, []byte(text), nil
+		}
+	}
+}
+
+// handle answers an IRC message from the client, or returns the chat
+// message or command it amounts to
+func (c *ircConn) handle(line string) (string, error) {
+	command, params := parseIRC(line)
+	param := func(i int) string {
+		if i < len(params) {
+			return params[i]
+		}
+		return ""
+	}
+	room := c.currentRoom()
+	switch command {
+	case "":
+	case "PRIVMSG":
+		target, text := param(0), param(1)
+		if strings.HasPrefix(text, "\x01") {
+			// CTCP: only /me is passed on
+			action, ok := strings.CutPrefix(strings.Trim(text, "\x01"), "ACTION ")
+			if !ok {
+				return "", nil
+			}
+			text = "*" + action + "*"
+		}
+		if text == "" {
+			return "", nil
+		}
+		if !strings.HasPrefix(target, "#") {
+			return "/whisper " + target + " " + text, nil
+		}
+		if name, _ := normalizeRoom(target); name != room {
+			c.writeLines(c.numeric(ircCannotSendToChan, target, "Cannot send to channel: you are in #"+room))
+			return "", nil
+		}
+		return text, nil
+	case "NOTICE":
+		// Notices are never answered, so automatic replies can't loop
+	case "JOIN":
+		channel, _, _ := strings.Cut(param(0), ",")
+		if channel == "" || channel == "0" {
+			return "", nil
+		}
+		return "/join " + channel, nil
+	case "PART":
+		channel, _, _ := strings.Cut(param(0), ",")
+		name, _ := normalizeRoom(channel)
+		switch {
+		case name != room:
+		case room == DefaultRoom:
+			c.writeLines(c.notice(c.nick, "You can't leave #"+DefaultRoom+"; join another channel instead"))
+		default:
+			return "/join " + DefaultRoom, nil
+		}
+	case "NAMES":
+		name := room
+		if channel, _, _ := strings.Cut(param(0), ","); channel != "" {
+			name, _ = normalizeRoom(channel)
+		}
+		c.writeLines(c.names(name)...)
+	case "LIST":
+		var lines []string
+		for _, info := range c.server.GetRoomList() {
+			lines = append(lines, c.numeric(ircList, "#"+info.Name, strconv.Itoa(info.Members), ""))
+		}
+		c.writeLines(append(lines, c.numeric(ircListEnd, "End of /LIST"))...)
+	case "KICK":
+		return strings.TrimSpace("/kick " + param(1) + " " + param(2)), nil
+	case "MODE":
+		if strings.HasPrefix(param(0), "#") {
+			c.writeLines(c.numeric(ircChannelModeIs, param(0), "+"))
+		} else {
+			c.writeLines(c.numeric(ircUModeIs, "+"))
+		}
+	case "WHO":
+		c.writeLines(c.numeric(ircEndOfWho, param(0), "End of /WHO list"))
+	case "TOPIC":
+		c.writeLines(c.numeric(ircNoTopic, param(0), "No topic is set"))
+	case "PING":
+		c.writeLines(ircLine(ircServerName, "PONG", append([]string{ircServerName}, params...)...))
+	case "PONG":
+		c.mu.Lock()
+		onPong := c.onPong
+		c.mu.Unlock()
+		if onPong != nil {
+			return "", onPong("")
+		}
+	case "CAP":
+		c.capabilities(params)
+	case "PASS", "USER":
+		c.writeLines(c.numeric(ircAlreadyRegistred, "You may not reregister"))
+	case "NICK":
+		c.writeLines(c.notice(c.nick, "Nicknames can't be changed; reconnect with the new one"))
+	case "QUIT":
+		c.writeLines(ircLine("", "ERROR", "Closing link: Quit"))
+		return "", &websocket.CloseError{Code: websocket.CloseGoingAway, Text: param(0)}
+	default:
+		// Anything else is taken for a chat command, such as LOGIN
+		return strings.TrimSpace("/" + strings.ToLower(command) + " " + strings.Join(params, " ")), nil
+	}
+	return "", nil
+}
+
+// WriteMessage translates a message from the chat into IRC messages,
+// after the registration replies if the client was just admitted
+func (c *ircConn) WriteMessage(messageType int, data []byte) error {
+	if messageType != websocket.TextMessage {
+		return errors.New("IRC connections only carry text messages")
+	}
+	return c.writeLines(c.translate(string(data))...)
+}
+
+// translate turns a message from the chat into IRC messages: room
+// messages, whispers, joins and departures into what an IRC server would
+// send for them, and the rest into notices
+func (c *ircConn) translate(text string) []string {
+	if !c.welcomed {
+		if reason, ok := strings.CutPrefix(text, "ERROR: "); ok || c.nick == "" {
+			if ok {
+				return []string{ircLine("", "ERROR", reason)}
+			}
+			return c.notices("*", text)
+		}
+	}
+	var lines []string
+	if !c.welcomed {
+		c.welcomed = true
+		lines = c.welcome()
+	}
+	room := c.currentRoom()
+
+	if strings.HasPrefix(text, "--- Last ") {
+		// History is only replayed on joining a room, so the replay for a
+		// room being joined is held back until the join
+		if c.history != nil || len(lines) > 0 {
+			return append(lines, c.notices("#"+room, text)...)
+		}
+		c.history = strings.Split(text, "\n")
+		return lines
+	}
+	if notice, ok := strings.CutPrefix(text, "*** "); ok && strings.HasSuffix(notice, " ***") {
+		notice = strings.TrimSuffix(notice, " ***")
+		if name, what, ok := strings.Cut(notice, " "); ok && c.isUser(name) {
+			return append(lines, c.membership(name, what, room)...)
+		}
+	}
+	if from, message, ok := strings.Cut(text, "]: "); ok && strings.HasPrefix(from, "[PM ") {
+		if sender, ok := strings.CutPrefix(from, "[PM from "); ok {
+			return append(lines, ircLines(ircPrefix(sender), "PRIVMSG", c.nick, message)...)
+		}
+		// IRC clients show what they send themselves
+		return lines
+	}
+	if from, message, ok := strings.Cut(text, ": "); ok && !strings.Contains(from, " ") && c.isUser(from) {
+		if strings.EqualFold(from, c.nick) {
+			return lines
+		}
+		return append(lines, ircLines(ircPrefix(from), "PRIVMSG", "#"+room, message)...)
+	}
+	return append(lines, c.notices(c.nick, text)...)
+}
+
+// membership translates a user joining or leaving the chat or a room, as
+// in "alice joined #dev", into JOIN, PART and QUIT messages. The client's
+// own room changes are followed, so the last room's channel is parted and
+// the new one's joined.
+func (c *ircConn) membership(name, what, room string) []string {
+	switch {
+	case what == "joined the chat":
+		if strings.EqualFold(name, c.nick) {
+			return nil
+		}
+		return []string{ircLine(ircPrefix(name), "JOIN", "#"+room)}
+	case what == "left the chat":
+		return []string{ircLine(ircPrefix(name), "QUIT", "Left the chat")}
+	case strings.HasPrefix(what, "left #"):
+		return []string{ircLine(ircPrefix(name), "PART", strings.TrimPrefix(what, "left "))}
+	case strings.HasPrefix(what, "joined #"):
+		joined := strings.TrimPrefix(what, "joined #")
+		if !strings.EqualFold(name, c.nick) {
+			return []string{ircLine(ircPrefix(name), "JOIN", "#"+joined)}
+		}
+		var lines []string
+		if joined != room {
+			lines = append(lines, ircLine(ircPrefix(c.nick), "PART", "#"+room))
+		}
+		c.roomMu.Lock()
+		c.room = joined
+		c.roomMu.Unlock()
+		lines = append(lines, c.join(joined)...)
+		for _, line := range c.history {
+			lines = append(lines, c.notice("#"+joined, line))
+		}
+		c.history = nil
+		return lines
+	}
+	return c.notices(c.nick, "*** "+name+" "+what+" ***")
+}
+
+// welcome returns the registration replies, and the client's joining the
+// channel of its room
+func (c *ircConn) welcome() []string {
+	lines := []string{
+		c.numeric(ircWelcome, "Welcome to go-chat, "+c.nick),
+		c.numeric(ircYourHost, "Your host is "+ircServerName),
+		c.numeric(ircMyInfo, ircServerName, "go-chat", "o", "o"),
+		c.numeric(ircISupport, "CHANTYPES=#", "CHANNELLEN=32", "NICKLEN="+strconv.Itoa(maxUsernameLength), "CASEMAPPING=ascii", "are supported by this server"),
+		c.numeric(ircNoMOTD, "MOTD File is missing"),
+	}
+	return append(lines, c.join(c.currentRoom())...)
+}
+
+// join returns the client's JOIN of room, and who is in it
+func (c *ircConn) join(room string) []string {
+	return append([]string{ircLine(ircPrefix(c.nick), "JOIN", "#"+room)}, c.names(room)...)
+}
+
+// names returns NAMES replies for room, listing the users in it here and
+// on other instances, moderators and admins marked as channel operators
+func (c *ircConn) names(room string) []string {
+	names := map[string]string{}
+	if room == c.currentRoom() {
+		names[userKey(c.nick)] = c.nick
+	}
+	c.server.clients.each(func(client *Session) {
+		if client.Room != room {
+			return
+		}
+		name := client.Username
+		if client.Role == RoleModerator || client.Role == RoleAdmin {
+			name = "@" + name
+		}
+		names[userKey(client.Username)] = name
+	})
+	for _, user := range c.server.remote.users() {
+		if user.Room == room {
+			names[userKey(user.Username)] = user.Username
+		}
+	}
+	sorted := make([]string, 0, len(names))
+	for _, name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return strings.TrimPrefix(sorted[i], "@") < strings.TrimPrefix(sorted[j], "@")
+	})
+
+	var lines []string
+	for len(sorted) > 0 {
+		n, length := 0, 0
+		for n < len(sorted) && (n == 0 || length+len(sorted[n]) < ircNamesLength) {
+			length += len(sorted[n]) + 1
+			n++
+		}
+		lines = append(lines, c.numeric(ircNamReply, "=", "#"+room, strings.Join(sorted[:n], " ")))
+		sorted = sorted[n:]
+	}
+	return append(lines, c.numeric(ircEndOfNames, "#"+room, "End of /NAMES list"))
+}
+
+// isUser reports whether name is a user connected here or to another
+// instance, for telling users' messages from the server's
+func (c *ircConn) isUser(name string) bool {
+	if c.server.clientByName(name) != nil {
+		return true
+	}
+	_, ok := c.server.remote.lookup(name)
+	return ok
+}
+
+// currentRoom returns the room the client is in
+func (c *ircConn) currentRoom() string {
+	c.roomMu.Lock()
+	defer c.roomMu.Unlock()
+	return c.room
+}
+
+// numeric formats a numeric reply to the client
+func (c *ircConn) numeric(code string, params ...string) string {
+	target := c.nick
+	if target == "" {
+		target = "*"
+	}
+	return ircLine(ircServerName, code, append([]string{target}, params...)...)
+}
+
+// notice formats a notice from the server to target
+func (c *ircConn) notice(target, text string) string {
+	return ircLine(ircServerName, "NOTICE", target, text)
+}
+
+// notices formats each non-blank line of text as a notice to target
+func (c *ircConn) notices(target, text string) []string {
+	return ircLines(ircServerName, "NOTICE", target, text)
+}
+
+// writeLines writes IRC messages to the client
+func (c *ircConn) writeLines(lines ...string) error {
+	if len(lines) == 0 {
+		return nil
+	}
+	return c.lineConn.WriteMessage(websocket.TextMessage, []byte(strings.Join(lines, "\n")))
+}
+
+// WriteControl sends a PING for a ping, to be answered with a PONG, and for
+// a close an ERROR with its reason, if any, before closing the connection
+func (c *ircConn) WriteControl(messageType int, data []byte, deadline time.Time) error {
+	switch messageType {
+	case websocket.PingMessage:
+		return c.writeLines(ircLine("", "PING", ircServerName))
+	case websocket.CloseMessage:
+		reason := "Closing link"
+		if len(data) > 2 {
+			reason += ": " + string(data[2:])
+		}
+		c.conn.SetWriteDeadline(deadline)
+		err := c.writeLines(ircLine("", "ERROR", reason))
+		c.Close()
+		return err
+	}
+	return nil
+}
+
+// ircPrefix returns the prefix of messages from the user called name
+func ircPrefix(name string) string {
+	return name + "!" + name + "@" + ircServerName
+}
+
+// ircLine formats an IRC message, with prefix if it isn't empty. The last
+// parameter is sent as a trailing one unless it is the only one and
+// doesn't need to be, as clients expect of PRIVMSG and numeric replies.
+func ircLine(prefix, command string, params ...string) string {
+	var b strings.Builder
+	if prefix != "" {
+		b.WriteString(":" + prefix + " ")
+	}
+	b.WriteString(command)
+	for i, param := range params {
+		b.WriteByte(' ')
+		if i == len(params)-1 && (i > 0 || param == "" || strings.HasPrefix(param, ":") || strings.Contains(param, " ")) {
+			b.WriteByte(':')
+		}
+		b.WriteString(param)
+	}
+	return b.String()
+}
+
+// ircLines formats a message to target for each non-blank line of text
+func ircLines(prefix, command, target, text string) []string {
+	var lines []string
+	for _, line := range strings.Split(text, "\n") {
+		if line = strings.TrimRight(line, "\r"); strings.TrimSpace(line) != "" {
+			lines = append(lines, ircLine(prefix, command, target, line))
+		}
+	}
+	return lines
+}
+
+// parseIRC splits an IRC message into its command, in upper case, and its
+// parameters, ignoring any tags and prefix
+func parseIRC(line string) (string, []string) {
+	if strings.HasPrefix(line, "@") {
+		_, line, _ = strings.Cut(line, " ")
+	}
+	if strings.HasPrefix(line, ":") {
+		_, line, _ = strings.Cut(line, " ")
+	}
+	middle, trailing, hasTrailing := strings.Cut(line, " :")
+	fields := strings.Fields(middle)
+	if len(fields) == 0 {
+		return "", nil
+	}
+	params := fields[1:]
+	if hasTrailing {
+		params = append(params, trailing)
+	}
+	return strings.ToUpper(fields[0]), params
+}
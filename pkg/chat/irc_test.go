@@ -0,0 +1,128 @@
+// pkg/chat/irc_test.go
+package chat
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// TestIRC registers an IRC client with a server password alongside a
+// WebSocket client, exchanges channel messages and whispers, moves to
+// another channel and back, then kicks the IRC client, which is told why
+func TestIRC(t *testing.T) {
+	s, url := newTestServer(t, Config{HistorySize: 5, Auth: &TokenAuth{SharedSecret: "shared", UserTokens: map[string]string{"secret": "ircer"}}})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go s.ServeIRC(ln)
+
+	dial := func() (net.Conn, *bufio.Reader) {
+		t.Helper()
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		return conn, bufio.NewReader(conn)
+	}
+	unauthorized, reader := dial()
+	defer unauthorized.Close()
+	io.WriteString(unauthorized, "NICK nobody\r\nUSER nobody 0 * :Nobody\r\n")
+	if line, _ := reader.ReadString('\n'); line != ":go-chat 464 * :Password incorrect\r\n" {
+		t.Errorf("without a password got %q", line)
+	}
+
+	conn, reader := dial()
+	defer conn.Close()
+	io.WriteString(conn, "CAP LS 302\r\nPASS secret\r\nNICK anyone\r\nUSER anyone 0 * :Any One\r\nCAP END\r\n")
+	expect := func(want string) {
+		t.Helper()
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				t.Fatalf("waiting for %q: %v", want, err)
+			}
+			if strings.TrimSuffix(line, "\r\n") == want {
+				return
+			}
+		}
+	}
+	expect(":go-chat CAP * LS :")
+	expect(":go-chat 001 ircer :Welcome to go-chat, ircer")
+	expect(":ircer!ircer@go-chat JOIN #lobby")
+	expect(":go-chat 353 ircer = #lobby :ircer")
+	expect(":go-chat 366 ircer #lobby :End of /NAMES list")
+
+	ws, err := connect(url+"?token=shared", "socket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	expect(":socket!socket@go-chat JOIN #lobby")
+	readWS := func(want string) {
+		t.Helper()
+		ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+		for {
+			_, message, err := ws.ReadMessage()
+			if err != nil {
+				t.Fatalf("waiting for %q: %v", want, err)
+			}
+			if string(message) == want {
+				return
+			}
+		}
+	}
+	ws.WriteMessage(websocket.TextMessage, []byte("hello irc"))
+	expect(":socket!socket@go-chat PRIVMSG #lobby :hello irc")
+	io.WriteString(conn, "PRIVMSG #lobby :hello socket\r\n")
+	readWS("ircer: hello socket")
+	io.WriteString(conn, "PRIVMSG #lobby :\x01ACTION waves\x01\r\n")
+	readWS("ircer: *waves*")
+
+	io.WriteString(conn, "PRIVMSG socket :psst\r\n")
+	readWS("[PM from ircer]: psst")
+	ws.WriteMessage(websocket.TextMessage, []byte("/whisper ircer hi"))
+	expect(":socket!socket@go-chat PRIVMSG ircer :hi")
+
+	io.WriteString(conn, "NAMES #lobby\r\nPING :check\r\n")
+	expect(":go-chat 353 ircer = #lobby :ircer socket")
+	expect(":go-chat PONG go-chat :check")
+
+	io.WriteString(conn, "JOIN #dev\r\n")
+	expect(":ircer!ircer@go-chat PART #lobby")
+	expect(":ircer!ircer@go-chat JOIN #dev")
+	expect(":go-chat 353 ircer = #dev :ircer")
+	io.WriteString(conn, "PRIVMSG #lobby :still here?\r\n")
+	expect(":go-chat 404 ircer #lobby :Cannot send to channel: you are in #dev")
+
+	// Parting goes back to the lobby, whose history follows the join
+	io.WriteString(conn, "PART #dev\r\n")
+	expect(":ircer!ircer@go-chat PART #dev")
+	expect(":ircer!ircer@go-chat JOIN #lobby")
+	expect(":go-chat 366 ircer #lobby :End of /NAMES list")
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(line, ":go-chat NOTICE #lobby :") {
+			t.Fatalf("got %q instead of history", line)
+		}
+		if strings.HasSuffix(line, "] socket: hello irc\r\n") {
+			break
+		}
+	}
+
+	if !s.KickUser("ircer", "testing", "admin") {
+		t.Fatal("ircer not connected")
+	}
+	expect("ERROR :Closing link: You were kicked by admin: testing")
+}
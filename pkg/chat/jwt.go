@@ -0,0 +1,419 @@
+// pkg/chat/jwt.go
+package chat
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// JWTConfig describes how to validate JSON Web Tokens
+type JWTConfig struct {
+	// Secret validates HS256/HS384/HS512 tokens; empty disables HMAC
+	Secret []byte
+
+	// JWKSURL is fetched for RS*/ES* public keys; empty disables them
+	JWKSURL string
+
+	// Issuer and Audience, if set, must match the iss and aud claims
+	Issuer   string
+	Audience string
+
+	// UsernameClaim names the claim holding the username
+	// (default "preferred_username", falling back to "sub")
+	UsernameClaim string
+
+	// RolesClaim names the claim holding a role or list of roles (default "roles")
+	RolesClaim string
+
+	// RequireExp refuses tokens without an exp claim, which would otherwise
+	// be accepted forever (default true)
+	RequireExp *bool
+}
+
+// jwtLeeway tolerates small clock differences when checking exp and nbf
+const jwtLeeway = 30 * time.Second
+
+// esCurveBits is the size of the curve each ES algorithm signs with
+var esCurveBits = map[string]int{"ES256": 256, "ES384": 384, "ES512": 521}
+
+// jwksRefreshInterval limits how often the JWKS URL is fetched
+const jwksRefreshInterval = time.Minute
+
+// JWTAuth authenticates connections carrying a signed JWT, taking the
+// username and role from the token's claims
+type JWTAuth struct {
+	config     JWTConfig
+	requireExp bool
+	client     *http.Client
+
+	mu        sync.Mutex
+	keys      map[string]crypto.PublicKey
+	fetchedAt time.Time
+}
+
+// NewJWTAuth creates a JWT authenticator. At least one of Secret or JWKSURL
+// must be set.
+func NewJWTAuth(cfg JWTConfig) (*JWTAuth, error) {
+	if len(cfg.Secret) == 0 && cfg.JWKSURL == "" {
+		return nil, fmt.Errorf("JWT auth requires a secret or a JWKS URL")
+	}
+	if cfg.UsernameClaim == "" {
+		cfg.UsernameClaim = "preferred_username"
+	}
+	if cfg.RolesClaim == "" {
+		cfg.RolesClaim = "roles"
+	}
+
+	a := &JWTAuth{
+		config:     cfg,
+		requireExp: cfg.RequireExp == nil || *cfg.RequireExp,
+		client:     &http.Client{Timeout: 10 * time.Second},
+		keys:       make(map[string]crypto.PublicKey),
+	}
+	if cfg.JWKSURL != "" {
+		if err := a.refreshKeys(); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+// Authenticate validates the bearer token on the request
+func (a *JWTAuth) Authenticate(r *http.Request) (Identity, error) {
+	token := requestToken(r)
+	if token == "" {
+		return Identity{}, fmt.Errorf("%w: missing token", ErrUnauthorized)
+	}
+	return a.Verify(token)
+}
+
+// Verify checks a token's signature and claims and returns the identity it
+// carries
+func (a *JWTAuth) Verify(token string) (Identity, error) {
+	claims, err := a.verifyToken(token)
+	if err != nil {
+		return Identity{}, fmt.Errorf("%w: %v", ErrUnauthorized, err)
+	}
+	return a.identityFromClaims(claims)
+}
+
+// identityFromClaims extracts the username and role from verified claims
+func (a *JWTAuth) identityFromClaims(claims map[string]interface{}) (Identity, error) {
+	username, _ := claims[a.config.UsernameClaim].(string)
+	if username == "" {
+		username, _ = claims["sub"].(string)
+	}
+	if username == "" {
+		return Identity{}, fmt.Errorf("%w: token has no username claim", ErrUnauthorized)
+	}
+	// Identity providers allow names that aren't safe to show in the chat
+	identity, err := validateIdentity(Identity{Username: username, Role: roleFromClaim(claims[a.config.RolesClaim])})
+	if err != nil {
+		return Identity{}, fmt.Errorf("%w: token username: %v", ErrUnauthorized, err)
+	}
+	return identity, nil
+}
+
+// verifyToken checks the signature and the standard time, issuer and
+// audience claims, returning all claims on success
+func (a *JWTAuth) verifyToken(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("bad header: %v", err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("bad signature encoding")
+	}
+	if err := a.verifySignature(header.Alg, header.Kid, parts[0]+"."+parts[1], sig); err != nil {
+		return nil, err
+	}
+
+	var claims map[string]interface{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("bad claims: %v", err)
+	}
+
+	now := time.Now()
+	exp, ok := claims["exp"].(float64)
+	if !ok && a.requireExp {
+		return nil, fmt.Errorf("token has no expiry")
+	}
+	if ok && now.After(time.Unix(int64(exp), 0).Add(jwtLeeway)) {
+		return nil, fmt.Errorf("token expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(jwtLeeway).Before(time.Unix(int64(nbf), 0)) {
+		return nil, fmt.Errorf("token not valid yet")
+	}
+	if a.config.Issuer != "" && claims["iss"] != a.config.Issuer {
+		return nil, fmt.Errorf("unexpected issuer")
+	}
+	if a.config.Audience != "" && !audienceMatches(claims["aud"], a.config.Audience) {
+		return nil, fmt.Errorf("unexpected audience")
+	}
+	return claims, nil
+}
+
+// verifySignature checks sig over signed using the algorithm in the header
+func (a *JWTAuth) verifySignature(alg, kid, signed string, sig []byte) error {
+	if len(alg) != 5 {
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+
+	var newHash func() hash.Hash
+	var cryptoHash crypto.Hash
+	switch alg[2:] {
+	case "256":
+		newHash, cryptoHash = sha256.New, crypto.SHA256
+	case "384":
+		newHash, cryptoHash = sha512.New384, crypto.SHA384
+	case "512":
+		newHash, cryptoHash = sha512.New, crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+
+	switch alg[:2] {
+	case "HS":
+		if len(a.config.Secret) == 0 {
+			return fmt.Errorf("HMAC tokens are not accepted")
+		}
+		mac := hmac.New(newHash, a.config.Secret)
+		mac.Write([]byte(signed))
+		if !hmac.Equal(mac.Sum(nil), sig) {
+			return fmt.Errorf("invalid signature")
+		}
+		return nil
+
+	case "RS", "ES":
+		key, err := a.publicKey(kid)
+		if err != nil {
+			return err
+		}
+		h := newHash()
+		h.Write([]byte(signed))
+		digest := h.Sum(nil)
+
+		switch pub := key.(type) {
+		case *rsa.PublicKey:
+			if alg[:2] != "RS" || rsa.VerifyPKCS1v15(pub, cryptoHash, digest, sig) != nil {
+				return fmt.Errorf("invalid signature")
+			}
+		case *ecdsa.PublicKey:
+			// Each ES algorithm is defined for one curve
+			bits := pub.Curve.Params().BitSize
+			size := (bits + 7) / 8
+			if alg[:2] != "ES" || esCurveBits[alg] != bits || len(sig) != 2*size {
+				return fmt.Errorf("invalid signature")
+			}
+			r := new(big.Int).SetBytes(sig[:size])
+			s := new(big.Int).SetBytes(sig[size:])
+			if !ecdsa.Verify(pub, digest, r, s) {
+				return fmt.Errorf("invalid signature")
+			}
+		default:
+			return fmt.Errorf("unsupported key type")
+		}
+		return nil
+	}
+
+	return fmt.Errorf("unsupported algorithm %q", alg)
+}
+
+// publicKey returns the JWKS key with the given ID, refetching the key set
+// if the ID is unknown (keys may have been rotated)
+func (a *JWTAuth) publicKey(kid string) (crypto.PublicKey, error) {
+	if a.config.JWKSURL == "" {
+		return nil, fmt.Errorf("public key tokens are not accepted")
+	}
+
+	a.mu.Lock()
+	key, ok := a.keys[kid]
+	stale := time.Since(a.fetchedAt) > jwksRefreshInterval
+	if !ok && stale {
+		// Record the attempt up front so a failing JWKS endpoint isn't
+		// hammered by every incoming connection
+		a.fetchedAt = time.Now()
+	}
+	a.mu.Unlock()
+	if ok {
+		return key, nil
+	}
+	if !stale {
+		return nil, fmt.Errorf("unknown key %q", kid)
+	}
+
+	if err := a.refreshKeys(); err != nil {
+		return nil, err
+	}
+	a.mu.Lock()
+	key, ok = a.keys[kid]
+	a.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown key %q", kid)
+	}
+	return key, nil
+}
+
+// jwk is a single JSON Web Key; only the fields needed for RSA and EC
+// public keys are decoded
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// refreshKeys fetches the key set from the JWKS URL
+func (a *JWTAuth) refreshKeys() error {
+	resp, err := a.client.Get(a.config.JWKSURL)
+	if err != nil {
+		return fmt.Errorf("fetch JWKS: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("fetch JWKS: %s", resp.Status)
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return fmt.Errorf("decode JWKS: %w", err)
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			continue // Skip key types we don't understand
+		}
+		keys[k.Kid] = key
+	}
+
+	a.mu.Lock()
+	a.keys = keys
+	a.fetchedAt = time.Now()
+	a.mu.Unlock()
+	return nil
+}
+
+// publicKey converts the JWK into an RSA or ECDSA public key
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+// decodeSegment decodes a base64url JSON segment of a token into v
+func decodeSegment(seg string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// audienceMatches reports whether the aud claim (a string or a list of
+// strings) contains want
+func audienceMatches(aud interface{}, want string) bool {
+	switch v := aud.(type) {
+	case string:
+		return v == want
+	case []interface{}:
+		for _, a := range v {
+			if a == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// roleFromClaim picks the most privileged known role from a claim holding
+// either a single role or a list of roles
+func roleFromClaim(claim interface{}) Role {
+	var names []string
+	switch v := claim.(type) {
+	case string:
+		names = []string{v}
+	case []interface{}:
+		for _, n := range v {
+			if s, ok := n.(string); ok {
+				names = append(names, s)
+			}
+		}
+	}
+
+	role := RoleUser
+	for _, name := range names {
+		switch Role(strings.ToLower(name)) {
+		case RoleAdmin:
+			return RoleAdmin
+		case RoleModerator:
+			role = RoleModerator
+		}
+	}
+	return role
+}
@@ -0,0 +1,247 @@
+// pkg/chat/jwt_test.go
+package chat
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// signJWT builds a token with the given header and claims, signed with key:
+// a []byte HMAC secret, an RSA or ECDSA private key, or nil for no signature
+func signJWT(t *testing.T, header, claims map[string]interface{}, key interface{}) string {
+	t.Helper()
+	segment := func(v interface{}) string {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	signed := segment(header) + "." + segment(claims)
+
+	alg, _ := header["alg"].(string)
+	var sig []byte
+	switch k := key.(type) {
+	case []byte:
+		newHash := sha256.New
+		if alg == "HS384" {
+			newHash = sha512.New384
+		}
+		mac := hmac.New(newHash, k)
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		digest := sha256.Sum256([]byte(signed))
+		var err error
+		if sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:]); err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		var digest []byte
+		switch alg {
+		case "ES384":
+			sum := sha512.Sum384([]byte(signed))
+			digest = sum[:]
+		default:
+			sum := sha256.Sum256([]byte(signed))
+			digest = sum[:]
+		}
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		size := (k.Curve.Params().BitSize + 7) / 8
+		sig = make([]byte, 2*size)
+		r.FillBytes(sig[:size])
+		s.FillBytes(sig[size:])
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// jwksServer serves a key set that tests can replace, to rotate keys
+type jwksServer struct {
+	*httptest.Server
+	mu   sync.Mutex
+	keys []map[string]string
+}
+
+func newJWKSServer(t *testing.T) *jwksServer {
+	js := &jwksServer{}
+	js.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		js.mu.Lock()
+		defer js.mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": js.keys})
+	}))
+	t.Cleanup(js.Close)
+	return js
+}
+
+// set replaces the key set with the public halves of keys, by key ID
+func (js *jwksServer) set(keys map[string]crypto.Signer) {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	js.keys = nil
+	for kid, key := range keys {
+		b64 := func(n *big.Int) string { return base64.RawURLEncoding.EncodeToString(n.Bytes()) }
+		switch pub := key.Public().(type) {
+		case *rsa.PublicKey:
+			js.keys = append(js.keys, map[string]string{
+				"kty": "RSA", "kid": kid, "n": b64(pub.N), "e": b64(big.NewInt(int64(pub.E))),
+			})
+		case *ecdsa.PublicKey:
+			js.keys = append(js.keys, map[string]string{
+				"kty": "EC", "kid": kid, "crv": pub.Curve.Params().Name, "x": b64(pub.X), "y": b64(pub.Y),
+			})
+		}
+	}
+}
+
+// TestJWTVerify checks that tokens are only accepted with a valid
+// signature, by an algorithm the key was made for, with current claims
+// from the expected issuer for the expected audience
+func TestJWTVerify(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p256, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	p384, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	jwks := newJWKSServer(t)
+	jwks.set(map[string]crypto.Signer{"rs": rsaKey, "p256": p256, "p384": p384})
+
+	secret := []byte("s3cret")
+	a, err := NewJWTAuth(JWTConfig{Secret: secret, JWKSURL: jwks.URL, Issuer: "https://idp.example.com", Audience: "go-chat"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	noExp := false
+	lenient, err := NewJWTAuth(JWTConfig{Secret: secret, RequireExp: &noExp})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().Unix()
+	claims := func(changes map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{
+			"sub": "alice", "iss": "https://idp.example.com", "aud": "go-chat", "exp": now + 60,
+		}
+		for k, v := range changes {
+			if v == nil {
+				delete(c, k)
+			} else {
+				c[k] = v
+			}
+		}
+		return c
+	}
+	hs256 := map[string]interface{}{"alg": "HS256", "typ": "JWT"}
+	// The RSA public key, as an attacker would use it for an HMAC secret
+	rsaPublic := rsaKey.PublicKey.N.Bytes()
+
+	tests := []struct {
+		name  string
+		auth  *JWTAuth
+		token string
+		want  string // The username, or "" if the token must be refused
+	}{
+		{"HS256", a, signJWT(t, hs256, claims(nil), secret), "alice"},
+		{"HS384", a, signJWT(t, map[string]interface{}{"alg": "HS384"}, claims(nil), secret), "alice"},
+		{"RS256", a, signJWT(t, map[string]interface{}{"alg": "RS256", "kid": "rs"}, claims(nil), rsaKey), "alice"},
+		{"ES256", a, signJWT(t, map[string]interface{}{"alg": "ES256", "kid": "p256"}, claims(nil), p256), "alice"},
+		{"ES384", a, signJWT(t, map[string]interface{}{"alg": "ES384", "kid": "p384"}, claims(nil), p384), "alice"},
+		{"username claim", a, signJWT(t, hs256, claims(map[string]interface{}{"preferred_username": "Bob"}), secret), "Bob"},
+
+		{"alg none", a, signJWT(t, map[string]interface{}{"alg": "none"}, claims(nil), nil), ""},
+		{"alg None", a, signJWT(t, map[string]interface{}{"alg": "None"}, claims(nil), nil), ""},
+		{"no alg", a, signJWT(t, map[string]interface{}{}, claims(nil), secret), ""},
+		{"wrong secret", a, signJWT(t, hs256, claims(nil), []byte("guess")), ""},
+		{"HS256 with the RSA public key", a, signJWT(t, map[string]interface{}{"alg": "HS256", "kid": "rs"}, claims(nil), rsaPublic), ""},
+		{"RS256 header on an ES key", a, signJWT(t, map[string]interface{}{"alg": "RS256", "kid": "p256"}, claims(nil), p256), ""},
+		{"ES256 header on an RSA key", a, signJWT(t, map[string]interface{}{"alg": "ES256", "kid": "rs"}, claims(nil), rsaKey), ""},
+		{"ES256 header on a P-384 key", a, signJWT(t, map[string]interface{}{"alg": "ES256", "kid": "p384"}, claims(nil), p384), ""},
+		{"ES384 header on a P-256 key", a, signJWT(t, map[string]interface{}{"alg": "ES384", "kid": "p256"}, claims(nil), p256), ""},
+		{"unknown kid", a, signJWT(t, map[string]interface{}{"alg": "RS256", "kid": "other"}, claims(nil), rsaKey), ""},
+		{"tampered claims", a, strings.Replace(signJWT(t, hs256, claims(nil), secret), ".", ".e30", 1), ""},
+
+		{"no exp", a, signJWT(t, hs256, claims(map[string]interface{}{"exp": nil}), secret), ""},
+		{"no exp allowed", lenient, signJWT(t, hs256, claims(map[string]interface{}{"exp": nil}), secret), "alice"},
+		{"expired", a, signJWT(t, hs256, claims(map[string]interface{}{"exp": now - 120}), secret), ""},
+		{"expired within leeway", a, signJWT(t, hs256, claims(map[string]interface{}{"exp": now - 5}), secret), "alice"},
+		{"not valid yet", a, signJWT(t, hs256, claims(map[string]interface{}{"nbf": now + 120}), secret), ""},
+		{"valid now", a, signJWT(t, hs256, claims(map[string]interface{}{"nbf": now}), secret), "alice"},
+		{"wrong issuer", a, signJWT(t, hs256, claims(map[string]interface{}{"iss": "https://evil.example.com"}), secret), ""},
+		{"no issuer", a, signJWT(t, hs256, claims(map[string]interface{}{"iss": nil}), secret), ""},
+		{"wrong audience", a, signJWT(t, hs256, claims(map[string]interface{}{"aud": "other"}), secret), ""},
+		{"audience list", a, signJWT(t, hs256, claims(map[string]interface{}{"aud": []string{"other", "go-chat"}}), secret), "alice"},
+		{"no audience", a, signJWT(t, hs256, claims(map[string]interface{}{"aud": nil}), secret), ""},
+
+		{"no username", a, signJWT(t, hs256, claims(map[string]interface{}{"sub": nil}), secret), ""},
+		{"invalid username", a, signJWT(t, hs256, claims(map[string]interface{}{"sub": "alice <b>"}), secret), ""},
+		{"mixed script username", a, signJWT(t, hs256, claims(map[string]interface{}{"sub": "pаypal"}), secret), ""},
+		{"guest username", a, signJWT(t, hs256, claims(map[string]interface{}{"sub": "Guest-1234"}), secret), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			identity, err := tt.auth.Verify(tt.token)
+			switch {
+			case tt.want == "" && err == nil:
+				t.Errorf("accepted as %q", identity.Username)
+			case tt.want != "" && err != nil:
+				t.Errorf("refused: %v", err)
+			case tt.want != "" && identity.Username != tt.want:
+				t.Errorf("got username %q, want %q", identity.Username, tt.want)
+			}
+		})
+	}
+}
+
+// TestJWTKeyRotation rotates the JWKS signing key and checks that tokens
+// signed with the new key are accepted once the key set is refetched, and
+// those signed with the retired one no longer are
+func TestJWTKeyRotation(t *testing.T) {
+	oldKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	newKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	jwks := newJWKSServer(t)
+	jwks.set(map[string]crypto.Signer{"old": oldKey})
+	a, err := NewJWTAuth(JWTConfig{JWKSURL: jwks.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims := map[string]interface{}{"sub": "alice", "exp": time.Now().Unix() + 60}
+	oldToken := signJWT(t, map[string]interface{}{"alg": "ES256", "kid": "old"}, claims, oldKey)
+	newToken := signJWT(t, map[string]interface{}{"alg": "ES256", "kid": "new"}, claims, newKey)
+
+	if _, err := a.Verify(oldToken); err != nil {
+		t.Fatalf("old key refused before rotation: %v", err)
+	}
+	jwks.set(map[string]crypto.Signer{"new": newKey})
+	// The key set was just fetched, so it isn't fetched again yet
+	if _, err := a.Verify(newToken); err == nil {
+		t.Fatal("new key accepted without refetching the key set")
+	}
+
+	a.mu.Lock()
+	a.fetchedAt = time.Now().Add(-2 * jwksRefreshInterval)
+	a.mu.Unlock()
+	if _, err := a.Verify(newToken); err != nil {
+		t.Fatalf("new key refused after rotation: %v", err)
+	}
+	if _, err := a.Verify(oldToken); err == nil {
+		t.Error("retired key still accepted")
+	}
+}
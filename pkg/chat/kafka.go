@@ -0,0 +1,181 @@
+// pkg/chat/kafka.go
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// kafkaQueueSize is how many events may wait to be handed to the producer;
+// more are dropped
+const kafkaQueueSize = 10000
+
+// DefaultKafkaTopic is the topic events are exported to unless configured
+// otherwise
+const DefaultKafkaTopic = "go-chat-events"
+
+// KafkaConfig describes a Kafka topic to export events to
+type KafkaConfig struct {
+	// Brokers are the host:port addresses used to discover the cluster
+	Brokers []string
+
+	// Topic must already exist; empty means DefaultKafkaTopic
+	Topic string
+
+	// Events are sent in batches of up to BatchSize events or BatchBytes
+	// bytes, or whatever has accumulated after BatchTimeout. Zero values
+	// mean 100 events, 1 MB and 1s.
+	BatchSize    int
+	BatchBytes   int64
+	BatchTimeout time.Duration
+}
+
+// KafkaExporter is an EventExporter that produces each event as a JSON
+// record keyed by room, so a room's events stay in order on one partition.
+// Records are sent in the background and acknowledged by all in-sync
+// replicas; failed batches are logged and dropped.
+type KafkaExporter struct {
+	Config KafkaConfig
+
+	writer  *kafka.Writer
+	queue   chan ExportEvent
+	done    chan struct{}
+	dropped atomic.Int64
+	mu      sync.Mutex
+	closed  bool
+}
+
+// NewKafkaExporter checks that cfg.Topic exists on the cluster and starts
+// exporting to it
+func NewKafkaExporter(cfg KafkaConfig) (*KafkaExporter, error) {
+	if len(cfg.Brokers) == 0 {
+		return nil, fmt.Errorf("kafka export requires at least one broker")
+	}
+	if cfg.Topic == "" {
+		cfg.Topic = DefaultKafkaTopic
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = 100
+	}
+	if cfg.BatchBytes <= 0 {
+		cfg.BatchBytes = 1 << 20
+	}
+	if cfg.BatchTimeout <= 0 {
+		cfg.BatchTimeout = time.Second
+	}
+
+	// Fail now, rather than on the first event, if the cluster is
+	// unreachable or the topic is missing
+	addr := kafka.TCP(cfg.Brokers...)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	metadata, err := (&kafka.Client{Addr: addr}).Metadata(ctx, &kafka.MetadataRequest{Topics: []string{cfg.Topic}})
+	if err != nil {
+		return nil, fmt.Errorf("connect to Kafka: %w", err)
+	}
+	if len(metadata.Topics) != 1 || metadata.Topics[0].Error != nil {
+		err := fmt.Errorf("not found")
+		if len(metadata.Topics) == 1 {
+			err = metadata.Topics[0].Error
+		}
+		return nil, fmt.Errorf("kafka topic %q: %w", cfg.Topic, err)
+	}
+
+	e := &KafkaExporter{
+		Config: cfg,
+		queue:  make(chan ExportEvent, kafkaQueueSize),
+		done:   make(chan struct{}),
+	}
+	e.writer = &kafka.Writer{
+		Addr:         addr,
+		Topic:        cfg.Topic,
+		Balancer:     &kafka.Hash{},
+		BatchSize:    cfg.BatchSize,
+		BatchBytes:   cfg.BatchBytes,
+		BatchTimeout: cfg.BatchTimeout,
+		RequiredAcks: kafka.RequireAll,
+		Async:        true,
+		Completion: func(messages []kafka.Message, err error) {
+			if err != nil {
+				slog.Warn("Error exporting events to Kafka", "events", len(messages), "err", err)
+			}
+		},
+	}
+	go e.run()
+	return e, nil
+}
+
+// Export queues event to be produced, dropping it if the queue is full
+func (e *KafkaExporter) Export(event ExportEvent) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.closed {
+		return
+	}
+	select {
+	case e.queue <- event:
+	default:
+		e.dropped.Add(1)
+	}
+}
+
+// run hands queued events to the producer until Close, logging how many
+// were dropped at most every few seconds
+func (e *KafkaExporter) run() {
+	defer close(e.done)
+	var lastWarning time.Time
+	for event := range e.queue {
+		value, err := json.Marshal(event)
+		if err != nil {
+			slog.Error("Error encoding exported event", "type", event.Type, "err", err)
+			continue
+		}
+		// Events outside rooms have no key and are spread over the partitions
+		var key []byte
+		if event.Room != "" {
+			key = []byte(event.Room)
+		}
+		// An async writer only fails here once it has been closed
+		if err := e.writer.WriteMessages(context.Background(), kafka.Message{Key: key, Value: value, Time: event.Time}); err != nil {
+			slog.Warn("Error exporting event to Kafka", "type", event.Type, "err", err)
+		}
+		if time.Since(lastWarning) > 10*time.Second {
+			if n := e.dropped.Swap(0); n > 0 {
+				slog.Warn("Dropped events, Kafka export queue full", "events", n)
+				lastWarning = time.Now()
+			}
+		}
+	}
+}
+
+// Close produces the events still queued and waits up to timeout for them
+// to be acknowledged
+func (e *KafkaExporter) Close(timeout time.Duration) {
+	e.mu.Lock()
+	if !e.closed {
+		e.closed = true
+		close(e.queue)
+	}
+	e.mu.Unlock()
+
+	flushed := make(chan struct{})
+	go func() {
+		<-e.done
+		if err := e.writer.Close(); err != nil {
+			slog.Warn("Error closing Kafka exporter", "err", err)
+		}
+		close(flushed)
+	}()
+	select {
+	case <-flushed:
+	case <-time.After(timeout):
+		slog.Warn("Timed out exporting the last events to Kafka")
+	}
+}
@@ -0,0 +1,117 @@
+// pkg/chat/kick.go
+package chat
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Closing connections
+const (
+	// maxCloseReason keeps a close reason within a control frame's 125 bytes
+	maxCloseReason = 120
+
+	// cleanupTimeout is how long closeClient waits for ReadPump to
+	// unregister the client
+	cleanupTimeout = 5 * time.Second
+)
+
+// closeClient ends a client's connection with a close frame explaining why,
+// after the messages already sent to it, and waits until ReadPump has
+// unregistered it, so the client is gone from the user list when this
+// returns. It may be called from any goroutine, but not from inside
+// registry.each or from the client's own ReadPump.
+func (s *Server) closeClient(client *Session, code int, reason string) {
+	if len(reason) > maxCloseReason {
+		reason = strings.ToValidUTF8(reason[:maxCloseReason], "")
+	}
+	if !client.closeWith(code, reason, true) {
+		// Already closing, perhaps gracefully; don't wait for that
+		client.conn.Close()
+	}
+
+	select {
+	case <-client.done:
+	case <-time.After(cleanupTimeout):
+		s.log.Warn("Timed out waiting for client to disconnect", "username", client.Username, "remote_addr", client.IP)
+	}
+}
+
+// Disconnect closes a connected user's connection, sending reason in the
+// close frame, without the public notice of a kick. It reports whether the
+// user was connected.
+func (s *Server) Disconnect(username, reason string) bool {
+	client := s.clientByName(username)
+	if client == nil {
+		return false
+	}
+
+	s.log.Info("Disconnecting client", "username", client.Username, "remote_addr", client.IP, "reason", reason)
+	s.audit(AuditAdmin, "", client.Username, client.IP, "disconnect: "+reason)
+	s.closeClient(client, websocket.CloseNormalClosure, reason)
+	return true
+}
+
+// handleKick implements /kick <user> [reason]
+func (c *Session) handleKick(args string) {
+	if !c.can(permModerate) {
+		c.send("Only moderators can kick users.")
+		return
+	}
+
+	target, reason, _ := strings.Cut(strings.TrimSpace(args), " ")
+	reason = strings.TrimSpace(reason)
+	if target == "" {
+		c.send("Usage: /kick <username> [reason]")
+		return
+	}
+	if sameUsername(target, c.Username) {
+		c.send("You cannot kick yourself.")
+		return
+	}
+
+	targetClient := c.Server.clientByName(target)
+	if targetClient == nil {
+		c.send(fmt.Sprintf("User '%s' not found", target))
+		return
+	}
+	if !c.outranks(targetClient) {
+		c.send(fmt.Sprintf("You cannot kick %s.", targetClient.Username))
+		return
+	}
+
+	c.Server.kick(targetClient, reason, c.Username)
+}
+
+// KickUser disconnects a connected user with a notice explaining why and
+// tells everyone else. It reports whether the user was connected.
+func (s *Server) KickUser(username, reason, by string) bool {
+	client := s.clientByName(username)
+	if client == nil {
+		return false
+	}
+	s.kick(client, reason, by)
+	return true
+}
+
+// kick disconnects client on behalf of by
+func (s *Server) kick(client *Session, reason, by string) {
+	notice := fmt.Sprintf("You were kicked by %s", by)
+	if reason != "" {
+		notice += ": " + reason
+	}
+	s.log.Info("Kicked", "username", client.Username, "remote_addr", client.IP, "by", by, "reason", reason)
+	s.audit(AuditKick, by, client.Username, client.IP, reason)
+
+	client.send("*** " + notice + " ***")
+	s.closeClient(client, websocket.ClosePolicyViolation, notice)
+
+	event := fmt.Sprintf("*** %s was kicked by %s", client.Username, by)
+	if reason != "" {
+		event += " (" + reason + ")"
+	}
+	s.broadcastMessage(event + " ***")
+}
@@ -0,0 +1,56 @@
+// pkg/chat/ldap_test.go
+package chat
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+)
+
+// TestLDAPServerName checks that the directory's certificate is checked
+// against its host name whatever form the URL takes
+func TestLDAPServerName(t *testing.T) {
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{"ldaps://ldap.example.com", "ldap.example.com"},
+		{"ldaps://ldap.example.com:636", "ldap.example.com"},
+		{"ldap://dc1.corp.example.com:389", "dc1.corp.example.com"},
+		{"ldap://dc1.corp.example.com", "dc1.corp.example.com"},
+		{"LDAP://dc1.corp.example.com/", "dc1.corp.example.com"},
+		{"ldaps://[2001:db8::1]:636", "2001:db8::1"},
+	}
+	for _, tt := range tests {
+		a, err := NewLDAPAuth(LDAPConfig{URL: tt.url, UserDNTemplate: "uid=%s,dc=example,dc=com"})
+		if err != nil {
+			t.Errorf("%s: %v", tt.url, err)
+			continue
+		}
+		if got := a.tlsConfig().ServerName; got != tt.want {
+			t.Errorf("%s: server name %q, want %q", tt.url, got, tt.want)
+		}
+	}
+
+	for _, url := range []string{"dc1.corp.example.com:389", "http://ldap.example.com", "ldap://%zz"} {
+		if _, err := NewLDAPAuth(LDAPConfig{URL: url, UserDNTemplate: "uid=%s"}); err == nil {
+			t.Errorf("%s: accepted", url)
+		}
+	}
+}
+
+// TestLDAPUsername checks that names the chat refuses are turned away
+// without asking the directory, which isn't running here
+func TestLDAPUsername(t *testing.T) {
+	a, err := NewLDAPAuth(LDAPConfig{URL: "ldap://127.0.0.1:1", UserDNTemplate: "uid=%s,dc=example,dc=com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, username := range []string{"guest-0001", "alice bob", "x"} {
+		r, _ := http.NewRequest(http.MethodGet, "/ws", nil)
+		r.SetBasicAuth(username, "wonderland")
+		if _, err := a.Authenticate(r); !errors.Is(err, ErrUnauthorized) {
+			t.Errorf("%q: got %v", username, err)
+		}
+	}
+}
@@ -0,0 +1,299 @@
+// pkg/chat/lines.go
+package chat
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// lineLoginTimeout is how long a line client has to send its first line
+// (and finish its TLS handshake) before it is admitted
+const lineLoginTimeout = 30 * time.Second
+
+// errLineTooLong is returned for lines longer than maxPostedMessage
+var errLineTooLong = errors.New("line too long")
+
+// Telnet commands, which are stripped from what clients send
+const (
+	telnetSE   = 240
+	telnetSB   = 250
+	telnetWILL = 251
+	telnetDONT = 254
+	telnetIAC  = 255
+)
+
+// ServeLines accepts connections on ln until it is closed, each joining
+// the chat with a plain line protocol, for nc, telnet and scripts: every
+// line sent is a message, and every message received ends in CRLF. The
+// first line is the username, unless it is "PASS <token>", which passes
+// the token as a bearer token and is followed by the username. Line clients
+// are otherwise admitted like WebSocket connections, with the same limits,
+// bans and Config.Auth.
+func (s *Server) ServeLines(ln net.Listener) error {
+	return s.acceptLoop(ln, "line", s.serveLines)
+}
+
+// acceptLoop accepts connections on ln until it is closed, serving each in
+// its own goroutine
+func (s *Server) acceptLoop(ln net.Listener, kind string, serve func(net.Conn)) error {
+	var delay time.Duration
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			// Errors like running out of file descriptors pass, so back off
+			delay = min(max(2*delay, 5*time.Millisecond), time.Second)
+			s.log.Warn("Error accepting "+kind+" connection", "err", err, "retry_in", delay)
+			time.Sleep(delay)
+			continue
+		}
+		delay = 0
+		go serve(conn)
+	}
+}
+
+// lineRequest returns a request standing in for netConn, with its address
+// and TLS state, once any TLS handshake is done. The client has
+// lineLoginTimeout from here to log in.
+func (s *Server) lineRequest(netConn net.Conn) (*http.Request, bool) {
+	r, _ := http.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = netConn.RemoteAddr().String()
+
+	netConn.SetDeadline(time.Now().Add(lineLoginTimeout))
+	if tlsConn, ok := netConn.(*tls.Conn); ok {
+		if err := tlsConn.Handshake(); err != nil {
+			s.log.Debug("TLS handshake failed", "remote_addr", r.RemoteAddr, "err", err)
+			return nil, false
+		}
+		state := tlsConn.ConnectionState()
+		r.TLS = &state
+	}
+	return r, true
+}
+
+// serveLines admits the client on conn through serveConnection, reading
+// its credentials first if it sends them
+func (s *Server) serveLines(netConn net.Conn) {
+	conn := &lineConn{conn: netConn, reader: bufio.NewReader(netConn)}
+	r, ok := s.lineRequest(netConn)
+	if !ok {
+		netConn.Close()
+		return
+	}
+	_, first, err := conn.ReadMessage()
+	if err != nil {
+		netConn.Close()
+		return
+	}
+	if token, ok := strings.CutPrefix(string(first), "PASS "); ok {
+		r.Header.Set("Authorization", "Bearer "+token)
+	} else {
+		conn.pending = first
+	}
+	// The read deadline stands until ReadPump sets its own, so that the
+	// username can't be held back either
+	netConn.SetWriteDeadline(time.Time{})
+
+	w := newRecordedResponse()
+	admitted := false
+	s.serveConnection(w, r, func(http.ResponseWriter, *http.Request) (wsConn, error) {
+		admitted = true
+		return conn, nil
+	})
+	if !admitted {
+		if w.code >= http.StatusBadRequest {
+			netConn.SetWriteDeadline(time.Now().Add(s.Config.WriteTimeout))
+			conn.WriteMessage(websocket.TextMessage, []byte("ERROR: "+strings.TrimSpace(w.body.String())))
+		}
+		netConn.Close()
+	}
+}
+
+// lineConn is a line client's connection, standing in for a WebSocket
+// connection. There are no pings: TCP keepalives notice dead peers, so
+// pings are answered straight away.
+type lineConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	// pending is a line read before the client was admitted, to be
+	// returned by the next read
+	pending []byte
+
+	// mu serializes writes and guards onPong
+	mu     sync.Mutex
+	onPong func(string) error
+}
+
+// NextReader returns the next line
+func (c *lineConn) NextReader() (int, io.Reader, error) {
+	messageType, message, err := c.ReadMessage()
+	if err != nil {
+		return 0, nil, err
+	}
+	return messageType, bytes.NewReader(message), nil
+}
+
+// ReadMessage returns the next line that isn't blank, without its line
+// ending or any telnet commands
+func (c *lineConn) ReadMessage() (int, []byte, error) {
+	if line := c.pending; line != nil {
+		c.pending = nil
+		return websocket.TextMessage, line, nil
+	}
+	for {
+		raw, err := c.readLine()
+		if err != nil {
+			return 0, nil, err
+		}
+		if line := cleanLine(raw); len(line) > 0 {
+			return websocket.TextMessage, line, nil
+		}
+	}
+}
+
+// readLine reads up to and including the next newline, returning a slice
+// that is only valid until the next read
+func (c *lineConn) readLine() ([]byte, error) {
+	var long []byte
+	for {
+		chunk, err := c.reader.ReadSlice('\n')
+		if len(long)+len(chunk) > maxPostedMessage {
+			return nil, errLineTooLong
+		}
+		switch {
+		case err == bufio.ErrBufferFull:
+			long = append(long, chunk...)
+		case err != nil:
+			return nil, err
+		case long != nil:
+			return append(long, chunk...), nil
+		default:
+			return chunk, nil
+		}
+	}
+}
+
+// cleanLine returns a copy of raw without its line ending or telnet
+// commands, with invalid UTF-8 replaced
+func cleanLine(raw []byte) []byte {
+	raw = bytes.TrimRight(raw, "\r\n")
+	line := make([]byte, 0, len(raw))
+	for i := 0; i < len(raw); i++ {
+		if raw[i] != telnetIAC || i+1 == len(raw) {
+			line = append(line, raw[i])
+			continue
+		}
+		i++
+		switch command := raw[i]; {
+		case command == telnetIAC:
+			// An escaped 255
+			line = append(line, telnetIAC)
+		case command >= telnetWILL && command <= telnetDONT:
+			// Option negotiation, which is refused by ignoring it
+			i++
+		case command == telnetSB:
+			// Subnegotiation runs to IAC SE
+			for i+1 < len(raw) && !(raw[i] == telnetIAC && raw[i+1] == telnetSE) {
+				i++
+			}
+			i++
+		}
+	}
+	return bytes.ToValidUTF8(line, []byte("\uFFFD"))
+}
+
+// WriteMessage writes data as one or more lines, each ending in CRLF;
+// binary messages aren't supported
+func (c *lineConn) WriteMessage(messageType int, data []byte) error {
+	if messageType != websocket.TextMessage {
+		return errors.New("line connections only carry text messages")
+	}
+	buf := getBuffer()
+	defer putBuffer(buf)
+	data = bytes.TrimSuffix(data, []byte("\n"))
+	for {
+		line, rest, found := bytes.Cut(data, []byte("\n"))
+		buf.Write(bytes.TrimSuffix(line, []byte("\r")))
+		buf.WriteString("\r\n")
+		if !found {
+			break
+		}
+		data = rest
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, err := c.conn.Write(buf.Bytes())
+	return err
+}
+
+// WritePreparedMessage isn't supported
+func (c *lineConn) WritePreparedMessage(pm *websocket.PreparedMessage) error {
+	return errPreparedMessage
+}
+
+// WriteControl calls the pong handler for a ping, and for a close writes
+// its reason, if any, before closing the connection
+func (c *lineConn) WriteControl(messageType int, data []byte, deadline time.Time) error {
+	switch messageType {
+	case websocket.PingMessage:
+		c.mu.Lock()
+		onPong := c.onPong
+		c.mu.Unlock()
+		if onPong != nil {
+			return onPong("")
+		}
+	case websocket.CloseMessage:
+		var err error
+		if len(data) > 2 {
+			c.conn.SetWriteDeadline(deadline)
+			err = c.WriteMessage(websocket.TextMessage, []byte("Disconnected by the server: "+string(data[2:])))
+		}
+		c.Close()
+		return err
+	}
+	return nil
+}
+
+// SetReadDeadline sets when ReadMessage gives up waiting
+func (c *lineConn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets when writes fail
+func (c *lineConn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
+
+// SetPongHandler sets what is called when a ping is written
+func (c *lineConn) SetPongHandler(h func(appData string) error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.onPong = h
+}
+
+// EnableWriteCompression does nothing: lines aren't compressed
+func (c *lineConn) EnableWriteCompression(bool) {}
+
+// SetCompressionLevel does nothing: lines aren't compressed
+func (c *lineConn) SetCompressionLevel(int) error { return nil }
+
+// Subprotocol returns "", as there are no subprotocols
+func (c *lineConn) Subprotocol() string { return "" }
+
+// Close closes the connection
+func (c *lineConn) Close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,96 @@
+// pkg/chat/lines_test.go
+package chat
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// TestLines joins with the line protocol alongside a WebSocket client,
+// presenting a token and sending a line with telnet negotiation in it,
+// then kicks the line client, which is told why before being cut off
+func TestLines(t *testing.T) {
+	s, url := newTestServer(t, Config{HistorySize: 5, Auth: &TokenAuth{SharedSecret: "shared", UserTokens: map[string]string{"secret": "liner"}}})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go s.ServeLines(ln)
+
+	dial := func() (net.Conn, *bufio.Reader) {
+		t.Helper()
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		return conn, bufio.NewReader(conn)
+	}
+	unauthorized, reader := dial()
+	defer unauthorized.Close()
+	io.WriteString(unauthorized, "nobody\n")
+	if line, _ := reader.ReadString('\n'); line != "ERROR: unauthorized\r\n" {
+		t.Errorf("without a token got %q", line)
+	}
+
+	conn, reader := dial()
+	defer conn.Close()
+	io.WriteString(conn, "PASS secret\r\n\r\nanyone\r\n")
+	expect := func(want string) {
+		t.Helper()
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				t.Fatalf("waiting for %q: %v", want, err)
+			}
+			if !strings.HasSuffix(line, "\r\n") {
+				t.Fatalf("line %q doesn't end in CRLF", line)
+			}
+			if strings.TrimSuffix(line, "\r\n") == want {
+				return
+			}
+		}
+	}
+	expect("*** liner joined the chat ***")
+
+	ws, err := connect(url+"?token=shared", "socket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	if err := ws.WriteMessage(websocket.TextMessage, []byte("hello lines")); err != nil {
+		t.Fatal(err)
+	}
+	expect("socket: hello lines")
+
+	// IAC WILL NAWS, then the message
+	io.WriteString(conn, "\xff\xfb\x1fhello socket\n")
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		_, message, err := ws.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(message) == "liner: hello socket" {
+			break
+		}
+	}
+
+	// History is one message of several lines
+	io.WriteString(conn, "/join other\n/join lobby\n")
+	expect("--- Last 2 messages ---")
+	if !s.KickUser("liner", "testing", "admin") {
+		t.Fatal("liner not connected")
+	}
+	expect("Disconnected by the server: You were kicked by admin: testing")
+	if _, err := reader.ReadByte(); err != io.EOF {
+		t.Errorf("connection still open after the kick: %v", err)
+	}
+}
@@ -0,0 +1,110 @@
+// pkg/chat/links.go
+package chat
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// linkPattern finds URLs in messages: anything with a scheme or starting
+// with www., and bare domains on TLDs that are popular with spam and
+// invite links
+var linkPattern = regexp.MustCompile(`(?i)\b(?:[a-z][a-z0-9+.-]*://|www\.)[^\s<>"]+` +
+	`|\b(?:[a-z0-9](?:[a-z0-9-]*[a-z0-9])?\.)+(?:com|net|org|info|biz|io|gg|me|ly|co|xyz|ru|app|dev|link|site|online|top)\b(?:/[^\s<>"]*)?`)
+
+// findLinks returns the links in a message
+func findLinks(text string) []string {
+	return linkPattern.FindAllString(text, -1)
+}
+
+// linkHost returns the lowercased host a link points to
+func linkHost(link string) string {
+	if !strings.Contains(link, "://") {
+		link = "http://" + link
+	}
+	u, err := url.Parse(link)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(strings.TrimSuffix(u.Hostname(), "."))
+}
+
+// linkDomainAllowed reports whether host is on the LinkDomains allowlist,
+// either exactly or as a subdomain
+func (s *Server) linkDomainAllowed(host string) bool {
+	if host == "" {
+		return false
+	}
+	for _, domain := range s.config().LinkDomains {
+		domain = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(domain), "*."))
+		if domain != "" && (host == domain || strings.HasSuffix(host, "."+domain)) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowLinks applies the link filter to a message from the client, telling
+// it why if the message is refused. Links to allowlisted domains are always
+// fine, as is anything posted by moderators.
+func (c *Session) allowLinks(text string) bool {
+	cfg := c.Server.config()
+	if !cfg.BlockLinks && cfg.LinkMinAccountAge <= 0 {
+		return true
+	}
+	if c.can(permModerate) {
+		return true
+	}
+
+	blocked := false
+	for _, link := range findLinks(text) {
+		if !c.Server.linkDomainAllowed(linkHost(link)) {
+			blocked = true
+			break
+		}
+	}
+	if !blocked {
+		return true
+	}
+
+	if cfg.BlockLinks {
+		c.send("ERROR: Links to other sites are not allowed here.")
+		return false
+	}
+
+	age, err := c.accountAge()
+	if err != nil {
+		c.logger().Error("Error checking account age", "err", err)
+		c.send("ERROR: Could not check whether you may post links. Please try again later.")
+		return false
+	}
+	if age < cfg.LinkMinAccountAge {
+		msg := fmt.Sprintf("ERROR: Only accounts older than %s may post links.", cfg.LinkMinAccountAge)
+		if !c.LoggedIn {
+			msg += " Use /register to create one."
+		}
+		c.send(msg)
+		return false
+	}
+	return true
+}
+
+// accountAge returns how long ago the client's account was registered;
+// clients without one have an age of zero
+func (c *Session) accountAge() (time.Duration, error) {
+	if !c.LoggedIn {
+		return 0, nil
+	}
+	account, err := c.Server.getUser(c.ctx, c.Username)
+	if errors.Is(err, ErrUserNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return time.Since(account.CreatedAt), nil
+}
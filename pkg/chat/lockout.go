@@ -0,0 +1,177 @@
+// pkg/chat/lockout.go
+package chat
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ErrLockedOut is the error code sent to connections refused because of
+// too many failed logins
+const ErrLockedOut = "ERR_LOCKED_OUT"
+
+// loginGuard locks out usernames and IPs after repeated authentication
+// failures. Each failure past maxFailures doubles the lockout, starting at
+// base and capped at max.
+type loginGuard struct {
+	mu          sync.Mutex
+	maxFailures int
+	base        time.Duration
+	max         time.Duration
+	entries     map[string]*loginEntry
+	lastSweep   time.Time
+}
+
+// loginEntry is the failure history of one username or IP
+type loginEntry struct {
+	failures    int
+	last        time.Time
+	lockedUntil time.Time
+}
+
+// newLoginGuard creates a guard; zero maxFailures disables it
+func newLoginGuard(maxFailures int, base, max time.Duration) *loginGuard {
+	g := &loginGuard{
+		entries:   make(map[string]*loginEntry),
+		lastSweep: time.Now(),
+	}
+	g.setLimits(maxFailures, base, max)
+	return g
+}
+
+// setLimits changes the limits. Lockouts already started run their course.
+func (g *loginGuard) setLimits(maxFailures int, base, max time.Duration) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.maxFailures, g.base, g.max = maxFailures, base, max
+	if g.max < g.base {
+		g.max = g.base
+	}
+}
+
+// loginKeys returns the entry keys for a username and IP, skipping
+// whichever is unknown
+func loginKeys(username, ip string) []string {
+	var keys []string
+	if username != "" {
+		keys = append(keys, "user:"+userKey(username))
+	}
+	if ip != "" {
+		keys = append(keys, "ip:"+ip)
+	}
+	return keys
+}
+
+// locked returns how much longer attempts for username or from ip are
+// locked out, or zero if they may proceed
+func (g *loginGuard) locked(username, ip string) time.Duration {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.maxFailures <= 0 {
+		return 0
+	}
+
+	now := time.Now()
+	var wait time.Duration
+	for _, key := range loginKeys(username, ip) {
+		if e := g.entries[key]; e != nil {
+			wait = max(wait, e.lockedUntil.Sub(now))
+		}
+	}
+	return wait
+}
+
+// fail records a failed attempt and returns the lockout it starts, if any
+func (g *loginGuard) fail(username, ip string) time.Duration {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.maxFailures <= 0 {
+		return 0
+	}
+
+	now := time.Now()
+	g.sweepLocked(now)
+
+	var lockout time.Duration
+	for _, key := range loginKeys(username, ip) {
+		e := g.entries[key]
+		if e == nil {
+			e = &loginEntry{}
+			g.entries[key] = e
+		}
+		e.failures++
+		e.last = now
+		if over := e.failures - g.maxFailures; over > 0 {
+			d := g.max
+			if over <= 30 {
+				d = min(g.base<<(over-1), g.max)
+			}
+			e.lockedUntil = now.Add(d)
+			lockout = max(lockout, d)
+		}
+	}
+	return lockout
+}
+
+// succeed forgets a username's failures after a successful login. The IP's
+// are kept, so one valid account doesn't reset a stuffing run.
+func (g *loginGuard) succeed(username string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.entries, "user:"+userKey(username))
+}
+
+// sweepLocked forgets entries whose lockout has expired and that have
+// been quiet for max, at most once a minute. g.mu must be held.
+func (g *loginGuard) sweepLocked(now time.Time) {
+	if now.Sub(g.lastSweep) < time.Minute {
+		return
+	}
+	g.lastSweep = now
+	for key, e := range g.entries {
+		if now.After(e.lockedUntil) && now.Sub(e.last) > g.max {
+			delete(g.entries, key)
+		}
+	}
+}
+
+// loginLocked reports whether authentication attempts for username (which
+// may be empty) from ip are locked out, recording the rejection
+func (s *Server) loginLocked(username, ip string) (time.Duration, bool) {
+	wait := s.logins.locked(username, ip)
+	if wait <= 0 {
+		return 0, false
+	}
+	s.log.Warn("Rejected login: locked out", "username", username, "remote_addr", ip, "remaining", wait.Round(time.Second))
+	s.audit(AuditRejected, "", username, ip, "locked out after failed logins")
+	return wait, true
+}
+
+// loginFailed records a failed authentication attempt for username (which
+// may be empty) from ip, auditing any lockout it starts
+func (s *Server) loginFailed(username, ip string) {
+	if lockout := s.logins.fail(username, ip); lockout > 0 {
+		s.log.Warn("Locked out after failed logins", "username", username, "remote_addr", ip, "lockout", lockout)
+		s.audit(AuditLockout, "", username, ip, fmt.Sprintf("for %s", lockout))
+	}
+}
+
+// retryAfter is a lockout's remaining wait in whole seconds, rounded up
+func retryAfter(wait time.Duration) int {
+	return int(wait.Seconds()) + 1
+}
+
+// lockedOutError tells an HTTP client to retry after a lockout
+func lockedOutError(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter(wait)))
+	http.Error(w, "too many failed login attempts", http.StatusTooManyRequests)
+}
+
+// lockedOutMessage tells a WebSocket client to retry after a lockout
+func lockedOutMessage(wait time.Duration) string {
+	return fmt.Sprintf("ERROR: %s: Too many failed login attempts. Try again in %s (retry after %d seconds).",
+		ErrLockedOut, wait.Round(time.Second), retryAfter(wait))
+}
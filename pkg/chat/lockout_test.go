@@ -0,0 +1,82 @@
+// pkg/chat/lockout_test.go
+package chat
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// TestTokenQueryLockout guesses tokens in the query string, as a browser's
+// EventSource or WebSocket would send them, until the IP is locked out
+func TestTokenQueryLockout(t *testing.T) {
+	_, url := newTestServer(t, Config{
+		Auth:             &TokenAuth{SharedSecret: "s3cret"},
+		LoginMaxFailures: 3,
+		LoginLockout:     time.Minute,
+		LoginLockoutMax:  time.Hour,
+	})
+
+	// The fourth failure starts the lockout
+	for i := 0; i < 4; i++ {
+		_, resp, err := websocket.DefaultDialer.Dial(url+"?token=guess", nil)
+		if err == nil || resp == nil || resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("guess %d: got %v, want 401", i+1, resp)
+		}
+	}
+	// Even the right token is refused until the lockout is over
+	_, resp, err := websocket.DefaultDialer.Dial(url+"?token=s3cret", nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("after 4 guesses: got %v, want 429", resp)
+	}
+	if resp.Header.Get("Retry-After") == "" {
+		t.Error("lockout has no Retry-After")
+	}
+}
+
+// TestLoginGuard trips a guard for a username and IP, and checks that the
+// lockout doubles with each further failure, expires, and is cleared for
+// the username by a successful login
+func TestLoginGuard(t *testing.T) {
+	g := newLoginGuard(2, 50*time.Millisecond, 150*time.Millisecond)
+	for i := 0; i < 2; i++ {
+		if lockout := g.fail("alice", "192.0.2.1"); lockout != 0 {
+			t.Fatalf("failure %d locked out for %v", i+1, lockout)
+		}
+	}
+	if lockout := g.fail("alice", "192.0.2.1"); lockout != 50*time.Millisecond {
+		t.Errorf("third failure locked out for %v, want 50ms", lockout)
+	}
+	if lockout := g.fail("alice", ""); lockout != 100*time.Millisecond {
+		t.Errorf("fourth failure locked out for %v, want 100ms", lockout)
+	}
+	if lockout := g.fail("alice", ""); lockout != 150*time.Millisecond {
+		t.Errorf("fifth failure locked out for %v, want the 150ms cap", lockout)
+	}
+	if g.locked("bob", "192.0.2.1") <= 0 || g.locked("alice", "198.51.100.1") <= 0 {
+		t.Error("the username or IP isn't locked out on its own")
+	}
+	if g.locked("bob", "198.51.100.1") > 0 {
+		t.Error("an unrelated username and IP are locked out")
+	}
+
+	if !waitFor(time.Second, func() bool { return g.locked("alice", "192.0.2.1") <= 0 }) {
+		t.Fatal("lockout didn't expire")
+	}
+	g.succeed("alice")
+	if lockout := g.fail("alice", ""); lockout != 0 {
+		t.Errorf("failure after logging in locked out for %v", lockout)
+	}
+}
+
+// TestLockedOutMessage checks that WebSocket clients are told they are
+// locked out, and when to try again
+func TestLockedOutMessage(t *testing.T) {
+	msg := lockedOutMessage(90 * time.Second)
+	want := "ERROR: ERR_LOCKED_OUT: Too many failed login attempts. Try again in 1m30s (retry after 91 seconds)."
+	if msg != want {
+		t.Errorf("got %q, want %q", msg, want)
+	}
+}
@@ -0,0 +1,200 @@
+// pkg/chat/logfile.go
+package chat
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// logFileTimeFormat names rotated log files; it sorts in time order
+const logFileTimeFormat = "20060102T150405.000"
+
+// LogFileConfig configures a rotating log file
+type LogFileConfig struct {
+	Path string
+
+	// MaxSize rotates the file before it grows past this many bytes
+	MaxSize int64
+	// RotateEvery rotates the file at each multiple of this interval
+	// (counted in UTC), e.g. 24h rotates at midnight UTC
+	RotateEvery time.Duration
+
+	// MaxBackups is how many rotated files to keep, and MaxAge how long.
+	// Zero keeps them regardless.
+	MaxBackups int
+	MaxAge     time.Duration
+}
+
+// LogFile is an io.Writer that appends to a file, moving it aside to
+// path-<time>.ext when it gets too big or too old and deleting old backups.
+// Zero limits never rotate.
+type LogFile struct {
+	mu     sync.Mutex
+	cfg    LogFileConfig
+	file   *os.File
+	size   int64
+	period time.Time
+}
+
+// OpenLogFile opens (or creates) the log file at cfg.Path
+func OpenLogFile(cfg LogFileConfig) (*LogFile, error) {
+	l := &LogFile{cfg: cfg}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// open opens the file for appending. l.mu must be held (or l unshared).
+func (l *LogFile) open() error {
+	f, err := os.OpenFile(l.cfg.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return fmt.Errorf("open log file: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("open log file: %w", err)
+	}
+
+	l.file = f
+	l.size = info.Size()
+	// A file left over from a previous run belongs to the period it was
+	// last written in, so it is rotated if that has passed
+	l.period = l.periodOf(info.ModTime())
+	if info.Size() == 0 {
+		l.period = l.periodOf(time.Now())
+	}
+	return nil
+}
+
+// periodOf returns the start of the rotation period containing t
+func (l *LogFile) periodOf(t time.Time) time.Time {
+	if l.cfg.RotateEvery <= 0 {
+		return time.Time{}
+	}
+	return t.UTC().Truncate(l.cfg.RotateEvery)
+}
+
+// Write appends p, rotating first if it would overflow the file or the
+// current period has ended
+func (l *LogFile) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file == nil {
+		return 0, os.ErrClosed
+	}
+	if l.size > 0 && (l.cfg.MaxSize > 0 && l.size+int64(len(p)) > l.cfg.MaxSize ||
+		!l.periodOf(time.Now()).Equal(l.period)) {
+		// If that fails, carry on with the old file rather than lose lines
+		if err := l.rotateLocked(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error rotating log file: %v\n", err)
+		}
+	}
+
+	n, err := l.file.Write(p)
+	l.size += int64(n)
+	return n, err
+}
+
+// Rotate moves the current file aside and starts a new one
+func (l *LogFile) Rotate() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return os.ErrClosed
+	}
+	return l.rotateLocked()
+}
+
+// rotateLocked does the work of Rotate. l.mu must be held.
+func (l *LogFile) rotateLocked() error {
+	if err := l.file.Close(); err != nil {
+		return err
+	}
+	ext := filepath.Ext(l.cfg.Path)
+	backup := strings.TrimSuffix(l.cfg.Path, ext) + "-" + time.Now().UTC().Format(logFileTimeFormat) + ext
+	renameErr := os.Rename(l.cfg.Path, backup)
+
+	// Reopen even if the rename failed, so writes carry on
+	if err := l.open(); err != nil {
+		l.file = nil
+		return err
+	}
+	if renameErr != nil {
+		return renameErr
+	}
+	l.size, l.period = 0, l.periodOf(time.Now())
+	return l.pruneLocked()
+}
+
+// pruneLocked deletes the backups beyond MaxBackups or older than MaxAge.
+// l.mu must be held.
+func (l *LogFile) pruneLocked() error {
+	if l.cfg.MaxBackups <= 0 && l.cfg.MaxAge <= 0 {
+		return nil
+	}
+	backups, err := l.backups()
+	if err != nil {
+		return err
+	}
+
+	var firstErr error
+	for i, path := range backups {
+		keep := l.cfg.MaxBackups <= 0 || i < l.cfg.MaxBackups
+		if keep && l.cfg.MaxAge > 0 {
+			if info, err := os.Stat(path); err == nil && time.Since(info.ModTime()) > l.cfg.MaxAge {
+				keep = false
+			}
+		}
+		if keep {
+			continue
+		}
+		if err := os.Remove(path); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// backups lists the rotated files, newest first
+func (l *LogFile) backups() ([]string, error) {
+	dir, name := filepath.Dir(l.cfg.Path), filepath.Base(l.cfg.Path)
+	ext := filepath.Ext(name)
+	prefix := strings.TrimSuffix(name, ext) + "-"
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var backups []string
+	for _, entry := range entries {
+		stamp, ok := strings.CutPrefix(entry.Name(), prefix)
+		if !ok || !strings.HasSuffix(stamp, ext) {
+			continue
+		}
+		if _, err := time.Parse(logFileTimeFormat, strings.TrimSuffix(stamp, ext)); err == nil {
+			backups = append(backups, filepath.Join(dir, entry.Name()))
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(backups)))
+	return backups, nil
+}
+
+// Close closes the log file
+func (l *LogFile) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
@@ -0,0 +1,41 @@
+// pkg/chat/logging.go
+package chat
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// NewLogger returns a logger writing to w in format ("text" or "json") at
+// level ("debug", "info", "warn" or "error") and above
+func NewLogger(w io.Writer, format, level string) (*slog.Logger, error) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("invalid log level %q", level)
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+
+	switch strings.ToLower(format) {
+	case "text", "":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	default:
+		return nil, fmt.Errorf("invalid log format %q (want text or json)", format)
+	}
+}
+
+// logger returns the client's logger, which tags every event with its
+// username, address and current room. The room changes, so only use it
+// from the client's own goroutine.
+func (c *Session) logger() *slog.Logger {
+	return c.Server.log.With("username", c.Username, "remote_addr", c.IP, "room", c.Room)
+}
+
+// requestLogger returns a logger tagged with the address of r
+func (s *Server) requestLogger(r *http.Request) *slog.Logger {
+	return s.log.With("remote_addr", s.clientIP(r))
+}
@@ -0,0 +1,118 @@
+// pkg/chat/memory.go
+package chat
+
+import (
+	"context"
+	"time"
+)
+
+// memoryCheckInterval is how often the server totals what is queued for
+// its clients and checks how close it is to its memory limits
+const memoryCheckInterval = time.Second
+
+// A limit is warned about once its use reaches memoryWarnRatio of it, and
+// again only after dropping below memoryClearRatio
+const (
+	memoryWarnRatio  = 0.8
+	memoryClearRatio = 0.6
+)
+
+// boundedStore is a MessageStore holding its messages in memory, which can
+// be held to Config.MaxHistoryMessages and Config.MaxRoomMessages
+type boundedStore interface {
+	SetLimits(maxMessages, maxPerRoom int)
+	Len() int
+	Evicted() int64
+}
+
+// limitHistory applies the history limits in cfg to store, if it keeps
+// its messages in memory
+func limitHistory(store MessageStore, cfg *Config) {
+	if cfg.MaxHistoryMessages <= 0 && cfg.MaxRoomMessages <= 0 {
+		return
+	}
+	if bounded, ok := store.(boundedStore); ok {
+		bounded.SetLimits(cfg.MaxHistoryMessages, cfg.MaxRoomMessages)
+	}
+}
+
+// historyUsage returns how many messages the room and private stores hold
+// in memory, in the fuller of the two and in all, and how many their
+// limits have evicted
+func (s *Server) historyUsage() (largest, total int, evicted int64) {
+	for _, store := range []MessageStore{s.Store, s.PrivateStore} {
+		if bounded, ok := store.(boundedStore); ok {
+			n := bounded.Len()
+			largest = max(largest, n)
+			total += n
+			evicted += bounded.Evicted()
+		}
+	}
+	return largest, total, evicted
+}
+
+// memoryGauge tracks the use of one memory limit, so that approaching it
+// is logged once rather than on every check
+type memoryGauge struct {
+	name   string
+	warned bool
+}
+
+// check logs when used first comes close to limit, and when it falls well
+// below it again
+func (g *memoryGauge) check(s *Server, used, limit int64) {
+	if limit <= 0 {
+		g.warned = false
+		return
+	}
+	ratio := float64(used) / float64(limit)
+	switch {
+	case !g.warned && ratio >= memoryWarnRatio:
+		g.warned = true
+		s.log.Warn("Approaching memory limit", "limit", g.name, "used", used, "max", limit)
+	case g.warned && ratio < memoryClearRatio:
+		g.warned = false
+		s.log.Info("Back under memory limit", "limit", g.name, "used", used, "max", limit)
+	}
+}
+
+// watchMemory checks the memory limits every memoryCheckInterval until ctx
+// is done
+func (s *Server) watchMemory(ctx context.Context) {
+	gauges := []memoryGauge{{name: "queued_bytes"}, {name: "history_messages"}}
+	ticker := time.NewTicker(memoryCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.checkMemory(gauges)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// checkMemory totals the bytes queued for every client, which
+// Config.MaxQueuedBytes is enforced against until the next check, and
+// updates gauges with the use of that limit and Config.MaxHistoryMessages.
+// Rooms reaching MaxRoomMessages aren't warned about, as busy rooms stay
+// at it.
+func (s *Server) checkMemory(gauges []memoryGauge) {
+	var queued int64
+	s.clients.each(func(client *Session) {
+		queued += client.queuedBytes.Load()
+	})
+	s.queuedBytes.Store(queued)
+
+	cfg := s.config()
+	gauges[0].check(s, queued, int64(cfg.MaxQueuedBytes))
+	largest, _, _ := s.historyUsage()
+	gauges[1].check(s, int64(largest), int64(cfg.MaxHistoryMessages))
+}
+
+// overQueueBudget reports whether the clients' outboxes held at least
+// Config.MaxQueuedBytes between them at the latest check
+func (s *Server) overQueueBudget() bool {
+	limit := s.config().MaxQueuedBytes
+	return limit > 0 && s.queuedBytes.Load() >= int64(limit)
+}
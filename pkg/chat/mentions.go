@@ -0,0 +1,50 @@
+// pkg/chat/mentions.go
+package chat
+
+import (
+	"regexp"
+	"strings"
+)
+
+// mentionPattern matches @name in a message, name being what usernames
+// may be made of
+var mentionPattern = regexp.MustCompile(`@([\p{L}\p{N}\p{M}._-]+)`)
+
+// mentions returns the users a message from sender mentions as @name, each
+// once, by their own spelling of their name. Only users connected here or
+// to another instance, or with an account, count; sender doesn't.
+func (s *Server) mentions(sender, text string) []string {
+	if !strings.Contains(text, "@") {
+		return nil
+	}
+	var names []string
+	seen := map[string]bool{}
+	for _, match := range mentionPattern.FindAllStringSubmatch(text, -1) {
+		// A mention may end a sentence, as in "thanks @bob."
+		name := strings.TrimRight(match[1], ".")
+		key := usernameSkeleton(name)
+		if len([]rune(name)) > maxUsernameLength || seen[key] || sameUsername(name, sender) {
+			continue
+		}
+		seen[key] = true
+		if mentioned, ok := s.knownUser(name); ok {
+			names = append(names, mentioned)
+		}
+	}
+	return names
+}
+
+// knownUser returns how a user connected here or to another instance, or
+// with an account, spells their name
+func (s *Server) knownUser(name string) (string, bool) {
+	if client := s.clientByName(name); client != nil {
+		return client.Username, true
+	}
+	if remote, ok := s.remote.lookup(name); ok {
+		return remote.Username, true
+	}
+	if account, err := s.Users.GetUser(name); err == nil {
+		return account.Username, true
+	}
+	return "", false
+}
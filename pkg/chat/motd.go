@@ -0,0 +1,81 @@
+// pkg/chat/motd.go
+package chat
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// DefaultMOTD is the welcome message sent to clients when they join.
+// {user}, {online} and {room} are replaced with the client's name, the
+// number of connected users and the client's room.
+const DefaultMOTD = "Welcome {user}! There are {online} users online. Type /help for available commands."
+
+// AnnouncementPrefix starts server-wide announcements, so clients can
+// highlight them
+const AnnouncementPrefix = "[ANNOUNCEMENT] "
+
+// LoadMOTD reads a message of the day from a file, dropping trailing
+// newlines
+func LoadMOTD(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("read MOTD: %w", err)
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// MOTD returns the current message of the day
+func (s *Server) MOTD() string {
+	s.motdMu.RLock()
+	defer s.motdMu.RUnlock()
+	return s.motd
+}
+
+// SetMOTD replaces the message of the day shown to clients that join from
+// now on; an empty message restores DefaultMOTD
+func (s *Server) SetMOTD(motd string) {
+	if strings.TrimSpace(motd) == "" {
+		motd = DefaultMOTD
+	}
+	s.motdMu.Lock()
+	s.motd = motd
+	s.motdMu.Unlock()
+}
+
+// welcomeMessage renders the MOTD for a client that just joined
+func (s *Server) welcomeMessage(client *Session) string {
+	msg := strings.NewReplacer(
+		"{user}", client.Username,
+		"{online}", strconv.Itoa(s.ClientCount()+len(s.remote.users())),
+		"{room}", client.Room,
+	).Replace(s.MOTD())
+	if client.Role == RoleGuest {
+		msg += " You are connected as a guest and can only read and post."
+	}
+	return msg
+}
+
+// Announce sends a highlighted notice to every connected client
+func (s *Server) Announce(text, by string) {
+	s.log.Info("Announcement", "by", by, "text", text)
+	s.audit(AuditAdmin, by, "", "", "announce: "+text)
+	s.broadcastMessage(AnnouncementPrefix + text)
+}
+
+// handleAnnounce implements /announce <text>
+func (c *Session) handleAnnounce(args string) {
+	if !c.can(permAdminister) {
+		c.send("Only admins can make announcements.")
+		return
+	}
+
+	text := strings.TrimSpace(args)
+	if text == "" {
+		c.send("Usage: /announce <text>")
+		return
+	}
+	c.Server.Announce(text, c.Username)
+}
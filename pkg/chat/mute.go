@@ -0,0 +1,200 @@
+// pkg/chat/mute.go
+package chat
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultMuteDuration is used when /mute is given no duration
+const defaultMuteDuration = 10 * time.Minute
+
+// mute silences a user until it expires
+type mute struct {
+	until  time.Time
+	reason string
+	by     string
+	timer  *time.Timer
+}
+
+// muteList holds the current mutes by username, so reconnecting doesn't
+// lift them. Mutes are not persisted.
+type muteList struct {
+	mu      sync.Mutex
+	entries map[string]*mute
+}
+
+// newMuteList creates an empty mute list
+func newMuteList() *muteList {
+	return &muteList{entries: make(map[string]*mute)}
+}
+
+// MuteUser silences username for d, telling them why if they're connected
+// and again when the mute expires. An existing mute is replaced.
+func (s *Server) MuteUser(username string, d time.Duration, reason, by string) {
+	key := userKey(username)
+	m := &mute{until: time.Now().Add(d), reason: reason, by: by}
+	m.timer = time.AfterFunc(d, func() {
+		s.mutes.mu.Lock()
+		current := s.mutes.entries[key] == m
+		if current {
+			delete(s.mutes.entries, key)
+		}
+		s.mutes.mu.Unlock()
+
+		if client := s.clientByName(username); current && client != nil {
+			client.send("Your mute has expired.")
+		}
+	})
+
+	s.mutes.mu.Lock()
+	if old, ok := s.mutes.entries[key]; ok {
+		old.timer.Stop()
+	}
+	s.mutes.entries[key] = m
+	s.mutes.mu.Unlock()
+
+	s.log.Info("Muted", "username", username, "duration", d, "by", by, "reason", reason)
+	detail := fmt.Sprintf("for %s", d)
+	if reason != "" {
+		detail += ": " + reason
+	}
+	target := s.clientByName(username)
+	ip := ""
+	if target != nil {
+		ip = target.IP
+	}
+	s.audit(AuditMute, by, username, ip, detail)
+
+	if target != nil {
+		notice := fmt.Sprintf("You have been muted for %s", d)
+		if by != "" {
+			notice += " by " + by
+		}
+		if reason != "" {
+			notice += ": " + reason
+		}
+		target.send(notice + ".")
+	}
+}
+
+// UnmuteUser lifts a mute early, reporting whether there was one
+func (s *Server) UnmuteUser(username string) bool {
+	key := userKey(username)
+
+	s.mutes.mu.Lock()
+	m, ok := s.mutes.entries[key]
+	if ok {
+		m.timer.Stop()
+		delete(s.mutes.entries, key)
+	}
+	s.mutes.mu.Unlock()
+	return ok
+}
+
+// muteFor returns the active mute on username, if any
+func (s *Server) muteFor(username string) (mute, bool) {
+	s.mutes.mu.Lock()
+	defer s.mutes.mu.Unlock()
+
+	m, ok := s.mutes.entries[userKey(username)]
+	if !ok || !time.Now().Before(m.until) {
+		return mute{}, false
+	}
+	return *m, true
+}
+
+// muted reports whether the client may not post right now, telling it so
+func (c *Session) muted() bool {
+	m, ok := c.Server.muteFor(c.Username)
+	if !ok {
+		return false
+	}
+	msg := fmt.Sprintf("ERROR: You are muted for another %s", time.Until(m.until).Round(time.Second))
+	if m.reason != "" {
+		msg += ": " + m.reason
+	}
+	c.send(msg + ".")
+	return true
+}
+
+// mutedBroadcast is muted for room messages: with EchoMutedMessages the
+// message is shown back to its sender only, otherwise they get an error
+func (c *Session) mutedBroadcast(text string) bool {
+	if !c.Server.config().EchoMutedMessages {
+		return c.muted()
+	}
+	m, ok := c.Server.muteFor(c.Username)
+	if !ok {
+		return false
+	}
+	c.send(fmt.Sprintf(
+		"%s: %s (not delivered: you are muted for another %s)",
+		c.Username, text, time.Until(m.until).Round(time.Second)))
+	return true
+}
+
+// handleMute implements /mute <user> [duration] [reason]
+func (c *Session) handleMute(args string) {
+	if !c.can(permModerate) {
+		c.send("Only moderators can mute users.")
+		return
+	}
+
+	fields := strings.Fields(args)
+	if len(fields) == 0 {
+		c.send("Usage: /mute <username> [duration] [reason]")
+		return
+	}
+	target, fields := fields[0], fields[1:]
+	if sameUsername(target, c.Username) {
+		c.send("You cannot mute yourself.")
+		return
+	}
+	targetClient := c.Server.clientByName(target)
+	if targetClient == nil {
+		c.send(fmt.Sprintf("User '%s' not found", target))
+		return
+	}
+	if !c.outranks(targetClient) {
+		c.send(fmt.Sprintf("You cannot mute %s.", targetClient.Username))
+		return
+	}
+
+	d := defaultMuteDuration
+	if len(fields) > 0 {
+		if parsed, ok := parseLongDuration(fields[0]); ok {
+			d, fields = parsed, fields[1:]
+		}
+	}
+	c.Server.MuteUser(targetClient.Username, d, strings.Join(fields, " "), c.Username)
+	c.Server.broadcastToRoom(targetClient.Room, fmt.Sprintf(
+		"*** %s was muted by %s for %s ***", targetClient.Username, c.Username, d))
+}
+
+// handleUnmute implements /unmute <user>
+func (c *Session) handleUnmute(args string) {
+	if !c.can(permModerate) {
+		c.send("Only moderators can unmute users.")
+		return
+	}
+
+	target := strings.TrimSpace(args)
+	if target == "" {
+		c.send("Usage: /unmute <username>")
+		return
+	}
+	if !c.Server.UnmuteUser(target) {
+		c.send(fmt.Sprintf("%s is not muted.", target))
+		return
+	}
+
+	c.logger().Info("Unmuted", "target", target)
+	c.Server.audit(AuditUnmute, c.Username, target, "", "")
+	c.send(fmt.Sprintf("Unmuted %s.", target))
+	if client := c.Server.clientByName(target); client != nil {
+		client.send(fmt.Sprintf("You have been unmuted by %s.", c.Username))
+	}
+}
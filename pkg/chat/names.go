@@ -0,0 +1,144 @@
+// pkg/chat/names.go
+package chat
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Error codes sent to connections whose username is refused
+const (
+	ErrUsernameReserved = "ERR_USERNAME_RESERVED"
+	ErrUsernameInvalid  = "ERR_USERNAME_INVALID"
+)
+
+// Username length limits, counted in characters after normalization
+const (
+	minUsernameLength = 2
+	maxUsernameLength = 20
+)
+
+// guestPrefix starts every guest name; only guests may use it
+const guestPrefix = "guest-"
+
+// DefaultReservedNames are names that could be mistaken for staff or the
+// server itself
+var DefaultReservedNames = []string{"admin", "administrator", "moderator", "mod", "root", "server", "system"}
+
+// confusables maps non-Latin letters that look like Latin ones to the
+// letter they imitate, so lookalike names compare equal
+var confusables = map[rune]rune{
+	// Cyrillic
+	'а': 'a', 'в': 'b', 'е': 'e', 'ё': 'e', 'к': 'k', 'м': 'm', 'н': 'h',
+	'о': 'o', 'р': 'p', 'с': 'c', 'т': 't', 'у': 'y', 'х': 'x', 'ѕ': 's',
+	'і': 'i', 'ї': 'i', 'ј': 'j', 'ԁ': 'd', 'һ': 'h', 'ԛ': 'q', 'ԝ': 'w',
+	'ӏ': 'l', 'ɡ': 'g',
+	// Greek
+	'α': 'a', 'β': 'b', 'γ': 'y', 'ε': 'e', 'η': 'n', 'ι': 'i', 'κ': 'k',
+	'ν': 'v', 'ο': 'o', 'ρ': 'p', 'τ': 't', 'υ': 'u', 'χ': 'x', 'ω': 'w',
+	// Latin lookalikes
+	'ı': 'i', 'ȷ': 'j', 'ł': 'l', 'ø': 'o',
+}
+
+// normalizeUsername puts a username in Unicode NFKC form, so that e.g.
+// fullwidth and ligature characters become their plain equivalents
+func normalizeUsername(username string) string {
+	return norm.NFKC.String(strings.TrimSpace(username))
+}
+
+// usernameSkeleton reduces a username to a form in which names that look
+// alike are identical: normalized, lowercased, and with confusable letters
+// replaced by the Latin letter they imitate
+func usernameSkeleton(username string) string {
+	lower := strings.ToLower(normalizeUsername(username))
+	return strings.Map(func(r rune) rune {
+		if latin, ok := confusables[r]; ok {
+			return latin
+		}
+		return r
+	}, lower)
+}
+
+// sameUsername reports whether two usernames would be confused for each other
+func sameUsername(a, b string) bool {
+	return usernameSkeleton(a) == usernameSkeleton(b)
+}
+
+// validateUsername normalizes a username chosen by a client and checks that
+// it is a sensible length, uses only letters, digits, '-', '_' and '.', and
+// doesn't mix scripts (as in "pаypal" with a Cyrillic а)
+func validateUsername(username string) (string, error) {
+	username = normalizeUsername(username)
+
+	length := len([]rune(username))
+	if length < minUsernameLength || length > maxUsernameLength {
+		return "", fmt.Errorf("usernames must be between %d and %d characters", minUsernameLength, maxUsernameLength)
+	}
+
+	scripts := make(map[string]bool)
+	for _, r := range username {
+		switch {
+		case unicode.IsLetter(r):
+			scripts[scriptOf(r)] = true
+		case unicode.IsDigit(r), unicode.IsMark(r), r == '-', r == '_', r == '.':
+		default:
+			return "", fmt.Errorf("usernames may only contain letters, digits, '-', '_' and '.'")
+		}
+	}
+
+	// Japanese legitimately mixes kanji and kana
+	if scripts["Han"] {
+		delete(scripts, "Hiragana")
+		delete(scripts, "Katakana")
+	}
+	if len(scripts) > 1 {
+		return "", fmt.Errorf("usernames may not mix letters from different alphabets")
+	}
+	return username, nil
+}
+
+// validateIdentity normalizes and checks the username an authenticator
+// vouched for. Credential files, directories and certificates allow names
+// that aren't safe to show in the chat, and only guests may have names
+// with the guest prefix.
+func validateIdentity(identity Identity) (Identity, error) {
+	if identity.Username == "" {
+		return identity, nil
+	}
+	username, err := validateUsername(identity.Username)
+	if err != nil {
+		return identity, err
+	}
+	if identity.Role != RoleGuest && strings.HasPrefix(usernameSkeleton(username), guestPrefix) {
+		return identity, fmt.Errorf("names starting with %s are reserved for guests", guestPrefix)
+	}
+	identity.Username = username
+	return identity, nil
+}
+
+// scriptOf returns the name of the Unicode script a letter belongs to
+func scriptOf(r rune) string {
+	for name, table := range unicode.Scripts {
+		if name != "Common" && name != "Inherited" && unicode.Is(table, r) {
+			return name
+		}
+	}
+	return "Common"
+}
+
+// reservedName reports whether username is off limits to a connection
+// that neither authenticated as that user nor logged in to its account
+func (s *Server) reservedName(username string, identity Identity) bool {
+	if strings.HasPrefix(usernameSkeleton(username), guestPrefix) {
+		return identity.Role != RoleGuest
+	}
+	for _, name := range s.config().ReservedNames {
+		if name = strings.TrimSpace(name); name != "" && sameUsername(name, username) {
+			return true
+		}
+	}
+	return false
+}
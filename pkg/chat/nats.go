@@ -0,0 +1,393 @@
+// pkg/chat/nats.go
+package chat
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// natsSID is the subscription ID of the backplane subject; there is only
+// one subscription per connection
+const natsSID = "1"
+
+// NATSConfig describes a NATS server to use as a backplane
+type NATSConfig struct {
+	// URL is nats://[user:password@|token@]host[:port], or tls:// to
+	// require TLS. Servers that require TLS get it either way.
+	URL string
+
+	// Subject is the subject the instances share; empty means
+	// DefaultBackplaneChannel
+	Subject string
+}
+
+// NATSBackplane is a Backplane using core NATS publish/subscribe on one
+// connection, which it re-establishes if it drops. Events are published
+// from a queue so a slow server never holds up clients, and events sent
+// while reconnecting are lost.
+type NATSBackplane struct {
+	Config NATSConfig
+
+	addr      string
+	host      string
+	forceTLS  bool
+	user      string
+	password  string
+	token     string
+	queue     chan []byte
+	published chan struct{}
+
+	mu      sync.Mutex
+	conn    *natsConn
+	handler func(event []byte)
+	closed  bool
+}
+
+// NewNATSBackplane connects to the NATS server at cfg.URL
+func NewNATSBackplane(cfg NATSConfig) (*NATSBackplane, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil || (u.Scheme != "nats" && u.Scheme != "tls") || u.Hostname() == "" {
+		return nil, fmt.Errorf("invalid NATS URL %q (want nats://host:port)", cfg.URL)
+	}
+	if cfg.Subject == "" {
+		cfg.Subject = DefaultBackplaneChannel
+	}
+	if strings.ContainsAny(cfg.Subject, " \t\r\n*>") {
+		return nil, fmt.Errorf("invalid NATS subject %q", cfg.Subject)
+	}
+
+	b := &NATSBackplane{
+		Config:    cfg,
+		addr:      u.Host,
+		host:      u.Hostname(),
+		forceTLS:  u.Scheme == "tls",
+		queue:     make(chan []byte, backplaneQueueSize),
+		published: make(chan struct{}),
+	}
+	if u.Port() == "" {
+		b.addr = net.JoinHostPort(u.Hostname(), "4222")
+	}
+	if u.User != nil {
+		if password, ok := u.User.Password(); ok {
+			b.user, b.password = u.User.Username(), password
+		} else {
+			b.token = u.User.Username()
+		}
+	}
+
+	// Fail now, rather than on the first message, if NATS is unreachable
+	conn, err := b.dial()
+	if err != nil {
+		return nil, err
+	}
+	b.conn = conn
+	go b.run(conn)
+	go b.runPublisher()
+	return b, nil
+}
+
+// Publish queues event to be sent on the subject
+func (b *NATSBackplane) Publish(event []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return net.ErrClosed
+	}
+	select {
+	case b.queue <- event:
+		return nil
+	default:
+		return errors.New("publish queue full")
+	}
+}
+
+// runPublisher sends queued events until Close
+func (b *NATSBackplane) runPublisher() {
+	defer close(b.published)
+	for event := range b.queue {
+		b.mu.Lock()
+		conn := b.conn
+		b.mu.Unlock()
+		if conn == nil {
+			slog.Warn("Dropped backplane event while reconnecting to NATS")
+			continue
+		}
+		if err := conn.write(fmt.Sprintf("PUB %s %d\r\n%s\r\n", b.Config.Subject, len(event), event)); err != nil {
+			slog.Warn("Error publishing to NATS backplane", "err", err)
+		}
+	}
+}
+
+// Subscribe subscribes to the subject and calls fn with each message from
+// the connection's reader goroutine until Close
+func (b *NATSBackplane) Subscribe(fn func(event []byte)) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return net.ErrClosed
+	}
+	b.handler = fn
+	if b.conn == nil {
+		// run subscribes once it has reconnected
+		return nil
+	}
+	return b.conn.write(fmt.Sprintf("SUB %s %s\r\n", b.Config.Subject, natsSID))
+}
+
+// run reads from conn until it fails, then reconnects and resubscribes,
+// until Close
+func (b *NATSBackplane) run(conn *natsConn) {
+	for {
+		err := b.receive(conn)
+		if b.isClosed() {
+			return
+		}
+		slog.Warn("Lost connection to NATS backplane, reconnecting", "err", err)
+
+		b.mu.Lock()
+		b.conn = nil
+		b.mu.Unlock()
+		if !reconnectBackplane("NATS", b.isClosed, func() (err error) {
+			if conn, err = b.dial(); err != nil {
+				return err
+			}
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			if b.closed {
+				conn.Close()
+				return net.ErrClosed
+			}
+			if b.handler != nil {
+				if err := conn.write(fmt.Sprintf("SUB %s %s\r\n", b.Config.Subject, natsSID)); err != nil {
+					conn.Close()
+					return err
+				}
+			}
+			b.conn = conn
+			return nil
+		}) {
+			return
+		}
+	}
+}
+
+// receive handles what the server sends on conn until it fails, pinging it
+// so a dead connection is noticed
+func (b *NATSBackplane) receive(conn *natsConn) error {
+	defer conn.Close()
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		ticker := time.NewTicker(backplanePingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if conn.write("PING\r\n") != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	for {
+		conn.conn.SetReadDeadline(time.Now().Add(2 * backplanePingInterval))
+		line, err := conn.readLine()
+		if err != nil {
+			return err
+		}
+		op, args, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(op) {
+		case "MSG":
+			// MSG <subject> <sid> [reply-to] <#bytes>
+			fields := strings.Fields(args)
+			if len(fields) < 3 {
+				return fmt.Errorf("nats: malformed MSG %q", line)
+			}
+			n, err := strconv.Atoi(fields[len(fields)-1])
+			if err != nil || n < 0 {
+				return fmt.Errorf("nats: malformed MSG %q", line)
+			}
+			payload := make([]byte, n+2)
+			if _, err := io.ReadFull(conn.r, payload); err != nil {
+				return err
+			}
+			b.mu.Lock()
+			fn := b.handler
+			b.mu.Unlock()
+			if fn != nil {
+				fn(payload[:n])
+			}
+		case "PING":
+			if err := conn.write("PONG\r\n"); err != nil {
+				return err
+			}
+		case "-ERR":
+			// Most errors are followed by the server closing the connection
+			slog.Warn("NATS backplane error", "err", strings.Trim(args, "'"))
+		case "PONG", "+OK", "INFO":
+		default:
+			return fmt.Errorf("nats: unexpected %q", line)
+		}
+	}
+}
+
+func (b *NATSBackplane) isClosed() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.closed
+}
+
+// Close stops subscribing and closes the connection, waiting a few seconds
+// for the queued events to be published
+func (b *NATSBackplane) Close() error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return nil
+	}
+	b.closed = true
+	close(b.queue)
+	b.mu.Unlock()
+
+	select {
+	case <-b.published:
+	case <-time.After(backplaneDialTimeout):
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.conn != nil {
+		b.conn.Close()
+	}
+	return nil
+}
+
+// natsInfo is the part of the server's INFO the client needs
+type natsInfo struct {
+	TLSRequired bool `json:"tls_required"`
+}
+
+// natsConnect is the client's CONNECT message
+type natsConnect struct {
+	Verbose     bool   `json:"verbose"`
+	Pedantic    bool   `json:"pedantic"`
+	TLSRequired bool   `json:"tls_required"`
+	Name        string `json:"name"`
+	Lang        string `json:"lang"`
+	Version     string `json:"version"`
+	Protocol    int    `json:"protocol"`
+	Echo        bool   `json:"echo"`
+	User        string `json:"user,omitempty"`
+	Pass        string `json:"pass,omitempty"`
+	AuthToken   string `json:"auth_token,omitempty"`
+}
+
+// dial connects and logs in to the server, upgrading to TLS if either side
+// requires it. A PING after CONNECT makes the server report a failed login
+// before the connection is used.
+func (b *NATSBackplane) dial() (*natsConn, error) {
+	nc, err := net.DialTimeout("tcp", b.addr, backplaneDialTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("connect to NATS: %w", err)
+	}
+	nc.SetDeadline(time.Now().Add(backplaneDialTimeout))
+	conn := &natsConn{conn: nc, r: bufio.NewReader(nc)}
+
+	fail := func(err error) (*natsConn, error) {
+		conn.Close()
+		return nil, fmt.Errorf("connect to NATS: %w", err)
+	}
+	line, err := conn.readLine()
+	if err != nil {
+		return fail(err)
+	}
+	infoJSON, ok := strings.CutPrefix(line, "INFO ")
+	if !ok {
+		return fail(fmt.Errorf("expected INFO, got %q", line))
+	}
+	var info natsInfo
+	if err := json.Unmarshal([]byte(infoJSON), &info); err != nil {
+		return fail(fmt.Errorf("parse INFO: %w", err))
+	}
+
+	useTLS := b.forceTLS || info.TLSRequired
+	if useTLS {
+		tc := tls.Client(nc, &tls.Config{ServerName: b.host})
+		if err := tc.Handshake(); err != nil {
+			return fail(err)
+		}
+		conn.conn, conn.r = tc, bufio.NewReader(tc)
+	}
+
+	connect, _ := json.Marshal(natsConnect{
+		TLSRequired: useTLS,
+		Name:        "go-chat",
+		Lang:        "go",
+		Version:     "1",
+		Protocol:    1,
+		User:        b.user,
+		Pass:        b.password,
+		AuthToken:   b.token,
+	})
+	if err := conn.write("CONNECT " + string(connect) + "\r\nPING\r\n"); err != nil {
+		return fail(err)
+	}
+	for {
+		line, err := conn.readLine()
+		if err != nil {
+			return fail(err)
+		}
+		if line == "PONG" {
+			break
+		}
+		if msg, isErr := strings.CutPrefix(line, "-ERR "); isErr {
+			return fail(errors.New(strings.Trim(msg, "'")))
+		}
+	}
+	conn.conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// natsConn is a connection speaking the NATS text protocol
+type natsConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	wmu  sync.Mutex
+}
+
+// write sends protocol lines, which must end in CRLF
+func (c *natsConn) write(data string) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(backplaneDialTimeout))
+	_, err := io.WriteString(c.conn, data)
+	return err
+}
+
+// readLine reads one protocol line without its CRLF
+func (c *natsConn) readLine() (string, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// Close closes the connection
+func (c *natsConn) Close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,57 @@
+// pkg/chat/notify.go
+package chat
+
+import "fmt"
+
+// online reports whether username is connected here or to another
+// instance
+func (s *Server) online(username string) bool {
+	if s.clientByName(username) != nil {
+		return true
+	}
+	_, ok := s.remote.lookup(username)
+	return ok
+}
+
+// notifyMentions tells each offline user mentioned in a room message, by
+// email and Web Push
+func (s *Server) notifyMentions(room, from string, mentioned []string, text string) {
+	for _, name := range mentioned {
+		s.notifyOffline(name, fmt.Sprintf("%s mentioned you in #%s: %s", from, room, text))
+		s.pushOffline(name, pushNotification{
+			Title: fmt.Sprintf("%s mentioned you in #%s", from, room),
+			Body:  text,
+			From:  from,
+			Room:  room,
+			Tag:   "room:" + room,
+		})
+	}
+}
+
+// whisperOffline takes a whisper for a registered user who is offline, to
+// be sent to them by email or Web Push, if they get either
+func (c *Session) whisperOffline(target, message string) bool {
+	account, err := c.Server.getUser(c.ctx, target)
+	if err != nil {
+		return false
+	}
+	_, emailed := notifiable(account)
+	emailed = emailed && c.Server.email != nil
+	if !emailed && !c.Server.pushSubscribed(account.Username) {
+		return false
+	}
+	c.send(fmt.Sprintf("[PM to %s]: %s", account.Username, message))
+	c.send(fmt.Sprintf("%s is offline and will be notified of your message.", account.Username))
+	if c.Server.Shadowbanned(c.Username) {
+		return true
+	}
+	c.Server.notifyOffline(account.Username, fmt.Sprintf("%s whispered: %s", c.Username, message))
+	c.Server.pushOffline(account.Username, pushNotification{
+		Title: c.Username + " whispered to you",
+		Body:  message,
+		From:  c.Username,
+		Tag:   "pm:" + c.Username,
+	})
+	c.Server.recordPrivateMessage(c.ctx, c.Username, account.Username, message)
+	return true
+}
@@ -0,0 +1,313 @@
+// pkg/chat/oidc.go
+package chat
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SessionCookie is the cookie holding a session token after OIDC login
+const SessionCookie = "gochat_session"
+
+// Lifetimes of the OIDC login state and the sessions it creates
+const (
+	oidcLoginTimeout = 10 * time.Minute
+	oidcSessionTTL   = 12 * time.Hour
+)
+
+// OIDCConfig describes an OpenID Connect provider and this server's client
+// registration with it
+type OIDCConfig struct {
+	// IssuerURL is the provider's issuer; its discovery document is
+	// fetched from IssuerURL + "/.well-known/openid-configuration"
+	IssuerURL string
+
+	ClientID     string
+	ClientSecret string
+
+	// RedirectURL is the externally visible URL of the callback handler,
+	// e.g. https://chat.example.com/auth/callback
+	RedirectURL string
+
+	// Scopes requested in addition to "openid" (default "profile")
+	Scopes []string
+
+	// UsernameClaim names the ID token claim used as the chat username
+	// (default "preferred_username", falling back to "sub")
+	UsernameClaim string
+}
+
+// OIDCProvider implements the login redirect, the callback that exchanges
+// the authorization code for an ID token, and an Authenticator accepting
+// the session tokens minted by the callback
+type OIDCProvider struct {
+	config        OIDCConfig
+	authEndpoint  string
+	tokenEndpoint string
+	idTokens      *JWTAuth
+	client        *http.Client
+
+	mu       sync.Mutex
+	pending  map[string]oidcLogin   // state -> login in progress
+	sessions map[string]oidcSession // session token -> session
+}
+
+type oidcLogin struct {
+	nonce    string
+	returnTo string
+	started  time.Time
+}
+
+type oidcSession struct {
+	identity Identity
+	expires  time.Time
+}
+
+// NewOIDCProvider fetches the provider's discovery document and prepares
+// to verify its ID tokens
+func NewOIDCProvider(cfg OIDCConfig) (*OIDCProvider, error) {
+	if cfg.IssuerURL == "" || cfg.ClientID == "" || cfg.RedirectURL == "" {
+		return nil, fmt.Errorf("OIDC requires an issuer URL, client ID and redirect URL")
+	}
+	if len(cfg.Scopes) == 0 {
+		cfg.Scopes = []string{"profile"}
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	discoveryURL := strings.TrimRight(cfg.IssuerURL, "/") + "/.well-known/openid-configuration"
+	resp, err := client.Get(discoveryURL)
+	if err != nil {
+		return nil, fmt.Errorf("OIDC discovery: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("OIDC discovery: %s", resp.Status)
+	}
+
+	var discovery struct {
+		Issuer                string `json:"issuer"`
+		AuthorizationEndpoint string `json:"authorization_endpoint"`
+		TokenEndpoint         string `json:"token_endpoint"`
+		JWKSURI               string `json:"jwks_uri"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&discovery); err != nil {
+		return nil, fmt.Errorf("OIDC discovery: %w", err)
+	}
+	if discovery.AuthorizationEndpoint == "" || discovery.TokenEndpoint == "" || discovery.JWKSURI == "" {
+		return nil, fmt.Errorf("OIDC discovery document is incomplete")
+	}
+
+	idTokens, err := NewJWTAuth(JWTConfig{
+		JWKSURL:       discovery.JWKSURI,
+		Issuer:        discovery.Issuer,
+		Audience:      cfg.ClientID,
+		UsernameClaim: cfg.UsernameClaim,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &OIDCProvider{
+		config:        cfg,
+		authEndpoint:  discovery.AuthorizationEndpoint,
+		tokenEndpoint: discovery.TokenEndpoint,
+		idTokens:      idTokens,
+		client:        client,
+		pending:       make(map[string]oidcLogin),
+		sessions:      make(map[string]oidcSession),
+	}, nil
+}
+
+// CallbackPath returns the local path the callback handler must be mounted at
+func (p *OIDCProvider) CallbackPath() string {
+	u, err := url.Parse(p.config.RedirectURL)
+	if err != nil || u.Path == "" {
+		return "/auth/callback"
+	}
+	return u.Path
+}
+
+// HandleLogin redirects the browser to the provider's login page. An
+// optional return_to query parameter (a local path) is where the browser
+// is sent after logging in.
+func (p *OIDCProvider) HandleLogin(w http.ResponseWriter, r *http.Request) {
+	state, nonce := randomToken(), randomToken()
+
+	// Only allow local paths so the login can't be used as an open redirect
+	returnTo := r.URL.Query().Get("return_to")
+	if !strings.HasPrefix(returnTo, "/") || strings.HasPrefix(returnTo, "//") {
+		returnTo = ""
+	}
+
+	p.mu.Lock()
+	p.expireLocked()
+	p.pending[state] = oidcLogin{nonce: nonce, returnTo: returnTo, started: time.Now()}
+	p.mu.Unlock()
+
+	query := url.Values{
+		"response_type": {"code"},
+		"client_id":     {p.config.ClientID},
+		"redirect_uri":  {p.config.RedirectURL},
+		"scope":         {strings.Join(append([]string{"openid"}, p.config.Scopes...), " ")},
+		"state":         {state},
+		"nonce":         {nonce},
+	}
+	target := p.authEndpoint
+	if strings.Contains(target, "?") {
+		target += "&" + query.Encode()
+	} else {
+		target += "?" + query.Encode()
+	}
+	http.Redirect(w, r, target, http.StatusFound)
+}
+
+// HandleCallback completes the login: it exchanges the authorization code
+// for an ID token, verifies it, and mints a session token usable on /ws
+func (p *OIDCProvider) HandleCallback(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if errCode := query.Get("error"); errCode != "" {
+		slog.Warn("OIDC login failed", "error", errCode, "description", query.Get("error_description"))
+		http.Error(w, "login failed: "+errCode, http.StatusUnauthorized)
+		return
+	}
+
+	p.mu.Lock()
+	login, ok := p.pending[query.Get("state")]
+	delete(p.pending, query.Get("state"))
+	p.mu.Unlock()
+	if !ok || time.Since(login.started) > oidcLoginTimeout {
+		http.Error(w, "login expired or invalid, please try again", http.StatusBadRequest)
+		return
+	}
+
+	identity, err := p.exchange(query.Get("code"), login.nonce)
+	if err != nil {
+		slog.Warn("OIDC login failed", "err", err)
+		http.Error(w, "login failed", http.StatusUnauthorized)
+		return
+	}
+
+	token := randomToken()
+	expires := time.Now().Add(oidcSessionTTL)
+	p.mu.Lock()
+	p.sessions[token] = oidcSession{identity: identity, expires: expires}
+	p.mu.Unlock()
+	slog.Info("OIDC login succeeded", "username", identity.Username)
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     SessionCookie,
+		Value:    token,
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	if login.returnTo != "" {
+		http.Redirect(w, r, login.returnTo, http.StatusFound)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintf(w, "Logged in as %s.\n\nSession token (valid until %s):\n%s\n\nUse it with: chat-client -token <session token>\n",
+		identity.Username, expires.Format(time.RFC1123), token)
+}
+
+// exchange trades an authorization code for a verified identity
+func (p *OIDCProvider) exchange(code, nonce string) (Identity, error) {
+	if code == "" {
+		return Identity{}, fmt.Errorf("missing authorization code")
+	}
+
+	form := url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {code},
+		"redirect_uri": {p.config.RedirectURL},
+	}
+	req, err := http.NewRequest(http.MethodPost, p.tokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return Identity{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(p.config.ClientID), url.QueryEscape(p.config.ClientSecret))
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return Identity{}, fmt.Errorf("token request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var tokens struct {
+		IDToken string `json:"id_token"`
+		Error   string `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokens); err != nil {
+		return Identity{}, fmt.Errorf("token response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK || tokens.IDToken == "" {
+		return Identity{}, fmt.Errorf("token request rejected: %s %s", resp.Status, tokens.Error)
+	}
+
+	claims, err := p.idTokens.verifyToken(tokens.IDToken)
+	if err != nil {
+		return Identity{}, fmt.Errorf("invalid ID token: %w", err)
+	}
+	if claims["nonce"] != nonce {
+		return Identity{}, fmt.Errorf("invalid ID token: nonce mismatch")
+	}
+	return p.idTokens.identityFromClaims(claims)
+}
+
+// Authenticate accepts connections presenting a session token, either as a
+// bearer token or in the session cookie set by the callback
+func (p *OIDCProvider) Authenticate(r *http.Request) (Identity, error) {
+	token := requestToken(r)
+	if token == "" {
+		if cookie, err := r.Cookie(SessionCookie); err == nil {
+			token = cookie.Value
+		}
+	}
+	if token == "" {
+		return Identity{}, fmt.Errorf("%w: missing session token", ErrUnauthorized)
+	}
+
+	p.mu.Lock()
+	session, ok := p.sessions[token]
+	p.mu.Unlock()
+	if !ok || time.Now().After(session.expires) {
+		return Identity{}, fmt.Errorf("%w: invalid or expired session", ErrUnauthorized)
+	}
+	return session.identity, nil
+}
+
+// expireLocked drops stale logins and sessions. p.mu must be held.
+func (p *OIDCProvider) expireLocked() {
+	now := time.Now()
+	for state, login := range p.pending {
+		if now.Sub(login.started) > oidcLoginTimeout {
+			delete(p.pending, state)
+		}
+	}
+	for token, session := range p.sessions {
+		if now.After(session.expires) {
+			delete(p.sessions, token)
+		}
+	}
+}
+
+// randomToken returns an unguessable URL-safe token
+func randomToken() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic("crypto/rand failed: " + err.Error())
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,151 @@
+// pkg/chat/oidc_test.go
+package chat
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeIDP is an OpenID provider issuing ID tokens for alice, with the nonce
+// set by the test
+type fakeIDP struct {
+	*httptest.Server
+
+	mu    sync.Mutex
+	nonce string
+}
+
+func newFakeIDP(t *testing.T) *fakeIDP {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	jwks := newJWKSServer(t)
+	jwks.set(map[string]crypto.Signer{"idp": key})
+
+	idp := &fakeIDP{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 idp.URL,
+			"authorization_endpoint": idp.URL + "/authorize",
+			"token_endpoint":         idp.URL + "/token",
+			"jwks_uri":               jwks.URL,
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if user, secret, _ := r.BasicAuth(); user != "go-chat" || secret != "client-secret" || r.FormValue("code") != "good-code" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		idp.mu.Lock()
+		claims := map[string]interface{}{
+			"iss": idp.URL, "aud": "go-chat", "sub": "alice", "nonce": idp.nonce,
+			"exp": time.Now().Add(time.Minute).Unix(),
+		}
+		idp.mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]string{
+			"id_token": signJWT(t, map[string]interface{}{"alg": "ES256", "kid": "idp"}, claims, key),
+		})
+	})
+	idp.Server = httptest.NewServer(mux)
+	t.Cleanup(idp.Close)
+	return idp
+}
+
+// login starts a login and returns its state and nonce from the redirect
+func login(t *testing.T, p *OIDCProvider, returnTo string) (state, nonce string) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	p.HandleLogin(rec, httptest.NewRequest("GET", "/auth/login?return_to="+url.QueryEscape(returnTo), nil))
+	if rec.Code != http.StatusFound {
+		t.Fatalf("login got %d", rec.Code)
+	}
+	target, err := url.Parse(rec.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return target.Query().Get("state"), target.Query().Get("nonce")
+}
+
+// callback completes a login with state and code
+func callback(p *OIDCProvider, state, code string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	p.HandleCallback(rec, httptest.NewRequest("GET", "/auth/callback?"+url.Values{"state": {state}, "code": {code}}.Encode(), nil))
+	return rec
+}
+
+// TestOIDCLogin logs in through a fake provider, connects with the session
+// cookie it sets, and checks that replayed, forged and failed logins and
+// unknown sessions are refused
+func TestOIDCLogin(t *testing.T) {
+	idp := newFakeIDP(t)
+	p, err := NewOIDCProvider(OIDCConfig{
+		IssuerURL: idp.URL, ClientID: "go-chat", ClientSecret: "client-secret",
+		RedirectURL: "https://chat.example.com/auth/callback",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, wsURL := newTestServer(t, Config{Auth: p})
+
+	state, nonce := login(t, p, "/chat")
+	idp.mu.Lock()
+	idp.nonce = nonce
+	idp.mu.Unlock()
+	rec := callback(p, state, "good-code")
+	if rec.Code != http.StatusFound || rec.Header().Get("Location") != "/chat" {
+		t.Fatalf("callback got %d to %q", rec.Code, rec.Header().Get("Location"))
+	}
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != SessionCookie || !cookies[0].HttpOnly {
+		t.Fatalf("got cookies %v", cookies)
+	}
+
+	header := http.Header{"Cookie": {cookies[0].String()}}
+	if got := dialStatus(t, wsURL, header); got != http.StatusSwitchingProtocols {
+		t.Errorf("with the session cookie: got %d", got)
+	}
+	if got := dialStatus(t, wsURL, http.Header{"Authorization": {"Bearer " + cookies[0].Value}}); got != http.StatusSwitchingProtocols {
+		t.Errorf("with the session token: got %d", got)
+	}
+	if got := dialStatus(t, wsURL, http.Header{"Cookie": {SessionCookie + "=forged"}}); got != http.StatusUnauthorized {
+		t.Errorf("with a forged session: got %d", got)
+	}
+	if id, err := p.Authenticate(httptest.NewRequest("GET", "/ws?token="+cookies[0].Value, nil)); err != nil || id.Username != "alice" {
+		t.Errorf("session is %+v, %v", id, err)
+	}
+
+	// The state can only be used once
+	if rec := callback(p, state, "good-code"); rec.Code != http.StatusBadRequest {
+		t.Errorf("replayed callback got %d", rec.Code)
+	}
+	if rec := callback(p, "made-up", "good-code"); rec.Code != http.StatusBadRequest {
+		t.Errorf("unknown state got %d", rec.Code)
+	}
+	// An ID token for another login's nonce
+	state, _ = login(t, p, "")
+	if rec := callback(p, state, "good-code"); rec.Code != http.StatusUnauthorized {
+		t.Errorf("nonce mismatch got %d", rec.Code)
+	}
+	state, _ = login(t, p, "")
+	if rec := callback(p, state, "bad-code"); rec.Code != http.StatusUnauthorized {
+		t.Errorf("rejected code got %d", rec.Code)
+	}
+
+	// Only local paths are returned to
+	state, nonce = login(t, p, "//evil.example.com/")
+	idp.mu.Lock()
+	idp.nonce = nonce
+	idp.mu.Unlock()
+	if rec := callback(p, state, "good-code"); rec.Code != http.StatusOK {
+		t.Errorf("login returning elsewhere got %d to %q", rec.Code, rec.Header().Get("Location"))
+	}
+}
@@ -0,0 +1,321 @@
+// pkg/chat/openapi.go
+package chat
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// openAPIVersion is the version of the REST and admin APIs in their
+// OpenAPI document; bump it when they change
+const openAPIVersion = "1.0.0"
+
+// BansRemoved is the admin API's answer to lifting bans
+type BansRemoved struct {
+	Removed int `json:"removed"`
+}
+
+// PostMessageRequest is the body of POST /api/rooms/{room}/messages
+type PostMessageRequest struct {
+	// From is who the message is from, for callers whose credentials
+	// don't fix their username
+	From string `json:"from,omitempty"`
+	Text string `json:"text"`
+}
+
+// apiOperation describes an endpoint of the REST or admin API for the
+// OpenAPI document
+type apiOperation struct {
+	id, method, path, summary string
+	params                    []apiParam
+	// body is the JSON request body's type, if any
+	body any
+	// response is the type of the JSON response, nil for 204 No Content;
+	// responseTypes lists the content types of other responses
+	response      any
+	responseTypes []string
+	admin         bool
+}
+
+// apiParam is a path or query parameter
+type apiParam struct {
+	name, in, kind, description string
+	required                    bool
+	enum                        []string
+}
+
+// queryParam and pathParam describe parameters; kind is an OpenAPI type,
+// or int64 for an integer of that format
+func queryParam(name, kind, description string) apiParam {
+	return apiParam{name: name, in: "query", kind: kind, description: description}
+}
+
+func pathParam(name, description string) apiParam {
+	return apiParam{name: name, in: "path", kind: "string", description: description, required: true}
+}
+
+// asRequired and oneOf return a copy of p that must be given, or must be
+// one of values
+func (p apiParam) asRequired() apiParam {
+	p.required = true
+	return p
+}
+
+func (p apiParam) oneOf(values ...string) apiParam {
+	p.enum = values
+	return p
+}
+
+// apiOperations are the endpoints of APIHandler and AdminHandler. Keep
+// them in step with the handlers; the OpenAPI document and the chatapi
+// client are generated from them.
+var apiOperations = []apiOperation{
+	{id: "listRooms", method: http.MethodGet, path: "/api/rooms",
+		summary: "List the rooms and how many users are in each", response: []RoomInfo{}},
+	{id: "listMessages", method: http.MethodGet, path: "/api/rooms/{room}/messages",
+		summary: "List a room's latest messages, oldest first, or those before a message ID",
+		params: []apiParam{
+			pathParam("room", "Room name"),
+			queryParam("limit", "integer", "Most messages to return, 50 by default and at most 1000"),
+			queryParam("before", "int64", "Only return messages before this message ID"),
+		},
+		response: []Message{}},
+	{id: "postMessage", method: http.MethodPost, path: "/api/rooms/{room}/messages",
+		summary: "Post a message to a room as the caller, or as from for the admin and callers whose credentials don't fix their username",
+		params:  []apiParam{pathParam("room", "Room name")},
+		body:    PostMessageRequest{}},
+	{id: "listUsers", method: http.MethodGet, path: "/api/users",
+		summary:  "List the users connected here and to other instances",
+		params:   []apiParam{queryParam("room", "string", "Only list the users in this room")},
+		response: []APIUser{}},
+
+	{id: "listClients", method: http.MethodGet, path: "/admin/clients", admin: true,
+		summary: "List the clients connected to this instance", response: []ClientInfo{}},
+	{id: "kickClient", method: http.MethodDelete, path: "/admin/clients", admin: true,
+		summary: "Kick a user, telling them and everyone else why",
+		params: []apiParam{
+			queryParam("user", "string", "Username").asRequired(),
+			queryParam("reason", "string", "Reason given to everyone"),
+		}},
+	{id: "disconnectClient", method: http.MethodPost, path: "/admin/disconnect", admin: true,
+		summary: "Quietly close a user's connection",
+		params: []apiParam{
+			queryParam("user", "string", "Username").asRequired(),
+			queryParam("reason", "string", "Reason sent in the close frame"),
+		}},
+	{id: "getStats", method: http.MethodGet, path: "/admin/stats", admin: true,
+		summary: "Show the server's statistics", response: Stats{}},
+	{id: "exportRoom", method: http.MethodGet, path: "/admin/export", admin: true,
+		summary: "Export a room's history as a JSON array of messages or as CSV",
+		params: []apiParam{
+			queryParam("room", "string", "Room name, the default room if not given"),
+			queryParam("format", "string", "Export format, json by default").oneOf("json", "csv"),
+		},
+		responseTypes: []string{"application/json", "text/csv"}},
+	{id: "eraseUser", method: http.MethodPost, path: "/admin/erase", admin: true,
+		summary: "Delete or anonymize everything stored about a user",
+		params: []apiParam{
+			queryParam("user", "string", "Username").asRequired(),
+			queryParam("mode", "string", "What to do with their messages, delete by default").oneOf("delete", "anonymize"),
+		},
+		response: EraseResult{}},
+	{id: "listBans", method: http.MethodGet, path: "/admin/bans", admin: true,
+		summary: "List the active bans", response: []Ban{}},
+	{id: "addBan", method: http.MethodPost, path: "/admin/bans", admin: true,
+		summary: "Ban a username, an IP address or both, disconnecting them",
+		params: []apiParam{
+			queryParam("user", "string", "Username to ban"),
+			queryParam("ip", "string", "IP address to ban"),
+			queryParam("reason", "string", "Reason given to the banned user"),
+			queryParam("duration", "string", "How long the ban lasts, e.g. 24h or 7d; permanent if not given"),
+		},
+		response: Ban{}},
+	{id: "removeBans", method: http.MethodDelete, path: "/admin/bans", admin: true,
+		summary: "Lift the bans on a username or IP address",
+		params: []apiParam{
+			queryParam("user", "string", "Username to unban"),
+			queryParam("ip", "string", "IP address to unban"),
+		},
+		response: BansRemoved{}},
+	{id: "listShadowbans", method: http.MethodGet, path: "/admin/shadowbans", admin: true,
+		summary: "List the shadowbanned users", response: []string{}},
+	{id: "addShadowban", method: http.MethodPost, path: "/admin/shadowbans", admin: true,
+		summary: "Shadowban a user", params: []apiParam{queryParam("user", "string", "Username").asRequired()}},
+	{id: "removeShadowban", method: http.MethodDelete, path: "/admin/shadowbans", admin: true,
+		summary: "Lift a shadowban", params: []apiParam{queryParam("user", "string", "Username").asRequired()}},
+	{id: "announce", method: http.MethodPost, path: "/admin/announce", admin: true,
+		summary: "Send a highlighted notice to everyone on the server",
+		params:  []apiParam{queryParam("text", "string", "Notice").asRequired()}},
+	{id: "sendMessage", method: http.MethodPost, path: "/admin/messages", admin: true,
+		summary: "Send a server message to one user, one room, or everyone as a system notice",
+		params: []apiParam{
+			queryParam("user", "string", "Username to send to"),
+			queryParam("room", "string", "Room to send to"),
+			queryParam("text", "string", "Message").asRequired(),
+		}},
+	{id: "listAuditEvents", method: http.MethodGet, path: "/admin/audit", admin: true,
+		summary:  "List the latest security audit events, oldest first",
+		params:   []apiParam{queryParam("limit", "integer", "Most events to return, 100 by default")},
+		response: []AuditEvent{}},
+}
+
+// openAPIDocument is built once, the first time it's asked for
+var openAPIDocument = sync.OnceValue(func() []byte {
+	spec, err := json.MarshalIndent(buildOpenAPI(), "", "  ")
+	if err != nil {
+		panic(err)
+	}
+	return append(spec, '\n')
+})
+
+// OpenAPI returns the OpenAPI 3 document describing the REST and admin
+// APIs, as JSON
+func OpenAPI() []byte {
+	return openAPIDocument()
+}
+
+// handleOpenAPI serves the OpenAPI document, which needs no credentials.
+// GET /api/openapi.json
+func (s *Server) handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(OpenAPI())
+}
+
+// buildOpenAPI describes apiOperations as an OpenAPI document, with a
+// schema for each Go type they use
+func buildOpenAPI() map[string]any {
+	schemas := map[string]any{}
+	paths := map[string]map[string]any{}
+	for _, op := range apiOperations {
+		operation := map[string]any{
+			"operationId": op.id,
+			"summary":     op.summary,
+			"tags":        []string{"api"},
+			"security":    []map[string][]string{{"bearer": {}}},
+		}
+		if op.admin {
+			operation["tags"] = []string{"admin"}
+		}
+		var params []map[string]any
+		for _, p := range op.params {
+			schema := map[string]any{"type": p.kind}
+			if p.kind == "int64" {
+				schema = map[string]any{"type": "integer", "format": "int64"}
+			}
+			if p.enum != nil {
+				schema["enum"] = p.enum
+			}
+			params = append(params, map[string]any{
+				"name": p.name, "in": p.in, "description": p.description, "required": p.required, "schema": schema,
+			})
+		}
+		if params != nil {
+			operation["parameters"] = params
+		}
+		if op.body != nil {
+			operation["requestBody"] = map[string]any{
+				"required": true,
+				"content":  map[string]any{"application/json": map[string]any{"schema": openAPISchema(reflect.TypeOf(op.body), schemas)}},
+			}
+		}
+
+		errorResponse := map[string]any{
+			"description": "An error, explained in plain text",
+			"content":     map[string]any{"text/plain": map[string]any{"schema": map[string]any{"type": "string"}}},
+		}
+		responses := map[string]any{"default": errorResponse}
+		switch {
+		case op.response != nil:
+			responses["200"] = map[string]any{
+				"description": "OK",
+				"content":     map[string]any{"application/json": map[string]any{"schema": openAPISchema(reflect.TypeOf(op.response), schemas)}},
+			}
+		case op.responseTypes != nil:
+			content := map[string]any{}
+			for _, contentType := range op.responseTypes {
+				content[contentType] = map[string]any{"schema": map[string]any{"type": "string", "format": "binary"}}
+			}
+			responses["200"] = map[string]any{"description": "OK", "content": content}
+		default:
+			responses["204"] = map[string]any{"description": "Done"}
+		}
+		operation["responses"] = responses
+
+		if paths[op.path] == nil {
+			paths[op.path] = map[string]any{}
+		}
+		paths[op.path][strings.ToLower(op.method)] = operation
+	}
+
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":       "go-chat",
+			"description": "REST API for rooms, messages and users, and the admin API. The REST API takes the admin token or credentials accepted for connecting; the admin API only the admin token.",
+			"version":     openAPIVersion,
+		},
+		"paths": paths,
+		"components": map[string]any{
+			"schemas":         schemas,
+			"securitySchemes": map[string]any{"bearer": map[string]any{"type": "http", "scheme": "bearer"}},
+		},
+	}
+}
+
+// openAPISchema returns the schema of t, adding the schemas of the structs
+// it uses to schemas and referring to them by their Go names
+func openAPISchema(t reflect.Type, schemas map[string]any) map[string]any {
+	if t == reflect.TypeFor[time.Time]() {
+		return map[string]any{"type": "string", "format": "date-time"}
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int32:
+		return map[string]any{"type": "integer", "format": "int32"}
+	case reflect.Int64:
+		return map[string]any{"type": "integer", "format": "int64"}
+	case reflect.Float64:
+		return map[string]any{"type": "number", "format": "double"}
+	case reflect.Slice:
+		return map[string]any{"type": "array", "items": openAPISchema(t.Elem(), schemas)}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": openAPISchema(t.Elem(), schemas)}
+	case reflect.Struct:
+		ref := map[string]any{"$ref": "#/components/schemas/" + t.Name()}
+		if _, ok := schemas[t.Name()]; ok {
+			return ref
+		}
+		// Placeholder, in case the struct refers to itself
+		schemas[t.Name()] = nil
+		properties := map[string]any{}
+		var required []string
+		for i := range t.NumField() {
+			field := t.Field(i)
+			name, options, _ := strings.Cut(field.Tag.Get("json"), ",")
+			if !field.IsExported() || name == "-" {
+				continue
+			}
+			if name == "" {
+				name = field.Name
+			}
+			properties[name] = openAPISchema(field.Type, schemas)
+			if !strings.Contains(options, "omitempty") && !strings.Contains(options, "omitzero") {
+				required = append(required, name)
+			}
+		}
+		schema := map[string]any{"type": "object", "properties": properties}
+		if required != nil {
+			schema["required"] = required
+		}
+		schemas[t.Name()] = schema
+		return ref
+	}
+	panic("no OpenAPI schema for " + t.String())
+}
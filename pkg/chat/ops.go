@@ -0,0 +1,80 @@
+// pkg/chat/ops.go
+package chat
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrNoAccount is returned when a role change targets an unregistered user
+var ErrNoAccount = errors.New("user has no registered account")
+
+// SetRole changes a registered user's role, stores it with their account
+// and applies it to their connection if they're online. Roles granted by
+// the authenticator (JWT claims, LDAP groups) still apply on top of it the
+// next time the user connects.
+func (s *Server) SetRole(username string, role Role, by string) (User, error) {
+	account, err := s.Users.GetUser(username)
+	if errors.Is(err, ErrUserNotFound) {
+		return User{}, ErrNoAccount
+	}
+	if err != nil {
+		return User{}, err
+	}
+
+	old := account.Role
+	account.Role = role
+	if err := s.Users.UpdateUser(account); err != nil {
+		return User{}, err
+	}
+
+	if client := s.clients.lookup(account.Username); client != nil {
+		s.clients.update(client, func() { client.Role = role })
+	}
+
+	s.log.Info("Role changed", "username", account.Username, "by", by, "old", old, "new", role)
+	s.audit(AuditRoleChange, by, account.Username, "", fmt.Sprintf("%s -> %s", old, role))
+	return account, nil
+}
+
+// handleOp implements /op <user> and /deop <user>, which make a registered
+// user a moderator or a regular user again
+func (c *Session) handleOp(args string, role Role) {
+	cmd := "/op"
+	if role != RoleModerator {
+		cmd = "/deop"
+	}
+	if !c.can(permAdminister) {
+		c.send("Only admins can change roles.")
+		return
+	}
+
+	target := strings.TrimSpace(args)
+	if target == "" {
+		c.send(fmt.Sprintf("Usage: %s <username>", cmd))
+		return
+	}
+	if sameUsername(target, c.Username) {
+		c.send("You cannot change your own role.")
+		return
+	}
+
+	account, err := c.Server.SetRole(target, role, c.Username)
+	if errors.Is(err, ErrNoAccount) {
+		c.send(fmt.Sprintf(
+			"%s has no registered account. They need to /register first.", target))
+		return
+	}
+	if err != nil {
+		c.logger().Error("Error changing role", "target", target, "err", err)
+		c.send("Role change failed, please try again.")
+		return
+	}
+
+	if role == RoleModerator {
+		c.Server.broadcastMessage(fmt.Sprintf("*** %s is now a moderator (by %s) ***", account.Username, c.Username))
+	} else {
+		c.Server.broadcastMessage(fmt.Sprintf("*** %s is no longer a moderator (by %s) ***", account.Username, c.Username))
+	}
+}
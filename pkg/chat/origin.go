@@ -0,0 +1,63 @@
+// pkg/chat/origin.go
+package chat
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// AllOrigins in Config.AllowedOrigins lets any web page connect
+const AllOrigins = "*"
+
+// checkOrigin decides whether a browser page may open a WebSocket. Requests
+// without an Origin header (non-browser clients such as chat-client) and
+// same-origin requests are always allowed; anything else must match
+// Config.AllowedOrigins.
+func (s *Server) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		s.requestLogger(r).Warn("Rejected malformed origin", "origin", origin)
+		return false
+	}
+	if strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+
+	for _, pattern := range s.config().AllowedOrigins {
+		if originMatches(pattern, u) {
+			return true
+		}
+	}
+	s.requestLogger(r).Warn("Rejected origin", "origin", origin)
+	return false
+}
+
+// originMatches reports whether an origin matches an allowlist entry. An
+// entry is "*", a full origin ("https://chat.example.com"), a host with or
+// without port ("chat.example.com", "localhost:3000"), or a wildcard
+// subdomain ("*.example.com", which doesn't match example.com itself).
+func originMatches(pattern string, origin *url.URL) bool {
+	pattern = strings.ToLower(strings.TrimSpace(pattern))
+	host := strings.ToLower(origin.Host)
+
+	if pattern == AllOrigins {
+		return true
+	}
+	if strings.Contains(pattern, "://") {
+		return pattern == strings.ToLower(origin.Scheme)+"://"+host
+	}
+	if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+		hostname := strings.ToLower(origin.Hostname())
+		return strings.HasSuffix(hostname, "."+suffix)
+	}
+	if strings.Contains(pattern, ":") {
+		return pattern == host
+	}
+	return pattern == strings.ToLower(origin.Hostname())
+}
@@ -0,0 +1,283 @@
+// pkg/chat/outbox.go
+package chat
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// SlowClientPolicy is what happens to a client that falls
+// Config.SendQueueSize messages behind, rather than holding up everyone
+// sending to it
+type SlowClientPolicy string
+
+// Slow client policies
+const (
+	// SlowClientDisconnect closes the connection with code 1013 (try again
+	// later) and a "too slow" reason
+	SlowClientDisconnect SlowClientPolicy = "disconnect"
+	// SlowClientDropOldest drops the oldest queued message to make room
+	SlowClientDropOldest SlowClientPolicy = "drop-oldest"
+	// SlowClientDropNewest drops messages until there is room again
+	SlowClientDropNewest SlowClientPolicy = "drop-newest"
+)
+
+// ParseSlowClientPolicy returns the policy named s
+func ParseSlowClientPolicy(s string) (SlowClientPolicy, error) {
+	switch policy := SlowClientPolicy(s); policy {
+	case SlowClientDisconnect, SlowClientDropOldest, SlowClientDropNewest:
+		return policy, nil
+	}
+	return "", fmt.Errorf("unknown slow client policy %q (want %s, %s or %s)", s, SlowClientDisconnect, SlowClientDropOldest, SlowClientDropNewest)
+}
+
+// Reasons send fails
+var (
+	errClientClosed   = errors.New("client is disconnecting")
+	errClientSlow     = errors.New("client is too slow, disconnecting")
+	errMessageDropped = errors.New("client is too slow, message dropped")
+)
+
+// outbound is an entry in a client's outbox: a text message, or a request
+// to stop writing. A broadcast message also carries prepared, its frame
+// built once for every recipient. A stop writes frame (a close frame) if
+// set, then hangs up if hangUp is set.
+type outbound struct {
+	text     string
+	prepared *websocket.PreparedMessage
+	stop     bool
+	frame    []byte
+	hangUp   bool
+}
+
+// send queues a text message for the client's write pump. It never blocks,
+// so it may be called from any goroutine whatever locks it holds; what
+// happens when the client's queue is full depends on SlowClientPolicy.
+func (c *Session) send(message string) error {
+	return c.queue(outbound{text: message})
+}
+
+// queue adds msg to the client's outbox, as described for send. The outbox
+// is full when it holds Config.SendQueueSize messages or
+// Config.SendQueueBytes bytes.
+func (c *Session) queue(msg outbound) error {
+	if c.closing.Load() {
+		return errClientClosed
+	}
+	if c.tryQueue(msg) {
+		return nil
+	}
+
+	policy := c.Server.config().SlowClientPolicy
+	switch policy {
+	case SlowClientDropOldest:
+		for {
+			select {
+			case old := <-c.outbox:
+				if old.stop {
+					// The client started closing meanwhile; let that go ahead
+					c.stopInBackground(old)
+					return errClientClosed
+				}
+				c.queuedBytes.Add(-int64(len(old.text)))
+				c.fellBehind(policy)
+			default:
+				// The write pump or another sender got there first
+				c.fellBehind(policy)
+				return errMessageDropped
+			}
+			if c.tryQueue(msg) {
+				return nil
+			}
+		}
+	case SlowClientDropNewest:
+		c.fellBehind(policy)
+		return errMessageDropped
+	default:
+		if c.closeWith(websocket.CloseTryAgainLater, "too slow", true) {
+			c.Server.slowClients.Add(1)
+			c.Server.log.Warn("Client fell behind, disconnecting", "username", c.Username, "remote_addr", c.IP,
+				"policy", SlowClientDisconnect, "queued", len(c.outbox), "queued_bytes", c.queuedBytes.Load())
+		}
+		return errClientSlow
+	}
+}
+
+// tryQueue adds msg to the outbox if there is room for it. A message
+// bigger than Config.SendQueueBytes only fits in an empty outbox, and
+// while the server is over Config.MaxQueuedBytes only an empty outbox
+// has room.
+func (c *Session) tryQueue(msg outbound) bool {
+	size := int64(len(msg.text))
+	queued := c.queuedBytes.Add(size)
+	if queued > size && (queued > int64(c.Server.Config.SendQueueBytes) || c.Server.overQueueBudget()) {
+		c.queuedBytes.Add(-size)
+		return false
+	}
+	select {
+	case c.outbox <- msg:
+		c.wake()
+		return true
+	default:
+		c.queuedBytes.Add(-size)
+		return false
+	}
+}
+
+// fellBehind counts a message dropped for the client under policy, logging
+// it the first time since the client last caught up
+func (c *Session) fellBehind(policy SlowClientPolicy) {
+	c.dropped.Add(1)
+	c.Server.dropped.Add(1)
+	if c.behind.CompareAndSwap(false, true) {
+		c.Server.slowClients.Add(1)
+		c.Server.log.Warn("Client fell behind, dropping messages", "username", c.Username, "remote_addr", c.IP,
+			"policy", policy, "queued", len(c.outbox), "queued_bytes", c.queuedBytes.Load())
+	}
+}
+
+// closeWith queues a close frame after the messages already queued, and
+// then hangs up if hangUp is set. Nothing more is sent to the client
+// afterwards. If the queue is full the frame is sent straight away instead.
+// It reports whether the client was not already closing.
+func (c *Session) closeWith(code int, reason string, hangUp bool) bool {
+	if !c.closing.CompareAndSwap(false, true) {
+		return false
+	}
+	stop := outbound{stop: true, frame: websocket.FormatCloseMessage(code, reason), hangUp: hangUp}
+	select {
+	case c.outbox <- stop:
+		c.wake()
+	default:
+		c.stopInBackground(stop)
+	}
+	return true
+}
+
+// stopInBackground carries out a stop without waiting for the write pump.
+// WriteControl is safe alongside the write pump, but may take a second, so
+// it's done in another goroutine.
+func (c *Session) stopInBackground(stop outbound) {
+	go func() {
+		if stop.frame != nil {
+			c.conn.WriteControl(websocket.CloseMessage, stop.frame, time.Now().Add(time.Second))
+		}
+		if stop.hangUp {
+			c.conn.Close()
+		}
+	}()
+}
+
+// stopWriting writes what is queued and stops the write pump, so that the
+// connection can be written directly again. It is for turning away a
+// client that was never registered.
+func (c *Session) stopWriting() {
+	c.closing.Store(true)
+	select {
+	case c.outbox <- outbound{stop: true}:
+		c.wake()
+	case <-c.written:
+	}
+	<-c.written
+}
+
+// write writes the messages in batch, in one frame if there are several
+func (c *Session) write(batch []outbound) error {
+	cfg := &c.Server.Config
+	c.conn.SetWriteDeadline(time.Now().Add(cfg.WriteTimeout))
+	var err error
+	switch msg := batch[0]; {
+	case len(batch) > 1:
+		err = c.writeBatch(batch)
+	case msg.prepared != nil && writesPrepared(c.conn):
+		compressAbove(c.conn, len(msg.text), cfg.CompressionThreshold)
+		err = c.conn.WritePreparedMessage(msg.prepared)
+	default:
+		compressAbove(c.conn, len(msg.text), cfg.CompressionThreshold)
+		err = writeText(c.conn, msg.text)
+	}
+	if err != nil {
+		return err
+	}
+	for _, msg := range batch {
+		c.sentMessages.Add(1)
+		c.sentBytes.Add(int64(len(msg.text)))
+		c.queuedBytes.Add(-int64(len(msg.text)))
+	}
+	return nil
+}
+
+// stopNow carries out a stop from the outbox
+func (c *Session) stopNow(stop outbound) {
+	if stop.frame != nil {
+		c.conn.WriteControl(websocket.CloseMessage, stop.frame, time.Now().Add(time.Second))
+	}
+	if stop.hangUp {
+		c.conn.Close()
+	}
+}
+
+// writeNext writes msg, with whatever is batched with it, or carries it out
+// if it is a stop. It reports whether to carry on writing.
+func (c *Session) writeNext(batch []outbound, msg outbound) bool {
+	if msg.stop {
+		c.stopNow(msg)
+		return false
+	}
+	batch, stop := c.collectBatch(batch[:0], msg)
+	if err := c.write(batch); err != nil {
+		c.Server.log.Debug("Error writing to client", "username", c.Username, "remote_addr", c.IP, "err", err)
+		c.closing.Store(true)
+		c.conn.Close()
+		return false
+	}
+	if stop != nil {
+		c.stopNow(*stop)
+		return false
+	}
+	if len(c.outbox) == 0 && c.behind.CompareAndSwap(true, false) {
+		c.Server.log.Info("Client caught up", "username", c.Username, "remote_addr", c.IP, "dropped", c.dropped.Load())
+	}
+	return true
+}
+
+// ping pings the client, closing the connection if that fails
+func (c *Session) ping() bool {
+	if err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(c.Server.Config.WriteTimeout)); err != nil {
+		c.closing.Store(true)
+		c.conn.Close()
+		return false
+	}
+	return true
+}
+
+// writePump is the only goroutine writing messages to the connection: it
+// writes the queued messages in order and pings the client, until a stop,
+// a failed write, or ReadPump finishing. A failed write closes the
+// connection, which ends ReadPump too.
+func (c *Session) writePump() {
+	defer close(c.written)
+	defer c.recoverPanic("write_pump")
+	cfg := &c.Server.Config
+	ticker := time.NewTicker(cfg.PingInterval)
+	defer ticker.Stop()
+	batch := make([]outbound, 0, max(cfg.BatchSize, 1))
+
+	for {
+		select {
+		case msg := <-c.outbox:
+			if !c.writeNext(batch, msg) {
+				return
+			}
+		case <-ticker.C:
+			if !c.ping() {
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
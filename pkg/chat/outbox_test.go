@@ -0,0 +1,395 @@
+// pkg/chat/outbox_test.go
+package chat
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// TestChurnUnderLoad connects and disconnects clients, moves them between
+// rooms and kicks them while others chat and the server is listed and
+// broadcast to, then shuts down. Run it with -race.
+func TestChurnUnderLoad(t *testing.T) {
+	churnUnderLoad(t, Config{HistorySize: 20})
+}
+
+// churnUnderLoad runs TestChurnUnderLoad on a server with cfg
+func churnUnderLoad(t *testing.T, cfg Config) {
+	s, url := newTestServer(t, cfg)
+
+	const (
+		talkers   = 4
+		messages  = 100
+		churners  = 8
+		churnRuns = 20
+	)
+	var wg sync.WaitGroup
+	errs := make(chan error, talkers+churners)
+
+	for i := 0; i < talkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, err := connect(url, fmt.Sprintf("talker-%d", i))
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer conn.Close()
+			go drain(conn)
+			for j := 0; j < messages; j++ {
+				text := fmt.Sprintf("message %d from talker %d", j, i)
+				if j%25 == 0 {
+					text = fmt.Sprintf("/join room-%d", j%3)
+				}
+				if err := conn.WriteMessage(websocket.TextMessage, []byte(text)); err != nil {
+					errs <- fmt.Errorf("talker %d: %w", i, err)
+					return
+				}
+				time.Sleep(time.Millisecond)
+			}
+		}()
+	}
+
+	for i := 0; i < churners; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < churnRuns; j++ {
+				conn, err := connect(url, fmt.Sprintf("churn-%d-%d", i, j))
+				if err != nil {
+					// Kicked before the welcome arrived
+					if websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+						continue
+					}
+					errs <- err
+					return
+				}
+				go drain(conn)
+				for _, text := range []string{"/join room-1", "hello", "/users", "/rooms"} {
+					conn.WriteMessage(websocket.TextMessage, []byte(text))
+				}
+				if j%2 == 0 {
+					conn.WriteControl(websocket.CloseMessage,
+						websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+				}
+				conn.Close()
+			}
+		}()
+	}
+
+	stop := make(chan struct{})
+	var admin sync.WaitGroup
+	admin.Add(1)
+	go func() {
+		defer admin.Done()
+		for n := 0; ; n++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			s.deliverToAll(fmt.Sprintf("notice %d", n))
+			s.GetClientList()
+			s.GetRoomList()
+			s.ClientInfos()
+			if _, err := s.Stats(); err != nil {
+				t.Error(err)
+			}
+			s.KickUser(fmt.Sprintf("churn-%d-%d", rand.Intn(churners), rand.Intn(churnRuns)), "churn", "test")
+			// Fast enough to overlap everything else, but not so fast that
+			// clients are disconnected for falling behind
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	finished := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(60 * time.Second):
+		t.Fatal("clients still running after 60s; the server is probably deadlocked")
+	}
+	close(stop)
+	admin.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	if !waitFor(5*time.Second, func() bool { return s.ClientCount() == 0 }) {
+		t.Errorf("%d clients still registered after Shutdown", s.ClientCount())
+	}
+}
+
+// TestSlowClientDoesNotBlockOthers fills the queue of a client that never
+// reads: sending to it must not block, and it must be disconnected while
+// everyone else still gets their messages
+func TestSlowClientDoesNotBlockOthers(t *testing.T) {
+	s, url := newTestServer(t, Config{})
+
+	slow, err := connect(url, "slow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slow.Close()
+	fast, err := connect(url, "fast")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fast.Close()
+
+	client := s.clientByName("slow")
+	if client == nil {
+		t.Fatal("slow client not registered")
+	}
+	big := strings.Repeat("x", 64<<10)
+	start := time.Now()
+	for i := 0; ; i++ {
+		err := client.send(big)
+		if err == errClientSlow || err == errClientClosed {
+			break
+		}
+		if err != nil {
+			t.Fatalf("send: %v", err)
+		}
+		if i > 100000 {
+			t.Fatal("queue never filled up")
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("filling the queue took %s; sends are blocking", elapsed)
+	}
+
+	if !waitFor(5*time.Second, func() bool { return s.clientByName("slow") == nil }) {
+		t.Error("slow client was not disconnected")
+	}
+
+	s.deliverToAll("still here")
+	fast.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		_, message, err := fast.ReadMessage()
+		if err != nil {
+			t.Fatalf("fast client: %v", err)
+		}
+		if string(message) == "still here" {
+			break
+		}
+	}
+}
+
+// TestKickNoticeBeforeClose checks that a kicked client gets the notice
+// queued for it before the close frame ends the connection
+func TestKickNoticeBeforeClose(t *testing.T) {
+	s, url := newTestServer(t, Config{})
+
+	conn, err := connect(url, "victim")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for i := 0; i < 10; i++ {
+		s.SendToUser("victim", fmt.Sprintf("message %d", i))
+	}
+	if !s.KickUser("victim", "testing", "admin") {
+		t.Fatal("victim not connected")
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var got []string
+	for {
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			if !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+				t.Errorf("expected a policy violation close, got %v", err)
+			}
+			break
+		}
+		got = append(got, string(message))
+	}
+	// After the join notice come the messages, then the kick notice
+	if len(got) != 12 || got[10] != "message 9" || got[11] != "*** You were kicked by admin: testing ***" {
+		t.Errorf("messages before close = %q", got)
+	}
+	if s.clientByName("victim") != nil {
+		t.Error("victim still registered after KickUser returned")
+	}
+}
+
+// TestDropPolicies checks which messages a client that isn't being written
+// to keeps under each drop policy
+func TestDropPolicies(t *testing.T) {
+	const sent = DefaultSendQueueSize + 44
+	for _, tc := range []struct {
+		policy SlowClientPolicy
+		first  int
+	}{
+		{SlowClientDropOldest, sent - DefaultSendQueueSize},
+		{SlowClientDropNewest, 0},
+	} {
+		t.Run(string(tc.policy), func(t *testing.T) {
+			s, _ := newTestServer(t, Config{SlowClientPolicy: tc.policy})
+			client := &Session{Username: "slow", Server: s, outbox: make(chan outbound, DefaultSendQueueSize)}
+			for i := 0; i < sent; i++ {
+				err := client.send(fmt.Sprint(i))
+				if err != nil && err != errMessageDropped {
+					t.Fatalf("send %d: %v", i, err)
+				}
+			}
+			for i := tc.first; i < tc.first+DefaultSendQueueSize; i++ {
+				if msg := <-client.outbox; msg.text != fmt.Sprint(i) {
+					t.Fatalf("queued %q, want %d", msg.text, i)
+				}
+			}
+			if vars := s.Vars(); vars.SlowClients != 1 || vars.DroppedMessages != sent-DefaultSendQueueSize {
+				t.Errorf("slow clients %d, dropped %d; want 1 and %d", vars.SlowClients, vars.DroppedMessages, sent-DefaultSendQueueSize)
+			}
+			if client.closing.Load() {
+				t.Error("client was disconnected")
+			}
+		})
+	}
+}
+
+// TestBatching checks that a client asking for BatchProtocol gets queued
+// messages in batches that split back into the messages sent, newlines and
+// all, while other clients still get one message per frame
+func TestBatching(t *testing.T) {
+	s, url := newTestServer(t, Config{BatchSize: 10, BatchDelay: 50 * time.Millisecond})
+
+	dialer := websocket.Dialer{Subprotocols: []string{BatchProtocol}}
+	batched, _, err := dialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer batched.Close()
+	if batched.Subprotocol() != BatchProtocol {
+		t.Fatalf("negotiated %q", batched.Subprotocol())
+	}
+	batched.WriteMessage(websocket.TextMessage, []byte("batched"))
+	plain, err := connect(url, "plain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+
+	sent := []string{"one", "two\nlines", "", "three"}
+	if !waitFor(5*time.Second, func() bool { return s.clientByName("batched") != nil }) {
+		t.Fatal("batched client not registered")
+	}
+	for _, text := range sent {
+		s.SendToUser("batched", text)
+		s.SendToUser("plain", text)
+	}
+
+	read := func(conn *websocket.Conn, want int) (got []string, frames int) {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		for len(got) < want {
+			messageType, data, err := conn.ReadMessage()
+			if err != nil {
+				t.Fatal(err)
+			}
+			frames++
+			if messageType != websocket.BinaryMessage {
+				got = append(got, string(data))
+				continue
+			}
+			messages, err := SplitBatch(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, messages...)
+		}
+		return got, frames
+	}
+
+	// The batched client also has its welcome and the other's join notice
+	got, frames := read(batched, len(sent)+3)
+	if strings.Join(got[len(got)-len(sent):], "|") != strings.Join(sent, "|") {
+		t.Errorf("batched client got %q", got)
+	}
+	if frames >= len(got) {
+		t.Errorf("%d messages came in %d frames", len(got), frames)
+	}
+	// The plain client has its own join notice first
+	got, frames = read(plain, len(sent)+1)
+	if strings.Join(got[1:], "|") != strings.Join(sent, "|") || frames != len(got) {
+		t.Errorf("plain client got %q in %d frames", got, frames)
+	}
+}
+
+// TestSendQueueBytes checks that a client's outbox is full once it holds
+// SendQueueBytes, but always takes one message however big
+func TestSendQueueBytes(t *testing.T) {
+	s, _ := newTestServer(t, Config{SendQueueBytes: 1000, SlowClientPolicy: SlowClientDropNewest})
+	client := &Session{Username: "firehose", Server: s, outbox: make(chan outbound, DefaultSendQueueSize)}
+
+	line := strings.Repeat("x", 100)
+	for i := 0; i < 20; i++ {
+		client.send(line)
+	}
+	if queued := len(client.outbox); queued != 10 {
+		t.Errorf("queued %d messages of 100 bytes, want 10", queued)
+	}
+	if vars := s.Vars(); vars.DroppedMessages != 10 {
+		t.Errorf("dropped %d messages, want 10", vars.DroppedMessages)
+	}
+	for len(client.outbox) > 0 {
+		msg := <-client.outbox
+		client.queuedBytes.Add(-int64(len(msg.text)))
+	}
+
+	if err := client.send(strings.Repeat("x", 5000)); err != nil {
+		t.Errorf("sending a big message to an empty outbox: %v", err)
+	}
+	if err := client.send(line); err != errMessageDropped {
+		t.Errorf("sending after a big message: %v", err)
+	}
+	if got := client.queuedBytes.Load(); got != 5000 {
+		t.Errorf("queued %d bytes, want 5000", got)
+	}
+}
+
+// TestMaxQueuedBytes checks that once the server's clients have
+// Config.MaxQueuedBytes queued between them, clients with a backlog get
+// nothing more while those that have caught up still get messages
+func TestMaxQueuedBytes(t *testing.T) {
+	s, _ := newTestServer(t, Config{MaxQueuedBytes: 1000, SlowClientPolicy: SlowClientDropNewest})
+	behind := &Session{Username: "behind", Server: s, outbox: make(chan outbound, DefaultSendQueueSize)}
+	current := &Session{Username: "current", Server: s, outbox: make(chan outbound, DefaultSendQueueSize)}
+	s.clients.add(behind, 0, func() bool { return false }, nil)
+	s.clients.add(current, 0, func() bool { return false }, nil)
+
+	line := strings.Repeat("x", 100)
+	for i := 0; i < 10; i++ {
+		if err := behind.send(line); err != nil {
+			t.Fatalf("queueing under the limit: %v", err)
+		}
+	}
+	s.checkMemory([]memoryGauge{{name: "queued_bytes"}, {name: "history_messages"}})
+	if vars := s.Vars(); vars.QueuedBytes != 1000 {
+		t.Errorf("queued %d bytes, want 1000", vars.QueuedBytes)
+	}
+
+	if err := behind.send(line); err != errMessageDropped {
+		t.Errorf("sending to a client with a backlog over the limit: %v", err)
+	}
+	if err := current.send(line); err != nil {
+		t.Errorf("sending to a client that caught up over the limit: %v", err)
+	}
+}
@@ -0,0 +1,85 @@
+// pkg/chat/private.go
+package chat
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// privateHistoryLimit caps how many messages /pm-history returns
+const privateHistoryLimit = 50
+
+// privateRoom returns the store key for the conversation between two users.
+// The key is the same regardless of argument order and is hashed so the
+// participants' names don't appear in it.
+func privateRoom(a, b string) string {
+	a, b = userKey(a), userKey(b)
+	if b < a {
+		a, b = b, a
+	}
+	sum := sha256.Sum256([]byte(a + "\n" + b))
+	return "pm:" + hex.EncodeToString(sum[:16])
+}
+
+// recordPrivateMessage stores a delivered whisper in the private store
+func (s *Server) recordPrivateMessage(ctx context.Context, from, to, text string) {
+	_, err := appendMessage(ctx, s.PrivateStore, Message{
+		Room: privateRoom(from, to),
+		From: from,
+		To:   to,
+		Text: text,
+		Time: time.Now(),
+	})
+	if err != nil {
+		s.log.Error("Error storing private message", "username", from, "err", err)
+	}
+	s.export(ExportEvent{Type: ExportPrivateMessage, Username: from, Target: to, Text: text})
+}
+
+// PrivateHistory returns the most recent private messages exchanged between
+// username and other. Callers must only pass the requesting user as
+// username, once they have proven the name is theirs by logging in or
+// through the authenticator: anyone may connect under a name that isn't
+// registered. The conversation key is derived from both participants, so
+// one user can never read a conversation they weren't part of.
+func (s *Server) PrivateHistory(username, other string, limit int) ([]Message, error) {
+	return s.PrivateStore.Recent(privateRoom(username, other), limit)
+}
+
+// handlePrivateHistory implements /pm-history <user>
+func (c *Session) handlePrivateHistory(args string) {
+	other := strings.TrimSpace(args)
+	if other == "" || strings.ContainsAny(other, " \t") {
+		c.send("Usage: /pm-history <username>")
+		return
+	}
+	// Anyone could have connected under an unregistered name, so only
+	// proven names get their history
+	if !c.LoggedIn && !c.Authenticated {
+		c.send("Only registered users can read their private message history. Use /register <password> first.")
+		return
+	}
+
+	messages, err := c.Server.PrivateHistory(c.Username, other, privateHistoryLimit)
+	if err != nil {
+		c.logger().Error("Error loading private history", "err", err)
+		c.send("Could not load private message history")
+		return
+	}
+	if len(messages) == 0 {
+		c.send(fmt.Sprintf("No private messages with %s", other))
+		return
+	}
+
+	var history strings.Builder
+	fmt.Fprintf(&history, "--- Private messages with %s (last %d) ---\n", other, len(messages))
+	for _, msg := range messages {
+		fmt.Fprintf(&history, "[%s] %s -> %s: %s\n", msg.Time.Format("Jan 2 15:04"), msg.From, msg.To, msg.Text)
+	}
+	history.WriteString("--- End of private messages ---")
+	c.send(history.String())
+}
@@ -0,0 +1,55 @@
+// pkg/chat/private_test.go
+package chat
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// TestPrivateHistoryNeedsProof checks that /pm-history is refused to
+// someone who reconnects under a whisperer's unregistered name, and allowed
+// to users who logged in or whose token named them
+func TestPrivateHistoryNeedsProof(t *testing.T) {
+	auth := &TokenAuth{SharedSecret: "s3cret", UserTokens: map[string]string{"bob-token": "bob"}}
+	s, url := newTestServer(t, Config{Auth: auth})
+	// join connects with token as username and returns the connection with
+	// the lines it reads
+	join := func(token, username string) (*websocket.Conn, <-chan string) {
+		t.Helper()
+		conn, _, err := websocket.DefaultDialer.Dial(url, http.Header{"Authorization": {"Bearer " + token}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		conn.WriteMessage(websocket.TextMessage, []byte(username))
+		lines := readLines(conn)
+		waitLine(t, lines, "Welcome", "")
+		return conn, lines
+	}
+
+	alice, aliceLines := join("s3cret", "alice")
+	alice.WriteMessage(websocket.TextMessage, []byte("/register correct-horse"))
+	waitLine(t, aliceLines, "Registered alice", "")
+	bob, bobLines := join("bob-token", "bob")
+	carol, carolLines := join("s3cret", "carol")
+	alice.WriteMessage(websocket.TextMessage, []byte("/whisper bob for bob"))
+	waitLine(t, bobLines, "for bob", "")
+	alice.WriteMessage(websocket.TextMessage, []byte("/whisper carol for carol"))
+	waitLine(t, carolLines, "for carol", "")
+	carol.Close()
+	if !waitFor(5*time.Second, func() bool { return !connected(s, "carol") }) {
+		t.Fatal("carol still connected")
+	}
+
+	mallory, malloryLines := join("s3cret", "carol")
+	mallory.WriteMessage(websocket.TextMessage, []byte("/pm-history alice"))
+	waitLine(t, malloryLines, "Only registered users can read their private message history.", "for carol")
+
+	bob.WriteMessage(websocket.TextMessage, []byte("/pm-history alice"))
+	waitLine(t, bobLines, "alice -> bob: for bob", "Only registered users")
+	alice.WriteMessage(websocket.TextMessage, []byte("/pm-history carol"))
+	waitLine(t, aliceLines, "alice -> carol: for carol", "Only registered users")
+}
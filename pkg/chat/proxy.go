@@ -0,0 +1,115 @@
+// pkg/chat/proxy.go
+package chat
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// proxyList is a parsed Config.TrustedProxies
+type proxyList []*net.IPNet
+
+// parseProxies parses IP addresses and CIDR ranges. Invalid entries are
+// skipped and reported in the error.
+func parseProxies(entries []string) (proxyList, error) {
+	var list proxyList
+	var errs []error
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if _, network, err := net.ParseCIDR(entry); err == nil {
+			list = append(list, network)
+			continue
+		}
+		ip := net.ParseIP(entry)
+		if ip == nil {
+			errs = append(errs, fmt.Errorf("invalid trusted proxy %q", entry))
+			continue
+		}
+		bits := 8 * net.IPv6len
+		if v4 := ip.To4(); v4 != nil {
+			ip, bits = v4, 8*net.IPv4len
+		}
+		list = append(list, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+	}
+	return list, errors.Join(errs...)
+}
+
+// setProxies replaces the trusted proxies
+func (s *Server) setProxies(entries []string) {
+	list, err := parseProxies(entries)
+	if err != nil {
+		s.log.Warn("Ignoring trusted proxies", "err", err)
+	}
+	s.proxies.Store(&list)
+}
+
+// trustedProxy reports whether ip is one of Config.TrustedProxies
+func (s *Server) trustedProxy(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, network := range *s.proxies.Load() {
+		if network.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the request's source IP. X-Forwarded-For, or failing
+// that X-Real-IP, is only believed when the direct peer is one of
+// Config.TrustedProxies, or a local reverse proxy connected over a unix
+// socket (which has no IP).
+func (s *Server) clientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	if net.ParseIP(ip) != nil && !s.trustedProxy(ip) {
+		return ip
+	}
+
+	// Take the last address in the chain that our proxies didn't add. The
+	// header may be repeated, each adding to the chain.
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+	forwarded := false
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := forwardedIP(hops[i])
+		if hop == "" {
+			break
+		}
+		ip, forwarded = hop, true
+		if !s.trustedProxy(hop) {
+			break
+		}
+	}
+	if !forwarded {
+		if real := forwardedIP(r.Header.Get("X-Real-IP")); real != "" {
+			ip = real
+		}
+	}
+	return ip
+}
+
+// forwardedIP returns the address in a proxy header value, which some
+// proxies give with a port, or "" if it isn't an IP
+func forwardedIP(value string) string {
+	value = strings.TrimSpace(value)
+	if host, _, err := net.SplitHostPort(value); err == nil {
+		value = host
+	}
+	if ip := net.ParseIP(value); ip != nil {
+		return ip.String()
+	}
+	return ""
+}
@@ -0,0 +1,395 @@
+// pkg/chat/push.go
+package chat
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Web Push delivery settings
+const (
+	pushKeyPrefix        = "PUSHKEY "
+	pushQueueSize        = 1000
+	pushWorkers          = 4
+	maxPushSubscriptions = 10
+	maxPushText          = 1000
+)
+
+// PushSubscription is a browser's Web Push subscription, as the Push API's
+// PushSubscription.toJSON() gives it
+type PushSubscription struct {
+	Endpoint string   `json:"endpoint"`
+	Keys     PushKeys `json:"keys"`
+	// CreatedAt is when the user subscribed
+	CreatedAt time.Time `json:"created_at,omitzero"`
+}
+
+// PushKeys are the keys a push message is encrypted for
+type PushKeys struct {
+	P256DH string `json:"p256dh"`
+	Auth   string `json:"auth"`
+}
+
+// PushStore persists users' Web Push subscriptions. Usernames are
+// case-insensitive.
+type PushStore interface {
+	// AddSubscription saves a subscription for username, replacing any
+	// with the same endpoint
+	AddSubscription(username string, sub PushSubscription) error
+
+	// RemoveSubscription deletes username's subscription with endpoint,
+	// if there is one
+	RemoveSubscription(username, endpoint string) error
+
+	// RemoveSubscriptions deletes all of username's subscriptions
+	RemoveSubscriptions(username string) error
+
+	// Subscriptions returns username's subscriptions, oldest first
+	Subscriptions(username string) ([]PushSubscription, error)
+
+	// Close releases any resources held by the store
+	Close() error
+}
+
+// MemoryPushStore keeps subscriptions in memory only; they are lost on
+// restart
+type MemoryPushStore struct {
+	mu   sync.Mutex
+	subs map[string][]PushSubscription
+}
+
+// NewMemoryPushStore creates an empty in-memory push subscription store
+func NewMemoryPushStore() *MemoryPushStore {
+	return &MemoryPushStore{subs: make(map[string][]PushSubscription)}
+}
+
+// AddSubscription saves a subscription, forgetting the user's oldest if
+// they have too many
+func (m *MemoryPushStore) AddSubscription(username string, sub PushSubscription) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.addLocked(username, sub)
+	return nil
+}
+
+func (m *MemoryPushStore) addLocked(username string, sub PushSubscription) {
+	key := userKey(username)
+	subs := removeEndpoint(m.subs[key], sub.Endpoint)
+	if len(subs) >= maxPushSubscriptions {
+		subs = subs[len(subs)-maxPushSubscriptions+1:]
+	}
+	m.subs[key] = append(subs, sub)
+}
+
+// RemoveSubscription deletes a subscription
+func (m *MemoryPushStore) RemoveSubscription(username, endpoint string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.removeLocked(username, endpoint)
+	return nil
+}
+
+func (m *MemoryPushStore) removeLocked(username, endpoint string) bool {
+	key := userKey(username)
+	subs := removeEndpoint(m.subs[key], endpoint)
+	if len(subs) == len(m.subs[key]) {
+		return false
+	}
+	if len(subs) == 0 {
+		delete(m.subs, key)
+	} else {
+		m.subs[key] = subs
+	}
+	return true
+}
+
+// RemoveSubscriptions deletes all of a user's subscriptions
+func (m *MemoryPushStore) RemoveSubscriptions(username string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.subs, userKey(username))
+	return nil
+}
+
+// Subscriptions returns a user's subscriptions
+func (m *MemoryPushStore) Subscriptions(username string) ([]PushSubscription, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return append([]PushSubscription(nil), m.subs[userKey(username)]...), nil
+}
+
+// Close is a no-op for the in-memory store
+func (m *MemoryPushStore) Close() error {
+	return nil
+}
+
+// removeEndpoint returns subs without the one for endpoint, in a new slice
+func removeEndpoint(subs []PushSubscription, endpoint string) []PushSubscription {
+	kept := make([]PushSubscription, 0, len(subs))
+	for _, sub := range subs {
+		if sub.Endpoint != endpoint {
+			kept = append(kept, sub)
+		}
+	}
+	return kept
+}
+
+// FilePushStore keeps subscriptions in a JSON file, rewritten on every
+// change
+type FilePushStore struct {
+	*MemoryPushStore
+	path string
+}
+
+// OpenFilePushStore loads (or creates) the subscription file at path
+func OpenFilePushStore(path string) (*FilePushStore, error) {
+	mem := NewMemoryPushStore()
+
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("open push store: %w", err)
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &mem.subs); err != nil {
+			return nil, fmt.Errorf("corrupt push store %s: %w", path, err)
+		}
+	}
+
+	return &FilePushStore{MemoryPushStore: mem, path: path}, nil
+}
+
+// AddSubscription saves a subscription and the file
+func (f *FilePushStore) AddSubscription(username string, sub PushSubscription) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.addLocked(username, sub)
+	return f.saveLocked()
+}
+
+// RemoveSubscription deletes a subscription and saves the file
+func (f *FilePushStore) RemoveSubscription(username, endpoint string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !f.removeLocked(username, endpoint) {
+		return nil
+	}
+	return f.saveLocked()
+}
+
+// RemoveSubscriptions deletes a user's subscriptions and saves the file
+func (f *FilePushStore) RemoveSubscriptions(username string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	key := userKey(username)
+	if _, ok := f.subs[key]; !ok {
+		return nil
+	}
+	delete(f.subs, key)
+	return f.saveLocked()
+}
+
+// saveLocked writes all subscriptions to disk. f.mu must be held.
+func (f *FilePushStore) saveLocked() error {
+	err := writeFileAtomic(f.path, func(w io.Writer) error {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(f.subs)
+	})
+	if err != nil {
+		return fmt.Errorf("save push store: %w", err)
+	}
+	return nil
+}
+
+// pushNotification is the JSON payload of a push, for the web client's
+// service worker to show
+type pushNotification struct {
+	Title string `json:"title"`
+	Body  string `json:"body"`
+	From  string `json:"from"`
+	// Room is where the mention was, empty for whispers
+	Room string `json:"room,omitempty"`
+	// Tag groups notifications so a new one replaces the last from the
+	// same conversation
+	Tag string `json:"tag"`
+}
+
+// pushJob is a notification for one user, waiting to be sent to each of
+// their browsers
+type pushJob struct {
+	username     string
+	notification pushNotification
+}
+
+// webPusher sends users' notifications to their browsers from a few
+// workers, so a slow push service doesn't hold up the chat
+type webPusher struct {
+	s     *Server
+	cfg   WebPushConfig
+	queue chan pushJob
+	// send delivers a payload to one subscription; tests replace it
+	send func(sub PushSubscription, payload []byte) error
+}
+
+func newWebPusher(s *Server, cfg WebPushConfig) *webPusher {
+	p := &webPusher{s: s, cfg: cfg, queue: make(chan pushJob, pushQueueSize)}
+	p.send = func(sub PushSubscription, payload []byte) error { return sendPush(&p.cfg, sub, payload) }
+	for range pushWorkers {
+		go p.run()
+	}
+	return p
+}
+
+// run sends queued notifications, forgetting subscriptions the push
+// service says are gone
+func (p *webPusher) run() {
+	for job := range p.queue {
+		subs, err := p.s.PushSubscriptions.Subscriptions(job.username)
+		if err != nil {
+			p.s.log.Error("Error loading push subscriptions", "username", job.username, "err", err)
+			continue
+		}
+		payload, err := json.Marshal(job.notification)
+		if err != nil {
+			continue
+		}
+		for _, sub := range subs {
+			err := p.send(sub, payload)
+			switch {
+			case errors.Is(err, errSubscriptionGone):
+				p.s.log.Info("Removing expired push subscription", "username", job.username)
+				if err := p.s.PushSubscriptions.RemoveSubscription(job.username, sub.Endpoint); err != nil {
+					p.s.log.Error("Error removing push subscription", "username", job.username, "err", err)
+				}
+			case err != nil:
+				p.s.log.Warn("Could not send push notification", "username", job.username, "err", err)
+			}
+		}
+	}
+}
+
+// pushOffline queues a notification for username's browsers if they are
+// offline and subscribed, reporting whether it will be sent
+func (s *Server) pushOffline(username string, notification pushNotification) bool {
+	if s.push == nil || s.online(username) || !s.pushSubscribed(username) {
+		return false
+	}
+	if runes := []rune(notification.Body); len(runes) > maxPushText {
+		notification.Body = string(runes[:maxPushText]) + "…"
+	}
+	select {
+	case s.push.queue <- pushJob{username: username, notification: notification}:
+	default:
+		s.log.Warn("Dropped push notification, queue full", "username", username)
+	}
+	return true
+}
+
+// pushSubscribed reports whether username has any browsers to push to
+func (s *Server) pushSubscribed(username string) bool {
+	if s.push == nil {
+		return false
+	}
+	subs, err := s.PushSubscriptions.Subscriptions(username)
+	return err == nil && len(subs) > 0
+}
+
+// validPushEndpoint reports whether the server may post to endpoint. Only
+// HTTPS URLs with a host name are accepted, so users can't point the server
+// at internal addresses.
+func validPushEndpoint(endpoint string) bool {
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Scheme != "https" || u.User != nil {
+		return false
+	}
+	host := u.Hostname()
+	if host == "" || net.ParseIP(host) != nil || host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return false
+	}
+	return true
+}
+
+// handlePush implements /push: the web client asks for the server's key
+// with /push key, then registers the subscription the browser gives it
+// with /push subscribe <json> to be notified of mentions and whispers
+// while its tabs are closed
+func (c *Session) handlePush(args string) {
+	p := c.Server.push
+	if p == nil {
+		c.send("Push notifications are not enabled on this server.")
+		return
+	}
+	if !c.LoggedIn {
+		c.send("Only registered users can get push notifications. Use /register <password> first.")
+		return
+	}
+
+	command, arg, _ := strings.Cut(strings.TrimSpace(args), " ")
+	arg = strings.TrimSpace(arg)
+	switch command {
+	case "key":
+		c.send(pushKeyPrefix + vapidPublicKey(p.cfg.Key))
+
+	case "subscribe":
+		var sub PushSubscription
+		if err := json.Unmarshal([]byte(arg), &sub); err != nil || sub.Keys.P256DH == "" || sub.Keys.Auth == "" {
+			c.send("Usage: /push subscribe <subscription JSON>")
+			return
+		}
+		if !validPushEndpoint(sub.Endpoint) {
+			c.send("Push endpoints must be HTTPS URLs.")
+			return
+		}
+		// Make sure pushes can be encrypted for it before keeping it
+		if _, err := encryptPush(sub, nil); err != nil {
+			c.send("Invalid push subscription keys.")
+			return
+		}
+		sub.CreatedAt = time.Now()
+		if err := c.Server.PushSubscriptions.AddSubscription(c.Username, sub); err != nil {
+			c.logger().Error("Error saving push subscription", "err", err)
+			c.send("Could not save your subscription, please try again.")
+			return
+		}
+		c.send("Subscribed. This browser will be notified of mentions and whispers while you're offline.")
+
+	case "unsubscribe":
+		if arg == "" {
+			c.send("Usage: /push unsubscribe <endpoint>")
+			return
+		}
+		if err := c.Server.PushSubscriptions.RemoveSubscription(c.Username, arg); err != nil {
+			c.logger().Error("Error removing push subscription", "err", err)
+			c.send("Could not remove your subscription, please try again.")
+			return
+		}
+		c.send("Unsubscribed.")
+
+	case "":
+		subs, err := c.Server.PushSubscriptions.Subscriptions(c.Username)
+		if err != nil {
+			c.logger().Error("Error loading push subscriptions", "err", err)
+			c.send("Could not load your subscriptions, please try again.")
+			return
+		}
+		c.send(fmt.Sprintf("You have %d browser(s) subscribed to push notifications.", len(subs)))
+
+	default:
+		c.send("Usage: /push [key | subscribe <subscription JSON> | unsubscribe <endpoint>]")
+	}
+}
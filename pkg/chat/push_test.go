@@ -0,0 +1,176 @@
+// pkg/chat/push_test.go
+package chat
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// TestWebPush posts a push to a fake push service that checks the VAPID
+// signature and decrypts the payload as a browser would, then answers 410
+// Gone to the next one
+func TestWebPush(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	browserKey, _ := ecdh.P256().GenerateKey(rand.Reader)
+	auth := make([]byte, 16)
+	rand.Read(auth)
+
+	received := make(chan []byte, 1)
+	gone := false
+	service := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if gone {
+			w.WriteHeader(http.StatusGone)
+			return
+		}
+		gone = true
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "vapid t=")
+		token, publicKey, _ := strings.Cut(token, ", k=")
+		if !ok || publicKey != vapidPublicKey(key) || !verifyES256(&key.PublicKey, token) {
+			t.Errorf("bad authorization %q", r.Header.Get("Authorization"))
+		}
+		body, _ := io.ReadAll(r.Body)
+		received <- decryptPush(t, browserKey, auth, body)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer service.Close()
+
+	cfg := &WebPushConfig{Key: key, Subject: "mailto:ops@example.com", Client: service.Client()}
+	sub := PushSubscription{Endpoint: service.URL + "/push/abc", Keys: PushKeys{
+		P256DH: base64.RawURLEncoding.EncodeToString(browserKey.PublicKey().Bytes()),
+		Auth:   base64.URLEncoding.EncodeToString(auth),
+	}}
+	if err := sendPush(cfg, sub, []byte(`{"title":"hi"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if payload := <-received; string(payload) != `{"title":"hi"}` {
+		t.Errorf("decrypted %q", payload)
+	}
+	if err := sendPush(cfg, sub, []byte("again")); !errors.Is(err, errSubscriptionGone) {
+		t.Errorf("410 gave %v", err)
+	}
+}
+
+// TestPushNotifications subscribes a browser with /push and checks it is
+// sent a mention while its user is offline
+func TestPushNotifications(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	s, url := newTestServer(t, Config{WebPush: &WebPushConfig{Key: key, Subject: "mailto:ops@example.com"}})
+	pushed := make(chan pushNotification, 1)
+	s.push.send = func(sub PushSubscription, payload []byte) error {
+		var n pushNotification
+		json.Unmarshal(payload, &n)
+		pushed <- n
+		return errSubscriptionGone
+	}
+
+	alice, err := connect(url, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := func(conn *websocket.Conn, want string) {
+		t.Helper()
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		for {
+			_, text, err := conn.ReadMessage()
+			if err != nil {
+				t.Fatalf("waiting for %q: %v", want, err)
+			}
+			if strings.HasPrefix(string(text), want) {
+				return
+			}
+		}
+	}
+	alice.WriteMessage(websocket.TextMessage, []byte("/push key"))
+	expect(alice, "Only registered users")
+	alice.WriteMessage(websocket.TextMessage, []byte("/register correct-horse"))
+	expect(alice, "Registered alice")
+	alice.WriteMessage(websocket.TextMessage, []byte("/push key"))
+	expect(alice, pushKeyPrefix+vapidPublicKey(key))
+
+	browserKey, _ := ecdh.P256().GenerateKey(rand.Reader)
+	keys := `"keys": {"p256dh": "` + base64.RawURLEncoding.EncodeToString(browserKey.PublicKey().Bytes()) + `", "auth": "c2VjcmV0c2VjcmV0c2VjcmV0"}`
+	alice.WriteMessage(websocket.TextMessage, []byte(`/push subscribe {"endpoint": "http://10.0.0.1/", `+keys+`}`))
+	expect(alice, "Push endpoints must be HTTPS URLs.")
+	alice.WriteMessage(websocket.TextMessage, []byte(`/push subscribe {"endpoint": "https://push.example.com/abc", `+keys+`}`))
+	expect(alice, "Subscribed.")
+	alice.Close()
+	for deadline := time.Now().Add(5 * time.Second); s.online("alice"); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("alice still online")
+		}
+	}
+
+	bob, err := connect(url, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bob.Close()
+	bob.WriteMessage(websocket.TextMessage, []byte("lunch, @alice?"))
+	select {
+	case n := <-pushed:
+		if n.Title != "bob mentioned you in #lobby" || n.Body != "lunch, @alice?" || n.Room != "lobby" {
+			t.Errorf("pushed %+v", n)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("mention not pushed")
+	}
+	// The push service said the subscription is gone, so it is forgotten
+	for deadline := time.Now().Add(5 * time.Second); s.pushSubscribed("alice"); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("expired subscription kept")
+		}
+	}
+}
+
+// verifyES256 checks a JWT's signature
+func verifyES256(key *ecdsa.PublicKey, token string) bool {
+	i := strings.LastIndex(token, ".")
+	sig, err := base64.RawURLEncoding.DecodeString(token[i+1:])
+	if err != nil || len(sig) != 64 {
+		return false
+	}
+	digest := sha256.Sum256([]byte(token[:i]))
+	return ecdsa.Verify(key, digest[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:]))
+}
+
+// decryptPush undoes encryptPush with the browser's keys (RFC 8291)
+func decryptPush(t *testing.T, browserKey *ecdh.PrivateKey, auth, body []byte) []byte {
+	t.Helper()
+	salt, idLen := body[:16], int(body[20])
+	serverPublic, ciphertext := body[21:21+idLen], body[21+idLen:]
+	serverKey, err := ecdh.P256().NewPublicKey(serverPublic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shared, _ := browserKey.ECDH(serverKey)
+	ikm, _ := hkdf.Key(sha256.New, shared, auth, "WebPush: info\x00"+string(browserKey.PublicKey().Bytes())+string(serverPublic), 32)
+	cek, _ := hkdf.Key(sha256.New, ikm, salt, "Content-Encoding: aes128gcm\x00", 16)
+	nonce, _ := hkdf.Key(sha256.New, ikm, salt, "Content-Encoding: nonce\x00", 12)
+	block, _ := aes.NewCipher(cek)
+	gcm, _ := cipher.NewGCM(block)
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The delimiter may be followed by zero padding
+	return bytes.TrimSuffix(bytes.TrimRight(plaintext, "\x00"), []byte{0x02})
+}
@@ -0,0 +1,362 @@
+// pkg/chat/redis.go
+package chat
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RedisConfig describes a Redis server to use as a backplane
+type RedisConfig struct {
+	// URL is redis://[[user]:password@]host[:port], or rediss:// for TLS.
+	// A database number in the path is allowed but unused, as pub/sub
+	// channels are shared by all databases.
+	URL string
+
+	// Channel is the pub/sub channel the instances share; empty means
+	// DefaultBackplaneChannel
+	Channel string
+}
+
+// RedisBackplane is a Backplane using Redis pub/sub. It publishes on one
+// connection, from a queue so a slow Redis never holds up clients, and
+// subscribes on another, reconnecting either if it drops. Events published
+// while the subscriber is reconnecting are missed.
+type RedisBackplane struct {
+	Config RedisConfig
+
+	addr     string
+	tls      *tls.Config
+	username string
+	password string
+
+	queue     chan []byte
+	pub       *redisConn
+	published chan struct{}
+
+	mu     sync.Mutex
+	sub    *redisConn
+	closed bool
+}
+
+// NewRedisBackplane connects to the Redis server at cfg.URL
+func NewRedisBackplane(cfg RedisConfig) (*RedisBackplane, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil || (u.Scheme != "redis" && u.Scheme != "rediss") || u.Hostname() == "" {
+		return nil, fmt.Errorf("invalid Redis URL %q (want redis://host:port)", cfg.URL)
+	}
+	if cfg.Channel == "" {
+		cfg.Channel = DefaultBackplaneChannel
+	}
+
+	b := &RedisBackplane{Config: cfg, addr: u.Host, queue: make(chan []byte, backplaneQueueSize), published: make(chan struct{})}
+	if u.Port() == "" {
+		b.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.Scheme == "rediss" {
+		b.tls = &tls.Config{ServerName: u.Hostname()}
+	}
+	if u.User != nil {
+		b.username = u.User.Username()
+		b.password, _ = u.User.Password()
+	}
+
+	// Fail now, rather than on the first message, if Redis is unreachable
+	conn, err := b.dial()
+	if err != nil {
+		return nil, err
+	}
+	b.pub = conn
+	go b.runPublisher()
+	return b, nil
+}
+
+// Publish queues event to be sent on the channel
+func (b *RedisBackplane) Publish(event []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return net.ErrClosed
+	}
+	select {
+	case b.queue <- event:
+		return nil
+	default:
+		return errors.New("publish queue full")
+	}
+}
+
+// runPublisher sends queued events until Close
+func (b *RedisBackplane) runPublisher() {
+	defer close(b.published)
+	for event := range b.queue {
+		if err := b.publish(event); err != nil {
+			slog.Warn("Error publishing to Redis backplane", "err", err)
+		}
+	}
+	if b.pub != nil {
+		b.pub.Close()
+	}
+}
+
+// publish sends one event, reconnecting once if the connection has dropped
+func (b *RedisBackplane) publish(event []byte) error {
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		if b.pub == nil {
+			if b.pub, err = b.dial(); err != nil {
+				return err
+			}
+		}
+		b.pub.conn.SetDeadline(time.Now().Add(backplaneDialTimeout))
+		if _, err = b.pub.do("PUBLISH", b.Config.Channel, string(event)); err == nil {
+			return nil
+		}
+		var redisErr redisError
+		if errors.As(err, &redisErr) {
+			return err
+		}
+		b.pub.Close()
+		b.pub = nil
+	}
+	return err
+}
+
+// Subscribe subscribes to the channel and calls fn with each message from
+// a background goroutine until Close
+func (b *RedisBackplane) Subscribe(fn func(event []byte)) error {
+	conn, err := b.subscribe()
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		for {
+			err := b.receive(conn, fn)
+			if b.isClosed() {
+				return
+			}
+			slog.Warn("Lost connection to Redis backplane, reconnecting", "err", err)
+			if !reconnectBackplane("Redis", b.isClosed, func() (err error) {
+				conn, err = b.subscribe()
+				return err
+			}) {
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// subscribe opens the subscriber connection
+func (b *RedisBackplane) subscribe() (*redisConn, error) {
+	conn, err := b.dial()
+	if err != nil {
+		return nil, err
+	}
+	reply, err := conn.do("SUBSCRIBE", b.Config.Channel)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("subscribe: %w", err)
+	}
+	if parts, ok := reply.([]any); !ok || len(parts) < 1 || parts[0] != "subscribe" {
+		conn.Close()
+		return nil, fmt.Errorf("subscribe: unexpected reply %v", reply)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		conn.Close()
+		return nil, net.ErrClosed
+	}
+	b.sub = conn
+	return conn, nil
+}
+
+// receive reads messages from a subscribed connection until it fails,
+// pinging it so a dead connection is noticed
+func (b *RedisBackplane) receive(conn *redisConn, fn func(event []byte)) error {
+	defer conn.Close()
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		ticker := time.NewTicker(backplanePingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if conn.write("PING") != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	for {
+		conn.conn.SetReadDeadline(time.Now().Add(2 * backplanePingInterval))
+		reply, err := conn.read()
+		if err != nil {
+			return err
+		}
+		// Messages are ["message", channel, payload]; pings are answered
+		// with ["pong", ""]
+		if parts, ok := reply.([]any); ok && len(parts) == 3 && parts[0] == "message" {
+			if payload, ok := parts[2].(string); ok {
+				fn([]byte(payload))
+			}
+		}
+	}
+}
+
+func (b *RedisBackplane) isClosed() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.closed
+}
+
+// Close stops subscribing and closes the connections, waiting a few
+// seconds for the queued events to be published
+func (b *RedisBackplane) Close() error {
+	b.mu.Lock()
+	if !b.closed {
+		b.closed = true
+		close(b.queue)
+		if b.sub != nil {
+			b.sub.Close()
+		}
+	}
+	b.mu.Unlock()
+
+	select {
+	case <-b.published:
+	case <-time.After(backplaneDialTimeout):
+	}
+	return nil
+}
+
+// dial opens an authenticated connection to the server
+func (b *RedisBackplane) dial() (*redisConn, error) {
+	var nc net.Conn
+	var err error
+	dialer := &net.Dialer{Timeout: backplaneDialTimeout}
+	if b.tls != nil {
+		nc, err = tls.DialWithDialer(dialer, "tcp", b.addr, b.tls)
+	} else {
+		nc, err = dialer.Dial("tcp", b.addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("connect to Redis: %w", err)
+	}
+	conn := &redisConn{conn: nc, r: bufio.NewReader(nc)}
+
+	if b.password != "" {
+		args := []string{"AUTH", b.password}
+		if b.username != "" {
+			args = []string{"AUTH", b.username, b.password}
+		}
+		nc.SetDeadline(time.Now().Add(backplaneDialTimeout))
+		if _, err := conn.do(args...); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("authenticate to Redis: %w", err)
+		}
+		nc.SetDeadline(time.Time{})
+	}
+	return conn, nil
+}
+
+// redisConn speaks RESP, the Redis protocol, on a connection
+type redisConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	wmu  sync.Mutex
+}
+
+// redisError is an error reply from the server
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+// do sends a command and reads its reply
+func (c *redisConn) do(args ...string) (any, error) {
+	if err := c.write(args...); err != nil {
+		return nil, err
+	}
+	return c.read()
+}
+
+// write sends a command as an array of bulk strings
+func (c *redisConn) write(args ...string) error {
+	var cmd strings.Builder
+	fmt.Fprintf(&cmd, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&cmd, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	_, err := io.WriteString(c.conn, cmd.String())
+	return err
+}
+
+// read reads one reply: a string, an int64, a []any, nil, or a redisError
+func (c *redisConn) read() (any, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("redis: empty reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		items := make([]any, n)
+		for i := range items {
+			if items[i], err = c.read(); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	default:
+		return nil, fmt.Errorf("redis: unexpected reply %q", line)
+	}
+}
+
+// Close closes the connection
+func (c *redisConn) Close() error {
+	return c.conn.Close()
+}
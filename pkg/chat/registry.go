@@ -0,0 +1,181 @@
+// pkg/chat/registry.go
+package chat
+
+import (
+	"errors"
+	"hash/maphash"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// registryShards is how many shards the client registry is split into; it
+// must be a power of two
+const registryShards = 32
+
+// Reasons add turns a client away
+var (
+	errUsernameTaken = errors.New("username taken")
+	errServerFull    = errors.New("server full")
+	errDraining      = errors.New("server shutting down")
+)
+
+// registry holds the clients connected to this instance, sharded by
+// username so that clients on different shards never contend. Each shard
+// has a RWMutex: broadcasts, lookups and listings share it, and only
+// registering, leaving, or changing a client's room or role takes it
+// exclusively.
+type registry struct {
+	seed   maphash.Seed
+	shards [registryShards]registryShard
+
+	// count is kept apart from the shards so the client limit can be
+	// checked without locking all of them
+	count atomic.Int64
+
+	// peak is the most clients connected at once, reached at peakAt
+	peakMu sync.Mutex
+	peak   int
+	peakAt time.Time
+}
+
+// registryShard holds the clients whose username keys hash to it
+type registryShard struct {
+	mu sync.RWMutex
+	// clients is keyed by userKey
+	clients map[string]*Session
+}
+
+func newRegistry() *registry {
+	r := &registry{seed: maphash.MakeSeed()}
+	for i := range r.shards {
+		r.shards[i].clients = make(map[string]*Session)
+	}
+	return r
+}
+
+// shard returns the shard username belongs to, and its key there
+func (r *registry) shard(username string) (*registryShard, string) {
+	key := userKey(username)
+	return &r.shards[maphash.String(r.seed, key)&(registryShards-1)], key
+}
+
+// lookup returns the client using username, or nil
+func (r *registry) lookup(username string) *Session {
+	shard, key := r.shard(username)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+	return shard.clients[key]
+}
+
+// len returns how many clients are connected
+func (r *registry) len() int {
+	return int(r.count.Load())
+}
+
+// each calls fn for every client, holding each shard's read lock in turn.
+// fn may read the clients' rooms and roles but must not block, send to
+// them or touch the registry.
+func (r *registry) each(fn func(client *Session)) {
+	for i := range r.shards {
+		shard := &r.shards[i]
+		shard.mu.RLock()
+		for _, client := range shard.clients {
+			fn(client)
+		}
+		shard.mu.RUnlock()
+	}
+}
+
+// filter returns the clients match accepts (all of them if match is nil),
+// so they can be sent to without holding any lock. match is called as by
+// each.
+func (r *registry) filter(match func(client *Session) bool) []*Session {
+	clients := make([]*Session, 0, r.len())
+	r.each(func(client *Session) {
+		if match == nil || match(client) {
+			clients = append(clients, client)
+		}
+	})
+	return clients
+}
+
+// update calls fn with client's shard locked, for changing the fields that
+// each and filter callers read
+func (r *registry) update(client *Session, fn func()) {
+	shard, _ := r.shard(client.Username)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	fn()
+}
+
+// add registers client unless its username is in use, the server is
+// draining, or maxClients (if positive) are already connected. draining is
+// checked with the shard locked so Shutdown, which sets it before listing
+// the clients, can't miss a client that got in. joined, if set, is called
+// once client is registered but before the lock is released, so whatever
+// it queues for client comes before any broadcast that includes it.
+func (r *registry) add(client *Session, maxClients int, draining func() bool, joined func()) error {
+	shard, key := r.shard(client.Username)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	if draining() {
+		return errDraining
+	}
+	if _, taken := shard.clients[key]; taken {
+		return errUsernameTaken
+	}
+	var n int64
+	for {
+		n = r.count.Load()
+		if maxClients > 0 && n >= int64(maxClients) {
+			return errServerFull
+		}
+		if r.count.CompareAndSwap(n, n+1) {
+			break
+		}
+	}
+	shard.clients[key] = client
+	r.recordPeak(int(n + 1))
+	if joined != nil {
+		joined()
+	}
+	return nil
+}
+
+// remove unregisters client, if it is still registered
+func (r *registry) remove(client *Session) {
+	shard, key := r.shard(client.Username)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	if shard.clients[key] == client {
+		delete(shard.clients, key)
+		r.count.Add(-1)
+	}
+}
+
+// recordPeak updates the peak after the nth client has joined
+func (r *registry) recordPeak(n int) {
+	r.peakMu.Lock()
+	defer r.peakMu.Unlock()
+	if n > r.peak {
+		r.peak, r.peakAt = n, time.Now()
+	}
+}
+
+// peakClients returns the most clients connected at once and when that was
+func (r *registry) peakClients() (int, time.Time) {
+	r.peakMu.Lock()
+	defer r.peakMu.Unlock()
+	return r.peak, r.peakAt
+}
+
+// probe takes every shard's lock in turn, returning once none is stuck
+func (r *registry) probe() {
+	for i := range r.shards {
+		r.shards[i].mu.Lock()
+		r.shards[i].mu.Unlock()
+	}
+}
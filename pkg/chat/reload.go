@@ -0,0 +1,100 @@
+// pkg/chat/reload.go
+package chat
+
+import (
+	"fmt"
+	"reflect"
+	"time"
+)
+
+// reloadableSettings are the Config fields Reload applies to a running
+// server. Everything else (stores, auth, TLS, rooms...) needs a restart.
+var reloadableSettings = []string{
+	"AllowGuests",
+	"ReservedNames",
+	"AllowedOrigins",
+	"ProofOfWorkBits",
+	"MaxClients",
+	"MaxConnectionsPerIP",
+	"ConnectionsPerMinute",
+	"UpgradesPerSecond",
+	"UpgradeBurst",
+	"UpgradeQueue",
+	"TrustedProxies",
+	"MessageRate",
+	"MessageBurst",
+	"FloodMuteStrikes",
+	"FloodMuteDuration",
+	"LoginMaxFailures",
+	"LoginLockout",
+	"LoginLockoutMax",
+	"GuestMessageInterval",
+	"EchoMutedMessages",
+	"BlockLinks",
+	"LinkDomains",
+	"LinkMinAccountAge",
+	"SpamRepeatLimit",
+	"SpamCapsPercent",
+	"SpamBurstMessages",
+	"SpamBurstWindow",
+	"SpamStrikeWindow",
+	"SpamSlowInterval",
+	"SpamSlowDuration",
+	"SpamMuteDuration",
+	"SlowClientPolicy",
+	"MaxQueuedBytes",
+}
+
+// config returns the settings currently in effect: Config as updated by
+// the latest Reload
+func (s *Server) config() *Config {
+	return s.current.Load()
+}
+
+// Reload applies the limits and filters in cfg (see reloadableSettings)
+// to the running server without dropping connections, and returns a
+// description of each setting that changed. The MOTD and automod rules
+// have their own setters, SetMOTD and SetAutomodRules.
+func (s *Server) Reload(cfg Config) []string {
+	old := s.config()
+	next := *old
+	oldValue, newValue := reflect.ValueOf(old).Elem(), reflect.ValueOf(&next).Elem()
+	src := reflect.ValueOf(cfg)
+
+	var changes []string
+	for _, name := range reloadableSettings {
+		value := src.FieldByName(name)
+		if reflect.DeepEqual(oldValue.FieldByName(name).Interface(), value.Interface()) {
+			continue
+		}
+		newValue.FieldByName(name).Set(value)
+		changes = append(changes, fmt.Sprintf("%s: %s -> %s",
+			name, formatSetting(oldValue.FieldByName(name)), formatSetting(value)))
+	}
+	if len(changes) == 0 {
+		return nil
+	}
+
+	s.current.Store(&next)
+	s.ipLimits.setLimits(next.ConnectionsPerMinute, next.MaxConnectionsPerIP)
+	s.upgrades.setLimits(next.UpgradesPerSecond, next.UpgradeBurst, next.UpgradeQueue)
+	s.logins.setLimits(next.LoginMaxFailures, next.LoginLockout, next.LoginLockoutMax)
+	s.setProxies(next.TrustedProxies)
+
+	for _, change := range changes {
+		s.log.Info("Reloaded setting", "change", change)
+	}
+	s.audit(AuditAdmin, "", "", "", fmt.Sprintf("reloaded %d settings", len(changes)))
+	return changes
+}
+
+// formatSetting renders a setting's value for the reload log
+func formatSetting(v reflect.Value) string {
+	if d, ok := v.Interface().(time.Duration); ok {
+		return d.String()
+	}
+	if v.Kind() == reflect.Slice && v.Len() == 0 {
+		return "none"
+	}
+	return fmt.Sprint(v.Interface())
+}
@@ -0,0 +1,140 @@
+// pkg/chat/reporting.go
+package chat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"runtime/debug"
+	"slices"
+	"time"
+)
+
+// ErrorReporter receives the server's panics and unexpected errors, e.g.
+// to forward them to an error tracker such as Sentry (see SentryReporter)
+type ErrorReporter interface {
+	// Report is called from the goroutine that hit the error, so it must
+	// not block
+	Report(report ErrorReport)
+}
+
+// ErrorReport is one panic or unexpected error
+type ErrorReport struct {
+	Time time.Time
+
+	// Message says what went wrong, e.g. "Error storing message"
+	Message string
+
+	// Err is the error, if there was one
+	Err error
+
+	// Panic is set for a recovered panic, and Stack is the stack of the
+	// goroutine that panicked
+	Panic bool
+	Stack string
+
+	// Attrs are the rest of the log record: username, room, remote_addr...
+	Attrs map[string]string
+}
+
+// reportingHandler passes log records to the next handler, and sends a
+// report of each one at error level to reporter. Everything logged with
+// s.log.Error is an unexpected error, the rest are expected.
+type reportingHandler struct {
+	slog.Handler
+	reporter ErrorReporter
+
+	// attrs and group are what WithAttrs and WithGroup have added
+	attrs []slog.Attr
+	group string
+}
+
+// reportErrors returns logger with its errors also sent to reporter
+func reportErrors(logger *slog.Logger, reporter ErrorReporter) *slog.Logger {
+	return slog.New(&reportingHandler{Handler: logger.Handler(), reporter: reporter})
+}
+
+// Enabled is true at error level even when the next handler logs nothing
+func (h *reportingHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= slog.LevelError || h.Handler.Enabled(ctx, level)
+}
+
+// Handle reports r if it is an error, then logs it
+func (h *reportingHandler) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level >= slog.LevelError {
+		h.reporter.Report(h.report(r))
+	}
+	if !h.Handler.Enabled(ctx, r.Level) {
+		return nil
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *reportingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	next := *h
+	next.Handler = h.Handler.WithAttrs(attrs)
+	next.attrs = slices.Clip(h.attrs)
+	for _, attr := range attrs {
+		next.attrs = append(next.attrs, slog.Attr{Key: h.group + attr.Key, Value: attr.Value})
+	}
+	return &next
+}
+
+func (h *reportingHandler) WithGroup(name string) slog.Handler {
+	next := *h
+	next.Handler = h.Handler.WithGroup(name)
+	next.group = h.group + name + "."
+	return &next
+}
+
+// report turns r into an ErrorReport, picking out the err, panic and
+// stack attributes
+func (h *reportingHandler) report(r slog.Record) ErrorReport {
+	report := ErrorReport{Time: r.Time, Message: r.Message, Attrs: make(map[string]string)}
+	for _, attr := range h.attrs {
+		report.add(attr.Key, attr.Value)
+	}
+	r.Attrs(func(attr slog.Attr) bool {
+		report.add(h.group+attr.Key, attr.Value)
+		return true
+	})
+	if report.Panic && report.Err == nil {
+		report.Err = errors.New(report.Message)
+	}
+	return report
+}
+
+// add records the attribute key, flattening groups
+func (report *ErrorReport) add(key string, value slog.Value) {
+	value = value.Resolve()
+	switch {
+	case value.Kind() == slog.KindGroup:
+		for _, attr := range value.Group() {
+			report.add(key+"."+attr.Key, attr.Value)
+		}
+	case key == "err":
+		if err, ok := value.Any().(error); ok {
+			report.Err = err
+		} else {
+			report.Err = errors.New(value.String())
+		}
+	case key == "panic":
+		report.Panic = true
+		report.Err = fmt.Errorf("panic: %s", value)
+	case key == "stack":
+		report.Stack = value.String()
+	default:
+		report.Attrs[key] = value.String()
+	}
+}
+
+// recoverPanic is deferred by the client's goroutines so that a panic
+// (say, in a command handler) disconnects only that client. The panic is
+// logged at error level, so it is also reported.
+func (c *Session) recoverPanic(goroutine string) {
+	if p := recover(); p != nil {
+		c.logger().Error("Recovered from panic", "goroutine", goroutine,
+			"panic", fmt.Sprint(p), "stack", string(debug.Stack()))
+	}
+}
@@ -0,0 +1,46 @@
+// pkg/chat/reports.go
+package chat
+
+import (
+	"fmt"
+	"strings"
+)
+
+// maxReportReason is the longest reason a report may give, in characters
+const maxReportReason = 500
+
+// handleReport implements /report <user> <reason>: the connected
+// moderators are alerted, and the report is recorded in the audit log and
+// exported, e.g. to webhooks
+func (c *Session) handleReport(args string) {
+	if !c.can(permReport) {
+		c.send("Guests cannot report users.")
+		return
+	}
+
+	target, reason, _ := strings.Cut(strings.TrimSpace(args), " ")
+	reason = strings.TrimSpace(reason)
+	if target == "" || reason == "" {
+		c.send("Usage: /report <username> <reason>")
+		return
+	}
+	if sameUsername(target, c.Username) {
+		c.send("You cannot report yourself.")
+		return
+	}
+	name, ok := c.Server.knownUser(target)
+	if !ok {
+		c.send(fmt.Sprintf("User '%s' not found", target))
+		return
+	}
+	if runes := []rune(reason); len(runes) > maxReportReason {
+		reason = string(runes[:maxReportReason])
+	}
+
+	c.logger().Info("Reported user", "target", name, "reason", reason)
+	// Exported with the room, which audit events don't have
+	c.Server.Audit.Record(AuditEvent{Event: AuditReport, Actor: c.Username, Target: name, IP: c.IP, Detail: fmt.Sprintf("in #%s: %s", c.Room, reason)})
+	c.Server.export(ExportEvent{Type: AuditReport, Room: c.Room, Username: c.Username, Target: name, IP: c.IP, Detail: reason})
+	c.Server.alertModerators(fmt.Sprintf("[REPORT] %s reported %s in #%s: %s", c.Username, name, c.Room, reason))
+	c.send(fmt.Sprintf("Thanks, your report about %s was sent to the moderators.", name))
+}
@@ -0,0 +1,135 @@
+// pkg/chat/rooms.go
+package chat
+
+import (
+	"fmt"
+	"log/slog"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// roomNamePattern limits room names to short, unambiguous identifiers
+var roomNamePattern = regexp.MustCompile(`^[a-z0-9_-]{1,32}$`)
+
+// RoomInfo describes a room and how many users are in it
+type RoomInfo struct {
+	Name    string `json:"name"`
+	Members int    `json:"members"`
+}
+
+// normalizeRoom lowercases a room name, strips a leading '#', and reports
+// whether the result is a valid name
+func normalizeRoom(name string) (string, bool) {
+	name = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(name), "#"))
+	return name, roomNamePattern.MatchString(name)
+}
+
+// permanentRooms returns the set of rooms that always exist: the default
+// room and any valid names in rooms
+func permanentRooms(rooms []string, logger *slog.Logger) map[string]bool {
+	set := map[string]bool{DefaultRoom: true}
+	for _, room := range rooms {
+		name, ok := normalizeRoom(room)
+		if !ok {
+			logger.Warn("Ignoring invalid room name", "room", room)
+			continue
+		}
+		set[name] = true
+	}
+	return set
+}
+
+// roomExists reports whether anyone is in room. The default room and
+// Config.Rooms always exist.
+func (s *Server) roomExists(room string) bool {
+	if s.rooms[room] {
+		return true
+	}
+	exists := false
+	s.clients.each(func(client *Session) {
+		exists = exists || client.Room == room
+	})
+	return exists
+}
+
+// GetRoomList returns all rooms with at least one member (plus the
+// permanent rooms), sorted by name
+func (s *Server) GetRoomList() []RoomInfo {
+	counts := make(map[string]int, len(s.rooms))
+	for room := range s.rooms {
+		counts[room] = 0
+	}
+	s.clients.each(func(client *Session) {
+		counts[client.Room]++
+	})
+	for _, user := range s.remote.users() {
+		counts[user.Room]++
+	}
+
+	rooms := make([]RoomInfo, 0, len(counts))
+	for name, members := range counts {
+		rooms = append(rooms, RoomInfo{Name: name, Members: members})
+	}
+	sort.Slice(rooms, func(i, j int) bool { return rooms[i].Name < rooms[j].Name })
+	return rooms
+}
+
+// broadcastToRoom sends a message to every client in room, on every instance
+func (s *Server) broadcastToRoom(room, message string) {
+	s.deliverToRoom(room, message)
+	s.publish(backplaneEvent{Type: eventRoom, Room: room, Text: message})
+}
+
+// deliverToRoom sends a message to every client in room on this instance
+func (s *Server) deliverToRoom(room, message string) {
+	s.log.Debug("Broadcasting to room", "room", room, "message", message)
+
+	s.sendToEach(s.clients.filter(func(client *Session) bool { return client.Room == room }), message)
+}
+
+// handleJoin implements /join <room>, moving the client to another room and
+// creating it if nobody is in it yet
+func (c *Session) handleJoin(args string) {
+	room, ok := normalizeRoom(args)
+	if !ok {
+		c.send("Usage: /join <room> (letters, digits, - and _, up to 32 characters)")
+		return
+	}
+	if room == c.Room {
+		c.send(fmt.Sprintf("You are already in #%s", room))
+		return
+	}
+
+	s := c.Server
+	if !c.can(permCreateRoom) && !s.roomExists(room) {
+		c.send(fmt.Sprintf("Room #%s does not exist and guests cannot create rooms", room))
+		return
+	}
+	oldRoom := c.Room
+	s.clients.update(c, func() { c.Room = room })
+	s.publish(backplaneEvent{Type: eventJoin, Username: c.Username, Room: room})
+	s.export(ExportEvent{Type: ExportLeave, Room: oldRoom, Username: c.Username, IP: c.IP, Detail: "to #" + room})
+	s.export(ExportEvent{Type: ExportJoin, Room: room, Username: c.Username, IP: c.IP, Detail: "from #" + oldRoom})
+
+	c.logger().Info("Changed room", "from", oldRoom)
+	s.broadcastToRoom(oldRoom, fmt.Sprintf("*** %s left #%s ***", c.Username, oldRoom))
+	s.replayHistory(c)
+	s.broadcastToRoom(room, fmt.Sprintf("*** %s joined #%s ***", c.Username, room))
+	s.relayPresence(c.Username, oldRoom, room)
+}
+
+// handleRooms implements /rooms
+func (c *Session) handleRooms() {
+	rooms := c.Server.GetRoomList()
+	var list strings.Builder
+	fmt.Fprintf(&list, "Rooms (%d):\n", len(rooms))
+	for _, room := range rooms {
+		marker := ""
+		if room.Name == c.Room {
+			marker = " (you are here)"
+		}
+		fmt.Fprintf(&list, "#%s - %d users%s\n", room.Name, room.Members, marker)
+	}
+	c.send(list.String())
+}
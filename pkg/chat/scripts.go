@@ -0,0 +1,415 @@
+// pkg/chat/scripts.go
+package chat
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// scriptQueueSize is how many events may wait for a script; more are
+// dropped
+const scriptQueueSize = 1000
+
+// scriptCallTimeout is how long a script may run for each event before it
+// is stopped
+const scriptCallTimeout = time.Second
+
+// Script event types, as passed to chat.on
+const (
+	scriptMessage = "message"
+	scriptJoin    = "join"
+	scriptLeave   = "leave"
+)
+
+// ScriptConfig describes the Lua scripts a ScriptEngine runs
+type ScriptConfig struct {
+	// Dir holds the scripts, the files in it ending in .lua
+	Dir string
+
+	// Username is who the scripts' messages are posted and whispered as,
+	// by default "bot"
+	Username string
+}
+
+// ScriptEngine runs Lua scripts that react to what happens in the chat,
+// for greeters, auto-responders and games. Each script has a global chat
+// table to subscribe to events and take actions with:
+//
+//	chat.on(event, fn)        call fn(e) for each "message" (e.room, e.username, e.text),
+//	                          "join" or "leave" (e.room, e.username)
+//	chat.command(name, fn)    add a slash command, calling fn(e) with e.room,
+//	                          e.username and e.args and sending back what it returns
+//	chat.send(room, text)     post a message to room
+//	chat.whisper(user, text)  send a private message to a connected user
+//	chat.after(seconds, fn)   call fn once after a delay
+//
+// print logs its arguments. Scripts only get Lua's base, string, table and
+// math libraries, so they can't reach files or the network. Each runs on
+// its own goroutine, handling its events one at a time in order, and is
+// stopped if handling one takes longer than scriptCallTimeout; errors are
+// logged and the script carries on. A script's events are dropped if it
+// falls too far behind. Scripts don't see the messages they or other
+// scripts post.
+type ScriptEngine struct {
+	Config ScriptConfig
+
+	server  *Server
+	scripts []*script
+
+	mu     sync.Mutex
+	closed bool
+}
+
+// script is one loaded script and the events waiting for it
+type script struct {
+	engine *ScriptEngine
+	name   string
+	state  *lua.LState
+
+	// handlers holds the functions subscribed with chat.on, by event
+	// type, which can only be done until loaded is set
+	handlers map[string][]*lua.LFunction
+	loaded   bool
+
+	events  chan scriptEvent
+	done    chan struct{}
+	dropped atomic.Int64
+}
+
+// scriptEvent is a call waiting to be made into a script: to fn if set,
+// otherwise to the handlers for kind. A command's reply goes to client.
+type scriptEvent struct {
+	kind   string
+	fn     *lua.LFunction
+	fields map[string]string
+	client *Session
+}
+
+// NewScriptEngine loads the scripts in cfg.Dir, in name order, and starts
+// running them against s. A script failing to load fails them all. Close
+// the engine when shutting down.
+func NewScriptEngine(s *Server, cfg ScriptConfig) (*ScriptEngine, error) {
+	if cfg.Username == "" {
+		cfg.Username = "bot"
+	}
+	username, err := validateUsername(cfg.Username)
+	if err != nil {
+		return nil, fmt.Errorf("invalid script username: %w", err)
+	}
+	cfg.Username = username
+	paths, err := filepath.Glob(filepath.Join(cfg.Dir, "*.lua"))
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 {
+		if _, err := os.Stat(cfg.Dir); err != nil {
+			return nil, fmt.Errorf("read scripts: %w", err)
+		}
+		return nil, fmt.Errorf("no .lua scripts in %s", cfg.Dir)
+	}
+	sort.Strings(paths)
+
+	e := &ScriptEngine{Config: cfg, server: s}
+	for _, path := range paths {
+		sc, err := e.load(path)
+		if err != nil {
+			// Leave the commands and timers of those loaded doing nothing
+			e.closed = true
+			for _, loaded := range e.scripts {
+				loaded.state.Close()
+			}
+			return nil, err
+		}
+		e.scripts = append(e.scripts, sc)
+	}
+	for _, sc := range e.scripts {
+		go sc.run()
+	}
+	s.addBridge(e)
+	s.log.Info("Scripts loaded", "dir", cfg.Dir, "scripts", len(e.scripts))
+	return e, nil
+}
+
+// load runs the script at path, giving it the chat table to subscribe to
+// events with
+func (e *ScriptEngine) load(path string) (*script, error) {
+	sc := &script{
+		engine:   e,
+		name:     filepath.Base(path),
+		state:    lua.NewState(lua.Options{SkipOpenLibs: true}),
+		handlers: map[string][]*lua.LFunction{},
+		events:   make(chan scriptEvent, scriptQueueSize),
+		done:     make(chan struct{}),
+	}
+	L := sc.state
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+	// Keep scripts to what they're given
+	for _, name := range []string{"dofile", "loadfile", "load", "loadstring", "require", "module"} {
+		L.SetGlobal(name, lua.LNil)
+	}
+	L.SetGlobal("print", L.NewFunction(sc.print))
+	L.SetGlobal("chat", L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+		"on":      sc.on,
+		"command": sc.command,
+		"send":    sc.send,
+		"whisper": sc.whisper,
+		"after":   sc.after,
+	}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), scriptCallTimeout)
+	defer cancel()
+	L.SetContext(ctx)
+	defer L.RemoveContext()
+	if err := L.DoFile(path); err != nil {
+		L.Close()
+		return nil, fmt.Errorf("load script %s: %w", sc.name, err)
+	}
+	sc.loaded = true
+	return sc, nil
+}
+
+// name is what scripts' messages are marked with, so they aren't relayed
+// back to them
+func (e *ScriptEngine) name() string { return "script" }
+
+// relay hands a room message to the scripts
+func (e *ScriptEngine) relay(room, username, text string) {
+	e.dispatch(scriptEvent{kind: scriptMessage, fields: map[string]string{"room": room, "username": username, "text": text}})
+}
+
+// moved hands the scripts a leave event for the room username left, if
+// any, and a join event for the one they joined
+func (e *ScriptEngine) moved(username, from, to string) {
+	if from != "" {
+		e.dispatch(scriptEvent{kind: scriptLeave, fields: map[string]string{"room": from, "username": username}})
+	}
+	if to != "" {
+		e.dispatch(scriptEvent{kind: scriptJoin, fields: map[string]string{"room": to, "username": username}})
+	}
+}
+
+// dispatch queues event for each script subscribed to its kind
+func (e *ScriptEngine) dispatch(event scriptEvent) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.closed {
+		return
+	}
+	for _, sc := range e.scripts {
+		if sc.subscribed(event.kind) {
+			sc.queue(event)
+		}
+	}
+}
+
+// subscribed reports whether the script has handlers for kind. Scripts
+// subscribe while loading, so their handlers don't change once running.
+func (sc *script) subscribed(kind string) bool {
+	return len(sc.handlers[kind]) > 0
+}
+
+// queue adds event to the script's queue, dropping it if the queue is
+// full. The engine's lock must be held, and the engine not closed.
+func (sc *script) queue(event scriptEvent) {
+	select {
+	case sc.events <- event:
+	default:
+		sc.dropped.Add(1)
+	}
+}
+
+// queueCall queues event for the script, unless the engine has been
+// closed
+func (sc *script) queueCall(event scriptEvent) {
+	sc.engine.mu.Lock()
+	defer sc.engine.mu.Unlock()
+	if !sc.engine.closed {
+		sc.queue(event)
+	}
+}
+
+// run makes the script's queued calls until Close, logging how many events
+// were dropped at most every few seconds
+func (sc *script) run() {
+	defer close(sc.done)
+	defer sc.state.Close()
+	var lastWarning time.Time
+	for event := range sc.events {
+		sc.handle(event)
+		if time.Since(lastWarning) > 10*time.Second {
+			if n := sc.dropped.Swap(0); n > 0 {
+				sc.logger().Warn("Dropped events, script queue full", "events", n)
+				lastWarning = time.Now()
+			}
+		}
+	}
+}
+
+// handle calls into the script for event, sending a command's reply back
+// to its client
+func (sc *script) handle(event scriptEvent) {
+	fns := sc.handlers[event.kind]
+	if event.fn != nil {
+		fns = []*lua.LFunction{event.fn}
+	}
+	L := sc.state
+	for _, fn := range fns {
+		var args []lua.LValue
+		if event.fields != nil {
+			table := L.NewTable()
+			for key, value := range event.fields {
+				table.RawSetString(key, lua.LString(value))
+			}
+			args = append(args, table)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), scriptCallTimeout)
+		L.SetContext(ctx)
+		err := L.CallByParam(lua.P{Fn: fn, NRet: 1, Protect: true}, args...)
+		L.RemoveContext()
+		cancel()
+		if err != nil {
+			sc.logger().Warn("Script error", "err", err)
+			continue
+		}
+		reply := L.Get(-1)
+		L.Pop(1)
+		if event.client != nil && reply != lua.LNil {
+			event.client.send(lua.LVAsString(reply))
+		}
+	}
+}
+
+// logger returns the server's logger with the script's name added
+func (sc *script) logger() *slog.Logger {
+	return sc.engine.server.log.With("script", sc.name)
+}
+
+// print logs its arguments, separated by spaces
+func (sc *script) print(L *lua.LState) int {
+	parts := make([]string, L.GetTop())
+	for i := range parts {
+		parts[i] = L.ToStringMeta(L.Get(i + 1)).String()
+	}
+	sc.logger().Info(strings.Join(parts, " "))
+	return 0
+}
+
+// on implements chat.on(event, fn)
+func (sc *script) on(L *lua.LState) int {
+	kind := L.CheckString(1)
+	fn := L.CheckFunction(2)
+	switch kind {
+	case scriptMessage, scriptJoin, scriptLeave:
+	default:
+		L.ArgError(1, fmt.Sprintf("unknown event %q", kind))
+	}
+	if sc.loaded {
+		L.RaiseError("chat.on can only be called while the script loads")
+	}
+	sc.handlers[kind] = append(sc.handlers[kind], fn)
+	return 0
+}
+
+// command implements chat.command(name, fn)
+func (sc *script) command(L *lua.LState) int {
+	name := L.CheckString(1)
+	fn := L.CheckFunction(2)
+	err := sc.engine.server.RegisterCommand(name, func(ctx context.Context, client *Session, args string) {
+		sc.queueCall(scriptEvent{fn: fn, client: client, fields: map[string]string{
+			"room": client.Room, "username": client.Username, "args": args,
+		}})
+	})
+	if err != nil {
+		L.RaiseError("%v", err)
+	}
+	return 0
+}
+
+// send implements chat.send(room, text)
+func (sc *script) send(L *lua.LState) int {
+	room, ok := normalizeRoom(L.CheckString(1))
+	if !ok {
+		L.ArgError(1, "invalid room name")
+	}
+	text := L.CheckString(2)
+	if strings.TrimSpace(text) == "" {
+		L.ArgError(2, "text is required")
+	}
+	e := sc.engine
+	e.server.postMessage(context.Background(), room, e.Config.Username, "", e.name(), text)
+	return 0
+}
+
+// whisper implements chat.whisper(username, text), returning whether the
+// user is connected here
+func (sc *script) whisper(L *lua.LState) int {
+	username := L.CheckString(1)
+	text := L.CheckString(2)
+	e := sc.engine
+	target := e.server.clientByName(username)
+	if target == nil {
+		L.Push(lua.LFalse)
+		return 1
+	}
+	target.send(fmt.Sprintf("[PM from %s]: %s", e.Config.Username, text))
+	e.server.recordPrivateMessage(context.Background(), e.Config.Username, target.Username, text)
+	L.Push(lua.LTrue)
+	return 1
+}
+
+// after implements chat.after(seconds, fn)
+func (sc *script) after(L *lua.LState) int {
+	delay := time.Duration(float64(L.CheckNumber(1)) * float64(time.Second))
+	fn := L.CheckFunction(2)
+	time.AfterFunc(delay, func() {
+		sc.queueCall(scriptEvent{fn: fn})
+	})
+	return 0
+}
+
+// Close stops the scripts once they have handled the events already
+// queued, waiting up to timeout for them. Commands they added stay
+// registered, but do nothing.
+func (e *ScriptEngine) Close(timeout time.Duration) {
+	e.mu.Lock()
+	if !e.closed {
+		e.closed = true
+		for _, sc := range e.scripts {
+			close(sc.events)
+		}
+	}
+	e.mu.Unlock()
+
+	deadline := time.After(timeout)
+	for _, sc := range e.scripts {
+		select {
+		case <-sc.done:
+		case <-deadline:
+			e.server.log.Warn("Timed out waiting for scripts to stop")
+			return
+		}
+	}
+}
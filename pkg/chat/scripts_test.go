@@ -0,0 +1,92 @@
+// pkg/chat/scripts_test.go
+package chat
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testScript greets, answers !ping, adds /roll, and hangs on !loop
+const testScript = `
+chat.on("join", function(e)
+  chat.whisper(e.username, "Welcome to #" .. e.room)
+end)
+
+chat.on("message", function(e)
+  if e.text == "!ping" then
+    chat.send(e.room, "pong " .. e.username)
+  elseif e.text == "!later" then
+    chat.after(0.05, function() chat.send(e.room, "later") end)
+  elseif e.text == "!loop" then
+    while true do end
+  elseif e.text == "!sandbox" then
+    chat.send(e.room, type(os) .. " " .. type(io) .. " " .. type(dofile))
+  end
+end)
+
+chat.command("roll", function(e)
+  return e.username .. " rolled " .. e.args
+end)
+`
+
+// TestScriptEngine runs a script against a client, and checks that one
+// spinning forever is stopped and carries on
+func TestScriptEngine(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "test.lua"), []byte(testScript), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	s, url := newTestServer(t, Config{})
+	engine, err := NewScriptEngine(s, ScriptConfig{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { engine.Close(time.Second) })
+
+	alice := newTestClient(t, url, "alice", ClientOptions{})
+	if msg := alice.waitMessage(t, func(msg ClientMessage) bool { return msg.Private }); msg.From != "bot" || msg.Text != "Welcome to #lobby" {
+		t.Errorf("greeted with %q", msg.Line)
+	}
+	fromBot := func(msg ClientMessage) bool { return msg.From == "bot" && !msg.Private }
+	for _, tc := range []struct{ send, want string }{
+		{"!ping", "pong alice"},
+		{"!sandbox", "nil nil nil"},
+		{"!later", "later"},
+		{"!loop", ""},
+		{"!ping", "pong alice"},
+	} {
+		if err := alice.Send(tc.send); err != nil {
+			t.Fatal(err)
+		}
+		if tc.want == "" {
+			continue
+		}
+		if msg := alice.waitMessage(t, fromBot); msg.Text != tc.want {
+			t.Errorf("%s: got %q, want %q", tc.send, msg.Text, tc.want)
+		}
+	}
+
+	alice.Send("/roll 2d6")
+	if msg := alice.waitMessage(t, func(msg ClientMessage) bool { return strings.Contains(msg.Line, "rolled") }); msg.Line != "alice rolled 2d6" {
+		t.Errorf("/roll replied %q", msg.Line)
+	}
+}
+
+// TestScriptEngineLoadError checks that a script that doesn't load fails
+// the engine
+func TestScriptEngineLoadError(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "bad.lua"), []byte(`chat.on("typing", function() end)`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	s, _ := newTestServer(t, Config{})
+	if _, err := NewScriptEngine(s, ScriptConfig{Dir: dir}); err == nil || !strings.Contains(err.Error(), "bad.lua") {
+		t.Errorf("got %v, want an error loading bad.lua", err)
+	}
+	if _, err := NewScriptEngine(s, ScriptConfig{Dir: t.TempDir()}); err == nil {
+		t.Error("loaded no scripts without an error")
+	}
+}
@@ -0,0 +1,296 @@
+// pkg/chat/sentry.go
+package chat
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sentryQueueSize is how many reports may wait to be sent; more are dropped
+const sentryQueueSize = 100
+
+// SentryConfig describes a Sentry project to report errors to
+type SentryConfig struct {
+	// DSN is the project's client key, e.g.
+	// https://<key>@o123.ingest.sentry.io/456
+	DSN string
+
+	// Environment, Release and ServerName tag every event, e.g.
+	// "production", the server's version and the host name
+	Environment string
+	Release     string
+	ServerName  string
+}
+
+// SentryReporter is an ErrorReporter that sends reports as Sentry events,
+// in the background so Report never blocks. Anything that speaks Sentry's
+// envelope protocol, such as GlitchTip, works too.
+type SentryReporter struct {
+	Config SentryConfig
+	Client *http.Client
+
+	endpoint  string
+	auth      string
+	queue     chan ErrorReport
+	done      chan struct{}
+	mu        sync.Mutex
+	closed    bool
+	muteUntil time.Time
+}
+
+// NewSentryReporter creates a reporter for the project named by cfg.DSN
+func NewSentryReporter(cfg SentryConfig) (*SentryReporter, error) {
+	dsn, err := url.Parse(cfg.DSN)
+	if err != nil || dsn.User == nil || dsn.User.Username() == "" || dsn.Host == "" {
+		return nil, fmt.Errorf("invalid Sentry DSN (want https://<key>@<host>/<project>)")
+	}
+	// The project ID is the last part of the path; anything before it is
+	// where a self-hosted Sentry is mounted
+	path := strings.Trim(dsn.Path, "/")
+	prefix, project := "", path
+	if i := strings.LastIndex(path, "/"); i >= 0 {
+		prefix, project = path[:i+1], path[i+1:]
+	}
+	if project == "" {
+		return nil, fmt.Errorf("invalid Sentry DSN: no project ID")
+	}
+	if cfg.ServerName == "" {
+		cfg.ServerName, _ = os.Hostname()
+	}
+
+	r := &SentryReporter{
+		Config:   cfg,
+		Client:   &http.Client{Timeout: 10 * time.Second},
+		endpoint: fmt.Sprintf("%s://%s/%sapi/%s/envelope/", dsn.Scheme, dsn.Host, prefix, project),
+		auth:     "Sentry sentry_version=7, sentry_client=go-chat, sentry_key=" + dsn.User.Username(),
+		queue:    make(chan ErrorReport, sentryQueueSize),
+		done:     make(chan struct{}),
+	}
+	go r.run()
+	return r, nil
+}
+
+// Report queues report to be sent, dropping it if the queue is full
+func (r *SentryReporter) Report(report ErrorReport) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return
+	}
+	select {
+	case r.queue <- report:
+	default:
+	}
+}
+
+// Close sends the reports still queued, waiting up to timeout
+func (r *SentryReporter) Close(timeout time.Duration) {
+	r.mu.Lock()
+	if !r.closed {
+		r.closed = true
+		close(r.queue)
+	}
+	r.mu.Unlock()
+
+	select {
+	case <-r.done:
+	case <-time.After(timeout):
+	}
+}
+
+// run sends queued reports until Close. Failures are logged as warnings,
+// which aren't reported themselves.
+func (r *SentryReporter) run() {
+	defer close(r.done)
+	for report := range r.queue {
+		if err := r.send(report); err != nil {
+			slog.Warn("Error sending report to Sentry", "err", err)
+		}
+	}
+}
+
+// send posts report as an envelope holding one event
+func (r *SentryReporter) send(report ErrorReport) error {
+	if time.Now().Before(r.muteUntil) {
+		return nil
+	}
+
+	event, err := json.Marshal(r.event(report))
+	if err != nil {
+		return fmt.Errorf("encode event: %w", err)
+	}
+	var body bytes.Buffer
+	fmt.Fprintf(&body, `{"sent_at":%q}`+"\n", time.Now().UTC().Format(time.RFC3339))
+	fmt.Fprintf(&body, `{"type":"event","length":%d}`+"\n", len(event))
+	body.Write(event)
+	body.WriteByte('\n')
+
+	req, err := http.NewRequest(http.MethodPost, r.endpoint, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-sentry-envelope")
+	req.Header.Set("X-Sentry-Auth", r.auth)
+
+	resp, err := r.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests:
+		// Sentry is rate limiting this project, so stop sending for a while
+		wait, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+		if err != nil || wait <= 0 {
+			wait = 60
+		}
+		r.muteUntil = time.Now().Add(time.Duration(wait) * time.Second)
+		return fmt.Errorf("rate limited for %ds", wait)
+	case resp.StatusCode >= 300:
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// sentryEvent is the subset of Sentry's event payload the server fills in
+type sentryEvent struct {
+	EventID     string            `json:"event_id"`
+	Timestamp   string            `json:"timestamp"`
+	Level       string            `json:"level"`
+	Platform    string            `json:"platform"`
+	Logger      string            `json:"logger"`
+	ServerName  string            `json:"server_name,omitempty"`
+	Environment string            `json:"environment,omitempty"`
+	Release     string            `json:"release,omitempty"`
+	Message     map[string]string `json:"message"`
+	Exception   *sentryExceptions `json:"exception,omitempty"`
+	Tags        map[string]string `json:"tags,omitempty"`
+	Extra       map[string]string `json:"extra,omitempty"`
+	User        map[string]string `json:"user,omitempty"`
+}
+
+type sentryExceptions struct {
+	Values []sentryException `json:"values"`
+}
+
+type sentryException struct {
+	Type       string            `json:"type"`
+	Value      string            `json:"value"`
+	Mechanism  map[string]any    `json:"mechanism"`
+	Stacktrace *sentryStacktrace `json:"stacktrace,omitempty"`
+}
+
+type sentryStacktrace struct {
+	Frames []sentryFrame `json:"frames"`
+}
+
+type sentryFrame struct {
+	Function string `json:"function"`
+	AbsPath  string `json:"abs_path"`
+	Lineno   int    `json:"lineno"`
+	InApp    bool   `json:"in_app"`
+}
+
+// event builds the Sentry event for report. Short attributes become
+// searchable tags and long ones extra data; the username and address also
+// identify the user.
+func (r *SentryReporter) event(report ErrorReport) sentryEvent {
+	id := make([]byte, 16)
+	rand.Read(id)
+	event := sentryEvent{
+		EventID:     hex.EncodeToString(id),
+		Timestamp:   report.Time.UTC().Format(time.RFC3339Nano),
+		Level:       "error",
+		Platform:    "go",
+		Logger:      "go-chat",
+		ServerName:  r.Config.ServerName,
+		Environment: r.Config.Environment,
+		Release:     r.Config.Release,
+		Message:     map[string]string{"formatted": report.Message},
+		Tags:        make(map[string]string),
+		Extra:       make(map[string]string),
+	}
+	if report.Panic {
+		event.Level = "fatal"
+	}
+
+	for key, value := range report.Attrs {
+		if len(value) <= 200 {
+			event.Tags[key] = value
+		} else {
+			event.Extra[key] = value
+		}
+	}
+	for attr, field := range map[string]string{"username": "username", "remote_addr": "ip_address"} {
+		if value := report.Attrs[attr]; value != "" {
+			if event.User == nil {
+				event.User = make(map[string]string)
+			}
+			event.User[field] = value
+		}
+	}
+
+	if report.Err != nil {
+		exception := sentryException{
+			Type:      fmt.Sprintf("%T", report.Err),
+			Value:     report.Err.Error(),
+			Mechanism: map[string]any{"type": "generic", "handled": !report.Panic},
+		}
+		if report.Panic {
+			exception.Type = "panic"
+		}
+		if frames := stackFrames(report.Stack); len(frames) > 0 {
+			exception.Stacktrace = &sentryStacktrace{Frames: frames}
+		}
+		event.Exception = &sentryExceptions{Values: []sentryException{exception}}
+	}
+	return event
+}
+
+// stackFrames parses a stack from runtime/debug.Stack into Sentry frames,
+// which run from the outermost call inwards
+func stackFrames(stack string) []sentryFrame {
+	lines := strings.Split(strings.TrimSpace(stack), "\n")
+	// After the "goroutine N [running]:" line, each frame is a function
+	// line followed by a tab-indented "file:line +0xNN" line. For a panic,
+	// the frames down to the call to panic are the recovery code.
+	start := 1
+	for i := 1; i < len(lines); i += 2 {
+		if strings.HasPrefix(lines[i], "panic(") {
+			start = i + 2
+			break
+		}
+	}
+	var frames []sentryFrame
+	for i := start; i+1 < len(lines); i += 2 {
+		function, _, _ := strings.Cut(strings.TrimPrefix(lines[i], "created by "), " in goroutine")
+		if paren := strings.LastIndex(function, "("); paren > 0 && strings.HasSuffix(function, ")") {
+			function = function[:paren]
+		}
+		location, _, _ := strings.Cut(strings.TrimSpace(lines[i+1]), " ")
+		file, line, _ := strings.Cut(location, ":")
+		lineno, _ := strconv.Atoi(line)
+		frames = append(frames, sentryFrame{
+			Function: function,
+			AbsPath:  file,
+			Lineno:   lineno,
+			InApp:    strings.Contains(function, "go-chat"),
+		})
+	}
+	for i, j := 0, len(frames)-1; i < j; i, j = i+1, j-1 {
+		frames[i], frames[j] = frames[j], frames[i]
+	}
+	return frames
+}
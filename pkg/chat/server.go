@@ -2,260 +2,1297 @@
 package chat
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
+	"runtime"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
 )
 
-// Client represents a connected chat user
-type Client struct {
+// Session is a connected chat user, on the server side
+type Session struct {
+	// Conn is the client's connection if it joined over a WebSocket served
+	// by gorilla/websocket, and nil for other transports
 	Conn     *websocket.Conn
 	Username string
+	Role     Role
 	Server   *Server
+
+	// Room is the room the client's messages go to
+	Room string
+
+	// IP is the address the client connected from
+	IP string
+
+	// UserAgent is the User-Agent header of the upgrade request
+	UserAgent string
+
+	// PublicKey is the client's base64 X25519 key for encrypted whispers,
+	// if it published one
+	PublicKey string
+
+	// LoggedIn is set once the client has proven it owns a registered account
+	LoggedIn bool
+
+	// Authenticated is set if the client's credentials named its user, so
+	// the authenticator vouches for its username
+	Authenticated bool
+
+	// conn is the client's connection, whatever the transport
+	conn wsConn
+
+	// ctx is cancelled once the client has disconnected
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// joinedAt is when the client was registered
+	joinedAt time.Time
+
+	// done is closed once ReadPump has unregistered the client
+	done chan struct{}
+
+	// outbox holds the messages waiting for writePump, which closes
+	// written when it stops. closing is set once nothing more should be
+	// queued. The outbox is never closed, so send can't panic.
+	outbox  chan outbound
+	written chan struct{}
+	closing atomic.Bool
+
+	// batched is set if the client takes batches (see BatchProtocol)
+	batched bool
+
+	// polled is the connection if the epoll transport's poller serves the
+	// client, rather than ReadPump and writePump. Its write pump, flush,
+	// runs while flushing is set, and pings when pingDue is.
+	polled   *epollConn
+	flushing atomic.Bool
+	pingDue  atomic.Bool
+
+	// queuedBytes is the size of the messages in the outbox, counted from
+	// when they are queued until they are written
+	queuedBytes atomic.Int64
+
+	// behind is set while the client's outbox is full and messages for it
+	// are being dropped (see SlowClientPolicy); dropped counts them
+	behind  atomic.Bool
+	dropped atomic.Int64
+
+	// lastMessage is when the client last posted to its room, for the
+	// guest and slow mode rate limits
+	lastMessage time.Time
+
+	// Flood control state: the message rate limiter and recent rate-limit
+	// strikes
+	limiter      *tokenBucket
+	strikes      int
+	strikesSince time.Time
+
+	// spamState tracks recent messages and offences for spam detection
+	spamState spamState
+
+	// Traffic counters for the access log, kept by writePump and
+	// ReadPump
+	sentMessages     atomic.Int64
+	sentBytes        atomic.Int64
+	receivedMessages int64
+	receivedBytes    int64
 }
 
 // Server manages all active clients
 type Server struct {
-	// Map of active clients
-	Clients map[*Client]bool
+	// clients holds the clients connected to this instance
+	clients *registry
+
+	// Settings the server was created with; Reload changes the limits and
+	// filters in effect
+	Config Config
+
+	// current holds the settings in effect (see config)
+	current atomic.Pointer[Config]
+
+	// Backplane state: this instance's ID on the backplane and the users
+	// connected to other instances
+	instanceID string
+	remote     presence
+
+	// log receives the server's log output (Config.Logger), and
+	// accessLog the access log (Config.AccessLog)
+	log       *slog.Logger
+	accessLog *slog.Logger
+
+	// Store records chat messages for history replay
+	Store MessageStore
+
+	// PrivateStore records whispers, kept apart from room history
+	PrivateStore MessageStore
+
+	// Users holds registered accounts
+	Users UserStore
+
+	// Bans holds banned usernames and IPs
+	Bans BanStore
+
+	// PushSubscriptions holds the browsers users receive Web Push at
+	PushSubscriptions PushStore
+
+	// Audit records security-relevant events
+	Audit *AuditLog
+
+	// upgrader is Upgrader with this server's origin policy
+	upgrader websocket.Upgrader
+
+	// broadcasts shares out large broadcasts, or is nil if
+	// Config.BroadcastWorkers is 0
+	broadcasts *broadcastPool
+
+	// netpoll serves clients with TransportEpoll, or is nil
+	netpoll *netpoll
+
+	// events holds the open event streams (see HandleEvents)
+	events *eventStreams
+
+	// proxies holds the parsed TrustedProxies in effect
+	proxies atomic.Pointer[proxyList]
+
+	// upgrades paces WebSocket upgrades across the server, and
+	// rejectedUpgrades counts those it turned away
+	upgrades         *upgradeLimiter
+	rejectedUpgrades atomic.Int64
+
+	// ipLimits caps connections per source IP
+	ipLimits *ipLimiter
+
+	// logins locks out usernames and IPs after failed logins
+	logins *loginGuard
+
+	// rooms are the rooms that exist even when empty
+	rooms map[string]bool
+
+	// history holds each room's newest messages for replay, or is nil if
+	// HistorySize is 0
+	history *historyCache
+
+	// mutes holds the users who may not post
+	mutes *muteList
+
+	// shadowbans holds the users whose messages only they can see
+	shadowbans *shadowList
 
-	// Mutex to protect clients map from concurrent access
-	Mutex sync.Mutex
+	// apiLimits holds the message rate limits of users posting through
+	// the REST API
+	apiLimits apiLimits
 
-	// Keep track of when clients joined
-	ClientJoinTime map[*Client]time.Time
+	// email mails offline users their mentions and whispers, or is nil
+	// without Config.Email
+	email *emailNotifier
+
+	// push sends offline users' mentions and whispers to their browsers,
+	// or is nil without Config.WebPush
+	push *webPusher
+
+	// startedAt, connections and messages feed the admin API's stats:
+	// when the server was created, how many clients have joined and how
+	// many room messages have been sent since then
+	startedAt   time.Time
+	connections atomic.Int64
+	messages    atomic.Int64
+
+	// messageRate measures room messages per second for Vars
+	messageRate rateMeter
+
+	// slowClients counts the times a client fell behind, and dropped the
+	// messages dropped for clients that did, for Vars
+	slowClients atomic.Int64
+	dropped     atomic.Int64
+
+	// queuedBytes is the total waiting in every client's outbox as of the
+	// latest checkMemory
+	queuedBytes atomic.Int64
+
+	// running is set once Run has started, and registryProbe while a
+	// health check is waiting for the registry
+	running       atomic.Bool
+	registryProbe atomic.Bool
+
+	// draining is set by Shutdown to refuse new clients
+	draining atomic.Bool
+
+	// automod holds the auto-moderation rules, which may change at runtime
+	automodMu sync.RWMutex
+	automod   []AutomodRule
+
+	// slowMode is the current slow mode interval in nanoseconds
+	slowMode atomic.Int64
+
+	// motd is the welcome message, which may change at runtime
+	motdMu sync.RWMutex
+	motd   string
+
+	// bridges relay room messages to other chat services
+	bridgesMu sync.RWMutex
+	bridges   []bridge
+
+	// commands holds the commands added with RegisterCommand
+	commandsMu sync.RWMutex
+	commands   map[string]CommandFunc
+
+	// subscriptions holds the open subscriptions to events (see Subscribe)
+	subscriptionsMu sync.RWMutex
+	subscriptions   map[*Subscription]bool
 }
 
-// Upgrader converts HTTP connections to WebSocket connections
+// Config holds tunable server settings
+type Config struct {
+	// Version is the server's version, reported by /health
+	Version string
+
+	// HistorySize is how many recent messages are replayed to a new client,
+	// and kept in memory for each room to replay them from
+	HistorySize int
+
+	// Store is where messages are recorded; nil means an in-memory store
+	Store MessageStore
+
+	// PrivateStore is where whispers are recorded; nil means an in-memory store
+	PrivateStore MessageStore
+
+	// Users is where accounts are kept; nil means an in-memory store
+	Users UserStore
+
+	// Bans is where bans are kept; nil means an in-memory store
+	Bans BanStore
+
+	// PushSubscriptions is where Web Push subscriptions are kept; nil
+	// means an in-memory store
+	PushSubscriptions PushStore
+
+	// Audit receives security-relevant events; nil keeps only the most
+	// recent ones in memory
+	Audit *AuditLog
+
+	// RetentionMaxAge deletes stored messages older than this (0 keeps forever)
+	RetentionMaxAge time.Duration
+
+	// RetentionMaxMessages caps how many messages are kept per room (0 is unlimited)
+	RetentionMaxMessages int
+
+	// PruneInterval is how often the retention policy is enforced
+	PruneInterval time.Duration
+
+	// Archiver, if set, receives messages older than RetentionMaxAge
+	// before they are pruned
+	Archiver Archiver
+
+	// MOTD is the welcome message sent to joining clients (see DefaultMOTD
+	// for the placeholders); empty means DefaultMOTD
+	MOTD string
+
+	// Logger receives the server's log output; nil uses slog.Default()
+	Logger *slog.Logger
+
+	// Backplane, if set, connects this server to other instances so that
+	// rooms, broadcasts, whispers and the user list span all of them
+	Backplane Backplane
+
+	// AccessLog, if set, receives an entry for every WebSocket upgrade
+	// request and a traffic summary of every connection when it closes
+	AccessLog *slog.Logger
+
+	// Exporter, if set, receives every room message, mention, whisper,
+	// join, departure and audit event; see Exporters to have several
+	Exporter EventExporter
+
+	// ErrorReporter, if set, receives panics in client goroutines and
+	// everything logged at error level
+	ErrorReporter ErrorReporter
+
+	// Hooks run, in order, when clients connect, post, send commands and
+	// disconnect; see Hook
+	Hooks []Hook
+
+	// AdminToken authenticates requests to the admin API; empty disables it
+	AdminToken string
+
+	// Auth, if set, must accept a request before it is upgraded
+	Auth Authenticator
+
+	// AllowGuests admits connections that Auth rejects as guest-NNN users
+	// who can read and post but not whisper, register, or create rooms
+	AllowGuests bool
+
+	// AutomodRules are applied to every room message (see AutomodRule)
+	AutomodRules []AutomodRule
+
+	// SlowMode, if set, starts the server in slow mode: users other than
+	// moderators may post once per SlowMode. Admins can change it at runtime.
+	SlowMode time.Duration
+
+	// Rooms always exist, like the default room, even when nobody is in
+	// them: they are listed by /rooms and guests may join them
+	Rooms []string
+
+	// GuestMessageInterval is the minimum time between a guest's messages
+	GuestMessageInterval time.Duration
+
+	// ReservedNames may only be used by connections that authenticate as
+	// that user or log in to a registered account with that name
+	ReservedNames []string
+
+	// AllowedOrigins lists the web origins, besides the server's own, whose
+	// pages may connect (see originMatches); AllOrigins allows any
+	AllowedOrigins []string
+
+	// ProofOfWorkBits, if positive, makes every connection solve a
+	// proof-of-work puzzle of that many bits before joining (see
+	// SolveProofOfWork); each extra bit doubles the work
+	ProofOfWorkBits int
+
+	// MaxClients caps how many users may be connected at once (0 is unlimited)
+	MaxClients int
+
+	// MaxConnectionsPerIP caps concurrent connections from one IP (0 is unlimited)
+	MaxConnectionsPerIP int
+
+	// ConnectionsPerMinute caps connection attempts per IP per minute (0 is unlimited)
+	ConnectionsPerMinute int
+
+	// UpgradesPerSecond caps WebSocket upgrades across the server after a
+	// burst of UpgradeBurst (0 is unlimited). Up to UpgradeQueue more wait
+	// their turn; the rest are turned away with a Retry-After.
+	UpgradesPerSecond int
+	UpgradeBurst      int
+	UpgradeQueue      int
+
+	// TrustedProxies lists proxy IPs or CIDR ranges whose X-Forwarded-For
+	// and X-Real-IP headers are believed when working out a client's IP
+	TrustedProxies []string
+
+	// MessageRate and MessageBurst limit how fast each client may send
+	// (messages per second, with bursts of up to MessageBurst); a zero
+	// MessageRate disables flood control
+	MessageRate  float64
+	MessageBurst int
+
+	// FloodMuteStrikes rate-limited messages within a minute mute the client
+	// for FloodMuteDuration (0 never mutes)
+	FloodMuteStrikes  int
+	FloodMuteDuration time.Duration
+
+	// LoginMaxFailures failed logins (passwords, tokens or admin tokens)
+	// for a username or from an IP are allowed before it is locked out
+	// for LoginLockout, doubling with each further failure up to
+	// LoginLockoutMax (0 never locks out)
+	LoginMaxFailures int
+	LoginLockout     time.Duration
+	LoginLockoutMax  time.Duration
+
+	// EchoMutedMessages shows muted users their own room messages (marked
+	// as not delivered) instead of an error
+	EchoMutedMessages bool
+
+	// BlockLinks refuses messages with links outside LinkDomains, and
+	// LinkMinAccountAge refuses them from accounts younger than this (or
+	// unregistered users). Moderators are exempt from both.
+	BlockLinks        bool
+	LinkDomains       []string
+	LinkMinAccountAge time.Duration
+
+	// Room messages are spam if the same text is sent SpamRepeatLimit times
+	// in a row, at least SpamCapsPercent of their letters are capitals, or
+	// they are one of SpamBurstMessages within SpamBurstWindow (0 disables
+	// each check). Offences within SpamStrikeWindow of each other escalate:
+	// a warning, then the user may post only once per SpamSlowInterval for
+	// SpamSlowDuration, then a SpamMuteDuration mute. Moderators are exempt.
+	SpamRepeatLimit   int
+	SpamCapsPercent   int
+	SpamBurstMessages int
+	SpamBurstWindow   time.Duration
+	SpamStrikeWindow  time.Duration
+	SpamSlowInterval  time.Duration
+	SpamSlowDuration  time.Duration
+	SpamMuteDuration  time.Duration
+
+	// Compression offers permessage-deflate to clients. Those that accept
+	// it get messages of at least CompressionThreshold bytes compressed at
+	// CompressionLevel, from 1 (fastest, the default) to 9 (smallest).
+	Compression          bool
+	CompressionLevel     int
+	CompressionThreshold int
+
+	// SlowClientPolicy decides what happens when a client falls so far
+	// behind that its outbox is full; the default is SlowClientDisconnect
+	SlowClientPolicy SlowClientPolicy
+
+	// A client is assumed gone if nothing arrives within ReadTimeout of
+	// its last message or PongWait of its last pong, whichever was later.
+	// Clients are pinged every PingInterval, which must be well under
+	// PongWait. A write taking more than WriteTimeout also drops the
+	// client.
+	ReadTimeout  time.Duration
+	PongWait     time.Duration
+	PingInterval time.Duration
+	WriteTimeout time.Duration
+
+	// SendQueueSize is how many messages, and SendQueueBytes how many
+	// bytes of them, may wait to be written to a client before
+	// SlowClientPolicy applies
+	SendQueueSize  int
+	SendQueueBytes int
+
+	// MaxQueuedBytes caps the bytes waiting to be written across all
+	// clients (0 is unlimited). Beyond it, any client with a backlog is
+	// treated as too slow under SlowClientPolicy; clients keeping up are
+	// unaffected. The total is taken every second, so it may be overshot
+	// briefly.
+	MaxQueuedBytes int
+
+	// MaxHistoryMessages and MaxRoomMessages cap how many messages an
+	// in-memory or file store keeps in memory, in all and in each room (0
+	// is unlimited). The oldest are evicted first, a batch at a time, so a
+	// store may go an eighth over. A file store keeps evicted messages on
+	// disk until pruning or erasing a user next rewrites the file.
+	MaxHistoryMessages int
+	MaxRoomMessages    int
+
+	// ReadBufferSize and WriteBufferSize are the sizes in bytes of each
+	// connection's I/O buffers; messages larger than these still work
+	ReadBufferSize  int
+	WriteBufferSize int
+
+	// BatchSize, if more than 1, lets clients that ask for BatchProtocol
+	// receive up to that many queued messages in one frame. A batch is
+	// written BatchDelay after its first message, and if BatchDelay is 0
+	// holds only what was already queued.
+	BatchSize  int
+	BatchDelay time.Duration
+
+	// BroadcastWorkers is how many goroutines share out queueing
+	// broadcasts to rooms of more than a few hundred clients (0 queues
+	// them all from the sender's goroutine)
+	BroadcastWorkers int
+
+	// Transport serves the connections; the default is TransportGorilla
+	Transport Transport
+
+	// Email, if set, lets registered users add an address with /email to
+	// be mailed digests of the mentions and whispers they get while offline
+	Email *EmailConfig
+
+	// WebPush, if set, lets registered users subscribe their browsers with
+	// /push to notifications of mentions and whispers while offline
+	WebPush *WebPushConfig
+}
+
+// DefaultConfig returns the settings used by NewServer
+func DefaultConfig() Config {
+	return Config{
+		HistorySize:          50,
+		PruneInterval:        10 * time.Minute,
+		GuestMessageInterval: 3 * time.Second,
+		ReservedNames:        DefaultReservedNames,
+		MaxConnectionsPerIP:  10,
+		ConnectionsPerMinute: 30,
+		MessageRate:          5,
+		MessageBurst:         10,
+		FloodMuteStrikes:     10,
+		FloodMuteDuration:    time.Minute,
+		LoginMaxFailures:     5,
+		LoginLockout:         time.Minute,
+		LoginLockoutMax:      time.Hour,
+		SpamRepeatLimit:      3,
+		SpamCapsPercent:      80,
+		SpamBurstMessages:    8,
+		SpamBurstWindow:      10 * time.Second,
+		SpamStrikeWindow:     10 * time.Minute,
+		SpamSlowInterval:     10 * time.Second,
+		SpamSlowDuration:     5 * time.Minute,
+		SpamMuteDuration:     10 * time.Minute,
+		CompressionThreshold: DefaultCompressionThreshold,
+		SlowClientPolicy:     SlowClientDisconnect,
+		ReadTimeout:          DefaultReadTimeout,
+		PongWait:             DefaultPongWait,
+		PingInterval:         DefaultPingInterval,
+		WriteTimeout:         DefaultWriteTimeout,
+		SendQueueSize:        DefaultSendQueueSize,
+		SendQueueBytes:       DefaultSendQueueBytes,
+		ReadBufferSize:       DefaultBufferSize,
+		WriteBufferSize:      DefaultBufferSize,
+		BroadcastWorkers:     runtime.NumCPU(),
+	}
+}
+
+// Defaults for the connection settings in Config, used for any left at zero
+const (
+	DefaultReadTimeout    = 10 * time.Minute
+	DefaultPongWait       = 10 * time.Minute
+	DefaultPingInterval   = 30 * time.Second
+	DefaultWriteTimeout   = 10 * time.Second
+	DefaultSendQueueSize  = 256
+	DefaultSendQueueBytes = 1 << 20
+	DefaultBufferSize     = 1024
+)
+
+// connectionDefaults fills in the connection settings left at zero
+func (cfg *Config) connectionDefaults() {
+	defaultTo := func(d *time.Duration, value time.Duration) {
+		if *d <= 0 {
+			*d = value
+		}
+	}
+	defaultTo(&cfg.ReadTimeout, DefaultReadTimeout)
+	defaultTo(&cfg.PongWait, DefaultPongWait)
+	defaultTo(&cfg.PingInterval, DefaultPingInterval)
+	defaultTo(&cfg.WriteTimeout, DefaultWriteTimeout)
+	if cfg.SendQueueSize <= 0 {
+		cfg.SendQueueSize = DefaultSendQueueSize
+	}
+	if cfg.SendQueueBytes <= 0 {
+		cfg.SendQueueBytes = DefaultSendQueueBytes
+	}
+	if cfg.ReadBufferSize <= 0 {
+		cfg.ReadBufferSize = DefaultBufferSize
+	}
+	if cfg.WriteBufferSize <= 0 {
+		cfg.WriteBufferSize = DefaultBufferSize
+	}
+}
+
+// Upgrader converts HTTP connections to WebSocket connections. Each server
+// replaces CheckOrigin with its Config.AllowedOrigins policy, and the buffer
+// sizes with Config's.
 var Upgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
-	CheckOrigin: func(r *http.Request) bool {
-		return true // Allow all connections for simplicity
-	},
+	ReadBufferSize:  DefaultBufferSize,
+	WriteBufferSize: DefaultBufferSize,
 }
 
-// NewServer creates a new chat server instance
+// NewServer creates a new chat server instance with the default settings
 func NewServer() *Server {
-	return &Server{
-		Clients:        make(map[*Client]bool),
-		ClientJoinTime: make(map[*Client]time.Time),
-	}
+	return NewServerWithConfig(DefaultConfig())
 }
 
-// Run starts the server's main process (keeping for compatibility)
-func (s *Server) Run() {
-	log.Println("Server running and ready for connections")
-	// This method is now mostly for compatibility - the real work happens in the WebSocket handlers
+// NewServerWithConfig creates a new chat server instance with custom settings
+func NewServerWithConfig(cfg Config) *Server {
+	store := cfg.Store
+	if store == nil {
+		store = NewMemoryStore()
+	}
+	privateStore := cfg.PrivateStore
+	if privateStore == nil {
+		privateStore = NewMemoryStore()
+	}
+	users := cfg.Users
+	if users == nil {
+		users = NewMemoryUserStore()
+	}
+	bans := cfg.Bans
+	if bans == nil {
+		bans = NewMemoryBanStore()
+	}
+	pushSubscriptions := cfg.PushSubscriptions
+	if pushSubscriptions == nil {
+		pushSubscriptions = NewMemoryPushStore()
+	}
+	audit := cfg.Audit
+	if audit == nil {
+		audit = NewAuditLog(nil)
+	}
+
+	logger := cfg.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	if cfg.ErrorReporter != nil {
+		logger = reportErrors(logger, cfg.ErrorReporter)
+	}
+	level, err := compressionLevel(cfg.CompressionLevel)
+	if err != nil {
+		logger.Warn("Using the default compression level", "err", err)
+	}
+	cfg.CompressionLevel = level
+	cfg.connectionDefaults()
+	if cfg.PingInterval >= cfg.PongWait {
+		logger.Warn("Clients will time out between pings: the ping interval should be well under the pong wait",
+			"ping_interval", cfg.PingInterval, "pong_wait", cfg.PongWait)
+	}
+
+	s := &Server{
+		clients:           newRegistry(),
+		Config:            cfg,
+		Store:             store,
+		PrivateStore:      privateStore,
+		Users:             users,
+		Bans:              bans,
+		PushSubscriptions: pushSubscriptions,
+		Audit:             audit,
+		upgrader:          Upgrader,
+		broadcasts:        newBroadcastPool(cfg.BroadcastWorkers),
+		upgrades:          newUpgradeLimiter(cfg.UpgradesPerSecond, cfg.UpgradeBurst, cfg.UpgradeQueue),
+		ipLimits:          newIPLimiter(cfg.ConnectionsPerMinute, cfg.MaxConnectionsPerIP),
+		logins:            newLoginGuard(cfg.LoginMaxFailures, cfg.LoginLockout, cfg.LoginLockoutMax),
+		rooms:             permanentRooms(cfg.Rooms, logger),
+		history:           newHistoryCache(cfg.HistorySize),
+		events:            newEventStreams(),
+		log:               logger,
+		accessLog:         cfg.AccessLog,
+		mutes:             newMuteList(),
+		shadowbans:        newShadowList(),
+		startedAt:         time.Now(),
+		instanceID:        newInstanceID(),
+	}
+	s.current.Store(&s.Config)
+	limitHistory(store, &cfg)
+	limitHistory(privateStore, &cfg)
+	s.upgrader.CheckOrigin = s.checkOrigin
+	s.upgrader.EnableCompression = cfg.Compression
+	s.upgrader.ReadBufferSize = cfg.ReadBufferSize
+	s.upgrader.WriteBufferSize = cfg.WriteBufferSize
+	if cfg.BatchSize > 1 {
+		s.upgrader.Subprotocols = []string{BatchProtocol}
+	}
+	if cfg.Transport == TransportEpoll {
+		s.netpoll, err = newNetpoll(s)
+		if err != nil {
+			s.log.Warn("Using the gorilla transport", "err", err)
+		} else if cfg.Compression {
+			s.log.Warn("The epoll transport doesn't compress messages; only TLS connections will be compressed")
+		}
+	}
+	if cfg.Email != nil {
+		s.email = newEmailNotifier(s, *cfg.Email)
+	}
+	if cfg.WebPush != nil {
+		s.push = newWebPusher(s, *cfg.WebPush)
+	}
+	s.SetMOTD(cfg.MOTD)
+	s.slowMode.Store(int64(cfg.SlowMode))
+	s.setProxies(cfg.TrustedProxies)
+	if err := s.SetAutomodRules(cfg.AutomodRules); err != nil {
+		s.log.Warn("Ignoring automod rules", "err", err)
+	}
+	return s
 }
 
-// broadcastMessage sends a message to all connected clients
-func (s *Server) broadcastMessage(message string) {
-	log.Printf("Broadcasting: %s", message)
+// Run does the server's background work, such as enforcing the retention
+// policy, until ctx is done. The real work of serving clients happens in
+// the WebSocket handlers.
+func (s *Server) Run(ctx context.Context) {
+	s.log.Info("Server running and ready for connections")
+	s.running.Store(true)
+	defer s.running.Store(false)
+	if s.Config.Backplane != nil {
+		go s.runBackplane(ctx)
+	}
+	go s.watchMemory(ctx)
+
+	if s.Config.RetentionMaxAge <= 0 && s.Config.RetentionMaxMessages <= 0 {
+		<-ctx.Done()
+		return
+	}
+
+	interval := s.Config.PruneInterval
+	if interval <= 0 {
+		interval = DefaultConfig().PruneInterval
+	}
+
+	s.pruneHistory()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.pruneHistory()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
 
-	s.Mutex.Lock()
-	defer s.Mutex.Unlock()
+// pruneHistory applies the retention policy to the message stores. Only room
+// history is archived; private messages are never uploaded anywhere.
+func (s *Server) pruneHistory() {
+	var cutoff time.Time
+	if s.Config.RetentionMaxAge > 0 {
+		cutoff = time.Now().Add(-s.Config.RetentionMaxAge)
+	}
 
-	for client := range s.Clients {
-		err := client.Conn.WriteMessage(websocket.TextMessage, []byte(message))
+	// Archive expired messages first; if that fails keep them for next time
+	if s.Config.Archiver != nil && !cutoff.IsZero() {
+		expired, err := s.Store.Before(cutoff)
 		if err != nil {
-			log.Printf("Error sending to client %s: %v", client.Username, err)
-			// Will be removed in ReadPump when connection error is detected
+			s.log.Error("Error loading messages to archive", "err", err)
+			return
+		}
+		if len(expired) > 0 {
+			if err := s.Config.Archiver.Archive(expired); err != nil {
+				s.log.Error("Error archiving messages, skipping prune", "messages", len(expired), "err", err)
+				return
+			}
+			s.log.Info("Archived messages", "messages", len(expired))
 		}
 	}
+
+	removed, err := s.Store.Prune(cutoff, s.Config.RetentionMaxMessages)
+	if removed > 0 && s.history != nil {
+		s.history.reset()
+	}
+	if err != nil {
+		s.log.Error("Error pruning message history", "err", err)
+		return
+	}
+	if removed > 0 {
+		s.log.Info("Pruned message history", "messages", removed)
+	}
+
+	removed, err = s.PrivateStore.Prune(cutoff, s.Config.RetentionMaxMessages)
+	if err != nil {
+		s.log.Error("Error pruning private message history", "err", err)
+		return
+	}
+	if removed > 0 {
+		s.log.Info("Pruned private messages", "messages", removed)
+	}
+}
+
+// broadcastMessage sends a message to all connected clients, on every
+// instance
+func (s *Server) broadcastMessage(message string) {
+	s.deliverToAll(message)
+	s.publish(backplaneEvent{Type: eventAll, Text: message})
+}
+
+// deliverToAll sends a message to all clients connected to this instance
+func (s *Server) deliverToAll(message string) {
+	s.log.Debug("Broadcasting", "message", message)
+	s.sendToEach(s.clients.filter(nil), message)
+}
+
+// recordMessage stores a chat message so it can be replayed to later clients
+func (s *Server) recordMessage(ctx context.Context, room, from, text string) {
+	msg := Message{
+		Room: room,
+		From: from,
+		Text: text,
+		Time: time.Now(),
+	}
+	var err error
+	if s.history != nil {
+		err = s.history.record(ctx, s.Store, msg)
+	} else {
+		_, err = appendMessage(ctx, s.Store, msg)
+	}
+	if err != nil {
+		s.log.Error("Error storing message", "username", from, "room", room, "err", err)
+	}
+}
+
+// replayHistory sends the most recent messages in the client's room to a
+// newly joined client. They are copied out of the room's history ring into
+// a pooled slice and formatted in a pooled buffer, so the only allocation
+// is the message sent.
+func (s *Server) replayHistory(client *Session) {
+	if s.history == nil {
+		return
+	}
+
+	messages := historyBuffers.Get().(*[]Message)
+	defer func() {
+		clear(*messages)
+		historyBuffers.Put(messages)
+	}()
+	var err error
+	*messages, err = s.history.recent(s.Store, client.Room, *messages)
+	if err != nil {
+		client.logger().Error("Error loading history", "err", err)
+		return
+	}
+	if len(*messages) == 0 {
+		return
+	}
+
+	buf := getBuffer()
+	defer putBuffer(buf)
+	formatHistory(buf, *messages)
+	client.send(buf.String())
 }
 
 // HandleWebSocket upgrades HTTP connections to WebSocket
 func (s *Server) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
-	conn, err := Upgrader.Upgrade(w, r, nil)
+	s.serveConnection(w, r, s.upgrade)
+}
+
+// serveConnection admits the client making r: it checks the limits, bans
+// and credentials, connects with upgrade, then takes the client through
+// joining and starts its pumps
+func (s *Server) serveConnection(w http.ResponseWriter, r *http.Request, upgrade func(http.ResponseWriter, *http.Request) (wsConn, error)) {
+	// Turn away connection floods before doing any real work
+	ip := s.clientIP(r)
+	access := &upgradeRequest{start: time.Now(), ip: ip, userAgent: r.UserAgent(), result: "rejected"}
+	defer s.logUpgrade(access)
+	if s.Draining() {
+		access.result = "draining"
+		s.rejectDraining(w, ip)
+		return
+	}
+	if !s.ipLimits.acquire(ip) {
+		access.result = "rate_limited"
+		s.log.Warn("Rate limited connection", "remote_addr", ip)
+		s.audit(AuditRejected, "", "", ip, "connection rate limit")
+		w.Header().Set("Retry-After", "60")
+		http.Error(w, "too many connections", http.StatusTooManyRequests)
+		return
+	}
+	handedOff := false
+	defer func() {
+		// Once ReadPump is running it releases the slot on disconnect
+		if !handedOff {
+			s.ipLimits.release(ip)
+		}
+	}()
+	if admitted, retry := s.upgrades.wait(r.Context()); !admitted {
+		access.result = "overloaded"
+		if r.Context().Err() == nil {
+			s.rejectOverloaded(w, ip, retry)
+		}
+		return
+	}
+
+	if ban, banned := s.checkBan("", ip); banned {
+		access.result = "banned"
+		s.log.Info("Rejected banned IP", "remote_addr", ip)
+		s.audit(AuditRejected, "", "", ip, "banned IP")
+		http.Error(w, strings.TrimPrefix(banMessage(ban), "ERROR: "), http.StatusForbidden)
+		return
+	}
+
+	// Authenticate before upgrading so rejected clients get a plain 401
+	identity := Identity{Role: RoleUser}
+	if s.Config.Auth != nil {
+		// Only requests that present credentials count towards lockouts,
+		// so guests aren't locked out for having none. Failures count
+		// against the IP, and the username claimed if there is one.
+		claimed, hasCredentials := presentedCredentials(r)
+		if hasCredentials {
+			if wait, locked := s.loginLocked(claimed, ip); locked {
+				access.result = "locked_out"
+				lockedOutError(w, wait)
+				return
+			}
+		}
+
+		id, err := s.authenticate(r)
+		if err != nil && errors.Is(err, ErrUnauthorized) && hasCredentials {
+			s.loginFailed(claimed, ip)
+		}
+		switch {
+		case err == nil:
+			identity = id
+			s.logins.succeed(identity.Username)
+			if identity.Role == "" {
+				identity.Role = RoleUser
+			}
+		case !errors.Is(err, ErrUnauthorized):
+			// The credential backend itself failed (e.g. LDAP is down)
+			access.result = "auth_unavailable"
+			s.log.Warn("Rejected connection", "remote_addr", ip, "err", err)
+			s.audit(AuditAuthFailure, "", "", ip, err.Error())
+			http.Error(w, "authentication unavailable", http.StatusServiceUnavailable)
+			return
+		case s.config().AllowGuests:
+			guest, guestErr := s.guestIdentity()
+			if guestErr != nil {
+				access.result = "guest_unavailable"
+				s.log.Warn("Rejected guest", "remote_addr", ip, "err", guestErr)
+				s.audit(AuditAuthFailure, "", "", ip, "no guest name: "+guestErr.Error())
+				http.Error(w, "no guest name available, try again later", http.StatusServiceUnavailable)
+				return
+			}
+			identity = guest
+			s.log.Info("Admitting as guest", "remote_addr", ip, "username", identity.Username, "err", err)
+			s.audit(AuditAuthFailure, "", identity.Username, ip, "admitted as guest: "+err.Error())
+		default:
+			access.result = "unauthorized"
+			s.log.Warn("Rejected connection", "remote_addr", ip, "err", err)
+			s.audit(AuditAuthFailure, "", "", ip, err.Error())
+			w.Header().Set("WWW-Authenticate", `Bearer realm="go-chat"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	conn, err := upgrade(w, r)
 	if err != nil {
-		log.Println("Error upgrading connection:", err)
+		access.result = "upgrade_failed"
+		s.log.Warn("Error upgrading connection", "remote_addr", ip, "err", err)
+		return
+	}
+
+	if s.full() {
+		access.result = "full"
+		s.rejectFull(conn, ip)
 		return
 	}
 
 	// Get username first
 	_, usernameMsg, err := conn.ReadMessage()
 	if err != nil {
+		access.result = "closed"
 		conn.Close()
-		log.Println("Error reading username:", err)
+		s.log.Info("Error reading username", "remote_addr", ip, "err", err)
 		return
 	}
 
 	username := string(usernameMsg)
-	log.Printf("User connecting: %s", username)
+	if identity.Username == "" {
+		// The client picked its own name, so make sure it's a sane one
+		username, err = validateUsername(username)
+		if err != nil {
+			access.result = "invalid_username"
+			s.log.Info("Rejected invalid username", "username", string(usernameMsg), "remote_addr", ip, "err", err)
+			s.audit(AuditRejected, "", string(usernameMsg), ip, "invalid username")
+			conn.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf("ERROR: %s: Invalid username: %v.", ErrUsernameInvalid, err)))
+			conn.Close()
+			return
+		}
+	} else {
+		// Credentials that name a user take precedence over the requested name
+		if !strings.EqualFold(username, identity.Username) {
+			s.log.Info("Using authenticated username", "requested", username, "username", identity.Username, "remote_addr", ip)
+		}
+		username = identity.Username
+	}
+	access.username = username
+	s.log.Debug("User connecting", "username", username, "remote_addr", ip)
 
-	// Check if username is already taken
-	s.Mutex.Lock()
-	usernameTaken := false
-	for client := range s.Clients {
-		if strings.EqualFold(client.Username, username) {
-			usernameTaken = true
-			break
+	// Make bots pay before doing any expensive work on their behalf
+	if !s.requireProofOfWork(conn, ip) {
+		access.result = "proof_of_work_failed"
+		conn.Close()
+		return
+	}
+
+	if ban, banned := s.checkBan(username, ""); banned {
+		access.result = "banned"
+		s.log.Info("Rejected banned user", "username", username, "remote_addr", ip)
+		s.audit(AuditRejected, "", username, ip, "banned user")
+		conn.WriteMessage(websocket.TextMessage, []byte(banMessage(ban)))
+		conn.Close()
+		return
+	}
+
+	// Registered usernames must prove they own the account. Guest names are
+	// picked to avoid registered ones.
+	var account User
+	if identity.Role != RoleGuest {
+		var ok bool
+		account, ok = s.claimAccount(conn, r, username, identity)
+		if !ok {
+			access.result = "login_failed"
+			conn.Close()
+			return
 		}
 	}
-	s.Mutex.Unlock()
+	loggedIn := account.Username != ""
+	if loggedIn {
+		username = account.Username
+		access.username = username
+		if roleRank(account.Role) > roleRank(identity.Role) {
+			identity.Role = account.Role
+		}
+	}
+
+	// Reserved names need credentials for that exact name
+	if !loggedIn && !sameUsername(identity.Username, username) && s.reservedName(username, identity) {
+		access.result = "reserved_username"
+		s.log.Info("Rejected reserved username", "username", username, "remote_addr", ip)
+		s.audit(AuditRejected, "", username, ip, "reserved username")
+		conn.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf(
+			"ERROR: %s: The username %s is reserved. Please choose another name.", ErrUsernameReserved, username)))
+		conn.Close()
+		return
+	}
 
-	if usernameTaken {
+	// Check if username is already taken
+	if s.usernameTaken(username) {
+		access.result = "username_taken"
 		// Notify client that username is taken
 		conn.WriteMessage(websocket.TextMessage, []byte("ERROR: Username already taken. Please try again with a different name."))
 		conn.Close()
 		return
 	}
 
-	client := &Client{
-		Conn:     conn,
-		Username: username,
-		Server:   s,
+	// IRC clients learn the name they end up with in the welcome
+	if irc, ok := conn.(*ircConn); ok {
+		irc.nick = username
 	}
+	// The request's context ends with the handler, before the client does
+	ctx, cancel := context.WithCancel(context.WithoutCancel(r.Context()))
+	client := &Session{
+		conn:      conn,
+		Username:  username,
+		Role:      identity.Role,
+		Server:    s,
+		Room:      DefaultRoom,
+		IP:        ip,
+		UserAgent: r.UserAgent(),
+		LoggedIn:  loggedIn,
+		ctx:       ctx,
+		cancel:    cancel,
+		done:      make(chan struct{}),
+		outbox:    make(chan outbound, s.Config.SendQueueSize),
+		written:   make(chan struct{}),
+		batched:   conn.Subprotocol() == BatchProtocol,
+		polled:    polledConn(conn),
+	}
+	client.Conn, _ = conn.(*websocket.Conn)
+	// Guest names are handed out, not proven
+	client.Authenticated = identity.Username != "" && identity.Role != RoleGuest
+	if key := r.Header.Get(PublicKeyHeader); key != "" {
+		if _, ok := decodeKey(key); ok {
+			client.PublicKey = key
+		} else {
+			s.log.Warn("Ignoring malformed public key", "username", username, "remote_addr", ip)
+		}
+	}
+	if err := s.hookConnect(client); err != nil {
+		access.result = "rejected"
+		client.cancel()
+		s.log.Info("Rejected connection by hook", "username", username, "remote_addr", ip, "err", err)
+		conn.WriteMessage(websocket.TextMessage, []byte("ERROR: "+err.Error()))
+		conn.Close()
+		return
+	}
+	// From here the connection is written through the client's outbox.
+	// Replay recent history before the client starts receiving live traffic.
+	client.startWriting()
+	s.replayHistory(client)
 
-	// Register client
-	s.Mutex.Lock()
-	s.Clients[client] = true
-	s.ClientJoinTime[client] = time.Now()
-	s.Mutex.Unlock()
-
-	log.Printf("Client connected: %s", client.Username)
+	// Register client, checking the name and limit again now that they're
+	// final, and that Shutdown (which only drains registered clients)
+	// hasn't started
+	client.joinedAt = time.Now()
+	err = s.clients.add(client, s.config().MaxClients, s.Draining, func() {
+		// Welcome the client before anything is broadcast to it
+		client.send(s.welcomeMessage(client))
+	})
+	if err != nil {
+		client.stopWriting()
+		client.cancel()
+	}
+	switch err {
+	case errDraining:
+		access.result = "draining"
+		conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down"),
+			time.Now().Add(time.Second))
+		conn.Close()
+		return
+	case errServerFull:
+		access.result = "full"
+		s.rejectFull(conn, ip)
+		return
+	case errUsernameTaken:
+		access.result = "username_taken"
+		conn.WriteMessage(websocket.TextMessage, []byte("ERROR: Username already taken. Please try again with a different name."))
+		conn.Close()
+		return
+	}
+	s.publish(backplaneEvent{Type: eventJoin, Username: client.Username, Room: client.Room})
 
-	// Send welcome message
-	welcomeMsg := fmt.Sprintf("Welcome %s! There are %d users online. Type /help for available commands.",
-		client.Username, len(s.Clients))
-	client.Conn.WriteMessage(websocket.TextMessage, []byte(welcomeMsg))
+	s.connections.Add(1)
+	access.result = "connected"
+	client.logger().Info("Client connected", "role", client.Role, "user_agent", client.UserAgent)
+	s.audit(AuditConnect, client.Username, "", ip, "role "+string(client.Role))
+	s.export(ExportEvent{Type: ExportJoin, Room: client.Room, Username: client.Username, IP: ip})
 
 	// Broadcast join notification
-	s.broadcastMessage(fmt.Sprintf("*** %s joined the chat ***", client.Username))
+	s.broadcastToRoom(client.Room, fmt.Sprintf("*** %s joined the chat ***", client.Username))
+	s.relayPresence(client.Username, "", client.Room)
 
-	// Start the reading goroutine
-	go client.ReadPump()
+	// Start reading the client's messages
+	handedOff = true
+	client.startReading()
 }
 
-// GetClientList returns a list of all connected usernames
-func (s *Server) GetClientList() []string {
-	s.Mutex.Lock()
-	defer s.Mutex.Unlock()
+// clientByName returns the connected client using username, or nil
+func (s *Server) clientByName(username string) *Session {
+	return s.clients.lookup(username)
+}
 
-	users := make([]string, 0, len(s.Clients))
-	for client := range s.Clients {
-		duration := time.Since(s.ClientJoinTime[client]).Round(time.Second)
-		users = append(users, fmt.Sprintf("%s (connected for %s)", client.Username, duration))
-	}
-	return users
+// ClientCount returns how many users are connected
+func (s *Server) ClientCount() int {
+	return s.clients.len()
 }
 
-// ReadPump reads messages from the client connection
-func (c *Client) ReadPump() {
-	defer func() {
-		// Unregister client on disconnect
-		c.Server.Mutex.Lock()
-		delete(c.Server.Clients, c)
-		delete(c.Server.ClientJoinTime, c)
-		c.Server.Mutex.Unlock()
-
-		log.Printf("Client disconnected: %s", c.Username)
-		c.Server.broadcastMessage(fmt.Sprintf("*** %s left the chat ***", c.Username))
-		c.Conn.Close()
-	}()
+// full reports whether the server has reached Config.MaxClients
+func (s *Server) full() bool {
+	return s.config().MaxClients > 0 && s.ClientCount() >= s.config().MaxClients
+}
+
+// rejectFull turns away a connection because the server is full
+func (s *Server) rejectFull(conn wsConn, ip string) {
+	s.log.Warn("Rejected connection: server full", "remote_addr", ip, "max_clients", s.config().MaxClients)
+	s.audit(AuditRejected, "", "", ip, "server full")
+	conn.WriteMessage(websocket.TextMessage, []byte("ERROR: Server full. Please try again later."))
+	conn.Close()
+}
 
-	// Setup ping/pong for keeping connection alive
-	c.Conn.SetReadDeadline(time.Now().Add(10 * time.Minute))
-	c.Conn.SetPongHandler(func(string) error {
-		c.Conn.SetReadDeadline(time.Now().Add(10 * time.Minute))
-		return nil
+// GetClientList returns a list of all connected usernames, including
+// those connected to other instances
+func (s *Server) GetClientList() []string {
+	users := make([]string, 0, s.clients.len())
+	s.clients.each(func(client *Session) {
+		duration := time.Since(client.joinedAt).Round(time.Second)
+		users = append(users, fmt.Sprintf("%s in #%s (connected for %s)", client.Username, client.Room, duration))
 	})
 
-	// Start a ticker to send pings
-	ticker := time.NewTicker(30 * time.Second)
-	go func() {
-		defer ticker.Stop()
-		for range ticker.C {
-			if err := c.Conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(5*time.Second)); err != nil {
-				return
-			}
-		}
-	}()
+	for _, user := range s.remote.users() {
+		users = append(users, fmt.Sprintf("%s in #%s (on another server)", user.Username, user.Room))
+	}
+	return users
+}
+
+// ReadPump reads messages from the client connection until it fails,
+// then disconnects the client
+func (c *Session) ReadPump() {
+	defer c.disconnect()
+	defer c.recoverPanic("read_pump")
+	c.keepAlive()
 
 	// Main message loop
 	for {
-		_, message, err := c.Conn.ReadMessage()
+		msgText, err := readText(c.conn)
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				log.Printf("Error: %v", err)
+				c.logger().Warn("Unexpected close", "err", err)
 			}
-			break
+			return
 		}
+		c.handleMessage(msgText)
+	}
+}
 
-		msgText := string(message)
-		log.Printf("Received from %s: %s", c.Username, msgText)
+// disconnect unregisters the client once its connection has failed or
+// been closed
+func (c *Session) disconnect() {
+	c.closing.Store(true)
+	c.Server.clients.remove(c)
+	c.Server.ipLimits.release(c.IP)
+	c.Server.publish(backplaneEvent{Type: eventLeave, Username: c.Username})
 
-		// Handle commands
-		if strings.HasPrefix(msgText, "/") {
-			c.handleCommand(msgText)
-			continue
-		}
+	c.logger().Info("Client disconnected")
+	c.logConnection()
+	c.Server.audit(AuditDisconnect, c.Username, "", c.IP, "")
+	c.Server.export(ExportEvent{Type: ExportLeave, Room: c.Room, Username: c.Username, IP: c.IP})
+	c.Server.broadcastToRoom(c.Room, fmt.Sprintf("*** %s left the chat ***", c.Username))
+	c.Server.relayPresence(c.Username, c.Room, "")
+	c.Server.hookDisconnect(c)
+	c.conn.Close()
+	c.cancel()
+	close(c.done)
+}
 
-		// Regular message
-		formattedMsg := fmt.Sprintf("%s: %s", c.Username, msgText)
-		c.Server.broadcastMessage(formattedMsg)
-	}
+// Context returns a context cancelled once the client has disconnected,
+// for work done on the client's behalf
+func (c *Session) Context() context.Context {
+	return c.ctx
 }
 
-// handleCommand processes client commands like /help, /users, etc.
-func (c *Client) handleCommand(cmd string) {
-	log.Printf("Command from %s: %s", c.Username, cmd)
-
-	if cmd == "/help" {
-		helpMsg := `
-Available commands:
-/help - Show this help message
-/users - List all connected users
-/time - Show current server time
-/exit - Exit the chat
-/whisper <username> <message> - Send private message to a user
-`
-		c.Conn.WriteMessage(websocket.TextMessage, []byte(helpMsg))
-	} else if cmd == "/users" {
-		users := c.Server.GetClientList()
-		usersMsg := fmt.Sprintf("Connected users (%d):\n", len(users))
-		for i, user := range users {
-			usersMsg += fmt.Sprintf("%d. %s\n", i+1, user)
-		}
-		c.Conn.WriteMessage(websocket.TextMessage, []byte(usersMsg))
-	} else if cmd == "/time" {
-		c.Conn.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf("Server time: %s", time.Now().Format(time.RFC1123))))
-	} else if strings.HasPrefix(cmd, "/whisper ") {
-		parts := strings.SplitN(cmd[9:], " ", 2)
-		if len(parts) != 2 {
-			c.Conn.WriteMessage(websocket.TextMessage, []byte("Usage: /whisper <username> <message>"))
-			return
-		}
+// Send queues a message for the client, as the server's own replies are.
+// It never blocks, and fails if the client is disconnecting or has fallen
+// too far behind (see Config.SlowClientPolicy).
+func (c *Session) Send(message string) error {
+	return c.send(message)
+}
 
-		targetUsername := strings.TrimSpace(parts[0])
-		message := parts[1]
+// handleMessage handles a message the client sent: a command, or a
+// message to its room
+func (c *Session) handleMessage(msgText string) {
+	c.conn.SetReadDeadline(time.Now().Add(c.Server.Config.ReadTimeout))
+	c.receivedMessages++
+	c.receivedBytes += int64(len(msgText))
+	c.logger().Debug("Received message", "message", redactSecrets(msgText))
 
-		c.Server.Mutex.Lock()
-		var targetClient *Client
-		for client := range c.Server.Clients {
-			if strings.EqualFold(client.Username, targetUsername) {
-				targetClient = client
-				break
-			}
-		}
-		c.Server.Mutex.Unlock()
+	if !c.allowMessage() {
+		return
+	}
 
-		if targetClient == nil {
-			c.Conn.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf("User '%s' not found", targetUsername)))
-			return
+	// Handle commands
+	if strings.HasPrefix(msgText, "/") {
+		if command, ok := c.hookCommand(msgText); ok {
+			c.handleCommand(command)
 		}
+		return
+	}
 
-		// Send to recipient
-		targetClient.Conn.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf("[PM from %s]: %s", c.Username, message)))
-		// Confirmation to sender
-		c.Conn.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf("[PM to %s]: %s", targetUsername, message)))
-	} else {
-		c.Conn.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf("Unknown command: %s. Type /help for available commands.", cmd)))
+	// Regular message
+	if c.mutedBroadcast(msgText) {
+		return
+	}
+	if !c.allowLinks(msgText) {
+		return
+	}
+	if c.slowedDown() {
+		return
+	}
+	if c.spam(msgText) {
+		return
+	}
+	if !c.automod(msgText) {
+		return
+	}
+	msgText, ok := c.hookMessage(msgText)
+	if !ok || strings.TrimSpace(msgText) == "" {
+		return
+	}
+	formattedMsg := c.Username + ": " + msgText
+	if c.Server.Shadowbanned(c.Username) {
+		c.send(formattedMsg)
+		return
+	}
+	c.Server.postMessage(c.ctx, c.Room, c.Username, c.IP, "", msgText)
+}
+
+// PostMessage posts a chat message to room as from, as if they had sent it,
+// for embedders and the gRPC API. It skips the checks made of clients'
+// messages (rate limits, mutes, spam and automod), so from should be a
+// trusted sender. ctx bounds storing the message.
+func (s *Server) PostMessage(ctx context.Context, room, from, text string) error {
+	name, ok := normalizeRoom(room)
+	if !ok {
+		return fmt.Errorf("invalid room name %q", room)
+	}
+	from, err := validateUsername(from)
+	if err != nil {
+		return fmt.Errorf("invalid sender: %w", err)
+	}
+	if strings.TrimSpace(text) == "" {
+		return errors.New("text is required")
+	}
+	s.postMessage(ctx, name, from, "", "", text)
+	return nil
+}
+
+// postMessage stores, exports, delivers and bridges a chat message from
+// username, connected from ip if known, or through the bridge called via.
+// ctx is the sender's, such as its connection's.
+func (s *Server) postMessage(ctx context.Context, room, username, ip, via, text string) {
+	s.recordMessage(ctx, room, username, text)
+	s.export(ExportEvent{Type: ExportMessage, Room: room, Username: username, IP: ip, Text: text, Bridge: via})
+	mentioned := s.mentions(username, text)
+	for _, name := range mentioned {
+		s.export(ExportEvent{Type: ExportMention, Room: room, Username: username, Target: name, Text: text, Bridge: via})
 	}
+	s.notifyMentions(room, username, mentioned, text)
+	s.deliverToRoom(room, username+": "+text)
+	s.relay(room, username, via, text)
+	s.publish(backplaneEvent{Type: eventMessage, Room: room, Username: username, Text: text})
+	s.messages.Add(1)
+	s.messageRate.add(time.Now())
 }
@@ -0,0 +1,78 @@
+// pkg/chat/server_test.go
+package chat
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// newTestServer starts a server with cfg behind an HTTP test server and
+// returns it with its WebSocket URL. Its log output is discarded.
+func newTestServer(t *testing.T, cfg Config) (*Server, string) {
+	t.Helper()
+	if cfg.Logger == nil {
+		cfg.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	}
+	s := NewServerWithConfig(cfg)
+	ts := httptest.NewServer(http.HandlerFunc(s.HandleWebSocket))
+	t.Cleanup(ts.Close)
+	return s, "ws" + strings.TrimPrefix(ts.URL, "http")
+}
+
+// connect joins the server as username and reads the welcome message
+func connect(url, username string) (*websocket.Conn, error) {
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(username)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, welcome, err := conn.ReadMessage()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if !strings.HasPrefix(string(welcome), "Welcome") {
+		conn.Close()
+		return nil, fmt.Errorf("%s: unexpected welcome %q", username, welcome)
+	}
+	conn.SetReadDeadline(time.Time{})
+	return conn, nil
+}
+
+// drain reads and discards messages until the connection fails
+func drain(conn *websocket.Conn) {
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			return
+		}
+	}
+}
+
+// waitFor polls cond until it holds or timeout passes
+func waitFor(timeout time.Duration, cond func() bool) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return cond()
+}
+
+// connected reports whether username is connected to s
+func connected(s *Server, username string) bool {
+	return s.clients.lookup(username) != nil
+}
@@ -0,0 +1,123 @@
+// pkg/chat/shadowban.go
+package chat
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// shadowList holds shadowbanned users: their messages are echoed back to
+// them as usual but never delivered to anyone else, so persistent spammers
+// don't notice and come back under a new name. Shadowbans are kept in
+// memory only.
+type shadowList struct {
+	mu    sync.Mutex
+	users map[string]string // userKey -> username as banned
+}
+
+// newShadowList creates an empty shadowban list
+func newShadowList() *shadowList {
+	return &shadowList{users: make(map[string]string)}
+}
+
+// ShadowbanUser shadowbans username
+func (s *Server) ShadowbanUser(username, by string) {
+	s.shadowbans.mu.Lock()
+	s.shadowbans.users[userKey(username)] = username
+	s.shadowbans.mu.Unlock()
+
+	s.log.Info("Shadowbanned", "username", username, "by", by)
+	s.audit(AuditShadowban, by, username, "", "")
+}
+
+// UnshadowbanUser lifts a shadowban, reporting whether there was one
+func (s *Server) UnshadowbanUser(username, by string) bool {
+	key := userKey(username)
+
+	s.shadowbans.mu.Lock()
+	_, ok := s.shadowbans.users[key]
+	delete(s.shadowbans.users, key)
+	s.shadowbans.mu.Unlock()
+
+	if ok {
+		s.log.Info("Lifted shadowban", "username", username, "by", by)
+		s.audit(AuditUnshadowban, by, username, "", "")
+	}
+	return ok
+}
+
+// Shadowbanned reports whether username is shadowbanned
+func (s *Server) Shadowbanned(username string) bool {
+	s.shadowbans.mu.Lock()
+	defer s.shadowbans.mu.Unlock()
+
+	_, ok := s.shadowbans.users[userKey(username)]
+	return ok
+}
+
+// Shadowbans returns the shadowbanned usernames, sorted
+func (s *Server) Shadowbans() []string {
+	s.shadowbans.mu.Lock()
+	defer s.shadowbans.mu.Unlock()
+
+	users := make([]string, 0, len(s.shadowbans.users))
+	for _, username := range s.shadowbans.users {
+		users = append(users, username)
+	}
+	sort.Strings(users)
+	return users
+}
+
+// handleShadowban implements /shadowban [user]; without a user it lists
+// the shadowbanned users
+func (c *Session) handleShadowban(args string) {
+	if !c.can(permAdminister) {
+		c.send("Only admins can shadowban users.")
+		return
+	}
+
+	target := strings.TrimSpace(args)
+	if target == "" {
+		users := c.Server.Shadowbans()
+		if len(users) == 0 {
+			c.send("Nobody is shadowbanned.")
+			return
+		}
+		c.send(fmt.Sprintf(
+			"Shadowbanned users (%d): %s", len(users), strings.Join(users, ", ")))
+		return
+	}
+	if sameUsername(target, c.Username) {
+		c.send("You cannot shadowban yourself.")
+		return
+	}
+	if !c.outranks(c.Server.clientByName(target)) {
+		c.send(fmt.Sprintf("You cannot shadowban %s.", target))
+		return
+	}
+
+	c.Server.ShadowbanUser(target, c.Username)
+	c.send(fmt.Sprintf(
+		"Shadowbanned %s. Their messages are now only shown to themselves.", target))
+}
+
+// handleUnshadowban implements /unshadowban <user>
+func (c *Session) handleUnshadowban(args string) {
+	if !c.can(permAdminister) {
+		c.send("Only admins can lift shadowbans.")
+		return
+	}
+
+	target := strings.TrimSpace(args)
+	if target == "" {
+		c.send("Usage: /unshadowban <username>")
+		return
+	}
+	if !c.Server.UnshadowbanUser(target, c.Username) {
+		c.send(fmt.Sprintf("%s is not shadowbanned.", target))
+		return
+	}
+	c.send(fmt.Sprintf("Lifted the shadowban on %s.", target))
+}
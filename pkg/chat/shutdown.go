@@ -0,0 +1,65 @@
+// pkg/chat/shutdown.go
+package chat
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/gorilla/websocket"
+)
+
+// shutdownNotice is broadcast to everyone when the server starts draining
+const shutdownNotice = "Server is shutting down, please reconnect shortly"
+
+// Shutdown drains the server: new connections are refused, everyone is
+// told the server is going down and sent a close frame, and Shutdown waits
+// for them to disconnect. Clients still connected when ctx is done are
+// dropped and ctx's error is returned. The stores are left open for the
+// caller to close.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.draining.Store(true)
+	// Mail the notifications waiting for offline users rather than lose them
+	defer s.email.flushAll()
+	// Tell the other instances this one's users are gone once it is done
+	defer s.publish(backplaneEvent{Type: eventGone})
+
+	clients := s.clients.filter(nil)
+
+	s.log.Info("Draining clients", "clients", len(clients))
+	// Only this instance is going away, so the notice isn't broadcast to
+	// the others on the backplane
+	s.deliverToAll("*** " + shutdownNotice + " ***")
+
+	// Clients answer the close frame, which follows the notice, with their
+	// own, which ends their ReadPump
+	for _, client := range clients {
+		client.closeWith(websocket.CloseGoingAway, "server shutting down", false)
+	}
+
+	for i, client := range clients {
+		select {
+		case <-client.done:
+		case <-ctx.Done():
+			remaining := clients[i:]
+			s.log.Warn("Shutdown timed out, dropping clients", "clients", len(remaining))
+			for _, client := range remaining {
+				client.conn.Close()
+			}
+			return ctx.Err()
+		}
+	}
+	s.log.Info("All clients disconnected")
+	return nil
+}
+
+// Draining reports whether Shutdown has been called
+func (s *Server) Draining() bool {
+	return s.draining.Load()
+}
+
+// rejectDraining turns away a connection that arrived during Shutdown
+func (s *Server) rejectDraining(w http.ResponseWriter, ip string) {
+	s.log.Info("Rejected connection: shutting down", "remote_addr", ip)
+	w.Header().Set("Retry-After", "5")
+	http.Error(w, "server shutting down", http.StatusServiceUnavailable)
+}
@@ -0,0 +1,485 @@
+// pkg/chat/slack.go
+package chat
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// slackQueueSize is how many messages may wait to be posted to Slack, and
+// Slack events to be posted here; more are dropped
+const slackQueueSize = 1000
+
+// slackSeenEvents is how many event IDs are remembered to ignore Slack's
+// redeliveries
+const slackSeenEvents = 1000
+
+// slackMaxRetries is how many times a message Slack rate-limits is retried
+const slackMaxRetries = 3
+
+// slackMaxSkew is how old a signed Events API request may be, as Slack's
+// signatures cover the timestamp to stop replays
+const slackMaxSkew = 5 * time.Minute
+
+// slackSuffix ends the names of Slack users in the chat, so they can't
+// pass for chat users
+const slackSuffix = ".slack"
+
+// slackMarkup matches Slack's <...> markup for mentions, channels and
+// links in message text
+var slackMarkup = regexp.MustCompile(`<([^<>]+)>`)
+
+// SlackRoom bridges a room with a Slack channel. Either side may be left
+// out for a bridge that only goes one way.
+type SlackRoom struct {
+	Room string `json:"room"`
+
+	// WebhookURL is an incoming webhook for the channel, which the room's
+	// messages are posted to
+	WebhookURL string `json:"webhook_url"`
+
+	// Channel is the channel ID, e.g. C0123456789, whose messages are
+	// posted to the room
+	Channel string `json:"channel"`
+}
+
+// SlackConfig describes the rooms bridged with Slack
+type SlackConfig struct {
+	// SigningSecret is the Slack app's signing secret, which Events API
+	// requests are checked with. It is needed for channels to be relayed.
+	SigningSecret string `json:"signing_secret"`
+
+	// BotToken, if set, is used to look up Slack users' names, which are
+	// otherwise their user IDs. It needs the users:read scope.
+	BotToken string `json:"bot_token"`
+
+	Rooms []SlackRoom `json:"rooms"`
+}
+
+// LoadSlackConfig reads a Slack bridge configuration from a JSON file
+func LoadSlackConfig(path string) (SlackConfig, error) {
+	var cfg SlackConfig
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, fmt.Errorf("read Slack config: %w", err)
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return cfg, fmt.Errorf("parse Slack config: %w", err)
+	}
+	return cfg, nil
+}
+
+// SlackBridge relays the messages of bridged rooms to Slack through
+// incoming webhooks, and serves the Events API endpoint that Slack sends
+// channel messages to, posting them to the bridged rooms. Slack users post
+// as their name with slackSuffix after it, and nothing is relayed back to
+// where it came from. Messages are posted in the background, in order;
+// failures are logged and the messages dropped.
+type SlackBridge struct {
+	Config SlackConfig
+
+	server *Server
+	client *http.Client
+	// apiURL is where the Web API is, for looking up users
+	apiURL string
+
+	// webhooks and channels map rooms to webhook URLs, and channels to
+	// rooms
+	webhooks map[string]string
+	channels map[string]string
+
+	outgoing chan slackPost
+	incoming chan slackEvent
+	done     chan struct{}
+	dropped  atomic.Int64
+	mu       sync.Mutex
+	closed   bool
+
+	// seen holds the IDs of the latest events, oldest first
+	seenMu    sync.Mutex
+	seen      map[string]bool
+	seenOrder []string
+
+	// names caches Slack users' chat names by user ID, and belongs to the
+	// goroutine posting events
+	names map[string]string
+}
+
+// slackPost is a message waiting to be posted to a webhook
+type slackPost struct {
+	webhook string
+	text    string
+}
+
+// slackEvent is the part of an Events API event callback the bridge uses
+type slackEvent struct {
+	Type    string `json:"type"`
+	Subtype string `json:"subtype"`
+	Channel string `json:"channel"`
+	User    string `json:"user"`
+	BotID   string `json:"bot_id"`
+	Text    string `json:"text"`
+	Files   []struct {
+		Permalink string `json:"permalink"`
+	} `json:"files"`
+}
+
+// NewSlackBridge checks cfg and starts bridging s's rooms with Slack. Serve
+// the bridge at a path Slack is told to send events to, e.g.
+// /slack/events, and Close it when shutting down.
+func NewSlackBridge(s *Server, cfg SlackConfig) (*SlackBridge, error) {
+	b := &SlackBridge{
+		Config:   cfg,
+		server:   s,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		apiURL:   "https://slack.com/api/",
+		webhooks: map[string]string{},
+		channels: map[string]string{},
+		outgoing: make(chan slackPost, slackQueueSize),
+		incoming: make(chan slackEvent, slackQueueSize),
+		done:     make(chan struct{}),
+		seen:     map[string]bool{},
+		names:    map[string]string{},
+	}
+	for _, bridged := range cfg.Rooms {
+		room, ok := normalizeRoom(bridged.Room)
+		if !ok {
+			return nil, fmt.Errorf("invalid room name %q", bridged.Room)
+		}
+		if bridged.WebhookURL == "" && bridged.Channel == "" {
+			return nil, fmt.Errorf("room %s needs a webhook_url or a channel", room)
+		}
+		if bridged.WebhookURL != "" {
+			if u, err := url.Parse(bridged.WebhookURL); err != nil || (u.Scheme != "https" && u.Scheme != "http") {
+				return nil, fmt.Errorf("room %s: invalid webhook URL", room)
+			}
+			b.webhooks[room] = bridged.WebhookURL
+		}
+		if bridged.Channel != "" {
+			if _, ok := b.channels[bridged.Channel]; ok {
+				return nil, fmt.Errorf("channel %s is bridged twice", bridged.Channel)
+			}
+			b.channels[bridged.Channel] = room
+		}
+	}
+	if len(b.channels) > 0 && cfg.SigningSecret == "" {
+		return nil, errors.New("relaying Slack channels needs the app's signing_secret")
+	}
+	go b.run()
+	go b.receive()
+	s.addBridge(b)
+	return b, nil
+}
+
+func (b *SlackBridge) name() string { return "slack" }
+
+// relay queues a room message to be posted to the room's webhook, if it
+// has one, dropping it if the queue is full
+func (b *SlackBridge) relay(room, username, text string) {
+	webhook, ok := b.webhooks[room]
+	if !ok {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return
+	}
+	select {
+	case b.outgoing <- slackPost{webhook: webhook, text: "*" + slackEscape(username) + "*: " + slackEscape(text)}:
+	default:
+		b.dropped.Add(1)
+	}
+}
+
+// run posts queued messages until Close, logging how many were dropped at
+// most every few seconds
+func (b *SlackBridge) run() {
+	defer close(b.done)
+	var lastWarning time.Time
+	for post := range b.outgoing {
+		if err := b.post(post); err != nil {
+			b.server.log.Warn("Error posting to Slack", "err", err)
+		}
+		if time.Since(lastWarning) > 10*time.Second {
+			if n := b.dropped.Swap(0); n > 0 {
+				b.server.log.Warn("Dropped messages, Slack queue full", "messages", n)
+				lastWarning = time.Now()
+			}
+		}
+	}
+}
+
+// post posts a message to its webhook, waiting as long as Slack asks when
+// it is rate-limited
+func (b *SlackBridge) post(post slackPost) error {
+	body, err := json.Marshal(map[string]string{"text": post.text})
+	if err != nil {
+		return err
+	}
+	for attempt := 0; ; attempt++ {
+		resp, err := b.client.Post(post.webhook, "application/json", bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 4<<10))
+		resp.Body.Close()
+		switch {
+		case resp.StatusCode < 300:
+			return nil
+		case resp.StatusCode == http.StatusTooManyRequests && attempt < slackMaxRetries:
+			wait, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+			if err != nil || wait <= 0 {
+				wait = 1
+			}
+			time.Sleep(time.Duration(wait) * time.Second)
+		default:
+			return fmt.Errorf("webhook answered %s", resp.Status)
+		}
+	}
+}
+
+// ServeHTTP takes Events API requests, answering Slack's URL check, and
+// queues messages in bridged channels to be posted to their rooms.
+// Requests must be signed with the signing secret.
+func (b *SlackBridge) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxPostedMessage+1))
+	if err != nil || len(body) > maxPostedMessage {
+		http.Error(w, "request too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if b.Config.SigningSecret == "" || !b.signed(r, body) {
+		http.Error(w, "invalid signature", http.StatusUnauthorized)
+		return
+	}
+
+	var callback struct {
+		Type      string     `json:"type"`
+		Challenge string     `json:"challenge"`
+		EventID   string     `json:"event_id"`
+		Event     slackEvent `json:"event"`
+	}
+	if err := json.Unmarshal(body, &callback); err != nil {
+		http.Error(w, "invalid JSON", http.StatusBadRequest)
+		return
+	}
+	switch callback.Type {
+	case "url_verification":
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, callback.Challenge)
+		return
+	case "event_callback":
+	default:
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if !b.firstDelivery(callback.EventID) {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	select {
+	case b.incoming <- callback.Event:
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		// Slack delivers it again later
+		b.forget(callback.EventID)
+		http.Error(w, "too many events", http.StatusServiceUnavailable)
+	}
+}
+
+// signed reports whether r carries a valid signature of body, made with the
+// signing secret in the last slackMaxSkew
+func (b *SlackBridge) signed(r *http.Request, body []byte) bool {
+	timestamp := r.Header.Get("X-Slack-Request-Timestamp")
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	if skew := time.Since(time.Unix(seconds, 0)); skew > slackMaxSkew || skew < -slackMaxSkew {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(b.Config.SigningSecret))
+	io.WriteString(mac, "v0:"+timestamp+":")
+	mac.Write(body)
+	want := "v0=" + hex.EncodeToString(mac.Sum(nil))
+	return hmac.Equal([]byte(want), []byte(r.Header.Get("X-Slack-Signature")))
+}
+
+// firstDelivery reports whether the event with id hasn't been taken
+// before, as Slack delivers events again if it doesn't hear back in time
+func (b *SlackBridge) firstDelivery(id string) bool {
+	if id == "" {
+		return true
+	}
+	b.seenMu.Lock()
+	defer b.seenMu.Unlock()
+	if b.seen[id] {
+		return false
+	}
+	if len(b.seenOrder) == slackSeenEvents {
+		delete(b.seen, b.seenOrder[0])
+		b.seenOrder = b.seenOrder[1:]
+	}
+	b.seen[id] = true
+	b.seenOrder = append(b.seenOrder, id)
+	return true
+}
+
+// forget forgets the event with id, so its redelivery is taken
+func (b *SlackBridge) forget(id string) {
+	b.seenMu.Lock()
+	defer b.seenMu.Unlock()
+	delete(b.seen, id)
+}
+
+// receive posts queued Slack messages to their rooms until Close. Bots'
+// messages, the bridge's own among them, and edits and other message
+// subtypes are left out.
+func (b *SlackBridge) receive() {
+	for event := range b.incoming {
+		room, ok := b.channels[event.Channel]
+		if !ok || event.Type != "message" || event.BotID != "" || event.User == "" {
+			continue
+		}
+		if event.Subtype != "" && event.Subtype != "file_share" {
+			continue
+		}
+		text := b.plainText(event.Text)
+		for _, file := range event.Files {
+			text = strings.TrimSpace(text + " " + file.Permalink)
+		}
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+		b.server.postMessage(context.Background(), room, b.username(event.User), "", b.name(), text)
+	}
+}
+
+// plainText turns Slack's markup into plain text: mentions into @name,
+// channels into #name and links into their URLs, after their labels if
+// they have any
+func (b *SlackBridge) plainText(text string) string {
+	text = slackMarkup.ReplaceAllStringFunc(text, func(markup string) string {
+		target, label, _ := strings.Cut(markup[1:len(markup)-1], "|")
+		switch {
+		case strings.HasPrefix(target, "@"):
+			return "@" + strings.TrimSuffix(b.username(target[1:]), slackSuffix)
+		case strings.HasPrefix(target, "#"):
+			if label == "" {
+				label = target[1:]
+			}
+			return "#" + label
+		case strings.HasPrefix(target, "!"):
+			// Special mentions like <!here>
+			if label == "" {
+				label = strings.TrimPrefix(target, "!")
+			}
+			return "@" + label
+		case label == "" || label == target || strings.TrimPrefix(target, "mailto:") == label:
+			return target
+		}
+		return label + " (" + target + ")"
+	})
+	return strings.NewReplacer("&lt;", "<", "&gt;", ">", "&amp;", "&").Replace(text)
+}
+
+// username returns the chat name of the Slack user with ID id
+func (b *SlackBridge) username(id string) string {
+	if name, ok := b.names[id]; ok {
+		return name
+	}
+	name := bridgedUsername(b.lookup(id), id, slackSuffix)
+	b.names[id] = name
+	return name
+}
+
+// lookup returns the Slack user's display or real name, or their username,
+// or "" if there is no bot token or the lookup fails
+func (b *SlackBridge) lookup(id string) string {
+	if b.Config.BotToken == "" {
+		return ""
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, b.apiURL+"users.info?user="+url.QueryEscape(id), nil)
+	req.Header.Set("Authorization", "Bearer "+b.Config.BotToken)
+	resp, err := b.client.Do(req)
+	if err != nil {
+		b.server.log.Warn("Error looking up Slack user", "user", id, "err", err)
+		return ""
+	}
+	defer resp.Body.Close()
+	var info struct {
+		OK    bool   `json:"ok"`
+		Error string `json:"error"`
+		User  struct {
+			Name    string `json:"name"`
+			Profile struct {
+				DisplayName string `json:"display_name"`
+				RealName    string `json:"real_name"`
+			} `json:"profile"`
+		} `json:"user"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&info); err != nil || !info.OK {
+		b.server.log.Warn("Error looking up Slack user", "user", id, "err", errors.Join(err, errors.New(info.Error)))
+		return ""
+	}
+	for _, name := range []string{info.User.Profile.DisplayName, info.User.Profile.RealName, info.User.Name} {
+		if name != "" {
+			return name
+		}
+	}
+	return ""
+}
+
+// slackEscape escapes the characters Slack's message formatting gives a
+// meaning to
+func slackEscape(text string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(text)
+}
+
+// Close stops taking events, posts the messages still queued and waits up
+// to timeout for them to be posted
+func (b *SlackBridge) Close(timeout time.Duration) {
+	b.mu.Lock()
+	if !b.closed {
+		b.closed = true
+		close(b.outgoing)
+		close(b.incoming)
+	}
+	b.mu.Unlock()
+
+	select {
+	case <-b.done:
+	case <-time.After(timeout):
+		b.server.log.Warn("Timed out posting the last messages to Slack")
+	}
+}
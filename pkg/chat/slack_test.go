@@ -0,0 +1,133 @@
+// pkg/chat/slack_test.go
+package chat
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// TestSlackBridge relays a room message to a webhook, then a signed event
+// from the bridged channel to the room, with its markup made plain and the
+// sender looked up, and checks it isn't relayed back
+func TestSlackBridge(t *testing.T) {
+	s, url := newTestServer(t, Config{})
+	posted := make(chan string, 10)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct{ Text string }
+		json.NewDecoder(r.Body).Decode(&body)
+		posted <- body.Text
+	}))
+	defer webhook.Close()
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/users.info" || r.Header.Get("Authorization") != "Bearer xoxb-test" {
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+		io.WriteString(w, `{"ok": true, "user": {"name": "al", "profile": {"display_name": "Alice B"}}}`)
+	}))
+	defer api.Close()
+
+	bridge, err := NewSlackBridge(s, SlackConfig{
+		SigningSecret: "signing",
+		BotToken:      "xoxb-test",
+		Rooms:         []SlackRoom{{Room: "#Lobby", WebhookURL: webhook.URL, Channel: "C1"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bridge.apiURL = api.URL + "/"
+	defer bridge.Close(time.Second)
+	events := httptest.NewServer(bridge)
+	defer events.Close()
+
+	ws, err := connect(url, "socket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	expectPosted := func(want string) {
+		t.Helper()
+		select {
+		case text := <-posted:
+			if text != want {
+				t.Errorf("posted %q, want %q", text, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%q not posted", want)
+		}
+	}
+	ws.WriteMessage(websocket.TextMessage, []byte("fish & <chips>"))
+	expectPosted("*socket*: fish &amp; &lt;chips&gt;")
+
+	send := func(body string, signed bool) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodPost, events.URL, strings.NewReader(body))
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		mac := hmac.New(sha256.New, []byte("signing"))
+		io.WriteString(mac, "v0:"+timestamp+":"+body)
+		if !signed {
+			mac.Write([]byte("tampered"))
+		}
+		req.Header.Set("X-Slack-Request-Timestamp", timestamp)
+		req.Header.Set("X-Slack-Signature", "v0="+hex.EncodeToString(mac.Sum(nil)))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	if resp := send(`{"type": "url_verification", "challenge": "abc"}`, false); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("unsigned request got %s", resp.Status)
+	}
+	resp := send(`{"type": "url_verification", "challenge": "abc"}`, true)
+	if challenge, _ := io.ReadAll(resp.Body); string(challenge) != "abc" {
+		t.Errorf("URL verification answered %q", challenge)
+	}
+
+	message := `{"type": "event_callback", "event_id": "Ev1", "event": {"type": "message", "channel": "C1", "user": "U1",
+		"text": "hi &amp; see <https://go.dev|Go>, <@U1>"}}`
+	send(`{"type": "event_callback", "event_id": "Ev0", "event": {"type": "message", "channel": "C1", "bot_id": "B1", "text": "echo"}}`, true)
+	send(message, true)
+	send(message, true)
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		_, text, err := ws.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(string(text), "echo") {
+			t.Fatalf("got %q", text)
+		}
+		if string(text) == "Alice_B.slack: hi & see Go (https://go.dev), @Alice_B" {
+			break
+		}
+	}
+
+	// Slack's own message isn't posted back to it, and the redelivery
+	// isn't posted again
+	ws.WriteMessage(websocket.TextMessage, []byte("again"))
+	expectPosted("*socket*: again")
+	for {
+		_, text, err := ws.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasPrefix(string(text), "Alice_B.slack: ") {
+			t.Fatalf("redelivered event posted again: %q", text)
+		}
+		if string(text) == "socket: again" {
+			break
+		}
+	}
+}
@@ -0,0 +1,101 @@
+// pkg/chat/slowmode.go
+package chat
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SlowMode returns the server-wide minimum time between each user's room
+// messages, or zero if slow mode is off
+func (s *Server) SlowMode() time.Duration {
+	return time.Duration(s.slowMode.Load())
+}
+
+// SetSlowMode turns slow mode on (every user may post once per interval)
+// or off (an interval of zero) and tells everyone. Moderators are exempt.
+func (s *Server) SetSlowMode(interval time.Duration, by string) {
+	if interval < 0 {
+		interval = 0
+	}
+	if time.Duration(s.slowMode.Swap(int64(interval))) == interval {
+		return
+	}
+
+	s.log.Info("Slow mode changed", "interval", interval, "by", by)
+	s.audit(AuditAdmin, by, "", "", "slow mode "+interval.String())
+	if interval == 0 {
+		s.broadcastMessage("*** Slow mode is off ***")
+	} else {
+		s.broadcastMessage(fmt.Sprintf("*** Slow mode is on: everyone may send one message every %s ***", interval))
+	}
+}
+
+// slowedDown reports whether the client must wait before posting to its
+// room again, because it is a guest, slow mode is on or it was slowed down
+// for spamming, telling it so.
+// Otherwise the message time is recorded.
+func (c *Session) slowedDown() bool {
+	interval, reason := time.Duration(0), ""
+	if guest := c.Server.config().GuestMessageInterval; c.Role == RoleGuest && guest > 0 {
+		interval, reason = guest, "Guests may send one message every %s. Please wait %s."
+	}
+	if slow := c.Server.SlowMode(); slow > interval && !c.can(permModerate) {
+		interval, reason = slow, "Slow mode is on: you may send one message every %s. Please wait %s."
+	}
+	if spam := c.Server.config().SpamSlowInterval; spam > interval && time.Now().Before(c.spamState.slowUntil) {
+		interval, reason = spam, "You have been slowed down for spamming: you may send one message every %s. Please wait %s."
+	}
+	if interval <= 0 {
+		return false
+	}
+
+	if wait := interval - time.Since(c.lastMessage); wait > 0 {
+		c.send(fmt.Sprintf(
+			reason, interval, wait.Round(100*time.Millisecond)))
+		return true
+	}
+	c.lastMessage = time.Now()
+	return false
+}
+
+// handleSlowMode implements /slowmode [interval|off]
+func (c *Session) handleSlowMode(args string) {
+	arg := strings.TrimSpace(args)
+	if arg == "" {
+		if slow := c.Server.SlowMode(); slow > 0 {
+			c.send(fmt.Sprintf("Slow mode is on: one message every %s.", slow))
+		} else {
+			c.send("Slow mode is off.")
+		}
+		return
+	}
+	if !c.can(permAdminister) {
+		c.send("Only admins can change slow mode.")
+		return
+	}
+
+	interval, ok := parseSlowMode(arg)
+	if !ok {
+		c.send("Usage: /slowmode [interval|off], e.g. /slowmode 30s")
+		return
+	}
+	c.Server.SetSlowMode(interval, c.Username)
+}
+
+// parseSlowMode reads a slow mode interval: a duration, a plain number of
+// seconds, or off
+func parseSlowMode(arg string) (time.Duration, bool) {
+	if arg == "off" || arg == "0" {
+		return 0, true
+	}
+	if d, err := time.ParseDuration(arg); err == nil && d > 0 {
+		return d, true
+	}
+	if seconds, err := strconv.Atoi(arg); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	return 0, false
+}
@@ -0,0 +1,136 @@
+// pkg/chat/spam.go
+package chat
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// spamRepeatWindow is how close together identical messages must be to
+// count as repeats
+const spamRepeatWindow = 5 * time.Minute
+
+// spamCapsMinLetters is how many letters a message needs before the caps
+// check applies, so short shouts like "LOL" are fine
+const spamCapsMinLetters = 8
+
+// Spam detection state for a client
+type spamState struct {
+	// last is the normalized text of the previous message, sent at lastAt,
+	// and repeats how many times in a row it has been sent
+	last    string
+	lastAt  time.Time
+	repeats int
+
+	// recent holds the times of the latest messages, for burst detection
+	recent []time.Time
+
+	// strikes counts offences since strikeAt, and slowUntil is when the
+	// slow down from a second strike ends
+	strikes   int
+	strikeAt  time.Time
+	slowUntil time.Time
+}
+
+// spam reports whether a room message looks like spam: repeated, shouted,
+// or one of a burst. Offences escalate from a warning to slowing the client
+// down to muting it. Moderators are exempt.
+func (c *Session) spam(text string) bool {
+	if c.can(permModerate) {
+		return false
+	}
+
+	now := time.Now()
+	kind := c.spamKind(text, now)
+	if kind == "" {
+		return false
+	}
+
+	cfg := c.Server.config()
+	st := &c.spamState
+	if now.Sub(st.strikeAt) > cfg.SpamStrikeWindow {
+		st.strikes = 0
+	}
+	st.strikes++
+	st.strikeAt = now
+
+	var action, notice string
+	switch {
+	case st.strikes == 2 && cfg.SpamSlowInterval > 0 && cfg.SpamSlowDuration > 0:
+		st.slowUntil = now.Add(cfg.SpamSlowDuration)
+		action = "slowed for " + cfg.SpamSlowDuration.String()
+		notice = fmt.Sprintf("Your message was not sent (%s). You may send one message every %s for the next %s.",
+			kind, cfg.SpamSlowInterval, cfg.SpamSlowDuration)
+	case st.strikes > 1 && cfg.SpamMuteDuration > 0:
+		st.strikes = 0
+		action = "muted"
+	default:
+		action = "warned"
+		notice = fmt.Sprintf("Warning: your message was not sent (%s). Keep this up and you will be muted.", kind)
+	}
+
+	c.logger().Info("Spam detected", "kind", kind, "action", action)
+	c.Server.audit(AuditSpam, "", c.Username, c.IP, kind+": "+action)
+	if action == "muted" {
+		c.Server.MuteUser(c.Username, cfg.SpamMuteDuration, "spam ("+kind+")", "")
+	} else {
+		c.send(notice)
+	}
+	return true
+}
+
+// spamKind updates the client's spam state with a message and names the
+// check it fails, or returns "" if it passes
+func (c *Session) spamKind(text string, now time.Time) string {
+	cfg := c.Server.config()
+	st := &c.spamState
+
+	normalized := strings.ToLower(strings.Join(strings.Fields(text), " "))
+	if normalized == st.last && now.Sub(st.lastAt) <= spamRepeatWindow {
+		st.repeats++
+	} else {
+		st.last, st.repeats = normalized, 1
+	}
+	st.lastAt = now
+
+	if n := cfg.SpamBurstMessages; n > 0 {
+		st.recent = append(st.recent, now)
+		if len(st.recent) > n {
+			st.recent = st.recent[len(st.recent)-n:]
+		}
+	}
+
+	switch {
+	case cfg.SpamRepeatLimit > 0 && st.repeats >= cfg.SpamRepeatLimit:
+		st.repeats = 0
+		return "repeated message"
+	case cfg.SpamCapsPercent > 0 && capsPercent(text) >= cfg.SpamCapsPercent:
+		return "excessive caps"
+	case cfg.SpamBurstMessages > 0 && len(st.recent) == cfg.SpamBurstMessages &&
+		now.Sub(st.recent[0]) <= cfg.SpamBurstWindow:
+		st.recent = st.recent[:0]
+		return "posting too fast"
+	}
+	return ""
+}
+
+// capsPercent returns the percentage of a message's letters that are
+// upper case, or 0 if it is too short to judge
+func capsPercent(text string) int {
+	letters, upper := 0, 0
+	for _, r := range text {
+		if !unicode.IsLetter(r) {
+			continue
+		}
+		letters++
+		if unicode.IsUpper(r) {
+			upper++
+		}
+	}
+	if letters < spamCapsMinLetters {
+		return 0
+	}
+	return upper * 100 / letters
+}
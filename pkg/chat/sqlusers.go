@@ -0,0 +1,224 @@
+// pkg/chat/sqlusers.go
+package chat
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sqlUsersSchema creates the accounts table; it is valid for both SQLite
+// and Postgres
+const sqlUsersSchema = `CREATE TABLE IF NOT EXISTS chat_users (
+	username_key   TEXT PRIMARY KEY,
+	username       TEXT NOT NULL,
+	password_hash  TEXT NOT NULL,
+	role           TEXT NOT NULL,
+	settings       TEXT NOT NULL,
+	created_at     TEXT NOT NULL,
+	email          TEXT NOT NULL,
+	email_verified BOOLEAN NOT NULL
+)`
+
+// sqlUsersMigrations add the columns that tables created by earlier
+// versions lack
+var sqlUsersMigrations = []struct{ column, definition string }{
+	{"email", "TEXT NOT NULL DEFAULT ''"},
+	{"email_verified", "BOOLEAN NOT NULL DEFAULT FALSE"},
+}
+
+// sqlUserColumns are the columns scanned by scanUser, in order
+const sqlUserColumns = "username, password_hash, role, settings, created_at, email, email_verified"
+
+// SQLUserStore keeps accounts in an SQL database. The driver is registered
+// by the program, e.g. with a blank import of modernc.org/sqlite for
+// "sqlite" or github.com/jackc/pgx/v5/stdlib for "pgx".
+type SQLUserStore struct {
+	db       *sql.DB
+	postgres bool
+}
+
+// OpenSQLUserStore connects to the database with the named driver and
+// creates the accounts table if it doesn't exist yet
+func OpenSQLUserStore(driver, dataSource string) (*SQLUserStore, error) {
+	db, err := sql.Open(driver, dataSource)
+	if err != nil {
+		return nil, fmt.Errorf("open user store: %w", err)
+	}
+	s := &SQLUserStore{db: db, postgres: driver == "pgx" || driver == "postgres"}
+	if !s.postgres {
+		// SQLite allows one writer at a time
+		db.SetMaxOpenConns(1)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := db.ExecContext(ctx, sqlUsersSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("open user store: %w", err)
+	}
+	for _, m := range sqlUsersMigrations {
+		// Selecting a column the table lacks fails on both databases
+		if _, err := db.ExecContext(ctx, "SELECT "+m.column+" FROM chat_users WHERE 1 = 0"); err == nil {
+			continue
+		}
+		if _, err := db.ExecContext(ctx, "ALTER TABLE chat_users ADD COLUMN "+m.column+" "+m.definition); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("open user store: add %s: %w", m.column, err)
+		}
+	}
+	return s, nil
+}
+
+// query rewrites the ? placeholders in q as $1, $2... for Postgres
+func (s *SQLUserStore) query(q string) string {
+	if !s.postgres {
+		return q
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range q {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// GetUser looks up an account by username
+func (s *SQLUserStore) GetUser(username string) (User, error) {
+	return s.GetUserContext(context.Background(), username)
+}
+
+// GetUserContext looks up an account by username, giving up when ctx is
+// done
+func (s *SQLUserStore) GetUserContext(ctx context.Context, username string) (User, error) {
+	row := s.db.QueryRowContext(ctx, s.query("SELECT "+sqlUserColumns+" FROM chat_users WHERE username_key = ?"), userKey(username))
+	user, err := scanUser(row)
+	if err == sql.ErrNoRows {
+		return User{}, ErrUserNotFound
+	}
+	if err != nil {
+		return User{}, fmt.Errorf("get user: %w", err)
+	}
+	return user, nil
+}
+
+// CreateUser adds a new account
+func (s *SQLUserStore) CreateUser(user User) error {
+	if user.Role == "" {
+		user.Role = RoleUser
+	}
+	if user.CreatedAt.IsZero() {
+		user.CreatedAt = time.Now()
+	}
+	args, err := userArgs(user)
+	if err != nil {
+		return err
+	}
+	res, err := s.db.Exec(s.query("INSERT INTO chat_users (username_key, "+sqlUserColumns+
+		") VALUES (?, ?, ?, ?, ?, ?, ?, ?) ON CONFLICT (username_key) DO NOTHING"),
+		append([]interface{}{userKey(user.Username)}, args...)...)
+	if err != nil {
+		return fmt.Errorf("create user: %w", err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrUserExists
+	}
+	return nil
+}
+
+// UpdateUser replaces an existing account
+func (s *SQLUserStore) UpdateUser(user User) error {
+	args, err := userArgs(user)
+	if err != nil {
+		return err
+	}
+	res, err := s.db.Exec(s.query("UPDATE chat_users SET username = ?, password_hash = ?, role = ?, settings = ?, "+
+		"created_at = ?, email = ?, email_verified = ? WHERE username_key = ?"),
+		append(args, userKey(user.Username))...)
+	if err != nil {
+		return fmt.Errorf("update user: %w", err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+// DeleteUser removes an account
+func (s *SQLUserStore) DeleteUser(username string) error {
+	res, err := s.db.Exec(s.query("DELETE FROM chat_users WHERE username_key = ?"), userKey(username))
+	if err != nil {
+		return fmt.Errorf("delete user: %w", err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+// ListUsers returns all accounts sorted by username
+func (s *SQLUserStore) ListUsers() ([]User, error) {
+	rows, err := s.db.Query("SELECT " + sqlUserColumns + " FROM chat_users ORDER BY username_key")
+	if err != nil {
+		return nil, fmt.Errorf("list users: %w", err)
+	}
+	defer rows.Close()
+
+	users := []User{}
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, fmt.Errorf("list users: %w", err)
+		}
+		users = append(users, user)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("list users: %w", err)
+	}
+	return users, nil
+}
+
+// Close closes the database
+func (s *SQLUserStore) Close() error {
+	return s.db.Close()
+}
+
+// userArgs returns the values of the columns in sqlUserColumns for user
+func userArgs(user User) ([]interface{}, error) {
+	settings, err := json.Marshal(user.Settings)
+	if err != nil {
+		return nil, fmt.Errorf("encode settings: %w", err)
+	}
+	return []interface{}{
+		user.Username, user.PasswordHash, string(user.Role), string(settings),
+		user.CreatedAt.UTC().Format(time.RFC3339Nano), user.Email, user.EmailVerified,
+	}, nil
+}
+
+// scanUser reads the columns in sqlUserColumns into a User
+func scanUser(row interface{ Scan(...interface{}) error }) (User, error) {
+	var user User
+	var role, settings, createdAt string
+	if err := row.Scan(&user.Username, &user.PasswordHash, &role, &settings, &createdAt, &user.Email, &user.EmailVerified); err != nil {
+		return User{}, err
+	}
+	user.Role = Role(role)
+	if err := json.Unmarshal([]byte(settings), &user.Settings); err != nil {
+		return User{}, fmt.Errorf("decode settings of %s: %w", user.Username, err)
+	}
+	created, err := time.Parse(time.RFC3339Nano, createdAt)
+	if err != nil {
+		return User{}, fmt.Errorf("decode creation time of %s: %w", user.Username, err)
+	}
+	user.CreatedAt = created
+	return user, nil
+}
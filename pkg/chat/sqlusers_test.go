@@ -0,0 +1,83 @@
+// pkg/chat/sqlusers_test.go
+package chat
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// TestSQLUserStore creates, updates and deletes accounts in an SQLite
+// database, and checks that they are still there after reopening it
+func TestSQLUserStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.db")
+	store, err := OpenSQLUserStore("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alice := User{Username: "Alice", PasswordHash: "hash", Settings: map[string]string{"theme": "dark"}, Email: "alice@example.com"}
+	if err := store.CreateUser(alice); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.CreateUser(User{Username: "alice"}); err != ErrUserExists {
+		t.Errorf("creating a taken name got %v", err)
+	}
+	if err := store.CreateUser(User{Username: "bob"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.UpdateUser(User{Username: "carol"}); err != ErrUserNotFound {
+		t.Errorf("updating a missing user got %v", err)
+	}
+
+	got, err := store.GetUser("ALICE")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Username != "Alice" || got.PasswordHash != "hash" || got.Role != RoleUser ||
+		got.Settings["theme"] != "dark" || got.Email != "alice@example.com" || time.Since(got.CreatedAt) > time.Minute {
+		t.Errorf("got %+v", got)
+	}
+	got.Role = RoleModerator
+	got.EmailVerified = true
+	if err := store.UpdateUser(got); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.DeleteUser("bob"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.DeleteUser("bob"); err != ErrUserNotFound {
+		t.Errorf("deleting a missing user got %v", err)
+	}
+	store.Close()
+
+	store, err = OpenSQLUserStore("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	users, err := store.ListUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 1 || users[0].Role != RoleModerator || !users[0].EmailVerified || !users[0].CreatedAt.Equal(got.CreatedAt) {
+		t.Errorf("after reopening, got %+v", users)
+	}
+	if _, err := store.GetUser("bob"); err != ErrUserNotFound {
+		t.Errorf("deleted user got %v", err)
+	}
+}
+
+// TestSQLUserStoreQuery checks that placeholders are numbered for Postgres
+func TestSQLUserStoreQuery(t *testing.T) {
+	q := "UPDATE chat_users SET role = ? WHERE username_key = ?"
+	if got := (&SQLUserStore{}).query(q); got != q {
+		t.Errorf("SQLite: got %q", got)
+	}
+	want := "UPDATE chat_users SET role = $1 WHERE username_key = $2"
+	if got := (&SQLUserStore{postgres: true}).query(q); got != want {
+		t.Errorf("Postgres: got %q, want %q", got, want)
+	}
+}
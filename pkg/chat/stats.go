@@ -0,0 +1,32 @@
+// pkg/chat/stats.go
+package chat
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// peak returns the most clients connected at once and when that was
+func (s *Server) peak() (int, time.Time) {
+	return s.clients.peakClients()
+}
+
+// handleStats shows the server's uptime and activity
+func (c *Session) handleStats() {
+	s := c.Server
+	peak, peakAt := s.peak()
+	rooms := s.GetRoomList()
+
+	var stats strings.Builder
+	fmt.Fprintf(&stats, "Server stats:\n")
+	fmt.Fprintf(&stats, "Uptime: %s (since %s)\n", time.Since(s.startedAt).Round(time.Second), s.startedAt.Format(time.RFC1123))
+	fmt.Fprintf(&stats, "Messages: %d (%.2f per second over the last minute)\n", s.messages.Load(), s.messageRate.perSecond(time.Now()))
+	fmt.Fprintf(&stats, "Peak users: %d (%s)\n", peak, peakAt.Format(time.RFC1123))
+	names := make([]string, len(rooms))
+	for i, room := range rooms {
+		names[i] = fmt.Sprintf("#%s (%d)", room.Name, room.Members)
+	}
+	fmt.Fprintf(&stats, "Rooms (%d): %s\n", len(rooms), strings.Join(names, ", "))
+	c.send(stats.String())
+}
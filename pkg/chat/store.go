@@ -0,0 +1,656 @@
+// pkg/chat/store.go
+package chat
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultRoom is the room every message belongs to unless stated otherwise
+const DefaultRoom = "lobby"
+
+// Message is a single chat message as recorded by a MessageStore
+type Message struct {
+	ID   int64     `json:"id"`
+	Room string    `json:"room"`
+	From string    `json:"from"`
+	To   string    `json:"to,omitempty"`
+	Text string    `json:"text"`
+	Time time.Time `json:"time"`
+}
+
+// MessageStore persists chat messages so they can be replayed later
+type MessageStore interface {
+	// Append records a message and returns it with its ID assigned
+	Append(msg Message) (Message, error)
+
+	// Recent returns up to limit of the newest messages in a room, oldest first
+	Recent(room string, limit int) ([]Message, error)
+
+	// ForEach calls fn for every stored message in a room, oldest first,
+	// stopping early if fn returns an error
+	ForEach(room string, fn func(Message) error) error
+
+	// Before returns every message, in any room, sent before cutoff
+	Before(cutoff time.Time) ([]Message, error)
+
+	// Prune deletes messages older than cutoff (if non-zero) and all but the
+	// newest maxPerRoom messages in each room (if positive), returning how
+	// many messages were removed
+	Prune(cutoff time.Time, maxPerRoom int) (int, error)
+
+	// EraseUser deletes every message sent by or addressed to username or,
+	// if anonymize is set, keeps the messages but replaces the user's name
+	// with AnonymousAuthor. It returns how many messages were affected.
+	EraseUser(username string, anonymize bool) (int, error)
+
+	// Close releases any resources held by the store
+	Close() error
+}
+
+// ContextMessageStore is implemented by message stores that can give up
+// on an append when its context is done, such as when the client posting
+// the message disconnects. Stores that don't are called with Append.
+type ContextMessageStore interface {
+	AppendContext(ctx context.Context, msg Message) (Message, error)
+}
+
+// appendMessage appends msg to store, under ctx if the store takes one
+func appendMessage(ctx context.Context, store MessageStore, msg Message) (Message, error) {
+	if cs, ok := store.(ContextMessageStore); ok {
+		return cs.AppendContext(ctx, msg)
+	}
+	return store.Append(msg)
+}
+
+// AnonymousAuthor replaces the sender of messages anonymized by EraseUser
+const AnonymousAuthor = "[deleted]"
+
+// MemoryStore keeps messages in memory only; history is lost on restart
+type MemoryStore struct {
+	mu       sync.Mutex
+	messages []Message
+	nextID   int64
+
+	// maxMessages and maxPerRoom are the limits set by SetLimits, rooms
+	// counts the messages in each room while maxPerRoom is set, and
+	// evicted counts the messages the limits have evicted
+	maxMessages int
+	maxPerRoom  int
+	rooms       map[string]int
+	evicted     int64
+}
+
+// NewMemoryStore creates an empty in-memory message store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{nextID: 1}
+}
+
+// Append records a message and assigns it the next ID
+func (m *MemoryStore) Append(msg Message) (Message, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	msg.ID = m.nextID
+	m.nextID++
+	m.messages = append(m.messages, msg)
+	if m.rooms != nil {
+		m.rooms[msg.Room]++
+	}
+	m.evictLocked(msg.Room)
+	return msg, nil
+}
+
+// SetLimits caps how many messages m keeps, in all and in each room (0 is
+// unlimited). Past a limit the oldest messages are evicted, in batches:
+// the store trims itself back once it is an eighth over.
+func (m *MemoryStore) SetLimits(maxMessages, maxPerRoom int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.maxMessages, m.maxPerRoom = max(maxMessages, 0), max(maxPerRoom, 0)
+	m.recountLocked()
+	before := len(m.messages)
+	if m.maxPerRoom > 0 {
+		m.pruneLocked(time.Time{}, m.maxPerRoom)
+	}
+	if m.maxMessages > 0 {
+		m.trimLocked(m.maxMessages)
+	}
+	m.evicted += int64(before - len(m.messages))
+}
+
+// Len returns how many messages m holds
+func (m *MemoryStore) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return len(m.messages)
+}
+
+// Evicted returns how many messages the limits set by SetLimits have evicted
+func (m *MemoryStore) Evicted() int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.evicted
+}
+
+// evictedAny reports whether the limits have ever evicted messages, so m
+// may no longer hold every message it was given
+func (m *MemoryStore) evictedAny() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.evicted > 0
+}
+
+// evictLocked trims the store back to its limits if room, the room just
+// appended to, or the store as a whole is more than an eighth over them
+func (m *MemoryStore) evictLocked(room string) {
+	before := len(m.messages)
+	if m.maxPerRoom > 0 && m.rooms[room] > m.maxPerRoom+m.maxPerRoom/8 {
+		m.pruneLocked(time.Time{}, m.maxPerRoom)
+	}
+	if m.maxMessages > 0 && len(m.messages) > m.maxMessages+m.maxMessages/8 {
+		m.trimLocked(m.maxMessages)
+	}
+	m.evicted += int64(before - len(m.messages))
+}
+
+// trimLocked drops the oldest messages until at most n are left
+func (m *MemoryStore) trimLocked(n int) {
+	excess := len(m.messages) - n
+	if excess <= 0 {
+		return
+	}
+	kept := copy(m.messages, m.messages[excess:])
+	clear(m.messages[kept:])
+	m.messages = m.messages[:kept]
+	m.recountLocked()
+}
+
+// recountLocked counts the messages in each room, if maxPerRoom needs them
+func (m *MemoryStore) recountLocked() {
+	m.rooms = nil
+	if m.maxPerRoom == 0 {
+		return
+	}
+	m.rooms = make(map[string]int)
+	for _, msg := range m.messages {
+		m.rooms[msg.Room]++
+	}
+}
+
+// Recent returns up to limit of the newest messages in room, oldest first
+func (m *MemoryStore) Recent(room string, limit int) ([]Message, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if limit <= 0 {
+		return nil, nil
+	}
+
+	// Walk backwards collecting matches, then reverse into chronological order
+	result := make([]Message, 0, limit)
+	for i := len(m.messages) - 1; i >= 0 && len(result) < limit; i-- {
+		if m.messages[i].Room == room {
+			result = append(result, m.messages[i])
+		}
+	}
+	for i, j := 0, len(result)-1; i < j; i, j = i+1, j-1 {
+		result[i], result[j] = result[j], result[i]
+	}
+	return result, nil
+}
+
+// ForEach calls fn for each message in room. The messages are copied first
+// so fn may block (e.g. writing to a slow HTTP client) without holding the lock.
+func (m *MemoryStore) ForEach(room string, fn func(Message) error) error {
+	m.mu.Lock()
+	var snapshot []Message
+	for _, msg := range m.messages {
+		if msg.Room == room {
+			snapshot = append(snapshot, msg)
+		}
+	}
+	m.mu.Unlock()
+
+	for _, msg := range snapshot {
+		if err := fn(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Before returns a copy of all messages older than cutoff
+func (m *MemoryStore) Before(cutoff time.Time) ([]Message, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var result []Message
+	for _, msg := range m.messages {
+		if msg.Time.Before(cutoff) {
+			result = append(result, msg)
+		}
+	}
+	return result, nil
+}
+
+// Prune removes messages that fall outside the retention limits
+func (m *MemoryStore) Prune(cutoff time.Time, maxPerRoom int) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.pruneLocked(cutoff, maxPerRoom), nil
+}
+
+func (m *MemoryStore) pruneLocked(cutoff time.Time, maxPerRoom int) int {
+	// Count how many messages each room holds after the age cut so we know
+	// how many of the oldest ones to skip to honor maxPerRoom
+	excess := make(map[string]int)
+	if maxPerRoom > 0 {
+		perRoom := make(map[string]int)
+		for _, msg := range m.messages {
+			if cutoff.IsZero() || !msg.Time.Before(cutoff) {
+				perRoom[msg.Room]++
+			}
+		}
+		for room, n := range perRoom {
+			if n > maxPerRoom {
+				excess[room] = n - maxPerRoom
+			}
+		}
+	}
+
+	kept := m.messages[:0]
+	for _, msg := range m.messages {
+		if !cutoff.IsZero() && msg.Time.Before(cutoff) {
+			continue
+		}
+		if excess[msg.Room] > 0 {
+			excess[msg.Room]--
+			continue
+		}
+		kept = append(kept, msg)
+	}
+
+	removed := len(m.messages) - len(kept)
+	// Clear the tail so pruned messages can be garbage collected
+	for i := len(kept); i < len(m.messages); i++ {
+		m.messages[i] = Message{}
+	}
+	m.messages = kept
+	m.recountLocked()
+	return removed
+}
+
+// EraseUser deletes or anonymizes all messages from or to username
+func (m *MemoryStore) EraseUser(username string, anonymize bool) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.eraseUserLocked(username, anonymize), nil
+}
+
+func (m *MemoryStore) eraseUserLocked(username string, anonymize bool) int {
+	affected := 0
+	kept := m.messages[:0]
+	for _, msg := range m.messages {
+		if from, to := involves(msg, username); from || to {
+			affected++
+			if !anonymize {
+				continue
+			}
+			if from {
+				msg.From = AnonymousAuthor
+			}
+			if to {
+				msg.To = AnonymousAuthor
+			}
+		}
+		kept = append(kept, msg)
+	}
+
+	for i := len(kept); i < len(m.messages); i++ {
+		m.messages[i] = Message{}
+	}
+	m.messages = kept
+	m.recountLocked()
+	return affected
+}
+
+// involves reports whether msg was sent by username, and whether it was
+// addressed to them
+func involves(msg Message, username string) (from, to bool) {
+	return strings.EqualFold(msg.From, username), msg.To != "" && strings.EqualFold(msg.To, username)
+}
+
+// Close is a no-op for the in-memory store
+func (m *MemoryStore) Close() error {
+	return nil
+}
+
+// FileStore persists messages as JSON lines in a file, keeping an in-memory
+// copy for fast reads. Existing messages are loaded when the store is opened.
+type FileStore struct {
+	*MemoryStore
+	mu   sync.Mutex
+	path string
+	file *os.File
+
+	// writeErr is the error from the latest append, if it failed
+	writeErr error
+}
+
+// OpenFileStore opens (or creates) a JSON lines message file at path
+func OpenFileStore(path string) (*FileStore, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("open message store: %w", err)
+	}
+
+	mem := NewMemoryStore()
+	err = scanMessages(f, func(msg Message) error {
+		mem.messages = append(mem.messages, msg)
+		if msg.ID >= mem.nextID {
+			mem.nextID = msg.ID + 1
+		}
+		return nil
+	})
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("read message store %s: %w", path, err)
+	}
+
+	return &FileStore{MemoryStore: mem, path: path, file: f}, nil
+}
+
+// scanMessages calls fn for each message in the JSON lines read from r,
+// stopping early if fn returns an error
+func scanMessages(r io.Reader, fn func(Message) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var msg Message
+		if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+			return fmt.Errorf("corrupt message: %w", err)
+		}
+		if err := fn(msg); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// Append records a message in memory and writes it to the file
+func (s *FileStore) Append(msg Message) (Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	msg, err := s.MemoryStore.Append(msg)
+	if err != nil {
+		return msg, err
+	}
+
+	line, err := json.Marshal(msg)
+	if err != nil {
+		return msg, fmt.Errorf("encode message: %w", err)
+	}
+	if _, err := s.file.Write(append(line, '\n')); err != nil {
+		s.writeErr = fmt.Errorf("write message: %w", err)
+		return msg, s.writeErr
+	}
+	s.writeErr = nil
+	return msg, nil
+}
+
+// Ping reports whether the file is still usable: it fails if the latest
+// append did, or the file can't be examined
+func (s *FileStore) Ping() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.writeErr != nil {
+		return s.writeErr
+	}
+	if _, err := s.file.Stat(); err != nil {
+		return fmt.Errorf("message store: %w", err)
+	}
+	return nil
+}
+
+// ForEach calls fn for each message in room. Once the history limits have
+// evicted messages from memory, they are read from the file instead, so
+// exports still see the whole history.
+func (s *FileStore) ForEach(room string, fn func(Message) error) error {
+	if !s.MemoryStore.evictedAny() {
+		return s.MemoryStore.ForEach(room, fn)
+	}
+	return s.scanFile(func(msg Message) error {
+		if msg.Room != room {
+			return nil
+		}
+		return fn(msg)
+	})
+}
+
+// Before returns all messages older than cutoff, from the file once the
+// history limits have evicted messages from memory
+func (s *FileStore) Before(cutoff time.Time) ([]Message, error) {
+	if !s.MemoryStore.evictedAny() {
+		return s.MemoryStore.Before(cutoff)
+	}
+	var result []Message
+	err := s.scanFile(func(msg Message) error {
+		if msg.Time.Before(cutoff) {
+			result = append(result, msg)
+		}
+		return nil
+	})
+	return result, err
+}
+
+// Prune removes messages outside the retention limits and rewrites the file
+// so that pruned messages no longer exist on disk. The file is scanned
+// rather than the in-memory copy, which may have evicted older messages.
+func (s *FileStore) Prune(cutoff time.Time, maxPerRoom int) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.MemoryStore.Prune(cutoff, maxPerRoom)
+
+	// Count what the age cut removes, and how many messages each room
+	// keeps after it, to know how many of the oldest to skip to honor
+	// maxPerRoom
+	removed := 0
+	perRoom := make(map[string]int)
+	err := s.scanFileLocked(func(msg Message) error {
+		if !cutoff.IsZero() && msg.Time.Before(cutoff) {
+			removed++
+		} else {
+			perRoom[msg.Room]++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	excess := make(map[string]int)
+	for room, n := range perRoom {
+		if maxPerRoom > 0 && n > maxPerRoom {
+			excess[room] = n - maxPerRoom
+			removed += n - maxPerRoom
+		}
+	}
+	if removed == 0 {
+		return 0, nil
+	}
+
+	err = s.editFileLocked(func(msg Message) (Message, bool) {
+		if !cutoff.IsZero() && msg.Time.Before(cutoff) {
+			return msg, false
+		}
+		if excess[msg.Room] > 0 {
+			excess[msg.Room]--
+			return msg, false
+		}
+		return msg, true
+	})
+	return removed, err
+}
+
+// EraseUser deletes or anonymizes all messages from or to username and rewrites
+// the file so the originals are no longer on disk. The file is scanned
+// rather than the in-memory copy, which may have evicted older messages.
+func (s *FileStore) EraseUser(username string, anonymize bool) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.MemoryStore.EraseUser(username, anonymize)
+
+	affected := 0
+	err := s.scanFileLocked(func(msg Message) error {
+		if from, to := involves(msg, username); from || to {
+			affected++
+		}
+		return nil
+	})
+	if err != nil || affected == 0 {
+		return 0, err
+	}
+	err = s.editFileLocked(func(msg Message) (Message, bool) {
+		from, to := involves(msg, username)
+		if !anonymize && (from || to) {
+			return msg, false
+		}
+		if from {
+			msg.From = AnonymousAuthor
+		}
+		if to {
+			msg.To = AnonymousAuthor
+		}
+		return msg, true
+	})
+	return affected, err
+}
+
+// scanFile calls fn for each message written to the file so far, oldest
+// first. s.mu is only held to open the file, so fn may block without
+// holding up appends: they add to the end, and rewrites replace the file,
+// so the part read is never changed underneath.
+func (s *FileStore) scanFile(fn func(Message) error) error {
+	s.mu.Lock()
+	f, err := os.Open(s.path)
+	if err != nil {
+		s.mu.Unlock()
+		return fmt.Errorf("read message store: %w", err)
+	}
+	info, err := f.Stat()
+	s.mu.Unlock()
+	defer f.Close()
+	if err != nil {
+		return fmt.Errorf("read message store: %w", err)
+	}
+	return scanMessages(io.LimitReader(f, info.Size()), fn)
+}
+
+// scanFileLocked calls fn for each message in the file, oldest first.
+// s.mu must be held.
+func (s *FileStore) scanFileLocked(fn func(Message) error) error {
+	f, err := os.Open(s.path)
+	if err != nil {
+		return fmt.Errorf("read message store: %w", err)
+	}
+	defer f.Close()
+	if err := scanMessages(f, fn); err != nil {
+		return fmt.Errorf("read message store: %w", err)
+	}
+	return nil
+}
+
+// editFileLocked rewrites the file, passing each message through edit,
+// which returns what to write in its place or false to drop it. s.mu must
+// be held.
+func (s *FileStore) editFileLocked(edit func(Message) (Message, bool)) error {
+	f, err := os.Open(s.path)
+	if err != nil {
+		return fmt.Errorf("compact message store: %w", err)
+	}
+	defer f.Close()
+	err = writeFileAtomic(s.path, func(w io.Writer) error {
+		enc := json.NewEncoder(w)
+		return scanMessages(f, func(msg Message) error {
+			if msg, keep := edit(msg); keep {
+				return enc.Encode(msg)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return fmt.Errorf("compact message store: %w", err)
+	}
+	return s.reopenLocked()
+}
+
+// reopenLocked reopens the file after it was replaced, so further appends
+// go to the new one. s.mu must be held.
+func (s *FileStore) reopenLocked() error {
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("reopen message store: %w", err)
+	}
+	s.file.Close()
+	s.file = f
+	return nil
+}
+
+// writeFileAtomic writes a file via a temporary file and rename, so readers
+// (and a crash mid-write) never see a partially written file
+func writeFileAtomic(path string, write func(io.Writer) error) error {
+	tmpPath := path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(tmp)
+	err = write(w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
+
+// Close flushes and closes the underlying file
+func (s *FileStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.file.Sync(); err != nil {
+		s.file.Close()
+		return err
+	}
+	return s.file.Close()
+}
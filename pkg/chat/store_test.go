@@ -0,0 +1,98 @@
+// pkg/chat/store_test.go
+package chat
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestFileStoreEraseUser erases a user whose older messages the history
+// limit has evicted from memory, and checks that reopening the file finds
+// none of their messages left
+func TestFileStoreEraseUser(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "messages.jsonl")
+	store, err := OpenFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, _ := newTestServer(t, Config{Store: store, MaxHistoryMessages: 2})
+	s.recordMessage(context.Background(), DefaultRoom, "alice", "secret")
+	for i := 0; i < 4; i++ {
+		s.recordMessage(context.Background(), DefaultRoom, "bob", "hi")
+	}
+	if store.Len() > 3 {
+		t.Fatalf("%d messages in memory, want the limit to evict some", store.Len())
+	}
+
+	result, err := s.EraseUser("Alice", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Messages != 1 {
+		t.Errorf("erased %d messages, want 1", result.Messages)
+	}
+	store.Close()
+
+	store, err = OpenFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if store.Len() != 4 {
+		t.Errorf("%d messages after reopening, want 4", store.Len())
+	}
+	for _, msg := range store.messages {
+		if msg.From == "alice" {
+			t.Errorf("alice's message %q is still on disk", msg.Text)
+		}
+	}
+}
+
+// TestFileStoreLimits caps a file store's memory and checks that exports,
+// archiving and pruning still see the messages evicted from it, and that
+// pruning removes them from the file
+func TestFileStoreLimits(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "messages.jsonl")
+	store, err := OpenFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.SetLimits(2, 0)
+	start := time.Now().Add(-time.Hour)
+	for i := 0; i < 6; i++ {
+		store.Append(Message{Room: DefaultRoom, From: "alice", Text: fmt.Sprint(i), Time: start.Add(time.Duration(i) * time.Minute)})
+	}
+	if store.Len() > 3 {
+		t.Fatalf("%d messages in memory, want the limit to evict some", store.Len())
+	}
+
+	var texts []string
+	store.ForEach(DefaultRoom, func(msg Message) error {
+		texts = append(texts, msg.Text)
+		return nil
+	})
+	if got := strings.Join(texts, " "); got != "0 1 2 3 4 5" {
+		t.Errorf("exported %s", got)
+	}
+	cutoff := start.Add(3*time.Minute - time.Second)
+	if old, err := store.Before(cutoff); err != nil || len(old) != 3 {
+		t.Errorf("got %d messages before the cutoff, %v", len(old), err)
+	}
+	if removed, err := store.Prune(cutoff, 0); err != nil || removed != 3 {
+		t.Errorf("pruned %d messages, %v", removed, err)
+	}
+	store.Close()
+
+	store, err = OpenFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if messages, _ := store.Recent(DefaultRoom, 10); len(messages) != 3 || messages[0].Text != "3" {
+		t.Errorf("after pruning and reopening: %+v", messages)
+	}
+}
@@ -0,0 +1,81 @@
+// pkg/chat/subscriptions.go
+package chat
+
+import (
+	"sync/atomic"
+)
+
+// subscriptionQueueSize is how many events may wait for a subscriber; more
+// are dropped
+const subscriptionQueueSize = 1000
+
+// Subscription is a stream of the server's events, from Subscribe
+type Subscription struct {
+	// C receives the events, and is closed by Close
+	C <-chan ExportEvent
+
+	server  *Server
+	events  chan ExportEvent
+	types   map[string]bool
+	dropped atomic.Int64
+}
+
+// Subscribe returns a subscription to the events of this instance of the
+// types given, e.g. ExportMessage, ExportJoin or AuditBan, or of every
+// type if none are: the same events Config.Exporter gets, for features
+// such as metrics, archivers and bridges to follow the chat without
+// changing the server. Events are handed over without blocking, so those
+// that don't fit in the subscription's queue, as it isn't read fast
+// enough, are dropped and counted by Dropped. Close it when done.
+func (s *Server) Subscribe(eventTypes ...string) *Subscription {
+	events := make(chan ExportEvent, subscriptionQueueSize)
+	sub := &Subscription{C: events, server: s, events: events}
+	if len(eventTypes) > 0 {
+		sub.types = make(map[string]bool, len(eventTypes))
+		for _, eventType := range eventTypes {
+			sub.types[eventType] = true
+		}
+	}
+
+	s.subscriptionsMu.Lock()
+	defer s.subscriptionsMu.Unlock()
+	if s.subscriptions == nil {
+		s.subscriptions = make(map[*Subscription]bool)
+	}
+	s.subscriptions[sub] = true
+	return sub
+}
+
+// Dropped returns how many events were dropped for the subscription, its
+// queue being full
+func (sub *Subscription) Dropped() int64 {
+	return sub.dropped.Load()
+}
+
+// Close ends the subscription, closing C once the events still queued
+// have been read
+func (sub *Subscription) Close() {
+	s := sub.server
+	s.subscriptionsMu.Lock()
+	defer s.subscriptionsMu.Unlock()
+	if s.subscriptions[sub] {
+		delete(s.subscriptions, sub)
+		close(sub.events)
+	}
+}
+
+// notifySubscribers hands event to the subscriptions wanting its type
+func (s *Server) notifySubscribers(event ExportEvent) {
+	s.subscriptionsMu.RLock()
+	defer s.subscriptionsMu.RUnlock()
+	for sub := range s.subscriptions {
+		if sub.types != nil && !sub.types[event.Type] {
+			continue
+		}
+		select {
+		case sub.events <- event:
+		default:
+			sub.dropped.Add(1)
+		}
+	}
+}
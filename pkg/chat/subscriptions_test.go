@@ -0,0 +1,72 @@
+// pkg/chat/subscriptions_test.go
+package chat
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// TestSubscribe follows a client joining, posting and being muted through
+// a filtered subscription and one to everything, and checks that a
+// subscription that isn't read drops events rather than holding up the
+// server
+func TestSubscribe(t *testing.T) {
+	s, url := newTestServer(t, Config{})
+	some := s.Subscribe(ExportJoin, ExportMessage, AuditMute)
+	defer some.Close()
+	all := s.Subscribe()
+	idle := s.Subscribe(ExportMessage)
+
+	alice := newTestClient(t, url, "alice", ClientOptions{})
+	if err := alice.Send("hello"); err != nil {
+		t.Fatal(err)
+	}
+	alice.waitMessage(t, func(msg ClientMessage) bool { return msg.Text == "hello" })
+	s.MuteUser("alice", time.Minute, "testing", "admin")
+
+	var got []ExportEvent
+	timeout := time.After(5 * time.Second)
+	for len(got) < 3 {
+		select {
+		case event := <-some.C:
+			got = append(got, event)
+		case <-timeout:
+			t.Fatalf("got %d events, want 3", len(got))
+		}
+	}
+	if got[0].Type != ExportJoin || got[1].Type != ExportMessage || got[1].Text != "hello" ||
+		got[2].Type != AuditMute || got[2].Target != "alice" {
+		t.Errorf("got %+v", got)
+	}
+	if got[0].Time.IsZero() || got[0].Instance == "" {
+		t.Errorf("event time and instance not set: %+v", got[0])
+	}
+	select {
+	case event := <-some.C:
+		t.Errorf("unwanted event %+v", event)
+	default:
+	}
+
+	// Everything includes the connection's audit event
+	types := map[string]bool{}
+	all.Close()
+	for event := range all.C {
+		types[event.Type] = true
+	}
+	for _, want := range []string{AuditConnect, ExportJoin, ExportMessage, AuditMute} {
+		if !types[want] {
+			t.Errorf("subscription to everything had no %s event: %v", want, types)
+		}
+	}
+
+	// Posted where alice won't see them
+	for i := 0; i < subscriptionQueueSize+10; i++ {
+		s.PostMessage(context.Background(), "elsewhere", "bot", "flood")
+	}
+	if dropped := idle.Dropped(); dropped != 11 {
+		t.Errorf("dropped %d events, want 11", dropped)
+	}
+	idle.Close()
+	idle.Close()
+}
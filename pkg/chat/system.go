@@ -0,0 +1,51 @@
+// pkg/chat/system.go
+package chat
+
+import (
+	"fmt"
+)
+
+// Server-originated messages, for embedders and the admin API. They are
+// delivered as-is, without being stored in the history or moderated.
+
+// SendToUser sends a message to a connected user, reporting whether they
+// were connected
+func (s *Server) SendToUser(username, message string) bool {
+	client := s.clientByName(username)
+	if client == nil {
+		if remote, ok := s.remote.lookup(username); ok {
+			s.publish(backplaneEvent{Type: eventUser, Username: remote.Username, Text: message})
+			return true
+		}
+		return false
+	}
+	if err := client.send(message); err != nil {
+		s.log.Warn("Error sending to client", "username", client.Username, "err", err)
+	}
+	return true
+}
+
+// SendToRoom sends a message to everyone in a room and returns how many
+// clients it was sent to
+func (s *Server) SendToRoom(room, message string) (int, error) {
+	name, ok := normalizeRoom(room)
+	if !ok {
+		return 0, fmt.Errorf("invalid room name %q", room)
+	}
+
+	recipients := 0
+	s.clients.each(func(client *Session) {
+		if client.Room == name {
+			recipients++
+		}
+	})
+
+	s.broadcastToRoom(name, message)
+	return recipients, nil
+}
+
+// BroadcastSystem sends a system notice, formatted like join and leave
+// notices, to every connected client
+func (s *Server) BroadcastSystem(message string) {
+	s.broadcastMessage("*** " + message + " ***")
+}
@@ -0,0 +1,123 @@
+// pkg/chat/terminal.go
+package chat
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// RunClient connects to a chat server and handles the chat session until
+// it ends or ctx is done
+func RunClient(ctx context.Context, serverAddr, username string) error {
+	return RunClientWithOptions(ctx, serverAddr, username, ClientOptions{})
+}
+
+// RunClientWithOptions connects to a chat server using the given options
+// and handles the chat session in the terminal until it ends or ctx is done
+func RunClientWithOptions(ctx context.Context, serverAddr, username string, opts ClientOptions) error {
+	if err := checkClientUsername(username); err != nil {
+		return err
+	}
+	u, err := serverURL(serverAddr)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Connecting to %s...\n", u.String())
+
+	client := NewClient(serverAddr, username, opts)
+	client.OnEvent(func(event ClientEvent) {
+		switch event.Type {
+		case ClientConnected:
+			if event.Err != nil {
+				fmt.Println(event.Err)
+			}
+			// Clear the screen and show welcome message
+			fmt.Print("\033[H\033[2J")
+			fmt.Println("=== Go Chat CLI ===")
+			fmt.Println("Type /help for available commands")
+			fmt.Println("Press Ctrl+C to exit")
+			fmt.Println("====================")
+			fmt.Print("> ")
+		case ClientError:
+			fmt.Printf("\r%v\n> ", event.Err)
+		case ClientDisconnected:
+			if event.Text != "" {
+				fmt.Printf("\rDisconnected by the server: %s\n", event.Text)
+			} else if event.Err != nil {
+				fmt.Printf("\rConnection closed: %v\n", event.Err)
+			}
+		}
+	})
+	client.OnMessage(func(msg ClientMessage) {
+		// Print the clean message to console, announcements in bold
+		text := msg.Line
+		if strings.HasPrefix(text, AnnouncementPrefix) {
+			text = "\033[1;33m" + text + "\033[0m"
+		}
+		fmt.Printf("\r%s\n", text)
+		fmt.Print("> ")
+	})
+
+	if err := client.Connect(ctx); err != nil {
+		if errors.Is(err, ErrCredentialsRejected) {
+			return fmt.Errorf("%w (use -token, -password or -cert)", err)
+		}
+		return err
+	}
+
+	// User input loop
+	go func() {
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			message := scanner.Text()
+
+			// Skip empty messages
+			if strings.TrimSpace(message) == "" {
+				fmt.Print("> ")
+				continue
+			}
+
+			// Handle client-side exit command
+			if message == "/exit" {
+				fmt.Println("Exiting chat...")
+				client.Close()
+				return
+			}
+
+			// Encrypted whispers are echoed here; the server only sees ciphertext
+			if target, text, ok := strings.Cut(strings.TrimPrefix(message, "/whisper "), " "); opts.Encrypt &&
+				strings.HasPrefix(message, "/whisper ") && ok && text != "" {
+				if err := client.Whisper(target, text); err != nil {
+					fmt.Printf("Error sending message: %v\n", err)
+					fmt.Print("> ")
+					continue
+				}
+				fmt.Printf("[PM to %s] (encrypted): %s\n", target, text)
+				fmt.Print("> ")
+				continue
+			}
+
+			if err := client.Send(message); err != nil {
+				fmt.Printf("Error sending message: %v\n", err)
+				return
+			}
+			fmt.Print("> ")
+		}
+	}()
+
+	// Wait for termination
+	select {
+	case <-client.Done():
+		return nil
+	case <-ctx.Done():
+		fmt.Println("\rClosing connection...")
+		if err := client.Close(); err != nil {
+			return fmt.Errorf("write close error: %w", err)
+		}
+		return nil
+	}
+}
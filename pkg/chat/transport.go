@@ -0,0 +1,197 @@
+// pkg/chat/transport.go
+package chat
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Transport is the WebSocket implementation that serves connections
+type Transport string
+
+// Transports
+const (
+	// TransportGorilla serves connections with gorilla/websocket, giving
+	// each one a goroutine reading from it and another writing to it
+	TransportGorilla Transport = "gorilla"
+	// TransportEpoll serves connections with gobwas/ws, watching idle ones
+	// with epoll rather than a goroutine each, for servers with tens of
+	// thousands of mostly quiet clients. It is only available on Linux,
+	// and doesn't compress messages; TLS connections, whose socket can't be
+	// watched, are still served with gorilla/websocket.
+	TransportEpoll Transport = "epoll"
+)
+
+// ParseTransport returns the transport named s
+func ParseTransport(s string) (Transport, error) {
+	switch transport := Transport(s); transport {
+	case TransportGorilla, TransportEpoll:
+		return transport, nil
+	}
+	return "", fmt.Errorf("unknown transport %q (want %s or %s)", s, TransportGorilla, TransportEpoll)
+}
+
+// wsConn is a client's WebSocket connection: a *websocket.Conn, or an
+// *epollConn with TransportEpoll. Message types are gorilla/websocket's.
+type wsConn interface {
+	NextReader() (messageType int, r io.Reader, err error)
+	ReadMessage() (messageType int, p []byte, err error)
+	WriteMessage(messageType int, data []byte) error
+	WritePreparedMessage(pm *websocket.PreparedMessage) error
+	WriteControl(messageType int, data []byte, deadline time.Time) error
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+	SetPongHandler(h func(appData string) error)
+	EnableWriteCompression(enable bool)
+	SetCompressionLevel(level int) error
+	Subprotocol() string
+	Close() error
+}
+
+// errPreparedMessage is returned by WritePreparedMessage on connections
+// other than gorilla/websocket's, which are written broadcasts' text
+// instead (see writesPrepared)
+var errPreparedMessage = errors.New("prepared messages need the gorilla transport")
+
+// writesPrepared reports whether conn can write a broadcast's prepared
+// message
+func writesPrepared(conn wsConn) bool {
+	_, ok := conn.(*websocket.Conn)
+	return ok
+}
+
+// inbox holds the incoming messages of a connection that is not a
+// WebSocket (an event stream or a gRPC stream) until it reads them, and
+// implements its read deadline
+type inbox struct {
+	messages chan string
+	// deadline is the read deadline in Unix nanoseconds, or 0 for none
+	deadline atomic.Int64
+	// done is closed when the connection is
+	done <-chan struct{}
+}
+
+func newInbox(size int, done <-chan struct{}) *inbox {
+	return &inbox{messages: make(chan string, size), done: done}
+}
+
+// read waits for the next message, until the read deadline
+func (in *inbox) read() (int, []byte, error) {
+	for {
+		deadline := in.deadline.Load()
+		if deadline == 0 {
+			return in.receive(nil)
+		}
+		wait := time.Until(time.Unix(0, deadline))
+		if wait <= 0 {
+			return 0, nil, os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(wait)
+		messageType, message, err := in.receive(timer.C)
+		timer.Stop()
+		if err != errDeadlineMoved {
+			return messageType, message, err
+		}
+	}
+}
+
+// errDeadlineMoved is returned by receive when the read deadline it was
+// waiting for has passed, though it may since have been put back
+var errDeadlineMoved = errors.New("read deadline reached")
+
+// receive waits for the next message, or until timeout
+func (in *inbox) receive(timeout <-chan time.Time) (int, []byte, error) {
+	select {
+	case text := <-in.messages:
+		return websocket.TextMessage, []byte(text), nil
+	case <-in.done:
+		return 0, nil, net.ErrClosed
+	case <-timeout:
+		return 0, nil, errDeadlineMoved
+	}
+}
+
+// setDeadline sets when read gives up waiting
+func (in *inbox) setDeadline(t time.Time) {
+	var deadline int64
+	if !t.IsZero() {
+		deadline = t.UnixNano()
+	}
+	in.deadline.Store(deadline)
+}
+
+// recordedResponse records the HTTP response a connection that is not made
+// over HTTP would have been given, so that a rejection can be passed on
+type recordedResponse struct {
+	header http.Header
+	code   int
+	body   bytes.Buffer
+}
+
+func newRecordedResponse() *recordedResponse {
+	return &recordedResponse{header: make(http.Header)}
+}
+
+func (w *recordedResponse) Header() http.Header { return w.header }
+
+func (w *recordedResponse) Write(p []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.body.Write(p)
+}
+
+func (w *recordedResponse) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+}
+
+// upgrade upgrades r to a WebSocket connection with the server's transport
+func (s *Server) upgrade(w http.ResponseWriter, r *http.Request) (wsConn, error) {
+	if s.netpoll != nil && r.TLS == nil {
+		return s.netpoll.upgrade(w, r)
+	}
+	conn, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetCompressionLevel(s.Config.CompressionLevel)
+	return conn, nil
+}
+
+// startWriting starts writing the client's outbox to the connection. A
+// polled client needs no write pump until something is queued (see wake).
+func (c *Session) startWriting() {
+	if c.polled == nil {
+		go c.writePump()
+	}
+}
+
+// startReading starts reading the registered client's messages, in
+// ReadPump or, for a polled client, whenever the poller finds some
+func (c *Session) startReading() {
+	if c.polled != nil {
+		c.Server.netpoll.add(c)
+		return
+	}
+	go c.ReadPump()
+}
+
+// keepAlive sets the read deadline of a newly registered client, and has
+// each pong extend it (see Config.ReadTimeout)
+func (c *Session) keepAlive() {
+	cfg := &c.Server.Config
+	c.conn.SetReadDeadline(time.Now().Add(cfg.ReadTimeout))
+	c.conn.SetPongHandler(func(string) error {
+		c.conn.SetReadDeadline(time.Now().Add(cfg.PongWait))
+		return nil
+	})
+}
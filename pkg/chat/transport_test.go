@@ -0,0 +1,154 @@
+// pkg/chat/transport_test.go
+package chat
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"net/http"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/gorilla/websocket"
+)
+
+// newEpollServer starts a server with cfg on the epoll transport, skipping
+// the test where that isn't available
+func newEpollServer(t *testing.T, cfg Config) (*Server, string) {
+	t.Helper()
+	cfg.Transport = TransportEpoll
+	s, url := newTestServer(t, cfg)
+	if s.netpoll == nil {
+		t.Skip("epoll transport not available")
+	}
+	return s, url
+}
+
+// TestEpollChurnUnderLoad is TestChurnUnderLoad on the epoll transport
+func TestEpollChurnUnderLoad(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("epoll transport not available")
+	}
+	churnUnderLoad(t, Config{HistorySize: 20, Transport: TransportEpoll, BatchSize: 10})
+}
+
+// TestEpollKickNoticeBeforeClose is TestKickNoticeBeforeClose on the epoll
+// transport, also checking that nothing is left polling afterwards
+func TestEpollKickNoticeBeforeClose(t *testing.T) {
+	s, url := newEpollServer(t, Config{})
+
+	conn, err := connect(url, "victim")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for i := 0; i < 10; i++ {
+		s.SendToUser("victim", "message")
+	}
+	if !s.KickUser("victim", "testing", "admin") {
+		t.Fatal("victim not connected")
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var got []string
+	for {
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			if !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+				t.Errorf("expected a policy violation close, got %v", err)
+			}
+			break
+		}
+		got = append(got, string(message))
+	}
+	if len(got) != 12 || got[11] != "*** You were kicked by admin: testing ***" {
+		t.Errorf("messages before close = %q", got)
+	}
+	if !waitFor(5*time.Second, func() bool {
+		s.netpoll.mu.Lock()
+		defer s.netpoll.mu.Unlock()
+		return len(s.netpoll.conns) == 0
+	}) {
+		t.Error("connection still polled after the client was kicked")
+	}
+}
+
+// TestEpollPipelined sends the username and a message along with the
+// handshake, before the server has answered it: the message must still be
+// read, though the poller never sees it arrive
+func TestEpollPipelined(t *testing.T) {
+	s, url := newEpollServer(t, Config{})
+	listener, err := connect(url, "listener")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(url, "ws://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	var request bytes.Buffer
+	request.WriteString("GET / HTTP/1.1\r\nHost: " + strings.TrimPrefix(url, "ws://") + "\r\n" +
+		"Upgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Version: 13\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n")
+	for _, text := range []string{"eager", "hello from the handshake"} {
+		ws.WriteFrame(&request, ws.MaskFrame(ws.NewTextFrame([]byte(text))))
+	}
+	if _, err := conn.Write(request.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	response, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("handshake status %d", response.StatusCode)
+	}
+
+	listener.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		_, message, err := listener.ReadMessage()
+		if err != nil {
+			t.Fatalf("listener: %v", err)
+		}
+		if string(message) == "eager: hello from the handshake" {
+			break
+		}
+	}
+	if s.clientByName("eager") == nil {
+		t.Error("eager client not registered")
+	}
+}
+
+// TestEpollTimeout checks that the poller pings idle clients, keeping
+// those that answer connected, and drops those that stop answering
+func TestEpollTimeout(t *testing.T) {
+	s, url := newEpollServer(t, Config{
+		ReadTimeout:  2 * time.Second,
+		PongWait:     2 * time.Second,
+		PingInterval: 200 * time.Millisecond,
+	})
+	// gorilla/websocket answers pings while reading
+	alive, err := connect(url, "alive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alive.Close()
+	go drain(alive)
+	gone, err := connect(url, "gone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gone.Close()
+
+	if !waitFor(5*time.Second, func() bool { return s.clientByName("gone") == nil }) {
+		t.Fatal("client that stopped answering pings was not dropped")
+	}
+	if s.clientByName("alive") == nil {
+		t.Error("client answering pings was dropped")
+	}
+}
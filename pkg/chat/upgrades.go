@@ -0,0 +1,100 @@
+// pkg/chat/upgrades.go
+package chat
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// upgradeLimiter caps WebSocket upgrades across the whole server, so a
+// reconnect storm (say, after a load balancer restart) is let in at a pace
+// the server can take. Upgrades beyond perSecond, after a burst, wait their
+// turn in a queue of up to queueSize; the rest are turned away.
+type upgradeLimiter struct {
+	mu        sync.Mutex
+	perSecond int
+	burst     int
+	queueSize int
+	// next is the slot of the next upgrade, one interval after the last.
+	// Upgrades are let in straight away until it is a burst's worth of
+	// intervals ahead of now.
+	next   time.Time
+	queued int
+}
+
+// newUpgradeLimiter creates a limiter; a zero perSecond disables it
+func newUpgradeLimiter(perSecond, burst, queueSize int) *upgradeLimiter {
+	l := &upgradeLimiter{}
+	l.setLimits(perSecond, burst, queueSize)
+	return l
+}
+
+// setLimits changes the limits, e.g. after a reload
+func (l *upgradeLimiter) setLimits(perSecond, burst, queueSize int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.perSecond, l.burst, l.queueSize = perSecond, max(burst, 1), queueSize
+}
+
+// wait admits an upgrade, waiting for its turn in the queue if need be,
+// and reports whether it was admitted. If not, retry is how long until it
+// would have been. Waiting ends early, unadmitted, if ctx is done.
+func (l *upgradeLimiter) wait(ctx context.Context) (admitted bool, retry time.Duration) {
+	l.mu.Lock()
+	if l.perSecond <= 0 {
+		l.mu.Unlock()
+		return true, 0
+	}
+	now := time.Now()
+	interval := time.Second / time.Duration(l.perSecond)
+	next := l.next
+	if next.Before(now) {
+		next = now
+	}
+	delay := next.Sub(now) - time.Duration(l.burst-1)*interval
+	if delay > 0 && l.queued >= l.queueSize {
+		l.mu.Unlock()
+		return false, delay
+	}
+	l.next = next.Add(interval)
+	if delay <= 0 {
+		l.mu.Unlock()
+		return true, 0
+	}
+	l.queued++
+	l.mu.Unlock()
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	defer func() {
+		l.mu.Lock()
+		l.queued--
+		l.mu.Unlock()
+	}()
+	select {
+	case <-timer.C:
+		return true, 0
+	case <-ctx.Done():
+		return false, 0
+	}
+}
+
+// waiting returns how many upgrades are queued
+func (l *upgradeLimiter) waiting() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.queued
+}
+
+// rejectOverloaded turns away an upgrade the limiter didn't admit, telling
+// the client when to try again
+func (s *Server) rejectOverloaded(w http.ResponseWriter, ip string, retry time.Duration) {
+	s.rejectedUpgrades.Add(1)
+	s.log.Debug("Too many upgrades, turning connection away", "remote_addr", ip, "retry_in", retry)
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retry.Seconds()))))
+	http.Error(w, "server busy, try again later", http.StatusServiceUnavailable)
+}
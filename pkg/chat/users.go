@@ -0,0 +1,276 @@
+// pkg/chat/users.go
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Role determines what a user is allowed to do on the server
+type Role string
+
+// Roles in increasing order of privilege
+const (
+	RoleGuest     Role = "guest"
+	RoleUser      Role = "user"
+	RoleModerator Role = "moderator"
+	RoleAdmin     Role = "admin"
+)
+
+// Errors returned by UserStore implementations
+var (
+	ErrUserNotFound = errors.New("user not found")
+	ErrUserExists   = errors.New("user already exists")
+)
+
+// User is a registered account
+type User struct {
+	Username     string            `json:"username"`
+	PasswordHash string            `json:"password_hash,omitempty"`
+	Role         Role              `json:"role"`
+	Settings     map[string]string `json:"settings,omitempty"`
+	CreatedAt    time.Time         `json:"created_at"`
+	// Email is where notifications are sent once EmailVerified is set by
+	// the user confirming a code mailed to it
+	Email         string `json:"email,omitempty"`
+	EmailVerified bool   `json:"email_verified,omitempty"`
+}
+
+// UserStore persists registered accounts. Usernames are case-insensitive.
+type UserStore interface {
+	// GetUser returns the account for username or ErrUserNotFound
+	GetUser(username string) (User, error)
+
+	// CreateUser adds a new account, failing with ErrUserExists if taken
+	CreateUser(user User) error
+
+	// UpdateUser replaces an existing account, or returns ErrUserNotFound
+	UpdateUser(user User) error
+
+	// DeleteUser removes an account, or returns ErrUserNotFound
+	DeleteUser(username string) error
+
+	// ListUsers returns all accounts sorted by username
+	ListUsers() ([]User, error)
+
+	// Close releases any resources held by the store
+	Close() error
+}
+
+// ContextUserStore is implemented by user stores that can give up on a
+// lookup when its context is done, such as when the client it is for
+// disconnects. Stores that don't are called with GetUser.
+type ContextUserStore interface {
+	GetUserContext(ctx context.Context, username string) (User, error)
+}
+
+// getUser looks up username's account, under ctx if the store takes one
+func (s *Server) getUser(ctx context.Context, username string) (User, error) {
+	if cs, ok := s.Users.(ContextUserStore); ok {
+		return cs.GetUserContext(ctx, username)
+	}
+	return s.Users.GetUser(username)
+}
+
+// userKey normalizes a username for use as a lookup key, so lookalike
+// names find the same account
+func userKey(username string) string {
+	return usernameSkeleton(username)
+}
+
+// copyUser returns a copy of u that doesn't share its settings map
+func copyUser(u User) User {
+	if u.Settings != nil {
+		settings := make(map[string]string, len(u.Settings))
+		for k, v := range u.Settings {
+			settings[k] = v
+		}
+		u.Settings = settings
+	}
+	return u
+}
+
+// MemoryUserStore keeps accounts in memory only; they are lost on restart
+type MemoryUserStore struct {
+	mu    sync.Mutex
+	users map[string]User
+}
+
+// NewMemoryUserStore creates an empty in-memory user store
+func NewMemoryUserStore() *MemoryUserStore {
+	return &MemoryUserStore{users: make(map[string]User)}
+}
+
+// GetUser looks up an account by username
+func (m *MemoryUserStore) GetUser(username string) (User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, ok := m.users[userKey(username)]
+	if !ok {
+		return User{}, ErrUserNotFound
+	}
+	return copyUser(user), nil
+}
+
+// CreateUser adds a new account
+func (m *MemoryUserStore) CreateUser(user User) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.createLocked(user)
+}
+
+func (m *MemoryUserStore) createLocked(user User) error {
+	key := userKey(user.Username)
+	if _, ok := m.users[key]; ok {
+		return ErrUserExists
+	}
+	if user.Role == "" {
+		user.Role = RoleUser
+	}
+	if user.CreatedAt.IsZero() {
+		user.CreatedAt = time.Now()
+	}
+	m.users[key] = copyUser(user)
+	return nil
+}
+
+// UpdateUser replaces an existing account
+func (m *MemoryUserStore) UpdateUser(user User) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.updateLocked(user)
+}
+
+func (m *MemoryUserStore) updateLocked(user User) error {
+	key := userKey(user.Username)
+	if _, ok := m.users[key]; !ok {
+		return ErrUserNotFound
+	}
+	m.users[key] = copyUser(user)
+	return nil
+}
+
+// DeleteUser removes an account
+func (m *MemoryUserStore) DeleteUser(username string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.deleteLocked(username)
+}
+
+func (m *MemoryUserStore) deleteLocked(username string) error {
+	key := userKey(username)
+	if _, ok := m.users[key]; !ok {
+		return ErrUserNotFound
+	}
+	delete(m.users, key)
+	return nil
+}
+
+// ListUsers returns all accounts sorted by username
+func (m *MemoryUserStore) ListUsers() ([]User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.listLocked(), nil
+}
+
+func (m *MemoryUserStore) listLocked() []User {
+	users := make([]User, 0, len(m.users))
+	for _, user := range m.users {
+		users = append(users, copyUser(user))
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return userKey(users[i].Username) < userKey(users[j].Username)
+	})
+	return users
+}
+
+// Close is a no-op for the in-memory store
+func (m *MemoryUserStore) Close() error {
+	return nil
+}
+
+// FileUserStore keeps accounts in a JSON file, rewritten on every change
+type FileUserStore struct {
+	*MemoryUserStore
+	path string
+}
+
+// OpenFileUserStore loads (or creates) the account file at path
+func OpenFileUserStore(path string) (*FileUserStore, error) {
+	mem := NewMemoryUserStore()
+
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("open user store: %w", err)
+	}
+	if len(data) > 0 {
+		var users []User
+		if err := json.Unmarshal(data, &users); err != nil {
+			return nil, fmt.Errorf("corrupt user store %s: %w", path, err)
+		}
+		for _, user := range users {
+			mem.users[userKey(user.Username)] = user
+		}
+	}
+
+	return &FileUserStore{MemoryUserStore: mem, path: path}, nil
+}
+
+// CreateUser adds a new account and saves the file
+func (f *FileUserStore) CreateUser(user User) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.createLocked(user); err != nil {
+		return err
+	}
+	return f.saveLocked()
+}
+
+// UpdateUser replaces an existing account and saves the file
+func (f *FileUserStore) UpdateUser(user User) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.updateLocked(user); err != nil {
+		return err
+	}
+	return f.saveLocked()
+}
+
+// DeleteUser removes an account and saves the file
+func (f *FileUserStore) DeleteUser(username string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.deleteLocked(username); err != nil {
+		return err
+	}
+	return f.saveLocked()
+}
+
+// saveLocked writes all accounts to disk. f.mu must be held.
+func (f *FileUserStore) saveLocked() error {
+	users := f.listLocked()
+	err := writeFileAtomic(f.path, func(w io.Writer) error {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(users)
+	})
+	if err != nil {
+		return fmt.Errorf("save user store: %w", err)
+	}
+	return nil
+}
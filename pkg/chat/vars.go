@@ -0,0 +1,122 @@
+// pkg/chat/vars.go
+package chat
+
+import (
+	"runtime"
+	"sync"
+	"time"
+)
+
+// Vars are live counters for quick inspection, e.g. published with expvar
+type Vars struct {
+	UptimeSeconds     int64   `json:"uptime_seconds"`
+	Goroutines        int     `json:"goroutines"`
+	Clients           int     `json:"clients"`
+	Guests            int     `json:"guests"`
+	Rooms             int     `json:"rooms"`
+	Mutes             int     `json:"mutes"`
+	Connections       int64   `json:"connections_total"`
+	Messages          int64   `json:"messages_total"`
+	MessagesPerSecond float64 `json:"messages_per_second"`
+	SlowClients       int64   `json:"slow_clients_total"`
+	DroppedMessages   int64   `json:"dropped_messages_total"`
+	SendQueueMax      int     `json:"send_queue_max"`
+	SendQueueAvg      float64 `json:"send_queue_avg"`
+	SendQueueBytesMax int64   `json:"send_queue_bytes_max"`
+	QueuedBytes       int64   `json:"queued_bytes"`
+	HistoryMessages   int     `json:"history_messages"`
+	EvictedMessages   int64   `json:"evicted_messages_total"`
+	QueuedUpgrades    int     `json:"upgrades_queued"`
+	RejectedUpgrades  int64   `json:"upgrades_rejected_total"`
+}
+
+// Vars returns the server's live counters. Unlike Stats it never touches
+// the ban store, so it is cheap enough to poll. MessagesPerSecond is the
+// average over the last minute. SlowClients counts the times a client fell
+// too far behind, and DroppedMessages what was dropped for them. The
+// SendQueue figures are how many messages, and bytes, are waiting to be
+// written to the most backed up client, and on average, and QueuedBytes
+// the bytes waiting for all of them. HistoryMessages are the messages held
+// in memory by the in-memory or file stores, and EvictedMessages those
+// Config.MaxHistoryMessages and MaxRoomMessages have evicted.
+// QueuedUpgrades are connections waiting for Config.UpgradesPerSecond to
+// let them in, and RejectedUpgrades those it turned away.
+func (s *Server) Vars() Vars {
+	vars := Vars{
+		UptimeSeconds:     int64(time.Since(s.startedAt).Seconds()),
+		Goroutines:        runtime.NumGoroutine(),
+		Rooms:             len(s.GetRoomList()),
+		Connections:       s.connections.Load(),
+		Messages:          s.messages.Load(),
+		MessagesPerSecond: s.messageRate.perSecond(time.Now()),
+		SlowClients:       s.slowClients.Load(),
+		DroppedMessages:   s.dropped.Load(),
+		QueuedUpgrades:    s.upgrades.waiting(),
+		RejectedUpgrades:  s.rejectedUpgrades.Load(),
+	}
+
+	vars.Clients = s.clients.len()
+	queued := 0
+	s.clients.each(func(client *Session) {
+		if client.Role == RoleGuest {
+			vars.Guests++
+		}
+		depth := len(client.outbox)
+		queued += depth
+		vars.SendQueueMax = max(vars.SendQueueMax, depth)
+		queuedBytes := client.queuedBytes.Load()
+		vars.SendQueueBytesMax = max(vars.SendQueueBytesMax, queuedBytes)
+		vars.QueuedBytes += queuedBytes
+	})
+	if vars.Clients > 0 {
+		vars.SendQueueAvg = float64(queued) / float64(vars.Clients)
+	}
+
+	_, vars.HistoryMessages, vars.EvictedMessages = s.historyUsage()
+
+	s.mutes.mu.Lock()
+	vars.Mutes = len(s.mutes.entries)
+	s.mutes.mu.Unlock()
+	return vars
+}
+
+// rateWindow is how many seconds a rateMeter averages over
+const rateWindow = 60
+
+// rateMeter counts events in one-second buckets over the last rateWindow
+// seconds
+type rateMeter struct {
+	mu     sync.Mutex
+	counts [rateWindow]int64
+	// seconds holds the Unix second each bucket is counting
+	seconds [rateWindow]int64
+}
+
+// add counts an event at now
+func (m *rateMeter) add(now time.Time) {
+	sec := now.Unix()
+	i := sec % rateWindow
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.seconds[i] != sec {
+		m.seconds[i], m.counts[i] = sec, 0
+	}
+	m.counts[i]++
+}
+
+// perSecond returns the average rate of events over the last rateWindow
+// seconds before now
+func (m *rateMeter) perSecond(now time.Time) float64 {
+	sec := now.Unix()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var total int64
+	for i, at := range m.seconds {
+		if sec-at < rateWindow {
+			total += m.counts[i]
+		}
+	}
+	return float64(total) / rateWindow
+}
@@ -0,0 +1,38 @@
+// pkg/chat/web.go
+package chat
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+// webFiles is the browser client: a page and script that join through
+// /ws, and the service worker that shows Web Push notifications
+//
+//go:embed web
+var webFiles embed.FS
+
+// WebClient returns the HTTP handler serving the browser client, to be
+// mounted at / on the server's main port so its WebSocket is same-origin
+func WebClient() http.Handler {
+	files, err := fs.Sub(webFiles, "web")
+	if err != nil {
+		panic(err)
+	}
+	fileServer := http.FileServerFS(files)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		// Only the page's own files may run, and it may not be framed
+		w.Header().Set("Content-Security-Policy", "default-src 'self'; frame-ancestors 'none'")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("Referrer-Policy", "no-referrer")
+		// Pick up a new client after an upgrade rather than a stale copy
+		w.Header().Set("Cache-Control", "no-cache")
+		fileServer.ServeHTTP(w, r)
+	})
+}
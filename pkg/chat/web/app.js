@@ -0,0 +1,181 @@
+// pkg/chat/web/app.js
+//
+// The browser client: it speaks the same text protocol as chat-client over
+// a WebSocket to /ws on the server that served this page.
+"use strict";
+
+const $ = (id) => document.getElementById(id);
+
+let socket = null;
+let joined = false;
+let password = "";
+
+function show(text, kind) {
+  const log = $("log");
+  const atBottom = log.scrollTop + log.clientHeight >= log.scrollHeight - 5;
+  const item = document.createElement("li");
+  item.textContent = text;
+  if (kind) {
+    item.className = kind;
+  }
+  log.appendChild(item);
+  if (atBottom) {
+    log.scrollTop = log.scrollHeight;
+  }
+}
+
+function kindOf(text) {
+  if (text.startsWith("ERROR:")) return "error";
+  if (text.startsWith("***")) return "system";
+  if (text.startsWith("[PM ")) return "private";
+  return "";
+}
+
+function send(text) {
+  if (socket && socket.readyState === WebSocket.OPEN) {
+    socket.send(text);
+  }
+}
+
+// leadingZeroBits counts the zero bits at the start of a hash
+function leadingZeroBits(bytes) {
+  let n = 0;
+  for (const b of bytes) {
+    if (b !== 0) {
+      return n + Math.clz32(b) - 24;
+    }
+    n += 8;
+  }
+  return n;
+}
+
+// solveProofOfWork finds a counter for which SHA-256("challenge:counter")
+// starts with enough zero bits, as SolveProofOfWork does in Go
+async function solveProofOfWork(challenge, difficulty) {
+  const encoder = new TextEncoder();
+  for (let counter = 0; ; counter++) {
+    const hash = await crypto.subtle.digest("SHA-256", encoder.encode(challenge + ":" + counter));
+    if (leadingZeroBits(new Uint8Array(hash)) >= difficulty) {
+      return counter;
+    }
+  }
+}
+
+function base64ToBytes(base64) {
+  const padded = (base64 + "===".slice((base64.length + 3) % 4)).replace(/-/g, "+").replace(/_/g, "/");
+  return Uint8Array.from(atob(padded), (c) => c.charCodeAt(0));
+}
+
+// subscribePush registers the service worker and subscribes this browser
+// with the server's VAPID key
+async function subscribePush(key) {
+  try {
+    const registration = await navigator.serviceWorker.register("sw.js");
+    await navigator.serviceWorker.ready;
+    const subscription = await registration.pushManager.subscribe({
+      userVisibleOnly: true,
+      applicationServerKey: base64ToBytes(key),
+    });
+    send("/push subscribe " + JSON.stringify(subscription));
+  } catch (err) {
+    show("Could not subscribe to notifications: " + err.message, "error");
+  }
+}
+
+function receive(text) {
+  if (text.startsWith("POW ")) {
+    const [, difficulty, challenge] = text.split(" ");
+    $("status").textContent = "Solving the server's challenge…";
+    solveProofOfWork(challenge, Number(difficulty)).then((counter) => send("/pow " + counter));
+    return;
+  }
+  if (text.startsWith("PUSHKEY ")) {
+    subscribePush(text.slice("PUSHKEY ".length));
+    return;
+  }
+  if (!joined && / is registered\. Type \/login /.test(text) && password) {
+    send("/login " + password);
+    return;
+  }
+  // Anything but the handshake's prompts means the server let us in
+  if (!joined && !handshake.some((pattern) => pattern.test(text))) {
+    joined = true;
+    $("status").textContent = "Connected";
+    $("notify").hidden = !("serviceWorker" in navigator && "PushManager" in window);
+  }
+  show(text, kindOf(text));
+}
+
+// handshake matches what the server may send before letting a client join
+const handshake = [/^ERROR:/, / is registered\. Type \/login /, /^Please log in first/, /^Invalid password\./, /^Too many failed/];
+
+function connect(username, token) {
+  const scheme = location.protocol === "https:" ? "wss:" : "ws:";
+  let url = scheme + "//" + location.host + "/ws";
+  if (token) {
+    url += "?token=" + encodeURIComponent(token);
+  }
+  socket = new WebSocket(url);
+  joined = false;
+
+  socket.onopen = () => socket.send(username);
+  socket.onmessage = (event) => receive(String(event.data));
+  socket.onclose = (event) => {
+    socket = null;
+    if (!joined) {
+      // Refused before joining: back to the form with the reason
+      const last = $("log").lastElementChild;
+      $("join-error").textContent = (last && last.textContent) || event.reason || "Could not connect.";
+      $("join-error").hidden = false;
+      $("chat").hidden = true;
+      $("join").hidden = false;
+      return;
+    }
+    $("status").textContent = "Disconnected" + (event.reason ? ": " + event.reason : "");
+    $("notify").hidden = true;
+  };
+}
+
+$("join").addEventListener("submit", (event) => {
+  event.preventDefault();
+  password = $("password").value;
+  $("join-error").hidden = true;
+  $("log").replaceChildren();
+  $("join").hidden = true;
+  $("chat").hidden = false;
+  $("status").textContent = "Connecting…";
+  connect($("username").value.trim(), $("token").value.trim());
+  $("message").focus();
+});
+
+$("compose").addEventListener("submit", (event) => {
+  event.preventDefault();
+  const text = $("message").value;
+  if (text.trim() === "") {
+    return;
+  }
+  if (!socket) {
+    show("Not connected. Leave and join again.", "error");
+    return;
+  }
+  send(text);
+  $("message").value = "";
+});
+
+$("notify").addEventListener("click", async () => {
+  if ((await Notification.requestPermission()) !== "granted") {
+    show("Notifications are blocked for this site.", "error");
+    return;
+  }
+  send("/push key");
+});
+
+$("leave").addEventListener("click", () => {
+  if (socket) {
+    socket.onclose = null;
+    socket.close(1000, "left");
+    socket = null;
+  }
+  $("chat").hidden = true;
+  $("join").hidden = false;
+});
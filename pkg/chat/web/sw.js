@@ -0,0 +1,32 @@
+// pkg/chat/web/sw.js
+//
+// The service worker shows the server's Web Push notifications of mentions
+// and whispers, and brings the chat back up when one is clicked.
+"use strict";
+
+self.addEventListener("push", (event) => {
+  let notification = { title: "go-chat", body: "" };
+  try {
+    notification = event.data.json();
+  } catch (err) {
+    notification.body = event.data ? event.data.text() : "";
+  }
+  event.waitUntil(self.registration.showNotification(notification.title, {
+    body: notification.body,
+    tag: notification.tag,
+    data: { room: notification.room },
+  }));
+});
+
+self.addEventListener("notificationclick", (event) => {
+  event.notification.close();
+  event.waitUntil((async () => {
+    const windows = await self.clients.matchAll({ type: "window", includeUncontrolled: true });
+    for (const client of windows) {
+      if (new URL(client.url).origin === self.location.origin && "focus" in client) {
+        return client.focus();
+      }
+    }
+    return self.clients.openWindow("/");
+  })());
+});
@@ -0,0 +1,48 @@
+// pkg/chat/web_test.go
+package chat
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestWebClient fetches the page and its files, with the security headers
+func TestWebClient(t *testing.T) {
+	ts := httptest.NewServer(WebClient())
+	defer ts.Close()
+
+	for _, file := range []struct {
+		path, contentType, contains string
+	}{
+		{"/", "text/html", `<script src="app.js"`},
+		{"/app.js", "text/javascript", `"/ws"`},
+		{"/sw.js", "text/javascript", `"push"`},
+		{"/style.css", "text/css", "#log"},
+	} {
+		resp, err := http.Get(ts.URL + file.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), file.contentType) ||
+			!strings.Contains(string(body), file.contains) {
+			t.Errorf("%s: %d %s %.80q", file.path, resp.StatusCode, resp.Header.Get("Content-Type"), body)
+		}
+		if !strings.Contains(resp.Header.Get("Content-Security-Policy"), "default-src 'self'") {
+			t.Errorf("%s has no CSP", file.path)
+		}
+	}
+
+	resp, err := http.Get(ts.URL + "/missing.js")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("missing file got %d", resp.StatusCode)
+	}
+}
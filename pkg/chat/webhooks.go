@@ -0,0 +1,275 @@
+// pkg/chat/webhooks.go
+package chat
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// webhookQueueSize is how many events may wait to be posted to a webhook;
+// more are dropped
+const webhookQueueSize = 1000
+
+// webhookAttempts is how many times an event is posted to a webhook before
+// it is given up on
+const webhookAttempts = 5
+
+// webhookMaxBackoff is the longest wait between attempts
+const webhookMaxBackoff = time.Minute
+
+// DefaultWebhookEvents are the events webhooks receive unless configured
+// otherwise
+var DefaultWebhookEvents = []string{ExportMessage, ExportJoin, ExportLeave, ExportMention, AuditReport}
+
+// Webhook is a URL that events are posted to
+type Webhook struct {
+	URL string `json:"url"`
+	// Secret signs each request, so the receiver can check it came from
+	// the server
+	Secret string `json:"secret"`
+	// Events are the types of event to post, by default
+	// DefaultWebhookEvents. Any exported event type may be given, e.g.
+	// "private_message" or "ban".
+	Events []string `json:"events,omitempty"`
+}
+
+// WebhookConfig lists the webhooks events are posted to
+type WebhookConfig struct {
+	Webhooks []Webhook `json:"webhooks"`
+}
+
+// LoadWebhookConfig reads a webhook config from a JSON file
+func LoadWebhookConfig(path string) (WebhookConfig, error) {
+	var cfg WebhookConfig
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, fmt.Errorf("read webhook config: %w", err)
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return cfg, fmt.Errorf("parse webhook config: %w", err)
+	}
+	return cfg, nil
+}
+
+// WebhookExporter is an EventExporter that posts events to webhooks as
+// JSON, one event per request, signed with the webhook's secret. Each
+// webhook gets its events in order, in the background; a failed request is
+// retried with exponential backoff, then logged and dropped, as are events
+// that don't fit in a webhook's queue.
+type WebhookExporter struct {
+	Config WebhookConfig
+
+	client *http.Client
+	hooks  []*webhookQueue
+	// backoff is the wait before the first retry, doubling after that
+	backoff time.Duration
+
+	// ctx is cancelled when Close gives up waiting, ending retries
+	ctx    context.Context
+	cancel context.CancelFunc
+	mu     sync.Mutex
+	closed bool
+}
+
+// webhookQueue is a webhook and the events waiting to be posted to it
+type webhookQueue struct {
+	Webhook
+	queue   chan ExportEvent
+	done    chan struct{}
+	dropped atomic.Int64
+}
+
+// NewWebhookExporter checks cfg and starts posting events to its webhooks.
+// Close it when shutting down.
+func NewWebhookExporter(cfg WebhookConfig) (*WebhookExporter, error) {
+	if len(cfg.Webhooks) == 0 {
+		return nil, errors.New("no webhooks configured")
+	}
+	e := &WebhookExporter{
+		Config:  cfg,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		backoff: time.Second,
+	}
+	for _, hook := range cfg.Webhooks {
+		u, err := url.Parse(hook.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid webhook URL %q", hook.URL)
+		}
+		if hook.Secret == "" {
+			return nil, fmt.Errorf("webhook %s needs a secret", u.Redacted())
+		}
+		if len(hook.Events) == 0 {
+			hook.Events = DefaultWebhookEvents
+		}
+		e.hooks = append(e.hooks, &webhookQueue{
+			Webhook: hook,
+			queue:   make(chan ExportEvent, webhookQueueSize),
+			done:    make(chan struct{}),
+		})
+	}
+	e.ctx, e.cancel = context.WithCancel(context.Background())
+	for _, hook := range e.hooks {
+		go e.run(hook)
+	}
+	return e, nil
+}
+
+// Export queues event for the webhooks that want it, dropping it for those
+// whose queue is full
+func (e *WebhookExporter) Export(event ExportEvent) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.closed {
+		return
+	}
+	for _, hook := range e.hooks {
+		if !slices.Contains(hook.Events, event.Type) {
+			continue
+		}
+		select {
+		case hook.queue <- event:
+		default:
+			hook.dropped.Add(1)
+		}
+	}
+}
+
+// run posts a webhook's queued events until Close, logging how many were
+// dropped at most every few seconds
+func (e *WebhookExporter) run(hook *webhookQueue) {
+	defer close(hook.done)
+	var lastWarning time.Time
+	for event := range hook.queue {
+		if err := e.deliver(hook.Webhook, event); err != nil {
+			slog.Warn("Error posting event to webhook", "url", redactURL(hook.URL), "type", event.Type, "err", err)
+		}
+		if time.Since(lastWarning) > 10*time.Second {
+			if n := hook.dropped.Swap(0); n > 0 {
+				slog.Warn("Dropped events, webhook queue full", "url", redactURL(hook.URL), "events", n)
+				lastWarning = time.Now()
+			}
+		}
+	}
+}
+
+// deliver posts event to hook, retrying failures that may be temporary:
+// network errors, timeouts, 429s and 5xx responses. A Retry-After header is
+// honoured, up to webhookMaxBackoff.
+func (e *WebhookExporter) deliver(hook Webhook, event ExportEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	delivery := randomToken()
+	backoff := e.backoff
+	for attempt := 1; ; attempt++ {
+		wait, err := e.post(hook, event.Type, delivery, body)
+		if err == nil || wait < 0 || attempt == webhookAttempts {
+			return err
+		}
+		if wait == 0 {
+			wait = backoff
+			backoff = min(2*backoff, webhookMaxBackoff)
+		}
+		select {
+		case <-time.After(min(wait, webhookMaxBackoff)):
+		case <-e.ctx.Done():
+			return err
+		}
+	}
+}
+
+// post makes one attempt at posting an event. On failure it returns how
+// long the webhook asked to wait before retrying, zero if it didn't say,
+// or -1 if retrying won't help.
+func (e *WebhookExporter) post(hook Webhook, eventType, delivery string, body []byte) (time.Duration, error) {
+	req, err := http.NewRequestWithContext(e.ctx, http.MethodPost, hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return -1, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "go-chat-webhooks")
+	req.Header.Set("X-Chat-Event", eventType)
+	// The same on every attempt, so receivers can spot duplicates
+	req.Header.Set("X-Chat-Delivery", delivery)
+	req.Header.Set("X-Chat-Timestamp", timestamp)
+	req.Header.Set("X-Chat-Signature", "sha256="+webhookSignature(hook.Secret, timestamp, body))
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return 0, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusRequestTimeout || resp.StatusCode >= 500:
+		wait := time.Duration(0)
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+			wait = time.Duration(seconds) * time.Second
+		}
+		return wait, fmt.Errorf("webhook answered %s", resp.Status)
+	default:
+		return -1, fmt.Errorf("webhook answered %s", resp.Status)
+	}
+}
+
+// webhookSignature returns the hex HMAC-SHA256, keyed with secret, of the
+// timestamp, a dot and the body, which receivers compute to check a request
+func webhookSignature(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// redactURL hides any password in a webhook URL, for logging
+func redactURL(raw string) string {
+	if u, err := url.Parse(raw); err == nil {
+		return u.Redacted()
+	}
+	return raw
+}
+
+// Close posts the events still queued, waiting up to timeout for them to
+// be delivered before giving up on the rest
+func (e *WebhookExporter) Close(timeout time.Duration) {
+	e.mu.Lock()
+	if !e.closed {
+		e.closed = true
+		for _, hook := range e.hooks {
+			close(hook.queue)
+		}
+	}
+	e.mu.Unlock()
+
+	deadline := time.After(timeout)
+	for _, hook := range e.hooks {
+		select {
+		case <-hook.done:
+		case <-deadline:
+			slog.Warn("Timed out posting the last events to webhooks")
+			e.cancel()
+			return
+		}
+	}
+	e.cancel()
+}
@@ -0,0 +1,95 @@
+// pkg/chat/webhooks_test.go
+package chat
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// TestWebhooks posts joins, a message, its mention and a report to a
+// webhook that fails the first request, and checks each is signed and
+// delivered in order
+func TestWebhooks(t *testing.T) {
+	received := make(chan ExportEvent, 20)
+	var requests atomic.Int32
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.Header.Get("X-Chat-Signature") != "sha256="+webhookSignature("hush", r.Header.Get("X-Chat-Timestamp"), body) {
+			t.Errorf("bad signature on %s", body)
+		}
+		if requests.Add(1) == 1 {
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+			return
+		}
+		var event ExportEvent
+		json.Unmarshal(body, &event)
+		if r.Header.Get("X-Chat-Event") != event.Type {
+			t.Errorf("%s event sent as %s", event.Type, r.Header.Get("X-Chat-Event"))
+		}
+		received <- event
+	}))
+	defer hook.Close()
+
+	webhooks, err := NewWebhookExporter(WebhookConfig{Webhooks: []Webhook{{URL: hook.URL, Secret: "hush"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	webhooks.backoff = 10 * time.Millisecond
+	defer webhooks.Close(time.Second)
+	_, url := newTestServer(t, Config{Exporter: webhooks})
+
+	alice, err := connect(url, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Close()
+	readUntil := func(want string) {
+		t.Helper()
+		alice.SetReadDeadline(time.Now().Add(5 * time.Second))
+		for {
+			_, text, err := alice.ReadMessage()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(text) == want {
+				return
+			}
+		}
+	}
+	readUntil("*** alice joined the chat ***")
+	bob, err := connect(url, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bob.Close()
+	bob.WriteMessage(websocket.TextMessage, []byte("hi @Alice, @nobody"))
+	// Whispers aren't posted unless asked for
+	bob.WriteMessage(websocket.TextMessage, []byte("/whisper alice psst"))
+	readUntil("[PM from bob]: psst")
+	alice.WriteMessage(websocket.TextMessage, []byte("/report bob too friendly"))
+
+	for _, want := range []ExportEvent{
+		{Type: ExportJoin, Room: "lobby", Username: "alice"},
+		{Type: ExportJoin, Room: "lobby", Username: "bob"},
+		{Type: ExportMessage, Room: "lobby", Username: "bob", Text: "hi @Alice, @nobody"},
+		{Type: ExportMention, Room: "lobby", Username: "bob", Target: "alice", Text: "hi @Alice, @nobody"},
+		{Type: AuditReport, Room: "lobby", Username: "alice", Target: "bob", Detail: "too friendly"},
+	} {
+		select {
+		case event := <-received:
+			if event.Type != want.Type || event.Room != want.Room || event.Username != want.Username ||
+				event.Target != want.Target || event.Text != want.Text || event.Detail != want.Detail {
+				t.Fatalf("got %+v, want %+v", event, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s event not posted", want.Type)
+		}
+	}
+}
@@ -0,0 +1,254 @@
+// pkg/chat/webpush.go
+package chat
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Web Push settings
+const (
+	defaultPushTTL   = 24 * time.Hour
+	vapidTokenExpiry = 12 * time.Hour
+	pushRecordSize   = 4096
+)
+
+// errSubscriptionGone is returned when the push service says a
+// subscription has expired or been withdrawn
+var errSubscriptionGone = errors.New("push subscription gone")
+
+// WebPushConfig is how the server sends Web Push notifications (RFC 8030)
+// to the browsers of users who subscribed with /push
+type WebPushConfig struct {
+	// Key is the server's VAPID key (RFC 8292); browsers subscribe with
+	// its public half, and only pushes signed with it reach them, so it
+	// must stay the same across restarts
+	Key *ecdsa.PrivateKey
+	// Subject is a mailto: or https: URL push services can contact the
+	// operator at
+	Subject string
+	// TTL is how long push services keep a notification for a browser
+	// that is offline, 24 hours by default
+	TTL time.Duration
+	// Client makes the requests to push services; nil uses a client with
+	// a 30 second timeout
+	Client *http.Client
+}
+
+// LoadVAPIDKey reads a P-256 private key from a PEM file, generating and
+// saving one first if the file doesn't exist
+func LoadVAPIDKey(path string) (*ecdsa.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600); err != nil {
+			return nil, fmt.Errorf("save VAPID key: %w", err)
+		}
+		return key, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read VAPID key: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("VAPID key %s: no PEM block", path)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		if parsed, err = x509.ParseECPrivateKey(block.Bytes); err != nil {
+			return nil, fmt.Errorf("VAPID key %s: %w", path, err)
+		}
+	}
+	key, ok := parsed.(*ecdsa.PrivateKey)
+	if !ok || key.Curve != elliptic.P256() {
+		return nil, fmt.Errorf("VAPID key %s: not a P-256 key", path)
+	}
+	return key, nil
+}
+
+// vapidPublicKey returns the key browsers pass to pushManager.subscribe
+// as applicationServerKey: the uncompressed point, base64url encoded
+func vapidPublicKey(key *ecdsa.PrivateKey) string {
+	public, err := key.PublicKey.Bytes()
+	if err != nil {
+		panic("VAPID key: " + err.Error())
+	}
+	return base64.RawURLEncoding.EncodeToString(public)
+}
+
+// vapidToken returns the ES256 JWT that authorizes pushes to endpoint's
+// push service
+func vapidToken(key *ecdsa.PrivateKey, endpoint *url.URL, subject string, now time.Time) (string, error) {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"typ":"JWT","alg":"ES256"}`))
+	claims, err := json.Marshal(map[string]any{
+		"aud": endpoint.Scheme + "://" + endpoint.Host,
+		"exp": now.Add(vapidTokenExpiry).Unix(),
+		"sub": subject,
+	})
+	if err != nil {
+		return "", err
+	}
+	signed := header + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(signed))
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	if err != nil {
+		return "", err
+	}
+	// JWS wants r and s as two 32-byte big-endian numbers
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// encryptPush encrypts payload for a subscription with aes128gcm, as Web
+// Push requires (RFC 8291), in a single record
+func encryptPush(sub PushSubscription, payload []byte) ([]byte, error) {
+	clientPublic, err := base64.RawURLEncoding.DecodeString(trimPadding(sub.Keys.P256DH))
+	if err != nil {
+		return nil, fmt.Errorf("subscription p256dh: %w", err)
+	}
+	authSecret, err := base64.RawURLEncoding.DecodeString(trimPadding(sub.Keys.Auth))
+	if err != nil {
+		return nil, fmt.Errorf("subscription auth: %w", err)
+	}
+	clientKey, err := ecdh.P256().NewPublicKey(clientPublic)
+	if err != nil {
+		return nil, fmt.Errorf("subscription p256dh: %w", err)
+	}
+
+	// A fresh key and salt for every message
+	serverKey, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := serverKey.ECDH(clientKey)
+	if err != nil {
+		return nil, err
+	}
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	serverPublic := serverKey.PublicKey().Bytes()
+
+	keyInfo := "WebPush: info\x00" + string(clientPublic) + string(serverPublic)
+	ikm, err := hkdf.Key(sha256.New, shared, authSecret, keyInfo, 32)
+	if err != nil {
+		return nil, err
+	}
+	cek, err := hkdf.Key(sha256.New, ikm, salt, "Content-Encoding: aes128gcm\x00", 16)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := hkdf.Key(sha256.New, ikm, salt, "Content-Encoding: nonce\x00", 12)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	// The header: salt, record size, and the key the browser derives the
+	// secret with
+	var body bytes.Buffer
+	body.Write(salt)
+	binary.Write(&body, binary.BigEndian, uint32(pushRecordSize))
+	body.WriteByte(byte(len(serverPublic)))
+	body.Write(serverPublic)
+	// 0x02 marks the last (here the only) record
+	plaintext := append(append([]byte{}, payload...), 0x02)
+	if len(plaintext)+gcm.Overhead() > pushRecordSize-body.Len() {
+		return nil, fmt.Errorf("push payload of %d bytes is too long", len(payload))
+	}
+	body.Write(gcm.Seal(nil, nonce, plaintext, nil))
+	return body.Bytes(), nil
+}
+
+// trimPadding lets keys through whether or not the browser padded them
+func trimPadding(s string) string {
+	for len(s) > 0 && s[len(s)-1] == '=' {
+		s = s[:len(s)-1]
+	}
+	return s
+}
+
+// sendPush encrypts payload for sub and posts it to the push service,
+// returning errSubscriptionGone if the subscription no longer works
+func sendPush(cfg *WebPushConfig, sub PushSubscription, payload []byte) error {
+	endpoint, err := url.Parse(sub.Endpoint)
+	if err != nil {
+		return err
+	}
+	body, err := encryptPush(sub, payload)
+	if err != nil {
+		return err
+	}
+	token, err := vapidToken(cfg.Key, endpoint, cfg.Subject, time.Now())
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, sub.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	ttl := cfg.TTL
+	if ttl <= 0 {
+		ttl = defaultPushTTL
+	}
+	req.Header.Set("Authorization", "vapid t="+token+", k="+vapidPublicKey(cfg.Key))
+	req.Header.Set("Content-Encoding", "aes128gcm")
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("TTL", strconv.Itoa(int(ttl.Seconds())))
+	req.Header.Set("Urgency", "high")
+
+	client := cfg.Client
+	if client == nil {
+		client = &http.Client{Timeout: 30 * time.Second}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		return errSubscriptionGone
+	case resp.StatusCode >= 300:
+		return fmt.Errorf("push service %s returned %s", endpoint.Host, resp.Status)
+	}
+	return nil
+}
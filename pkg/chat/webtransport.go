@@ -0,0 +1,319 @@
+// pkg/chat/webtransport.go
+package chat
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/quic-go/webtransport-go"
+)
+
+// webTransportStreamTimeout is how long a WebTransport client has to open
+// its stream once the session is established
+const webTransportStreamTimeout = 10 * time.Second
+
+// webTransportCloseGrace is how long a closed WebTransport session is kept
+// for what was written to arrive
+const webTransportCloseGrace = time.Second
+
+// errMessageTooLong is returned for messages longer than maxPostedMessage
+var errMessageTooLong = errors.New("message too long")
+
+// WebTransportServer returns an HTTP/3 server taking WebTransport sessions
+// at /ws (experimental). Serve it with Serve on a UDP socket, usually on
+// the same port number as the HTTPS listener, and stop it with Close once
+// the clients have been drained. Each session carries one bidirectional
+// stream, opened by the client, with every message framed as in a batch
+// (see BatchProtocol), in both directions, and a close frame ending it
+// (see wtConn.WriteControl). Sessions are admitted like
+// WebSocket connections, with the same limits, bans and Config.Auth.
+func (s *Server) WebTransportServer(tlsConfig *tls.Config) *webtransport.Server {
+	wt := &webtransport.Server{
+		H3: &http3.Server{
+			TLSConfig: http3.ConfigureTLSConfig(tlsConfig),
+			// QUIC keepalives take the place of WebSocket pings, and a
+			// peer that stops answering them is dropped after PongWait
+			QUICConfig: &quic.Config{
+				KeepAlivePeriod: s.Config.PingInterval,
+				MaxIdleTimeout:  s.Config.PongWait,
+			},
+		},
+		CheckOrigin: s.checkOrigin,
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+		s.serveConnection(w, r, func(w http.ResponseWriter, r *http.Request) (wsConn, error) {
+			return acceptWebTransport(wt, w, r)
+		})
+	})
+	wt.H3.Handler = mux
+	webtransport.ConfigureHTTP3Server(wt.H3)
+	return wt
+}
+
+// acceptWebTransport upgrades r to a WebTransport session and waits for
+// the client to open its stream
+func acceptWebTransport(wt *webtransport.Server, w http.ResponseWriter, r *http.Request) (*wtConn, error) {
+	session, err := wt.Upgrade(w, r)
+	if err != nil {
+		http.Error(w, "WebTransport session expected", http.StatusBadRequest)
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(session.Context(), webTransportStreamTimeout)
+	defer cancel()
+	stream, err := session.AcceptStream(ctx)
+	if err != nil {
+		session.CloseWithError(webtransport.SessionErrorCode(websocket.ClosePolicyViolation), "no stream opened")
+		return nil, err
+	}
+	return newWTConn(session, stream), nil
+}
+
+// dialWebTransport opens a WebTransport session to the https:// URL u and
+// the stream to talk over
+func dialWebTransport(ctx context.Context, u *url.URL, header http.Header, tlsConfig *tls.Config) (*wtConn, *http.Response, error) {
+	var qconn *quic.Conn
+	transport := &webtransport.Transport{
+		TLSClientConfig: tlsConfig,
+		QUICConfig: &quic.Config{
+			EnableDatagrams:                  true,
+			EnableStreamResetPartialDelivery: true,
+			KeepAlivePeriod:                  DefaultPingInterval,
+		},
+		DialAddr: func(ctx context.Context, addr string, tlsConfig *tls.Config, config *quic.Config) (*quic.Conn, error) {
+			conn, err := quic.DialAddrEarly(ctx, addr, tlsConfig, config)
+			qconn = conn
+			return conn, err
+		},
+	}
+	resp, session, err := transport.Dial(ctx, u.String(), header)
+	if err != nil {
+		return nil, resp, err
+	}
+	stream, err := session.OpenStream()
+	if err != nil {
+		session.CloseWithError(0, "")
+		return nil, resp, err
+	}
+	conn := newWTConn(session, stream)
+	conn.quic = qconn
+	return conn, resp, nil
+}
+
+// wtConn is a WebTransport session, standing in for a WebSocket connection
+// on either end. Closes are handshaken as with WebSockets: a close frame
+// is answered with one, after which each side ends its stream, and the
+// session only ends once what was written has had time to arrive. There
+// are no pings: QUIC keepalives notice dead peers, so pings are answered
+// straight away.
+type wtConn struct {
+	session *webtransport.Session
+	stream  *webtransport.Stream
+	reader  *bufio.Reader
+
+	// mu serializes writes and guards onPong
+	mu     sync.Mutex
+	onPong func(string) error
+
+	closeSent atomic.Bool
+	closeOnce sync.Once
+
+	// quic is the connection a dialed session runs on, which Close closes
+	// there and then, as the client may exit before a session close would
+	// be sent
+	quic *quic.Conn
+}
+
+func newWTConn(session *webtransport.Session, stream *webtransport.Stream) *wtConn {
+	return &wtConn{session: session, stream: stream, reader: bufio.NewReader(stream)}
+}
+
+// NextReader returns the next message
+func (c *wtConn) NextReader() (int, io.Reader, error) {
+	messageType, message, err := c.ReadMessage()
+	if err != nil {
+		return 0, nil, err
+	}
+	return messageType, bytes.NewReader(message), nil
+}
+
+// ReadMessage reads the next message. A close frame is answered, unless
+// one was sent first, and returned as a *websocket.CloseError, as is the
+// session ending.
+func (c *wtConn) ReadMessage() (int, []byte, error) {
+	header, err := c.reader.ReadSlice('\n')
+	if err != nil {
+		return 0, nil, c.readError(err)
+	}
+	header = header[:len(header)-1]
+	code := 0
+	if rest, ok := bytes.CutPrefix(header, []byte("close ")); ok {
+		codeText, length, _ := bytes.Cut(rest, []byte(" "))
+		if code, err = strconv.Atoi(string(codeText)); err != nil {
+			return 0, nil, fmt.Errorf("invalid close code %q", codeText)
+		}
+		header = length
+	}
+	n, err := strconv.Atoi(string(header))
+	if err != nil || n < 0 {
+		return 0, nil, fmt.Errorf("invalid message length %q", header)
+	}
+	if n > maxPostedMessage {
+		return 0, nil, errMessageTooLong
+	}
+	message := make([]byte, n)
+	if _, err := io.ReadFull(c.reader, message); err != nil {
+		return 0, nil, c.readError(err)
+	}
+
+	if code != 0 {
+		c.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, ""), time.Now().Add(time.Second))
+		return 0, nil, &websocket.CloseError{Code: code, Text: string(message)}
+	}
+	return websocket.TextMessage, message, nil
+}
+
+// readError returns the error a failed read amounts to: the peer ending
+// the session or giving up on the stream without a close frame is an
+// abnormal closure
+func (c *wtConn) readError(err error) error {
+	var closed *webtransport.SessionError
+	if errors.As(err, &closed) {
+		code := int(closed.ErrorCode)
+		if code == 0 {
+			code = websocket.CloseAbnormalClosure
+		}
+		return &websocket.CloseError{Code: code, Text: closed.Message}
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return &websocket.CloseError{Code: websocket.CloseAbnormalClosure, Text: io.ErrUnexpectedEOF.Error()}
+	}
+	return err
+}
+
+// WriteMessage writes data with its length in front; binary messages
+// aren't supported. A close message is written as WriteControl does.
+func (c *wtConn) WriteMessage(messageType int, data []byte) error {
+	switch messageType {
+	case websocket.TextMessage:
+	case websocket.CloseMessage:
+		return c.WriteControl(messageType, data, time.Time{})
+	default:
+		return errors.New("WebTransport streams only carry text messages")
+	}
+	if c.closeSent.Load() {
+		return websocket.ErrCloseSent
+	}
+	return c.writeFrame("", data)
+}
+
+// writeFrame writes data with prefix and its length in front
+func (c *wtConn) writeFrame(prefix string, data []byte) error {
+	buf := getBuffer()
+	defer putBuffer(buf)
+	buf.WriteString(prefix)
+	buf.Write(strconv.AppendInt(buf.AvailableBuffer(), int64(len(data)), 10))
+	buf.WriteByte('\n')
+	buf.Write(data)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, err := c.stream.Write(buf.Bytes())
+	return err
+}
+
+// WritePreparedMessage isn't supported
+func (c *wtConn) WritePreparedMessage(pm *websocket.PreparedMessage) error {
+	return errPreparedMessage
+}
+
+// WriteControl calls the pong handler for a ping, and for a close writes a
+// close frame, "close", the code and the reason's length, a newline and
+// the reason, then ends the stream
+func (c *wtConn) WriteControl(messageType int, data []byte, deadline time.Time) error {
+	switch messageType {
+	case websocket.PingMessage:
+		c.mu.Lock()
+		onPong := c.onPong
+		c.mu.Unlock()
+		if onPong != nil {
+			return onPong("")
+		}
+	case websocket.CloseMessage:
+		if !c.closeSent.CompareAndSwap(false, true) {
+			return websocket.ErrCloseSent
+		}
+		code := websocket.CloseNoStatusReceived
+		if len(data) >= 2 {
+			code = int(binary.BigEndian.Uint16(data))
+			data = data[2:]
+		}
+		if !deadline.IsZero() {
+			c.stream.SetWriteDeadline(deadline)
+		}
+		err := c.writeFrame("close "+strconv.Itoa(code)+" ", data)
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.stream.Close()
+		return err
+	}
+	return nil
+}
+
+// SetReadDeadline sets when ReadMessage gives up waiting
+func (c *wtConn) SetReadDeadline(t time.Time) error {
+	return c.stream.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets when writes fail
+func (c *wtConn) SetWriteDeadline(t time.Time) error {
+	return c.stream.SetWriteDeadline(t)
+}
+
+// SetPongHandler sets what is called when a ping is written
+func (c *wtConn) SetPongHandler(h func(appData string) error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.onPong = h
+}
+
+// EnableWriteCompression does nothing: messages aren't compressed
+func (c *wtConn) EnableWriteCompression(bool) {}
+
+// SetCompressionLevel does nothing: messages aren't compressed
+func (c *wtConn) SetCompressionLevel(int) error { return nil }
+
+// Subprotocol returns "", as there are no subprotocols
+func (c *wtConn) Subprotocol() string { return "" }
+
+// Close ends the stream, then the session once what was written has had
+// webTransportCloseGrace to arrive, as closing the session straight away
+// would throw it away. A dialed session's connection is closed at once.
+func (c *wtConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.mu.Lock()
+		c.stream.Close()
+		c.mu.Unlock()
+		if c.quic != nil {
+			c.quic.CloseWithError(0, "")
+			return
+		}
+		time.AfterFunc(webTransportCloseGrace, func() { c.session.CloseWithError(0, "") })
+	})
+	return nil
+}
@@ -0,0 +1,103 @@
+// pkg/chat/webtransport_test.go
+package chat
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// TestWebTransport joins over WebTransport alongside a WebSocket client,
+// with a token, then kicks the WebTransport client, whose session is
+// closed with the kick's close code and reason
+func TestWebTransport(t *testing.T) {
+	s, wsURL := newTestServer(t, Config{Auth: &TokenAuth{SharedSecret: "shared", UserTokens: map[string]string{"secret": "quick"}}})
+	// httptest's certificate is for 127.0.0.1
+	ts := httptest.NewTLSServer(http.NotFoundHandler())
+	defer ts.Close()
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wt := s.WebTransportServer(ts.TLS.Clone())
+	go wt.Serve(udp)
+	defer wt.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ts.Certificate())
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	u := &url.URL{Scheme: "https", Host: udp.LocalAddr().String(), Path: "/ws"}
+	if _, resp, err := dialWebTransport(ctx, u, nil, &tls.Config{RootCAs: roots}); err == nil || resp == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("without a token got %v", err)
+	}
+	conn, _, err := dialWebTransport(ctx, u, http.Header{"Authorization": {"Bearer secret"}}, &tls.Config{RootCAs: roots})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("anyone")); err != nil {
+		t.Fatal(err)
+	}
+	expect := func(want string) {
+		t.Helper()
+		for {
+			_, message, err := conn.ReadMessage()
+			if err != nil {
+				t.Fatalf("waiting for %q: %v", want, err)
+			}
+			if string(message) == want {
+				return
+			}
+		}
+	}
+	expect("*** quick joined the chat ***")
+
+	ws, err := connect(wsURL+"?token=shared", "socket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	if err := ws.WriteMessage(websocket.TextMessage, []byte("hello quic")); err != nil {
+		t.Fatal(err)
+	}
+	expect("socket: hello quic")
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("hello socket")); err != nil {
+		t.Fatal(err)
+	}
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		_, message, err := ws.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(message) == "quick: hello socket" {
+			break
+		}
+	}
+
+	if !s.KickUser("quick", "testing", "admin") {
+		t.Fatal("quick not connected")
+	}
+	for {
+		_, _, err := conn.ReadMessage()
+		if err == nil {
+			continue
+		}
+		var closeErr *websocket.CloseError
+		if !errors.As(err, &closeErr) || closeErr.Code != websocket.ClosePolicyViolation || closeErr.Text != "You were kicked by admin: testing" {
+			t.Errorf("session ended with %v", err)
+		}
+		break
+	}
+}
@@ -0,0 +1,576 @@
+// pkg/chat/xmpp.go
+package chat
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// xmppDialTimeout is how long connecting and handshaking with the XMPP
+// server may take
+const xmppDialTimeout = 10 * time.Second
+
+// xmppMaxBackoff is the longest wait between attempts to reconnect to the
+// XMPP server
+const xmppMaxBackoff = time.Minute
+
+// xmppSuffix ends the names of XMPP users in the chat, so they can't pass
+// for chat users
+const xmppSuffix = ".xmpp"
+
+// XMPP namespaces the component uses
+const (
+	xmppNSComponent  = "jabber:component:accept"
+	xmppNSStreams    = "http://etherx.jabber.org/streams"
+	xmppNSStanzas    = "urn:ietf:params:xml:ns:xmpp-stanzas"
+	xmppNSMUC        = "http://jabber.org/protocol/muc"
+	xmppNSMUCUser    = "http://jabber.org/protocol/muc#user"
+	xmppNSDiscoInfo  = "http://jabber.org/protocol/disco#info"
+	xmppNSDiscoItems = "http://jabber.org/protocol/disco#items"
+	xmppNSPing       = "urn:xmpp:ping"
+)
+
+// XMPPConfig describes the XMPP server to connect to as a component
+type XMPPConfig struct {
+	// Addr is the XMPP server's component port, e.g. localhost:5347
+	Addr string
+
+	// Domain is the component's domain, as configured on the XMPP server.
+	// Rooms are MUCs at room@Domain.
+	Domain string
+
+	// Secret is the component's shared secret
+	Secret string
+}
+
+// XMPPComponent exposes rooms as multi-user chats (XEP-0045) through an
+// external component connection (XEP-0114) to an XMPP server. XMPP users
+// join room@domain with the nick of their choice, see the room's users as
+// occupants and its messages as groupchat messages, and appear in the chat
+// as their nick with xmppSuffix after it, their joins and departures
+// announced to the room. If the connection drops, the component reconnects
+// and its occupants are told they have to join again.
+type XMPPComponent struct {
+	Config XMPPConfig
+
+	server *Server
+
+	// mu guards the connection, occupants, and whether Close has been
+	// called, and serializes writes
+	mu     sync.Mutex
+	conn   net.Conn
+	closed bool
+	// occupants maps each room to its XMPP occupants' nicks and the full
+	// JIDs they joined from
+	occupants map[string]map[string]string
+
+	done chan struct{}
+}
+
+// xmppStanza is the part of a stanza from the XMPP server the component
+// uses
+type xmppStanza struct {
+	XMLName  xml.Name
+	From     string    `xml:"from,attr"`
+	To       string    `xml:"to,attr"`
+	ID       string    `xml:"id,attr"`
+	Type     string    `xml:"type,attr"`
+	Body     string    `xml:"body"`
+	Children []xmlName `xml:",any"`
+}
+
+// xmlName is an element of which only the name matters
+type xmlName struct {
+	XMLName xml.Name
+}
+
+// NewXMPPComponent connects to the XMPP server as the component in cfg and
+// starts exposing s's rooms. Close it when shutting down.
+func NewXMPPComponent(s *Server, cfg XMPPConfig) (*XMPPComponent, error) {
+	if cfg.Addr == "" || cfg.Domain == "" || cfg.Secret == "" {
+		return nil, errors.New("the XMPP component needs the server's address, its domain and its secret")
+	}
+	c := &XMPPComponent{
+		Config:    cfg,
+		server:    s,
+		occupants: map[string]map[string]string{},
+		done:      make(chan struct{}),
+	}
+	conn, decoder, err := c.dial()
+	if err != nil {
+		return nil, err
+	}
+	c.conn = conn
+	go c.run(conn, decoder)
+	s.addBridge(c)
+	return c, nil
+}
+
+// dial connects to the XMPP server and authenticates as the component
+func (c *XMPPComponent) dial() (net.Conn, *xml.Decoder, error) {
+	conn, err := net.DialTimeout("tcp", c.Config.Addr, xmppDialTimeout)
+	if err != nil {
+		return nil, nil, fmt.Errorf("connect to XMPP server: %w", err)
+	}
+	conn.SetDeadline(time.Now().Add(xmppDialTimeout))
+	fail := func(err error) (net.Conn, *xml.Decoder, error) {
+		conn.Close()
+		return nil, nil, fmt.Errorf("XMPP component handshake: %w", err)
+	}
+	if _, err := fmt.Fprintf(conn, "<stream:stream xmlns='%s' xmlns:stream='%s' to='%s'>", xmppNSComponent, xmppNSStreams, xmlEscape(c.Config.Domain)); err != nil {
+		return fail(err)
+	}
+
+	decoder := xml.NewDecoder(conn)
+	var streamID string
+	for streamID == "" {
+		token, err := decoder.Token()
+		if err != nil {
+			return fail(err)
+		}
+		if start, ok := token.(xml.StartElement); ok && start.Name.Local == "stream" {
+			for _, attr := range start.Attr {
+				if attr.Name.Local == "id" {
+					streamID = attr.Value
+				}
+			}
+			if streamID == "" {
+				return fail(errors.New("the server sent no stream ID"))
+			}
+		}
+	}
+	hash := sha1.Sum([]byte(streamID + c.Config.Secret))
+	if _, err := fmt.Fprintf(conn, "<handshake>%s</handshake>", hex.EncodeToString(hash[:])); err != nil {
+		return fail(err)
+	}
+	var reply xmppStanza
+	if err := nextStanza(decoder, &reply); err != nil {
+		return fail(err)
+	}
+	if reply.XMLName.Local != "handshake" {
+		// Most likely a stream error for a wrong secret or domain
+		return fail(fmt.Errorf("the server answered with %s", reply.XMLName.Local))
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, decoder, nil
+}
+
+// nextStanza decodes the next top-level element from the stream into
+// stanza, failing if the stream ends
+func nextStanza(decoder *xml.Decoder, stanza *xmppStanza) error {
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return err
+		}
+		switch token := token.(type) {
+		case xml.StartElement:
+			return decoder.DecodeElement(stanza, &token)
+		case xml.EndElement:
+			return errors.New("stream closed by the server")
+		}
+	}
+}
+
+// run handles stanzas until Close, reconnecting whenever the connection
+// drops, after a backoff
+func (c *XMPPComponent) run(conn net.Conn, decoder *xml.Decoder) {
+	defer close(c.done)
+	var backoff time.Duration
+	for {
+		if conn != nil {
+			connected := time.Now()
+			err := c.serve(decoder)
+			if c.disconnected(conn) {
+				return
+			}
+			c.server.log.Warn("XMPP component disconnected", "err", err)
+			if time.Since(connected) > xmppMaxBackoff {
+				backoff = 0
+			}
+		}
+		backoff = min(max(2*backoff, time.Second), xmppMaxBackoff)
+		time.Sleep(backoff)
+
+		var err error
+		if conn, decoder, err = c.dial(); err != nil {
+			c.server.log.Warn("Error reconnecting XMPP component", "err", err, "retry_in", min(2*backoff, xmppMaxBackoff))
+			conn = nil
+			continue
+		}
+		if !c.reconnected(conn) {
+			conn.Close()
+			return
+		}
+		c.server.log.Info("XMPP component reconnected")
+	}
+}
+
+// disconnected forgets the dropped connection, and reports whether Close
+// was called
+func (c *XMPPComponent) disconnected(conn net.Conn) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	conn.Close()
+	c.conn = nil
+	return c.closed
+}
+
+// reconnected takes a new connection, unless Close has been called, and
+// tells the previous occupants they are no longer in their rooms
+func (c *XMPPComponent) reconnected(conn net.Conn) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return false
+	}
+	c.conn = conn
+	c.removeOccupantsLocked()
+	return true
+}
+
+// removeOccupantsLocked tells every occupant they were removed from their
+// room because the service went away, and forgets them
+func (c *XMPPComponent) removeOccupantsLocked() {
+	for room, occupants := range c.occupants {
+		for nick, jid := range occupants {
+			c.writeLocked(fmt.Sprintf("<presence from='%s' to='%s' type='unavailable'><x xmlns='%s'><item affiliation='none' role='none'/><status code='110'/><status code='332'/></x></presence>",
+				xmlEscape(c.occupantJID(room, nick)), xmlEscape(jid), xmppNSMUCUser))
+		}
+	}
+	c.occupants = map[string]map[string]string{}
+}
+
+// serve handles stanzas from the connection until it fails
+func (c *XMPPComponent) serve(decoder *xml.Decoder) error {
+	for {
+		var stanza xmppStanza
+		if err := nextStanza(decoder, &stanza); err != nil {
+			return err
+		}
+		room, nick, ok := c.parseJID(stanza.To)
+		if !ok {
+			continue
+		}
+		switch stanza.XMLName.Local {
+		case "presence":
+			c.presence(stanza, room, nick)
+		case "message":
+			c.message(stanza, room, nick)
+		case "iq":
+			c.iq(stanza, room)
+		case "error":
+			return errors.New("stream error from the server")
+		}
+	}
+}
+
+// parseJID splits a JID at the component into its room and nick, either of
+// which may be empty, and reports whether it is at the component at all
+func (c *XMPPComponent) parseJID(jid string) (room, nick string, ok bool) {
+	jid, nick, _ = strings.Cut(jid, "/")
+	local, domain, found := strings.Cut(jid, "@")
+	if !found {
+		local, domain = "", jid
+	}
+	if !strings.EqualFold(domain, c.Config.Domain) {
+		return "", "", false
+	}
+	if local != "" {
+		if room, ok = normalizeRoom(local); !ok {
+			return "", "", false
+		}
+	}
+	return room, nick, true
+}
+
+// roomJID and occupantJID return a room's JID and an occupant's in it
+func (c *XMPPComponent) roomJID(room string) string {
+	return room + "@" + c.Config.Domain
+}
+
+func (c *XMPPComponent) occupantJID(room, nick string) string {
+	return c.roomJID(room) + "/" + nick
+}
+
+// presence handles joining and leaving a room
+func (c *XMPPComponent) presence(stanza xmppStanza, room, nick string) {
+	if room == "" || nick == "" {
+		if stanza.Type == "" {
+			c.write(stanzaError("presence", stanza, "modify", "jid-malformed"))
+		}
+		return
+	}
+	switch stanza.Type {
+	case "":
+		c.join(stanza, room, nick)
+	case "unavailable":
+		c.leave(stanza.From, room, true)
+	case "error":
+		// The occupant's server can't be reached
+		c.leave(stanza.From, room, false)
+	}
+}
+
+// join adds the user at jid to room as nick, sending them the occupants'
+// presence, then their own and the room's subject, which completes the
+// join, and telling the room's users and other occupants
+func (c *XMPPComponent) join(stanza xmppStanza, room, nick string) {
+	jid := stanza.From
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	occupants := c.occupants[room]
+	for other, otherJID := range occupants {
+		if otherJID == jid {
+			// Already in, and only changing their status
+			return
+		}
+		if strings.EqualFold(other, nick) {
+			c.writeLocked(stanzaError("presence", stanza, "cancel", "conflict"))
+			return
+		}
+	}
+	users := c.roomUsers(room)
+	for _, user := range users {
+		if strings.EqualFold(user, nick) {
+			c.writeLocked(stanzaError("presence", stanza, "cancel", "conflict"))
+			return
+		}
+	}
+
+	for _, user := range users {
+		c.writeLocked(c.presenceStanza(room, user, jid, false))
+	}
+	for other := range occupants {
+		c.writeLocked(c.presenceStanza(room, other, jid, false))
+	}
+	c.writeLocked(strings.Replace(c.presenceStanza(room, nick, jid, false), "</x>", "<status code='110'/></x>", 1))
+	c.writeLocked(fmt.Sprintf("<message type='groupchat' from='%s' to='%s' id='%s'><subject>#%s</subject></message>",
+		xmlEscape(c.roomJID(room)), xmlEscape(jid), randomToken(), room))
+	for _, otherJID := range occupants {
+		c.writeLocked(c.presenceStanza(room, nick, otherJID, false))
+	}
+
+	if occupants == nil {
+		occupants = map[string]string{}
+		c.occupants[room] = occupants
+	}
+	occupants[nick] = jid
+	c.server.broadcastToRoom(room, fmt.Sprintf("*** %s joined #%s ***", bridgedUsername(nick, nick, xmppSuffix), room))
+}
+
+// leave removes the user at jid from room, telling them if they asked to
+// leave, and telling the room's users and other occupants
+func (c *XMPPComponent) leave(jid, room string, reply bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	occupants := c.occupants[room]
+	nick := ""
+	for other, otherJID := range occupants {
+		if otherJID == jid {
+			nick = other
+		}
+	}
+	if nick == "" {
+		return
+	}
+	delete(occupants, nick)
+	if len(occupants) == 0 {
+		delete(c.occupants, room)
+	}
+
+	if reply {
+		c.writeLocked(strings.Replace(c.presenceStanza(room, nick, jid, true), "</x>", "<status code='110'/></x>", 1))
+	}
+	for _, otherJID := range occupants {
+		c.writeLocked(c.presenceStanza(room, nick, otherJID, true))
+	}
+	c.server.broadcastToRoom(room, fmt.Sprintf("*** %s left #%s ***", bridgedUsername(nick, nick, xmppSuffix), room))
+}
+
+// roomUsers returns the users in room here and on other instances
+func (c *XMPPComponent) roomUsers(room string) []string {
+	var users []string
+	c.server.clients.each(func(client *Session) {
+		if client.Room == room {
+			users = append(users, client.Username)
+		}
+	})
+	for _, user := range c.server.remote.users() {
+		if user.Room == room {
+			users = append(users, user.Username)
+		}
+	}
+	return users
+}
+
+// presenceStanza returns the presence of the occupant nick of room, or its
+// going away, for the user at to
+func (c *XMPPComponent) presenceStanza(room, nick, to string, unavailable bool) string {
+	typ, role := "", "participant"
+	if unavailable {
+		typ, role = " type='unavailable'", "none"
+	}
+	return fmt.Sprintf("<presence from='%s' to='%s'%s><x xmlns='%s'><item affiliation='none' role='%s'/></x></presence>",
+		xmlEscape(c.occupantJID(room, nick)), xmlEscape(to), typ, xmppNSMUCUser, role)
+}
+
+// message posts an occupant's groupchat message to the room, and reflects
+// it to the room's occupants, the sender among them, as MUCs do
+func (c *XMPPComponent) message(stanza xmppStanza, room, nick string) {
+	if stanza.Type == "error" {
+		return
+	}
+	if room == "" || nick != "" || stanza.Type != "groupchat" {
+		// Private messages to occupants aren't supported
+		c.write(stanzaError("message", stanza, "cancel", "feature-not-implemented"))
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	sender := ""
+	for other, jid := range c.occupants[room] {
+		if jid == stanza.From {
+			sender = other
+		}
+	}
+	if sender == "" {
+		c.writeLocked(stanzaError("message", stanza, "modify", "not-acceptable"))
+		return
+	}
+	if strings.TrimSpace(stanza.Body) == "" {
+		return
+	}
+	for _, jid := range c.occupants[room] {
+		c.writeLocked(c.messageStanza(room, sender, jid, stanza.ID, stanza.Body))
+	}
+	c.server.postMessage(context.Background(), room, bridgedUsername(sender, sender, xmppSuffix), "", c.name(), stanza.Body)
+}
+
+// messageStanza returns a groupchat message from the occupant nick of room
+// for the user at to
+func (c *XMPPComponent) messageStanza(room, nick, to, id, body string) string {
+	if id == "" {
+		id = randomToken()
+	}
+	return fmt.Sprintf("<message type='groupchat' from='%s' to='%s' id='%s'><body>%s</body></message>",
+		xmlEscape(c.occupantJID(room, nick)), xmlEscape(to), xmlEscape(id), xmlEscape(body))
+}
+
+// iq answers pings and service discovery, listing the rooms as MUCs
+func (c *XMPPComponent) iq(stanza xmppStanza, room string) {
+	if stanza.Type != "get" && stanza.Type != "set" {
+		return
+	}
+	payload := ""
+	if len(stanza.Children) > 0 {
+		payload = stanza.Children[0].XMLName.Space
+	}
+	result := func(query string) {
+		c.write(fmt.Sprintf("<iq type='result' from='%s' to='%s' id='%s'>%s</iq>",
+			xmlEscape(stanza.To), xmlEscape(stanza.From), xmlEscape(stanza.ID), query))
+	}
+	switch {
+	case stanza.Type == "get" && payload == xmppNSPing:
+		result("")
+	case stanza.Type == "get" && payload == xmppNSDiscoInfo:
+		name := "go-chat"
+		if room != "" {
+			name = "#" + room
+		}
+		result(fmt.Sprintf("<query xmlns='%s'><identity category='conference' type='text' name='%s'/><feature var='%s'/><feature var='%s'/><feature var='%s'/></query>",
+			xmppNSDiscoInfo, xmlEscape(name), xmppNSMUC, xmppNSDiscoInfo, xmppNSDiscoItems))
+	case stanza.Type == "get" && payload == xmppNSDiscoItems:
+		var items strings.Builder
+		if room == "" {
+			for _, info := range c.server.GetRoomList() {
+				fmt.Fprintf(&items, "<item jid='%s' name='#%s'/>", xmlEscape(c.roomJID(info.Name)), info.Name)
+			}
+		}
+		result(fmt.Sprintf("<query xmlns='%s'>%s</query>", xmppNSDiscoItems, items.String()))
+	default:
+		c.write(stanzaError("iq", stanza, "cancel", "service-unavailable"))
+	}
+}
+
+// stanzaError returns an error reply of kind to stanza, with condition
+// from the stanza errors namespace
+func stanzaError(kind string, stanza xmppStanza, typ, condition string) string {
+	return fmt.Sprintf("<%s type='error' from='%s' to='%s' id='%s'><error type='%s'><%s xmlns='%s'/></error></%s>",
+		kind, xmlEscape(stanza.To), xmlEscape(stanza.From), xmlEscape(stanza.ID), typ, condition, xmppNSStanzas, kind)
+}
+
+func (c *XMPPComponent) name() string { return "xmpp" }
+
+// relay sends a room message to the room's occupants
+func (c *XMPPComponent) relay(room, username, text string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, jid := range c.occupants[room] {
+		c.writeLocked(c.messageStanza(room, username, jid, "", text))
+	}
+}
+
+// moved tells the occupants of the rooms a user left and joined
+func (c *XMPPComponent) moved(username, from, to string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, jid := range c.occupants[from] {
+		c.writeLocked(c.presenceStanza(from, username, jid, true))
+	}
+	for _, jid := range c.occupants[to] {
+		c.writeLocked(c.presenceStanza(to, username, jid, false))
+	}
+}
+
+// write sends a stanza to the XMPP server, if connected
+func (c *XMPPComponent) write(stanza string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeLocked(stanza)
+}
+
+// writeLocked is write for callers holding mu. A failed write closes the
+// connection, for run to reconnect.
+func (c *XMPPComponent) writeLocked(stanza string) {
+	if c.conn == nil {
+		return
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(c.server.Config.WriteTimeout))
+	if _, err := c.conn.Write([]byte(stanza)); err != nil {
+		c.conn.Close()
+	}
+}
+
+// xmlEscape escapes text for XML character data and attribute values
+func xmlEscape(text string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(text))
+	return b.String()
+}
+
+// Close tells the occupants the rooms are going away, ends the stream and
+// disconnects
+func (c *XMPPComponent) Close() {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return
+	}
+	c.closed = true
+	c.removeOccupantsLocked()
+	c.writeLocked("</stream:stream>")
+	if c.conn != nil {
+		c.conn.Close()
+	}
+	c.mu.Unlock()
+	<-c.done
+}
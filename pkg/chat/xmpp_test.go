@@ -0,0 +1,149 @@
+// pkg/chat/xmpp_test.go
+package chat
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// TestXMPPComponent handshakes with a fake XMPP server, joins a room from
+// it, and relays messages and presence both ways
+func TestXMPPComponent(t *testing.T) {
+	s, url := newTestServer(t, Config{})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		accepted <- conn
+	}()
+	ws, err := connect(url, "socket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+
+	components := make(chan *XMPPComponent, 1)
+	go func() {
+		c, err := NewXMPPComponent(s, XMPPConfig{Addr: ln.Addr().String(), Domain: "rooms.test", Secret: "s3cret"})
+		if err != nil {
+			t.Error(err)
+		}
+		components <- c
+	}()
+	conn := <-accepted
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	decoder := xml.NewDecoder(bufio.NewReader(conn))
+	token, err := decoder.Token()
+	if start, ok := token.(xml.StartElement); err != nil || !ok || start.Name.Local != "stream" {
+		t.Fatalf("component opened with %v, %v", token, err)
+	}
+	fmt.Fprint(conn, "<stream:stream xmlns='jabber:component:accept' xmlns:stream='http://etherx.jabber.org/streams' id='abc' from='rooms.test'>")
+	var handshake struct {
+		XMLName xml.Name
+		Hash    string `xml:",chardata"`
+	}
+	if err := decoder.Decode(&handshake); err != nil {
+		t.Fatal(err)
+	}
+	if hash := sha1.Sum([]byte("abcs3cret")); handshake.Hash != hex.EncodeToString(hash[:]) {
+		t.Fatalf("handshake %q", handshake.Hash)
+	}
+	fmt.Fprint(conn, "<handshake/>")
+	c := <-components
+	if c == nil {
+		t.FailNow()
+	}
+	defer c.Close()
+
+	next := func() xmppStanza {
+		t.Helper()
+		var stanza xmppStanza
+		if err := nextStanza(decoder, &stanza); err != nil {
+			t.Fatal(err)
+		}
+		return stanza
+	}
+	expect := func(kind, from, body string) xmppStanza {
+		t.Helper()
+		stanza := next()
+		if stanza.XMLName.Local != kind || stanza.From != from || stanza.Body != body || stanza.To != "bob@example.com/phone" {
+			t.Fatalf("got %s from %s to %s with %q, want %s from %s with %q", stanza.XMLName.Local, stanza.From, stanza.To, stanza.Body, kind, from, body)
+		}
+		return stanza
+	}
+	readUntil := func(want string) {
+		t.Helper()
+		ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+		for {
+			_, text, err := ws.ReadMessage()
+			if err != nil {
+				t.Fatalf("waiting for %q: %v", want, err)
+			}
+			if string(text) == want {
+				return
+			}
+		}
+	}
+
+	fmt.Fprint(conn, "<iq type='get' from='bob@example.com/phone' to='rooms.test' id='1'><query xmlns='http://jabber.org/protocol/disco#items'/></iq>")
+	var items struct {
+		Items []struct {
+			JID string `xml:"jid,attr"`
+		} `xml:"query>item"`
+	}
+	token, _ = decoder.Token()
+	start := token.(xml.StartElement)
+	if err := decoder.DecodeElement(&items, &start); err != nil || len(items.Items) != 1 || items.Items[0].JID != "lobby@rooms.test" {
+		t.Fatalf("rooms %+v, %v", items, err)
+	}
+
+	// A nick taken in the room is refused
+	fmt.Fprint(conn, "<presence from='bob@example.com/phone' to='lobby@rooms.test/Socket'><x xmlns='http://jabber.org/protocol/muc'/></presence>")
+	if stanza := next(); stanza.Type != "error" {
+		t.Fatalf("joined as a taken nick: %+v", stanza)
+	}
+
+	fmt.Fprint(conn, "<presence from='bob@example.com/phone' to='lobby@rooms.test/bob'><x xmlns='http://jabber.org/protocol/muc'/></presence>")
+	expect("presence", "lobby@rooms.test/socket", "")
+	expect("presence", "lobby@rooms.test/bob", "")
+	expect("message", "lobby@rooms.test", "")
+	readUntil("*** bob.xmpp joined #lobby ***")
+
+	ws.WriteMessage(websocket.TextMessage, []byte("fish & <chips>"))
+	expect("message", "lobby@rooms.test/socket", "fish & <chips>")
+
+	fmt.Fprint(conn, "<message type='groupchat' from='bob@example.com/phone' to='lobby@rooms.test' id='m1'><body>hello</body></message>")
+	if stanza := expect("message", "lobby@rooms.test/bob", "hello"); stanza.ID != "m1" {
+		t.Errorf("reflection has ID %q", stanza.ID)
+	}
+	readUntil("bob.xmpp: hello")
+
+	ws.WriteMessage(websocket.TextMessage, []byte("/join dev"))
+	if stanza := expect("presence", "lobby@rooms.test/socket", ""); stanza.Type != "unavailable" {
+		t.Errorf("leaving the room sent presence of type %q", stanza.Type)
+	}
+	ws.WriteMessage(websocket.TextMessage, []byte("/join lobby"))
+	expect("presence", "lobby@rooms.test/socket", "")
+
+	fmt.Fprint(conn, "<presence type='unavailable' from='bob@example.com/phone' to='lobby@rooms.test/bob'/>")
+	if stanza := expect("presence", "lobby@rooms.test/bob", ""); stanza.Type != "unavailable" {
+		t.Errorf("leaving sent presence of type %q", stanza.Type)
+	}
+	readUntil("*** bob.xmpp left #lobby ***")
+}
@@ -0,0 +1,79 @@
+// pkg/chatapi/chatapi_test.go
+package chatapi
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/ryk-9/go-chat/pkg/chat"
+)
+
+// TestOpenAPIUpToDate fails when the API's description has changed without
+// the client being regenerated
+func TestOpenAPIUpToDate(t *testing.T) {
+	committed, err := os.ReadFile("openapi.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(committed, chat.OpenAPI()) {
+		t.Fatal("openapi.json is out of date; run make apigen")
+	}
+}
+
+// TestClient posts and reads back messages through the REST API and bans
+// and unbans a user through the admin API
+func TestClient(t *testing.T) {
+	s := chat.NewServerWithConfig(chat.Config{
+		Logger:     slog.New(slog.NewTextHandler(io.Discard, nil)),
+		AdminToken: "root",
+	})
+	mux := http.NewServeMux()
+	mux.Handle("/admin/", s.AdminHandler())
+	mux.Handle("/api/", s.APIHandler())
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+	ctx := context.Background()
+	c := NewClient(ts.URL, "root")
+
+	for _, text := range []string{"one", "two", "three"} {
+		if err := c.PostMessage(ctx, "lobby", PostMessageRequest{From: "alice", Text: text}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	messages, err := c.ListMessages(ctx, "lobby", ListMessagesParams{Limit: 2})
+	if err != nil || len(messages) != 2 || messages[0].Text != "two" || messages[1].From != "alice" {
+		t.Fatalf("messages %+v, %v", messages, err)
+	}
+	older, err := c.ListMessages(ctx, "lobby", ListMessagesParams{Before: messages[0].ID})
+	if err != nil || len(older) != 1 || older[0].Text != "one" {
+		t.Errorf("messages before %d: %+v, %v", messages[0].ID, older, err)
+	}
+	rooms, err := c.ListRooms(ctx)
+	if err != nil || len(rooms) == 0 {
+		t.Errorf("rooms %+v, %v", rooms, err)
+	}
+	export, err := c.ExportRoom(ctx, ExportRoomParams{Room: "lobby", Format: "csv"})
+	if err != nil || !bytes.Contains(export, []byte("three")) {
+		t.Errorf("export %q, %v", export, err)
+	}
+
+	if ban, err := c.AddBan(ctx, AddBanParams{User: "mallory", Reason: "spam"}); err != nil || ban.Username != "mallory" {
+		t.Fatalf("ban %+v, %v", ban, err)
+	}
+	if removed, err := c.RemoveBans(ctx, RemoveBansParams{User: "mallory"}); err != nil || removed.Removed != 1 {
+		t.Errorf("unban %+v, %v", removed, err)
+	}
+
+	var apiErr *Error
+	err = NewClient(ts.URL, "wrong").PostMessage(ctx, "lobby", PostMessageRequest{From: "alice", Text: "hi"})
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusUnauthorized {
+		t.Errorf("bad token got %v", err)
+	}
+}
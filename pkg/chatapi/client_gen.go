@@ -0,0 +1,424 @@
+// Code generated by go run ./cmd/apigen from openapi.json. DO NOT EDIT.
+
+package chatapi
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// APIUser is the APIUser schema of the OpenAPI document
+type APIUser struct {
+	Remote   bool   `json:"remote,omitempty"`
+	Role     string `json:"role,omitempty"`
+	Room     string `json:"room"`
+	Username string `json:"username"`
+}
+
+// AuditEvent is the AuditEvent schema of the OpenAPI document
+type AuditEvent struct {
+	Actor  string    `json:"actor,omitempty"`
+	Detail string    `json:"detail,omitempty"`
+	Event  string    `json:"event"`
+	IP     string    `json:"ip,omitempty"`
+	Target string    `json:"target,omitempty"`
+	Time   time.Time `json:"time"`
+}
+
+// Ban is the Ban schema of the OpenAPI document
+type Ban struct {
+	By        string    `json:"by,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at,omitzero"`
+	IP        string    `json:"ip,omitempty"`
+	Reason    string    `json:"reason,omitempty"`
+	Username  string    `json:"username,omitempty"`
+}
+
+// BansRemoved is the BansRemoved schema of the OpenAPI document
+type BansRemoved struct {
+	Removed int `json:"removed"`
+}
+
+// ClientInfo is the ClientInfo schema of the OpenAPI document
+type ClientInfo struct {
+	Encrypted      bool      `json:"encrypted"`
+	IP             string    `json:"ip"`
+	JoinedAt       time.Time `json:"joined_at"`
+	LoggedIn       bool      `json:"logged_in"`
+	QueuedBytes    int64     `json:"queued_bytes"`
+	QueuedMessages int       `json:"queued_messages"`
+	Role           string    `json:"role"`
+	Room           string    `json:"room"`
+	UserAgent      string    `json:"user_agent,omitempty"`
+	Username       string    `json:"username"`
+}
+
+// EraseResult is the EraseResult schema of the OpenAPI document
+type EraseResult struct {
+	Account  bool   `json:"account"`
+	Messages int    `json:"messages"`
+	Mode     string `json:"mode"`
+	User     string `json:"user"`
+}
+
+// Message is the Message schema of the OpenAPI document
+type Message struct {
+	From string    `json:"from"`
+	ID   int64     `json:"id"`
+	Room string    `json:"room"`
+	Text string    `json:"text"`
+	Time time.Time `json:"time"`
+	To   string    `json:"to,omitempty"`
+}
+
+// PostMessageRequest is the PostMessageRequest schema of the OpenAPI document
+type PostMessageRequest struct {
+	From string `json:"from,omitempty"`
+	Text string `json:"text"`
+}
+
+// RoomInfo is the RoomInfo schema of the OpenAPI document
+type RoomInfo struct {
+	Members int    `json:"members"`
+	Name    string `json:"name"`
+}
+
+// Stats is the Stats schema of the OpenAPI document
+type Stats struct {
+	Bans              int        `json:"bans"`
+	Clients           int        `json:"clients"`
+	Connections       int64      `json:"connections"`
+	Guests            int        `json:"guests"`
+	MaxClients        int        `json:"max_clients"`
+	Messages          int64      `json:"messages"`
+	MessagesPerSecond float64    `json:"messages_per_second"`
+	PeakClients       int        `json:"peak_clients"`
+	PeakClientsAt     time.Time  `json:"peak_clients_at"`
+	RemoteClients     int        `json:"remote_clients"`
+	RoomMembers       []RoomInfo `json:"room_members"`
+	Rooms             int        `json:"rooms"`
+	Shadowbans        int        `json:"shadowbans"`
+	StartedAt         time.Time  `json:"started_at"`
+	UptimeSeconds     int64      `json:"uptime_seconds"`
+}
+
+// AddBanParams are the query parameters of AddBan
+type AddBanParams struct {
+	// Username to ban
+	User string
+	// IP address to ban
+	IP string
+	// Reason given to the banned user
+	Reason string
+	// How long the ban lasts, e.g. 24h or 7d; permanent if not given
+	Duration string
+}
+
+// AddBan calls POST /admin/bans: Ban a username, an IP address or both,
+// disconnecting them
+func (c *Client) AddBan(ctx context.Context, params AddBanParams) (Ban, error) {
+	query := url.Values{}
+	if params.User != "" {
+		query.Set("user", params.User)
+	}
+	if params.IP != "" {
+		query.Set("ip", params.IP)
+	}
+	if params.Reason != "" {
+		query.Set("reason", params.Reason)
+	}
+	if params.Duration != "" {
+		query.Set("duration", params.Duration)
+	}
+	var result Ban
+	err := c.do(ctx, http.MethodPost, "/admin/bans", query, nil, &result)
+	return result, err
+}
+
+// AddShadowbanParams are the query parameters of AddShadowban
+type AddShadowbanParams struct {
+	// Username (required)
+	User string
+}
+
+// AddShadowban calls POST /admin/shadowbans: Shadowban a user
+func (c *Client) AddShadowban(ctx context.Context, params AddShadowbanParams) error {
+	query := url.Values{}
+	if params.User != "" {
+		query.Set("user", params.User)
+	}
+	return c.do(ctx, http.MethodPost, "/admin/shadowbans", query, nil, nil)
+}
+
+// AnnounceParams are the query parameters of Announce
+type AnnounceParams struct {
+	// Notice (required)
+	Text string
+}
+
+// Announce calls POST /admin/announce: Send a highlighted notice to
+// everyone on the server
+func (c *Client) Announce(ctx context.Context, params AnnounceParams) error {
+	query := url.Values{}
+	if params.Text != "" {
+		query.Set("text", params.Text)
+	}
+	return c.do(ctx, http.MethodPost, "/admin/announce", query, nil, nil)
+}
+
+// DisconnectClientParams are the query parameters of DisconnectClient
+type DisconnectClientParams struct {
+	// Username (required)
+	User string
+	// Reason sent in the close frame
+	Reason string
+}
+
+// DisconnectClient calls POST /admin/disconnect: Quietly close a user's
+// connection
+func (c *Client) DisconnectClient(ctx context.Context, params DisconnectClientParams) error {
+	query := url.Values{}
+	if params.User != "" {
+		query.Set("user", params.User)
+	}
+	if params.Reason != "" {
+		query.Set("reason", params.Reason)
+	}
+	return c.do(ctx, http.MethodPost, "/admin/disconnect", query, nil, nil)
+}
+
+// EraseUserParams are the query parameters of EraseUser
+type EraseUserParams struct {
+	// Username (required)
+	User string
+	// What to do with their messages, delete by default
+	Mode string
+}
+
+// EraseUser calls POST /admin/erase: Delete or anonymize everything stored
+// about a user
+func (c *Client) EraseUser(ctx context.Context, params EraseUserParams) (EraseResult, error) {
+	query := url.Values{}
+	if params.User != "" {
+		query.Set("user", params.User)
+	}
+	if params.Mode != "" {
+		query.Set("mode", params.Mode)
+	}
+	var result EraseResult
+	err := c.do(ctx, http.MethodPost, "/admin/erase", query, nil, &result)
+	return result, err
+}
+
+// ExportRoomParams are the query parameters of ExportRoom
+type ExportRoomParams struct {
+	// Room name, the default room if not given
+	Room string
+	// Export format, json by default
+	Format string
+}
+
+// ExportRoom calls GET /admin/export: Export a room's history as a JSON
+// array of messages or as CSV
+func (c *Client) ExportRoom(ctx context.Context, params ExportRoomParams) ([]byte, error) {
+	query := url.Values{}
+	if params.Room != "" {
+		query.Set("room", params.Room)
+	}
+	if params.Format != "" {
+		query.Set("format", params.Format)
+	}
+	return c.raw(ctx, http.MethodGet, "/admin/export", query)
+}
+
+// GetStats calls GET /admin/stats: Show the server's statistics
+func (c *Client) GetStats(ctx context.Context) (Stats, error) {
+	var result Stats
+	err := c.do(ctx, http.MethodGet, "/admin/stats", nil, nil, &result)
+	return result, err
+}
+
+// KickClientParams are the query parameters of KickClient
+type KickClientParams struct {
+	// Username (required)
+	User string
+	// Reason given to everyone
+	Reason string
+}
+
+// KickClient calls DELETE /admin/clients: Kick a user, telling them and
+// everyone else why
+func (c *Client) KickClient(ctx context.Context, params KickClientParams) error {
+	query := url.Values{}
+	if params.User != "" {
+		query.Set("user", params.User)
+	}
+	if params.Reason != "" {
+		query.Set("reason", params.Reason)
+	}
+	return c.do(ctx, http.MethodDelete, "/admin/clients", query, nil, nil)
+}
+
+// ListAuditEventsParams are the query parameters of ListAuditEvents
+type ListAuditEventsParams struct {
+	// Most events to return, 100 by default
+	Limit int
+}
+
+// ListAuditEvents calls GET /admin/audit: List the latest security audit
+// events, oldest first
+func (c *Client) ListAuditEvents(ctx context.Context, params ListAuditEventsParams) ([]AuditEvent, error) {
+	query := url.Values{}
+	if params.Limit != 0 {
+		query.Set("limit", strconv.Itoa(params.Limit))
+	}
+	var result []AuditEvent
+	err := c.do(ctx, http.MethodGet, "/admin/audit", query, nil, &result)
+	return result, err
+}
+
+// ListBans calls GET /admin/bans: List the active bans
+func (c *Client) ListBans(ctx context.Context) ([]Ban, error) {
+	var result []Ban
+	err := c.do(ctx, http.MethodGet, "/admin/bans", nil, nil, &result)
+	return result, err
+}
+
+// ListClients calls GET /admin/clients: List the clients connected to this
+// instance
+func (c *Client) ListClients(ctx context.Context) ([]ClientInfo, error) {
+	var result []ClientInfo
+	err := c.do(ctx, http.MethodGet, "/admin/clients", nil, nil, &result)
+	return result, err
+}
+
+// ListMessagesParams are the query parameters of ListMessages
+type ListMessagesParams struct {
+	// Most messages to return, 50 by default and at most 1000
+	Limit int
+	// Only return messages before this message ID
+	Before int64
+}
+
+// ListMessages calls GET /api/rooms/{room}/messages: List a room's latest
+// messages, oldest first, or those before a message ID
+func (c *Client) ListMessages(ctx context.Context, room string, params ListMessagesParams) ([]Message, error) {
+	query := url.Values{}
+	if params.Limit != 0 {
+		query.Set("limit", strconv.Itoa(params.Limit))
+	}
+	if params.Before != 0 {
+		query.Set("before", strconv.FormatInt(params.Before, 10))
+	}
+	var result []Message
+	err := c.do(ctx, http.MethodGet, "/api/rooms/"+url.PathEscape(room)+"/messages", query, nil, &result)
+	return result, err
+}
+
+// ListRooms calls GET /api/rooms: List the rooms and how many users are in
+// each
+func (c *Client) ListRooms(ctx context.Context) ([]RoomInfo, error) {
+	var result []RoomInfo
+	err := c.do(ctx, http.MethodGet, "/api/rooms", nil, nil, &result)
+	return result, err
+}
+
+// ListShadowbans calls GET /admin/shadowbans: List the shadowbanned users
+func (c *Client) ListShadowbans(ctx context.Context) ([]string, error) {
+	var result []string
+	err := c.do(ctx, http.MethodGet, "/admin/shadowbans", nil, nil, &result)
+	return result, err
+}
+
+// ListUsersParams are the query parameters of ListUsers
+type ListUsersParams struct {
+	// Only list the users in this room
+	Room string
+}
+
+// ListUsers calls GET /api/users: List the users connected here and to
+// other instances
+func (c *Client) ListUsers(ctx context.Context, params ListUsersParams) ([]APIUser, error) {
+	query := url.Values{}
+	if params.Room != "" {
+		query.Set("room", params.Room)
+	}
+	var result []APIUser
+	err := c.do(ctx, http.MethodGet, "/api/users", query, nil, &result)
+	return result, err
+}
+
+// PostMessage calls POST /api/rooms/{room}/messages: Post a message to a
+// room as the caller, or as from for the admin and callers whose
+// credentials don't fix their username
+func (c *Client) PostMessage(ctx context.Context, room string, body PostMessageRequest) error {
+	return c.do(ctx, http.MethodPost, "/api/rooms/"+url.PathEscape(room)+"/messages", nil, body, nil)
+}
+
+// RemoveBansParams are the query parameters of RemoveBans
+type RemoveBansParams struct {
+	// Username to unban
+	User string
+	// IP address to unban
+	IP string
+}
+
+// RemoveBans calls DELETE /admin/bans: Lift the bans on a username or IP
+// address
+func (c *Client) RemoveBans(ctx context.Context, params RemoveBansParams) (BansRemoved, error) {
+	query := url.Values{}
+	if params.User != "" {
+		query.Set("user", params.User)
+	}
+	if params.IP != "" {
+		query.Set("ip", params.IP)
+	}
+	var result BansRemoved
+	err := c.do(ctx, http.MethodDelete, "/admin/bans", query, nil, &result)
+	return result, err
+}
+
+// RemoveShadowbanParams are the query parameters of RemoveShadowban
+type RemoveShadowbanParams struct {
+	// Username (required)
+	User string
+}
+
+// RemoveShadowban calls DELETE /admin/shadowbans: Lift a shadowban
+func (c *Client) RemoveShadowban(ctx context.Context, params RemoveShadowbanParams) error {
+	query := url.Values{}
+	if params.User != "" {
+		query.Set("user", params.User)
+	}
+	return c.do(ctx, http.MethodDelete, "/admin/shadowbans", query, nil, nil)
+}
+
+// SendMessageParams are the query parameters of SendMessage
+type SendMessageParams struct {
+	// Username to send to
+	User string
+	// Room to send to
+	Room string
+	// Message (required)
+	Text string
+}
+
+// SendMessage calls POST /admin/messages: Send a server message to one
+// user, one room, or everyone as a system notice
+func (c *Client) SendMessage(ctx context.Context, params SendMessageParams) error {
+	query := url.Values{}
+	if params.User != "" {
+		query.Set("user", params.User)
+	}
+	if params.Room != "" {
+		query.Set("room", params.Room)
+	}
+	if params.Text != "" {
+		query.Set("text", params.Text)
+	}
+	return c.do(ctx, http.MethodPost, "/admin/messages", query, nil, nil)
+}